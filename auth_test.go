@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// requestWithAuth makes a request with the Authorization header set to auth, if not empty,
+// and returns the response with its body closed
+func requestWithAuth(t *testing.T, method, url, auth string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestAPITokenRequired(t *testing.T) {
+	server := newTestServer(t, func(s *Server) {
+		s.apiToken = "api-secret"
+		s.adminToken = "admin-secret"
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		auth   string
+		want   int
+	}{
+		{"no token", http.MethodGet, "/api/conversations", "", http.StatusUnauthorized},
+		{"wrong token", http.MethodGet, "/api/conversations", "Bearer wrong", http.StatusUnauthorized},
+		{"token without scheme", http.MethodGet, "/api/conversations", "api-secret", http.StatusUnauthorized},
+		{"basic scheme", http.MethodGet, "/api/conversations", "Basic api-secret", http.StatusUnauthorized},
+		{"API token", http.MethodGet, "/api/conversations", "Bearer api-secret", http.StatusOK},
+		{"admin token", http.MethodGet, "/api/conversations", "Bearer admin-secret", http.StatusOK},
+		{"health check without token", http.MethodGet, "/healthz", "", http.StatusOK},
+		{"admin endpoint without token", http.MethodPost, "/api/admin/vacuum", "", http.StatusUnauthorized},
+		{"admin endpoint with API token", http.MethodPost, "/api/admin/vacuum", "Bearer api-secret", http.StatusForbidden},
+		{"admin endpoint with admin token", http.MethodPost, "/api/admin/vacuum", "Bearer admin-secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := requestWithAuth(t, tt.method, server.URL+tt.path, tt.auth)
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			if resp.StatusCode == http.StatusUnauthorized && strings.HasPrefix(tt.path, "/api/conversations") &&
+				resp.Header.Get("WWW-Authenticate") == "" {
+				t.Error("401 response lacks WWW-Authenticate")
+			}
+		})
+	}
+}
+
+func TestAPIOpenWithoutToken(t *testing.T) {
+	server := newTestServer(t, nil)
+
+	if resp := requestWithAuth(t, http.MethodGet, server.URL+"/api/conversations", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d without a configured token, want 200", resp.StatusCode)
+	}
+	// Admin endpoints stay disabled
+	if resp := requestWithAuth(t, http.MethodPost, server.URL+"/api/admin/vacuum", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("admin endpoint status = %d without an admin token, want 403", resp.StatusCode)
+	}
+}
+
+func TestWebSocketRequiresToken(t *testing.T) {
+	server := newTestServer(t, func(s *Server) { s.apiToken = "api-secret" })
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws"
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil {
+		t.Fatal("WebSocket connected without a token")
+	}
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("handshake response = %v, want 401", resp)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Authorization": {"Bearer api-secret"}})
+	if err != nil {
+		t.Fatalf("WebSocket with the token: %v", err)
+	}
+	conn.Close()
+}
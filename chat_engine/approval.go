@@ -0,0 +1,307 @@
+package chat_engine
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// With tool approval enabled, a round of tool calls that includes a tool able to change
+// something is not run right away. The turn pauses after the assistant message requesting
+// the calls, and SendUserMessageWithOptions returns an *ApprovalRequiredError. The calls
+// awaiting approval are the unanswered tool calls of the conversation's last assistant
+// message, so they survive a restart. Once every one of them has been approved or rejected
+// with DecideToolCall, the round runs and the turn continues like before the pause. Calls
+// left undecided past the approval timeout are rejected, and canceling a paused turn with
+// CancelTurn answers its calls as not executed without resuming the turn.
+
+// approvalFreeTools only read and never need approval
+var approvalFreeTools = map[string]bool{
+	"read_file":          true,
+	"search_code":        true,
+	"list_processes":     true,
+	"get_process_output": true,
+	"conversation_info":  true,
+}
+
+// ErrToolCallNotPending is returned when deciding on a tool call that is not awaiting approval
+var ErrToolCallNotPending = errors.New("tool call is not awaiting approval")
+
+// ApprovalRequiredError is returned together with the turn's messages when the turn paused
+// because tool calls need approval
+type ApprovalRequiredError struct {
+	ToolCalls []ToolCall
+}
+
+func (err *ApprovalRequiredError) Error() string {
+	names := make([]string, len(err.ToolCalls))
+	for i, toolCall := range err.ToolCalls {
+		names[i] = toolCall.Name
+	}
+	return fmt.Sprintf("waiting for approval of %d tool call(s): %s", len(err.ToolCalls), strings.Join(names, ", "))
+}
+
+// WithToolApproval makes tool calls that may change something wait for approval
+func WithToolApproval(enabled bool) Option {
+	return func(e *ChatEngine) {
+		e.toolApproval = enabled
+	}
+}
+
+// WithApprovalTimeout rejects tool calls that are still awaiting approval timeout after the
+// turn paused for them, and the turn continues as if the user had rejected them. 0, the
+// default, waits for a decision indefinitely. Calls that were awaiting approval before a
+// restart don't time out.
+func WithApprovalTimeout(timeout time.Duration) Option {
+	return func(e *ChatEngine) {
+		e.approvalTimeout = timeout
+	}
+}
+
+// requiresApproval reports whether a tool call may only run once approved
+func (e *ChatEngine) requiresApproval(toolCall ToolCall) bool {
+	return e.toolApproval && !approvalFreeTools[toolCall.Name]
+}
+
+// awaitingApproval returns the tool calls of a round that need a decision before the round
+// can run. Ephemeral turns can't be resumed, so they never wait.
+func (e *ChatEngine) awaitingApproval(conv *Conversation, toolCalls []ToolCall, allowedTools toolFilter, decisions map[string]bool) []ToolCall {
+	if conv.ephemeral {
+		return nil
+	}
+	var waiting []ToolCall
+	for _, toolCall := range toolCalls {
+		// Calls of tools that are not allowed aren't run either way
+		if _, decided := decisions[toolCall.ID]; !decided && allowedTools.allows(toolCall.Name) && e.requiresApproval(toolCall) {
+			waiting = append(waiting, toolCall)
+		}
+	}
+	return waiting
+}
+
+// rejectionOutput returns the tool output for a call that may not run for lack of approval,
+// or "" when it may run
+func (e *ChatEngine) rejectionOutput(conv *Conversation, toolCall ToolCall, decisions map[string]bool) string {
+	if !e.requiresApproval(toolCall) || decisions[toolCall.ID] {
+		return ""
+	}
+	if conv.ephemeral {
+		return fmt.Sprintf("Not executed: %s needs approval, which is not available for ephemeral messages.", toolCall.Name)
+	}
+	return "Not executed: the user rejected this tool call."
+}
+
+// PendingToolCalls returns the tool calls of a conversation that are awaiting a decision
+func (e *ChatEngine) PendingToolCalls(conversationID string) []ToolCall {
+	conv := e.GetConversation(conversationID)
+	if conv == nil {
+		return nil
+	}
+
+	e.approvalMutex.Lock()
+	defer e.approvalMutex.Unlock()
+	return e.awaitingApproval(conv, e.unansweredToolCalls(conv), e.turnTools(conv, SendOptions{}), e.toolDecisions[conversationID])
+}
+
+// DecideToolCall approves or rejects a tool call awaiting approval. While other calls of the
+// round are still undecided it returns an *ApprovalRequiredError listing them. Once all are
+// decided the round runs, rejected calls answered as not executed, and the turn continues;
+// the new messages are returned as by SendUserMessageWithOptions, including an
+// *ApprovalRequiredError if the turn paused again.
+func (e *ChatEngine) DecideToolCall(conversationID, toolCallID string, approved bool, opts SendOptions) ([]*Message, error) {
+	conv := e.GetConversation(conversationID)
+	if conv == nil {
+		return nil, fmt.Errorf("conversation %s not found", conversationID)
+	}
+
+	e.approvalMutex.Lock()
+	if e.resumingConversations[conversationID] {
+		e.approvalMutex.Unlock()
+		return nil, ErrToolCallNotPending
+	}
+	round := e.unansweredToolCalls(conv)
+	found := false
+	for _, toolCall := range round {
+		if toolCall.ID == toolCallID && e.requiresApproval(toolCall) {
+			found = true
+		}
+	}
+	if !found {
+		e.approvalMutex.Unlock()
+		return nil, ErrToolCallNotPending
+	}
+
+	decisions := e.toolDecisions[conversationID]
+	if decisions == nil {
+		decisions = make(map[string]bool)
+		e.toolDecisions[conversationID] = decisions
+	}
+	decisions[toolCallID] = approved
+	allowedTools := e.turnTools(conv, opts)
+	if waiting := e.awaitingApproval(conv, round, allowedTools, decisions); len(waiting) > 0 {
+		e.approvalMutex.Unlock()
+		return make([]*Message, 0), &ApprovalRequiredError{ToolCalls: waiting}
+	}
+	delete(e.toolDecisions, conversationID)
+	e.resumingConversations[conversationID] = true
+	e.approvalMutex.Unlock()
+
+	defer func() {
+		e.approvalMutex.Lock()
+		delete(e.resumingConversations, conversationID)
+		e.approvalMutex.Unlock()
+	}()
+
+	ctx, endTurn := e.beginTurn(conversationID, opts.RequestID)
+	defer endTurn()
+
+	logger := opts.turnLogger(conv)
+	logger.Info("All tool calls decided, resuming turn")
+	messages, err := e.executeLLMRequestedToolCalls(ctx, conv, round, opts.Callback, opts.OnDelta, opts.OnToolStart, opts.ResponseFormat, e.sampling.merge(opts.Sampling), allowedTools, decisions, logger)
+	e.saveTurnMessages(conv, logger)
+	e.notifyTurnEnded(conv, messages, err)
+	return messages, err
+}
+
+// scheduleApprovalTimeout rejects the calls of a round that paused for approval which are
+// still undecided once the approval timeout passed
+func (e *ChatEngine) scheduleApprovalTimeout(conversationID string, waiting []ToolCall) {
+	if e.approvalTimeout <= 0 {
+		return
+	}
+
+	e.approvalMutex.Lock()
+	defer e.approvalMutex.Unlock()
+	if e.approvalTimersStopped {
+		return
+	}
+	if timer := e.approvalTimers[conversationID]; timer != nil {
+		timer.Stop()
+	}
+	e.approvalTimers[conversationID] = time.AfterFunc(e.approvalTimeout, func() {
+		e.expireApprovals(conversationID, waiting)
+	})
+}
+
+// expireApprovals rejects the calls of waiting that are still awaiting approval. Rejecting
+// the last undecided call of the round resumes the turn.
+func (e *ChatEngine) expireApprovals(conversationID string, waiting []ToolCall) {
+	pending := make(map[string]bool)
+	for _, toolCall := range e.PendingToolCalls(conversationID) {
+		pending[toolCall.ID] = true
+	}
+
+	for _, toolCall := range waiting {
+		if !pending[toolCall.ID] {
+			continue
+		}
+		slog.Info("Tool call approval timed out, rejecting it", "conversation_id", conversationID, "tool_call_id", toolCall.ID, "timeout", e.approvalTimeout)
+		_, err := e.DecideToolCall(conversationID, toolCall.ID, false, SendOptions{})
+		var approvalErr *ApprovalRequiredError
+		if err != nil && !errors.As(err, &approvalErr) {
+			slog.Warn("Failed to reject tool call after approval timeout", "conversation_id", conversationID, "tool_call_id", toolCall.ID, "error", err)
+		}
+	}
+}
+
+// stopApprovalTimers stops pending approval timeouts, none start afterwards
+func (e *ChatEngine) stopApprovalTimers() {
+	e.approvalMutex.Lock()
+	defer e.approvalMutex.Unlock()
+	e.approvalTimersStopped = true
+	for _, timer := range e.approvalTimers {
+		timer.Stop()
+	}
+	clear(e.approvalTimers)
+}
+
+// cancelPausedTurn answers the tool calls of a conversation whose turn paused for approval as
+// not executed, so it no longer waits for a decision. It reports whether the conversation
+// was waiting.
+func (e *ChatEngine) cancelPausedTurn(conversationID string) bool {
+	conv := e.GetConversation(conversationID)
+	if conv == nil {
+		return false
+	}
+
+	e.approvalMutex.Lock()
+	if e.resumingConversations[conversationID] {
+		e.approvalMutex.Unlock()
+		return false
+	}
+	waiting := e.awaitingApproval(conv, e.unansweredToolCalls(conv), e.turnTools(conv, SendOptions{}), e.toolDecisions[conversationID])
+	if len(waiting) == 0 {
+		e.approvalMutex.Unlock()
+		return false
+	}
+	e.resumingConversations[conversationID] = true
+	e.approvalMutex.Unlock()
+
+	defer func() {
+		e.approvalMutex.Lock()
+		delete(e.resumingConversations, conversationID)
+		e.approvalMutex.Unlock()
+	}()
+
+	logger := slog.Default().With("conversation_id", conversationID)
+	logger.Info("Canceled turn waiting for approval", "tool_calls", len(waiting))
+	e.answerUnansweredToolCalls(conv, "Not executed: the user canceled the turn.", nil, logger)
+	e.saveTurnMessages(conv, logger)
+	return true
+}
+
+// unansweredToolCalls returns the tool calls of the last assistant message that have no
+// tool response yet
+func (e *ChatEngine) unansweredToolCalls(conv *Conversation) []ToolCall {
+	e.conversationsMutex.RLock()
+	defer e.conversationsMutex.RUnlock()
+
+	answered := make(map[string]bool)
+	for i := len(conv.Messages) - 1; i >= 0; i-- {
+		msg := conv.Messages[i]
+		if msg.Role == "tool" {
+			answered[msg.TollCallID] = true
+			continue
+		}
+		if msg.Role != "assistant" {
+			return nil
+		}
+
+		var unanswered []ToolCall
+		for _, toolCall := range msg.ToolCalls {
+			if !answered[toolCall.ID] {
+				unanswered = append(unanswered, toolCall)
+			}
+		}
+		return unanswered
+	}
+	return nil
+}
+
+// answerUnansweredToolCalls records tool calls left without a response, e.g. still awaiting
+// approval, as not executed with output, so that a new user message can follow them
+func (e *ChatEngine) answerUnansweredToolCalls(conv *Conversation, output string, callback MessageUpdateCallback, logger *slog.Logger) []*Message {
+	unanswered := e.unansweredToolCalls(conv)
+
+	e.approvalMutex.Lock()
+	delete(e.toolDecisions, conv.ID)
+	e.approvalMutex.Unlock()
+
+	newMessages := make([]*Message, 0, len(unanswered))
+	for _, toolCall := range unanswered {
+		toolMessage := Message{
+			ID:         fmt.Sprintf("msg_%d", time.Now().UnixNano()),
+			Role:       "tool",
+			Content:    output,
+			TollCallID: toolCall.ID,
+		}
+		e.addTurnMessage(conv, &toolMessage)
+		newMessages = append(newMessages, &toolMessage)
+		if callback != nil {
+			callback(&toolMessage)
+		}
+	}
+	return newMessages
+}
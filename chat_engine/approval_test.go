@@ -0,0 +1,203 @@
+package chat_engine
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// pauseForApproval sends a message to which the model replies with calls of the count tool,
+// and checks that the turn paused for them
+func pauseForApproval(t *testing.T, engine *ChatEngine, tool *countingTool) []ToolCall {
+	t.Helper()
+	_, err := engine.SendUserMessage("conv", "count")
+	var approvalErr *ApprovalRequiredError
+	if !errors.As(err, &approvalErr) {
+		t.Fatalf("SendUserMessage returned %v, want an ApprovalRequiredError", err)
+	}
+	if got := tool.calls.Load(); got != 0 {
+		t.Fatalf("tool ran %d times before it was approved", got)
+	}
+	return approvalErr.ToolCalls
+}
+
+// toolOutputs returns the content of the tool messages by tool call ID
+func toolOutputs(messages []*Message) map[string]string {
+	outputs := make(map[string]string)
+	for _, msg := range messages {
+		if msg.Role == "tool" {
+			outputs[msg.TollCallID] = msg.Content
+		}
+	}
+	return outputs
+}
+
+func TestApprovedToolCallRuns(t *testing.T) {
+	tool := &countingTool{name: "count"}
+	provider := newFakeProvider(toolCallReply("call_1", "count", `{}`), textReply("done"))
+	engine := newTestEngine(t, provider, WithTool(tool), WithToolApproval(true))
+
+	waiting := pauseForApproval(t, engine, tool)
+	if len(waiting) != 1 || waiting[0].ID != "call_1" {
+		t.Fatalf("waiting for %+v, want call_1", waiting)
+	}
+	if pending := engine.PendingToolCalls("conv"); len(pending) != 1 {
+		t.Fatalf("%d tool calls pending, want 1", len(pending))
+	}
+
+	messages, err := engine.DecideToolCall("conv", "call_1", true, SendOptions{})
+	if err != nil {
+		t.Fatalf("DecideToolCall: %v", err)
+	}
+	if got := tool.calls.Load(); got != 1 {
+		t.Errorf("tool ran %d times, want 1", got)
+	}
+	if output := toolOutputs(messages)["call_1"]; output != "counted" {
+		t.Errorf("tool output is %q, want counted", output)
+	}
+	if last := messages[len(messages)-1]; last.Content != "done" {
+		t.Errorf("resumed turn ended with %q, want the reply", last.Content)
+	}
+	if pending := engine.PendingToolCalls("conv"); len(pending) != 0 {
+		t.Errorf("%d tool calls still pending", len(pending))
+	}
+	if _, err := engine.DecideToolCall("conv", "call_1", true, SendOptions{}); !errors.Is(err, ErrToolCallNotPending) {
+		t.Errorf("deciding again returned %v, want ErrToolCallNotPending", err)
+	}
+}
+
+func TestRejectedToolCallDoesNotRun(t *testing.T) {
+	tool := &countingTool{name: "count"}
+	provider := newFakeProvider(toolCallReply("call_1", "count", `{}`), textReply("ok, I won't"))
+	engine := newTestEngine(t, provider, WithTool(tool), WithToolApproval(true))
+	pauseForApproval(t, engine, tool)
+
+	messages, err := engine.DecideToolCall("conv", "call_1", false, SendOptions{})
+	if err != nil {
+		t.Fatalf("DecideToolCall: %v", err)
+	}
+	if got := tool.calls.Load(); got != 0 {
+		t.Errorf("rejected tool ran %d times", got)
+	}
+	if got := engine.GetConversation("conv").ToolCallCount; got != 0 {
+		t.Errorf("rejected tool call was counted, tool call count is %d", got)
+	}
+	if output := toolOutputs(messages)["call_1"]; output != "Not executed: the user rejected this tool call." {
+		t.Errorf("tool output is %q, want the rejection", output)
+	}
+	// The model is told and replies
+	if last := messages[len(messages)-1]; last.Role != "assistant" || last.Content != "ok, I won't" {
+		t.Errorf("resumed turn ended with %s %q, want the reply", last.Role, last.Content)
+	}
+}
+
+func TestRoundRunsOnceEveryCallIsDecided(t *testing.T) {
+	tool := &countingTool{name: "count"}
+	provider := newFakeProvider(
+		&Message{Role: "assistant", ToolCalls: []ToolCall{
+			{ID: "call_1", Type: "function", Name: "count", Arguments: `{"n": 1}`},
+			{ID: "call_2", Type: "function", Name: "count", Arguments: `{"n": 2}`},
+		}},
+		textReply("done"),
+	)
+	engine := newTestEngine(t, provider, WithTool(tool), WithToolApproval(true))
+	if waiting := pauseForApproval(t, engine, tool); len(waiting) != 2 {
+		t.Fatalf("waiting for %d tool calls, want 2", len(waiting))
+	}
+
+	_, err := engine.DecideToolCall("conv", "call_1", true, SendOptions{})
+	var approvalErr *ApprovalRequiredError
+	if !errors.As(err, &approvalErr) || len(approvalErr.ToolCalls) != 1 || approvalErr.ToolCalls[0].ID != "call_2" {
+		t.Fatalf("first decision returned %v, want to wait for call_2", err)
+	}
+	if got := tool.calls.Load(); got != 0 {
+		t.Fatalf("tool ran %d times before the round was decided", got)
+	}
+
+	messages, err := engine.DecideToolCall("conv", "call_2", false, SendOptions{})
+	if err != nil {
+		t.Fatalf("DecideToolCall: %v", err)
+	}
+	outputs := toolOutputs(messages)
+	if outputs["call_1"] != "counted" || outputs["call_2"] != "Not executed: the user rejected this tool call." {
+		t.Errorf("tool outputs are %v, want call_1 run and call_2 rejected", outputs)
+	}
+}
+
+func TestApprovalTimesOut(t *testing.T) {
+	tool := &countingTool{name: "count"}
+	provider := newFakeProvider(toolCallReply("call_1", "count", `{}`), textReply("nobody answered"))
+	engine := newTestEngine(t, provider, WithTool(tool), WithToolApproval(true), WithApprovalTimeout(50*time.Millisecond))
+	pauseForApproval(t, engine, tool)
+
+	// The turn continues on its own once the call was rejected
+	if !waitFor(5*time.Second, func() bool { return len(provider.Requests()) == 2 && !engine.TurnRunning("conv") }) {
+		t.Fatal("turn didn't continue after the approval timeout")
+	}
+	if got := tool.calls.Load(); got != 0 {
+		t.Errorf("tool ran %d times without approval", got)
+	}
+	if pending := engine.PendingToolCalls("conv"); len(pending) != 0 {
+		t.Errorf("%d tool calls still pending", len(pending))
+	}
+	messages := engine.GetConversation("conv").Messages
+	if output := toolOutputs(messages)["call_1"]; output != "Not executed: the user rejected this tool call." {
+		t.Errorf("tool output is %q, want the rejection", output)
+	}
+	if last := messages[len(messages)-1]; last.Content != "nobody answered" {
+		t.Errorf("conversation ends with %q, want the reply", last.Content)
+	}
+}
+
+func TestCancelTurnWaitingForApproval(t *testing.T) {
+	tool := &countingTool{name: "count"}
+	provider := newFakeProvider(toolCallReply("call_1", "count", `{}`), textReply("done"))
+	engine := newTestEngine(t, provider, WithTool(tool), WithToolApproval(true))
+	pauseForApproval(t, engine, tool)
+
+	if err := engine.CancelTurn("conv", false); err != nil {
+		t.Fatalf("CancelTurn: %v", err)
+	}
+	if pending := engine.PendingToolCalls("conv"); len(pending) != 0 {
+		t.Errorf("%d tool calls still pending", len(pending))
+	}
+	if _, err := engine.DecideToolCall("conv", "call_1", true, SendOptions{}); !errors.Is(err, ErrToolCallNotPending) {
+		t.Errorf("approving a canceled call returned %v, want ErrToolCallNotPending", err)
+	}
+	if got := tool.calls.Load(); got != 0 {
+		t.Errorf("tool ran %d times", got)
+	}
+	// Neither resumed nor asked again
+	if got := len(provider.Requests()); got != 1 {
+		t.Errorf("model was asked %d times, want 1", got)
+	}
+
+	stored, err := engine.db.LoadConversation("conv")
+	if err != nil {
+		t.Fatalf("LoadConversation: %v", err)
+	}
+	if output := toolOutputs(stored.Messages)["call_1"]; output != "Not executed: the user canceled the turn." {
+		t.Errorf("stored tool output is %q, want the cancellation", output)
+	}
+	if err := engine.CancelTurn("conv", false); !errors.Is(err, ErrNoActiveTurn) {
+		t.Errorf("canceling again returned %v, want ErrNoActiveTurn", err)
+	}
+}
+
+func TestNewMessageDropsPendingApproval(t *testing.T) {
+	tool := &countingTool{name: "count"}
+	provider := newFakeProvider(toolCallReply("call_1", "count", `{}`), textReply("never mind then"))
+	engine := newTestEngine(t, provider, WithTool(tool), WithToolApproval(true))
+	pauseForApproval(t, engine, tool)
+
+	messages, err := engine.SendUserMessage("conv", "don't count")
+	if err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if output := toolOutputs(messages)["call_1"]; output != "Not executed: the user sent a new message instead of approving this tool call." {
+		t.Errorf("tool output is %q, want the call dropped", output)
+	}
+	if got := tool.calls.Load(); got != 0 {
+		t.Errorf("tool ran %d times", got)
+	}
+}
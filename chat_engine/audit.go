@@ -0,0 +1,148 @@
+package chat_engine
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// CommandAuditEntry records a command run by the bash_command or shell tool
+type CommandAuditEntry struct {
+	ID             int64  `json:"id"`
+	ConversationID string `json:"conversation_id"`
+	Tool           string `json:"tool"`
+	Command        string `json:"command"`
+	WorkingDir     string `json:"working_dir"`
+	Background     bool   `json:"background"`
+	// PID of background commands
+	PID int `json:"pid,omitempty"`
+	// Nil while a background command is running, or when the command could not be started
+	ExitCode *int   `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+	// How long the command ran; for background commands only known once they exited
+	DurationMS int64     `json:"duration_ms"`
+	StartedAt  time.Time `json:"started_at"`
+	// ID of the request whose turn ran the command, if it had one
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// CommandAuditPage is one page of the command audit log
+type CommandAuditPage struct {
+	Entries []CommandAuditEntry `json:"entries"`
+	Total   int                 `json:"total"`
+	Limit   int                 `json:"limit"`
+	Offset  int                 `json:"offset"`
+}
+
+// auditFunc records a command in the audit log and sets the entry's ID
+type auditFunc func(entry *CommandAuditEntry)
+
+// commandAuditor returns the auditFunc for commands the tool runs in conv during the turn of ctx
+func (e *ChatEngine) commandAuditor(ctx context.Context, conv *Conversation, tool string, logger *slog.Logger) auditFunc {
+	requestID := ToolRequestID(ctx)
+	return func(entry *CommandAuditEntry) {
+		entry.ConversationID = conv.ID
+		entry.RequestID = requestID
+		entry.Tool = tool
+		if err := e.db.RecordCommand(entry); err != nil {
+			logger.Error("Failed to record command in audit log", "command", entry.Command, "error", err)
+		}
+	}
+}
+
+// CommandAudit returns up to limit audit log entries starting at offset, most recent first.
+// With a conversation ID only the commands of that conversation are listed.
+func (e *ChatEngine) CommandAudit(conversationID string, limit, offset int) (*CommandAuditPage, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive")
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("offset must not be negative")
+	}
+
+	entries, total, err := e.db.ListCommandAudit(conversationID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return &CommandAuditPage{
+		Entries: entries,
+		Total:   total,
+		Limit:   limit,
+		Offset:  offset,
+	}, nil
+}
+
+// RecordCommand adds an entry to the command audit log and sets its ID
+func (d *DB) RecordCommand(entry *CommandAuditEntry) error {
+	result, err := d.db.Exec(`
+		INSERT INTO command_audit (conversation_id, request_id, tool, command, working_dir, background, pid, exit_code, error, duration_ms, started_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, entry.ConversationID, entry.RequestID, entry.Tool, entry.Command, entry.WorkingDir, entry.Background, entry.PID,
+		entry.ExitCode, entry.Error, entry.DurationMS, entry.StartedAt.UTC().Format(sqliteMilliTimeFormat))
+	if err != nil {
+		return fmt.Errorf("failed to record command: %w", err)
+	}
+
+	entry.ID, err = result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get audit entry ID: %w", err)
+	}
+	return nil
+}
+
+// FinishAuditedCommand records the exit code and run time of a background command
+func (d *DB) FinishAuditedCommand(id int64, exitCode int, duration time.Duration) error {
+	_, err := d.db.Exec(`UPDATE command_audit SET exit_code = ?, duration_ms = ? WHERE id = ?`,
+		exitCode, duration.Milliseconds(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update audit entry %d: %w", id, err)
+	}
+	return nil
+}
+
+// ListCommandAudit returns a page of the command audit log, most recent first, and the number
+// of entries in total. An empty conversation ID lists the commands of all conversations.
+func (d *DB) ListCommandAudit(conversationID string, limit, offset int) ([]CommandAuditEntry, int, error) {
+	var total int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM command_audit WHERE ? = '' OR conversation_id = ?`,
+		conversationID, conversationID).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to count audit entries: %w", err)
+	}
+
+	rows, err := d.db.Query(`
+		SELECT id, conversation_id, request_id, tool, command, working_dir, background, pid, exit_code, error, duration_ms, started_at
+		FROM command_audit
+		WHERE ? = '' OR conversation_id = ?
+		ORDER BY id DESC
+		LIMIT ? OFFSET ?
+	`, conversationID, conversationID, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query audit entries: %w", err)
+	}
+	defer rows.Close()
+
+	entries := make([]CommandAuditEntry, 0)
+	for rows.Next() {
+		var entry CommandAuditEntry
+		var exitCode sql.NullInt64
+		err := rows.Scan(&entry.ID, &entry.ConversationID, &entry.RequestID, &entry.Tool, &entry.Command, &entry.WorkingDir,
+			&entry.Background, &entry.PID, &exitCode, &entry.Error, &entry.DurationMS, &entry.StartedAt)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to scan audit entry: %w", err)
+		}
+		if exitCode.Valid {
+			code := int(exitCode.Int64)
+			entry.ExitCode = &code
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating audit entries: %w", err)
+	}
+
+	return entries, total, nil
+}
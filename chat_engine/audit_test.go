@@ -0,0 +1,46 @@
+package chat_engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCommandsAreAudited(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")))
+	callTool(t, engine, "conv", "bash_command", `{"command": "sleep 0.2; exit 3"}`)
+	callTool(t, engine, "conv", "bash_command", `{"command": "sleep 0.2; exit 5", "background": true}`)
+	callTool(t, engine, "other", "bash_command", `{"command": "true"}`)
+
+	// auditEntries returns the entries of conv, oldest first
+	auditEntries := func() []CommandAuditEntry {
+		t.Helper()
+		page, err := engine.CommandAudit("conv", 10, 0)
+		if err != nil {
+			t.Fatalf("CommandAudit: %v", err)
+		}
+		entries := page.Entries
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+		return entries
+	}
+	if !waitFor(5*time.Second, func() bool {
+		entries := auditEntries()
+		return len(entries) == 2 && entries[1].ExitCode != nil
+	}) {
+		t.Fatalf("background command was not audited as finished: %+v", auditEntries())
+	}
+
+	entries := auditEntries()
+	foreground, background := entries[0], entries[1]
+	if foreground.Tool != "bash_command" || foreground.Command != "sleep 0.2; exit 3" || foreground.Background ||
+		foreground.WorkingDir != engine.WorkingDir("conv") || foreground.StartedAt.IsZero() {
+		t.Errorf("foreground entry is %+v", foreground)
+	}
+	if foreground.ExitCode == nil || *foreground.ExitCode != 3 || foreground.DurationMS < 200 {
+		t.Errorf("foreground command exited with %v after %dms, want 3 after at least 200ms", foreground.ExitCode, foreground.DurationMS)
+	}
+	if !background.Background || background.PID == 0 || *background.ExitCode != 5 || background.DurationMS < 200 {
+		t.Errorf("background entry is %+v, want its PID and exit code 5 after at least 200ms", background)
+	}
+}
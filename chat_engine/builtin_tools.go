@@ -0,0 +1,707 @@
+package chat_engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/openai/openai-go/v2"
+)
+
+// Definitions of the built-in tools
+var (
+	bashCommandTool = openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
+		Name:        "bash_command",
+		Description: openai.String("Execute a bash command and return the output, preceded by an Exit code line telling whether it succeeded. Use background=true for long-running commands like servers."),
+		Parameters: openai.FunctionParameters{
+			"type": "object",
+			"properties": map[string]any{
+				"command": map[string]string{
+					"type":        "string",
+					"description": "The bash command to execute",
+				},
+				"background": map[string]any{
+					"type":        "boolean",
+					"description": "If true, run the command in the background. Use for long-running commands like servers. Returns process ID instead of output.",
+				},
+				"stdin": map[string]any{
+					"type":        "string",
+					"description": "Text to pipe into the command's standard input, e.g. input for a script or lines to sort. Not supported with background=true.",
+				},
+				"working_dir": map[string]any{
+					"type":        "string",
+					"description": "Directory to run the command in, relative to the conversation's working directory or absolute. Defaults to the conversation's working directory.",
+				},
+			},
+			"required": []string{"command"},
+		},
+	})
+	shellTool = openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
+		Name: "shell",
+		Description: openai.String("Run a command in a persistent bash session that belongs to this conversation. " +
+			"Unlike bash_command, state such as the current directory, exported variables and activated virtualenvs " +
+			"persists between calls. Not suitable for interactive programs or servers, use bash_command with background=true for those."),
+		Parameters: openai.FunctionParameters{
+			"type": "object",
+			"properties": map[string]any{
+				"command": map[string]string{
+					"type":        "string",
+					"description": "The command to run in the session",
+				},
+				"reset": map[string]any{
+					"type":        "boolean",
+					"description": "If true, discard the current session and start a fresh one before running the command",
+				},
+			},
+			"required": []string{"command"},
+		},
+	})
+	listProcessesTool = openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
+		Name:        "list_processes",
+		Description: openai.String("List all currently running background processes started by bash_command"),
+		Parameters: openai.FunctionParameters{
+			"type":       "object",
+			"properties": map[string]any{},
+		},
+	})
+	getProcessOutputTool = openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
+		Name:        "get_process_output",
+		Description: openai.String("Get the recent output (stdout and stderr) of a background process started by bash_command, also available shortly after it exited"),
+		Parameters: openai.FunctionParameters{
+			"type": "object",
+			"properties": map[string]any{
+				"pid": map[string]any{
+					"type":        "integer",
+					"description": "The process ID (PID) of the background process",
+				},
+			},
+			"required": []string{"pid"},
+		},
+	})
+	killProcessTool = openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
+		Name:        "kill_process",
+		Description: openai.String("Kill a background process by its process ID (PID)"),
+		Parameters: openai.FunctionParameters{
+			"type": "object",
+			"properties": map[string]any{
+				"pid": map[string]any{
+					"type":        "integer",
+					"description": "The process ID (PID) to kill",
+				},
+			},
+			"required": []string{"pid"},
+		},
+	})
+	stopBackgroundCommandTool = openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
+		Name:        "stop_background_command",
+		Description: openai.String("Stop a background process started in this conversation, given either its PID or part of its command line (for example \"npm run dev\" or \"http.server\"). Fails listing the candidates when the text matches several processes."),
+		Parameters: openai.FunctionParameters{
+			"type": "object",
+			"properties": map[string]any{
+				"pid": map[string]any{
+					"type":        "integer",
+					"description": "The process ID (PID) to stop",
+				},
+				"match": map[string]any{
+					"type":        "string",
+					"description": "Text contained in the command of the process to stop, used instead of pid",
+				},
+			},
+		},
+	})
+	killConversationProcessesTool = openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
+		Name:        "kill_conversation_processes",
+		Description: openai.String("Kill all background processes started in this conversation, for example to clean up servers before finishing a task. Also resets the persistent shell session."),
+		Parameters: openai.FunctionParameters{
+			"type":       "object",
+			"properties": map[string]any{},
+		},
+	})
+	httpGetTool = openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
+		Name: "http_get",
+		Description: openai.String("Fetch a URL with an HTTP GET request and return the response status, content type and body. " +
+			"Prefer this over curl for reading web pages and APIs. Long bodies are truncated."),
+		Parameters: openai.FunctionParameters{
+			"type": "object",
+			"properties": map[string]any{
+				"url": map[string]any{
+					"type":        "string",
+					"description": "The http or https URL to fetch",
+				},
+				"headers": map[string]any{
+					"type":                 "object",
+					"description":          "Request headers to send, e.g. Accept",
+					"additionalProperties": map[string]string{"type": "string"},
+				},
+			},
+			"required": []string{"url"},
+		},
+	})
+	webSearchTool = openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
+		Name:        "web_search",
+		Description: openai.String("Search the web and return the titles, URLs and snippets of the top results. Use http_get to read a result."),
+		Parameters: openai.FunctionParameters{
+			"type": "object",
+			"properties": map[string]any{
+				"query": map[string]any{
+					"type":        "string",
+					"description": "The search query",
+				},
+				"count": map[string]any{
+					"type":        "integer",
+					"description": fmt.Sprintf("Number of results, at most %d. Defaults to %d.", maxWebSearchResults, defaultWebSearchResults),
+				},
+			},
+			"required": []string{"query"},
+		},
+	})
+	conversationInfoTool = openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
+		Name:        "conversation_info",
+		Description: openai.String("Get information about this conversation: message and turn counts, tool calls used, time since it started and the remaining tool call budget. Useful to pace long tasks."),
+		Parameters: openai.FunctionParameters{
+			"type":       "object",
+			"properties": map[string]any{},
+		},
+	})
+	readFileTool = openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
+		Name:        "read_file",
+		Description: openai.String("Read a text file and return its contents with line numbers. Prefer this over bash for reading files. Use start_line/end_line to read part of a large file."),
+		Parameters: openai.FunctionParameters{
+			"type": "object",
+			"properties": map[string]any{
+				"path": map[string]any{
+					"type":        "string",
+					"description": "Path of the file to read, relative to the working directory or absolute",
+				},
+				"start_line": map[string]any{
+					"type":        "integer",
+					"description": "First line to return (1-based, inclusive). Defaults to the start of the file.",
+				},
+				"end_line": map[string]any{
+					"type":        "integer",
+					"description": "Last line to return (1-based, inclusive). Defaults to the end of the file.",
+				},
+			},
+			"required": []string{"path"},
+		},
+	})
+	searchCodeTool = openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
+		Name:        "search_code",
+		Description: openai.String("Search files for lines matching a regular expression and return them as path:line:content. Prefer this over grep in bash for finding code. VCS, node_modules and vendor directories and binary files are skipped."),
+		Parameters: openai.FunctionParameters{
+			"type": "object",
+			"properties": map[string]any{
+				"pattern": map[string]any{
+					"type":        "string",
+					"description": "Regular expression (RE2 syntax) to search for",
+				},
+				"path": map[string]any{
+					"type":        "string",
+					"description": "File or directory to search, relative to the working directory or absolute. Defaults to the working directory.",
+				},
+				"file_glob": map[string]any{
+					"type":        "string",
+					"description": "Only search files whose name matches this glob, e.g. *.go. A glob containing / is matched against the path relative to path.",
+				},
+				"ignore_case": map[string]any{
+					"type":        "boolean",
+					"description": "Match case-insensitively",
+				},
+			},
+			"required": []string{"pattern"},
+		},
+	})
+	gitTool = openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
+		Name:        "git",
+		Description: openai.String("Run a git command in the working directory: status, diff, log, add, commit or branch. Prefer this over git in bash. Force options, amending commits and force-deleting branches are refused. Returns the combined output and the exit code."),
+		Parameters: openai.FunctionParameters{
+			"type": "object",
+			"properties": map[string]any{
+				"subcommand": map[string]any{
+					"type":        "string",
+					"enum":        []string{"status", "diff", "log", "add", "commit", "branch"},
+					"description": "The git subcommand to run",
+				},
+				"args": map[string]any{
+					"type":        "array",
+					"items":       map[string]any{"type": "string"},
+					"description": "Arguments after the subcommand, one per element without shell quoting, e.g. [\"-m\", \"Fix the parser\"]",
+				},
+			},
+			"required": []string{"subcommand"},
+		},
+	})
+	writeFileTool = openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
+		Name:        "write_file",
+		Description: openai.String("Write content to a file, replacing it or appending to it. Prefer this over echo or heredocs in bash. Returns the number of bytes written."),
+		Parameters: openai.FunctionParameters{
+			"type": "object",
+			"properties": map[string]any{
+				"path": map[string]any{
+					"type":        "string",
+					"description": "Path of the file to write, relative to the working directory or absolute",
+				},
+				"content": map[string]any{
+					"type":        "string",
+					"description": "The content to write",
+				},
+				"mode": map[string]any{
+					"type":        "string",
+					"enum":        []string{"overwrite", "append"},
+					"description": "overwrite (default) replaces the file, append adds content to its end",
+				},
+				"create_dirs": map[string]any{
+					"type":        "boolean",
+					"description": "If true, create missing parent directories",
+				},
+			},
+			"required": []string{"path", "content"},
+		},
+	})
+	scheduleCommandTool = openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
+		Name: "schedule_command",
+		Description: openai.String("Schedule a bash command to run periodically, every interval_seconds or on a cron expression. " +
+			"The output of every run is added to this conversation. Returns the ID of the schedule."),
+		Parameters: openai.FunctionParameters{
+			"type": "object",
+			"properties": map[string]any{
+				"command": map[string]any{
+					"type":        "string",
+					"description": "The bash command to run",
+				},
+				"interval_seconds": map[string]any{
+					"type":        "integer",
+					"description": fmt.Sprintf("Run every this many seconds, at least %d. Use either this or cron.", int(minScheduleInterval.Seconds())),
+				},
+				"cron": map[string]any{
+					"type":        "string",
+					"description": "Run on a five-field cron expression in the server's time zone, e.g. \"*/15 * * * *\". Use either this or interval_seconds.",
+				},
+				"working_dir": map[string]any{
+					"type":        "string",
+					"description": "Directory to run the command in, relative to the conversation's working directory. Defaults to it.",
+				},
+			},
+			"required": []string{"command"},
+		},
+	})
+	memoryTool = openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
+		Name: "memory",
+		Description: openai.String("Remember facts across conversations, e.g. preferences of the user or details of a project, or recall them. " +
+			"Remembered facts are shown at the start of every conversation. remember stores value under key, replacing what was stored under it; " +
+			"recall returns the facts whose key or value contains query, or all of them without a query."),
+		Parameters: openai.FunctionParameters{
+			"type": "object",
+			"properties": map[string]any{
+				"action": map[string]any{
+					"type":        "string",
+					"enum":        []string{"remember", "recall"},
+					"description": "remember stores a fact, recall looks facts up",
+				},
+				"key": map[string]any{
+					"type":        "string",
+					"description": "Short name of the fact to remember, e.g. preferred_language",
+				},
+				"value": map[string]any{
+					"type":        "string",
+					"description": "The fact to remember",
+				},
+				"query": map[string]any{
+					"type":        "string",
+					"description": "Text to look for in the keys and values of the facts to recall",
+				},
+			},
+			"required": []string{"action"},
+		},
+	})
+	editFileTool = openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
+		Name: "edit_file",
+		Description: openai.String("Edit a file in place. Either replace the exact text `search` with `replace` (search must match exactly once), " +
+			"or apply a unified `diff`. Returns the edited region with line numbers."),
+		Parameters: openai.FunctionParameters{
+			"type": "object",
+			"properties": map[string]any{
+				"path": map[string]any{
+					"type":        "string",
+					"description": "Path of the file to edit, relative to the working directory or absolute",
+				},
+				"search": map[string]any{
+					"type":        "string",
+					"description": "Exact text to find. Include enough surrounding lines to make it unique.",
+				},
+				"replace": map[string]any{
+					"type":        "string",
+					"description": "Text to put in place of search",
+				},
+				"diff": map[string]any{
+					"type":        "string",
+					"description": "A unified diff for this file, used instead of search/replace. Each hunk must match the file exactly once.",
+				},
+			},
+			"required": []string{"path"},
+		},
+	})
+)
+
+// builtinTools returns the tools of every engine, web_search only when a search provider is set
+// and memory only when memory is enabled
+func (e *ChatEngine) builtinTools() []Tool {
+	tools := []Tool{
+		builtinTool{bashCommandTool, e.runBashCommand},
+		builtinTool{shellTool, e.runShell},
+		builtinTool{listProcessesTool, e.runListProcesses},
+		builtinTool{getProcessOutputTool, e.runGetProcessOutput},
+		builtinTool{killProcessTool, e.runKillProcess},
+		builtinTool{stopBackgroundCommandTool, e.runStopBackgroundCommand},
+		builtinTool{killConversationProcessesTool, e.runKillConversationProcesses},
+		builtinTool{httpGetTool, e.runHTTPGet},
+	}
+	if e.webSearch != nil {
+		tools = append(tools, builtinTool{webSearchTool, e.runWebSearch})
+	}
+	tools = append(tools,
+		builtinTool{conversationInfoTool, e.runConversationInfo},
+		builtinTool{readFileTool, e.runReadFile},
+		builtinTool{searchCodeTool, e.runSearchCode},
+		builtinTool{gitTool, e.runGit},
+		builtinTool{writeFileTool, e.runWriteFile},
+		builtinTool{editFileTool, e.runEditFile},
+		builtinTool{scheduleCommandTool, e.runScheduleCommand},
+	)
+	if e.memoryNamespace != "" {
+		tools = append(tools, builtinTool{memoryTool, e.runMemoryTool})
+	}
+	return tools
+}
+
+func (e *ChatEngine) runBashCommand(ctx context.Context, conv *Conversation, rawArgs json.RawMessage, logger *slog.Logger) (string, error) {
+	args, err := parseToolArgs(rawArgs)
+	if err != nil {
+		return "", err
+	}
+	command, ok := args["command"].(string)
+	if !ok {
+		return "", fmt.Errorf("%w: missing the command argument", ErrInvalidToolArguments)
+	}
+
+	workingDir, _ := args["working_dir"].(string)
+	dir, err := e.toolDir(conv, workingDir)
+	if err != nil {
+		return fmt.Sprintf("Error: invalid working_dir: %v", err), nil
+	}
+
+	stdin, _ := args["stdin"].(string)
+
+	// Check if command should run in background
+	background, _ := args["background"].(bool)
+	if background {
+		if stdin != "" {
+			return "Error: stdin can't be used with background=true", nil
+		}
+		return executeBashCommandBackground(command, dir, e.processManager, conv.ID, e.commandAuditor(ctx, conv, "bash_command", logger))
+	}
+	output, err := executeBashCommand(ctx, command, dir, stdin, e.envPolicy.environ(), e.commandTimeout, e.maxCommandOutputBytes, e.commandAuditor(ctx, conv, "bash_command", logger))
+	if err != nil {
+		logger.Warn("Command failed", "command", command, "error", err)
+	}
+	return output, nil
+}
+
+func (e *ChatEngine) runShell(ctx context.Context, conv *Conversation, rawArgs json.RawMessage, logger *slog.Logger) (string, error) {
+	args, err := parseToolArgs(rawArgs)
+	if err != nil {
+		return "", err
+	}
+	command, ok := args["command"].(string)
+	if !ok {
+		return "", fmt.Errorf("%w: missing the command argument", ErrInvalidToolArguments)
+	}
+	if reset, _ := args["reset"].(bool); reset {
+		e.processManager.CloseShell(conv.ID)
+	}
+
+	dir := e.WorkingDir(conv.ID)
+	start := time.Now()
+	output, exitCode, err := e.processManager.RunInShell(ctx, conv.ID, dir, command, e.commandTimeout)
+	entry := CommandAuditEntry{
+		Command:    command,
+		WorkingDir: dir,
+		DurationMS: time.Since(start).Milliseconds(),
+		StartedAt:  start,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		entry.ExitCode = &exitCode
+	}
+	e.commandAuditor(ctx, conv, "shell", logger)(&entry)
+	output = truncateOutput(output, e.maxCommandOutputBytes)
+	if err != nil {
+		return fmt.Sprintf("%s\n[error: %v]", output, err), nil
+	}
+	return fmt.Sprintf("%s\n[exit code: %d]", output, exitCode), nil
+}
+
+func (e *ChatEngine) runListProcesses(ctx context.Context, conv *Conversation, rawArgs json.RawMessage, logger *slog.Logger) (string, error) {
+	processes := e.processManager.ListProcesses()
+	if len(processes) == 0 {
+		return "No background processes running.", nil
+	}
+	var lines []string
+	for _, proc := range processes {
+		duration := time.Since(proc.StartTime).Round(time.Second)
+		line := fmt.Sprintf("PID: %d | Command: %s | Running for: %s", proc.PID, proc.Command, duration)
+		if proc.Usage != nil {
+			line += " | " + proc.Usage.String()
+		}
+		lines = append(lines, line)
+	}
+	return fmt.Sprintf("Running background processes (%d):\n%s", len(processes), strings.Join(lines, "\n")), nil
+}
+
+func (e *ChatEngine) runGetProcessOutput(ctx context.Context, conv *Conversation, rawArgs json.RawMessage, logger *slog.Logger) (string, error) {
+	args, err := parseToolArgs(rawArgs)
+	if err != nil {
+		return "", err
+	}
+	pidFloat, ok := args["pid"].(float64)
+	if !ok {
+		return "Error: invalid PID", nil
+	}
+	processOutput, err := e.processManager.GetOutput(int(pidFloat))
+	if err != nil {
+		return fmt.Sprintf("Error getting process output: %v", err), nil
+	}
+
+	status := "running"
+	if !processOutput.Running {
+		status = fmt.Sprintf("exited with code %d", *processOutput.ExitCode)
+	}
+	output := fmt.Sprintf("Process %d (%s) is %s.\n", processOutput.PID, processOutput.Command, status)
+	if processOutput.Truncated {
+		output += "[earlier output was dropped, showing the most recent output]\n"
+	}
+	if processOutput.Output == "" {
+		output += "(no output yet)"
+	} else {
+		output += processOutput.Output
+	}
+	return output, nil
+}
+
+func (e *ChatEngine) runKillProcess(ctx context.Context, conv *Conversation, rawArgs json.RawMessage, logger *slog.Logger) (string, error) {
+	args, err := parseToolArgs(rawArgs)
+	if err != nil {
+		return "", err
+	}
+	pidFloat, ok := args["pid"].(float64)
+	if !ok {
+		return "Error: invalid PID", nil
+	}
+	pid := int(pidFloat)
+	if err := e.processManager.KillProcess(pid); err != nil {
+		return fmt.Sprintf("Error killing process: %v", err), nil
+	}
+	return fmt.Sprintf("Successfully killed process %d", pid), nil
+}
+
+func (e *ChatEngine) runStopBackgroundCommand(ctx context.Context, conv *Conversation, rawArgs json.RawMessage, logger *slog.Logger) (string, error) {
+	var args struct {
+		PID   int    `json:"pid"`
+		Match string `json:"match"`
+	}
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidToolArguments, err)
+	}
+	if (args.PID == 0) == (args.Match == "") {
+		return "", fmt.Errorf("%w: exactly one of pid and match is required", ErrInvalidToolArguments)
+	}
+
+	info, err := e.processManager.FindConversationProcess(conv.ID, args.PID, args.Match)
+	if err != nil {
+		return fmt.Sprintf("Error: %v", err), nil
+	}
+	if err := e.processManager.KillProcess(info.PID); err != nil {
+		return fmt.Sprintf("Error stopping process: %v", err), nil
+	}
+	duration := time.Since(info.StartTime).Round(time.Second)
+	return fmt.Sprintf("Stopped process %d (%s) after running for %s", info.PID, info.Command, duration), nil
+}
+
+func (e *ChatEngine) runKillConversationProcesses(ctx context.Context, conv *Conversation, rawArgs json.RawMessage, logger *slog.Logger) (string, error) {
+	killed := e.processManager.KillByConversation(conv.ID)
+	return fmt.Sprintf("Killed %d background process(es) started by this conversation", killed), nil
+}
+
+func (e *ChatEngine) runHTTPGet(ctx context.Context, conv *Conversation, rawArgs json.RawMessage, logger *slog.Logger) (string, error) {
+	var args struct {
+		URL     string            `json:"url"`
+		Headers map[string]string `json:"headers"`
+	}
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidToolArguments, err)
+	}
+	output, err := httpGet(ctx, e.httpClient, args.URL, args.Headers, e.maxHTTPResponseBytes)
+	if err != nil {
+		logger.Info("HTTP request failed", "url", args.URL, "error", err)
+		return fmt.Sprintf("Error fetching %s: %v", args.URL, err), nil
+	}
+	return output, nil
+}
+
+func (e *ChatEngine) runWebSearch(ctx context.Context, conv *Conversation, rawArgs json.RawMessage, logger *slog.Logger) (string, error) {
+	var args struct {
+		Query string `json:"query"`
+		Count int    `json:"count"`
+	}
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidToolArguments, err)
+	}
+	output, err := webSearch(ctx, e.webSearch, args.Query, args.Count)
+	if err != nil {
+		logger.Warn("Web search failed", "query", args.Query, "error", err)
+		return fmt.Sprintf("Error searching the web: %v", err), nil
+	}
+	return output, nil
+}
+
+func (e *ChatEngine) runConversationInfo(ctx context.Context, conv *Conversation, rawArgs json.RawMessage, logger *slog.Logger) (string, error) {
+	infoJSON, err := json.MarshalIndent(e.conversationInfo(conv), "", "  ")
+	if err != nil {
+		return fmt.Sprintf("Error getting conversation info: %v", err), nil
+	}
+	return string(infoJSON), nil
+}
+
+func (e *ChatEngine) runReadFile(ctx context.Context, conv *Conversation, rawArgs json.RawMessage, logger *slog.Logger) (string, error) {
+	args, err := parseToolArgs(rawArgs)
+	if err != nil {
+		return "", err
+	}
+	path, _ := args["path"].(string)
+	startLine, _ := args["start_line"].(float64)
+	endLine, _ := args["end_line"].(float64)
+	output, err := readFile(e.workspaceRoot, e.toolPath(conv, path), int(startLine), int(endLine), e.maxReadFileBytes)
+	if err != nil {
+		return fmt.Sprintf("Error reading file: %v", err), nil
+	}
+	return output, nil
+}
+
+func (e *ChatEngine) runSearchCode(ctx context.Context, conv *Conversation, rawArgs json.RawMessage, logger *slog.Logger) (string, error) {
+	var search codeSearch
+	if err := json.Unmarshal(rawArgs, &search); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidToolArguments, err)
+	}
+	dir := e.WorkingDir(conv.ID)
+	path := dir
+	if search.Path != "" {
+		path = e.toolPath(conv, search.Path)
+	}
+	output, err := searchCode(ctx, e.workspaceRoot, dir, path, search, e.maxSearchResults)
+	if err != nil {
+		return fmt.Sprintf("Error searching code: %v", err), nil
+	}
+	return output, nil
+}
+
+func (e *ChatEngine) runGit(ctx context.Context, conv *Conversation, rawArgs json.RawMessage, logger *slog.Logger) (string, error) {
+	var call gitCall
+	if err := json.Unmarshal(rawArgs, &call); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidToolArguments, err)
+	}
+	if reason := call.check(); reason != "" {
+		return fmt.Sprintf("Error: %s", reason), nil
+	}
+
+	output, err := runGit(ctx, call, e.WorkingDir(conv.ID), e.envPolicy.environ(), e.commandTimeout, e.maxCommandOutputBytes, e.commandAuditor(ctx, conv, "git", logger))
+	if err != nil {
+		logger.Warn("Git command failed", "command", call.commandLine(), "error", err)
+		if output == "" {
+			return fmt.Sprintf("Error: %v", err), nil
+		}
+	}
+	return output, nil
+}
+
+func (e *ChatEngine) runWriteFile(ctx context.Context, conv *Conversation, rawArgs json.RawMessage, logger *slog.Logger) (string, error) {
+	args, err := parseToolArgs(rawArgs)
+	if err != nil {
+		return "", err
+	}
+	path, _ := args["path"].(string)
+	content, _ := args["content"].(string)
+	mode, _ := args["mode"].(string)
+	createDirs, _ := args["create_dirs"].(bool)
+	written, err := writeFile(e.workspaceRoot, e.toolPath(conv, path), content, mode, createDirs)
+	if err != nil {
+		return fmt.Sprintf("Error writing file: %v", err), nil
+	}
+	return fmt.Sprintf("Wrote %d bytes to %s", written, path), nil
+}
+
+func (e *ChatEngine) runEditFile(ctx context.Context, conv *Conversation, rawArgs json.RawMessage, logger *slog.Logger) (string, error) {
+	args, err := parseToolArgs(rawArgs)
+	if err != nil {
+		return "", err
+	}
+	path, _ := args["path"].(string)
+	search, _ := args["search"].(string)
+	replace, _ := args["replace"].(string)
+	diff, _ := args["diff"].(string)
+
+	edits := []fileEdit{{old: search, new: replace}}
+	if diff != "" {
+		edits, err = parseUnifiedDiff(diff)
+	}
+	var output string
+	if err == nil {
+		output, err = editFile(e.workspaceRoot, e.toolPath(conv, path), edits)
+	}
+	if err != nil {
+		return fmt.Sprintf("Error editing file: %v", err), nil
+	}
+	return output, nil
+}
+
+func (e *ChatEngine) runScheduleCommand(ctx context.Context, conv *Conversation, rawArgs json.RawMessage, logger *slog.Logger) (string, error) {
+	var args struct {
+		Command         string `json:"command"`
+		IntervalSeconds int64  `json:"interval_seconds"`
+		Cron            string `json:"cron"`
+		WorkingDir      string `json:"working_dir"`
+	}
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidToolArguments, err)
+	}
+	if conv.ephemeral {
+		return "Error: commands can't be scheduled from ephemeral messages.", nil
+	}
+	dir, err := e.toolDir(conv, args.WorkingDir)
+	if err != nil {
+		return fmt.Sprintf("Error: invalid working_dir: %v", err), nil
+	}
+
+	schedule, err := e.ScheduleCommand(conv.ID, args.Command, dir, args.IntervalSeconds, strings.TrimSpace(args.Cron))
+	if err != nil {
+		return fmt.Sprintf("Error: %v", err), nil
+	}
+	logger.Info("Scheduled command", "schedule_id", schedule.ID, "command", schedule.Command)
+	return fmt.Sprintf("Scheduled %s, next run at %s.", schedule.ID, schedule.NextRunAt.Format(time.RFC3339)), nil
+}
+
+func (e *ChatEngine) runMemoryTool(ctx context.Context, conv *Conversation, rawArgs json.RawMessage, logger *slog.Logger) (string, error) {
+	var args struct {
+		Action string `json:"action"`
+		Key    string `json:"key"`
+		Value  string `json:"value"`
+		Query  string `json:"query"`
+	}
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidToolArguments, err)
+	}
+	return e.runMemory(args.Action, args.Key, args.Value, args.Query), nil
+}
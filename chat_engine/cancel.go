@@ -0,0 +1,91 @@
+package chat_engine
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+// ErrTurnCanceled is returned together with the messages produced so far when a turn was
+// stopped with CancelTurn
+var ErrTurnCanceled = errors.New("turn canceled")
+
+// ErrNoActiveTurn is returned by CancelTurn when no turn of the conversation is running
+var ErrNoActiveTurn = errors.New("no turn is running in this conversation")
+
+// ErrTurnRunning is returned for changes that can't be made while a turn of the conversation
+// is running
+var ErrTurnRunning = errors.New("a turn is running in this conversation")
+
+// activeTurn is a running turn that can be canceled
+type activeTurn struct {
+	cancel context.CancelCauseFunc
+}
+
+// beginTurn registers a running turn of a conversation. The returned context, which carries
+// the ID of the request that started the turn, is canceled with ErrTurnCanceled by
+// CancelTurn; end must be called once the turn is over.
+func (e *ChatEngine) beginTurn(conversationID, requestID string) (ctx context.Context, end func()) {
+	ctx, cancel := context.WithCancelCause(context.WithValue(context.Background(), requestIDKey{}, requestID))
+	turn := &activeTurn{cancel: cancel}
+
+	e.activeTurnsMutex.Lock()
+	e.activeTurns[conversationID] = append(e.activeTurns[conversationID], turn)
+	e.activeTurnsMutex.Unlock()
+
+	return ctx, func() {
+		e.activeTurnsMutex.Lock()
+		turns := e.activeTurns[conversationID]
+		for i, t := range turns {
+			if t == turn {
+				turns = append(turns[:i], turns[i+1:]...)
+				break
+			}
+		}
+		if len(turns) == 0 {
+			delete(e.activeTurns, conversationID)
+		} else {
+			e.activeTurns[conversationID] = turns
+		}
+		e.activeTurnsMutex.Unlock()
+		cancel(nil)
+	}
+}
+
+// CancelTurn stops the running turns of a conversation. A foreground command that is running
+// is killed, and the turn ends once the current completion request or tool call returned.
+// A turn paused for approval ends with its tool calls answered as not executed. With
+// killProcesses the background processes and the shell session of the conversation are
+// killed as well. It returns ErrNoActiveTurn when no turn is running or paused.
+func (e *ChatEngine) CancelTurn(conversationID string, killProcesses bool) error {
+	e.activeTurnsMutex.Lock()
+	turns := e.activeTurns[conversationID]
+	for _, turn := range turns {
+		turn.cancel(ErrTurnCanceled)
+	}
+	e.activeTurnsMutex.Unlock()
+
+	if len(turns) == 0 && !e.cancelPausedTurn(conversationID) {
+		return ErrNoActiveTurn
+	}
+	slog.Info("Canceled turn", "conversation_id", conversationID, "kill_processes", killProcesses)
+
+	if killProcesses {
+		killed := e.processManager.KillByConversation(conversationID)
+		slog.Info("Killed processes of canceled turn", "conversation_id", conversationID, "processes", killed)
+	}
+	return nil
+}
+
+// TurnRunning reports whether a turn of the conversation is running
+func (e *ChatEngine) TurnRunning(conversationID string) bool {
+	return e.turnRunning(conversationID)
+}
+
+// turnCanceled returns ErrTurnCanceled once the turn's context was canceled, nil otherwise
+func turnCanceled(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return nil
+}
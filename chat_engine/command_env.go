@@ -0,0 +1,87 @@
+package chat_engine
+
+import (
+	"os"
+	"path"
+	"strings"
+)
+
+// DefaultBlockedEnv are the patterns of environment variables the server is likely to hold
+// secrets in, like OPENAI_API_KEY or AGENT_ADMIN_TOKEN. They are matched against the upper
+// case name of a variable.
+var DefaultBlockedEnv = []string{
+	"*API_KEY*",
+	"*ACCESS_KEY*",
+	"*PRIVATE_KEY*",
+	"*SECRET*",
+	"*TOKEN*",
+	"*PASSWORD*",
+	"*PASSWD*",
+	"*CREDENTIAL*",
+	"DATABASE_URL",
+}
+
+// EnvPolicy decides which environment variables of the server are passed to the commands the
+// model runs: bash_command, shell, git, scheduled and background commands. Patterns are shell
+// globs like PATH or LC_*, matched against variable names ignoring case.
+type EnvPolicy struct {
+	// Allow, when not empty, lists the only variables that are passed
+	Allow []string
+	// Block lists variables that are never passed, even when allowed
+	Block []string
+	// Set are variables set for every command, replacing inherited ones. They are passed
+	// regardless of Allow and Block.
+	Set map[string]string
+}
+
+// DefaultEnvPolicy passes the server's environment without the variables matching
+// DefaultBlockedEnv
+func DefaultEnvPolicy() *EnvPolicy {
+	return &EnvPolicy{Block: DefaultBlockedEnv}
+}
+
+// WithEnvPolicy sets which environment variables commands get, see EnvPolicy. Defaults to
+// DefaultEnvPolicy, nil passes the whole environment of the server.
+func WithEnvPolicy(policy *EnvPolicy) Option {
+	return func(e *ChatEngine) {
+		e.envPolicy = policy
+	}
+}
+
+// environ filters the server's environment by the policy. The result is never nil, as a nil
+// exec.Cmd.Env inherits everything; a nil policy returns nil for just that.
+func (p *EnvPolicy) environ() []string {
+	if p == nil {
+		return nil
+	}
+
+	env := make([]string, 0)
+	for _, entry := range os.Environ() {
+		name, _, _ := strings.Cut(entry, "=")
+		if _, ok := p.Set[name]; ok {
+			continue
+		}
+		if len(p.Allow) > 0 && !matchesEnvPattern(p.Allow, name) {
+			continue
+		}
+		if matchesEnvPattern(p.Block, name) {
+			continue
+		}
+		env = append(env, entry)
+	}
+	for name, value := range p.Set {
+		env = append(env, name+"="+value)
+	}
+	return env
+}
+
+// matchesEnvPattern tells whether name matches one of patterns, ignoring case
+func matchesEnvPattern(patterns []string, name string) bool {
+	name = strings.ToUpper(name)
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.ToUpper(pattern), name); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package chat_engine
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvPolicyEnviron(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "sk-secret")
+	t.Setenv("AGENT_ADMIN_TOKEN", "admin-secret")
+	t.Setenv("Db_Password", "hunter2")
+	t.Setenv("DATABASE_URL", "postgres://user:pass@db/agent")
+	t.Setenv("LC_TEST_LOCALE", "C")
+	t.Setenv("AGENT_TEST_VISIBLE", "visible")
+
+	tests := []struct {
+		name   string
+		policy *EnvPolicy
+		want   []string
+		absent []string
+	}{
+		{
+			name:   "default blocks secrets",
+			policy: DefaultEnvPolicy(),
+			want:   []string{"LC_TEST_LOCALE=C", "AGENT_TEST_VISIBLE=visible"},
+			absent: []string{"OPENAI_API_KEY", "AGENT_ADMIN_TOKEN", "Db_Password", "DATABASE_URL"},
+		},
+		{
+			name:   "allow list",
+			policy: &EnvPolicy{Allow: []string{"lc_*", "OPENAI_API_KEY"}, Block: DefaultBlockedEnv},
+			want:   []string{"LC_TEST_LOCALE=C"},
+			absent: []string{"OPENAI_API_KEY", "AGENT_TEST_VISIBLE", "PATH"},
+		},
+		{
+			name:   "set replaces inherited",
+			policy: &EnvPolicy{Block: DefaultBlockedEnv, Set: map[string]string{"AGENT_TEST_VISIBLE": "replaced", "GIT_TOKEN": "given"}},
+			want:   []string{"AGENT_TEST_VISIBLE=replaced", "GIT_TOKEN=given"},
+			absent: []string{"AGENT_TEST_VISIBLE=visible", "OPENAI_API_KEY"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := tt.policy.environ()
+			for _, entry := range tt.want {
+				if !slices.Contains(env, entry) {
+					t.Errorf("environment lacks %s", entry)
+				}
+			}
+			for _, absent := range tt.absent {
+				for _, entry := range env {
+					if entry == absent || strings.HasPrefix(entry, absent+"=") {
+						t.Errorf("environment contains %s", entry)
+					}
+				}
+			}
+		})
+	}
+
+	var policy *EnvPolicy
+	if env := policy.environ(); env != nil {
+		t.Errorf("a nil policy returned %d variables, want nil to inherit everything", len(env))
+	}
+}
+
+func TestCommandsDontSeeSecrets(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "sk-secret")
+	t.Setenv("AGENT_TEST_VISIBLE", "visible")
+
+	provider := newFakeProvider(
+		toolCallReply("call_env", "bash_command", `{"command": "env"}`),
+		textReply("done"),
+	)
+	engine := newTestEngine(t, provider)
+
+	messages, err := engine.SendUserMessage("conv", "show the environment")
+	if err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	output := toolOutputs(messages)["call_env"]
+	if !strings.Contains(output, "AGENT_TEST_VISIBLE=visible") {
+		t.Errorf("command output lacks an allowed variable:\n%s", output)
+	}
+	if strings.Contains(output, "sk-secret") {
+		t.Errorf("command output contains the API key:\n%s", output)
+	}
+}
+
+func TestShellSessionsDontSeeSecrets(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "sk-secret")
+	t.Setenv("AGENT_TEST_VISIBLE", "visible")
+
+	pm := newTestProcessManager(t)
+	pm.SetEnvPolicy(DefaultEnvPolicy())
+	output, _, err := pm.RunInShell(context.Background(), "conv", t.TempDir(), "env", 10*time.Second)
+	if err != nil {
+		t.Fatalf("RunInShell: %v", err)
+	}
+	if !strings.Contains(output, "AGENT_TEST_VISIBLE=visible") {
+		t.Errorf("shell output lacks an allowed variable:\n%s", output)
+	}
+	if strings.Contains(output, "sk-secret") {
+		t.Errorf("shell output contains the API key:\n%s", output)
+	}
+}
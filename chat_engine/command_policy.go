@@ -0,0 +1,149 @@
+package chat_engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// CommandPolicyMode decides whether command policy patterns allow or block commands
+type CommandPolicyMode string
+
+const (
+	// CommandPolicyAllowlist only runs commands whose every simple command matches a pattern
+	CommandPolicyAllowlist CommandPolicyMode = "allowlist"
+	// CommandPolicyBlocklist refuses commands where the whole command line or any simple
+	// command in it matches a pattern
+	CommandPolicyBlocklist CommandPolicyMode = "blocklist"
+)
+
+// ParseCommandPolicyMode validates a command policy mode name
+func ParseCommandPolicyMode(s string) (CommandPolicyMode, error) {
+	switch mode := CommandPolicyMode(s); mode {
+	case CommandPolicyAllowlist, CommandPolicyBlocklist:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown command policy mode %q", s)
+	}
+}
+
+// CommandPolicy restricts the commands bash_command, shell and schedule_command may run. A
+// command line is split into simple commands at ;, &&, ||, pipes, subshells and command
+// substitutions, and leading variable assignments and wrappers such as sudo or env are
+// dropped, so the patterns see e.g. "rm -rf build" for "cd x && sudo rm -rf build". Patterns
+// are unanchored regular expressions, start them with ^ to match a command prefix.
+type CommandPolicy struct {
+	Mode     CommandPolicyMode
+	Patterns []*regexp.Regexp
+}
+
+// NewCommandPolicy compiles the patterns of a command policy
+func NewCommandPolicy(mode CommandPolicyMode, exprs []string) (*CommandPolicy, error) {
+	policy := &CommandPolicy{Mode: mode}
+	for _, expr := range exprs {
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid command pattern %q: %w", expr, err)
+		}
+		policy.Patterns = append(policy.Patterns, pattern)
+	}
+	return policy, nil
+}
+
+// ReadCommandPatterns reads command policy patterns from a file, one per line. Empty lines
+// and lines starting with # are skipped.
+func ReadCommandPatterns(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open command patterns: %w", err)
+	}
+	defer file.Close()
+
+	var exprs []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		exprs = append(exprs, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read command patterns: %w", err)
+	}
+	return exprs, nil
+}
+
+// WithCommandPolicy restricts the commands tools may run, nil allows every command
+func WithCommandPolicy(policy *CommandPolicy) Option {
+	return func(e *ChatEngine) {
+		e.commandPolicy = policy
+	}
+}
+
+// Check returns why a command is not allowed, or "" when it may run
+func (p *CommandPolicy) Check(command string) string {
+	switch p.Mode {
+	case CommandPolicyBlocklist:
+		if pattern := p.match(strings.TrimSpace(command)); pattern != nil {
+			return fmt.Sprintf("matches blocked pattern %s", pattern)
+		}
+		for _, words := range simpleCommands(command) {
+			if pattern := p.match(strings.Join(words, " ")); pattern != nil {
+				return fmt.Sprintf("matches blocked pattern %s", pattern)
+			}
+		}
+	case CommandPolicyAllowlist:
+		for _, words := range simpleCommands(command) {
+			simple := strings.Join(words, " ")
+			if p.match(simple) == nil {
+				return fmt.Sprintf("%q is not on the allowlist", simple)
+			}
+		}
+	}
+	return ""
+}
+
+// match returns the first pattern matching s
+func (p *CommandPolicy) match(s string) *regexp.Regexp {
+	for _, pattern := range p.Patterns {
+		if pattern.MatchString(s) {
+			return pattern
+		}
+	}
+	return nil
+}
+
+// commandPolicyViolation returns the message for a command tool call the command policy
+// doesn't allow, or "" when the call may run
+func (e *ChatEngine) commandPolicyViolation(toolCall ToolCall) string {
+	if e.commandPolicy == nil {
+		return ""
+	}
+
+	var command string
+	switch toolCall.Name {
+	case "bash_command", "shell", "schedule_command":
+		var args map[string]interface{}
+		if err := json.Unmarshal([]byte(toolCall.Arguments), &args); err != nil {
+			return ""
+		}
+		command, _ = args["command"].(string)
+	case "git":
+		// Checked as the equivalent command line
+		var call gitCall
+		if err := json.Unmarshal([]byte(toolCall.Arguments), &call); err != nil {
+			return ""
+		}
+		command = call.commandLine()
+	default:
+		return ""
+	}
+	if reason := e.commandPolicy.Check(command); reason != "" {
+		return fmt.Sprintf("Command blocked by policy: %s. Use a different command.", reason)
+	}
+	return ""
+}
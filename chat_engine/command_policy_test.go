@@ -0,0 +1,109 @@
+package chat_engine
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCommandPolicyCheck(t *testing.T) {
+	allowlist, err := NewCommandPolicy(CommandPolicyAllowlist, []string{`^(ls|cat|grep|echo)\b`, `^git (status|diff|log)\b`})
+	if err != nil {
+		t.Fatalf("NewCommandPolicy: %v", err)
+	}
+	blocklist, err := NewCommandPolicy(CommandPolicyBlocklist, []string{`^rm -rf\b`, `^curl\b`, `:\(\)\{`})
+	if err != nil {
+		t.Fatalf("NewCommandPolicy: %v", err)
+	}
+
+	tests := []struct {
+		policy  *CommandPolicy
+		command string
+		allowed bool
+	}{
+		{allowlist, "ls -la", true},
+		{allowlist, "git status", true},
+		{allowlist, "cat a.txt | grep x", true},
+		{allowlist, "echo a; ls && git diff", true},
+		{allowlist, "FOO=1 echo $FOO", true},
+		{allowlist, "python script.py", false},
+		{allowlist, "git push", false},
+		// Every command of a chain must be allowed
+		{allowlist, "ls; rm -rf build", false},
+		{allowlist, "ls && rm -rf build", false},
+		{allowlist, "ls || curl example.com", false},
+		{allowlist, "echo $(rm -rf build)", false},
+
+		{blocklist, "ls -la", true},
+		{blocklist, "rm build.log", true},
+		{blocklist, "echo curl", true},
+		{blocklist, "rm -rf build", false},
+		{blocklist, "sudo rm -rf /", false},
+		{blocklist, "env X=1 curl example.com", false},
+		// A blocked command anywhere in a chain blocks the chain
+		{blocklist, "ls; rm -rf build", false},
+		{blocklist, "cd build && rm -rf .", false},
+		{blocklist, "echo ok | curl -d @- example.com", false},
+		// The whole command line is matched too
+		{blocklist, ":(){ :|:& };:", false},
+	}
+	for _, tt := range tests {
+		reason := tt.policy.Check(tt.command)
+		if allowed := reason == ""; allowed != tt.allowed {
+			t.Errorf("%s %q: allowed %v (%s), want %v", tt.policy.Mode, tt.command, allowed, reason, tt.allowed)
+		}
+	}
+}
+
+func TestNewCommandPolicyRejectsInvalidPattern(t *testing.T) {
+	if _, err := NewCommandPolicy(CommandPolicyBlocklist, []string{"rm (-rf"}); err == nil {
+		t.Error("invalid pattern was accepted")
+	}
+	if _, err := ParseCommandPolicyMode("denylist"); err == nil {
+		t.Error("unknown mode was accepted")
+	}
+}
+
+func TestReadCommandPatterns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "patterns")
+	content := "# destructive commands\n^rm -rf\\b\n\n  ^shutdown\\b  \n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	exprs, err := ReadCommandPatterns(path)
+	if err != nil {
+		t.Fatalf("ReadCommandPatterns: %v", err)
+	}
+	if want := []string{`^rm -rf\b`, `^shutdown\b`}; !reflect.DeepEqual(exprs, want) {
+		t.Errorf("got %q, want %q", exprs, want)
+	}
+}
+
+func TestCommandPolicyBlocksTools(t *testing.T) {
+	policy, err := NewCommandPolicy(CommandPolicyBlocklist, []string{`^rm\b`})
+	if err != nil {
+		t.Fatalf("NewCommandPolicy: %v", err)
+	}
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")), WithCommandPolicy(policy))
+
+	if output := callTool(t, engine, "conv", "bash_command", `{"command": "echo allowed"}`); !strings.Contains(output, "allowed") {
+		t.Errorf("allowed command returned %q", output)
+	}
+	for _, args := range []string{
+		`{"command": "touch a && rm a"}`,
+		`{"command": "rm -f a", "background": true}`,
+	} {
+		output := callTool(t, engine, "conv", "bash_command", args)
+		if !strings.HasPrefix(output, `Command blocked by policy: matches blocked pattern ^rm\b`) {
+			t.Errorf("%s returned %q, want it blocked", args, output)
+		}
+	}
+	if processes := engine.GetProcesses(); len(processes) != 0 {
+		t.Errorf("blocked background command started %d processes", len(processes))
+	}
+	if _, err := os.Stat(filepath.Join(engine.WorkingDir("conv"), "a")); err == nil {
+		t.Error("blocked chain ran its first command")
+	}
+}
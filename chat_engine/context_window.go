@@ -0,0 +1,187 @@
+package chat_engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/openai/openai-go/v2"
+)
+
+const (
+	// defaultContextBudget is the prompt token budget of models without a known budget
+	defaultContextBudget = 100_000
+	// messageTokenOverhead approximates the tokens a message costs beyond its content
+	messageTokenOverhead = 4
+	// charsPerToken approximates how much text a token holds
+	charsPerToken = 4
+)
+
+// modelContextBudgets are the prompt token budgets of known models, leaving room for the
+// reply within the context window. Models are matched by the longest known prefix, like
+// modelPrices.
+var modelContextBudgets = map[string]int{
+	"gpt-5":   272_000,
+	"gpt-4.1": 1_000_000,
+	"gpt-4o":  120_000,
+}
+
+// ErrContextWindowExceeded is returned when a request doesn't fit the model's context budget
+// even after trimming, because the system prompt and the latest message alone are too large
+var ErrContextWindowExceeded = errors.New("the conversation does not fit the model's context window")
+
+// ModelReporter is implemented by providers that know which model serves requests without
+// a Model, so the engine can apply that model's context budget
+type ModelReporter interface {
+	DefaultModel() string
+}
+
+// WithContextBudget sets how many prompt tokens are sent to model. Older messages are left
+// out of requests that would exceed it. An empty model sets the budget of models without a
+// budget of their own. A budget of 0 disables trimming.
+func WithContextBudget(model string, tokens int) Option {
+	return func(e *ChatEngine) {
+		if e.contextBudgets == nil {
+			e.contextBudgets = make(map[string]int)
+		}
+		e.contextBudgets[model] = tokens
+	}
+}
+
+// contextBudget returns the prompt token budget of model, 0 when unlimited
+func (e *ChatEngine) contextBudget(model string) int {
+	if model == "" {
+		if reporter, ok := e.provider.(ModelReporter); ok {
+			model = reporter.DefaultModel()
+		}
+	}
+
+	for _, budgets := range []map[string]int{e.contextBudgets, modelContextBudgets} {
+		matched := ""
+		budget, found := 0, false
+		for name, tokens := range budgets {
+			if name != "" && strings.HasPrefix(model, name) && len(name) > len(matched) {
+				matched, budget, found = name, tokens, true
+			}
+		}
+		if found {
+			return budget
+		}
+	}
+	if budget, ok := e.contextBudgets[""]; ok {
+		return budget
+	}
+	return defaultContextBudget
+}
+
+// contextMessages returns the messages of conv sent to model along with tools, including
+// remembered facts, trimmed to the model's context budget
+func (e *ChatEngine) contextMessages(conv *Conversation, model string, tools []openai.ChatCompletionToolUnionParam) []*Message {
+	memory := e.memoryMessage()
+	budget := e.contextBudget(model)
+	if budget <= 0 {
+		return withMemory(conv.modelMessages(), memory)
+	}
+	budget -= toolTokens(tools)
+	if memory != nil {
+		budget -= EstimateTokens(memory)
+	}
+	return withMemory(conv.TrimToBudget(budget), memory)
+}
+
+// checkContextBudget returns ErrContextWindowExceeded when messages and tools, as returned
+// by contextMessages, exceed the context budget of model
+func (e *ChatEngine) checkContextBudget(model string, messages []*Message, tools []openai.ChatCompletionToolUnionParam) error {
+	budget := e.contextBudget(model)
+	if budget <= 0 {
+		return nil
+	}
+	tokens := toolTokens(tools)
+	for _, msg := range messages {
+		tokens += EstimateTokens(msg)
+	}
+	if tokens > budget {
+		return fmt.Errorf("%w: about %d tokens, the budget is %d", ErrContextWindowExceeded, tokens, budget)
+	}
+	return nil
+}
+
+// toolTokens roughly estimates how many tokens the definitions of tools cost
+func toolTokens(tools []openai.ChatCompletionToolUnionParam) int {
+	if len(tools) == 0 {
+		return 0
+	}
+	data, err := json.Marshal(tools)
+	if err != nil {
+		return 0
+	}
+	return len(data) / charsPerToken
+}
+
+// EstimateTokens roughly estimates how many tokens a message costs, without a tokenizer
+func EstimateTokens(msg *Message) int {
+	chars := len(msg.Content)
+	for _, toolCall := range msg.ToolCalls {
+		chars += len(toolCall.ID) + len(toolCall.Name) + len(toolCall.Arguments)
+	}
+	return messageTokenOverhead + (chars+charsPerToken-1)/charsPerToken
+}
+
+// TrimToBudget returns the messages sent to the model, like modelMessages, leaving out the
+// oldest messages until their estimated size fits budget tokens. The system prompt and the
+// latest message are always kept, and an assistant message with tool calls is only ever
+// dropped together with the responses to its calls. A system note tells the model how many
+// messages were left out.
+func (conv *Conversation) TrimToBudget(budget int) []*Message {
+	messages := conv.modelMessages()
+
+	// Leading system messages are kept no matter what
+	start := 0
+	for start < len(messages) && messages[start].Role == "system" {
+		start++
+	}
+	history := messages[start:]
+
+	total := 0
+	for _, msg := range messages {
+		total += EstimateTokens(msg)
+	}
+	if total <= budget || len(history) == 0 {
+		return messages
+	}
+
+	// Drop whole groups from the front: an assistant message with tool calls together with
+	// the tool responses following it, or any other single message
+	note := &Message{Role: "system"}
+	dropped := 0
+	for {
+		group := 1
+		if len(history[dropped].ToolCalls) > 0 {
+			for dropped+group < len(history) && history[dropped+group].Role == "tool" {
+				group++
+			}
+		}
+		// The latest group holds the message being answered
+		if dropped+group >= len(history) {
+			break
+		}
+		for _, msg := range history[dropped : dropped+group] {
+			total -= EstimateTokens(msg)
+		}
+		dropped += group
+
+		note.Content = fmt.Sprintf("%d earlier messages of this conversation were left out to fit the context window.", dropped)
+		if total+EstimateTokens(note) <= budget {
+			break
+		}
+	}
+	if dropped == 0 {
+		return messages
+	}
+
+	trimmed := make([]*Message, 0, start+1+len(history)-dropped)
+	trimmed = append(trimmed, messages[:start]...)
+	trimmed = append(trimmed, note)
+	return append(trimmed, history[dropped:]...)
+}
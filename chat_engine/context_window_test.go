@@ -0,0 +1,99 @@
+package chat_engine
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// longConversation is a conversation with a system prompt and turns of many tool calls each,
+// followed by a new user message
+func longConversation() *Conversation {
+	conv := &Conversation{ID: "conv", SystemPrompt: "You are a helpful assistant."}
+	for _, prefix := range []string{"first", "second", "third"} {
+		conv.Messages = append(conv.Messages, turnMessages(prefix, 10)...)
+	}
+	conv.Messages = append(conv.Messages, &Message{ID: "latest", Role: "user", Content: "and now?"})
+	return conv
+}
+
+func estimateAll(messages []*Message) int {
+	total := 0
+	for _, msg := range messages {
+		total += EstimateTokens(msg)
+	}
+	return total
+}
+
+func TestTrimToBudgetKeepsEverythingWithinBudget(t *testing.T) {
+	conv := longConversation()
+	all := conv.modelMessages()
+
+	if trimmed := conv.TrimToBudget(estimateAll(all)); len(trimmed) != len(all) {
+		t.Errorf("trimmed to %d messages, want all %d", len(trimmed), len(all))
+	}
+}
+
+func TestTrimToBudgetKeepsToolCallsWithTheirResponses(t *testing.T) {
+	conv := longConversation()
+	all := conv.modelMessages()
+
+	for budget := estimateAll(all) - 1; budget > 0; budget -= 37 {
+		trimmed := conv.TrimToBudget(budget)
+
+		if trimmed[0].Content != conv.SystemPrompt {
+			t.Fatalf("budget %d: first message is %+v, want the system prompt", budget, trimmed[0])
+		}
+		if last := trimmed[len(trimmed)-1]; last.ID != "latest" {
+			t.Fatalf("budget %d: last message is %s, want the latest one", budget, last.ID)
+		}
+		note := trimmed[1]
+		if note.Role != "system" || !strings.Contains(note.Content, "left out") {
+			t.Fatalf("budget %d: second message is %+v, want a note about left out messages", budget, note)
+		}
+		// What's left is a valid transcript: no tool call lost its response or the other way round
+		if report := ValidateTranscript(trimmed[2:]); !report.Valid {
+			t.Fatalf("budget %d: trimmed history is invalid: %+v", budget, report.Problems)
+		}
+		if dropped := len(all) - (len(trimmed) - 1); dropped < 1 {
+			t.Fatalf("budget %d: nothing was dropped", budget)
+		}
+		// Only the latest message may keep a trimmed conversation over budget
+		if total := estimateAll(trimmed); total > budget && len(trimmed) > 3 {
+			t.Errorf("budget %d: trimmed messages still take %d tokens", budget, total)
+		}
+	}
+}
+
+func TestSendMessageRefusesConversationOverBudget(t *testing.T) {
+	provider := newFakeProvider(textReply("never sent"))
+	engine := newTestEngine(t, provider, WithContextBudget("", 200))
+
+	_, err := engine.SendUserMessageWithOptions("conv", strings.Repeat("word ", 1000), SendOptions{DisableTools: true})
+	if !errors.Is(err, ErrContextWindowExceeded) {
+		t.Fatalf("SendUserMessage returned %v, want ErrContextWindowExceeded", err)
+	}
+	if n := len(provider.Requests()); n != 0 {
+		t.Errorf("provider got %d requests, want none", n)
+	}
+}
+
+func TestSendMessageTrimsToBudget(t *testing.T) {
+	provider := newFakeProvider(textReply("ok"))
+	engine := newTestEngine(t, provider, WithContextBudget("", 300))
+
+	for i := 0; i < 10; i++ {
+		if _, err := engine.SendUserMessageWithOptions("conv", strings.Repeat("word ", 40), SendOptions{DisableTools: true}); err != nil {
+			t.Fatalf("turn %d: %v", i, err)
+		}
+	}
+
+	requests := provider.Requests()
+	last := requests[len(requests)-1]
+	if total := estimateAll(last.Messages); total > 300 {
+		t.Errorf("last request takes %d tokens, over the budget of 300", total)
+	}
+	if last.Messages[0].Role != "system" || !strings.Contains(last.Messages[0].Content, "left out") {
+		t.Errorf("first message of the last request is %+v, want a note about left out messages", last.Messages[0])
+	}
+}
@@ -0,0 +1,84 @@
+package chat_engine
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNothingToContinue is returned when continuing a conversation whose last turn was not
+// interrupted
+var ErrNothingToContinue = errors.New("the conversation has no interrupted turn to continue")
+
+// ContinueTurn resumes the last turn of a conversation where it was interrupted, e.g. by a
+// restart or a failed completion request. Tool calls of the last assistant message that have
+// no response yet are run and the tool loop goes on from there. A conversation that ends with
+// tool responses or a user message gets the model's next reply. Tool calls that need approval
+// pause the turn as usual. The new messages are returned as by SendUserMessageWithOptions.
+func (e *ChatEngine) ContinueTurn(conversationID string, opts SendOptions) (messages []*Message, err error) {
+	conv := e.GetConversation(conversationID)
+	if conv == nil {
+		return nil, fmt.Errorf("conversation %s not found", conversationID)
+	}
+
+	e.approvalMutex.Lock()
+	if e.resumingConversations[conversationID] || e.turnRunning(conversationID) {
+		e.approvalMutex.Unlock()
+		return nil, ErrTurnRunning
+	}
+	round := e.unansweredToolCalls(conv)
+	if len(round) == 0 && !e.awaitsReply(conv) {
+		e.approvalMutex.Unlock()
+		return nil, ErrNothingToContinue
+	}
+	e.resumingConversations[conversationID] = true
+	e.approvalMutex.Unlock()
+
+	defer func() {
+		e.approvalMutex.Lock()
+		delete(e.resumingConversations, conversationID)
+		e.approvalMutex.Unlock()
+	}()
+
+	logger := opts.turnLogger(conv)
+	defer func() {
+		e.notifyTurnEnded(conv, messages, err)
+	}()
+	ctx, endTurn := e.beginTurn(conversationID, opts.RequestID)
+	defer endTurn()
+	defer e.saveTurnMessages(conv, logger)
+
+	allowedTools := e.turnTools(conv, opts)
+	sampling := e.sampling.merge(opts.Sampling)
+	messages = make([]*Message, 0)
+	if len(round) == 0 {
+		logger.Info("Continuing turn with the next reply of the model")
+		responseMessage, err := e.sendUserMessageToLLMStream(ctx, conv, opts.OnDelta, opts.ResponseFormat, sampling, allowedTools)
+		if err != nil {
+			return messages, err
+		}
+		e.addTurnMessage(conv, responseMessage)
+		if opts.Callback != nil {
+			opts.Callback(responseMessage)
+		}
+		messages = append(messages, responseMessage)
+		round = responseMessage.ToolCalls
+	} else {
+		logger.Info("Continuing turn with unanswered tool calls", "tool_calls", len(round))
+	}
+
+	toolMessages, err := e.executeLLMRequestedToolCalls(ctx, conv, round, opts.Callback, opts.OnDelta, opts.OnToolStart, opts.ResponseFormat, sampling, allowedTools, nil, logger)
+	return append(messages, toolMessages...), err
+}
+
+// awaitsReply reports whether the last message of a conversation is one the model hasn't
+// replied to, a user message or a tool response
+func (e *ChatEngine) awaitsReply(conv *Conversation) bool {
+	e.conversationsMutex.RLock()
+	defer e.conversationsMutex.RUnlock()
+
+	if len(conv.Messages) == 0 {
+		return false
+	}
+	role := conv.Messages[len(conv.Messages)-1].Role
+	return role == "user" || role == "tool"
+}
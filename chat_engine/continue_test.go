@@ -0,0 +1,91 @@
+package chat_engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestContinueTurnAfterRestart(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "agent.db")
+
+	// A server that went down while the tool ran left the round saved without its response,
+	// see TestTurnMessagesAreSavedBeforeToolsRun
+	db, err := NewDB(dbPath)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	err = db.SaveMessages("conv", []*Message{
+		{ID: "msg_user", Role: "user", Content: "count"},
+		toolCallReply("call_1", "count", `{}`),
+	})
+	db.Close()
+	if err != nil {
+		t.Fatalf("SaveMessages: %v", err)
+	}
+
+	tool := &countingTool{name: "count"}
+	provider := newFakeProvider(textReply("counted once"))
+	engine := newTestEngine(t, provider, WithTool(tool), WithDatabaseURL(dbPath))
+
+	messages, err := engine.ContinueTurn("conv", SendOptions{})
+	if err != nil {
+		t.Fatalf("ContinueTurn: %v", err)
+	}
+	if got := tool.calls.Load(); got != 1 {
+		t.Errorf("tool ran %d times, want 1", got)
+	}
+	if len(messages) != 2 || messages[0].Role != "tool" || messages[0].TollCallID != "call_1" || messages[1].Content != "counted once" {
+		t.Fatalf("continued with %+v, want the tool response and the reply", messages)
+	}
+
+	stored, err := engine.db.LoadConversation("conv")
+	if err != nil {
+		t.Fatalf("LoadConversation: %v", err)
+	}
+	if len(stored.Messages) != 4 {
+		t.Errorf("stored %d messages, want 4", len(stored.Messages))
+	}
+	if _, err := engine.ContinueTurn("conv", SendOptions{}); !errors.Is(err, ErrNothingToContinue) {
+		t.Errorf("continuing a finished turn returned %v, want ErrNothingToContinue", err)
+	}
+}
+
+func TestContinueTurnInterruptedMidLoop(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "agent.db")
+	ctx, crash := context.WithCancel(context.Background())
+	defer crash()
+
+	// The first engine's tool never returns, as if the server went down while it ran
+	started := make(chan struct{})
+	hanging := &funcTool{name: "count", run: func(context.Context, json.RawMessage) (string, error) {
+		close(started)
+		<-ctx.Done()
+		return "", ctx.Err()
+	}}
+	first := newTestEngine(t, newFakeProvider(toolCallReply("call_1", "count", `{}`), textReply("too late")), WithTool(hanging), WithDatabaseURL(dbPath), WithToolTimeout(0))
+	firstDone := make(chan struct{})
+	go func() {
+		defer close(firstDone)
+		first.SendUserMessage("conv", "count")
+	}()
+	<-started
+
+	tool := &countingTool{name: "count"}
+	second := newTestEngine(t, newFakeProvider(textReply("done")), WithTool(tool), WithDatabaseURL(dbPath))
+	messages, err := second.ContinueTurn("conv", SendOptions{})
+	if err != nil {
+		t.Fatalf("ContinueTurn: %v", err)
+	}
+	if got := tool.calls.Load(); got != 1 {
+		t.Errorf("tool ran %d times in the fresh engine, want 1", got)
+	}
+	if last := messages[len(messages)-1]; last.Content != "done" {
+		t.Errorf("continued turn ended with %q, want the reply", last.Content)
+	}
+
+	crash()
+	<-firstDone
+}
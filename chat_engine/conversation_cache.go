@@ -0,0 +1,72 @@
+package chat_engine
+
+// Conversations are loaded from the database on first access and kept in memory. Once more
+// than the configured number are held, the least recently used ones are dropped, unless a turn
+// is running in them; they are loaded again when accessed next.
+
+// defaultMaxCachedConversations bounds the conversations held in memory
+const defaultMaxCachedConversations = 1000
+
+// WithMaxCachedConversations sets how many conversations are held in memory before the least
+// recently used ones are evicted. A value of 0 keeps every accessed conversation.
+func WithMaxCachedConversations(n int) Option {
+	return func(e *ChatEngine) {
+		e.maxCachedConversations = n
+	}
+}
+
+// cachedConversation returns the conversation if it is held in memory, marking it as recently used
+func (e *ChatEngine) cachedConversation(conversationID string) *Conversation {
+	e.conversationsMutex.Lock()
+	defer e.conversationsMutex.Unlock()
+
+	conv := e.conversations[conversationID]
+	if conv != nil {
+		e.conversationLRU.MoveToFront(e.conversationElements[conversationID])
+	}
+	return conv
+}
+
+// cacheConversation holds conv in memory, evicting the least recently used conversations
+// beyond the limit. When the conversation was cached meanwhile, e.g. by a concurrent load,
+// the cached one is returned instead so that there is a single copy.
+func (e *ChatEngine) cacheConversation(conv *Conversation) *Conversation {
+	e.conversationsMutex.Lock()
+	defer e.conversationsMutex.Unlock()
+
+	if cached := e.conversations[conv.ID]; cached != nil {
+		e.conversationLRU.MoveToFront(e.conversationElements[conv.ID])
+		return cached
+	}
+	e.conversations[conv.ID] = conv
+	e.conversationElements[conv.ID] = e.conversationLRU.PushFront(conv.ID)
+	e.evictConversations()
+	return conv
+}
+
+// evictConversations drops the least recently used conversations while more than the limit are
+// held. Conversations with a running turn stay. conversationsMutex must be held.
+func (e *ChatEngine) evictConversations() {
+	if e.maxCachedConversations <= 0 {
+		return
+	}
+
+	elem := e.conversationLRU.Back()
+	for elem != nil && len(e.conversations) > e.maxCachedConversations {
+		prev := elem.Prev()
+		id := elem.Value.(string)
+		if !e.turnRunning(id) {
+			e.conversationLRU.Remove(elem)
+			delete(e.conversationElements, id)
+			delete(e.conversations, id)
+		}
+		elem = prev
+	}
+}
+
+// turnRunning reports whether a turn of the conversation is running
+func (e *ChatEngine) turnRunning(conversationID string) bool {
+	e.activeTurnsMutex.Lock()
+	defer e.activeTurnsMutex.Unlock()
+	return len(e.activeTurns[conversationID]) > 0
+}
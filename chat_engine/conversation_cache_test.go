@@ -0,0 +1,85 @@
+package chat_engine
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestConversationsAreLoadedOnFirstAccess(t *testing.T) {
+	provider := newFakeProvider(textReply("one"), textReply("two"))
+	engine := newTestEngine(t, provider)
+	for _, id := range []string{"a", "b"} {
+		if _, err := engine.SendUserMessage(id, "hi"); err != nil {
+			t.Fatalf("SendUserMessage: %v", err)
+		}
+	}
+
+	engine = reopenEngine(t, engine, provider)
+	if n := len(engine.ListConversation()); n != 0 {
+		t.Errorf("%d conversations are in memory right after starting, want none", n)
+	}
+	// Listing reads the summaries without loading the conversations
+	page, err := engine.ListConversationsPaged(10, 0, "")
+	if err != nil {
+		t.Fatalf("ListConversationsPaged: %v", err)
+	}
+	if page.Total != 2 || engine.cachedConversation("a") != nil {
+		t.Errorf("listed %d conversations and loaded a, want 2 listed and none loaded", page.Total)
+	}
+
+	conv := engine.GetConversation("a")
+	if conv == nil || len(conv.Messages) != 2 || conv.Messages[1].Content != "one" {
+		t.Fatalf("GetConversation loaded %+v, want the stored history", conv)
+	}
+	if engine.cachedConversation("a") != conv {
+		t.Error("a is not held in memory after it was accessed")
+	}
+	if engine.cachedConversation("b") != nil {
+		t.Error("b was loaded without being accessed")
+	}
+	if engine.GetConversation("missing") != nil {
+		t.Error("GetConversation returned a conversation that doesn't exist")
+	}
+}
+
+func TestLeastRecentlyUsedConversationsAreEvicted(t *testing.T) {
+	provider := newFakeProvider(textReply("one"), textReply("two"), textReply("three"))
+	engine := newTestEngine(t, provider, WithMaxCachedConversations(2))
+
+	for _, id := range []string{"a", "b"} {
+		if _, err := engine.SendUserMessage(id, "hi"); err != nil {
+			t.Fatalf("SendUserMessage: %v", err)
+		}
+	}
+	// a becomes the most recently used, so b is evicted for c
+	engine.GetConversation("a")
+	if _, err := engine.SendUserMessage("c", "hi"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if engine.cachedConversation("b") != nil || engine.cachedConversation("a") == nil || engine.cachedConversation("c") == nil {
+		t.Errorf("held %d conversations, want a and c", len(engine.ListConversation()))
+	}
+
+	// An evicted conversation is loaded again with its history
+	conv := engine.GetConversation("b")
+	if conv == nil || len(conv.Messages) != 2 || conv.Messages[1].Content != "two" {
+		t.Errorf("reloaded b is %+v, want its history", conv)
+	}
+	if n := len(engine.ListConversation()); n != 2 {
+		t.Errorf("%d conversations are held, want at most 2", n)
+	}
+}
+
+func TestConversationWithRunningTurnIsNotEvicted(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")), WithMaxCachedConversations(1))
+
+	running := engine.GetOrCreateConversation("running")
+	_, end := engine.beginTurn("running", "")
+	defer end()
+	for i := range 3 {
+		engine.GetOrCreateConversation(fmt.Sprintf("conv-%d", i))
+	}
+	if engine.cachedConversation("running") != running {
+		t.Error("the conversation with a running turn was evicted")
+	}
+}
@@ -0,0 +1,65 @@
+package chat_engine
+
+import "time"
+
+// ConversationInfo is what the conversation_info tool reports about a conversation
+type ConversationInfo struct {
+	ConversationID string `json:"conversation_id"`
+	Title          string `json:"title,omitempty"`
+	MessageCount   int    `json:"message_count"`
+	// Turns are counted by user messages
+	TurnCount int `json:"turn_count"`
+
+	CreatedAt      time.Time `json:"created_at"`
+	ElapsedSeconds int64     `json:"elapsed_seconds"`
+
+	// Tool calls executed over the lifetime of the conversation and the remaining budget,
+	// the limit and remaining fields are omitted when there is no limit
+	ToolCalls          int  `json:"tool_calls"`
+	ToolCallLimit      int  `json:"tool_call_limit,omitempty"`
+	ToolCallsRemaining *int `json:"tool_calls_remaining,omitempty"`
+
+	// Tool call rounds used in the current turn, including the one being executed
+	ToolRoundsThisTurn   int `json:"tool_rounds_this_turn"`
+	MaxToolRoundsPerTurn int `json:"max_tool_rounds_per_turn"`
+	ToolRoundsRemaining  int `json:"tool_rounds_remaining"`
+
+	WorkingDir string `json:"working_dir"`
+	ReadOnly   bool   `json:"read_only"`
+}
+
+// conversationInfo collects ConversationInfo from the conversation's current state
+func (e *ChatEngine) conversationInfo(conv *Conversation) *ConversationInfo {
+	info := &ConversationInfo{
+		ConversationID:       conv.ID,
+		Title:                conv.Title,
+		MessageCount:         len(conv.Messages),
+		CreatedAt:            conv.CreatedAt,
+		ToolCalls:            conv.ToolCallCount,
+		MaxToolRoundsPerTurn: e.maxToolIterations,
+		WorkingDir:           e.WorkingDir(conv.ID),
+		ReadOnly:             e.IsReadOnly(conv.ID),
+	}
+	if !conv.CreatedAt.IsZero() {
+		info.ElapsedSeconds = int64(time.Since(conv.CreatedAt).Seconds())
+	}
+
+	for _, msg := range conv.Messages {
+		switch {
+		case msg.Role == "user":
+			info.TurnCount++
+			info.ToolRoundsThisTurn = 0
+		case msg.Role == "assistant" && len(msg.ToolCalls) > 0:
+			info.ToolRoundsThisTurn++
+		}
+	}
+	info.ToolRoundsRemaining = max(e.maxToolIterations-info.ToolRoundsThisTurn, 0)
+
+	if e.maxConversationToolCalls > 0 {
+		remaining := max(e.maxConversationToolCalls-conv.ToolCallCount, 0)
+		info.ToolCallLimit = e.maxConversationToolCalls
+		info.ToolCallsRemaining = &remaining
+	}
+
+	return info
+}
@@ -0,0 +1,90 @@
+package chat_engine
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// ConversationLimitPolicy decides what happens when a user message is sent to a conversation
+// that reached its message limit, see WithMaxConversationMessages
+type ConversationLimitPolicy string
+
+const (
+	// ConversationLimitRefuse rejects the message with ErrConversationFull
+	ConversationLimitRefuse ConversationLimitPolicy = "refuse"
+	// ConversationLimitTrim deletes the oldest turns of the conversation to make room
+	ConversationLimitTrim ConversationLimitPolicy = "trim"
+)
+
+// ErrConversationFull is returned for a user message sent to a conversation at its message
+// limit with ConversationLimitRefuse
+var ErrConversationFull = errors.New("conversation has reached its message limit")
+
+// ParseConversationLimitPolicy validates a conversation limit policy name
+func ParseConversationLimitPolicy(s string) (ConversationLimitPolicy, error) {
+	switch policy := ConversationLimitPolicy(s); policy {
+	case ConversationLimitRefuse, ConversationLimitTrim:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown conversation limit policy %q, use refuse or trim", s)
+	}
+}
+
+// WithMaxConversationMessages caps the messages of a conversation at n. The cap is checked
+// when a user message is sent, so a turn with many tool calls can go past it; the next
+// message is then handled according to policy. A value of 0 disables the cap.
+func WithMaxConversationMessages(n int, policy ConversationLimitPolicy) Option {
+	return func(e *ChatEngine) {
+		e.maxConversationMessages = n
+		e.conversationLimitPolicy = policy
+	}
+}
+
+// enforceConversationLimit makes room for a user message in conv according to the limit
+// policy, or returns ErrConversationFull
+func (e *ChatEngine) enforceConversationLimit(conv *Conversation, logger *slog.Logger) error {
+	if e.maxConversationMessages <= 0 {
+		return nil
+	}
+
+	e.conversationsMutex.RLock()
+	messages := append([]*Message(nil), conv.Messages...)
+	e.conversationsMutex.RUnlock()
+	if len(messages) < e.maxConversationMessages {
+		return nil
+	}
+	if e.conversationLimitPolicy != ConversationLimitTrim {
+		return fmt.Errorf("%w of %d messages, start a new conversation or clear this one", ErrConversationFull, e.maxConversationMessages)
+	}
+
+	// Whole turns are deleted, so that tool calls keep their responses. The first turn kept
+	// is the oldest one that leaves room for the new message, or none.
+	cut := len(messages)
+	for i, msg := range messages {
+		if msg.Role == "user" && len(messages)-i < e.maxConversationMessages {
+			cut = i
+			break
+		}
+	}
+
+	ids := make([]string, cut)
+	for i, msg := range messages[:cut] {
+		ids[i] = msg.ID
+	}
+	if !conv.ephemeral {
+		if err := e.db.DeleteMessages(conv.ID, ids); err != nil {
+			return err
+		}
+	}
+
+	e.conversationsMutex.Lock()
+	// Messages are only ever appended, so the deleted ones are still first
+	conv.Messages = append([]*Message(nil), conv.Messages[cut:]...)
+	conv.UpdatedAt = time.Now().UTC()
+	e.conversationsMutex.Unlock()
+
+	logger.Info("Deleted the oldest messages of a conversation at its message limit", "messages", cut, "limit", e.maxConversationMessages)
+	return nil
+}
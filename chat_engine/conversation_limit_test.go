@@ -0,0 +1,93 @@
+package chat_engine
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestConversationLimitRefuse(t *testing.T) {
+	provider := newFakeProvider(textReply("one"), textReply("two"), textReply("three"))
+	engine := newTestEngine(t, provider, WithMaxConversationMessages(4, ConversationLimitRefuse))
+
+	for _, content := range []string{"1", "2"} {
+		if _, err := engine.SendUserMessage("conv", content); err != nil {
+			t.Fatalf("SendUserMessage(%s): %v", content, err)
+		}
+	}
+	if _, err := engine.SendUserMessage("conv", "3"); !errors.Is(err, ErrConversationFull) {
+		t.Fatalf("message to a full conversation returned %v, want ErrConversationFull", err)
+	}
+	if n := len(provider.Requests()); n != 2 {
+		t.Errorf("provider got %d requests, want none for the refused message", n)
+	}
+	if n := len(engine.GetConversation("conv").Messages); n != 4 {
+		t.Errorf("conversation has %d messages, want the 4 it had", n)
+	}
+	stats, err := engine.ConversationStats("conv")
+	if err != nil || stats.MessageCount != 4 || stats.MaxMessages != 4 {
+		t.Errorf("stats = %+v, %v, want 4 of at most 4 messages", stats, err)
+	}
+
+	// Other conversations and a cleared one have room
+	if _, err := engine.SendUserMessage("other", "1"); err != nil {
+		t.Errorf("message to another conversation: %v", err)
+	}
+	if err := engine.ClearConversation("conv"); err != nil {
+		t.Fatalf("ClearConversation: %v", err)
+	}
+	if _, err := engine.SendUserMessage("conv", "3"); err != nil {
+		t.Errorf("message to the cleared conversation: %v", err)
+	}
+}
+
+func TestConversationLimitTrimsOldestTurns(t *testing.T) {
+	provider := newFakeProvider(textReply("one"), textReply("two"), textReply("three"))
+	engine := newTestEngine(t, provider, WithMaxConversationMessages(4, ConversationLimitTrim))
+
+	for _, content := range []string{"1", "2", "3"} {
+		if _, err := engine.SendUserMessage("conv", content); err != nil {
+			t.Fatalf("SendUserMessage(%s): %v", content, err)
+		}
+	}
+	want := []string{"user: 2", "assistant: two", "user: 3", "assistant: three"}
+	if got := messageContents(engine.GetConversation("conv").Messages); !slices.Equal(got, want) {
+		t.Errorf("conversation holds %q, want %q", got, want)
+	}
+	// The model no longer sees the first turn
+	requests := provider.Requests()
+	if got := messageContents(requests[len(requests)-1].Messages); !slices.Equal(got, want[:3]) {
+		t.Errorf("last request sent %q, want %q", got, want[:3])
+	}
+	if got := messageContents(reopenEngine(t, engine, provider).GetConversation("conv").Messages); !slices.Equal(got, want) {
+		t.Errorf("stored conversation holds %q, want %q", got, want)
+	}
+}
+
+func TestConversationLimitTrimsWholeTurns(t *testing.T) {
+	provider := newFakeProvider(toolCallReply("call_1", "bash_command", `{"command": "echo hi"}`), textReply("one"), textReply("two"))
+	engine := newTestEngine(t, provider, WithMaxConversationMessages(4, ConversationLimitTrim))
+
+	if _, err := engine.SendUserMessage("conv", "1"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	// Keeping the tool output without its call would leave room, but the whole turn goes
+	if _, err := engine.SendUserMessage("conv", "2"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	want := []string{"user: 2", "assistant: two"}
+	if got := messageContents(engine.GetConversation("conv").Messages); !slices.Equal(got, want) {
+		t.Errorf("conversation holds %q, want %q", got, want)
+	}
+}
+
+func TestParseConversationLimitPolicy(t *testing.T) {
+	for _, name := range []string{"refuse", "trim"} {
+		if policy, err := ParseConversationLimitPolicy(name); err != nil || string(policy) != name {
+			t.Errorf("ParseConversationLimitPolicy(%s) = %s, %v", name, policy, err)
+		}
+	}
+	if _, err := ParseConversationLimitPolicy("drop"); err == nil {
+		t.Error("unknown policy was accepted")
+	}
+}
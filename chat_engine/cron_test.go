@@ -0,0 +1,45 @@
+package chat_engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2025, time.January, 15, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2025, time.January, 15, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2025, time.January, 15, 10, 15, 0, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2025, time.January, 16, 9, 0, 0, 0, time.UTC)},
+		{"30 8-18/2 * * *", time.Date(2025, time.January, 15, 10, 30, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2025, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 * * 0", time.Date(2025, time.January, 19, 12, 0, 0, 0, time.UTC)},
+		{"0 12 * * 7", time.Date(2025, time.January, 19, 12, 0, 0, 0, time.UTC)},
+		{"0 0 * 3,6 *", time.Date(2025, time.March, 1, 0, 0, 0, 0, time.UTC)},
+		// With both day fields restricted either matches
+		{"0 0 20 * 5", time.Date(2025, time.January, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		cron, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := cron.next(from); !got.Equal(tt.want) {
+			t.Errorf("%q: next is %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseCronRejectsInvalidExpressions(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *", "* * * jan *", "0 0 30 2 *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded", expr)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package chat_engine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultDatabasePath is the SQLite database used unless WithDatabaseURL names another
+const defaultDatabasePath = "agent.db"
+
+// WithDatabaseURL sets the database conversations are stored in: a SQLite file path, a
+// sqlite:// URL or a file: URI, or a postgres:// URL for a PostgreSQL database. Defaults to
+// agent.db in the working directory.
+func WithDatabaseURL(url string) Option {
+	return func(e *ChatEngine) {
+		e.databaseURL = url
+	}
+}
+
+// openStore opens the store a database URL names and brings its schema up to date
+func openStore(url string) (engineStore, error) {
+	if isPostgresURL(url) {
+		db, err := NewPostgresDB(url)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize database: %w", err)
+		}
+		return db, nil
+	}
+
+	dbPath, err := databasePath(url)
+	if err != nil {
+		return nil, err
+	}
+	db, err := NewDB(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize database: %w", err)
+	}
+	return db, nil
+}
+
+// isPostgresURL reports whether a database URL names a PostgreSQL database
+func isPostgresURL(url string) bool {
+	scheme, _, ok := strings.Cut(url, "://")
+	return ok && (strings.EqualFold(scheme, "postgres") || strings.EqualFold(scheme, "postgresql"))
+}
+
+// databasePath returns the SQLite database to open for a database URL
+func databasePath(url string) (string, error) {
+	if url == "" {
+		return defaultDatabasePath, nil
+	}
+
+	scheme, rest, ok := strings.Cut(url, "://")
+	if !ok {
+		// A plain path or a file: URI, both understood by the SQLite driver
+		return url, nil
+	}
+	switch strings.ToLower(scheme) {
+	case "file":
+		return url, nil
+	case "sqlite", "sqlite3":
+		if rest == "" {
+			return "", fmt.Errorf("database URL %q has no path", url)
+		}
+		return rest, nil
+	default:
+		return "", fmt.Errorf("unsupported database URL scheme %q", scheme)
+	}
+}
@@ -2,114 +2,117 @@ package chat_engine
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"net/url"
+	"strings"
+	"time"
 
 	_ "modernc.org/sqlite"
 )
 
+// sqliteTimeFormat matches the UTC timestamps written by CURRENT_TIMESTAMP, so they compare as strings
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// sqliteMilliTimeFormat adds milliseconds to sqliteTimeFormat, which keeps messages of the same
+// second in order and still compares as strings against it
+const sqliteMilliTimeFormat = "2006-01-02 15:04:05.000"
+
+const (
+	// sqliteBusyTimeout is how long a statement waits for a lock held by another connection
+	// before failing with "database is locked"
+	sqliteBusyTimeout = 5 * time.Second
+	// maxOpenConns bounds the connections to the database. In WAL mode readers wait neither
+	// for each other nor for the writer, writers take turns.
+	maxOpenConns = 8
+)
+
 type DB struct {
-	db *sql.DB
+	db   *sql.DB
+	path string
 }
 
 func NewDB(dbPath string) (*DB, error) {
-	db, err := sql.Open("sqlite", dbPath)
+	db, err := sql.Open("sqlite", sqliteDSN(dbPath))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
-
-	// Enable foreign keys
-	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
-		return nil, fmt.Errorf("failed to enable foreign keys: %w", err)
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxOpenConns)
+	// Every connection to an in-memory database has a database of its own
+	if dbPath == ":memory:" || strings.Contains(dbPath, "mode=memory") {
+		db.SetMaxOpenConns(1)
 	}
 
-	database := &DB{db: db}
+	database := &DB{db: db, path: dbPath}
 
-	// Initialize schema
-	if err := database.initSchema(); err != nil {
-		return nil, fmt.Errorf("failed to initialize schema: %w", err)
+	// Bring the schema up to date
+	if err := database.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate schema: %w", err)
 	}
 
 	return database, nil
 }
 
+// sqliteDSN adds the settings every connection to the database at path needs: WAL mode so
+// that readers and the writer don't block each other, a busy timeout so that a locked
+// database is waited for instead of failing right away, foreign keys, and transactions that
+// take the write lock when they begin. Upgrading a read lock later can fail regardless of
+// the busy timeout.
+func sqliteDSN(path string) string {
+	params := url.Values{}
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", sqliteBusyTimeout.Milliseconds()))
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Set("_txlock", "immediate")
+
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	return path + separator + params.Encode()
+}
+
 func (d *DB) Close() error {
 	return d.db.Close()
 }
 
-func (d *DB) initSchema() error {
-	// Create conversations table
-	_, err := d.db.Exec(`
-		CREATE TABLE IF NOT EXISTS conversations (
-			id TEXT PRIMARY KEY,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
-	if err != nil {
-		return fmt.Errorf("failed to create conversations table: %w", err)
-	}
-
-	// Create messages table
-	_, err = d.db.Exec(`
-		CREATE TABLE IF NOT EXISTS messages (
-			id TEXT PRIMARY KEY,
-			conversation_id TEXT NOT NULL,
-			role TEXT NOT NULL,
-			content TEXT NOT NULL,
-			tool_call_id TEXT DEFAULT '',
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE
-		)
-	`)
+// SaveConversation creates or updates a conversation
+func (d *DB) SaveConversation(conv *Conversation) error {
+	tx, err := d.db.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to create messages table: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	// Create tool_calls table
-	_, err = d.db.Exec(`
-		CREATE TABLE IF NOT EXISTS tool_calls (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			message_id TEXT NOT NULL,
-			tool_call_id TEXT NOT NULL,
-			type TEXT NOT NULL,
-			name TEXT NOT NULL,
-			arguments TEXT NOT NULL,
-			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
-		)
-	`)
+	// Insert or update conversation
+	_, err = tx.Exec(`
+		INSERT INTO conversations (id, title, system_prompt, updated_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(id) DO UPDATE SET title = excluded.title, system_prompt = excluded.system_prompt, updated_at = CURRENT_TIMESTAMP
+	`, conv.ID, conv.Title, conv.SystemPrompt)
 	if err != nil {
-		return fmt.Errorf("failed to create tool_calls table: %w", err)
+		return fmt.Errorf("failed to save conversation: %w", err)
 	}
 
-	// Create indexes for better query performance
-	_, err = d.db.Exec(`
-		CREATE INDEX IF NOT EXISTS idx_messages_conversation_id ON messages(conversation_id);
-		CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at);
-		CREATE INDEX IF NOT EXISTS idx_tool_calls_message_id ON tool_calls(message_id);
-	`)
-	if err != nil {
-		return fmt.Errorf("failed to create indexes: %w", err)
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
 	return nil
 }
 
-// SaveConversation creates or updates a conversation
-func (d *DB) SaveConversation(conv *Conversation) error {
+// SaveMessage saves a message to the database
+func (d *DB) SaveMessage(conversationID string, msg *Message) error {
 	tx, err := d.db.Begin()
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	// Insert or update conversation
-	_, err = tx.Exec(`
-		INSERT INTO conversations (id, updated_at)
-		VALUES (?, CURRENT_TIMESTAMP)
-		ON CONFLICT(id) DO UPDATE SET updated_at = CURRENT_TIMESTAMP
-	`, conv.ID)
-	if err != nil {
-		return fmt.Errorf("failed to save conversation: %w", err)
+	if err := saveMessage(tx, conversationID, msg); err != nil {
+		return err
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -119,16 +122,46 @@ func (d *DB) SaveConversation(conv *Conversation) error {
 	return nil
 }
 
-// SaveMessage saves a message to the database
-func (d *DB) SaveMessage(conversationID string, msg *Message) error {
+// SaveMessages stores messages of a conversation, e.g. those of a turn, in a single
+// transaction, creating the conversation if needed
+func (d *DB) SaveMessages(conversationID string, msgs []*Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
 	tx, err := d.db.Begin()
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	// Ensure conversation exists
-	_, err = tx.Exec(`
+	if err := ensureConversation(tx, conversationID); err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if err := insertMessage(tx, conversationID, msg); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// saveMessage inserts a message with its tool calls within tx
+func saveMessage(tx *sql.Tx, conversationID string, msg *Message) error {
+	if err := ensureConversation(tx, conversationID); err != nil {
+		return err
+	}
+	return insertMessage(tx, conversationID, msg)
+}
+
+// ensureConversation creates the conversation within tx if it doesn't exist yet and marks it
+// as updated
+func ensureConversation(tx *sql.Tx, conversationID string) error {
+	_, err := tx.Exec(`
 		INSERT INTO conversations (id, updated_at)
 		VALUES (?, CURRENT_TIMESTAMP)
 		ON CONFLICT(id) DO UPDATE SET updated_at = CURRENT_TIMESTAMP
@@ -136,16 +169,47 @@ func (d *DB) SaveMessage(conversationID string, msg *Message) error {
 	if err != nil {
 		return fmt.Errorf("failed to ensure conversation exists: %w", err)
 	}
+	return nil
+}
+
+// insertMessage inserts a message of an existing conversation with its tool calls within tx
+func insertMessage(tx *sql.Tx, conversationID string, msg *Message) error {
+	var promptTokens, completionTokens int64
+	if msg.Usage != nil {
+		promptTokens = msg.Usage.PromptTokens
+		completionTokens = msg.Usage.CompletionTokens
+	}
+
+	createdAt := msg.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+
+	images, err := encodeImages(msg)
+	if err != nil {
+		return err
+	}
 
 	// Insert message
 	_, err = tx.Exec(`
-		INSERT INTO messages (id, conversation_id, role, content, tool_call_id)
-		VALUES (?, ?, ?, ?, ?)
-	`, msg.ID, conversationID, msg.Role, msg.Content, msg.TollCallID)
+		INSERT INTO messages (id, conversation_id, role, content, tool_call_id, model, prompt_tokens, completion_tokens, raw_content, images, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, msg.ID, conversationID, msg.Role, msg.Content, msg.TollCallID, msg.Model, promptTokens, completionTokens, msg.RawContent,
+		images, createdAt.UTC().Format(sqliteMilliTimeFormat))
 	if err != nil {
 		return fmt.Errorf("failed to insert message: %w", err)
 	}
 
+	if isSearchable(msg) {
+		_, err = tx.Exec(`
+			INSERT INTO messages_fts (content, message_id, conversation_id)
+			VALUES (?, ?, ?)
+		`, msg.Content, msg.ID, conversationID)
+		if err != nil {
+			return fmt.Errorf("failed to index message: %w", err)
+		}
+	}
+
 	// Insert tool calls if any
 	for _, toolCall := range msg.ToolCalls {
 		_, err = tx.Exec(`
@@ -157,35 +221,232 @@ func (d *DB) SaveMessage(conversationID string, msg *Message) error {
 		}
 	}
 
+	return nil
+}
+
+// UpdateMessage replaces the role, content and tool calls of a stored message
+func (d *DB) UpdateMessage(conversationID string, msg *Message) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE messages SET role = ?, content = ?
+		WHERE id = ? AND conversation_id = ?
+	`, msg.Role, msg.Content, msg.ID, conversationID)
+	if err != nil {
+		return fmt.Errorf("failed to update message: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to update message: %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("message %s not found in conversation %s", msg.ID, conversationID)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM tool_calls WHERE message_id = ?`, msg.ID); err != nil {
+		return fmt.Errorf("failed to delete tool calls: %w", err)
+	}
+	for _, toolCall := range msg.ToolCalls {
+		_, err = tx.Exec(`
+			INSERT INTO tool_calls (message_id, tool_call_id, type, name, arguments)
+			VALUES (?, ?, ?, ?, ?)
+		`, msg.ID, toolCall.ID, toolCall.Type, toolCall.Name, toolCall.Arguments)
+		if err != nil {
+			return fmt.Errorf("failed to insert tool call: %w", err)
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM messages_fts WHERE message_id = ?`, msg.ID); err != nil {
+		return fmt.Errorf("failed to update search index: %w", err)
+	}
+	// The indexer embeds the new content
+	if _, err := tx.Exec(`DELETE FROM message_embeddings WHERE message_id = ?`, msg.ID); err != nil {
+		return fmt.Errorf("failed to delete embedding: %w", err)
+	}
+	if isSearchable(msg) {
+		_, err = tx.Exec(`
+			INSERT INTO messages_fts (content, message_id, conversation_id)
+			VALUES (?, ?, ?)
+		`, msg.Content, msg.ID, conversationID)
+		if err != nil {
+			return fmt.Errorf("failed to index message: %w", err)
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE conversations SET updated_at = CURRENT_TIMESTAMP WHERE id = ?`, conversationID); err != nil {
+		return fmt.Errorf("failed to update conversation: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// DeleteMessages deletes messages of a conversation together with their tool calls
+func (d *DB) DeleteMessages(conversationID string, messageIDs []string) error {
+	if len(messageIDs) == 0 {
+		return nil
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := deleteMessages(tx, conversationID, messageIDs); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// CompactMessages replaces messages of a conversation with a summary of them
+func (d *DB) CompactMessages(conversationID string, messageIDs []string, summary *Message) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := deleteMessages(tx, conversationID, messageIDs); err != nil {
+		return err
+	}
+	if err := saveMessage(tx, conversationID, summary); err != nil {
+		return err
+	}
+
 	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
+	return nil
+}
 
+// deleteMessages deletes messages of a conversation within tx
+func deleteMessages(tx *sql.Tx, conversationID string, messageIDs []string) error {
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(messageIDs)), ",")
+	args := make([]interface{}, 0, len(messageIDs)+1)
+	args = append(args, conversationID)
+	for _, id := range messageIDs {
+		args = append(args, id)
+	}
+
+	// Tool calls, embeddings and the search index are cleaned up explicitly rather than
+	// relying on foreign keys, the search index has none
+	statements := []string{
+		`DELETE FROM tool_calls WHERE message_id IN (SELECT id FROM messages WHERE conversation_id = ? AND id IN (%s))`,
+		`DELETE FROM messages_fts WHERE conversation_id = ? AND message_id IN (%s)`,
+		`DELETE FROM message_embeddings WHERE conversation_id = ? AND message_id IN (%s)`,
+		`DELETE FROM messages WHERE conversation_id = ? AND id IN (%s)`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(fmt.Sprintf(statement, placeholders), args...); err != nil {
+			return fmt.Errorf("failed to delete messages: %w", err)
+		}
+	}
 	return nil
 }
 
 // LoadConversation loads a conversation with all its messages from the database
 func (d *DB) LoadConversation(conversationID string) (*Conversation, error) {
-	// Check if conversation exists
-	var exists bool
+	// Load conversation row, which also tells whether it exists
+	var title, systemPrompt, webhookURL, parentID string
+	var toolCallCount int
+	var createdAt, updatedAt time.Time
 	err := d.db.QueryRow(`
-		SELECT EXISTS(SELECT 1 FROM conversations WHERE id = ?)
-	`, conversationID).Scan(&exists)
+		SELECT title, system_prompt, webhook_url, parent_id, tool_call_count, created_at, updated_at FROM conversations WHERE id = ?
+	`, conversationID).Scan(&title, &systemPrompt, &webhookURL, &parentID, &toolCallCount, &createdAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to check conversation existence: %w", err)
+		return nil, fmt.Errorf("failed to load conversation: %w", err)
 	}
 
+	messages, err := d.queryMessages(`
+		SELECT id, role, content, tool_call_id, model, prompt_tokens, completion_tokens, raw_content, images, created_at
+		FROM messages
+		WHERE conversation_id = ?
+		ORDER BY created_at ASC, rowid ASC
+	`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := d.ConversationTags(conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	conv := &Conversation{
+		ID:            conversationID,
+		Title:         title,
+		Tags:          tags,
+		ParentID:      parentID,
+		Messages:      messages,
+		SystemPrompt:  systemPrompt,
+		WebhookURL:    webhookURL,
+		ToolCallCount: toolCallCount,
+		CreatedAt:     createdAt,
+		UpdatedAt:     updatedAt,
+	}
+
+	return conv, nil
+}
+
+// LoadConversationMessages returns up to limit messages of a conversation starting at offset,
+// oldest first, with their tool calls
+func (d *DB) LoadConversationMessages(conversationID string, limit, offset int) ([]*Message, error) {
+	return d.queryMessages(`
+		SELECT id, role, content, tool_call_id, model, prompt_tokens, completion_tokens, raw_content, images, created_at
+		FROM messages
+		WHERE conversation_id = ?
+		ORDER BY created_at ASC, rowid ASC
+		LIMIT ? OFFSET ?
+	`, conversationID, limit, offset)
+}
+
+// LoadMessagesAfter returns the messages of a conversation stored after the given message,
+// oldest first, or ErrMessageNotFound if the conversation has no such message
+func (d *DB) LoadMessagesAfter(conversationID, messageID string) ([]*Message, error) {
+	var exists bool
+	err := d.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM messages WHERE id = ? AND conversation_id = ?)`, messageID, conversationID).Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up message: %w", err)
+	}
 	if !exists {
-		return nil, nil
+		return nil, ErrMessageNotFound
 	}
 
-	// Load messages
-	rows, err := d.db.Query(`
-		SELECT id, role, content, tool_call_id
+	return d.queryMessages(`
+		SELECT id, role, content, tool_call_id, model, prompt_tokens, completion_tokens, raw_content, images, created_at
 		FROM messages
 		WHERE conversation_id = ?
-		ORDER BY created_at ASC
-	`, conversationID)
+			AND (created_at, rowid) > (SELECT created_at, rowid FROM messages WHERE id = ? AND conversation_id = ?)
+		ORDER BY created_at ASC, rowid ASC
+	`, conversationID, messageID, conversationID)
+}
+
+// CountMessages returns the number of messages in a conversation
+func (d *DB) CountMessages(conversationID string) (int, error) {
+	var count int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE conversation_id = ?`, conversationID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count messages: %w", err)
+	}
+	return count, nil
+}
+
+// queryMessages runs a query selecting message columns and loads the tool calls of the
+// returned messages
+func (d *DB) queryMessages(query string, args ...interface{}) ([]*Message, error) {
+	rows, err := d.db.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query messages: %w", err)
 	}
@@ -195,17 +456,12 @@ func (d *DB) LoadConversation(conversationID string) (*Conversation, error) {
 	messageMap := make(map[string]*Message)
 
 	for rows.Next() {
-		var msg Message
-		var toolCallID string
-		err := rows.Scan(&msg.ID, &msg.Role, &msg.Content, &toolCallID)
+		msg, err := scanMessage(rows)
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan message: %w", err)
+			return nil, err
 		}
-		msg.TollCallID = toolCallID
-		msg.ToolCalls = make([]ToolCall, 0)
-
-		messages = append(messages, &msg)
-		messageMap[msg.ID] = &msg
+		messages = append(messages, msg)
+		messageMap[msg.ID] = msg
 	}
 
 	if err := rows.Err(); err != nil {
@@ -228,14 +484,14 @@ func (d *DB) LoadConversation(conversationID string) (*Conversation, error) {
 			placeholders += "?"
 		}
 
-		query := fmt.Sprintf(`
+		toolQuery := fmt.Sprintf(`
 			SELECT message_id, tool_call_id, type, name, arguments
 			FROM tool_calls
 			WHERE message_id IN (%s)
 			ORDER BY id ASC
 		`, placeholders)
 
-		toolRows, err := d.db.Query(query, messageIDs...)
+		toolRows, err := d.db.Query(toolQuery, messageIDs...)
 		if err != nil {
 			return nil, fmt.Errorf("failed to query tool calls: %w", err)
 		}
@@ -259,12 +515,47 @@ func (d *DB) LoadConversation(conversationID string) (*Conversation, error) {
 		}
 	}
 
-	conv := &Conversation{
-		ID:       conversationID,
-		Messages: messages,
+	return messages, nil
+}
+
+// scanMessage reads a row of the columns id, role, content, tool_call_id, model,
+// prompt_tokens, completion_tokens, raw_content, images and created_at of a message. Its tool
+// calls are left empty.
+func scanMessage(rows *sql.Rows) (*Message, error) {
+	var msg Message
+	var promptTokens, completionTokens int64
+	var images string
+	err := rows.Scan(&msg.ID, &msg.Role, &msg.Content, &msg.TollCallID, &msg.Model, &promptTokens, &completionTokens, &msg.RawContent, &images, &msg.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan message: %w", err)
+	}
+	if images != "" {
+		if err := json.Unmarshal([]byte(images), &msg.Images); err != nil {
+			return nil, fmt.Errorf("failed to decode images of message %s: %w", msg.ID, err)
+		}
+	}
+	if promptTokens > 0 || completionTokens > 0 {
+		msg.Usage = &TokenUsage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      promptTokens + completionTokens,
+		}
 	}
+	msg.ToolCalls = make([]ToolCall, 0)
+	return &msg, nil
+}
 
-	return conv, nil
+// encodeImages returns the images of a message as a JSON array, empty for messages without
+// images
+func encodeImages(msg *Message) (string, error) {
+	if len(msg.Images) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(msg.Images)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode message images: %w", err)
+	}
+	return string(data), nil
 }
 
 // ListConversations returns all conversation IDs
@@ -295,12 +586,332 @@ func (d *DB) ListConversations() ([]string, error) {
 	return conversationIDs, nil
 }
 
-// DeleteConversation deletes a conversation and all its messages
+// ListConversationSummaries returns one page of conversations, most recently updated first,
+// together with the total number of conversations. A non-empty tag only includes
+// conversations with that tag.
+func (d *DB) ListConversationSummaries(limit, offset int, tag string) ([]ConversationSummary, int, error) {
+	// An empty tag matches every conversation
+	const filter = `(? = '' OR c.id IN (SELECT conversation_id FROM conversation_tags WHERE tag = ?))`
+
+	var total int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM conversations c WHERE `+filter, tag, tag).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count conversations: %w", err)
+	}
+
+	rows, err := d.db.Query(`
+		SELECT c.id, c.title, c.parent_id, c.created_at, c.updated_at, (SELECT COUNT(*) FROM messages m WHERE m.conversation_id = c.id),
+			(SELECT COALESCE(GROUP_CONCAT(tag, ','), '') FROM (SELECT tag FROM conversation_tags t WHERE t.conversation_id = c.id ORDER BY tag))
+		FROM conversations c
+		WHERE `+filter+`
+		ORDER BY c.updated_at DESC, c.id ASC
+		LIMIT ? OFFSET ?
+	`, tag, tag, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query conversations: %w", err)
+	}
+	defer rows.Close()
+
+	summaries := make([]ConversationSummary, 0)
+	for rows.Next() {
+		var summary ConversationSummary
+		var tags string
+		if err := rows.Scan(&summary.ID, &summary.Title, &summary.ParentID, &summary.CreatedAt, &summary.UpdatedAt, &summary.MessageCount, &tags); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan conversation: %w", err)
+		}
+		// Tags can't contain commas, see ValidateTag
+		if tags != "" {
+			summary.Tags = strings.Split(tags, ",")
+		}
+		summaries = append(summaries, summary)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating conversations: %w", err)
+	}
+
+	return summaries, total, nil
+}
+
+// usageRow is the token usage of one model on one day
+type usageRow struct {
+	Day              string
+	Model            string
+	Requests         int64
+	PromptTokens     int64
+	CompletionTokens int64
+}
+
+// UsageByDay sums the token usage of messages created in [from, to), per UTC day and model
+func (d *DB) UsageByDay(from, to time.Time) ([]usageRow, error) {
+	rows, err := d.db.Query(`
+		SELECT date(created_at) AS day, model, COUNT(*), SUM(prompt_tokens), SUM(completion_tokens)
+		FROM messages
+		WHERE created_at >= ? AND created_at < ? AND (prompt_tokens > 0 OR completion_tokens > 0)
+		GROUP BY day, model
+		ORDER BY day ASC, model ASC
+	`, from.UTC().Format(sqliteTimeFormat), to.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage: %w", err)
+	}
+	defer rows.Close()
+
+	usage := make([]usageRow, 0)
+	for rows.Next() {
+		var row usageRow
+		if err := rows.Scan(&row.Day, &row.Model, &row.Requests, &row.PromptTokens, &row.CompletionTokens); err != nil {
+			return nil, fmt.Errorf("failed to scan usage: %w", err)
+		}
+		usage = append(usage, row)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating usage: %w", err)
+	}
+
+	return usage, nil
+}
+
+// UpdateConversationTitle sets the title of an existing conversation
+func (d *DB) UpdateConversationTitle(conversationID, title string) error {
+	_, err := d.db.Exec(`
+		UPDATE conversations SET title = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?
+	`, title, conversationID)
+	if err != nil {
+		return fmt.Errorf("failed to update conversation title: %w", err)
+	}
+	return nil
+}
+
+// UpdateConversationSystemPrompt sets the system prompt of an existing conversation
+func (d *DB) UpdateConversationSystemPrompt(conversationID, prompt string) error {
+	_, err := d.db.Exec(`
+		UPDATE conversations SET system_prompt = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?
+	`, prompt, conversationID)
+	if err != nil {
+		return fmt.Errorf("failed to update conversation system prompt: %w", err)
+	}
+	return nil
+}
+
+// UpdateConversationWebhookURL sets the webhook of an existing conversation
+func (d *DB) UpdateConversationWebhookURL(conversationID, webhookURL string) error {
+	_, err := d.db.Exec(`
+		UPDATE conversations SET webhook_url = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?
+	`, webhookURL, conversationID)
+	if err != nil {
+		return fmt.Errorf("failed to update conversation webhook: %w", err)
+	}
+	return nil
+}
+
+// AddConversationTag labels an existing conversation with tag, doing nothing if it already has it
+func (d *DB) AddConversationTag(conversationID, tag string) error {
+	_, err := d.db.Exec(`
+		INSERT INTO conversation_tags (conversation_id, tag) VALUES (?, ?)
+		ON CONFLICT(conversation_id, tag) DO NOTHING
+	`, conversationID, tag)
+	if err != nil {
+		return fmt.Errorf("failed to add conversation tag: %w", err)
+	}
+	return nil
+}
+
+// RemoveConversationTag removes a tag from a conversation and reports whether it had the tag
+func (d *DB) RemoveConversationTag(conversationID, tag string) (bool, error) {
+	result, err := d.db.Exec(`DELETE FROM conversation_tags WHERE conversation_id = ? AND tag = ?`, conversationID, tag)
+	if err != nil {
+		return false, fmt.Errorf("failed to remove conversation tag: %w", err)
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to remove conversation tag: %w", err)
+	}
+	return removed > 0, nil
+}
+
+// ConversationTags returns the tags of a conversation in alphabetical order
+func (d *DB) ConversationTags(conversationID string) ([]string, error) {
+	rows, err := d.db.Query(`SELECT tag FROM conversation_tags WHERE conversation_id = ? ORDER BY tag`, conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query conversation tags: %w", err)
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, fmt.Errorf("failed to scan conversation tag: %w", err)
+		}
+		tags = append(tags, tag)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating conversation tags: %w", err)
+	}
+
+	return tags, nil
+}
+
+// IncrementToolCallCount adds one to a conversation's lifetime tool call count
+func (d *DB) IncrementToolCallCount(conversationID string) error {
+	_, err := d.db.Exec(`
+		UPDATE conversations SET tool_call_count = tool_call_count + 1 WHERE id = ?
+	`, conversationID)
+	if err != nil {
+		return fmt.Errorf("failed to update tool call count: %w", err)
+	}
+	return nil
+}
+
+// DeleteConversation deletes a conversation and all its messages. Rows referencing it are
+// deleted explicitly in the same transaction rather than through ON DELETE CASCADE, which
+// only applies on connections with foreign keys enabled and leaves orphans otherwise.
 func (d *DB) DeleteConversation(conversationID string) error {
-	_, err := d.db.Exec(`DELETE FROM conversations WHERE id = ?`, conversationID)
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`DELETE FROM tool_calls WHERE message_id IN (SELECT id FROM messages WHERE conversation_id = ?)`,
+		`DELETE FROM messages_fts WHERE conversation_id = ?`,
+		`DELETE FROM message_embeddings WHERE conversation_id = ?`,
+		`DELETE FROM messages WHERE conversation_id = ?`,
+		`DELETE FROM conversation_tags WHERE conversation_id = ?`,
+		`DELETE FROM schedules WHERE conversation_id = ?`,
+		`DELETE FROM conversations WHERE id = ?`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, conversationID); err != nil {
+			return fmt.Errorf("failed to delete conversation: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// ClearConversationMessages deletes all messages of a conversation with their tool calls,
+// keeping the conversation itself
+func (d *DB) ClearConversationMessages(conversationID string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`DELETE FROM tool_calls WHERE message_id IN (SELECT id FROM messages WHERE conversation_id = ?)`,
+		`DELETE FROM messages_fts WHERE conversation_id = ?`,
+		`DELETE FROM message_embeddings WHERE conversation_id = ?`,
+		`DELETE FROM messages WHERE conversation_id = ?`,
+		`UPDATE conversations SET updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, conversationID); err != nil {
+			return fmt.Errorf("failed to clear conversation: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// SearchMessages returns up to limit indexed messages containing every word of query as a
+// prefix, best matches first, with a snippet of the matching text where matches are wrapped
+// in [ and ]
+func (d *DB) SearchMessages(query string, limit int) ([]SearchResult, error) {
+	rows, err := d.db.Query(`
+		SELECT f.conversation_id, f.message_id, m.role, snippet(messages_fts, 0, '[', ']', '…', 12), m.created_at
+		FROM messages_fts f
+		JOIN messages m ON m.id = f.message_id
+		WHERE messages_fts MATCH ?
+		ORDER BY rank
+		LIMIT ?
+	`, ftsQuery(query), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search messages: %w", err)
+	}
+	defer rows.Close()
+
+	results := make([]SearchResult, 0)
+	for rows.Next() {
+		var result SearchResult
+		if err := rows.Scan(&result.ConversationID, &result.MessageID, &result.Role, &result.Snippet, &result.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan search result: %w", err)
+		}
+		results = append(results, result)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating search results: %w", err)
+	}
+
+	return results, nil
+}
+
+// SaveProcess records a started background process
+func (d *DB) SaveProcess(info *ProcessInfo) error {
+	_, err := d.db.Exec(`
+		INSERT OR REPLACE INTO processes (pid, command, working_dir, conversation_id, started_at, start_ticks)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, info.PID, info.Command, info.WorkingDir, info.ConversationID, info.StartTime.UTC(), int64(info.startTicks))
 	if err != nil {
-		return fmt.Errorf("failed to delete conversation: %w", err)
+		return fmt.Errorf("failed to save process: %w", err)
 	}
 	return nil
 }
 
+// DeleteProcess removes the record of a background process that exited
+func (d *DB) DeleteProcess(pid int) error {
+	_, err := d.db.Exec(`DELETE FROM processes WHERE pid = ?`, pid)
+	if err != nil {
+		return fmt.Errorf("failed to delete process: %w", err)
+	}
+	return nil
+}
+
+// DeleteAllProcesses removes all process records
+func (d *DB) DeleteAllProcesses() error {
+	_, err := d.db.Exec(`DELETE FROM processes`)
+	if err != nil {
+		return fmt.Errorf("failed to delete processes: %w", err)
+	}
+	return nil
+}
+
+// ListProcesses returns all recorded background processes
+func (d *DB) ListProcesses() ([]*ProcessInfo, error) {
+	rows, err := d.db.Query(`
+		SELECT pid, command, working_dir, conversation_id, started_at, start_ticks
+		FROM processes
+		ORDER BY started_at ASC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query processes: %w", err)
+	}
+	defer rows.Close()
+
+	processes := make([]*ProcessInfo, 0)
+	for rows.Next() {
+		var info ProcessInfo
+		var startTicks int64
+		if err := rows.Scan(&info.PID, &info.Command, &info.WorkingDir, &info.ConversationID, &info.StartTime, &startTicks); err != nil {
+			return nil, fmt.Errorf("failed to scan process: %w", err)
+		}
+		info.startTicks = uint64(startTicks)
+		processes = append(processes, &info)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating processes: %w", err)
+	}
+
+	return processes, nil
+}
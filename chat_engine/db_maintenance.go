@@ -0,0 +1,98 @@
+package chat_engine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// vacuumBusyTimeout is how long compaction waits for in-flight writes to finish
+const vacuumBusyTimeout = 30 * time.Second
+
+// VacuumResult reports the database size before and after compaction. Sizes include the
+// write-ahead log, if there is one.
+type VacuumResult struct {
+	SizeBefore int64 `json:"size_before"`
+	SizeAfter  int64 `json:"size_after"`
+	DurationMS int64 `json:"duration_ms"`
+}
+
+// VacuumOptions selects the maintenance done together with VACUUM
+type VacuumOptions struct {
+	// Move the write-ahead log into the database and truncate it
+	Checkpoint bool
+	// Run PRAGMA optimize afterwards, which refreshes the statistics the query planner uses
+	Optimize bool
+}
+
+// Vacuum rebuilds the database file to reclaim the space of deleted rows, see VacuumOptions
+// for what else it does. SQLite's locking keeps this safe while the server is running: it
+// waits for in-flight writes to finish, and other writes wait for it.
+func (d *DB) Vacuum(ctx context.Context, opts VacuumOptions) (*VacuumResult, error) {
+	start := time.Now()
+	result := &VacuumResult{SizeBefore: d.fileSize()}
+
+	// Use a single connection so the busy timeout applies to the statements below
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("PRAGMA busy_timeout = %d", vacuumBusyTimeout.Milliseconds())); err != nil {
+		return nil, fmt.Errorf("failed to set busy timeout: %w", err)
+	}
+	// The connection goes back to the pool
+	defer conn.ExecContext(context.Background(), fmt.Sprintf("PRAGMA busy_timeout = %d", sqliteBusyTimeout.Milliseconds()))
+	if opts.Checkpoint {
+		if _, err := conn.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+			return nil, fmt.Errorf("failed to checkpoint write-ahead log: %w", err)
+		}
+	}
+	if _, err := conn.ExecContext(ctx, "VACUUM"); err != nil {
+		return nil, fmt.Errorf("failed to vacuum database: %w", err)
+	}
+	if opts.Checkpoint {
+		// VACUUM itself goes through the log in WAL mode
+		if _, err := conn.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+			return nil, fmt.Errorf("failed to checkpoint write-ahead log: %w", err)
+		}
+	}
+	if opts.Optimize {
+		if _, err := conn.ExecContext(ctx, "PRAGMA optimize"); err != nil {
+			return nil, fmt.Errorf("failed to optimize database: %w", err)
+		}
+	}
+
+	result.SizeAfter = d.fileSize()
+	result.DurationMS = time.Since(start).Milliseconds()
+	return result, nil
+}
+
+// fileSize returns the size of the database file and its write-ahead log
+func (d *DB) fileSize() int64 {
+	var size int64
+	for _, path := range []string{d.path, d.path + "-wal"} {
+		if info, err := os.Stat(path); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// CompactDatabase vacuums the database, see DB.Vacuum
+func (e *ChatEngine) CompactDatabase(ctx context.Context, opts VacuumOptions) (*VacuumResult, error) {
+	return e.db.Vacuum(ctx, opts)
+}
+
+// Ping checks that the database answers queries
+func (d *DB) Ping(ctx context.Context) error {
+	var one int
+	return d.db.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
+
+// CheckDatabase reports whether the database is reachable, see DB.Ping
+func (e *ChatEngine) CheckDatabase(ctx context.Context) error {
+	return e.db.Ping(ctx)
+}
@@ -0,0 +1,1192 @@
+package chat_engine
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// postgresTables are the tables of the PostgreSQL schema, see postgresMigrations
+var postgresTables = []string{
+	"conversations", "messages", "tool_calls", "processes", "command_audit", "conversation_tags",
+	"message_embeddings", "memories", "schedules",
+}
+
+// PostgresDB is a Store in a PostgreSQL database. It keeps the same data as DB, the SQLite
+// store, in tables of the connection's current schema.
+type PostgresDB struct {
+	db *sql.DB
+}
+
+// NewPostgresDB connects to the PostgreSQL database of a postgres:// URL or a key=value
+// connection string and brings its schema up to date. It needs PostgreSQL 12 or later.
+func NewPostgresDB(dsn string) (*PostgresDB, error) {
+	cfg, err := pq.NewConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PostgreSQL connection string: %w", err)
+	}
+	// Timestamps are read in UTC, like those of the SQLite store
+	if cfg.Runtime == nil {
+		cfg.Runtime = make(map[string]string)
+	}
+	cfg.Runtime["timezone"] = "UTC"
+	connector, err := pq.NewConnectorConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxOpenConns)
+
+	database := &PostgresDB{db: db}
+	if err := database.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate schema: %w", err)
+	}
+	return database, nil
+}
+
+func (d *PostgresDB) Close() error {
+	return d.db.Close()
+}
+
+// Ping checks that the database answers queries
+func (d *PostgresDB) Ping(ctx context.Context) error {
+	var one int
+	return d.db.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
+
+// Vacuum vacuums the tables of the store, with opts.Optimize also refreshing their planner
+// statistics. Unlike SQLite's VACUUM it doesn't lock the tables, the space of deleted rows is
+// reused rather than returned to the operating system. The server manages its write-ahead
+// log itself, so opts.Checkpoint has no effect. Sizes are those of the tables and their
+// indexes.
+func (d *PostgresDB) Vacuum(ctx context.Context, opts VacuumOptions) (*VacuumResult, error) {
+	start := time.Now()
+	result := &VacuumResult{}
+	var err error
+	if result.SizeBefore, err = d.tablesSize(ctx); err != nil {
+		return nil, err
+	}
+
+	statement := "VACUUM "
+	if opts.Optimize {
+		statement = "VACUUM (ANALYZE) "
+	}
+	if _, err := d.db.ExecContext(ctx, statement+strings.Join(postgresTables, ", ")); err != nil {
+		return nil, fmt.Errorf("failed to vacuum database: %w", err)
+	}
+
+	if result.SizeAfter, err = d.tablesSize(ctx); err != nil {
+		return nil, err
+	}
+	result.DurationMS = time.Since(start).Milliseconds()
+	return result, nil
+}
+
+// tablesSize returns the disk space used by the tables of the store and their indexes
+func (d *PostgresDB) tablesSize(ctx context.Context) (int64, error) {
+	var size int64
+	err := d.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(pg_total_relation_size(c.oid)), 0)::BIGINT
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = current_schema() AND c.relkind = 'r' AND c.relname = ANY($1)
+	`, pq.Array(postgresTables)).Scan(&size)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query database size: %w", err)
+	}
+	return size, nil
+}
+
+// SaveConversation creates or updates a conversation
+func (d *PostgresDB) SaveConversation(conv *Conversation) error {
+	_, err := d.db.Exec(`
+		INSERT INTO conversations (id, title, system_prompt, updated_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP)
+		ON CONFLICT (id) DO UPDATE SET title = excluded.title, system_prompt = excluded.system_prompt, updated_at = CURRENT_TIMESTAMP
+	`, conv.ID, conv.Title, conv.SystemPrompt)
+	if err != nil {
+		return fmt.Errorf("failed to save conversation: %w", err)
+	}
+	return nil
+}
+
+// SaveMessage saves a message, creating the conversation if needed
+func (d *PostgresDB) SaveMessage(conversationID string, msg *Message) error {
+	return d.SaveMessages(conversationID, []*Message{msg})
+}
+
+// SaveMessages stores messages of a conversation, e.g. those of a turn, in a single
+// transaction, creating the conversation if needed
+func (d *PostgresDB) SaveMessages(conversationID string, msgs []*Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := ensurePostgresConversation(tx, conversationID); err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if err := insertPostgresMessage(tx, conversationID, msg); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// ensurePostgresConversation creates the conversation within tx if it doesn't exist yet and
+// marks it as updated
+func ensurePostgresConversation(tx *sql.Tx, conversationID string) error {
+	_, err := tx.Exec(`
+		INSERT INTO conversations (id, updated_at)
+		VALUES ($1, CURRENT_TIMESTAMP)
+		ON CONFLICT (id) DO UPDATE SET updated_at = CURRENT_TIMESTAMP
+	`, conversationID)
+	if err != nil {
+		return fmt.Errorf("failed to ensure conversation exists: %w", err)
+	}
+	return nil
+}
+
+// insertPostgresMessage inserts a message of an existing conversation with its tool calls
+// within tx. The search index is a generated column, so it needs no separate insert.
+func insertPostgresMessage(tx *sql.Tx, conversationID string, msg *Message) error {
+	var promptTokens, completionTokens int64
+	if msg.Usage != nil {
+		promptTokens = msg.Usage.PromptTokens
+		completionTokens = msg.Usage.CompletionTokens
+	}
+
+	createdAt := msg.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+
+	images, err := encodeImages(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO messages (id, conversation_id, role, content, tool_call_id, model, prompt_tokens, completion_tokens, raw_content, images, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`, msg.ID, conversationID, msg.Role, msg.Content, msg.TollCallID, msg.Model, promptTokens, completionTokens, msg.RawContent,
+		images, createdAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to insert message: %w", err)
+	}
+
+	return insertPostgresToolCalls(tx, msg)
+}
+
+// insertPostgresToolCalls inserts the tool calls of a message within tx
+func insertPostgresToolCalls(tx *sql.Tx, msg *Message) error {
+	for _, toolCall := range msg.ToolCalls {
+		_, err := tx.Exec(`
+			INSERT INTO tool_calls (message_id, tool_call_id, type, name, arguments)
+			VALUES ($1, $2, $3, $4, $5)
+		`, msg.ID, toolCall.ID, toolCall.Type, toolCall.Name, toolCall.Arguments)
+		if err != nil {
+			return fmt.Errorf("failed to insert tool call: %w", err)
+		}
+	}
+	return nil
+}
+
+// UpdateMessage replaces the role, content and tool calls of a stored message
+func (d *PostgresDB) UpdateMessage(conversationID string, msg *Message) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE messages SET role = $1, content = $2
+		WHERE id = $3 AND conversation_id = $4
+	`, msg.Role, msg.Content, msg.ID, conversationID)
+	if err != nil {
+		return fmt.Errorf("failed to update message: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to update message: %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("message %s not found in conversation %s", msg.ID, conversationID)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM tool_calls WHERE message_id = $1`, msg.ID); err != nil {
+		return fmt.Errorf("failed to delete tool calls: %w", err)
+	}
+	if err := insertPostgresToolCalls(tx, msg); err != nil {
+		return err
+	}
+	// The indexer embeds the new content
+	if _, err := tx.Exec(`DELETE FROM message_embeddings WHERE message_id = $1`, msg.ID); err != nil {
+		return fmt.Errorf("failed to delete embedding: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE conversations SET updated_at = CURRENT_TIMESTAMP WHERE id = $1`, conversationID); err != nil {
+		return fmt.Errorf("failed to update conversation: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// DeleteMessages deletes messages of a conversation together with their tool calls
+func (d *PostgresDB) DeleteMessages(conversationID string, messageIDs []string) error {
+	if len(messageIDs) == 0 {
+		return nil
+	}
+	// Tool calls and embeddings are deleted by their foreign keys
+	_, err := d.db.Exec(`DELETE FROM messages WHERE conversation_id = $1 AND id = ANY($2)`, conversationID, pq.Array(messageIDs))
+	if err != nil {
+		return fmt.Errorf("failed to delete messages: %w", err)
+	}
+	return nil
+}
+
+// CompactMessages replaces messages of a conversation with a summary of them
+func (d *PostgresDB) CompactMessages(conversationID string, messageIDs []string, summary *Message) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM messages WHERE conversation_id = $1 AND id = ANY($2)`, conversationID, pq.Array(messageIDs))
+	if err != nil {
+		return fmt.Errorf("failed to delete messages: %w", err)
+	}
+	if err := ensurePostgresConversation(tx, conversationID); err != nil {
+		return err
+	}
+	if err := insertPostgresMessage(tx, conversationID, summary); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// LoadConversation loads a conversation with all its messages from the database
+func (d *PostgresDB) LoadConversation(conversationID string) (*Conversation, error) {
+	conv := &Conversation{ID: conversationID}
+	err := d.db.QueryRow(`
+		SELECT title, system_prompt, webhook_url, parent_id, tool_call_count, created_at, updated_at FROM conversations WHERE id = $1
+	`, conversationID).Scan(&conv.Title, &conv.SystemPrompt, &conv.WebhookURL, &conv.ParentID, &conv.ToolCallCount, &conv.CreatedAt, &conv.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load conversation: %w", err)
+	}
+
+	conv.Messages, err = d.queryMessages(`
+		SELECT id, role, content, tool_call_id, model, prompt_tokens, completion_tokens, raw_content, images, created_at
+		FROM messages
+		WHERE conversation_id = $1
+		ORDER BY created_at ASC, seq ASC
+	`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	conv.Tags, err = d.ConversationTags(conversationID)
+	if err != nil {
+		return nil, err
+	}
+	return conv, nil
+}
+
+// LoadConversationMessages returns up to limit messages of a conversation starting at offset,
+// oldest first, with their tool calls
+func (d *PostgresDB) LoadConversationMessages(conversationID string, limit, offset int) ([]*Message, error) {
+	return d.queryMessages(`
+		SELECT id, role, content, tool_call_id, model, prompt_tokens, completion_tokens, raw_content, images, created_at
+		FROM messages
+		WHERE conversation_id = $1
+		ORDER BY created_at ASC, seq ASC
+		LIMIT $2 OFFSET $3
+	`, conversationID, limit, offset)
+}
+
+// LoadMessagesAfter returns the messages of a conversation stored after the given message,
+// oldest first, or ErrMessageNotFound if the conversation has no such message
+func (d *PostgresDB) LoadMessagesAfter(conversationID, messageID string) ([]*Message, error) {
+	var exists bool
+	err := d.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM messages WHERE id = $1 AND conversation_id = $2)`, messageID, conversationID).Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up message: %w", err)
+	}
+	if !exists {
+		return nil, ErrMessageNotFound
+	}
+
+	return d.queryMessages(`
+		SELECT id, role, content, tool_call_id, model, prompt_tokens, completion_tokens, raw_content, images, created_at
+		FROM messages
+		WHERE conversation_id = $1
+			AND (created_at, seq) > (SELECT created_at, seq FROM messages WHERE id = $2 AND conversation_id = $1)
+		ORDER BY created_at ASC, seq ASC
+	`, conversationID, messageID)
+}
+
+// CountMessages returns the number of messages in a conversation
+func (d *PostgresDB) CountMessages(conversationID string) (int, error) {
+	var count int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE conversation_id = $1`, conversationID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count messages: %w", err)
+	}
+	return count, nil
+}
+
+// queryMessages runs a query selecting the columns scanMessage reads and loads the tool calls
+// of the returned messages
+func (d *PostgresDB) queryMessages(query string, args ...interface{}) ([]*Message, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := make([]*Message, 0)
+	messageMap := make(map[string]*Message)
+	messageIDs := make([]string, 0)
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+		messageMap[msg.ID] = msg
+		messageIDs = append(messageIDs, msg.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating messages: %w", err)
+	}
+	if len(messages) == 0 {
+		return messages, nil
+	}
+
+	toolRows, err := d.db.Query(`
+		SELECT message_id, tool_call_id, type, name, arguments
+		FROM tool_calls
+		WHERE message_id = ANY($1)
+		ORDER BY id ASC
+	`, pq.Array(messageIDs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tool calls: %w", err)
+	}
+	defer toolRows.Close()
+
+	for toolRows.Next() {
+		var messageID string
+		var toolCall ToolCall
+		if err := toolRows.Scan(&messageID, &toolCall.ID, &toolCall.Type, &toolCall.Name, &toolCall.Arguments); err != nil {
+			return nil, fmt.Errorf("failed to scan tool call: %w", err)
+		}
+		if msg, ok := messageMap[messageID]; ok {
+			msg.ToolCalls = append(msg.ToolCalls, toolCall)
+		}
+	}
+	if err := toolRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating tool calls: %w", err)
+	}
+	return messages, nil
+}
+
+// ListConversations returns all conversation IDs, most recently updated first
+func (d *PostgresDB) ListConversations() ([]string, error) {
+	rows, err := d.db.Query(`SELECT id FROM conversations ORDER BY updated_at DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query conversations: %w", err)
+	}
+	defer rows.Close()
+
+	conversationIDs := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan conversation ID: %w", err)
+		}
+		conversationIDs = append(conversationIDs, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating conversations: %w", err)
+	}
+	return conversationIDs, nil
+}
+
+// ListConversationSummaries returns one page of conversations, most recently updated first,
+// together with the total number of conversations. A non-empty tag only includes
+// conversations with that tag.
+func (d *PostgresDB) ListConversationSummaries(limit, offset int, tag string) ([]ConversationSummary, int, error) {
+	// An empty tag matches every conversation
+	const filter = `($1 = '' OR c.id IN (SELECT conversation_id FROM conversation_tags WHERE tag = $1))`
+
+	var total int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM conversations c WHERE `+filter, tag).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count conversations: %w", err)
+	}
+
+	rows, err := d.db.Query(`
+		SELECT c.id, c.title, c.parent_id, c.created_at, c.updated_at, (SELECT COUNT(*) FROM messages m WHERE m.conversation_id = c.id),
+			(SELECT COALESCE(string_agg(t.tag, ',' ORDER BY t.tag), '') FROM conversation_tags t WHERE t.conversation_id = c.id)
+		FROM conversations c
+		WHERE `+filter+`
+		ORDER BY c.updated_at DESC, c.id ASC
+		LIMIT $2 OFFSET $3
+	`, tag, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query conversations: %w", err)
+	}
+	defer rows.Close()
+
+	summaries := make([]ConversationSummary, 0)
+	for rows.Next() {
+		var summary ConversationSummary
+		var tags string
+		if err := rows.Scan(&summary.ID, &summary.Title, &summary.ParentID, &summary.CreatedAt, &summary.UpdatedAt, &summary.MessageCount, &tags); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan conversation: %w", err)
+		}
+		// Tags can't contain commas, see ValidateTag
+		if tags != "" {
+			summary.Tags = strings.Split(tags, ",")
+		}
+		summaries = append(summaries, summary)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating conversations: %w", err)
+	}
+	return summaries, total, nil
+}
+
+// UsageByDay sums the token usage of messages created in [from, to), per UTC day and model
+func (d *PostgresDB) UsageByDay(from, to time.Time) ([]usageRow, error) {
+	rows, err := d.db.Query(`
+		SELECT to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day, model, COUNT(*),
+			SUM(prompt_tokens)::BIGINT, SUM(completion_tokens)::BIGINT
+		FROM messages
+		WHERE created_at >= $1 AND created_at < $2 AND (prompt_tokens > 0 OR completion_tokens > 0)
+		GROUP BY day, model
+		ORDER BY day ASC, model ASC
+	`, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage: %w", err)
+	}
+	defer rows.Close()
+
+	usage := make([]usageRow, 0)
+	for rows.Next() {
+		var row usageRow
+		if err := rows.Scan(&row.Day, &row.Model, &row.Requests, &row.PromptTokens, &row.CompletionTokens); err != nil {
+			return nil, fmt.Errorf("failed to scan usage: %w", err)
+		}
+		usage = append(usage, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating usage: %w", err)
+	}
+	return usage, nil
+}
+
+// updateConversation sets a column of an existing conversation and marks it as updated
+func (d *PostgresDB) updateConversation(conversationID, column, value string) error {
+	_, err := d.db.Exec(`UPDATE conversations SET `+column+` = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`, value, conversationID)
+	if err != nil {
+		return fmt.Errorf("failed to update conversation %s: %w", strings.ReplaceAll(column, "_", " "), err)
+	}
+	return nil
+}
+
+// UpdateConversationTitle sets the title of an existing conversation
+func (d *PostgresDB) UpdateConversationTitle(conversationID, title string) error {
+	return d.updateConversation(conversationID, "title", title)
+}
+
+// UpdateConversationSystemPrompt sets the system prompt of an existing conversation
+func (d *PostgresDB) UpdateConversationSystemPrompt(conversationID, prompt string) error {
+	return d.updateConversation(conversationID, "system_prompt", prompt)
+}
+
+// UpdateConversationWebhookURL sets the webhook of an existing conversation
+func (d *PostgresDB) UpdateConversationWebhookURL(conversationID, webhookURL string) error {
+	return d.updateConversation(conversationID, "webhook_url", webhookURL)
+}
+
+// AddConversationTag labels an existing conversation with tag, doing nothing if it already has it
+func (d *PostgresDB) AddConversationTag(conversationID, tag string) error {
+	_, err := d.db.Exec(`
+		INSERT INTO conversation_tags (conversation_id, tag) VALUES ($1, $2)
+		ON CONFLICT (conversation_id, tag) DO NOTHING
+	`, conversationID, tag)
+	if err != nil {
+		return fmt.Errorf("failed to add conversation tag: %w", err)
+	}
+	return nil
+}
+
+// RemoveConversationTag removes a tag from a conversation and reports whether it had the tag
+func (d *PostgresDB) RemoveConversationTag(conversationID, tag string) (bool, error) {
+	result, err := d.db.Exec(`DELETE FROM conversation_tags WHERE conversation_id = $1 AND tag = $2`, conversationID, tag)
+	if err != nil {
+		return false, fmt.Errorf("failed to remove conversation tag: %w", err)
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to remove conversation tag: %w", err)
+	}
+	return removed > 0, nil
+}
+
+// ConversationTags returns the tags of a conversation in alphabetical order
+func (d *PostgresDB) ConversationTags(conversationID string) ([]string, error) {
+	rows, err := d.db.Query(`SELECT tag FROM conversation_tags WHERE conversation_id = $1 ORDER BY tag`, conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query conversation tags: %w", err)
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, fmt.Errorf("failed to scan conversation tag: %w", err)
+		}
+		tags = append(tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating conversation tags: %w", err)
+	}
+	return tags, nil
+}
+
+// IncrementToolCallCount adds one to a conversation's lifetime tool call count
+func (d *PostgresDB) IncrementToolCallCount(conversationID string) error {
+	_, err := d.db.Exec(`UPDATE conversations SET tool_call_count = tool_call_count + 1 WHERE id = $1`, conversationID)
+	if err != nil {
+		return fmt.Errorf("failed to update tool call count: %w", err)
+	}
+	return nil
+}
+
+// DeleteConversation deletes a conversation and everything referring to it. PostgreSQL always
+// enforces foreign keys, so their cascades delete the messages, tool calls,
+// embeddings, tags and schedules.
+func (d *PostgresDB) DeleteConversation(conversationID string) error {
+	if _, err := d.db.Exec(`DELETE FROM conversations WHERE id = $1`, conversationID); err != nil {
+		return fmt.Errorf("failed to delete conversation: %w", err)
+	}
+	return nil
+}
+
+// ClearConversationMessages deletes all messages of a conversation with their tool calls,
+// keeping the conversation itself
+func (d *PostgresDB) ClearConversationMessages(conversationID string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM messages WHERE conversation_id = $1`, conversationID); err != nil {
+		return fmt.Errorf("failed to clear conversation: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE conversations SET updated_at = CURRENT_TIMESTAMP WHERE id = $1`, conversationID); err != nil {
+		return fmt.Errorf("failed to clear conversation: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// CopyConversation copies a conversation into a new one, see DB.CopyConversation
+func (d *PostgresDB) CopyConversation(sourceID, targetID, throughMessageID, parentID string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO conversations (id, title, system_prompt, parent_id)
+		SELECT $1, title, system_prompt, $2 FROM conversations WHERE id = $3
+	`, targetID, parentID, sourceID)
+	if err != nil {
+		return fmt.Errorf("failed to create conversation copy: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to create conversation copy: %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("conversation %s not found", sourceID)
+	}
+
+	rows, err := tx.Query(`SELECT id FROM messages WHERE conversation_id = $1 ORDER BY created_at ASC, seq ASC`, sourceID)
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+	var messageIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan message: %w", err)
+		}
+		messageIDs = append(messageIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating messages: %w", err)
+	}
+
+	if throughMessageID != "" {
+		end := -1
+		for i, id := range messageIDs {
+			if id == throughMessageID {
+				end = i
+				break
+			}
+		}
+		if end == -1 {
+			return ErrMessageNotFound
+		}
+		messageIDs = messageIDs[:end+1]
+	}
+
+	// New IDs follow the msg_<nanoseconds> scheme, kept increasing within the copy
+	var lastNano int64
+	for _, oldID := range messageIDs {
+		nano := time.Now().UnixNano()
+		if nano <= lastNano {
+			nano = lastNano + 1
+		}
+		lastNano = nano
+		newID := fmt.Sprintf("msg_%d", nano)
+
+		_, err := tx.Exec(`
+			INSERT INTO messages (id, conversation_id, role, content, tool_call_id, model, prompt_tokens, completion_tokens, raw_content, images, created_at)
+			SELECT $1, $2, role, content, tool_call_id, model, prompt_tokens, completion_tokens, raw_content, images, created_at
+			FROM messages WHERE id = $3
+		`, newID, targetID, oldID)
+		if err != nil {
+			return fmt.Errorf("failed to copy message %s: %w", oldID, err)
+		}
+		_, err = tx.Exec(`
+			INSERT INTO tool_calls (message_id, tool_call_id, type, name, arguments)
+			SELECT $1, tool_call_id, type, name, arguments FROM tool_calls WHERE message_id = $2 ORDER BY id ASC
+		`, newID, oldID)
+		if err != nil {
+			return fmt.Errorf("failed to copy tool calls of message %s: %w", oldID, err)
+		}
+		_, err = tx.Exec(`
+			INSERT INTO message_embeddings (message_id, conversation_id, vector)
+			SELECT $1, $2, vector FROM message_embeddings WHERE message_id = $3
+		`, newID, targetID, oldID)
+		if err != nil {
+			return fmt.Errorf("failed to copy embedding of message %s: %w", oldID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// ImportConversation creates conv with all its messages in a single transaction
+func (d *PostgresDB) ImportConversation(conv *Conversation) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO conversations (id, title, system_prompt)
+		VALUES ($1, $2, $3)
+	`, conv.ID, conv.Title, conv.SystemPrompt)
+	if err != nil {
+		return fmt.Errorf("failed to create conversation: %w", err)
+	}
+	for _, msg := range conv.Messages {
+		if err := insertPostgresMessage(tx, conv.ID, msg); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// ConversationStats aggregates the messages, tool calls, token usage and background
+// processes of a conversation
+func (d *PostgresDB) ConversationStats(conversationID string) (*ConversationStats, error) {
+	stats := &ConversationStats{
+		ConversationID:  conversationID,
+		MessagesByRole:  make(map[string]int64),
+		ToolCallsByName: make(map[string]int64),
+	}
+
+	rows, err := d.db.Query(`
+		SELECT role, COUNT(*), SUM(prompt_tokens)::BIGINT, SUM(completion_tokens)::BIGINT
+		FROM messages WHERE conversation_id = $1
+		GROUP BY role
+	`, conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query message stats: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var role string
+		var count, promptTokens, completionTokens int64
+		if err := rows.Scan(&role, &count, &promptTokens, &completionTokens); err != nil {
+			return nil, fmt.Errorf("failed to scan message stats: %w", err)
+		}
+		stats.MessagesByRole[role] = count
+		stats.MessageCount += count
+		stats.PromptTokens += promptTokens
+		stats.CompletionTokens += completionTokens
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating message stats: %w", err)
+	}
+	stats.TotalTokens = stats.PromptTokens + stats.CompletionTokens
+
+	toolRows, err := d.db.Query(`
+		SELECT tc.name, COUNT(*)
+		FROM tool_calls tc JOIN messages m ON m.id = tc.message_id
+		WHERE m.conversation_id = $1
+		GROUP BY tc.name
+	`, conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tool call stats: %w", err)
+	}
+	defer toolRows.Close()
+	for toolRows.Next() {
+		var name string
+		var count int64
+		if err := toolRows.Scan(&name, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan tool call stats: %w", err)
+		}
+		stats.ToolCallsByName[name] = count
+	}
+	if err := toolRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating tool call stats: %w", err)
+	}
+
+	var first, last sql.NullTime
+	err = d.db.QueryRow(`SELECT MIN(created_at), MAX(created_at) FROM messages WHERE conversation_id = $1`, conversationID).Scan(&first, &last)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query message times: %w", err)
+	}
+	if first.Valid {
+		stats.FirstMessageAt = &first.Time
+		stats.LastMessageAt = &last.Time
+	}
+
+	err = d.db.QueryRow(`
+		SELECT COUNT(*) FROM command_audit WHERE conversation_id = $1 AND background AND pid != 0
+	`, conversationID).Scan(&stats.BackgroundProcesses)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count background processes: %w", err)
+	}
+
+	return stats, nil
+}
+
+// SearchMessages returns up to limit user and assistant messages containing every word of
+// query as a prefix, best matches first, with a snippet of the matching text where matches
+// are wrapped in [ and ]
+func (d *PostgresDB) SearchMessages(query string, limit int) ([]SearchResult, error) {
+	rows, err := d.db.Query(`
+		SELECT m.conversation_id, m.id, m.role,
+			ts_headline('simple', m.content, q.query, 'StartSel=[, StopSel=], MinWords=6, MaxWords=12'), m.created_at
+		FROM messages m, to_tsquery('simple', $1) AS q(query)
+		WHERE m.search_vector @@ q.query
+		ORDER BY ts_rank(m.search_vector, q.query) DESC, m.created_at ASC, m.seq ASC
+		LIMIT $2
+	`, tsQuery(query), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search messages: %w", err)
+	}
+	defer rows.Close()
+
+	results := make([]SearchResult, 0)
+	for rows.Next() {
+		var result SearchResult
+		if err := rows.Scan(&result.ConversationID, &result.MessageID, &result.Role, &result.Snippet, &result.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan search result: %w", err)
+		}
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating search results: %w", err)
+	}
+	return results, nil
+}
+
+// tsQuery turns free text into a text search query matching all of its words as prefixes,
+// like ftsQuery does for SQLite. Each word is quoted so that operators in the input are
+// matched literally.
+func tsQuery(text string) string {
+	words := strings.Fields(text)
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		word = strings.ReplaceAll(strings.ReplaceAll(word, `\`, `\\`), `'`, `''`)
+		terms = append(terms, `'`+word+`':*`)
+	}
+	return strings.Join(terms, " & ")
+}
+
+// messagesWithoutEmbedding returns up to limit searchable messages that have no embedding
+func (d *PostgresDB) messagesWithoutEmbedding(limit int) ([]pendingEmbedding, error) {
+	rows, err := d.db.Query(`
+		SELECT m.id, m.conversation_id, m.content
+		FROM messages m
+		LEFT JOIN message_embeddings e ON e.message_id = m.id
+		WHERE e.message_id IS NULL AND m.role IN ('user', 'assistant') AND m.content != ''
+		ORDER BY m.created_at ASC, m.seq ASC
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages to embed: %w", err)
+	}
+	defer rows.Close()
+
+	var pending []pendingEmbedding
+	for rows.Next() {
+		var msg pendingEmbedding
+		if err := rows.Scan(&msg.ID, &msg.ConversationID, &msg.Content); err != nil {
+			return nil, fmt.Errorf("failed to scan message to embed: %w", err)
+		}
+		pending = append(pending, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating messages to embed: %w", err)
+	}
+	return pending, nil
+}
+
+// SaveEmbedding stores the embedding of a message. A message deleted in the meantime is
+// skipped.
+func (d *PostgresDB) SaveEmbedding(messageID, conversationID string, vector []float32) error {
+	_, err := d.db.Exec(`
+		INSERT INTO message_embeddings (message_id, conversation_id, vector)
+		SELECT id, conversation_id, $1::BYTEA FROM messages WHERE id = $2 AND conversation_id = $3
+		ON CONFLICT (message_id) DO UPDATE SET vector = excluded.vector, created_at = CURRENT_TIMESTAMP
+	`, encodeVector(vector), messageID, conversationID)
+	if err != nil {
+		return fmt.Errorf("failed to save embedding: %w", err)
+	}
+	return nil
+}
+
+// NearestMessages returns up to limit embedded messages with the highest cosine similarity
+// to vector, best first, see DB.NearestMessages
+func (d *PostgresDB) NearestMessages(vector []float32, limit int) ([]SearchResult, error) {
+	rows, err := d.db.Query(`SELECT message_id, vector FROM message_embeddings`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query embeddings: %w", err)
+	}
+	candidates, err := nearestEmbeddings(rows, vector, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]SearchResult, 0, len(candidates))
+	for _, candidate := range candidates {
+		result := SearchResult{MessageID: candidate.messageID, Score: candidate.score}
+		var content string
+		err := d.db.QueryRow(`
+			SELECT conversation_id, role, content, created_at FROM messages WHERE id = $1
+		`, candidate.messageID).Scan(&result.ConversationID, &result.Role, &content, &result.CreatedAt)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load search result: %w", err)
+		}
+		result.Snippet = semanticSnippet(content)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// RecordCommand adds an entry to the command audit log and sets its ID
+func (d *PostgresDB) RecordCommand(entry *CommandAuditEntry) error {
+	err := d.db.QueryRow(`
+		INSERT INTO command_audit (conversation_id, request_id, tool, command, working_dir, background, pid, exit_code, error, duration_ms, started_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id
+	`, entry.ConversationID, entry.RequestID, entry.Tool, entry.Command, entry.WorkingDir, entry.Background, entry.PID,
+		entry.ExitCode, entry.Error, entry.DurationMS, entry.StartedAt.UTC()).Scan(&entry.ID)
+	if err != nil {
+		return fmt.Errorf("failed to record command: %w", err)
+	}
+	return nil
+}
+
+// FinishAuditedCommand records the exit code and run time of a background command
+func (d *PostgresDB) FinishAuditedCommand(id int64, exitCode int, duration time.Duration) error {
+	_, err := d.db.Exec(`UPDATE command_audit SET exit_code = $1, duration_ms = $2 WHERE id = $3`,
+		exitCode, duration.Milliseconds(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update audit entry %d: %w", id, err)
+	}
+	return nil
+}
+
+// ListCommandAudit returns a page of the command audit log, most recent first, and the number
+// of entries in total. An empty conversation ID lists the commands of all conversations.
+func (d *PostgresDB) ListCommandAudit(conversationID string, limit, offset int) ([]CommandAuditEntry, int, error) {
+	var total int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM command_audit WHERE $1 = '' OR conversation_id = $1`, conversationID).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to count audit entries: %w", err)
+	}
+
+	rows, err := d.db.Query(`
+		SELECT id, conversation_id, request_id, tool, command, working_dir, background, pid, exit_code, error, duration_ms, started_at
+		FROM command_audit
+		WHERE $1 = '' OR conversation_id = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3
+	`, conversationID, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query audit entries: %w", err)
+	}
+	defer rows.Close()
+
+	entries := make([]CommandAuditEntry, 0)
+	for rows.Next() {
+		var entry CommandAuditEntry
+		var exitCode sql.NullInt64
+		err := rows.Scan(&entry.ID, &entry.ConversationID, &entry.RequestID, &entry.Tool, &entry.Command, &entry.WorkingDir,
+			&entry.Background, &entry.PID, &exitCode, &entry.Error, &entry.DurationMS, &entry.StartedAt)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to scan audit entry: %w", err)
+		}
+		if exitCode.Valid {
+			code := int(exitCode.Int64)
+			entry.ExitCode = &code
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating audit entries: %w", err)
+	}
+	return entries, total, nil
+}
+
+// SaveProcess records a started background process
+func (d *PostgresDB) SaveProcess(info *ProcessInfo) error {
+	_, err := d.db.Exec(`
+		INSERT INTO processes (pid, command, working_dir, conversation_id, started_at, start_ticks)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (pid) DO UPDATE SET command = excluded.command, working_dir = excluded.working_dir,
+			conversation_id = excluded.conversation_id, started_at = excluded.started_at, start_ticks = excluded.start_ticks
+	`, info.PID, info.Command, info.WorkingDir, info.ConversationID, info.StartTime.UTC(), int64(info.startTicks))
+	if err != nil {
+		return fmt.Errorf("failed to save process: %w", err)
+	}
+	return nil
+}
+
+// DeleteProcess removes the record of a background process that exited
+func (d *PostgresDB) DeleteProcess(pid int) error {
+	if _, err := d.db.Exec(`DELETE FROM processes WHERE pid = $1`, pid); err != nil {
+		return fmt.Errorf("failed to delete process: %w", err)
+	}
+	return nil
+}
+
+// DeleteAllProcesses removes all process records
+func (d *PostgresDB) DeleteAllProcesses() error {
+	if _, err := d.db.Exec(`DELETE FROM processes`); err != nil {
+		return fmt.Errorf("failed to delete processes: %w", err)
+	}
+	return nil
+}
+
+// ListProcesses returns all recorded background processes
+func (d *PostgresDB) ListProcesses() ([]*ProcessInfo, error) {
+	rows, err := d.db.Query(`
+		SELECT pid, command, working_dir, conversation_id, started_at, start_ticks
+		FROM processes
+		ORDER BY started_at ASC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query processes: %w", err)
+	}
+	defer rows.Close()
+
+	processes := make([]*ProcessInfo, 0)
+	for rows.Next() {
+		var info ProcessInfo
+		var startTicks int64
+		if err := rows.Scan(&info.PID, &info.Command, &info.WorkingDir, &info.ConversationID, &info.StartTime, &startTicks); err != nil {
+			return nil, fmt.Errorf("failed to scan process: %w", err)
+		}
+		info.startTicks = uint64(startTicks)
+		processes = append(processes, &info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating processes: %w", err)
+	}
+	return processes, nil
+}
+
+// SaveMemory stores a memory, replacing the value of an existing one
+func (d *PostgresDB) SaveMemory(namespace, key, value string) (*Memory, error) {
+	memory := Memory{Namespace: namespace, Key: key, Value: value}
+	err := d.db.QueryRow(`
+		INSERT INTO memories (namespace, key, value) VALUES ($1, $2, $3)
+		ON CONFLICT (namespace, key) DO UPDATE SET value = excluded.value, updated_at = CURRENT_TIMESTAMP
+		RETURNING created_at, updated_at
+	`, namespace, key, value).Scan(&memory.CreatedAt, &memory.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save memory: %w", err)
+	}
+	return &memory, nil
+}
+
+// Memories returns up to limit memories of a namespace whose key or value contains query,
+// ignoring case, most recently updated first
+func (d *PostgresDB) Memories(namespace, query string, limit int) ([]Memory, error) {
+	rows, err := d.db.Query(`
+		SELECT namespace, key, value, created_at, updated_at FROM memories
+		WHERE namespace = $1 AND (strpos(lower(key), lower($2)) > 0 OR strpos(lower(value), lower($2)) > 0)
+		ORDER BY updated_at DESC, key ASC
+		LIMIT $3
+	`, namespace, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query memories: %w", err)
+	}
+	defer rows.Close()
+
+	memories := make([]Memory, 0)
+	for rows.Next() {
+		var memory Memory
+		if err := rows.Scan(&memory.Namespace, &memory.Key, &memory.Value, &memory.CreatedAt, &memory.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan memory: %w", err)
+		}
+		memories = append(memories, memory)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating memories: %w", err)
+	}
+	return memories, nil
+}
+
+// DeleteMemory deletes a memory and reports whether it existed
+func (d *PostgresDB) DeleteMemory(namespace, key string) (bool, error) {
+	result, err := d.db.Exec(`DELETE FROM memories WHERE namespace = $1 AND key = $2`, namespace, key)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete memory: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete memory: %w", err)
+	}
+	return deleted > 0, nil
+}
+
+// SaveSchedule stores a new schedule
+func (d *PostgresDB) SaveSchedule(schedule *Schedule) error {
+	_, err := d.db.Exec(`
+		INSERT INTO schedules (id, conversation_id, command, working_dir, interval_seconds, cron, next_run_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, schedule.ID, schedule.ConversationID, schedule.Command, schedule.WorkingDir, schedule.IntervalSeconds,
+		schedule.Cron, schedule.NextRunAt.UTC(), schedule.CreatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to save schedule: %w", err)
+	}
+	return nil
+}
+
+// UpdateScheduleRun records that a schedule ran at lastRun and runs next at nextRun
+func (d *PostgresDB) UpdateScheduleRun(id string, lastRun, nextRun time.Time) error {
+	_, err := d.db.Exec(`UPDATE schedules SET last_run_at = $1, next_run_at = $2 WHERE id = $3`, lastRun.UTC(), nextRun.UTC(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update schedule: %w", err)
+	}
+	return nil
+}
+
+// CountSchedules returns how many schedules a conversation has
+func (d *PostgresDB) CountSchedules(conversationID string) (int, error) {
+	var count int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM schedules WHERE conversation_id = $1`, conversationID).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count schedules: %w", err)
+	}
+	return count, nil
+}
+
+// ListSchedules returns the schedules of a conversation, or all of them when conversationID
+// is empty, oldest first
+func (d *PostgresDB) ListSchedules(conversationID string) ([]Schedule, error) {
+	rows, err := d.db.Query(`
+		SELECT id, conversation_id, command, working_dir, interval_seconds, cron, next_run_at, last_run_at, created_at
+		FROM schedules
+		WHERE $1 = '' OR conversation_id = $1
+		ORDER BY created_at ASC, id ASC
+	`, conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schedules: %w", err)
+	}
+	defer rows.Close()
+
+	schedules := make([]Schedule, 0)
+	for rows.Next() {
+		var schedule Schedule
+		var lastRunAt sql.NullTime
+		err := rows.Scan(&schedule.ID, &schedule.ConversationID, &schedule.Command, &schedule.WorkingDir,
+			&schedule.IntervalSeconds, &schedule.Cron, &schedule.NextRunAt, &lastRunAt, &schedule.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan schedule: %w", err)
+		}
+		if lastRunAt.Valid {
+			schedule.LastRunAt = &lastRunAt.Time
+		}
+		schedules = append(schedules, schedule)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating schedules: %w", err)
+	}
+	return schedules, nil
+}
+
+// DeleteSchedule deletes a schedule and reports whether it existed
+func (d *PostgresDB) DeleteSchedule(id string) (bool, error) {
+	result, err := d.db.Exec(`DELETE FROM schedules WHERE id = $1`, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete schedule: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete schedule: %w", err)
+	}
+	return deleted > 0, nil
+}
@@ -0,0 +1,294 @@
+package chat_engine
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestDB opens a database in a temporary directory
+func newTestDB(t testing.TB) *DB {
+	t.Helper()
+	db, err := NewDB(filepath.Join(t.TempDir(), "agent.db"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// turnMessages returns the messages of a turn with n tool calls answered one by one
+func turnMessages(prefix string, n int) []*Message {
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	messages := []*Message{{ID: prefix + "_user", Role: "user", Content: "run the tools", CreatedAt: created}}
+	for i := 0; i < n; i++ {
+		callID := fmt.Sprintf("%s_call_%d", prefix, i)
+		messages = append(messages,
+			&Message{
+				ID:        fmt.Sprintf("%s_assistant_%d", prefix, i),
+				Role:      "assistant",
+				ToolCalls: []ToolCall{{ID: callID, Type: "function", Name: "bash_command", Arguments: fmt.Sprintf(`{"command": "echo %d"}`, i)}},
+				CreatedAt: created,
+			},
+			&Message{ID: fmt.Sprintf("%s_tool_%d", prefix, i), Role: "tool", Content: fmt.Sprint(i), TollCallID: callID, CreatedAt: created},
+		)
+	}
+	return append(messages, &Message{ID: prefix + "_reply", Role: "assistant", Content: "done", CreatedAt: created})
+}
+
+func TestSaveMessages(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db engineStore) {
+		saved := turnMessages("turn", 3)
+
+		if err := db.SaveMessages("conv", saved); err != nil {
+			t.Fatalf("SaveMessages: %v", err)
+		}
+
+		conv, err := db.LoadConversation("conv")
+		if err != nil {
+			t.Fatalf("LoadConversation: %v", err)
+		}
+		if conv == nil {
+			t.Fatal("conversation was not created")
+		}
+		if len(conv.Messages) != len(saved) {
+			t.Fatalf("loaded %d messages, want %d", len(conv.Messages), len(saved))
+		}
+		// Messages created in the same instant keep the order they were saved in
+		for i, msg := range conv.Messages {
+			want := saved[i]
+			if msg.ID != want.ID || msg.Role != want.Role || msg.Content != want.Content || msg.TollCallID != want.TollCallID {
+				t.Errorf("message %d = %+v, want %+v", i, msg, want)
+			}
+			if len(msg.ToolCalls) != len(want.ToolCalls) {
+				t.Errorf("message %s has %d tool calls, want %d", msg.ID, len(msg.ToolCalls), len(want.ToolCalls))
+				continue
+			}
+			for j, toolCall := range msg.ToolCalls {
+				if toolCall != want.ToolCalls[j] {
+					t.Errorf("tool call %d of message %s = %+v, want %+v", j, msg.ID, toolCall, want.ToolCalls[j])
+				}
+			}
+		}
+	})
+}
+
+func TestSaveMessagesIsAtomic(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db engineStore) {
+		if err := db.SaveMessages("conv", turnMessages("first", 1)); err != nil {
+			t.Fatalf("SaveMessages: %v", err)
+		}
+
+		// The last message repeats an ID, so nothing of the batch may be stored
+		batch := turnMessages("second", 1)
+		batch = append(batch, &Message{ID: "first_user", Role: "user", Content: "duplicate"})
+		if err := db.SaveMessages("conv", batch); err == nil {
+			t.Fatal("SaveMessages stored a duplicate message ID")
+		}
+
+		count, err := db.CountMessages("conv")
+		if err != nil {
+			t.Fatalf("CountMessages: %v", err)
+		}
+		if want := len(turnMessages("first", 1)); count != want {
+			t.Errorf("conversation has %d messages, want the %d of the first batch", count, want)
+		}
+	})
+}
+
+func BenchmarkSaveMessages(b *testing.B) {
+	db := newTestDB(b)
+	for i := 0; i < b.N; i++ {
+		if err := db.SaveMessages("conv", turnMessages(fmt.Sprintf("turn%d", i), 5)); err != nil {
+			b.Fatalf("SaveMessages: %v", err)
+		}
+	}
+}
+
+// BenchmarkSaveMessageOneByOne saves the same turns as BenchmarkSaveMessages, a transaction
+// per message
+func BenchmarkSaveMessageOneByOne(b *testing.B) {
+	db := newTestDB(b)
+	for i := 0; i < b.N; i++ {
+		for _, msg := range turnMessages(fmt.Sprintf("turn%d", i), 5) {
+			if err := db.SaveMessage("conv", msg); err != nil {
+				b.Fatalf("SaveMessage: %v", err)
+			}
+		}
+	}
+}
+
+func TestDBUsesWAL(t *testing.T) {
+	db := newTestDB(t)
+
+	// Every pooled connection is set up the same way, so ask a few of them at once
+	conns := make([]*sql.Conn, 3)
+	for i := range conns {
+		conn, err := db.db.Conn(context.Background())
+		if err != nil {
+			t.Fatalf("Conn: %v", err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	for i, conn := range conns {
+		var mode string
+		var busyTimeout, foreignKeys int
+		row := conn.QueryRowContext(context.Background(), `SELECT * FROM pragma_journal_mode, pragma_busy_timeout, pragma_foreign_keys`)
+		if err := row.Scan(&mode, &busyTimeout, &foreignKeys); err != nil {
+			t.Fatalf("reading pragmas: %v", err)
+		}
+		if mode != "wal" {
+			t.Errorf("connection %d: journal_mode = %q, want wal", i, mode)
+		}
+		if busyTimeout != int(sqliteBusyTimeout.Milliseconds()) {
+			t.Errorf("connection %d: busy_timeout = %d, want %d", i, busyTimeout, sqliteBusyTimeout.Milliseconds())
+		}
+		if foreignKeys != 1 {
+			t.Errorf("connection %d: foreign_keys = %d, want 1", i, foreignKeys)
+		}
+	}
+}
+
+func TestDBConcurrentReadsAndWrites(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.SaveMessages("conv", turnMessages("first", 1)); err != nil {
+		t.Fatalf("SaveMessages: %v", err)
+	}
+
+	const writers, readers, rounds = 4, 4, 20
+	errs := make(chan error, (writers+readers)*rounds)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				errs <- db.SaveMessages(fmt.Sprintf("conv%d", w), turnMessages(fmt.Sprintf("w%d_%d", w, i), 2))
+			}
+		}()
+	}
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				_, err := db.LoadConversation("conv")
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent access failed: %v", err)
+		}
+	}
+	for w := 0; w < writers; w++ {
+		count, err := db.CountMessages(fmt.Sprintf("conv%d", w))
+		if err != nil {
+			t.Fatalf("CountMessages: %v", err)
+		}
+		if want := rounds * len(turnMessages("x", 2)); count != want {
+			t.Errorf("conversation %d has %d messages, want %d", w, count, want)
+		}
+	}
+}
+
+func TestDBReadsDuringWriteTransaction(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.SaveMessages("conv", turnMessages("first", 1)); err != nil {
+		t.Fatalf("SaveMessages: %v", err)
+	}
+
+	// A write transaction holds the write lock until it ends
+	tx, err := db.db.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	defer tx.Rollback()
+	if err := ensureConversation(tx, "conv"); err != nil {
+		t.Fatalf("ensureConversation: %v", err)
+	}
+
+	// In WAL mode readers neither wait for it nor fail
+	start := time.Now()
+	conv, err := db.LoadConversation("conv")
+	if err != nil {
+		t.Fatalf("LoadConversation during a write: %v", err)
+	}
+	if len(conv.Messages) != len(turnMessages("first", 1)) {
+		t.Errorf("loaded %d messages, want the committed ones", len(conv.Messages))
+	}
+	if elapsed := time.Since(start); elapsed > sqliteBusyTimeout/2 {
+		t.Errorf("read took %s, it waited for the writer", elapsed)
+	}
+}
+
+// conversationRows counts the rows of every table that refer to a conversation
+func conversationRows(t *testing.T, db *DB, conversationID string) map[string]int {
+	t.Helper()
+	queries := map[string]string{
+		"conversations": `SELECT COUNT(*) FROM conversations WHERE id = ?`,
+		"messages":      `SELECT COUNT(*) FROM messages WHERE conversation_id = ?`,
+		// Message IDs of the test conversations start with the conversation ID
+		"tool_calls":         `SELECT COUNT(*) FROM tool_calls WHERE instr(message_id, ?) = 1`,
+		"messages_fts":       `SELECT COUNT(*) FROM messages_fts WHERE conversation_id = ?`,
+		"message_embeddings": `SELECT COUNT(*) FROM message_embeddings WHERE conversation_id = ?`,
+		"conversation_tags":  `SELECT COUNT(*) FROM conversation_tags WHERE conversation_id = ?`,
+		"schedules":          `SELECT COUNT(*) FROM schedules WHERE conversation_id = ?`,
+	}
+	counts := make(map[string]int)
+	for table, query := range queries {
+		var count int
+		if err := db.db.QueryRow(query, conversationID).Scan(&count); err != nil {
+			t.Fatalf("counting %s: %v", table, err)
+		}
+		counts[table] = count
+	}
+	return counts
+}
+
+func TestDeleteConversationRemovesChildRows(t *testing.T) {
+	db := newTestDB(t)
+	for _, id := range []string{"deleted", "kept"} {
+		if err := db.SaveMessages(id, turnMessages(id, 2)); err != nil {
+			t.Fatalf("SaveMessages: %v", err)
+		}
+		if err := db.AddConversationTag(id, "work"); err != nil {
+			t.Fatalf("AddConversationTag: %v", err)
+		}
+		if err := db.SaveEmbedding(id+"_reply", id, []float32{1, 0}); err != nil {
+			t.Fatalf("SaveEmbedding: %v", err)
+		}
+		schedule := &Schedule{ID: id + "_schedule", ConversationID: id, Command: "true", IntervalSeconds: 60, NextRunAt: time.Now()}
+		if err := db.SaveSchedule(schedule); err != nil {
+			t.Fatalf("SaveSchedule: %v", err)
+		}
+	}
+	before := conversationRows(t, db, "deleted")
+	for table, count := range before {
+		if count == 0 {
+			t.Fatalf("no %s rows were stored for the conversation", table)
+		}
+	}
+
+	if err := db.DeleteConversation("deleted"); err != nil {
+		t.Fatalf("DeleteConversation: %v", err)
+	}
+
+	for table, count := range conversationRows(t, db, "deleted") {
+		if count != 0 {
+			t.Errorf("%d %s rows of the deleted conversation are left", count, table)
+		}
+	}
+	if kept := conversationRows(t, db, "kept"); fmt.Sprint(kept) != fmt.Sprint(before) {
+		t.Errorf("rows of the other conversation are %v, want %v", kept, before)
+	}
+}
@@ -0,0 +1,354 @@
+package chat_engine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/openai/openai-go/v2"
+)
+
+// Messages are embedded in the background rather than while they are saved, so that turns
+// don't wait for the embeddings API and messages saved while it is unavailable are embedded
+// later. Semantic search finds a message once the indexer got to it.
+
+const (
+	// embeddingIndexInterval is how often messages without an embedding are looked for
+	embeddingIndexInterval = 5 * time.Second
+	// embeddingBatchSize bounds the messages embedded with a single request
+	embeddingBatchSize = 64
+	// maxEmbeddedChars bounds the text of a message that is embedded, the API rejects
+	// inputs longer than the model's context
+	maxEmbeddedChars = 16000
+	// embeddingTimeout bounds a single embeddings request
+	embeddingTimeout = 30 * time.Second
+	// semanticSnippetChars bounds the snippet of a semantic search result
+	semanticSnippetChars = 200
+)
+
+// ErrSemanticSearchDisabled is returned by SemanticSearch when no embedder is configured
+var ErrSemanticSearchDisabled = errors.New("semantic search is not enabled")
+
+// Embedder turns texts into embedding vectors, one per text in the same order. Vectors of
+// different texts must have the same dimensions to be compared.
+type Embedder interface {
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// WithEmbedder enables semantic search, messages are embedded with embedder
+func WithEmbedder(embedder Embedder) Option {
+	return func(e *ChatEngine) {
+		e.embedder = embedder
+	}
+}
+
+// OpenAIEmbedder is an Embedder backed by the OpenAI embeddings API
+type OpenAIEmbedder struct {
+	client *openai.Client
+	model  string
+}
+
+// NewOpenAIEmbedder creates an embedder using client with model, e.g. text-embedding-3-small
+func NewOpenAIEmbedder(client *openai.Client, model string) *OpenAIEmbedder {
+	return &OpenAIEmbedder{client: client, model: model}
+}
+
+func (p *OpenAIEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	resp, err := p.client.Embeddings.New(ctx, openai.EmbeddingNewParams{
+		Input: openai.EmbeddingNewParamsInputUnion{OfArrayOfStrings: texts},
+		Model: p.model,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Data) != len(texts) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(texts), len(resp.Data))
+	}
+
+	vectors := make([][]float32, len(texts))
+	for _, embedding := range resp.Data {
+		if embedding.Index < 0 || int(embedding.Index) >= len(texts) {
+			return nil, fmt.Errorf("embedding index %d out of range", embedding.Index)
+		}
+		vector := make([]float32, len(embedding.Embedding))
+		for i, f := range embedding.Embedding {
+			vector[i] = float32(f)
+		}
+		vectors[embedding.Index] = vector
+	}
+	return vectors, nil
+}
+
+// SemanticSearch returns up to limit user and assistant messages across all conversations
+// closest in meaning to query, by cosine similarity of their embeddings, best matches first.
+// It returns ErrSemanticSearchDisabled unless an embedder is configured.
+func (e *ChatEngine) SemanticSearch(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	if e.embedder == nil {
+		return nil, ErrSemanticSearchDisabled
+	}
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive")
+	}
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, fmt.Errorf("search query is empty")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, embeddingTimeout)
+	defer cancel()
+	vectors, err := e.embedder.Embed(ctx, []string{truncateForEmbedding(query)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed query: %w", err)
+	}
+	if len(vectors) != 1 {
+		return nil, fmt.Errorf("expected 1 embedding, got %d", len(vectors))
+	}
+	return e.db.NearestMessages(vectors[0], limit)
+}
+
+// startEmbeddingIndexer embeds stored messages that have no embedding yet, right away and
+// then periodically until Close
+func (e *ChatEngine) startEmbeddingIndexer() {
+	ctx, cancel := context.WithCancel(context.Background())
+	e.embeddingCancel = cancel
+	e.embeddingDone = make(chan struct{})
+
+	go func() {
+		defer close(e.embeddingDone)
+		ticker := time.NewTicker(embeddingIndexInterval)
+		defer ticker.Stop()
+		for {
+			if err := e.embedPendingMessages(ctx); err != nil && ctx.Err() == nil {
+				slog.Warn("Failed to embed messages, retrying later", "error", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// stopEmbeddingIndexer stops the indexer and waits for it to return
+func (e *ChatEngine) stopEmbeddingIndexer() {
+	if e.embeddingCancel == nil {
+		return
+	}
+	e.embeddingCancel()
+	<-e.embeddingDone
+}
+
+// embedPendingMessages embeds all messages without an embedding, a batch at a time
+func (e *ChatEngine) embedPendingMessages(ctx context.Context) error {
+	for ctx.Err() == nil {
+		pending, err := e.db.messagesWithoutEmbedding(embeddingBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+
+		texts := make([]string, len(pending))
+		for i, msg := range pending {
+			texts[i] = truncateForEmbedding(msg.Content)
+		}
+		embedCtx, cancel := context.WithTimeout(ctx, embeddingTimeout)
+		vectors, err := e.embedder.Embed(embedCtx, texts)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if len(vectors) != len(pending) {
+			return fmt.Errorf("expected %d embeddings, got %d", len(pending), len(vectors))
+		}
+
+		for i, msg := range pending {
+			if err := e.db.SaveEmbedding(msg.ID, msg.ConversationID, vectors[i]); err != nil {
+				return err
+			}
+		}
+		slog.Debug("Embedded messages", "count", len(pending))
+	}
+	return nil
+}
+
+// truncateForEmbedding cuts text to maxEmbeddedChars without splitting a character
+func truncateForEmbedding(text string) string {
+	if len(text) <= maxEmbeddedChars {
+		return text
+	}
+	return strings.ToValidUTF8(text[:maxEmbeddedChars], "")
+}
+
+// pendingEmbedding is a stored message still to be embedded
+type pendingEmbedding struct {
+	ID             string
+	ConversationID string
+	Content        string
+}
+
+// messagesWithoutEmbedding returns up to limit searchable messages that have no embedding
+func (d *DB) messagesWithoutEmbedding(limit int) ([]pendingEmbedding, error) {
+	rows, err := d.db.Query(`
+		SELECT m.id, m.conversation_id, m.content
+		FROM messages m
+		LEFT JOIN message_embeddings e ON e.message_id = m.id
+		WHERE e.message_id IS NULL AND m.role IN ('user', 'assistant') AND m.content != ''
+		ORDER BY m.created_at ASC, m.rowid ASC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages to embed: %w", err)
+	}
+	defer rows.Close()
+
+	var pending []pendingEmbedding
+	for rows.Next() {
+		var msg pendingEmbedding
+		if err := rows.Scan(&msg.ID, &msg.ConversationID, &msg.Content); err != nil {
+			return nil, fmt.Errorf("failed to scan message to embed: %w", err)
+		}
+		pending = append(pending, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating messages to embed: %w", err)
+	}
+	return pending, nil
+}
+
+// SaveEmbedding stores the embedding of a message. A message deleted in the meantime is
+// skipped, so that no embedding is left without its message.
+func (d *DB) SaveEmbedding(messageID, conversationID string, vector []float32) error {
+	_, err := d.db.Exec(`
+		INSERT OR REPLACE INTO message_embeddings (message_id, conversation_id, vector)
+		SELECT id, conversation_id, ? FROM messages WHERE id = ? AND conversation_id = ?
+	`, encodeVector(vector), messageID, conversationID)
+	if err != nil {
+		return fmt.Errorf("failed to save embedding: %w", err)
+	}
+	return nil
+}
+
+// NearestMessages returns up to limit embedded messages with the highest cosine similarity
+// to vector, best first. Embeddings of other dimensions, e.g. from a previous embedding
+// model, are skipped.
+func (d *DB) NearestMessages(vector []float32, limit int) ([]SearchResult, error) {
+	rows, err := d.db.Query(`SELECT message_id, vector FROM message_embeddings`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query embeddings: %w", err)
+	}
+	candidates, err := nearestEmbeddings(rows, vector, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]SearchResult, 0, len(candidates))
+	for _, candidate := range candidates {
+		result := SearchResult{MessageID: candidate.messageID, Score: candidate.score}
+		var content string
+		err := d.db.QueryRow(`
+			SELECT conversation_id, role, content, created_at FROM messages WHERE id = ?
+		`, candidate.messageID).Scan(&result.ConversationID, &result.Role, &content, &result.CreatedAt)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load search result: %w", err)
+		}
+		result.Snippet = semanticSnippet(content)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// scoredEmbedding is the similarity of a message's embedding to a query vector
+type scoredEmbedding struct {
+	messageID string
+	score     float64
+}
+
+// nearestEmbeddings reads rows of message IDs and encoded vectors and returns the limit
+// messages most similar to vector, best first. It closes rows.
+func nearestEmbeddings(rows *sql.Rows, vector []float32, limit int) ([]scoredEmbedding, error) {
+	defer rows.Close()
+
+	var candidates []scoredEmbedding
+	for rows.Next() {
+		var messageID string
+		var blob []byte
+		if err := rows.Scan(&messageID, &blob); err != nil {
+			return nil, fmt.Errorf("failed to scan embedding: %w", err)
+		}
+		stored := decodeVector(blob)
+		if len(stored) != len(vector) {
+			continue
+		}
+		candidates = append(candidates, scoredEmbedding{messageID, cosineSimilarity(vector, stored)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating embeddings: %w", err)
+	}
+
+	slices.SortStableFunc(candidates, func(a, b scoredEmbedding) int {
+		switch {
+		case a.score > b.score:
+			return -1
+		case a.score < b.score:
+			return 1
+		}
+		return 0
+	})
+	return candidates[:min(limit, len(candidates))], nil
+}
+
+// semanticSnippet returns the beginning of a message's content, as a semantic match has no
+// matching words to show
+func semanticSnippet(content string) string {
+	content = strings.Join(strings.Fields(content), " ")
+	runes := []rune(content)
+	if len(runes) <= semanticSnippetChars {
+		return content
+	}
+	return string(runes[:semanticSnippetChars]) + "…"
+}
+
+// cosineSimilarity of two vectors of the same dimensions, 0 if either is all zeros
+func cosineSimilarity(a, b []float32) float64 {
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// encodeVector stores a vector as little-endian float32 values
+func encodeVector(vector []float32) []byte {
+	buf := make([]byte, 4*len(vector))
+	for i, f := range vector {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(f))
+	}
+	return buf
+}
+
+// decodeVector reads a vector stored by encodeVector
+func decodeVector(buf []byte) []float32 {
+	vector := make([]float32, len(buf)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:]))
+	}
+	return vector
+}
@@ -1,12 +1,17 @@
 package chat_engine
 
 import (
+	"bytes"
+	"container/list"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/openai/openai-go/v2"
@@ -15,8 +20,25 @@ import (
 )
 
 type Conversation struct {
-	ID       string     `json:"id"`
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	// Labels organizing the conversation, in alphabetical order, see AddConversationTag
+	Tags []string `json:"tags,omitempty"`
+	// The conversation this one was forked from, see ForkConversation
+	ParentID string     `json:"parent_id,omitempty"`
 	Messages []*Message `json:"messages"`
+	// Sent to the model as a system message ahead of the history, not part of Messages
+	SystemPrompt string `json:"system_prompt,omitempty"`
+	// Notified when a turn ended, see SetWebhookURL
+	WebhookURL string `json:"webhook_url,omitempty"`
+	// Tool calls executed over the lifetime of the conversation
+	ToolCallCount int       `json:"tool_call_count"`
+	CreatedAt     time.Time `json:"created_at"`
+	// Last time a message was added or the conversation's settings changed
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Ephemeral conversations are never written to the database
+	ephemeral bool
 }
 
 func (conv *Conversation) AddMessage(msg *Message) {
@@ -24,20 +46,40 @@ func (conv *Conversation) AddMessage(msg *Message) {
 }
 
 // AddMessageWithDB adds a message to the conversation and saves it to the database
-func (conv *Conversation) AddMessageWithDB(msg *Message, db *DB) error {
+func (conv *Conversation) AddMessageWithDB(msg *Message, db Store) error {
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now().UTC()
+	}
 	conv.Messages = append(conv.Messages, msg)
+	conv.UpdatedAt = msg.CreatedAt
+	if conv.ephemeral {
+		return nil
+	}
 	return db.SaveMessage(conv.ID, msg)
 }
 
+// ephemeralCopy returns a copy of the conversation whose new messages are neither
+// persisted nor visible in the original
+func (conv *Conversation) ephemeralCopy() *Conversation {
+	cp := *conv
+	cp.Messages = append([]*Message(nil), conv.Messages...)
+	cp.ephemeral = true
+	return &cp
+}
+
 // ToOpenAIMessage converts a single Message to OpenAI format
 func ToOpenAIMessage(msg *Message) openai.ChatCompletionMessageParamUnion {
 	switch msg.Role {
 	case "user":
-		return openai.UserMessage(msg.Content)
+		return userMessageParam(msg)
 	case "assistant":
 		return ToOpenAIMessageWithTools(msg)
 	case "tool":
 		return openai.ToolMessage(msg.Content, msg.TollCallID)
+	case "system":
+		return openai.SystemMessage(msg.Content)
+	case "summary":
+		return openai.SystemMessage("Summary of the earlier conversation:\n\n" + msg.Content)
 	default:
 		// Fallback for unknown roles
 		return openai.UserMessage(msg.Content)
@@ -78,23 +120,54 @@ func ToOpenAIMessageWithTools(msg *Message) openai.ChatCompletionMessageParamUni
 
 // ToOpenAIMessages return messages in a format which can be used in OpenAI API
 func (conv *Conversation) ToOpenAIMessages() []openai.ChatCompletionMessageParamUnion {
+	messages := conv.modelMessages()
+
 	// Convert messages to OpenAI format
-	openaiMessages := make([]openai.ChatCompletionMessageParamUnion, 0, len(conv.Messages))
-	for _, msg := range conv.Messages {
+	openaiMessages := make([]openai.ChatCompletionMessageParamUnion, 0, len(messages))
+	for _, msg := range messages {
 		openaiMessages = append(openaiMessages, ToOpenAIMessage(msg))
 	}
 
 	return openaiMessages
 }
 
+// modelMessages returns the messages sent to the model: the system prompt, if any, followed
+// by the history. The returned slice may be appended to without affecting the conversation.
+func (conv *Conversation) modelMessages() []*Message {
+	messages := make([]*Message, 0, len(conv.Messages)+1)
+	if conv.SystemPrompt != "" {
+		messages = append(messages, &Message{Role: "system", Content: conv.SystemPrompt})
+	}
+	return append(messages, conv.Messages...)
+}
+
 type Message struct {
 	ID        string     `json:"ID"`
-	Role      string     `json:"role"` // "user", "assistant", "tool"
+	Role      string     `json:"role"` // "user", "assistant", "tool", "system", "summary"
 	Content   string     `json:"content"`
 	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
 
+	// Images attached to a user message
+	Images []ImageRef `json:"images,omitempty"`
+
 	// If non-empty - means it's a response to LLM tool call request
 	TollCallID string
+
+	// Set on assistant messages produced by a completion request
+	Model string      `json:"model,omitempty"`
+	Usage *TokenUsage `json:"usage,omitempty"`
+
+	// Content before post-processing, only kept when enabled with WithKeepRawContent
+	RawContent string `json:"raw_content,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TokenUsage is the number of tokens a completion request consumed
+type TokenUsage struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	TotalTokens      int64 `json:"total_tokens"`
 }
 
 type ToolCall struct {
@@ -105,84 +178,247 @@ type ToolCall struct {
 }
 
 type ChatEngine struct {
-	client             *openai.Client
+	provider           CompletionProvider
 	conversations      map[string]*Conversation
 	processManager     *ProcessManager
-	db                 *DB
+	db                 engineStore
+	databaseURL        string
 	conversationsMutex sync.RWMutex
+	// Recency of the conversations held in memory, see WithMaxCachedConversations
+	conversationLRU        *list.List
+	conversationElements   map[string]*list.Element
+	maxCachedConversations int
+	// Messages of running turns not saved yet, by conversation, see addTurnMessage. Guarded
+	// by conversationsMutex.
+	unsavedMessages map[string][]*Message
+
+	maxRepeatedToolCalls  int
+	workspaceRoot         string
+	workingDirs           map[string]string
+	workingDirsMutex      sync.RWMutex
+	maxReadFileBytes      int
+	maxSearchResults      int
+	commandTimeout        time.Duration
+	toolTimeout           time.Duration
+	maxCommandOutputBytes int
+	maxMessageBytes       int
+	titleTrigger          TitleTrigger
+	maxProcessDepth       int
+	killGracePeriod       time.Duration
+	envPolicy             *EnvPolicy
+	orphanPolicy          OrphanPolicy
+
+	// Message limit per conversation, 0 means unlimited
+	maxConversationMessages int
+	conversationLimitPolicy ConversationLimitPolicy
+
+	// Lifetime limit of tool calls per conversation, 0 means unlimited
+	maxConversationToolCalls int
+	maxToolIterations        int
+
+	postProcessors []PostProcessor
+	keepRawContent bool
+
+	readOnly              bool
+	readOnlyConversations map[string]bool
+	readOnlyMutex         sync.RWMutex
+
+	// Tools conversations are restricted to, see SetAllowedTools
+	allowedTools      map[string]toolFilter
+	allowedToolsMutex sync.RWMutex
+
+	// Restricts commands run by bash_command and shell, nil allows all
+	commandPolicy *CommandPolicy
+
+	toolApproval bool
+	// Decisions on tool calls awaiting approval, by conversation ID and tool call ID
+	toolDecisions map[string]map[string]bool
+	// Conversations whose approved round is running
+	resumingConversations map[string]bool
+	// Rejects undecided tool calls, see WithApprovalTimeout
+	approvalTimeout time.Duration
+	approvalTimers  map[string]*time.Timer
+	// Set by Close, no approval timers start afterwards
+	approvalTimersStopped bool
+	approvalMutex         sync.Mutex
+
+	iterationLimitMessage  string
+	iterationLimitTemplate *template.Template
+	iterationLimitSummary  bool
+
+	// Notified when the turn of any conversation ended, empty for none
+	webhookURL string
+
+	// Model of every completion of a turn, the first one and those after tool calls alike.
+	// The provider's default model when empty.
+	model string
+	// How often a completion request is tried when it fails with a transient error
+	maxCompletionAttempts int
+	// How often the model is asked again after an empty reply
+	maxEmptyReplyRetries int
+
+	// Prompt token budgets by model prefix overriding modelContextBudgets, see WithContextBudget
+	contextBudgets map[string]int
+	// Estimated tokens above which old messages are summarized, 0 disables it
+	summarizeThreshold int
+
+	// Defaults for completion requests, see WithSampling
+	sampling SamplingParams
+
+	// Tools offered to the model, and those added with WithTool
+	tools      *ToolRegistry
+	extraTools []Tool
+
+	// Backs the web_search tool, nil when it is disabled
+	webSearch WebSearchProvider
+
+	// Embeds messages for SemanticSearch, nil when it is disabled
+	embedder        Embedder
+	embeddingCancel context.CancelFunc
+	embeddingDone   chan struct{}
+
+	// Namespace of the memories shown to the model, empty when memory is disabled
+	memoryNamespace string
+
+	// Used by the http_get tool, see WithHTTPPrivateNetworks
+	httpClient           *http.Client
+	httpAllowPrivate     bool
+	maxHTTPResponseBytes int
+
+	// Running turns by conversation ID, see CancelTurn
+	activeTurns      map[string][]*activeTurn
+	activeTurnsMutex sync.Mutex
+
+	// Runs scheduled commands, see ScheduleCommand
+	schedulerCancel  context.CancelFunc
+	schedulerDone    chan struct{}
+	scheduleRuns     sync.WaitGroup
+	runningSchedules map[string]bool
+	schedulesMutex   sync.Mutex
 }
 
-func NewChatEngine(client *openai.Client) (*ChatEngine, error) {
-	// Initialize database
-	db, err := NewDB("agent.db")
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize database: %w", err)
-	}
-
+// NewChatEngine creates an engine that gets assistant messages from provider
+func NewChatEngine(provider CompletionProvider, opts ...Option) (*ChatEngine, error) {
 	engine := &ChatEngine{
-		client:             client,
+		provider:           provider,
 		conversations:      make(map[string]*Conversation),
-		processManager:     NewProcessManager(),
-		db:                 db,
 		conversationsMutex: sync.RWMutex{},
+
+		conversationLRU:        list.New(),
+		conversationElements:   make(map[string]*list.Element),
+		maxCachedConversations: defaultMaxCachedConversations,
+
+		maxRepeatedToolCalls:  defaultMaxRepeatedToolCalls,
+		workspaceRoot:         ".",
+		workingDirs:           make(map[string]string),
+		maxReadFileBytes:      defaultMaxReadFileBytes,
+		maxSearchResults:      defaultMaxSearchResults,
+		commandTimeout:        defaultCommandTimeout,
+		toolTimeout:           defaultToolTimeout,
+		maxCommandOutputBytes: defaultMaxCommandOutputBytes,
+		maxMessageBytes:       defaultMaxMessageBytes,
+		titleTrigger:          TitleTriggerFirstUser,
+		orphanPolicy:          OrphanPolicyKill,
+		killGracePeriod:       defaultKillGracePeriod,
+		envPolicy:             DefaultEnvPolicy(),
+		maxToolIterations:     defaultMaxToolIterations,
+		readOnlyConversations: make(map[string]bool),
+		unsavedMessages:       make(map[string][]*Message),
+		allowedTools:          make(map[string]toolFilter),
+		toolDecisions:         make(map[string]map[string]bool),
+		resumingConversations: make(map[string]bool),
+		approvalTimers:        make(map[string]*time.Timer),
+		activeTurns:           make(map[string][]*activeTurn),
+		runningSchedules:      make(map[string]bool),
+
+		iterationLimitMessage: defaultIterationLimitMessage,
+		maxCompletionAttempts: defaultMaxCompletionAttempts,
+		maxEmptyReplyRetries:  defaultMaxEmptyReplyRetries,
+		maxHTTPResponseBytes:  defaultMaxHTTPResponseBytes,
+	}
+	for _, opt := range opts {
+		opt(engine)
 	}
 
-	// Load all conversations from database
-	if err := engine.loadAllConversations(); err != nil {
-		log.Printf("Warning: failed to load conversations from database: %v", err)
+	if engine.maxToolIterations < 1 {
+		return nil, fmt.Errorf("max tool iterations must be at least 1, got %d", engine.maxToolIterations)
+	}
+	if engine.maxCompletionAttempts < 1 {
+		return nil, fmt.Errorf("max completion attempts must be at least 1, got %d", engine.maxCompletionAttempts)
+	}
+	if err := engine.sampling.Validate(); err != nil {
+		return nil, err
+	}
+	if engine.memoryNamespace != "" {
+		if err := ValidateMemoryNamespace(engine.memoryNamespace); err != nil {
+			return nil, err
+		}
 	}
 
-	return engine, nil
-}
+	engine.tools = NewToolRegistry()
+	for _, tool := range append(engine.builtinTools(), engine.extraTools...) {
+		if err := engine.tools.Register(tool); err != nil {
+			return nil, err
+		}
+	}
 
-func (e *ChatEngine) loadAllConversations() error {
-	conversationIDs, err := e.db.ListConversations()
+	// Initialize database
+	db, err := openStore(engine.databaseURL)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	engine.db = db
+	engine.processManager = NewProcessManager(db)
+
+	engine.httpClient = newHTTPGetClient(engine.httpAllowPrivate)
+	engine.processManager.SetMaxDepth(engine.maxProcessDepth)
+	engine.processManager.SetKillGracePeriod(engine.killGracePeriod)
+	engine.processManager.SetEnvPolicy(engine.envPolicy)
+	if err := engine.processManager.ReapOrphans(engine.orphanPolicy); err != nil {
+		slog.Warn("Failed to handle processes left from a previous run", "error", err)
 	}
 
-	for _, id := range conversationIDs {
-		conv, err := e.db.LoadConversation(id)
-		if err != nil {
-			log.Printf("Failed to load conversation %s: %v", id, err)
-			continue
-		}
-		if conv != nil {
-			e.conversationsMutex.Lock()
-			e.conversations[id] = conv
-			e.conversationsMutex.Unlock()
-		}
+	engine.iterationLimitTemplate, err = template.New("iteration_limit").Parse(engine.iterationLimitMessage)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("invalid iteration limit message template: %w", err)
 	}
 
-	log.Printf("Loaded %d conversations from database", len(conversationIDs))
-	return nil
+	if engine.embedder != nil {
+		engine.startEmbeddingIndexer()
+	}
+	engine.startScheduler()
+
+	return engine, nil
 }
 
+// GetConversation returns a conversation, loading it from the database when it isn't held in
+// memory, or nil if it does not exist
 func (e *ChatEngine) GetConversation(conversationID string) *Conversation {
-	e.conversationsMutex.RLock()
-	conv := e.conversations[conversationID]
-	e.conversationsMutex.RUnlock()
+	conv := e.cachedConversation(conversationID)
 
 	// If not in memory, try loading from database
 	if conv == nil {
 		dbConv, err := e.db.LoadConversation(conversationID)
 		if err != nil {
-			log.Printf("Failed to load conversation from database: %v", err)
+			slog.Error("Failed to load conversation from database", "conversation_id", conversationID, "error", err)
 			return nil
 		}
 		if dbConv != nil {
-			e.conversationsMutex.Lock()
-			e.conversations[conversationID] = dbConv
-			e.conversationsMutex.Unlock()
-			return dbConv
+			return e.cacheConversation(dbConv)
 		}
 	}
 
 	return conv
 }
 
+// ListConversation returns the conversations currently held in memory. Use
+// ListConversationsPaged to list all stored conversations.
 func (e *ChatEngine) ListConversation() []*Conversation {
-	conversations := make([]*Conversation, 0)
+	e.conversationsMutex.RLock()
+	defer e.conversationsMutex.RUnlock()
+
+	conversations := make([]*Conversation, 0, len(e.conversations))
 	for _, conv := range e.conversations {
 		conversations = append(conversations, conv)
 	}
@@ -190,11 +426,86 @@ func (e *ChatEngine) ListConversation() []*Conversation {
 	return conversations
 }
 
+// ConversationSummary describes a conversation without its messages
+type ConversationSummary struct {
+	ID           string    `json:"id"`
+	Title        string    `json:"title"`
+	Tags         []string  `json:"tags,omitempty"`
+	ParentID     string    `json:"parent_id,omitempty"`
+	MessageCount int       `json:"message_count"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// ConversationPage is one page of conversation summaries
+type ConversationPage struct {
+	Conversations []ConversationSummary `json:"conversations"`
+	Total         int                   `json:"total"`
+	Limit         int                   `json:"limit"`
+	Offset        int                   `json:"offset"`
+}
+
+// ListConversationsPaged returns up to limit conversation summaries starting at offset, most
+// recently updated first. A non-empty tag only lists conversations with that tag. An offset
+// past the end yields an empty page.
+func (e *ChatEngine) ListConversationsPaged(limit, offset int, tag string) (*ConversationPage, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive")
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("offset must not be negative")
+	}
+
+	summaries, total, err := e.db.ListConversationSummaries(limit, offset, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &ConversationPage{
+		Conversations: summaries,
+		Total:         total,
+		Limit:         limit,
+		Offset:        offset,
+	}, nil
+}
+
+// MessagePage is one page of a conversation's messages
+type MessagePage struct {
+	Messages []*Message `json:"messages"`
+	Total    int        `json:"total"`
+	Limit    int        `json:"limit"`
+	Offset   int        `json:"offset"`
+}
+
+// ConversationMessagesPaged returns up to limit messages of a conversation starting at
+// offset, oldest first. An offset past the end yields an empty page. Use GetConversation
+// for the full history.
+func (e *ChatEngine) ConversationMessagesPaged(conversationID string, limit, offset int) (*MessagePage, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive")
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("offset must not be negative")
+	}
+
+	total, err := e.db.CountMessages(conversationID)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := e.db.LoadConversationMessages(conversationID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return &MessagePage{
+		Messages: messages,
+		Total:    total,
+		Limit:    limit,
+		Offset:   offset,
+	}, nil
+}
+
 func (e *ChatEngine) GetOrCreateConversation(conversationID string) *Conversation {
 	// Try to get from memory first
-	e.conversationsMutex.RLock()
-	conv := e.conversations[conversationID]
-	e.conversationsMutex.RUnlock()
+	conv := e.cachedConversation(conversationID)
 
 	if conv != nil {
 		return conv
@@ -203,32 +514,265 @@ func (e *ChatEngine) GetOrCreateConversation(conversationID string) *Conversatio
 	// Try loading from database
 	dbConv, err := e.db.LoadConversation(conversationID)
 	if err != nil {
-		log.Printf("Failed to load conversation from database: %v", err)
+		slog.Error("Failed to load conversation from database", "conversation_id", conversationID, "error", err)
 	}
 
 	if dbConv != nil {
-		e.conversationsMutex.Lock()
-		e.conversations[conversationID] = dbConv
-		e.conversationsMutex.Unlock()
-		return dbConv
+		return e.cacheConversation(dbConv)
 	}
 
 	// Create new conversation
+	now := time.Now().UTC()
 	conv = &Conversation{
-		ID:       conversationID,
-		Messages: make([]*Message, 0),
+		ID:        conversationID,
+		Messages:  make([]*Message, 0),
+		CreatedAt: now,
+		UpdatedAt: now,
 	}
 
 	// Save to database
 	if err := e.db.SaveConversation(conv); err != nil {
-		log.Printf("Failed to save new conversation to database: %v", err)
+		slog.Error("Failed to save new conversation to database", "conversation_id", conversationID, "error", err)
+	}
+
+	return e.cacheConversation(conv)
+}
+
+// ConversationContext is what the model would receive for the next completion in a conversation
+type ConversationContext struct {
+	ConversationID string                                   `json:"conversation_id"`
+	Messages       []openai.ChatCompletionMessageParamUnion `json:"messages"`
+	Tools          []openai.ChatCompletionToolUnionParam    `json:"tools"`
+}
+
+// GetConversationContext returns the messages and tools that would be sent to the model for
+// the conversation, or nil if the conversation does not exist
+func (e *ChatEngine) GetConversationContext(conversationID string) *ConversationContext {
+	conv := e.GetConversation(conversationID)
+	if conv == nil {
+		return nil
+	}
+
+	tools := e.toolsForConversation(conv, e.turnTools(conv, SendOptions{}))
+	messages := e.contextMessages(conv, "", tools)
+	openaiMessages := make([]openai.ChatCompletionMessageParamUnion, 0, len(messages))
+	for _, msg := range messages {
+		openaiMessages = append(openaiMessages, ToOpenAIMessage(msg))
+	}
+
+	return &ConversationContext{
+		ConversationID: conv.ID,
+		Messages:       openaiMessages,
+		Tools:          tools,
+	}
+}
+
+// SetSystemPrompt sets the system prompt of a conversation, creating the conversation if needed
+// so the prompt can be set before the first message. An empty prompt removes it.
+func (e *ChatEngine) SetSystemPrompt(conversationID, prompt string) error {
+	conv := e.GetOrCreateConversation(conversationID)
+
+	if err := e.db.UpdateConversationSystemPrompt(conversationID, prompt); err != nil {
+		return err
 	}
 
 	e.conversationsMutex.Lock()
-	e.conversations[conversationID] = conv
+	conv.SystemPrompt = prompt
+	conv.UpdatedAt = time.Now().UTC()
 	e.conversationsMutex.Unlock()
+	return nil
+}
 
-	return conv
+// ErrMessageNotFound is returned when a message ID does not exist in a conversation
+var ErrMessageNotFound = errors.New("message not found")
+
+// EditMessage replaces the content of a stored message. Editing a user message removes every
+// message after it, as the replies no longer answer it; the edited message is then the last
+// one in the conversation. It returns the updated conversation, or ErrTurnRunning while a turn
+// is running.
+func (e *ChatEngine) EditMessage(conversationID, messageID, content string) (*Conversation, error) {
+	conv := e.GetConversation(conversationID)
+	if conv == nil {
+		return nil, fmt.Errorf("conversation %s not found", conversationID)
+	}
+	if e.turnRunning(conversationID) {
+		return nil, ErrTurnRunning
+	}
+
+	e.conversationsMutex.RLock()
+	index := -1
+	for i, msg := range conv.Messages {
+		if msg.ID == messageID {
+			index = i
+			break
+		}
+	}
+	e.conversationsMutex.RUnlock()
+	if index == -1 {
+		return nil, ErrMessageNotFound
+	}
+
+	edited := *conv.Messages[index]
+	edited.Content = content
+	if err := e.db.UpdateMessage(conversationID, &edited); err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	if edited.Role == "user" {
+		for _, msg := range conv.Messages[index+1:] {
+			removed = append(removed, msg.ID)
+		}
+		if err := e.db.DeleteMessages(conversationID, removed); err != nil {
+			return nil, err
+		}
+	}
+
+	e.conversationsMutex.Lock()
+	conv.Messages[index] = &edited
+	conv.UpdatedAt = time.Now().UTC()
+	if len(removed) > 0 {
+		conv.Messages = conv.Messages[:index+1]
+	}
+	e.conversationsMutex.Unlock()
+
+	return conv, nil
+}
+
+// DeleteConversation deletes a conversation with its messages and schedules. So that nothing
+// keeps running on behalf of a conversation that is gone, its running turns are canceled and
+// its background processes and shell session are killed first.
+func (e *ChatEngine) DeleteConversation(conversationID string) error {
+	if e.GetConversation(conversationID) == nil {
+		return fmt.Errorf("conversation %s not found", conversationID)
+	}
+
+	if err := e.CancelTurn(conversationID, false); err != nil && !errors.Is(err, ErrNoActiveTurn) {
+		return err
+	}
+	killed := e.processManager.KillByConversation(conversationID)
+	slog.Info("Killed processes of deleted conversation", "conversation_id", conversationID, "processes", killed)
+
+	if err := e.db.DeleteConversation(conversationID); err != nil {
+		return err
+	}
+
+	e.conversationsMutex.Lock()
+	if elem := e.conversationElements[conversationID]; elem != nil {
+		e.conversationLRU.Remove(elem)
+	}
+	delete(e.conversationElements, conversationID)
+	delete(e.conversations, conversationID)
+	e.conversationsMutex.Unlock()
+
+	e.workingDirsMutex.Lock()
+	delete(e.workingDirs, conversationID)
+	e.workingDirsMutex.Unlock()
+	e.readOnlyMutex.Lock()
+	delete(e.readOnlyConversations, conversationID)
+	e.readOnlyMutex.Unlock()
+	e.allowedToolsMutex.Lock()
+	delete(e.allowedTools, conversationID)
+	e.allowedToolsMutex.Unlock()
+	e.approvalMutex.Lock()
+	delete(e.toolDecisions, conversationID)
+	e.approvalMutex.Unlock()
+	return nil
+}
+
+// ClearConversation deletes the messages of a conversation, keeping the conversation with its
+// title, system prompt and other settings. It returns ErrTurnRunning while a turn is running.
+func (e *ChatEngine) ClearConversation(conversationID string) error {
+	conv := e.GetConversation(conversationID)
+	if conv == nil {
+		return fmt.Errorf("conversation %s not found", conversationID)
+	}
+	if e.turnRunning(conversationID) {
+		return ErrTurnRunning
+	}
+
+	if err := e.db.ClearConversationMessages(conversationID); err != nil {
+		return err
+	}
+
+	e.conversationsMutex.Lock()
+	conv.Messages = make([]*Message, 0)
+	conv.UpdatedAt = time.Now().UTC()
+	e.conversationsMutex.Unlock()
+
+	// Tool calls awaiting approval went with their messages
+	e.approvalMutex.Lock()
+	delete(e.toolDecisions, conversationID)
+	e.approvalMutex.Unlock()
+	return nil
+}
+
+// MessagesAfter returns the messages of a conversation that follow the given message, e.g. to
+// catch up a client that was disconnected. It returns ErrMessageNotFound if the conversation
+// has no such message.
+func (e *ChatEngine) MessagesAfter(conversationID, messageID string) ([]*Message, error) {
+	// A cached conversation also has the messages of a running turn, which aren't saved yet
+	if conv := e.cachedConversation(conversationID); conv != nil {
+		e.conversationsMutex.RLock()
+		defer e.conversationsMutex.RUnlock()
+		for i, msg := range conv.Messages {
+			if msg.ID == messageID {
+				return append([]*Message(nil), conv.Messages[i+1:]...), nil
+			}
+		}
+		return nil, ErrMessageNotFound
+	}
+	return e.db.LoadMessagesAfter(conversationID, messageID)
+}
+
+// toolsForConversation returns the tools advertised to the model for the conversation,
+// those allowed by the filter
+func (e *ChatEngine) toolsForConversation(conv *Conversation, allowed toolFilter) []openai.ChatCompletionToolUnionParam {
+	if e.toolCallBudgetExhausted(conv) {
+		return nil
+	}
+	definitions := e.tools.Definitions()
+	if allowed == nil {
+		return definitions
+	}
+
+	// No tools at all are sent as nil, the API rejects an empty list
+	var tools []openai.ChatCompletionToolUnionParam
+	for _, definition := range definitions {
+		if allowed[toolName(definition)] {
+			tools = append(tools, definition)
+		}
+	}
+	return tools
+}
+
+// toolCallBudgetExhausted reports whether the conversation used up its lifetime tool calls
+func (e *ChatEngine) toolCallBudgetExhausted(conv *Conversation) bool {
+	return e.maxConversationToolCalls > 0 && conv.ToolCallCount >= e.maxConversationToolCalls
+}
+
+// countToolCall adds an executed tool call to the conversation's lifetime count
+func (e *ChatEngine) countToolCall(conv *Conversation) {
+	e.conversationsMutex.Lock()
+	conv.ToolCallCount++
+	e.conversationsMutex.Unlock()
+
+	if conv.ephemeral {
+		return
+	}
+	if err := e.db.IncrementToolCallCount(conv.ID); err != nil {
+		slog.Error("Failed to save tool call count", "conversation_id", conv.ID, "error", err)
+	}
+}
+
+// Close kills all background processes and closes the database.
+// The engine must not be used after Close.
+func (e *ChatEngine) Close() error {
+	e.stopApprovalTimers()
+	e.stopEmbeddingIndexer()
+	e.stopScheduler()
+	e.processManager.Close()
+	return e.db.Close()
 }
 
 // GetProcesses returns all running background processes
@@ -236,173 +780,361 @@ func (e *ChatEngine) GetProcesses() []*ProcessInfo {
 	return e.processManager.ListProcesses()
 }
 
+// KillConversationProcesses kills all background processes started by a conversation and
+// returns how many were killed
+func (e *ChatEngine) KillConversationProcesses(conversationID string) int {
+	return e.processManager.KillByConversation(conversationID)
+}
+
+// GetProcessOutput returns the captured output of a background process by PID
+func (e *ChatEngine) GetProcessOutput(pid int) (*ProcessOutput, error) {
+	return e.processManager.GetOutput(pid)
+}
+
+// FollowProcessOutput passes the output of a background process to onOutput as it is written
+// until the process exits, see ProcessManager.FollowOutput
+func (e *ChatEngine) FollowProcessOutput(ctx context.Context, pid int, onOutput func(output string, truncated bool)) (int, error) {
+	return e.processManager.FollowOutput(ctx, pid, onOutput)
+}
+
 // KillProcess kills a background process by PID
 func (e *ChatEngine) KillProcess(pid int) error {
 	return e.processManager.KillProcess(pid)
 }
 
-// MessageUpdateCallback is called whenever a new message is added during processing
+// MessageUpdateCallback is called whenever a new message is added during processing.
+//
+// Within a turn messages are reported in a fixed order, which is also the order they are
+// stored in: the user message, then for every round the assistant message (including its
+// tool_calls) before any of those tools run, then one tool message per tool call in the
+// order the calls were requested, and only then the next assistant message. Streaming
+// content of an assistant message, when supported, must be delivered before that message.
 type MessageUpdateCallback func(*Message)
 
+// ToolStartCallback is called right before a tool call is executed, after the assistant
+// message requesting it and before its tool message are reported. Calls that are answered
+// without running the tool, e.g. rejected or over a limit, are not reported.
+type ToolStartCallback func(toolCall ToolCall)
+
+var (
+	// ErrEmptyMessage is returned for a user message without content or images
+	ErrEmptyMessage = errors.New("message is empty")
+	// ErrMessageTooLong is returned for a user message longer than WithMaxMessageBytes allows
+	ErrMessageTooLong = errors.New("message is too long")
+)
+
+// ValidateUserMessage checks that a user message can be sent: it needs content that isn't
+// just whitespace, or images, and must not exceed the length limit
+func (e *ChatEngine) ValidateUserMessage(content string, images []ImageRef) error {
+	if strings.TrimSpace(content) == "" && len(images) == 0 {
+		return ErrEmptyMessage
+	}
+	if e.maxMessageBytes > 0 && len(content) > e.maxMessageBytes {
+		return fmt.Errorf("%w: %d bytes, at most %d are allowed", ErrMessageTooLong, len(content), e.maxMessageBytes)
+	}
+	return nil
+}
+
 func (e *ChatEngine) SendUserMessage(conversationID, content string) ([]*Message, error) {
 	return e.SendUserMessageWithCallback(conversationID, content, nil)
 }
 
+// SendOptions holds per-request settings for SendUserMessageWithOptions
+type SendOptions struct {
+	// Callback is called for every message created during the turn
+	Callback MessageUpdateCallback
+	// Ephemeral turns are processed normally but nothing is saved to the database
+	// or added to the stored conversation
+	Ephemeral bool
+	// SystemPrompt, when set, replaces the conversation's system prompt before the turn.
+	// For ephemeral turns it only applies to that turn.
+	SystemPrompt string
+	// OnDelta, when set, receives assistant content while it is generated, before Callback
+	// receives the complete message
+	OnDelta DeltaCallback
+	// OnToolStart, when set, is called before each tool call of the turn is executed
+	OnToolStart ToolStartCallback
+	// Logger, when set, is used for the log lines of the turn, e.g. to tag them with the ID of
+	// the request that started it. Defaults to slog.Default().
+	Logger *slog.Logger
+	// ResponseFormat, when set, makes the model's final reply JSON. Replies are not streamed
+	// to OnDelta then.
+	ResponseFormat *ResponseFormat
+	// Sampling overrides the engine's sampling parameters that are set in it for the turn
+	Sampling *SamplingParams
+	// DisableTools offers the model no tools in the turn, making it a plain chat
+	DisableTools bool
+	// AllowedTools, when not nil, restricts the tools offered in the turn to the named ones,
+	// within those the conversation allows
+	AllowedTools []string
+	// Images are attached to the user message, see ValidateImages
+	Images []ImageRef
+	// RequestID, when set, identifies the request that started the turn. It is added to the
+	// log lines of the turn and recorded with the commands it runs.
+	RequestID string
+}
+
+// turnLogger returns the logger for a turn in conv
+func (opts SendOptions) turnLogger(conv *Conversation) *slog.Logger {
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if opts.RequestID != "" {
+		logger = logger.With("request_id", opts.RequestID)
+	}
+	return logger.With("conversation_id", conv.ID)
+}
+
 func (e *ChatEngine) SendUserMessageWithCallback(conversationID, content string, callback MessageUpdateCallback) ([]*Message, error) {
-	conv := e.GetOrCreateConversation(conversationID)
+	return e.SendUserMessageWithOptions(conversationID, content, SendOptions{Callback: callback})
+}
 
-	userMessage := Message{
-		ID:      fmt.Sprintf("msg_%d", time.Now().UnixNano()),
-		Role:    "user",
-		Content: content,
+// SendUserMessageWithOptions runs a turn: it adds the user message, then lets the model answer
+// and use tools until it is done. If the turn ended at the tool iteration limit, the messages
+// are returned together with an *IterationLimitError, if it paused for tool calls to be
+// approved, together with an *ApprovalRequiredError. Webhooks are notified once it ended.
+// Messages ValidateUserMessage rejects are not sent.
+func (e *ChatEngine) SendUserMessageWithOptions(conversationID, content string, opts SendOptions) (messages []*Message, err error) {
+	if err := e.ValidateUserMessage(content, opts.Images); err != nil {
+		return nil, err
 	}
-	if err := conv.AddMessageWithDB(&userMessage, e.db); err != nil {
-		log.Printf("Failed to save user message to database: %v", err)
+	callback := opts.Callback
+
+	var conv *Conversation
+	if opts.Ephemeral {
+		conv = e.GetConversation(conversationID)
+		if conv == nil {
+			now := time.Now().UTC()
+			conv = &Conversation{ID: conversationID, Messages: make([]*Message, 0), CreatedAt: now, UpdatedAt: now}
+		}
+		conv = conv.ephemeralCopy()
+	} else {
+		conv = e.GetOrCreateConversation(conversationID)
 	}
-	if callback != nil {
-		callback(&userMessage)
+
+	if opts.SystemPrompt != "" && opts.SystemPrompt != conv.SystemPrompt {
+		if conv.ephemeral {
+			conv.SystemPrompt = opts.SystemPrompt
+		} else if err := e.SetSystemPrompt(conversationID, opts.SystemPrompt); err != nil {
+			return nil, err
+		}
 	}
 
-	responseMessage, err := e.sendUserMessageToLLM(conv)
-	if err != nil {
+	logger := opts.turnLogger(conv)
+	if err := e.enforceConversationLimit(conv, logger); err != nil {
 		return nil, err
 	}
-	if err := conv.AddMessageWithDB(responseMessage, e.db); err != nil {
-		log.Printf("Failed to save assistant message to database: %v", err)
+	defer func() {
+		e.notifyTurnEnded(conv, messages, err)
+	}()
+	ctx, endTurn := e.beginTurn(conv.ID, opts.RequestID)
+	defer endTurn()
+	defer e.saveTurnMessages(conv, logger)
+
+	// Tool calls still awaiting approval are dropped in favor of the new message
+	skippedMessages := e.answerUnansweredToolCalls(conv, "Not executed: the user sent a new message instead of approving this tool call.", callback, logger)
+
+	userMessage := Message{
+		ID:        fmt.Sprintf("msg_%d", time.Now().UnixNano()),
+		Role:      "user",
+		Content:   content,
+		Images:    opts.Images,
+		CreatedAt: time.Now().UTC(),
+	}
+	e.addTurnMessage(conv, &userMessage)
+	if callback != nil {
+		callback(&userMessage)
 	}
+	e.titleAfterUserMessage(conv, content)
+	e.summarizeIfNeeded(ctx, conv, logger)
+
+	allowedTools := e.turnTools(conv, opts)
+	responseMessage, err := e.sendUserMessageToLLMStream(ctx, conv, opts.OnDelta, opts.ResponseFormat, e.sampling.merge(opts.Sampling), allowedTools)
+	if errors.Is(err, ErrTurnCanceled) {
+		return append(skippedMessages, &userMessage), err
+	} else if err != nil {
+		return nil, err
+	}
+	e.addTurnMessage(conv, responseMessage)
 	if callback != nil {
 		callback(responseMessage)
 	}
 
-	log.Printf("going to execute %v tool calls", len(responseMessage.ToolCalls))
+	logger.Debug("Model replied", "tool_calls", len(responseMessage.ToolCalls))
 	toolMessages := make([]*Message, 0)
+	// Errors for turns that ended early but are complete and saved
+	var limitErr *IterationLimitError
+	var approvalErr *ApprovalRequiredError
+	var turnErr error
 	if len(responseMessage.ToolCalls) > 0 {
-		toolMessages, err = e.executeLLMRequestedToolCalls(conv, responseMessage.ToolCalls, callback)
-		if err != nil {
-			log.Printf("can't executeLLMRequestedToolCalls: %v", err)
+		toolMessages, err = e.executeLLMRequestedToolCalls(ctx, conv, responseMessage.ToolCalls, callback, opts.OnDelta, opts.OnToolStart, opts.ResponseFormat, e.sampling.merge(opts.Sampling), allowedTools, nil, logger)
+		if errors.As(err, &limitErr) || errors.As(err, &approvalErr) || errors.Is(err, ErrTurnCanceled) {
+			turnErr = err
+		} else if err != nil {
+			logger.Error("Failed to run tool calls", "error", err)
 			return nil, err
 		}
 	}
 
 	allNewMessages := make([]*Message, 0)
+	allNewMessages = append(allNewMessages, skippedMessages...)
 	allNewMessages = append(allNewMessages, &userMessage) // Include user message
 	allNewMessages = append(allNewMessages, responseMessage)
 	allNewMessages = append(allNewMessages, toolMessages...)
 
+	finalMessage := allNewMessages[len(allNewMessages)-1]
+	e.titleAfterTurn(conv, content, finalMessage.Content)
+
+	if turnErr != nil {
+		return allNewMessages, turnErr
+	}
 	return allNewMessages, nil
 }
 
-func (e *ChatEngine) sendUserMessageToLLM(conv *Conversation) (*Message, error) {
-	ctx := context.Background()
-
-	params := openai.ChatCompletionNewParams{
-		Messages: conv.ToOpenAIMessages(),
-		Tools:    allTools,
-		Model:    openai.ChatModelGPT5,
+// sendUserMessageToLLMStream asks the provider for the next assistant message of the
+// conversation. If onDelta is set, content is streamed to it as it is generated; the complete
+// message is only returned once the response has ended, so its tool calls are complete.
+// Deltas are not streamed when post-processors are configured, as they would expose content
+// before post-processing, nor with a response format, whose replies are validated first.
+// A final reply that should be JSON but isn't is asked for once more, an empty reply up to
+// the configured number of times. Tool calls are only run once a reply is returned, so a
+// retry repeats none. A conversation that doesn't fit the context budget even when trimmed
+// fails with ErrContextWindowExceeded without asking the model.
+func (e *ChatEngine) sendUserMessageToLLMStream(
+	ctx context.Context,
+	conv *Conversation,
+	onDelta DeltaCallback,
+	format *ResponseFormat,
+	sampling SamplingParams,
+	allowedTools toolFilter,
+) (*Message, error) {
+	if len(e.postProcessors) > 0 || format != nil {
+		onDelta = nil
 	}
 
-	completion, err := e.client.Chat.Completions.New(ctx, params)
-	if err != nil {
+	tools := e.toolsForConversation(conv, allowedTools)
+	req := CompletionRequest{
+		Messages:       e.contextMessages(conv, e.model, tools),
+		Tools:          tools,
+		Model:          e.model,
+		OnDelta:        onDelta,
+		ResponseFormat: format,
+		Sampling:       sampling,
+	}
+	if err := e.checkContextBudget(e.model, req.Messages, tools); err != nil {
 		return nil, err
 	}
-
-	toolCalls := make([]ToolCall, len(completion.Choices[0].Message.ToolCalls))
-	for i, toolCall := range completion.Choices[0].Message.ToolCalls {
-		toolCalls[i] = ToolCall{
-			ID:        toolCall.ID,
-			Type:      string(toolCall.Type),
-			Name:      toolCall.Function.Name,
-			Arguments: toolCall.Function.Arguments,
+	responseMessage, err := e.complete(ctx, req)
+	for retry := 1; err == nil && isEmptyReply(responseMessage) && retry <= e.maxEmptyReplyRetries; retry++ {
+		slog.Warn("Model reply is empty, asking again", "conversation_id", conv.ID, "retry", retry)
+		if retry == 1 {
+			req.Messages = append(req.Messages, &Message{Role: "system", Content: emptyReplyInstruction})
+		}
+		usage := responseMessage.Usage
+		responseMessage, err = e.complete(ctx, req)
+		if err == nil {
+			addUsage(responseMessage, usage)
 		}
 	}
-
-	responseMessage := Message{
-		ID:        fmt.Sprintf("msg_%d", time.Now().UnixNano()),
-		Role:      "assistant",
-		Content:   completion.Choices[0].Message.Content,
-		ToolCalls: toolCalls,
+	if format != nil && err == nil && len(responseMessage.ToolCalls) == 0 && !json.Valid([]byte(responseMessage.Content)) {
+		slog.Warn("Model reply is not valid JSON, asking again", "conversation_id", conv.ID)
+		req.Messages = append(req.Messages, responseMessage, &Message{Role: "system", Content: invalidJSONInstruction})
+		responseMessage, err = e.complete(ctx, req)
+		if err == nil && len(responseMessage.ToolCalls) == 0 && !json.Valid([]byte(responseMessage.Content)) {
+			err = ErrInvalidJSONResponse
+		}
+	}
+	if canceled := turnCanceled(ctx); canceled != nil {
+		return nil, canceled
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	return &responseMessage, nil
+	responseMessage.ID = fmt.Sprintf("msg_%d", time.Now().UnixNano())
+	if len(responseMessage.ToolCalls) == 0 {
+		e.postProcess(responseMessage)
+	}
+	return responseMessage, nil
 }
 
 func (e *ChatEngine) executeLLMRequestedToolCalls(
+	ctx context.Context,
 	conv *Conversation,
 	toolCalls []ToolCall,
 	callback MessageUpdateCallback,
+	onDelta DeltaCallback,
+	onToolStart ToolStartCallback,
+	format *ResponseFormat,
+	sampling SamplingParams,
+	allowedTools toolFilter,
+	decisions map[string]bool,
+	logger *slog.Logger,
 ) ([]*Message, error) {
 	allNewMessages := make([]*Message, 0)
-	maxIterations := 10 // Prevent infinite loops
+	maxIterations := e.maxToolIterations // Prevent infinite loops
 	iteration := 0
 
+	repeats := &toolCallRepeatTracker{}
+	warnedAboutRepeats := false
+	stuckRepeating := false
+	toolCallsRun := 0
+
 	for len(toolCalls) > 0 && iteration < maxIterations {
+		// Pause before the round if some of its calls need approval. decisions only covers
+		// the round the turn resumes with.
+		if waiting := e.awaitingApproval(conv, toolCalls, allowedTools, decisions); len(waiting) > 0 {
+			logger.Info("Waiting for approval of tool calls", "tool_calls", len(waiting))
+			e.scheduleApprovalTimeout(conv.ID, waiting)
+			return allNewMessages, &ApprovalRequiredError{ToolCalls: waiting}
+		}
+
 		iteration++
-		log.Printf("Tool call iteration %d: executing %d tool calls", iteration, len(toolCalls))
+		logger.Debug("Executing tool calls", "iteration", iteration, "tool_calls", len(toolCalls))
+
+		// Save the messages so far, so the round can be continued if the server goes down
+		e.saveTurnMessages(conv, logger)
 
 		// Execute all tool calls in this round
+		repeatedInRound := 0
 		for _, toolCall := range toolCalls {
 			var output string
-			var err error
-
-			switch toolCall.Name {
-			case "bash_command":
-				var args map[string]interface{}
-				if err := json.Unmarshal([]byte(toolCall.Arguments), &args); err != nil {
-					log.Printf("Error parsing tool call arguments: %v", err)
-					continue
-				}
-				command, ok := args["command"].(string)
-				if !ok {
-					log.Printf("Tool call missing command argument")
-					continue
-				}
-
-				// Check if command should run in background
-				background, _ := args["background"].(bool)
-				if background {
-					output, err = executeBashCommandBackground(command, e.processManager, conv.ID)
-				} else {
-					output, err = executeBashCommand(command)
-					if err != nil {
-						fmt.Printf("Error executing bash command: %v, output: %s\n", err, output)
-					}
-				}
-
-			case "list_processes":
-				processes := e.processManager.ListProcesses()
-				if len(processes) == 0 {
-					output = "No background processes running."
-				} else {
-					var lines []string
-					for _, proc := range processes {
-						duration := time.Since(proc.StartTime).Round(time.Second)
-						lines = append(lines, fmt.Sprintf("PID: %d | Command: %s | Running for: %s", proc.PID, proc.Command, duration))
-					}
-					output = fmt.Sprintf("Running background processes (%d):\n%s", len(processes), strings.Join(lines, "\n"))
-				}
-
-			case "kill_process":
-				var args map[string]interface{}
-				if err := json.Unmarshal([]byte(toolCall.Arguments), &args); err != nil {
-					log.Printf("Error parsing tool call arguments: %v", err)
-					continue
+			count := repeats.observe(toolCall)
+			if turnCanceled(ctx) != nil {
+				// Calls left in the round are answered so the history stays valid
+				output = "Not executed: the user canceled the turn."
+			} else if e.maxRepeatedToolCalls > 0 && count >= e.maxRepeatedToolCalls {
+				logger.Warn("Tool call repeated, not executing", "tool", toolCall.Name, "repeats", count)
+				repeatedInRound++
+				output = fmt.Sprintf(
+					"This exact %s call (same arguments) has been requested %d times in a row and was not executed again. "+
+						"Repeating it will not produce a different result; try a different approach.",
+					toolCall.Name, count,
+				)
+			} else if e.toolCallBudgetExhausted(conv) {
+				logger.Warn("Conversation reached its lifetime tool call limit, not executing", "tool", toolCall.Name, "limit", e.maxConversationToolCalls)
+				output = fmt.Sprintf(
+					"Not executed: this conversation has reached its limit of %d tool calls and can't use tools anymore. "+
+						"Answer with the information you already have.",
+					e.maxConversationToolCalls,
+				)
+			} else if !allowedTools.allows(toolCall.Name) {
+				logger.Warn("Tool is not available in this turn, not executing", "tool", toolCall.Name)
+				output = fmt.Sprintf("Not executed: the %s tool is not available in this conversation.", toolCall.Name)
+			} else if rejection := e.rejectionOutput(conv, toolCall, decisions); rejection != "" {
+				logger.Info("Not executing tool call without approval", "tool", toolCall.Name, "tool_call_id", toolCall.ID)
+				output = rejection
+			} else {
+				if onToolStart != nil {
+					onToolStart(toolCall)
 				}
-				pidFloat, ok := args["pid"].(float64)
-				if !ok {
-					output = "Error: invalid PID"
-					break
+				var ran bool
+				output, ran = e.executeToolCall(ctx, conv, toolCall, logger.With("tool", toolCall.Name, "tool_call_id", toolCall.ID))
+				if ran {
+					toolCallsRun++
+					e.countToolCall(conv)
 				}
-				pid := int(pidFloat)
-				err = e.processManager.KillProcess(pid)
-				if err != nil {
-					output = fmt.Sprintf("Error killing process: %v", err)
-				} else {
-					output = fmt.Sprintf("Successfully killed process %d", pid)
-				}
-
-			default:
-				log.Printf("Unknown tool call: %s", toolCall.Name)
-				continue
 			}
 
 			// Add tool response message
@@ -412,62 +1144,297 @@ func (e *ChatEngine) executeLLMRequestedToolCalls(
 				Content:    output,
 				TollCallID: toolCall.ID,
 			}
-			if err := conv.AddMessageWithDB(&toolMessage, e.db); err != nil {
-				log.Printf("Failed to save tool message to database: %v", err)
-			}
+			e.addTurnMessage(conv, &toolMessage)
 			allNewMessages = append(allNewMessages, &toolMessage)
 			if callback != nil {
 				callback(&toolMessage)
 			}
 		}
 
-		// Get response from OpenAI after tool execution
-		params := openai.ChatCompletionNewParams{
-			Messages: conv.ToOpenAIMessages(),
-			Tools:    allTools,
-			Model:    openai.ChatModelGPT5,
-		}
-		completion, err := e.client.Chat.Completions.New(context.Background(), params)
-		if err != nil {
-			return nil, fmt.Errorf("can't send message with tool responses: %v", err)
+		if canceled := turnCanceled(ctx); canceled != nil {
+			logger.Info("Turn canceled, stopping tool loop")
+			return allNewMessages, canceled
 		}
 
-		// Extract tool calls from the response
-		toolCalls = make([]ToolCall, len(completion.Choices[0].Message.ToolCalls))
-		for i, toolCall := range completion.Choices[0].Message.ToolCalls {
-			toolCalls[i] = ToolCall{
-				ID:        toolCall.ID,
-				Type:      string(toolCall.Type),
-				Name:      toolCall.Function.Name,
-				Arguments: toolCall.Function.Arguments,
+		// A model that keeps repeating itself after being warned is stuck, stop the loop
+		if repeatedInRound > 0 {
+			if warnedAboutRepeats {
+				logger.Warn("Tool calls kept repeating after warning, stopping tool loop")
+				stuckRepeating = true
+				break
 			}
+			warnedAboutRepeats = true
 		}
 
-		// Create assistant message
-		assistantMessage := Message{
-			ID:        fmt.Sprintf("msg_%d", time.Now().UnixNano()),
-			Role:      "assistant",
-			Content:   completion.Choices[0].Message.Content,
-			ToolCalls: toolCalls,
-		}
-		if err := conv.AddMessageWithDB(&assistantMessage, e.db); err != nil {
-			log.Printf("Failed to save assistant message to database: %v", err)
+		// Get response from the model after tool execution
+		assistantMessage, err := e.sendUserMessageToLLMStream(ctx, conv, onDelta, format, sampling, allowedTools)
+		if errors.Is(err, ErrTurnCanceled) {
+			logger.Info("Turn canceled, stopping tool loop")
+			return allNewMessages, err
+		} else if err != nil {
+			return nil, fmt.Errorf("can't send message with tool responses: %v", err)
 		}
-		allNewMessages = append(allNewMessages, &assistantMessage)
+		toolCalls = assistantMessage.ToolCalls
+		decisions = nil
+
+		e.addTurnMessage(conv, assistantMessage)
+		allNewMessages = append(allNewMessages, assistantMessage)
 		if callback != nil {
-			callback(&assistantMessage)
+			callback(assistantMessage)
 		}
 
 		// If there are no more tool calls, we're done
 		if len(toolCalls) == 0 {
-			log.Printf("No more tool calls, conversation complete")
+			logger.Debug("No more tool calls, turn complete")
 			break
 		}
 	}
 
-	if iteration >= maxIterations {
-		log.Printf("Warning: reached max iterations (%d) for tool calls", maxIterations)
+	// The loop was stopped, the turn still ends with a reply to the user
+	if stuckRepeating {
+		allNewMessages = append(allNewMessages, e.finishStuckRepeating(ctx, conv, callback, logger))
+		return allNewMessages, nil
+	}
+
+	// The model still wants tools but the budget is spent: end the turn with an explanation
+	if len(toolCalls) > 0 {
+		logger.Warn("Reached the tool call iteration limit", "max_iterations", maxIterations)
+		limitMessages := e.finishAtIterationLimit(ctx, conv, toolCalls, maxIterations, toolCallsRun, callback, logger)
+		allNewMessages = append(allNewMessages, limitMessages...)
+		return allNewMessages, &IterationLimitError{MaxIterations: maxIterations, ToolCalls: toolCallsRun}
 	}
 
 	return allNewMessages, nil
 }
+
+// IterationLimitError is returned together with the turn's messages when the turn ended
+// because the model still requested tools after the iteration limit. The turn is complete
+// and saved, but the task may not be.
+type IterationLimitError struct {
+	MaxIterations int
+	ToolCalls     int
+}
+
+func (err *IterationLimitError) Error() string {
+	return fmt.Sprintf("stopped after reaching the limit of %d tool call rounds (%d tool calls)", err.MaxIterations, err.ToolCalls)
+}
+
+// iterationLimitData is available to the iteration limit message template
+type iterationLimitData struct {
+	MaxIterations int
+	ToolCalls     int
+}
+
+// finishAtIterationLimit answers tool calls left pending when the iteration cap was reached,
+// so the conversation stays valid for the next turn, and appends a final assistant message.
+// Canceling ctx, the turn's context, stops summarizing the progress.
+func (e *ChatEngine) finishAtIterationLimit(
+	ctx context.Context,
+	conv *Conversation,
+	pending []ToolCall,
+	maxIterations int,
+	toolCallsRun int,
+	callback MessageUpdateCallback,
+	logger *slog.Logger,
+) []*Message {
+	newMessages := make([]*Message, 0, len(pending)+1)
+
+	for _, toolCall := range pending {
+		toolMessage := Message{
+			ID:         fmt.Sprintf("msg_%d", time.Now().UnixNano()),
+			Role:       "tool",
+			Content:    "Not executed: the tool call limit for this turn was reached.",
+			TollCallID: toolCall.ID,
+		}
+		e.addTurnMessage(conv, &toolMessage)
+		newMessages = append(newMessages, &toolMessage)
+		if callback != nil {
+			callback(&toolMessage)
+		}
+	}
+
+	var content string
+	if e.iterationLimitSummary {
+		summary, err := e.summarizeAtIterationLimit(ctx, conv)
+		if err != nil {
+			logger.Error("Failed to summarize progress at iteration limit", "error", err)
+		}
+		content = summary
+	}
+	if strings.TrimSpace(content) == "" {
+		var buf bytes.Buffer
+		data := iterationLimitData{MaxIterations: maxIterations, ToolCalls: toolCallsRun}
+		if err := e.iterationLimitTemplate.Execute(&buf, data); err != nil {
+			logger.Error("Failed to render iteration limit message", "error", err)
+			buf.Reset()
+			fmt.Fprintf(&buf, "Stopped after reaching the limit of %d tool call rounds.", maxIterations)
+		}
+		content = buf.String()
+	}
+
+	assistantMessage := Message{
+		ID:      fmt.Sprintf("msg_%d", time.Now().UnixNano()),
+		Role:    "assistant",
+		Content: content,
+	}
+	e.postProcess(&assistantMessage)
+	e.addTurnMessage(conv, &assistantMessage)
+	newMessages = append(newMessages, &assistantMessage)
+	if callback != nil {
+		callback(&assistantMessage)
+	}
+
+	return newMessages
+}
+
+const (
+	iterationLimitInstruction = "You have reached the limit of tool calls for this task and cannot call any more tools. " +
+		"Tell the user the task hit its complexity limit, summarize what has been done so far " +
+		"and what remains, and suggest how to continue."
+
+	repeatedToolCallsInstruction = "You kept requesting the same tool call after being told it won't run again, so the " +
+		"tool loop was stopped and you cannot call any more tools. Tell the user what you tried, what you found " +
+		"out so far and why you are stuck."
+
+	// repeatedToolCallsMessage ends a turn stopped for repeated tool calls when the model
+	// can't be asked for a final reply
+	repeatedToolCallsMessage = "I stopped because I kept repeating the same tool call without making progress. " +
+		"Send another message with more guidance if you want me to try differently."
+)
+
+// summarizeAtIterationLimit asks the model, without offering any tools, to summarize its progress
+func (e *ChatEngine) summarizeAtIterationLimit(ctx context.Context, conv *Conversation) (string, error) {
+	return e.replyWithoutTools(ctx, conv, iterationLimitInstruction)
+}
+
+// finishStuckRepeating appends a final assistant message to a turn whose tool loop was stopped
+// because the model kept repeating a tool call, so the turn doesn't end on a tool message. The
+// model is asked for it without tools, a fixed message is used if that fails.
+func (e *ChatEngine) finishStuckRepeating(ctx context.Context, conv *Conversation, callback MessageUpdateCallback, logger *slog.Logger) *Message {
+	content, err := e.replyWithoutTools(ctx, conv, repeatedToolCallsInstruction)
+	if err != nil {
+		logger.Error("Failed to get a final reply after repeated tool calls", "error", err)
+	}
+	if strings.TrimSpace(content) == "" {
+		content = repeatedToolCallsMessage
+	}
+
+	assistantMessage := Message{
+		ID:      fmt.Sprintf("msg_%d", time.Now().UnixNano()),
+		Role:    "assistant",
+		Content: content,
+	}
+	e.postProcess(&assistantMessage)
+	e.addTurnMessage(conv, &assistantMessage)
+	if callback != nil {
+		callback(&assistantMessage)
+	}
+	return &assistantMessage
+}
+
+// replyWithoutTools asks the model for a reply to the conversation following a system
+// instruction, without offering any tools
+func (e *ChatEngine) replyWithoutTools(ctx context.Context, conv *Conversation, instruction string) (string, error) {
+	messages := e.contextMessages(conv, e.model, nil)
+	messages = append(messages, &Message{Role: "system", Content: instruction})
+
+	response, err := e.complete(ctx, CompletionRequest{Messages: messages, Model: e.model, Sampling: e.sampling})
+	if err != nil {
+		return "", err
+	}
+
+	return response.Content, nil
+}
+
+// executeToolCall runs a single tool call requested by the LLM and returns its output. Every
+// tool call needs a response, so a call that is blocked, of an unknown tool or with invalid
+// arguments gets the reason as its output; ran is false then, as no tool ran.
+func (e *ChatEngine) executeToolCall(ctx context.Context, conv *Conversation, toolCall ToolCall, logger *slog.Logger) (output string, ran bool) {
+	if violation := e.readOnlyViolation(conv, toolCall); violation != "" {
+		logger.Info("Blocked tool call in read-only conversation")
+		return violation, false
+	}
+	if violation := e.commandPolicyViolation(toolCall); violation != "" {
+		logger.Info("Blocked tool call by command policy")
+		return violation, false
+	}
+
+	tool, ok := e.tools.Get(toolCall.Name)
+	if !ok {
+		logger.Warn("Unknown tool call")
+		return fmt.Sprintf("Error: there is no tool named %s", toolCall.Name), false
+	}
+
+	ctx = context.WithValue(ctx, toolScopeKey{}, &toolScope{conv: conv, logger: logger})
+	output, timedOut, err := e.executeWithTimeout(ctx, tool, json.RawMessage(toolCall.Arguments))
+	if timedOut {
+		logger.Warn("Tool call timed out", "timeout", e.toolTimeout)
+		return fmt.Sprintf("Error: tool %s timed out after %s", toolCall.Name, e.toolTimeout), true
+	}
+	if errors.Is(err, ErrInvalidToolArguments) {
+		logger.Warn("Invalid tool call arguments", "error", err)
+		return "Error: " + err.Error(), false
+	}
+	if err != nil {
+		output = "Error: " + err.Error()
+	}
+	return output, true
+}
+
+// executeWithTimeout runs a tool within the tool timeout. The tool's context is canceled once
+// it times out, a tool that ignores it is left running in the background.
+func (e *ChatEngine) executeWithTimeout(ctx context.Context, tool Tool, args json.RawMessage) (output string, timedOut bool, err error) {
+	if e.toolTimeout <= 0 {
+		output, err = tool.Execute(ctx, args)
+		return output, false, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		output string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		output, err := tool.Execute(ctx, args)
+		done <- result{output, err}
+	}()
+
+	timer := time.NewTimer(e.toolTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.output, false, res.err
+	case <-timer.C:
+		return "", true, nil
+	}
+}
+
+// toolCallRepeatTracker counts how many times in a row the same tool call was requested
+type toolCallRepeatTracker struct {
+	lastKey string
+	count   int
+}
+
+// observe records a tool call and returns how many consecutive times it has been seen
+func (t *toolCallRepeatTracker) observe(toolCall ToolCall) int {
+	key := toolCall.Name + "\x00" + compactJSON(toolCall.Arguments)
+	if key == t.lastKey {
+		t.count++
+	} else {
+		t.lastKey = key
+		t.count = 1
+	}
+	return t.count
+}
+
+// compactJSON strips insignificant whitespace so equivalent arguments compare equal
+func compactJSON(s string) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, []byte(s)); err != nil {
+		return s
+	}
+	return buf.String()
+}
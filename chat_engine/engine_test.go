@@ -0,0 +1,700 @@
+package chat_engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/openai/openai-go/v2"
+)
+
+// countingTool is a tool that counts its calls
+type countingTool struct {
+	name  string
+	calls atomic.Int64
+}
+
+func (c *countingTool) Definition() openai.ChatCompletionToolUnionParam {
+	return openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
+		Name:       c.name,
+		Parameters: openai.FunctionParameters{"type": "object", "properties": map[string]any{}},
+	})
+}
+
+func (c *countingTool) Execute(ctx context.Context, args json.RawMessage) (string, error) {
+	c.calls.Add(1)
+	return "counted", nil
+}
+
+// funcTool is a tool that runs a function
+type funcTool struct {
+	name string
+	run  func(ctx context.Context, args json.RawMessage) (string, error)
+}
+
+func (f *funcTool) Definition() openai.ChatCompletionToolUnionParam {
+	return openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
+		Name:       f.name,
+		Parameters: openai.FunctionParameters{"type": "object", "properties": map[string]any{}},
+	})
+}
+
+func (f *funcTool) Execute(ctx context.Context, args json.RawMessage) (string, error) {
+	return f.run(ctx, args)
+}
+
+func TestRepeatedToolCallsAreStopped(t *testing.T) {
+	const maxRepeats = 3
+	tool := &countingTool{name: "count"}
+	// The model keeps asking for the same call whatever it gets back, until it is offered no tools
+	provider := &fakeProvider{reply: func(n int, req CompletionRequest) (*Message, error) {
+		if req.Tools == nil {
+			return textReply("I kept counting and got stuck"), nil
+		}
+		return toolCallReply("call_1", "count", `{}`), nil
+	}}
+	engine := newTestEngine(t, provider, WithTool(tool), WithMaxRepeatedToolCalls(maxRepeats))
+
+	messages, err := engine.SendUserMessage("conv", "count")
+	if err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+
+	if got := tool.calls.Load(); got != maxRepeats-1 {
+		t.Errorf("tool ran %d times, want %d", got, maxRepeats-1)
+	}
+	// Refused once with a warning, the loop stops when the model repeats the call again and the
+	// model is asked for a final reply
+	requests := provider.Requests()
+	if got := len(requests); got != maxRepeats+2 {
+		t.Errorf("model was asked %d times, want %d", got, maxRepeats+2)
+	}
+	if tools := requests[len(requests)-1].Tools; tools != nil {
+		t.Errorf("final reply was requested with %d tools, want none", len(tools))
+	}
+	refused := messages[len(messages)-2]
+	if refused.Role != "tool" || !strings.Contains(refused.Content, "was not executed again") {
+		t.Errorf("message before the last is %s %q, want the refused tool call", refused.Role, refused.Content)
+	}
+	last := messages[len(messages)-1]
+	if last.Role != "assistant" || last.Content != "I kept counting and got stuck" {
+		t.Errorf("last message is %s %q, want the final reply", last.Role, last.Content)
+	}
+}
+
+func TestRepeatedToolCallsStoppedWithoutFinalReply(t *testing.T) {
+	tool := &countingTool{name: "count"}
+	// Also asked for the final reply, the model only comes up with the same call
+	provider := newFakeProvider(toolCallReply("call_1", "count", `{}`))
+	engine := newTestEngine(t, provider, WithTool(tool), WithMaxRepeatedToolCalls(2))
+
+	messages, err := engine.SendUserMessage("conv", "count")
+	if err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	last := messages[len(messages)-1]
+	if last.Role != "assistant" || last.Content != repeatedToolCallsMessage {
+		t.Errorf("last message is %s %q, want the fixed explanation", last.Role, last.Content)
+	}
+}
+
+func TestRepeatedToolCallsWithDifferentArgumentsRun(t *testing.T) {
+	tool := &countingTool{name: "count"}
+	provider := newFakeProvider(
+		toolCallReply("call_1", "count", `{"n": 1}`),
+		toolCallReply("call_2", "count", `{"n": 2}`),
+		toolCallReply("call_3", "count", `{"n": 3}`),
+		textReply("done"),
+	)
+	engine := newTestEngine(t, provider, WithTool(tool), WithMaxRepeatedToolCalls(2))
+
+	if _, err := engine.SendUserMessage("conv", "count"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if got := tool.calls.Load(); got != 3 {
+		t.Errorf("tool ran %d times, want 3", got)
+	}
+}
+
+func TestToolCallRepeatTrackerIgnoresWhitespace(t *testing.T) {
+	var tracker toolCallRepeatTracker
+	tracker.observe(ToolCall{Name: "read_file", Arguments: `{"path": "a.go"}`})
+	if got := tracker.observe(ToolCall{Name: "read_file", Arguments: `{"path":"a.go"}`}); got != 2 {
+		t.Errorf("equivalent arguments counted %d times, want 2", got)
+	}
+	if got := tracker.observe(ToolCall{Name: "read_file", Arguments: `{"path":"b.go"}`}); got != 1 {
+		t.Errorf("different arguments counted %d times, want 1", got)
+	}
+}
+
+func TestToOpenAIMessageRoles(t *testing.T) {
+	system := ToOpenAIMessage(&Message{Role: "system", Content: "be brief"})
+	if system.OfSystem == nil || system.OfUser != nil {
+		t.Fatalf("system message converted to %+v, want a system message", system)
+	}
+	if got := system.OfSystem.Content.OfString.Value; got != "be brief" {
+		t.Errorf("system content = %q, want %q", got, "be brief")
+	}
+
+	summary := ToOpenAIMessage(&Message{Role: "summary", Content: "earlier"})
+	if summary.OfSystem == nil || !strings.HasSuffix(summary.OfSystem.Content.OfString.Value, "earlier") {
+		t.Errorf("summary converted to %+v, want a system message", summary)
+	}
+	if msg := ToOpenAIMessage(&Message{Role: "user", Content: "hi"}); msg.OfUser == nil {
+		t.Errorf("user message converted to %+v, want a user message", msg)
+	}
+	if msg := ToOpenAIMessage(&Message{Role: "tool", Content: "out", TollCallID: "call_1"}); msg.OfTool == nil || msg.OfTool.ToolCallID != "call_1" {
+		t.Errorf("tool message converted to %+v, want a tool message for call_1", msg)
+	}
+}
+
+func TestWithModelAppliesToEveryCompletionOfATurn(t *testing.T) {
+	tool := &countingTool{name: "count"}
+	provider := newFakeProvider(
+		&Message{Role: "assistant", ToolCalls: []ToolCall{
+			{ID: "call_1", Type: "function", Name: "count", Arguments: `{"n": 1}`},
+			{ID: "call_2", Type: "function", Name: "count", Arguments: `{"n": 2}`},
+		}},
+		toolCallReply("call_3", "count", `{"n": 3}`),
+		textReply("done"),
+	)
+	engine := newTestEngine(t, provider, WithTool(tool), WithModel("chosen-model"))
+
+	messages, err := engine.SendUserMessage("conv", "count")
+	if err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	requests := provider.Requests()
+	if len(requests) != 3 {
+		t.Fatalf("model was asked %d times, want 3", len(requests))
+	}
+	for i, req := range requests {
+		if req.Model != "chosen-model" {
+			t.Errorf("completion %d used model %q, want chosen-model", i, req.Model)
+		}
+	}
+	for _, msg := range messages {
+		if msg.Role == "assistant" && msg.Model != "chosen-model" {
+			t.Errorf("assistant message %q records model %q, want chosen-model", msg.Content, msg.Model)
+		}
+	}
+}
+
+func TestUnusableToolCallsAreAnswered(t *testing.T) {
+	tool := &countingTool{name: "count"}
+	provider := newFakeProvider(
+		&Message{Role: "assistant", ToolCalls: []ToolCall{
+			{ID: "call_unknown", Type: "function", Name: "no_such_tool", Arguments: `{}`},
+			{ID: "call_invalid", Type: "function", Name: "bash_command", Arguments: `{"command": `},
+			{ID: "call_missing", Type: "function", Name: "bash_command", Arguments: `{}`},
+			{ID: "call_count", Type: "function", Name: "count", Arguments: `{}`},
+		}},
+		textReply("done"),
+	)
+	engine := newTestEngine(t, provider, WithTool(tool))
+
+	messages, err := engine.SendUserMessage("conv", "use tools")
+	if err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+
+	outputs := make(map[string]string)
+	for _, msg := range messages {
+		if msg.Role == "tool" {
+			outputs[msg.TollCallID] = msg.Content
+		}
+	}
+	for id, want := range map[string]string{
+		"call_unknown": "Error: there is no tool named no_such_tool",
+		"call_invalid": "Error: invalid tool arguments",
+		"call_missing": "Error: invalid tool arguments: missing the command argument",
+		"call_count":   "counted",
+	} {
+		if got, ok := outputs[id]; !ok || !strings.HasPrefix(got, want) {
+			t.Errorf("response to %s is %q (present: %v), want it to start with %q", id, got, ok, want)
+		}
+	}
+	// Only the call that ran counts
+	if got := engine.GetConversation("conv").ToolCallCount; got != 1 {
+		t.Errorf("tool call count is %d, want 1", got)
+	}
+	// The next request answers every tool call
+	if report := ValidateTranscript(provider.Requests()[1].Messages); !report.Valid {
+		t.Errorf("follow-up request is invalid: %+v", report.Problems)
+	}
+}
+
+func TestBlockedToolCallsDoNotUseBudget(t *testing.T) {
+	tool := &countingTool{name: "count"}
+	policy, err := NewCommandPolicy(CommandPolicyAllowlist, []string{`^echo\b`})
+	if err != nil {
+		t.Fatalf("NewCommandPolicy: %v", err)
+	}
+	provider := newFakeProvider(
+		&Message{Role: "assistant", ToolCalls: []ToolCall{
+			{ID: "call_read_only", Type: "function", Name: "write_file", Arguments: `{"path": "notes.txt", "content": "x"}`},
+			{ID: "call_policy", Type: "function", Name: "bash_command", Arguments: `{"command": "rm -rf build"}`},
+			{ID: "call_disabled", Type: "function", Name: "read_file", Arguments: `{"path": "notes.txt"}`},
+			{ID: "call_count", Type: "function", Name: "count", Arguments: `{}`},
+			{ID: "call_repeated", Type: "function", Name: "count", Arguments: `{}`},
+		}},
+		textReply("done"),
+		toolCallReply("call_next_turn", "count", `{}`),
+		textReply("done again"),
+	)
+	engine := newTestEngine(t, provider,
+		WithTool(tool),
+		WithCommandPolicy(policy),
+		WithMaxRepeatedToolCalls(2),
+		WithMaxConversationToolCalls(2),
+	)
+	if err := engine.SetReadOnly("conv", true); err != nil {
+		t.Fatalf("SetReadOnly: %v", err)
+	}
+	if err := engine.SetAllowedTools("conv", []string{"write_file", "bash_command", "count"}); err != nil {
+		t.Fatalf("SetAllowedTools: %v", err)
+	}
+
+	messages, err := engine.SendUserMessage("conv", "use tools")
+	if err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	outputs := toolOutputs(messages)
+	for _, id := range []string{"call_read_only", "call_policy", "call_disabled", "call_repeated"} {
+		if output := outputs[id]; output == "" || output == "counted" {
+			t.Errorf("response to %s is %q, want why it was blocked", id, output)
+		}
+	}
+	// Only the call that ran counts against the budget of 2
+	if got := engine.GetConversation("conv").ToolCallCount; got != 1 {
+		t.Fatalf("tool call count is %d, want 1", got)
+	}
+
+	// So the next turn still has a call left
+	messages, err = engine.SendUserMessage("conv", "count again")
+	if err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if output := toolOutputs(messages)["call_next_turn"]; output != "counted" {
+		t.Errorf("call of the next turn got %q, want it to run", output)
+	}
+	if got := tool.calls.Load(); got != 2 {
+		t.Errorf("tool ran %d times, want 2", got)
+	}
+}
+
+func TestEphemeralTurnIsNotSaved(t *testing.T) {
+	tool := &countingTool{name: "count"}
+	provider := newFakeProvider(
+		textReply("hello"),
+		toolCallReply("call_1", "count", `{}`), textReply("counted once"),
+		toolCallReply("call_2", "count", `{}`), textReply("counted again"),
+	)
+	engine := newTestEngine(t, provider, WithTool(tool))
+	if _, err := engine.SendUserMessage("conv", "hi"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+
+	// In an existing conversation and in a new one
+	for _, id := range []string{"conv", "scratch"} {
+		messages, err := engine.SendUserMessageWithOptions(id, "count", SendOptions{Ephemeral: true})
+		if err != nil {
+			t.Fatalf("SendUserMessageWithOptions: %v", err)
+		}
+		if len(messages) != 4 {
+			t.Errorf("ephemeral turn returned %d messages, want 4", len(messages))
+		}
+	}
+
+	stored, err := engine.db.LoadConversation("conv")
+	if err != nil {
+		t.Fatalf("LoadConversation: %v", err)
+	}
+	if len(stored.Messages) != 2 || stored.ToolCallCount != 0 {
+		t.Errorf("conversation has %d messages and %d tool calls stored, want only the first turn", len(stored.Messages), stored.ToolCallCount)
+	}
+	if got := len(engine.GetConversation("conv").Messages); got != 2 {
+		t.Errorf("conversation has %d messages in memory, want 2", got)
+	}
+	if scratch, err := engine.db.LoadConversation("scratch"); err != nil || scratch != nil {
+		t.Errorf("ephemeral conversation was stored: %+v, %v", scratch, err)
+	}
+	if _, total, err := engine.db.ListConversationSummaries(10, 0, ""); err != nil || total != 1 {
+		t.Errorf("%d conversations are stored (%v), want 1", total, err)
+	}
+}
+
+func TestEditMessage(t *testing.T) {
+	provider := newFakeProvider(textReply("hello"), textReply("hi again"))
+	engine := newTestEngine(t, provider)
+	for _, content := range []string{"hi", "hi there"} {
+		if _, err := engine.SendUserMessage("conv", content); err != nil {
+			t.Fatalf("SendUserMessage: %v", err)
+		}
+	}
+	messages := engine.GetConversation("conv").Messages
+
+	// An edited reply keeps the messages after it
+	conv, err := engine.EditMessage("conv", messages[1].ID, "hello!")
+	if err != nil {
+		t.Fatalf("EditMessage: %v", err)
+	}
+	if len(conv.Messages) != 4 || conv.Messages[1].Content != "hello!" {
+		t.Fatalf("after editing the reply the conversation has %d messages, the reply is %q", len(conv.Messages), conv.Messages[1].Content)
+	}
+
+	// An edited prompt drops the replies to it, in the database too
+	if _, err := engine.EditMessage("conv", messages[2].ID, "bye"); err != nil {
+		t.Fatalf("EditMessage: %v", err)
+	}
+	stored, err := engine.db.LoadConversation("conv")
+	if err != nil {
+		t.Fatalf("LoadConversation: %v", err)
+	}
+	if len(stored.Messages) != 3 || stored.Messages[2].Content != "bye" || stored.Messages[1].Content != "hello!" {
+		t.Errorf("stored messages after editing the prompt: %+v", stored.Messages)
+	}
+
+	if _, err := engine.EditMessage("conv", "no_such_message", "x"); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("editing an unknown message returned %v, want ErrMessageNotFound", err)
+	}
+}
+
+func TestEditMessageWhileTurnRunning(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	hanging := &funcTool{name: "count", run: func(context.Context, json.RawMessage) (string, error) {
+		close(started)
+		<-release
+		return "counted", nil
+	}}
+	provider := newFakeProvider(textReply("hello"), toolCallReply("call_1", "count", `{}`), textReply("done"))
+	engine := newTestEngine(t, provider, WithTool(hanging))
+	if _, err := engine.SendUserMessage("conv", "hi"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	first := engine.GetConversation("conv").Messages[0]
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		engine.SendUserMessage("conv", "count")
+	}()
+	<-started
+
+	if _, err := engine.EditMessage("conv", first.ID, "edited"); !errors.Is(err, ErrTurnRunning) {
+		t.Errorf("editing during a turn returned %v, want ErrTurnRunning", err)
+	}
+	close(release)
+	<-done
+	if content := engine.GetConversation("conv").Messages[0].Content; content != "hi" {
+		t.Errorf("message was changed to %q during the turn", content)
+	}
+}
+
+// toolLoopProvider asks for another call of the count tool whenever it is offered tools, with
+// new arguments each time so the calls aren't repeats
+func toolLoopProvider() *fakeProvider {
+	return &fakeProvider{reply: func(n int, req CompletionRequest) (*Message, error) {
+		if req.Tools == nil {
+			return textReply("Here is how far I got."), nil
+		}
+		return toolCallReply(fmt.Sprintf("call_%d", n), "count", fmt.Sprintf(`{"n": %d}`, n)), nil
+	}}
+}
+
+func TestIterationLimitMessage(t *testing.T) {
+	tool := &countingTool{name: "count"}
+	engine := newTestEngine(t, toolLoopProvider(),
+		WithTool(tool),
+		WithMaxToolIterations(2),
+		WithIterationLimitMessage("Out of budget after {{.MaxIterations}} rounds and {{.ToolCalls}} tool calls."),
+	)
+
+	messages, err := engine.SendUserMessage("conv", "count forever")
+	var limitErr *IterationLimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("SendUserMessage returned %v, want an IterationLimitError", err)
+	}
+	last := messages[len(messages)-1]
+	if want := "Out of budget after 2 rounds and 2 tool calls."; last.Role != "assistant" || last.Content != want {
+		t.Errorf("last message is %s %q, want %q", last.Role, last.Content, want)
+	}
+	// The call requested after the limit is answered without running
+	if got := toolOutputs(messages)["call_2"]; got != "Not executed: the tool call limit for this turn was reached." {
+		t.Errorf("call after the limit got %q", got)
+	}
+	if got := tool.calls.Load(); got != 2 {
+		t.Errorf("tool ran %d times, want 2", got)
+	}
+	stored, err := engine.db.LoadConversation("conv")
+	if err != nil {
+		t.Fatalf("LoadConversation: %v", err)
+	}
+	if got := stored.Messages[len(stored.Messages)-1].Content; got != last.Content {
+		t.Errorf("stored last message is %q, want the limit message", got)
+	}
+}
+
+func TestCancelTurnStopsIterationLimitSummary(t *testing.T) {
+	tool := &countingTool{name: "count"}
+	var engine *ChatEngine
+	var calls atomic.Int64
+	provider := funcProvider(func(ctx context.Context, req CompletionRequest) (*Message, error) {
+		n := calls.Add(1)
+		if req.Tools != nil {
+			return toolCallReply(fmt.Sprintf("call_%d", n), "count", fmt.Sprintf(`{"n": %d}`, n)), nil
+		}
+		// The summary at the iteration limit, offered no tools, waits for the turn to be canceled
+		go engine.CancelTurn("conv", false)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	engine = newTestEngine(t, provider, WithTool(tool), WithMaxToolIterations(1), WithIterationLimitSummary(true))
+
+	messages, err := engine.SendUserMessage("conv", "count")
+	var limitErr *IterationLimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("SendUserMessage returned %v, want an IterationLimitError", err)
+	}
+	last := messages[len(messages)-1]
+	if last.Role != "assistant" || !strings.HasPrefix(last.Content, "I stopped because this task hit the complexity limit") {
+		t.Errorf("last message is %s %q, want the iteration limit message", last.Role, last.Content)
+	}
+}
+
+func TestSlowToolTimesOut(t *testing.T) {
+	canceled := make(chan struct{})
+	slow := &funcTool{name: "slow", run: func(ctx context.Context, args json.RawMessage) (string, error) {
+		<-ctx.Done()
+		close(canceled)
+		return "finished anyway", nil
+	}}
+	provider := newFakeProvider(toolCallReply("call_slow", "slow", `{}`), textReply("the tool hung"))
+	engine := newTestEngine(t, provider, WithTool(slow), WithToolTimeout(100*time.Millisecond))
+
+	start := time.Now()
+	messages, err := engine.SendUserMessage("conv", "run the slow tool")
+	if err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("turn took %s, the tool timeout is 100ms", elapsed)
+	}
+	if want := "Error: tool slow timed out after 100ms"; toolOutputs(messages)["call_slow"] != want {
+		t.Errorf("tool output = %q, want %q", toolOutputs(messages)["call_slow"], want)
+	}
+	if last := messages[len(messages)-1]; last.Content != "the tool hung" {
+		t.Errorf("turn ended with %+v, want the model's reply to the timeout", last)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("the timed out tool's context was not canceled")
+	}
+}
+
+func TestFastToolBeatsTimeout(t *testing.T) {
+	fast := &funcTool{name: "fast", run: func(ctx context.Context, args json.RawMessage) (string, error) {
+		return "quick", nil
+	}}
+	provider := newFakeProvider(toolCallReply("call_fast", "fast", `{}`), textReply("done"))
+	engine := newTestEngine(t, provider, WithTool(fast), WithToolTimeout(time.Minute))
+
+	messages, err := engine.SendUserMessage("conv", "run the fast tool")
+	if err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if got := toolOutputs(messages)["call_fast"]; got != "quick" {
+		t.Errorf("tool output = %q, want quick", got)
+	}
+}
+
+func TestSystemPromptIsSentFirst(t *testing.T) {
+	provider := newFakeProvider(textReply("Hi."))
+	engine := newTestEngine(t, provider)
+
+	if _, err := engine.SendUserMessageWithOptions("conv", "hi", SendOptions{SystemPrompt: "Be brief."}); err != nil {
+		t.Fatalf("first turn: %v", err)
+	}
+	// Later turns keep the stored prompt
+	if _, err := engine.SendUserMessage("conv", "hi again"); err != nil {
+		t.Fatalf("second turn: %v", err)
+	}
+	for i, req := range provider.Requests() {
+		if first := req.Messages[0]; first.Role != "system" || first.Content != "Be brief." {
+			t.Errorf("request %d starts with %s %q, want the system prompt", i, first.Role, first.Content)
+		}
+		if got := req.Messages[1]; got.Role != "user" || got.Content != "hi" {
+			t.Errorf("request %d continues with %s %q, want the first prompt", i, got.Role, got.Content)
+		}
+	}
+
+	stored, err := engine.db.LoadConversation("conv")
+	if err != nil {
+		t.Fatalf("LoadConversation: %v", err)
+	}
+	if stored.SystemPrompt != "Be brief." {
+		t.Errorf("stored system prompt is %q", stored.SystemPrompt)
+	}
+	for _, msg := range stored.Messages {
+		if msg.Role == "system" {
+			t.Errorf("system prompt was stored as a message")
+		}
+	}
+	if openaiMessages := stored.ToOpenAIMessages(); openaiMessages[0].OfSystem == nil {
+		t.Errorf("converted messages don't start with the system prompt")
+	}
+}
+
+// reopenEngine closes engine and opens a new one on the same database and workspace, so
+// conversations are loaded from the database
+func reopenEngine(t *testing.T, engine *ChatEngine, provider CompletionProvider) *ChatEngine {
+	t.Helper()
+	dir := engine.workspaceRoot
+	engine.Close()
+	reopened, err := NewChatEngine(provider, WithDatabaseURL(filepath.Join(dir, "agent.db")), WithWorkspaceRoot(dir))
+	if err != nil {
+		t.Fatalf("NewChatEngine: %v", err)
+	}
+	t.Cleanup(func() { reopened.Close() })
+	return reopened
+}
+
+func TestConversationTimesSurviveRestart(t *testing.T) {
+	provider := newFakeProvider(textReply("Hello."))
+	engine := newTestEngine(t, provider)
+	before := time.Now().Add(-time.Second)
+	if _, err := engine.SendUserMessage("conv", "hi"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+
+	conv := reopenEngine(t, engine, provider).GetConversation("conv")
+	if conv == nil {
+		t.Fatal("conversation was not stored")
+	}
+	// The database keeps whole seconds
+	after := time.Now().Add(time.Second)
+	if conv.CreatedAt.Before(before) || conv.CreatedAt.After(after) {
+		t.Errorf("created at %s, want between %s and %s", conv.CreatedAt, before, after)
+	}
+	if conv.UpdatedAt.Before(conv.CreatedAt) || conv.UpdatedAt.After(after) {
+		t.Errorf("updated at %s, want between the creation at %s and %s", conv.UpdatedAt, conv.CreatedAt, after)
+	}
+}
+
+func TestMessageTimesSurviveRestart(t *testing.T) {
+	provider := newFakeProvider(
+		toolCallReply("call_1", "count", `{}`),
+		textReply("Counted."),
+		textReply("Hello again."),
+	)
+	engine := newTestEngine(t, provider, WithTool(&countingTool{name: "count"}))
+	first, err := engine.SendUserMessage("conv", "count")
+	if err != nil {
+		t.Fatalf("first turn: %v", err)
+	}
+	second, err := engine.SendUserMessage("conv", "hi")
+	if err != nil {
+		t.Fatalf("second turn: %v", err)
+	}
+	sent := append(first, second...)
+
+	conv := reopenEngine(t, engine, provider).GetConversation("conv")
+	if conv == nil || len(conv.Messages) != len(sent) {
+		t.Fatalf("loaded %v, want the %d messages sent", conv, len(sent))
+	}
+	// The database keeps milliseconds
+	for i, msg := range conv.Messages {
+		if msg.ID != sent[i].ID || msg.CreatedAt.Sub(sent[i].CreatedAt).Abs() >= time.Millisecond {
+			t.Errorf("message %d is %s created at %s, want %s created at %s", i, msg.ID, msg.CreatedAt, sent[i].ID, sent[i].CreatedAt)
+		}
+		if msg.CreatedAt.IsZero() {
+			t.Errorf("message %s has no time", msg.ID)
+		}
+		if i > 0 && msg.CreatedAt.Before(conv.Messages[i-1].CreatedAt) {
+			t.Errorf("message %s is older than the one before it", msg.ID)
+		}
+	}
+}
+
+func TestCancelTurnStopsToolLoop(t *testing.T) {
+	var engine *ChatEngine
+	var calls atomic.Int64
+	tool := &funcTool{name: "step", run: func(ctx context.Context, args json.RawMessage) (string, error) {
+		if calls.Add(1) == 2 {
+			if err := engine.CancelTurn("conv", false); err != nil {
+				t.Errorf("CancelTurn: %v", err)
+			}
+		}
+		return "stepped", nil
+	}}
+	// The model keeps asking for another step
+	engine = newTestEngine(t, funcProvider(func(ctx context.Context, req CompletionRequest) (*Message, error) {
+		n := calls.Load()
+		return toolCallReply(fmt.Sprintf("call_%d", n), "step", fmt.Sprintf(`{"n": %d}`, n)), nil
+	}), WithTool(tool))
+
+	messages, err := engine.SendUserMessage("conv", "step forever")
+	if !errors.Is(err, ErrTurnCanceled) {
+		t.Fatalf("SendUserMessage returned %v, want ErrTurnCanceled", err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("tool ran %d times, want the loop to stop after the call that canceled it", got)
+	}
+	// The messages up to the cancellation are kept, with every call answered
+	if report := ValidateTranscript(messages); !report.Valid {
+		t.Errorf("turn ended with an invalid transcript: %+v", report.Problems)
+	}
+	stored, err := engine.db.LoadConversation("conv")
+	if err != nil {
+		t.Fatalf("LoadConversation: %v", err)
+	}
+	if len(stored.Messages) != len(messages) {
+		t.Errorf("stored %d messages, want the %d of the canceled turn", len(stored.Messages), len(messages))
+	}
+	if engine.TurnRunning("conv") {
+		t.Error("canceled turn is still running")
+	}
+	if err := engine.CancelTurn("conv", false); !errors.Is(err, ErrNoActiveTurn) {
+		t.Errorf("canceling again returned %v, want ErrNoActiveTurn", err)
+	}
+}
+
+func TestInvalidUserMessagesAreRejected(t *testing.T) {
+	provider := newFakeProvider(textReply("ok"), textReply("ok"))
+	engine := newTestEngine(t, provider, WithMaxMessageBytes(10))
+
+	tests := map[string]error{
+		"":            ErrEmptyMessage,
+		" \n\t":       ErrEmptyMessage,
+		"eleven byte": ErrMessageTooLong,
+		"ünïcödé":     ErrMessageTooLong, // 7 characters, 11 bytes
+	}
+	for content, want := range tests {
+		if _, err := engine.SendUserMessage("conv", content); !errors.Is(err, want) {
+			t.Errorf("SendUserMessage(%q) = %v, want %v", content, err, want)
+		}
+	}
+	if n := len(provider.Requests()); n != 0 {
+		t.Errorf("rejected messages made %d requests", n)
+	}
+	if conv := engine.GetConversation("conv"); conv != nil {
+		t.Errorf("rejected messages created a conversation with %d messages", len(conv.Messages))
+	}
+
+	// A message at the limit is sent
+	if _, err := engine.SendUserMessage("conv", "ten bytes!"); err != nil {
+		t.Errorf("message of 10 bytes was rejected: %v", err)
+	}
+	unlimited := newTestEngine(t, newFakeProvider(textReply("ok")), WithMaxMessageBytes(0))
+	if _, err := unlimited.SendUserMessage("conv", strings.Repeat("x", defaultMaxMessageBytes+1)); err != nil {
+		t.Errorf("message was rejected without a limit: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package chat_engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ExportFormat is a file format conversations can be exported to
+type ExportFormat string
+
+const (
+	// ExportMarkdown renders a conversation as a readable document
+	ExportMarkdown ExportFormat = "markdown"
+	// ExportJSON is the conversation as returned by the API, suitable for re-import
+	ExportJSON ExportFormat = "json"
+)
+
+// ParseExportFormat validates an export format name
+func ParseExportFormat(s string) (ExportFormat, error) {
+	switch format := ExportFormat(s); format {
+	case ExportMarkdown, ExportJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown export format %q", s)
+	}
+}
+
+// FileExtension returns the extension, without dot, of files in this format
+func (f ExportFormat) FileExtension() string {
+	if f == ExportMarkdown {
+		return "md"
+	}
+	return string(f)
+}
+
+// ExportConversation renders the full history of a conversation in the given format
+func (e *ChatEngine) ExportConversation(conversationID string, format ExportFormat) ([]byte, error) {
+	conv := e.GetConversation(conversationID)
+	if conv == nil {
+		return nil, fmt.Errorf("conversation %s not found", conversationID)
+	}
+
+	e.conversationsMutex.RLock()
+	defer e.conversationsMutex.RUnlock()
+
+	switch format {
+	case ExportMarkdown:
+		return []byte(RenderMarkdown(conv, time.Now())), nil
+	case ExportJSON:
+		return json.MarshalIndent(conv, "", "  ")
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// RenderMarkdown renders a conversation as Markdown. Tool calls are shown below the message
+// requesting them as fenced code blocks, followed by their output.
+func RenderMarkdown(conv *Conversation, exportedAt time.Time) string {
+	var b strings.Builder
+
+	title := conv.Title
+	if title == "" {
+		title = "Conversation " + conv.ID
+	}
+	fmt.Fprintf(&b, "# %s\n\n", title)
+	fmt.Fprintf(&b, "- Conversation ID: `%s`\n", conv.ID)
+	if !conv.CreatedAt.IsZero() {
+		fmt.Fprintf(&b, "- Created: %s\n", conv.CreatedAt.UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintf(&b, "- Exported: %s\n", exportedAt.UTC().Format(time.RFC3339))
+
+	if conv.SystemPrompt != "" {
+		fmt.Fprintf(&b, "\n## System prompt\n\n%s\n", conv.SystemPrompt)
+	}
+
+	// Tool output is shown with the call that produced it rather than as a separate turn
+	outputs := make(map[string]*Message)
+	for _, msg := range conv.Messages {
+		if msg.Role == "tool" && msg.TollCallID != "" {
+			outputs[msg.TollCallID] = msg
+		}
+	}
+	shown := make(map[*Message]bool)
+
+	for _, msg := range conv.Messages {
+		if msg.Role == "tool" && shown[msg] {
+			continue
+		}
+
+		if msg.CreatedAt.IsZero() {
+			fmt.Fprintf(&b, "\n## %s\n", roleHeading(msg.Role))
+		} else {
+			fmt.Fprintf(&b, "\n## %s (%s)\n", roleHeading(msg.Role), msg.CreatedAt.UTC().Format(time.RFC3339))
+		}
+		if msg.Role == "tool" {
+			// Output of a call that isn't in the transcript
+			fmt.Fprintf(&b, "\n%s", fencedBlock("text", msg.Content))
+		} else if msg.Content != "" {
+			fmt.Fprintf(&b, "\n%s\n", strings.TrimRight(msg.Content, "\n"))
+		}
+
+		for _, toolCall := range msg.ToolCalls {
+			language, code := toolCallSource(toolCall)
+			fmt.Fprintf(&b, "\n**Tool call:** `%s`\n\n%s", toolCall.Name, fencedBlock(language, code))
+			if output, ok := outputs[toolCall.ID]; ok {
+				fmt.Fprintf(&b, "\n**Output:**\n\n%s", fencedBlock("text", output.Content))
+				shown[output] = true
+			}
+		}
+	}
+
+	return b.String()
+}
+
+func roleHeading(role string) string {
+	switch role {
+	case "user":
+		return "User"
+	case "assistant":
+		return "Assistant"
+	case "tool":
+		return "Tool"
+	case "system":
+		return "System"
+	case "summary":
+		return "Summary"
+	default:
+		return role
+	}
+}
+
+// toolCallSource returns what to show for a tool call: the command for shell tools and
+// the indented arguments otherwise
+func toolCallSource(toolCall ToolCall) (language, code string) {
+	var args map[string]interface{}
+	if err := json.Unmarshal([]byte(toolCall.Arguments), &args); err != nil {
+		return "json", toolCall.Arguments
+	}
+
+	if toolCall.Name == "bash_command" || toolCall.Name == "shell" {
+		if command, ok := args["command"].(string); ok {
+			return "bash", command
+		}
+	}
+
+	indented, err := json.MarshalIndent(args, "", "  ")
+	if err != nil {
+		return "json", toolCall.Arguments
+	}
+	return "json", string(indented)
+}
+
+// fencedBlock wraps code in a fence longer than any run of backticks it contains
+func fencedBlock(language, code string) string {
+	longest, run := 0, 0
+	for _, r := range code {
+		if r == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	fence := strings.Repeat("`", max(3, longest+1))
+	return fmt.Sprintf("%s%s\n%s\n%s\n", fence, language, strings.TrimRight(code, "\n"), fence)
+}
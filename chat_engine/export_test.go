@@ -0,0 +1,72 @@
+package chat_engine
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	conv := &Conversation{
+		ID:           "conv",
+		Title:        "Listing files",
+		SystemPrompt: "Be brief.",
+		CreatedAt:    created,
+		Messages: []*Message{
+			{Role: "user", Content: "list files", CreatedAt: created},
+			{Role: "assistant", ToolCalls: []ToolCall{
+				{ID: "call_1", Name: "bash_command", Arguments: `{"command": "ls"}`},
+				{ID: "call_2", Name: "read_file", Arguments: `{"path": "a.md"}`},
+			}},
+			{Role: "tool", TollCallID: "call_1", Content: "a.md\n"},
+			{Role: "tool", TollCallID: "call_2", Content: "```go\n```\n"},
+			{Role: "assistant", Content: "There is a.md."},
+		},
+	}
+
+	want := "# Listing files\n\n" +
+		"- Conversation ID: `conv`\n" +
+		"- Created: 2026-01-02T03:04:05Z\n" +
+		"- Exported: 2026-01-03T00:00:00Z\n" +
+		"\n## System prompt\n\nBe brief.\n" +
+		"\n## User (2026-01-02T03:04:05Z)\n\nlist files\n" +
+		"\n## Assistant\n" +
+		"\n**Tool call:** `bash_command`\n\n```bash\nls\n```\n" +
+		"\n**Output:**\n\n```text\na.md\n```\n" +
+		"\n**Tool call:** `read_file`\n\n```json\n{\n  \"path\": \"a.md\"\n}\n```\n" +
+		"\n**Output:**\n\n````text\n```go\n```\n````\n" +
+		"\n## Assistant\n\nThere is a.md.\n"
+	if got := RenderMarkdown(conv, time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC)); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestExportConversation(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("Hello.")))
+	if _, err := engine.SendUserMessage("conv", "hi"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+
+	data, err := engine.ExportConversation("conv", ExportJSON)
+	if err != nil {
+		t.Fatalf("JSON export: %v", err)
+	}
+	var exported Conversation
+	if err := json.Unmarshal(data, &exported); err != nil {
+		t.Fatalf("invalid JSON export %s: %v", data, err)
+	}
+	if exported.ID != "conv" || len(exported.Messages) != 2 || exported.Messages[1].Content != "Hello." {
+		t.Errorf("exported %s, want the conversation with its messages", data)
+	}
+
+	if _, err := engine.ExportConversation("conv", ExportMarkdown); err != nil {
+		t.Errorf("Markdown export: %v", err)
+	}
+	if _, err := engine.ExportConversation("missing", ExportJSON); err == nil {
+		t.Error("exporting an unknown conversation succeeded")
+	}
+	if _, err := ParseExportFormat("pdf"); err == nil {
+		t.Error("unknown export format was accepted")
+	}
+}
@@ -0,0 +1,156 @@
+package chat_engine
+
+import (
+	"fmt"
+	"time"
+)
+
+// ForkConversation starts a new conversation from the history of another one, to explore an
+// alternative path without changing the original. The fork gets the messages up to and
+// including fromMessageID, or all of them when it is empty, under new IDs, together with the
+// title and system prompt. Its ParentID is the original conversation. It returns
+// ErrMessageNotFound if the conversation has no such message.
+func (e *ChatEngine) ForkConversation(conversationID, fromMessageID string) (*Conversation, error) {
+	if e.GetConversation(conversationID) == nil {
+		return nil, fmt.Errorf("conversation %s not found", conversationID)
+	}
+
+	forkID := fmt.Sprintf("conv_%d", time.Now().UnixNano())
+	if err := e.db.CopyConversation(conversationID, forkID, fromMessageID, conversationID); err != nil {
+		return nil, err
+	}
+
+	fork := e.GetConversation(forkID)
+	if fork == nil {
+		return nil, fmt.Errorf("failed to load forked conversation %s", forkID)
+	}
+	return fork, nil
+}
+
+// DuplicateConversation copies a whole conversation into a new one, for example to start
+// several conversations from the same template. Unlike a fork the copy has no parent, it is
+// independent of the original.
+func (e *ChatEngine) DuplicateConversation(conversationID string) (*Conversation, error) {
+	if e.GetConversation(conversationID) == nil {
+		return nil, fmt.Errorf("conversation %s not found", conversationID)
+	}
+	// Messages of a running turn are only saved once it ends
+	if e.TurnRunning(conversationID) {
+		return nil, ErrTurnRunning
+	}
+
+	copyID := fmt.Sprintf("conv_%d", time.Now().UnixNano())
+	if err := e.db.CopyConversation(conversationID, copyID, "", ""); err != nil {
+		return nil, err
+	}
+
+	duplicate := e.GetConversation(copyID)
+	if duplicate == nil {
+		return nil, fmt.Errorf("failed to load duplicated conversation %s", copyID)
+	}
+	return duplicate, nil
+}
+
+// CopyConversation copies a conversation into a new one with the ID targetID in a single
+// transaction. Messages are copied in order, up to and including throughMessageID unless it
+// is empty, under new IDs and with their tool calls and embeddings. The copy keeps the title
+// and system prompt and records parentID as its parent. It returns ErrMessageNotFound if
+// throughMessageID is not a message of the conversation.
+func (d *DB) CopyConversation(sourceID, targetID, throughMessageID, parentID string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO conversations (id, title, system_prompt, parent_id)
+		SELECT ?, title, system_prompt, ? FROM conversations WHERE id = ?
+	`, targetID, parentID, sourceID)
+	if err != nil {
+		return fmt.Errorf("failed to create conversation copy: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to create conversation copy: %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("conversation %s not found", sourceID)
+	}
+
+	rows, err := tx.Query(`SELECT id FROM messages WHERE conversation_id = ? ORDER BY created_at ASC, rowid ASC`, sourceID)
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+	var messageIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan message: %w", err)
+		}
+		messageIDs = append(messageIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating messages: %w", err)
+	}
+
+	if throughMessageID != "" {
+		end := -1
+		for i, id := range messageIDs {
+			if id == throughMessageID {
+				end = i
+				break
+			}
+		}
+		if end == -1 {
+			return ErrMessageNotFound
+		}
+		messageIDs = messageIDs[:end+1]
+	}
+
+	// New IDs follow the msg_<nanoseconds> scheme, kept increasing within the copy
+	var lastNano int64
+	for _, oldID := range messageIDs {
+		nano := time.Now().UnixNano()
+		if nano <= lastNano {
+			nano = lastNano + 1
+		}
+		lastNano = nano
+		newID := fmt.Sprintf("msg_%d", nano)
+
+		_, err := tx.Exec(`
+			INSERT INTO messages (id, conversation_id, role, content, tool_call_id, model, prompt_tokens, completion_tokens, raw_content, images, created_at)
+			SELECT ?, ?, role, content, tool_call_id, model, prompt_tokens, completion_tokens, raw_content, images, created_at
+			FROM messages WHERE id = ?
+		`, newID, targetID, oldID)
+		if err != nil {
+			return fmt.Errorf("failed to copy message %s: %w", oldID, err)
+		}
+		_, err = tx.Exec(`
+			INSERT INTO tool_calls (message_id, tool_call_id, type, name, arguments)
+			SELECT ?, tool_call_id, type, name, arguments FROM tool_calls WHERE message_id = ? ORDER BY id ASC
+		`, newID, oldID)
+		if err != nil {
+			return fmt.Errorf("failed to copy tool calls of message %s: %w", oldID, err)
+		}
+		_, err = tx.Exec(`
+			INSERT INTO messages_fts (content, message_id, conversation_id)
+			SELECT content, ?, ? FROM messages_fts WHERE message_id = ?
+		`, newID, targetID, oldID)
+		if err != nil {
+			return fmt.Errorf("failed to index message copy: %w", err)
+		}
+		_, err = tx.Exec(`
+			INSERT INTO message_embeddings (message_id, conversation_id, vector)
+			SELECT ?, ?, vector FROM message_embeddings WHERE message_id = ?
+		`, newID, targetID, oldID)
+		if err != nil {
+			return fmt.Errorf("failed to copy embedding of message %s: %w", oldID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package chat_engine
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// messageContents returns the roles and contents of messages, with their tool calls
+func messageContents(messages []*Message) []string {
+	contents := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		content := msg.Role + ": " + msg.Content
+		for _, call := range msg.ToolCalls {
+			content += " [" + call.ID + " " + call.Name + " " + call.Arguments + "]"
+		}
+		if msg.TollCallID != "" {
+			content += " (" + msg.TollCallID + ")"
+		}
+		contents = append(contents, content)
+	}
+	return contents
+}
+
+func TestForkConversation(t *testing.T) {
+	provider := newFakeProvider(toolCallReply("call_1", "bash_command", `{"command": "echo hi"}`), textReply("It printed hi."), textReply("Forked reply."))
+	engine := newTestEngine(t, provider)
+	if _, err := engine.SendUserMessage("source", "run echo"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if err := engine.SetSystemPrompt("source", "be brief"); err != nil {
+		t.Fatalf("SetSystemPrompt: %v", err)
+	}
+	source := engine.GetConversation("source")
+	sourceContents := messageContents(source.Messages)
+
+	// Fork after the tool's output, before the reply
+	fork, err := engine.ForkConversation("source", source.Messages[2].ID)
+	if err != nil {
+		t.Fatalf("ForkConversation: %v", err)
+	}
+	if !strings.HasPrefix(fork.ID, "conv_") || fork.ID == "source" || fork.ParentID != "source" || fork.SystemPrompt != "be brief" {
+		t.Errorf("fork is %s with parent %q and system prompt %q", fork.ID, fork.ParentID, fork.SystemPrompt)
+	}
+	if got, want := messageContents(fork.Messages), sourceContents[:3]; strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("fork has messages\n%q\nwant\n%q", got, want)
+	}
+	for i, msg := range fork.Messages {
+		if !strings.HasPrefix(msg.ID, "msg_") || msg.ID == source.Messages[i].ID {
+			t.Errorf("fork message %d has ID %q, want a new msg_ ID", i, msg.ID)
+		}
+	}
+
+	// Continuing the fork leaves the source as it was
+	if _, err := engine.SendUserMessage(fork.ID, "and now?"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	source = reopenEngine(t, engine, provider).GetConversation("source")
+	if got := messageContents(source.Messages); strings.Join(got, "\n") != strings.Join(sourceContents, "\n") {
+		t.Errorf("source changed to\n%q", got)
+	}
+	if source.ParentID != "" {
+		t.Errorf("source got the parent %q", source.ParentID)
+	}
+}
+
+func TestForkWholeConversation(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("Hello.")))
+	if _, err := engine.SendUserMessage("source", "hi"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+
+	fork, err := engine.ForkConversation("source", "")
+	if err != nil {
+		t.Fatalf("ForkConversation: %v", err)
+	}
+	if got := messageContents(fork.Messages); len(got) != 2 || got[1] != "assistant: Hello." {
+		t.Errorf("fork has messages %q, want the whole history", got)
+	}
+}
+
+func TestForkConversationErrors(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("Hello.")))
+	if _, err := engine.SendUserMessage("source", "hi"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+
+	if _, err := engine.ForkConversation("source", "msg_missing"); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("forking at an unknown message returned %v, want ErrMessageNotFound", err)
+	}
+	if _, err := engine.ForkConversation("missing", ""); err == nil {
+		t.Error("forked a conversation that doesn't exist")
+	}
+	if page, _ := engine.ListConversationsPaged(10, 0, ""); page.Total != 1 {
+		t.Errorf("%d conversations exist after failed forks, want 1", page.Total)
+	}
+}
+
+func TestDuplicateConversation(t *testing.T) {
+	provider := newFakeProvider(toolCallReply("call_1", "bash_command", `{"command": "echo hi"}`), textReply("It printed hi."), textReply("Copy reply."))
+	engine := newTestEngine(t, provider)
+	if _, err := engine.SendUserMessage("source", "run echo"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if err := engine.SetSystemPrompt("source", "be brief"); err != nil {
+		t.Fatalf("SetSystemPrompt: %v", err)
+	}
+	source := engine.GetConversation("source")
+	sourceContents := messageContents(source.Messages)
+
+	duplicate, err := engine.DuplicateConversation("source")
+	if err != nil {
+		t.Fatalf("DuplicateConversation: %v", err)
+	}
+	if !strings.HasPrefix(duplicate.ID, "conv_") || duplicate.ParentID != "" || duplicate.SystemPrompt != "be brief" {
+		t.Errorf("duplicate is %s with parent %q and system prompt %q, want a new conv_ ID without a parent", duplicate.ID, duplicate.ParentID, duplicate.SystemPrompt)
+	}
+	// The same messages in the same order, tool calls still matching their outputs
+	if got := messageContents(duplicate.Messages); strings.Join(got, "\n") != strings.Join(sourceContents, "\n") {
+		t.Errorf("duplicate has messages\n%q\nwant\n%q", got, sourceContents)
+	}
+	for i, msg := range duplicate.Messages {
+		if !strings.HasPrefix(msg.ID, "msg_") || msg.ID == source.Messages[i].ID {
+			t.Errorf("duplicate message %d has ID %q, want a new msg_ ID", i, msg.ID)
+		}
+	}
+
+	if _, err := engine.SendUserMessage(duplicate.ID, "again"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	source = reopenEngine(t, engine, provider).GetConversation("source")
+	if got := messageContents(source.Messages); strings.Join(got, "\n") != strings.Join(sourceContents, "\n") {
+		t.Errorf("source changed to\n%q", got)
+	}
+}
+
+func TestDuplicateConversationWithRunningTurn(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("Hello.")))
+	if _, err := engine.SendUserMessage("source", "hi"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+
+	_, end := engine.beginTurn("source", "")
+	if _, err := engine.DuplicateConversation("source"); !errors.Is(err, ErrTurnRunning) {
+		t.Errorf("duplicating during a turn returned %v, want ErrTurnRunning", err)
+	}
+	end()
+	if _, err := engine.DuplicateConversation("source"); err != nil {
+		t.Errorf("duplicating after the turn: %v", err)
+	}
+	if _, err := engine.DuplicateConversation("missing"); err == nil {
+		t.Error("duplicated a conversation that doesn't exist")
+	}
+}
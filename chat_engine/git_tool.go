@@ -0,0 +1,189 @@
+package chat_engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// gitSubcommands are the git subcommands the git tool runs
+var gitSubcommands = map[string]bool{
+	"status": true,
+	"diff":   true,
+	"log":    true,
+	"add":    true,
+	"commit": true,
+	"branch": true,
+}
+
+// gitBlockedArgs are arguments the git tool refuses, by subcommand, because they destroy
+// work, rewrite history or write files outside of git's control
+var gitBlockedArgs = map[string]map[string]string{
+	"branch": {
+		"-f":      "forcing is not allowed",
+		"--force": "forcing is not allowed",
+		"-D":      "force-deleting branches is not allowed",
+		"-M":      "force-renaming branches is not allowed",
+		"-C":      "force-copying branches is not allowed",
+	},
+	"commit": {
+		"--amend": "rewriting commits is not allowed",
+	},
+	"diff": {
+		"--output": "writing output to files is not allowed",
+	},
+	"log": {
+		"--output": "writing output to files is not allowed",
+	},
+}
+
+// gitBranchWriteFlags are branch flags that create, delete or change branches
+var gitBranchWriteFlags = map[string]bool{
+	"-d": true, "--delete": true, "-m": true, "--move": true, "-c": true, "--copy": true,
+	"-u": true, "--set-upstream-to": true, "--unset-upstream": true, "--edit-description": true,
+	"-t": true, "--track": true, "--no-track": true,
+}
+
+// gitBranchListFlags make branch list branches even when given a pattern or commit
+var gitBranchListFlags = map[string]bool{
+	"-l": true, "--list": true, "--contains": true, "--no-contains": true,
+	"--merged": true, "--no-merged": true, "--points-at": true,
+}
+
+// gitCall is a call of the git tool
+type gitCall struct {
+	Subcommand string   `json:"subcommand"`
+	Args       []string `json:"args"`
+}
+
+// commandLine returns the call as a git command line, for the audit log and command policies
+func (c gitCall) commandLine() string {
+	words := append([]string{"git", c.Subcommand}, c.Args...)
+	for i, word := range words {
+		if word == "" || strings.ContainsAny(word, " \t\n'\"\\$`|&;<>(){}*?") {
+			words[i] = "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// check returns why the call is not allowed, or ""
+func (c gitCall) check() string {
+	if !gitSubcommands[c.Subcommand] {
+		return fmt.Sprintf("git %s is not supported, use one of status, diff, log, add, commit or branch", c.Subcommand)
+	}
+	blocked := gitBlockedArgs[c.Subcommand]
+	for _, arg := range c.Args {
+		name, _, _ := strings.Cut(arg, "=")
+		if reason := blocked[name]; reason != "" {
+			return fmt.Sprintf("%s: %s", arg, reason)
+		}
+		// Combined short flags of branch, e.g. -vD
+		if c.Subcommand == "branch" && len(arg) > 2 && arg[0] == '-' && arg[1] != '-' {
+			for _, flag := range arg[1:] {
+				if reason := blocked["-"+string(flag)]; reason != "" {
+					return fmt.Sprintf("%s: %s", arg, reason)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// writeReason returns why the call changes the repository, or "" when it only reads
+func (c gitCall) writeReason() string {
+	switch c.Subcommand {
+	case "add", "commit":
+		return "git " + c.Subcommand
+	case "branch":
+		listing := false
+		for _, arg := range c.Args {
+			name, _, _ := strings.Cut(arg, "=")
+			if gitBranchWriteFlags[name] {
+				return "git branch " + arg
+			}
+			listing = listing || gitBranchListFlags[name]
+		}
+		if listing {
+			return ""
+		}
+		// Without a list flag a branch name creates the branch
+		for _, arg := range c.Args {
+			if !strings.HasPrefix(arg, "-") {
+				return "git branch " + arg
+			}
+		}
+	}
+	return ""
+}
+
+// runGit runs a git tool call in dir and returns its combined output, cut from the middle
+// beyond maxOutput bytes, followed by the exit code. The command is recorded with audit. git
+// gets the environment env, or the server's when it is nil.
+func runGit(parent context.Context, call gitCall, dir string, env []string, timeout time.Duration, maxOutput int, audit auditFunc) (string, error) {
+	ctx := parent
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Global options come before the subcommand, so the model's arguments can't add any
+	args := append([]string{"--no-pager", "-c", "color.ui=never", "-c", "core.editor=true", call.Subcommand}, call.Args...)
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = append(env, "GIT_TERMINAL_PROMPT=0", "GIT_EDITOR=true")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 5 * time.Second
+
+	output := newHeadTailBuffer(maxOutput)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	start := time.Now()
+	err := cmd.Run()
+
+	exitCode := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	} else if err != nil {
+		exitCode = -1
+	}
+
+	entry := CommandAuditEntry{
+		Command:    call.commandLine(),
+		WorkingDir: dir,
+		ExitCode:   &exitCode,
+		DurationMS: time.Since(start).Milliseconds(),
+		StartedAt:  start,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	audit(&entry)
+
+	result := strings.TrimRight(output.String(), "\n")
+	if parent.Err() != nil {
+		return fmt.Sprintf("%s\n[git was killed because the turn was canceled]", result), context.Cause(parent)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Sprintf("%s\n[git timed out after %s and was killed]", result, timeout), ctx.Err()
+	}
+	if exitCode == -1 {
+		return "", fmt.Errorf("failed to run git: %w", err)
+	}
+	return fmt.Sprintf("%s\n[exit code: %d]", result, exitCode), nil
+}
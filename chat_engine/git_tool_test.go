@@ -0,0 +1,102 @@
+package chat_engine
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// gitTestEngine returns an engine whose workspace is a new git repository
+func gitTestEngine(t *testing.T) *ChatEngine {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	// Keep the user's git configuration out of the tests
+	t.Setenv("GIT_CONFIG_GLOBAL", "/dev/null")
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_AUTHOR_NAME", "Test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "Test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")))
+	init := exec.Command("git", "init", "-q", "-b", "main")
+	init.Dir = engine.workspaceRoot
+	if output, err := init.CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v: %s", err, output)
+	}
+	// The engine's database lives in the workspace too
+	writeFiles(t, engine.workspaceRoot, map[string]string{".git/info/exclude": "agent.db*\n"})
+	return engine
+}
+
+func TestGitToolCommits(t *testing.T) {
+	engine := gitTestEngine(t)
+	writeFiles(t, engine.workspaceRoot, map[string]string{"README.md": "hello\n"})
+
+	if output := callTool(t, engine, "conv", "git", `{"subcommand": "status", "args": ["--short"]}`); output != "?? README.md\n[exit code: 0]" {
+		t.Errorf("status output is %q", output)
+	}
+	callTool(t, engine, "conv", "git", `{"subcommand": "add", "args": ["README.md"]}`)
+	if output := callTool(t, engine, "conv", "git", `{"subcommand": "commit", "args": ["-m", "Add the readme"]}`); !strings.Contains(output, "Add the readme") || !strings.HasSuffix(output, "[exit code: 0]") {
+		t.Errorf("commit output is %q", output)
+	}
+	if output := callTool(t, engine, "conv", "git", `{"subcommand": "log", "args": ["--format=%s"]}`); output != "Add the readme\n[exit code: 0]" {
+		t.Errorf("log output is %q", output)
+	}
+
+	// Failing commands report their exit code
+	output := callTool(t, engine, "conv", "git", `{"subcommand": "diff", "args": ["no-such-revision"]}`)
+	if !strings.HasSuffix(output, "[exit code: 128]") {
+		t.Errorf("diff of an unknown revision returned %q, want exit code 128", output)
+	}
+}
+
+func TestGitToolRefusesDestructiveCalls(t *testing.T) {
+	engine := gitTestEngine(t)
+
+	tests := map[string]string{
+		`{"subcommand": "push"}`:                                   "git push is not supported",
+		`{"subcommand": "commit", "args": ["--amend", "-m", "x"]}`: "--amend: rewriting commits is not allowed",
+		`{"subcommand": "branch", "args": ["-D", "main"]}`:         "-D: force-deleting branches is not allowed",
+		`{"subcommand": "branch", "args": ["-vD", "main"]}`:        "-vD: force-deleting branches is not allowed",
+		`{"subcommand": "branch", "args": ["--force", "main"]}`:    "--force: forcing is not allowed",
+		`{"subcommand": "diff", "args": ["--output=/tmp/diff"]}`:   "--output=/tmp/diff: writing output to files is not allowed",
+	}
+	for args, want := range tests {
+		if output := callTool(t, engine, "conv", "git", args); !strings.HasPrefix(output, "Error: "+want) {
+			t.Errorf("%s: output is %q, want %q", args, output, "Error: "+want)
+		}
+	}
+}
+
+func TestGitCallWriteReason(t *testing.T) {
+	tests := []struct {
+		call   gitCall
+		writes bool
+	}{
+		{gitCall{Subcommand: "status"}, false},
+		{gitCall{Subcommand: "log", Args: []string{"-p"}}, false},
+		{gitCall{Subcommand: "add", Args: []string{"."}}, true},
+		{gitCall{Subcommand: "commit", Args: []string{"-m", "x"}}, true},
+		{gitCall{Subcommand: "branch"}, false},
+		{gitCall{Subcommand: "branch", Args: []string{"-a"}}, false},
+		{gitCall{Subcommand: "branch", Args: []string{"--list", "feature/*"}}, false},
+		{gitCall{Subcommand: "branch", Args: []string{"feature"}}, true},
+		{gitCall{Subcommand: "branch", Args: []string{"-d", "feature"}}, true},
+		{gitCall{Subcommand: "branch", Args: []string{"--set-upstream-to=origin/main"}}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.call.writeReason() != ""; got != tt.writes {
+			t.Errorf("%s: writes %v, want %v", tt.call.commandLine(), got, tt.writes)
+		}
+	}
+}
+
+func TestGitCallCommandLine(t *testing.T) {
+	call := gitCall{Subcommand: "commit", Args: []string{"-m", "Fix the parser's bug"}}
+	if got, want := call.commandLine(), `git commit -m 'Fix the parser'\''s bug'`; got != want {
+		t.Errorf("commandLine() = %s, want %s", got, want)
+	}
+}
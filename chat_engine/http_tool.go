@@ -0,0 +1,155 @@
+package chat_engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// httpGetTimeout bounds an http_get request including reading the body
+	httpGetTimeout = 30 * time.Second
+	// defaultMaxHTTPResponseBytes caps how much of a response body is returned to the model
+	defaultMaxHTTPResponseBytes = 100 * 1024
+	// httpGetMaxRedirects is how many redirects http_get follows
+	httpGetMaxRedirects = 5
+)
+
+// blockedPrefixes are address ranges http_get may not connect to unless private networks are
+// allowed, in addition to loopback, private, link-local and unspecified addresses
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // Carrier-grade NAT
+}
+
+// errBlockedAddress is returned when http_get would connect to an internal address
+var errBlockedAddress = errors.New("connecting to private, loopback and link-local addresses is not allowed")
+
+// WithHTTPPrivateNetworks lets the http_get tool fetch from loopback, private and link-local
+// addresses, which it refuses by default so the model can't reach internal services
+func WithHTTPPrivateNetworks(allowed bool) Option {
+	return func(e *ChatEngine) {
+		e.httpAllowPrivate = allowed
+	}
+}
+
+// WithMaxHTTPResponseBytes caps how much of a response body http_get returns
+func WithMaxHTTPResponseBytes(n int) Option {
+	return func(e *ChatEngine) {
+		e.maxHTTPResponseBytes = n
+	}
+}
+
+// isBlockedAddress reports whether addr is an internal address http_get must not connect to
+func isBlockedAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsUnspecified() || addr.IsMulticast() {
+		return true
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// newHTTPGetClient returns the client used by http_get. Unless allowPrivate is set, addresses
+// are checked when connecting, after DNS resolution, so neither a hostname resolving to an
+// internal address nor a redirect to one gets through.
+func newHTTPGetClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if isBlockedAddress(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s", errBlockedAddress, addrPort.Addr())
+			}
+			return nil
+		}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			// A proxy would make the connection on our behalf, bypassing the address check
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= httpGetMaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", httpGetMaxRedirects)
+			}
+			return nil
+		},
+	}
+}
+
+// httpGet fetches rawURL and returns the response status, content type and body, the body
+// cut off after maxBytes
+func httpGet(ctx context.Context, client *http.Client, rawURL string, headers map[string]string, maxBytes int) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid URL %q: must be an http or https URL", rawURL)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, httpGetTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "agent-http-get")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxBytes)+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %w", err)
+	}
+	truncated := len(body) > maxBytes
+	if truncated {
+		body = body[:maxBytes]
+		// Don't let the cut split the last character
+		for i := 0; i < utf8.UTFMax-1 && !utf8.Valid(body); i++ {
+			body = body[:len(body)-1]
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Status: %s\n", resp.Status)
+	fmt.Fprintf(&b, "Content-Type: %s\n", resp.Header.Get("Content-Type"))
+	if resp.Request.URL.String() != u.String() {
+		fmt.Fprintf(&b, "Final URL: %s\n", resp.Request.URL)
+	}
+	b.WriteString("\n")
+	if !utf8.Valid(body) {
+		fmt.Fprintf(&b, "[binary body of %d bytes not shown]", len(body))
+		return b.String(), nil
+	}
+	b.Write(body)
+	if truncated {
+		fmt.Fprintf(&b, "\n[body truncated after %d bytes]", maxBytes)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,109 @@
+package chat_engine
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestIsBlockedAddress(t *testing.T) {
+	tests := []struct {
+		addr    string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"127.1.2.3", true},
+		{"::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"10.0.0.1", true},
+		{"172.16.5.4", true},
+		{"192.168.1.1", true},
+		{"fd00::1", true},
+		{"169.254.169.254", true},
+		{"fe80::1", true},
+		{"0.0.0.0", true},
+		{"::", true},
+		{"100.64.0.1", true},
+		{"224.0.0.1", true},
+		{"93.184.216.34", false},
+		{"2606:2800:220:1:248:1893:25c8:1946", false},
+	}
+	for _, tt := range tests {
+		if got := isBlockedAddress(netip.MustParseAddr(tt.addr)); got != tt.blocked {
+			t.Errorf("isBlockedAddress(%s) = %v, want %v", tt.addr, got, tt.blocked)
+		}
+	}
+}
+
+func TestHTTPGetBlocksInternalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal secret"))
+	}))
+	defer server.Close()
+	_, port, _ := strings.Cut(server.Listener.Addr().String(), ":")
+
+	client := newHTTPGetClient(false)
+	for _, rawURL := range []string{
+		server.URL,
+		"http://localhost:" + port,
+		"http://[::1]:" + port,
+		"http://169.254.169.254/latest/meta-data/",
+	} {
+		output, err := httpGet(context.Background(), client, rawURL, nil, defaultMaxHTTPResponseBytes)
+		if !errors.Is(err, errBlockedAddress) {
+			t.Errorf("fetching %s returned %q, %v, want errBlockedAddress", rawURL, output, err)
+		}
+	}
+
+	output, err := httpGet(context.Background(), newHTTPGetClient(true), server.URL, nil, defaultMaxHTTPResponseBytes)
+	if err != nil {
+		t.Fatalf("fetching with private networks allowed: %v", err)
+	}
+	if !strings.Contains(output, "internal secret") {
+		t.Errorf("output = %q, want the body", output)
+	}
+}
+
+// publicHostTransport sends requests for public.example to a test server, as if it were a
+// public host, and everything else through the guarded transport
+type publicHostTransport struct {
+	public  *url.URL
+	guarded http.RoundTripper
+}
+
+func (p publicHostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Hostname() != "public.example" {
+		return p.guarded.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = p.public.Scheme, p.public.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestHTTPGetBlocksRedirectToInternalAddress(t *testing.T) {
+	var reached bool
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+		w.Write([]byte("internal secret"))
+	}))
+	defer internal.Close()
+	public := httptest.NewServer(http.RedirectHandler(internal.URL+"/secret", http.StatusFound))
+	defer public.Close()
+
+	publicURL, _ := url.Parse(public.URL)
+	client := newHTTPGetClient(false)
+	client.Transport = publicHostTransport{public: publicURL, guarded: client.Transport}
+
+	output, err := httpGet(context.Background(), client, "http://public.example/", nil, defaultMaxHTTPResponseBytes)
+	if !errors.Is(err, errBlockedAddress) {
+		t.Errorf("following the redirect returned %q, %v, want errBlockedAddress", output, err)
+	}
+	if reached {
+		t.Error("the internal server was reached through the redirect")
+	}
+}
@@ -0,0 +1,68 @@
+package chat_engine
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/openai/openai-go/v2"
+)
+
+// maxImagesPerMessage bounds the images attached to a single user message
+const maxImagesPerMessage = 10
+
+// ImageRef is an image attached to a user message, for models that accept images
+type ImageRef struct {
+	// URL is an http(s) URL of the image or a data URL with the base64 encoded image,
+	// e.g. data:image/png;base64,...
+	URL string `json:"url"`
+	// Detail is the fidelity the model looks at the image with: "auto" (default), "low" or "high"
+	Detail string `json:"detail,omitempty"`
+}
+
+// ValidateImages checks images to be attached to a user message
+func ValidateImages(images []ImageRef) error {
+	if len(images) > maxImagesPerMessage {
+		return fmt.Errorf("too many images: %d, at most %d can be attached to a message", len(images), maxImagesPerMessage)
+	}
+	for i, image := range images {
+		switch image.Detail {
+		case "", "auto", "low", "high":
+		default:
+			return fmt.Errorf("image %d: invalid detail %q, use auto, low or high", i, image.Detail)
+		}
+
+		if strings.HasPrefix(image.URL, "data:") {
+			mediaType, _, ok := strings.Cut(strings.TrimPrefix(image.URL, "data:"), ";base64,")
+			if !ok || !strings.HasPrefix(mediaType, "image/") {
+				return fmt.Errorf("image %d: data URLs must be base64 encoded images, e.g. data:image/png;base64,...", i)
+			}
+			continue
+		}
+		u, err := url.Parse(image.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("image %d: url must be an http(s) URL or a data URL", i)
+		}
+	}
+	return nil
+}
+
+// userMessageParam converts a user message to OpenAI format. Messages with images are sent
+// as content parts, the text first followed by the images.
+func userMessageParam(msg *Message) openai.ChatCompletionMessageParamUnion {
+	if len(msg.Images) == 0 {
+		return openai.UserMessage(msg.Content)
+	}
+
+	parts := make([]openai.ChatCompletionContentPartUnionParam, 0, len(msg.Images)+1)
+	if msg.Content != "" {
+		parts = append(parts, openai.TextContentPart(msg.Content))
+	}
+	for _, image := range msg.Images {
+		parts = append(parts, openai.ImageContentPart(openai.ChatCompletionContentPartImageImageURLParam{
+			URL:    image.URL,
+			Detail: image.Detail,
+		}))
+	}
+	return openai.UserMessage(parts)
+}
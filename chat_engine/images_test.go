@@ -0,0 +1,74 @@
+package chat_engine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateImages(t *testing.T) {
+	tests := []struct {
+		images []ImageRef
+		valid  bool
+	}{
+		{nil, true},
+		{[]ImageRef{{URL: "https://example.com/cat.png"}, {URL: "data:image/jpeg;base64,/9j/4AAQ", Detail: "high"}}, true},
+		{[]ImageRef{{URL: "https://example.com/cat.png", Detail: "medium"}}, false},
+		{[]ImageRef{{URL: "ftp://example.com/cat.png"}}, false},
+		{[]ImageRef{{URL: "cat.png"}}, false},
+		{[]ImageRef{{URL: "data:text/plain;base64,aGk="}}, false},
+		{[]ImageRef{{URL: "data:image/png,raw"}}, false},
+		{make([]ImageRef, maxImagesPerMessage+1), false},
+	}
+	for _, tt := range tests {
+		if err := ValidateImages(tt.images); (err == nil) != tt.valid {
+			t.Errorf("ValidateImages(%v) = %v, want valid %v", tt.images, err, tt.valid)
+		}
+	}
+}
+
+func TestImagesAreStoredWithMessage(t *testing.T) {
+	provider := newFakeProvider(textReply("A cat."))
+	engine := newTestEngine(t, provider)
+	images := []ImageRef{{URL: "https://example.com/cat.png", Detail: "low"}, {URL: "data:image/png;base64,iVBORw0KGgo="}}
+
+	if _, err := engine.SendUserMessageWithOptions("conv", "what is this?", SendOptions{Images: images}); err != nil {
+		t.Fatalf("SendUserMessageWithOptions: %v", err)
+	}
+	if sent := provider.Requests()[0].Messages; !reflect.DeepEqual(sent[len(sent)-1].Images, images) {
+		t.Errorf("provider got images %v, want %v", sent[len(sent)-1].Images, images)
+	}
+
+	conv := reopenEngine(t, engine, provider).GetConversation("conv")
+	if got := conv.Messages[0].Images; !reflect.DeepEqual(got, images) {
+		t.Errorf("stored images are %v, want %v", got, images)
+	}
+}
+
+func TestImageOnlyMessageIsAccepted(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("A cat.")))
+	if _, err := engine.SendUserMessageWithOptions("conv", " ", SendOptions{Images: []ImageRef{{URL: "https://example.com/cat.png"}}}); err != nil {
+		t.Errorf("message with only an image was rejected: %v", err)
+	}
+}
+
+func TestOpenAIProviderSendsImageParts(t *testing.T) {
+	provider, lastRequest := openAITestProvider(t, "A cat.")
+
+	if _, err := provider.Complete(t.Context(), CompletionRequest{Messages: []*Message{
+		{Role: "user", Content: "plain text"},
+		{Role: "user", Content: "what is this?", Images: []ImageRef{{URL: "https://example.com/cat.png", Detail: "low"}}},
+	}}); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	messages := lastRequest()["messages"].([]any)
+	if content := messages[0].(map[string]any)["content"]; content != "plain text" {
+		t.Errorf("message without images has content %v, want a string", content)
+	}
+	want := []any{
+		map[string]any{"type": "text", "text": "what is this?"},
+		map[string]any{"type": "image_url", "image_url": map[string]any{"url": "https://example.com/cat.png", "detail": "low"}},
+	}
+	if content := messages[1].(map[string]any)["content"]; !reflect.DeepEqual(content, want) {
+		t.Errorf("message with an image has content %v, want %v", content, want)
+	}
+}
@@ -0,0 +1,83 @@
+package chat_engine
+
+import (
+	"fmt"
+	"time"
+)
+
+// InvalidTranscriptError is returned when importing a transcript that ValidateTranscript
+// reports problems for
+type InvalidTranscriptError struct {
+	Report *TranscriptReport
+}
+
+func (e *InvalidTranscriptError) Error() string {
+	return fmt.Sprintf("transcript has %d problems, the first: %s", len(e.Report.Problems), e.Report.Problems[0].Detail)
+}
+
+// ImportConversation stores a transcript, e.g. exported from another server, as a new
+// conversation with its title, system prompt and messages. It is validated first with
+// ValidateTranscript, the check POST /api/import/validate runs, and rejected with an
+// *InvalidTranscriptError if there are problems. Messages get new IDs, so a transcript can be
+// imported more than once.
+func (e *ChatEngine) ImportConversation(transcript *Conversation) (*Conversation, error) {
+	if report := ValidateTranscript(transcript.Messages); !report.Valid {
+		return nil, &InvalidTranscriptError{Report: report}
+	}
+
+	conv := &Conversation{
+		ID:           fmt.Sprintf("conv_%d", time.Now().UnixNano()),
+		Title:        transcript.Title,
+		SystemPrompt: transcript.SystemPrompt,
+		Messages:     make([]*Message, 0, len(transcript.Messages)),
+	}
+	// New IDs follow the msg_<nanoseconds> scheme, kept increasing within the transcript
+	var lastNano int64
+	for _, msg := range transcript.Messages {
+		nano := time.Now().UnixNano()
+		if nano <= lastNano {
+			nano = lastNano + 1
+		}
+		lastNano = nano
+
+		imported := *msg
+		imported.ID = fmt.Sprintf("msg_%d", nano)
+		conv.Messages = append(conv.Messages, &imported)
+	}
+	if err := e.db.ImportConversation(conv); err != nil {
+		return nil, err
+	}
+
+	imported := e.GetConversation(conv.ID)
+	if imported == nil {
+		return nil, fmt.Errorf("failed to load imported conversation %s", conv.ID)
+	}
+	return imported, nil
+}
+
+// ImportConversation creates conv with all its messages in a single transaction
+func (d *DB) ImportConversation(conv *Conversation) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO conversations (id, title, system_prompt)
+		VALUES (?, ?, ?)
+	`, conv.ID, conv.Title, conv.SystemPrompt)
+	if err != nil {
+		return fmt.Errorf("failed to create conversation: %w", err)
+	}
+	for _, msg := range conv.Messages {
+		if err := insertMessage(tx, conv.ID, msg); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package chat_engine
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Memories are facts that outlive a conversation, e.g. preferences of the user or details of
+// a project. They are grouped in namespaces and named by a key within one. With memory
+// enabled the model stores and looks them up with the memory tool, and the memories of the
+// engine's namespace are added to the context of every conversation after its system prompt.
+
+const (
+	// DefaultMemoryNamespace is used when no namespace is given
+	DefaultMemoryNamespace = "default"
+
+	maxMemoryKeyLength   = 128
+	maxMemoryValueLength = 4000
+	// maxContextMemories bounds the memories added to the context, most recently updated first
+	maxContextMemories = 50
+	// maxRecalledMemories bounds the memories returned by a recall
+	maxRecalledMemories = 50
+)
+
+// ErrMemoryNotFound is returned when deleting a memory that doesn't exist
+var ErrMemoryNotFound = errors.New("memory not found")
+
+// validMemoryNamespace is what namespaces look like: letters, digits and a few separators
+var validMemoryNamespace = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:/-]{0,63}$`)
+
+// Memory is a fact remembered across conversations
+type Memory struct {
+	Namespace string    `json:"namespace"`
+	Key       string    `json:"key"`
+	Value     string    `json:"value"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// WithMemory enables the memory tool and adds the memories of namespace to the context of
+// every conversation. An empty namespace means DefaultMemoryNamespace.
+func WithMemory(namespace string) Option {
+	return func(e *ChatEngine) {
+		if namespace == "" {
+			namespace = DefaultMemoryNamespace
+		}
+		e.memoryNamespace = namespace
+	}
+}
+
+// ValidateMemoryNamespace checks that a namespace is usable: up to 64 letters, digits, '_',
+// '.', ':', '/' and '-', starting with a letter or digit
+func ValidateMemoryNamespace(namespace string) error {
+	if !validMemoryNamespace.MatchString(namespace) {
+		return fmt.Errorf("invalid memory namespace %q: use up to 64 letters, digits, '_', '.', ':', '/' or '-', starting with a letter or digit", namespace)
+	}
+	return nil
+}
+
+// memoryNamespaceOrDefault returns namespace, or when it is empty the namespace of the engine
+func (e *ChatEngine) memoryNamespaceOrDefault(namespace string) string {
+	if namespace != "" {
+		return namespace
+	}
+	if e.memoryNamespace != "" {
+		return e.memoryNamespace
+	}
+	return DefaultMemoryNamespace
+}
+
+// Remember stores value under key in a namespace, replacing what was stored under the key.
+// An empty namespace means the engine's one.
+func (e *ChatEngine) Remember(namespace, key, value string) (*Memory, error) {
+	namespace = e.memoryNamespaceOrDefault(namespace)
+	if err := ValidateMemoryNamespace(namespace); err != nil {
+		return nil, err
+	}
+	key = strings.TrimSpace(key)
+	value = strings.TrimSpace(value)
+	switch {
+	case key == "":
+		return nil, fmt.Errorf("key is required")
+	case len(key) > maxMemoryKeyLength:
+		return nil, fmt.Errorf("key is too long, at most %d bytes", maxMemoryKeyLength)
+	case value == "":
+		return nil, fmt.Errorf("value is required")
+	case len(value) > maxMemoryValueLength:
+		return nil, fmt.Errorf("value is too long, at most %d bytes", maxMemoryValueLength)
+	}
+	return e.db.SaveMemory(namespace, key, value)
+}
+
+// Recall returns up to limit memories of a namespace whose key or value contains query,
+// ignoring case, most recently updated first. An empty query matches every memory and an
+// empty namespace means the engine's one.
+func (e *ChatEngine) Recall(namespace, query string, limit int) ([]Memory, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive")
+	}
+	return e.db.Memories(e.memoryNamespaceOrDefault(namespace), strings.TrimSpace(query), limit)
+}
+
+// Forget deletes a memory, returning ErrMemoryNotFound if there is none under key. An empty
+// namespace means the engine's one.
+func (e *ChatEngine) Forget(namespace, key string) error {
+	deleted, err := e.db.DeleteMemory(e.memoryNamespaceOrDefault(namespace), key)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrMemoryNotFound
+	}
+	return nil
+}
+
+// memoryMessage returns a system message listing the memories of the engine's namespace, or
+// nil when memory is disabled or there is nothing to list
+func (e *ChatEngine) memoryMessage() *Message {
+	if e.memoryNamespace == "" {
+		return nil
+	}
+	memories, err := e.db.Memories(e.memoryNamespace, "", maxContextMemories)
+	if err != nil {
+		slog.Warn("Failed to load memories", "namespace", e.memoryNamespace, "error", err)
+		return nil
+	}
+	if len(memories) == 0 {
+		return nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Facts remembered from previous conversations, keep them up to date with the memory tool:\n")
+	for _, memory := range memories {
+		fmt.Fprintf(&sb, "- %s: %s\n", memory.Key, memory.Value)
+	}
+	return &Message{Role: "system", Content: strings.TrimSuffix(sb.String(), "\n")}
+}
+
+// withMemory inserts the memory message after the leading system messages
+func withMemory(messages []*Message, memory *Message) []*Message {
+	if memory == nil {
+		return messages
+	}
+	i := 0
+	for i < len(messages) && messages[i].Role == "system" {
+		i++
+	}
+	result := make([]*Message, 0, len(messages)+1)
+	result = append(result, messages[:i]...)
+	result = append(result, memory)
+	return append(result, messages[i:]...)
+}
+
+// runMemory performs an action of the memory tool
+func (e *ChatEngine) runMemory(action, key, value, query string) string {
+	switch action {
+	case "remember":
+		if _, err := e.Remember("", key, value); err != nil {
+			return fmt.Sprintf("Error: %v", err)
+		}
+		return fmt.Sprintf("Remembered %s.", strings.TrimSpace(key))
+	case "recall":
+		memories, err := e.Recall("", query, maxRecalledMemories)
+		if err != nil {
+			return fmt.Sprintf("Error recalling memories: %v", err)
+		}
+		if len(memories) == 0 {
+			return "No memories found."
+		}
+		var sb strings.Builder
+		for _, memory := range memories {
+			fmt.Fprintf(&sb, "%s: %s\n", memory.Key, memory.Value)
+		}
+		return strings.TrimSuffix(sb.String(), "\n")
+	default:
+		return fmt.Sprintf("Error: unknown action %q, use remember or recall", action)
+	}
+}
+
+// SaveMemory stores a memory, replacing the value of an existing one
+func (d *DB) SaveMemory(namespace, key, value string) (*Memory, error) {
+	_, err := d.db.Exec(`
+		INSERT INTO memories (namespace, key, value) VALUES (?, ?, ?)
+		ON CONFLICT(namespace, key) DO UPDATE SET value = excluded.value, updated_at = CURRENT_TIMESTAMP
+	`, namespace, key, value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save memory: %w", err)
+	}
+
+	memory := Memory{Namespace: namespace, Key: key, Value: value}
+	err = d.db.QueryRow(`
+		SELECT created_at, updated_at FROM memories WHERE namespace = ? AND key = ?
+	`, namespace, key).Scan(&memory.CreatedAt, &memory.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load memory: %w", err)
+	}
+	return &memory, nil
+}
+
+// Memories returns up to limit memories of a namespace whose key or value contains query,
+// ignoring case, most recently updated first
+func (d *DB) Memories(namespace, query string, limit int) ([]Memory, error) {
+	rows, err := d.db.Query(`
+		SELECT namespace, key, value, created_at, updated_at FROM memories
+		WHERE namespace = ? AND (instr(lower(key), lower(?)) > 0 OR instr(lower(value), lower(?)) > 0)
+		ORDER BY updated_at DESC, key ASC
+		LIMIT ?
+	`, namespace, query, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query memories: %w", err)
+	}
+	defer rows.Close()
+
+	memories := make([]Memory, 0)
+	for rows.Next() {
+		var memory Memory
+		if err := rows.Scan(&memory.Namespace, &memory.Key, &memory.Value, &memory.CreatedAt, &memory.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan memory: %w", err)
+		}
+		memories = append(memories, memory)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating memories: %w", err)
+	}
+	return memories, nil
+}
+
+// DeleteMemory deletes a memory and reports whether it existed
+func (d *DB) DeleteMemory(namespace, key string) (bool, error) {
+	result, err := d.db.Exec(`DELETE FROM memories WHERE namespace = ? AND key = ?`, namespace, key)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete memory: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete memory: %w", err)
+	}
+	return deleted > 0, nil
+}
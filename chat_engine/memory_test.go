@@ -0,0 +1,113 @@
+package chat_engine
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMemoryToolRemembersAcrossConversations(t *testing.T) {
+	provider := newFakeProvider(
+		toolCallReply("call_1", "memory", `{"action": "remember", "key": "editor", "value": "The user prefers vim"}`),
+		textReply("Noted."),
+		textReply("You use vim."),
+	)
+	engine := newTestEngine(t, provider, WithMemory(""))
+
+	messages, err := engine.SendUserMessage("first", "I use vim")
+	if err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if output := toolOutputs(messages)["call_1"]; output != "Remembered editor." {
+		t.Errorf("memory tool returned %q", output)
+	}
+
+	// Another conversation gets the fact after its system prompt
+	engine.GetOrCreateConversation("second")
+	if err := engine.SetSystemPrompt("second", "be brief"); err != nil {
+		t.Fatalf("SetSystemPrompt: %v", err)
+	}
+	if _, err := engine.SendUserMessage("second", "which editor do I use?"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	sent := provider.Requests()[2].Messages
+	if len(sent) != 3 || sent[0].Content != "be brief" || sent[1].Role != "system" || !strings.Contains(sent[1].Content, "- editor: The user prefers vim") {
+		t.Errorf("second conversation sent %q, want the system prompt, the memories and the question", messageContents(sent))
+	}
+	// The memories are not stored in the conversation
+	if conv := engine.GetConversation("second"); len(conv.Messages) != 2 {
+		t.Errorf("second conversation stored %q", messageContents(conv.Messages))
+	}
+}
+
+func TestMemoryToolRecall(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(), WithMemory("project"))
+	for key, value := range map[string]string{"language": "Go", "database": "SQLite", "ci": "GitHub Actions"} {
+		if _, err := engine.Remember("", key, value); err != nil {
+			t.Fatalf("Remember: %v", err)
+		}
+	}
+
+	output := callTool(t, engine, "conv", "memory", `{"action": "recall", "query": "LITE"}`)
+	if output != "database: SQLite" {
+		t.Errorf("recall returned %q, want the database", output)
+	}
+	if output := callTool(t, engine, "conv", "memory", `{"action": "recall", "query": "rust"}`); output != "No memories found." {
+		t.Errorf("recall of nothing returned %q", output)
+	}
+	if output := callTool(t, engine, "conv", "memory", `{"action": "remember", "key": "editor"}`); output != "Error: value is required" {
+		t.Errorf("remembering without a value returned %q", output)
+	}
+	if output := callTool(t, engine, "conv", "memory", `{"action": "forget"}`); !strings.Contains(output, `unknown action "forget"`) {
+		t.Errorf("unknown action returned %q", output)
+	}
+}
+
+func TestMemoryNamespacesAreSeparate(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(), WithMemory("work"))
+	if _, err := engine.Remember("", "editor", "vim"); err != nil {
+		t.Fatalf("Remember: %v", err)
+	}
+	if _, err := engine.Remember("home", "editor", "emacs"); err != nil {
+		t.Fatalf("Remember: %v", err)
+	}
+	if _, err := engine.Remember("bad namespace", "editor", "nano"); err == nil {
+		t.Error("remembered in an invalid namespace")
+	}
+
+	work, _ := engine.Recall("", "", 10)
+	home, _ := engine.Recall("home", "", 10)
+	if len(work) != 1 || work[0].Value != "vim" || len(home) != 1 || home[0].Value != "emacs" {
+		t.Errorf("work has %+v and home %+v", work, home)
+	}
+
+	if err := engine.Forget("", "editor"); err != nil {
+		t.Fatalf("Forget: %v", err)
+	}
+	if err := engine.Forget("", "editor"); !errors.Is(err, ErrMemoryNotFound) {
+		t.Errorf("forgetting twice returned %v, want ErrMemoryNotFound", err)
+	}
+	if home, _ := engine.Recall("home", "", 10); len(home) != 1 {
+		t.Errorf("forgetting in work removed %+v from home", home)
+	}
+}
+
+func TestMemoryIsOffByDefault(t *testing.T) {
+	provider := newFakeProvider(textReply("Hello."))
+	engine := newTestEngine(t, provider)
+	if _, err := engine.Remember("", "editor", "vim"); err != nil {
+		t.Fatalf("Remember: %v", err)
+	}
+
+	if _, err := engine.SendUserMessage("conv", "hi"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	request := provider.Requests()[0]
+	if slices.Contains(toolNames(request.Tools), "memory") {
+		t.Error("memory tool is offered without WithMemory")
+	}
+	if len(request.Messages) != 1 {
+		t.Errorf("sent %q, want only the question", messageContents(request.Messages))
+	}
+}
@@ -0,0 +1,368 @@
+package chat_engine
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+// migration brings the schema from one version to the next. The schema version is the
+// number of migrations applied, so migrations must only ever be appended to the list.
+type migration struct {
+	description string
+	apply       func(tx *sql.Tx) error
+}
+
+// migrations up to and including the message search index predate schema versioning.
+// Databases created before it may already have any of their tables and columns, so those
+// migrations must be idempotent. Later ones run exactly once.
+var migrations = []migration{
+	{"initial schema", migrateInitialSchema},
+	{"conversation titles", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "conversations", "title", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{"message model and token usage", func(tx *sql.Tx) error {
+		if err := addColumnIfMissing(tx, "messages", "model", "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+		if err := addColumnIfMissing(tx, "messages", "prompt_tokens", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		return addColumnIfMissing(tx, "messages", "completion_tokens", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{"conversation tool call count", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "conversations", "tool_call_count", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{"background processes", migrateProcesses},
+	{"conversation system prompts", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "conversations", "system_prompt", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{"raw message content", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "messages", "raw_content", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{"message pagination index", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE INDEX IF NOT EXISTS idx_messages_conversation_created_at ON messages(conversation_id, created_at)`)
+		return err
+	}},
+	{"message search index", migrateSearchIndex},
+	{"command audit log", migrateCommandAudit},
+	{"conversation webhooks", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "conversations", "webhook_url", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{"conversation tags", migrateConversationTags},
+	{"message images", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "messages", "images", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{"command audit request IDs", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "command_audit", "request_id", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{"conversation parents", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "conversations", "parent_id", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{"message embeddings", migrateMessageEmbeddings},
+	{"memories", migrateMemories},
+	{"schedules", migrateSchedules},
+}
+
+// migrate applies pending migrations in order, each in its own transaction together with
+// the version it brings the schema to
+func (d *DB) migrate() error {
+	return migrateSchema(d.db, migrations, `
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			description TEXT NOT NULL,
+			applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`, `INSERT INTO schema_version (version, description) VALUES (?, ?)`)
+}
+
+// SchemaVersion returns the number of migrations applied to the database
+func (d *DB) SchemaVersion() (int, error) {
+	return schemaVersion(d.db)
+}
+
+// migrateSchema applies the pending ones of a backend's migrations. createVersionTable
+// creates the schema_version table unless it exists, recordVersion inserts a version and its
+// description into it.
+func migrateSchema(db *sql.DB, migrations []migration, createVersionTable, recordVersion string) error {
+	if _, err := db.Exec(createVersionTable); err != nil {
+		return fmt.Errorf("failed to create schema_version table: %w", err)
+	}
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than the latest known version %d", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		if err := applyMigration(db, i+1, migrations[i], recordVersion); err != nil {
+			return err
+		}
+		slog.Info("Applied database migration", "version", i+1, "description", migrations[i].description)
+	}
+	return nil
+}
+
+func applyMigration(db *sql.DB, version int, m migration, recordVersion string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := m.apply(tx); err != nil {
+		return fmt.Errorf("migration %d (%s) failed: %w", version, m.description, err)
+	}
+	if _, err := tx.Exec(recordVersion, version, m.description); err != nil {
+		return fmt.Errorf("failed to record schema version %d: %w", version, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %d: %w", version, err)
+	}
+	return nil
+}
+
+// schemaVersion returns the number of migrations applied to a database
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+func migrateInitialSchema(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS conversations (
+			id TEXT PRIMARY KEY,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create conversations table: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS messages (
+			id TEXT PRIMARY KEY,
+			conversation_id TEXT NOT NULL,
+			role TEXT NOT NULL,
+			content TEXT NOT NULL,
+			tool_call_id TEXT DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create messages table: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS tool_calls (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			message_id TEXT NOT NULL,
+			tool_call_id TEXT NOT NULL,
+			type TEXT NOT NULL,
+			name TEXT NOT NULL,
+			arguments TEXT NOT NULL,
+			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create tool_calls table: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_messages_conversation_id ON messages(conversation_id);
+		CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at);
+		CREATE INDEX IF NOT EXISTS idx_tool_calls_message_id ON tool_calls(message_id);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create indexes: %w", err)
+	}
+	return nil
+}
+
+// migrateProcesses creates the table of background processes that are still running
+func migrateProcesses(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS processes (
+			pid INTEGER PRIMARY KEY,
+			command TEXT NOT NULL,
+			working_dir TEXT NOT NULL DEFAULT '',
+			conversation_id TEXT NOT NULL DEFAULT '',
+			started_at DATETIME NOT NULL,
+			start_ticks INTEGER NOT NULL DEFAULT 0
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create processes table: %w", err)
+	}
+	return nil
+}
+
+// migrateSearchIndex creates the full-text index over user and assistant messages, which
+// SaveMessage keeps in sync, and indexes the messages saved before it existed
+func migrateSearchIndex(tx *sql.Tx) error {
+	var exists int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'messages_fts'`).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check for search index: %w", err)
+	}
+	if exists > 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(`
+		CREATE VIRTUAL TABLE messages_fts USING fts5(
+			content,
+			message_id UNINDEXED,
+			conversation_id UNINDEXED
+		);
+		INSERT INTO messages_fts (content, message_id, conversation_id)
+		SELECT content, id, conversation_id FROM messages
+		WHERE role IN ('user', 'assistant') AND content != '';
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create search index: %w", err)
+	}
+	return nil
+}
+
+// migrateCommandAudit creates the audit log of commands run by tools
+func migrateCommandAudit(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS command_audit (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			conversation_id TEXT NOT NULL,
+			tool TEXT NOT NULL,
+			command TEXT NOT NULL,
+			working_dir TEXT NOT NULL DEFAULT '',
+			background INTEGER NOT NULL DEFAULT 0,
+			pid INTEGER NOT NULL DEFAULT 0,
+			exit_code INTEGER,
+			error TEXT NOT NULL DEFAULT '',
+			duration_ms INTEGER NOT NULL DEFAULT 0,
+			started_at DATETIME NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_command_audit_conversation ON command_audit(conversation_id);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create command audit table: %w", err)
+	}
+	return nil
+}
+
+// migrateConversationTags creates the table of tags conversations are labeled with
+func migrateConversationTags(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE conversation_tags (
+			conversation_id TEXT NOT NULL,
+			tag TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (conversation_id, tag),
+			FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE
+		);
+		CREATE INDEX idx_conversation_tags_tag ON conversation_tags(tag);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create conversation tags table: %w", err)
+	}
+	return nil
+}
+
+func migrateMessageEmbeddings(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE message_embeddings (
+			message_id TEXT PRIMARY KEY,
+			conversation_id TEXT NOT NULL,
+			vector BLOB NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+		);
+		CREATE INDEX idx_message_embeddings_conversation_id ON message_embeddings(conversation_id);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create message embeddings table: %w", err)
+	}
+	return nil
+}
+
+func migrateMemories(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE memories (
+			namespace TEXT NOT NULL,
+			key TEXT NOT NULL,
+			value TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (namespace, key)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create memories table: %w", err)
+	}
+	return nil
+}
+
+func migrateSchedules(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE schedules (
+			id TEXT PRIMARY KEY,
+			conversation_id TEXT NOT NULL,
+			command TEXT NOT NULL,
+			working_dir TEXT NOT NULL DEFAULT '',
+			interval_seconds INTEGER NOT NULL DEFAULT 0,
+			cron TEXT NOT NULL DEFAULT '',
+			next_run_at DATETIME NOT NULL,
+			last_run_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE
+		);
+		CREATE INDEX idx_schedules_conversation_id ON schedules(conversation_id);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schedules table: %w", err)
+	}
+	return nil
+}
+
+// addColumnIfMissing adds a column to an existing table unless it is already there
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to inspect %s table: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   bool
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return fmt.Errorf("failed to scan %s table info: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating %s table info: %w", table, err)
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add %s.%s column: %w", table, column, err)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package chat_engine
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// postgresMigrations are the schema migrations of PostgresDB. They are versioned separately
+// from the SQLite ones and, like those, must only ever be appended to.
+var postgresMigrations = []migration{
+	{"initial schema", migratePostgresInitialSchema},
+	{"conversation tags", migratePostgresConversationTags},
+	{"message images", func(tx *sql.Tx) error {
+		return addPostgresColumn(tx, "messages", "images", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{"command audit request IDs", func(tx *sql.Tx) error {
+		return addPostgresColumn(tx, "command_audit", "request_id", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{"conversation parents", func(tx *sql.Tx) error {
+		return addPostgresColumn(tx, "conversations", "parent_id", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{"message embeddings", migratePostgresMessageEmbeddings},
+	{"memories", migratePostgresMemories},
+	{"schedules", migratePostgresSchedules},
+}
+
+// migrate applies pending migrations, see migrateSchema
+func (d *PostgresDB) migrate() error {
+	return migrateSchema(d.db, postgresMigrations, `
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			description TEXT NOT NULL,
+			applied_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		)
+	`, `INSERT INTO schema_version (version, description) VALUES ($1, $2)`)
+}
+
+// SchemaVersion returns the number of migrations applied to the database
+func (d *PostgresDB) SchemaVersion() (int, error) {
+	return schemaVersion(d.db)
+}
+
+// migratePostgresInitialSchema creates the tables of the SQLite schema as of its "conversation
+// webhooks" migration. Messages get a seq column that orders messages of the same instant,
+// which SQLite does by rowid, and a generated search_vector column instead of the FTS5 table.
+func migratePostgresInitialSchema(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE conversations (
+			id TEXT PRIMARY KEY,
+			title TEXT NOT NULL DEFAULT '',
+			system_prompt TEXT NOT NULL DEFAULT '',
+			webhook_url TEXT NOT NULL DEFAULT '',
+			tool_call_count INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE messages (
+			id TEXT PRIMARY KEY,
+			seq BIGSERIAL,
+			conversation_id TEXT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+			role TEXT NOT NULL,
+			content TEXT NOT NULL,
+			tool_call_id TEXT NOT NULL DEFAULT '',
+			model TEXT NOT NULL DEFAULT '',
+			prompt_tokens BIGINT NOT NULL DEFAULT 0,
+			completion_tokens BIGINT NOT NULL DEFAULT 0,
+			raw_content TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			search_vector TSVECTOR GENERATED ALWAYS AS (
+				CASE WHEN role IN ('user', 'assistant') THEN to_tsvector('simple', content) END
+			) STORED
+		);
+		CREATE INDEX idx_messages_conversation_created_at ON messages(conversation_id, created_at, seq);
+		CREATE INDEX idx_messages_created_at ON messages(created_at);
+		CREATE INDEX idx_messages_search_vector ON messages USING GIN (search_vector);
+
+		CREATE TABLE tool_calls (
+			id BIGSERIAL PRIMARY KEY,
+			message_id TEXT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+			tool_call_id TEXT NOT NULL,
+			type TEXT NOT NULL,
+			name TEXT NOT NULL,
+			arguments TEXT NOT NULL
+		);
+		CREATE INDEX idx_tool_calls_message_id ON tool_calls(message_id);
+
+		CREATE TABLE processes (
+			pid INTEGER PRIMARY KEY,
+			command TEXT NOT NULL,
+			working_dir TEXT NOT NULL DEFAULT '',
+			conversation_id TEXT NOT NULL DEFAULT '',
+			started_at TIMESTAMPTZ NOT NULL,
+			start_ticks BIGINT NOT NULL DEFAULT 0
+		);
+
+		CREATE TABLE command_audit (
+			id BIGSERIAL PRIMARY KEY,
+			conversation_id TEXT NOT NULL,
+			tool TEXT NOT NULL,
+			command TEXT NOT NULL,
+			working_dir TEXT NOT NULL DEFAULT '',
+			background BOOLEAN NOT NULL DEFAULT FALSE,
+			pid INTEGER NOT NULL DEFAULT 0,
+			exit_code INTEGER,
+			error TEXT NOT NULL DEFAULT '',
+			duration_ms BIGINT NOT NULL DEFAULT 0,
+			started_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE INDEX idx_command_audit_conversation ON command_audit(conversation_id);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create tables: %w", err)
+	}
+	return nil
+}
+
+// migratePostgresConversationTags creates the table of tags conversations are labeled with
+func migratePostgresConversationTags(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE conversation_tags (
+			conversation_id TEXT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+			tag TEXT NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (conversation_id, tag)
+		);
+		CREATE INDEX idx_conversation_tags_tag ON conversation_tags(tag);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create conversation tags table: %w", err)
+	}
+	return nil
+}
+
+// migratePostgresMessageEmbeddings creates the table of message embeddings for semantic search
+func migratePostgresMessageEmbeddings(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE message_embeddings (
+			message_id TEXT PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE,
+			conversation_id TEXT NOT NULL,
+			vector BYTEA NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX idx_message_embeddings_conversation_id ON message_embeddings(conversation_id);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create message embeddings table: %w", err)
+	}
+	return nil
+}
+
+// migratePostgresMemories creates the table of facts remembered across conversations
+func migratePostgresMemories(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE memories (
+			namespace TEXT NOT NULL,
+			key TEXT NOT NULL,
+			value TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (namespace, key)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create memories table: %w", err)
+	}
+	return nil
+}
+
+// migratePostgresSchedules creates the table of commands run periodically
+func migratePostgresSchedules(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE schedules (
+			id TEXT PRIMARY KEY,
+			conversation_id TEXT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+			command TEXT NOT NULL,
+			working_dir TEXT NOT NULL DEFAULT '',
+			interval_seconds BIGINT NOT NULL DEFAULT 0,
+			cron TEXT NOT NULL DEFAULT '',
+			next_run_at TIMESTAMPTZ NOT NULL,
+			last_run_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX idx_schedules_conversation_id ON schedules(conversation_id);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schedules table: %w", err)
+	}
+	return nil
+}
+
+// addPostgresColumn adds a column to an existing table unless it is already there
+func addPostgresColumn(tx *sql.Tx, table, column, definition string) error {
+	_, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add %s.%s column: %w", table, column, err)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package chat_engine
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// legacySchema is a database written before schema versioning, at the time conversations
+// got titles
+const legacySchema = `
+	CREATE TABLE conversations (
+		id TEXT PRIMARY KEY,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		title TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE messages (
+		id TEXT PRIMARY KEY,
+		conversation_id TEXT NOT NULL,
+		role TEXT NOT NULL,
+		content TEXT NOT NULL,
+		tool_call_id TEXT DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE
+	);
+	CREATE TABLE tool_calls (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		message_id TEXT NOT NULL,
+		tool_call_id TEXT NOT NULL,
+		type TEXT NOT NULL,
+		name TEXT NOT NULL,
+		arguments TEXT NOT NULL,
+		FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+	);
+	INSERT INTO conversations (id, title) VALUES ('old', 'Old conversation');
+	INSERT INTO messages (id, conversation_id, role, content, created_at) VALUES
+		('old_user', 'old', 'user', 'list files', '2024-01-01 10:00:00'),
+		('old_assistant', 'old', 'assistant', '', '2024-01-01 10:00:01'),
+		('old_tool', 'old', 'tool', 'a.txt', '2024-01-01 10:00:02');
+	UPDATE messages SET tool_call_id = 'call_ls' WHERE id = 'old_tool';
+	INSERT INTO tool_calls (message_id, tool_call_id, type, name, arguments) VALUES
+		('old_assistant', 'call_ls', 'function', 'bash_command', '{"command": "ls"}');
+`
+
+// newLegacyDB writes a database with legacySchema and returns its path
+func newLegacyDB(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "agent.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(legacySchema); err != nil {
+		t.Fatalf("creating legacy schema: %v", err)
+	}
+	return path
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	path := newLegacyDB(t)
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("NewDB on a legacy database: %v", err)
+	}
+	defer db.Close()
+
+	version, err := db.SchemaVersion()
+	if err != nil {
+		t.Fatalf("SchemaVersion: %v", err)
+	}
+	if version != len(migrations) {
+		t.Errorf("schema version = %d, want %d", version, len(migrations))
+	}
+
+	conv, err := db.LoadConversation("old")
+	if err != nil || conv == nil {
+		t.Fatalf("LoadConversation: %v, %v", conv, err)
+	}
+	if conv.Title != "Old conversation" {
+		t.Errorf("title = %q, want the stored one", conv.Title)
+	}
+	if len(conv.Messages) != 3 {
+		t.Fatalf("loaded %d messages, want 3", len(conv.Messages))
+	}
+	if toolCalls := conv.Messages[1].ToolCalls; len(toolCalls) != 1 || toolCalls[0].ID != "call_ls" {
+		t.Errorf("assistant message has tool calls %+v, want call_ls", toolCalls)
+	}
+
+	// Tables and columns of later migrations are usable
+	if err := db.SaveMessages("old", turnMessages("new", 1)); err != nil {
+		t.Errorf("SaveMessages after migrating: %v", err)
+	}
+	if err := db.AddConversationTag("old", "legacy"); err != nil {
+		t.Errorf("AddConversationTag after migrating: %v", err)
+	}
+	if results, err := db.SearchMessages("files", 10); err != nil || len(results) != 1 {
+		t.Errorf("searching migrated messages returned %d results, %v, want the old message", len(results), err)
+	}
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.db")
+	for i := 0; i < 2; i++ {
+		db, err := NewDB(path)
+		if err != nil {
+			t.Fatalf("opening the database the %d. time: %v", i+1, err)
+		}
+		var rows int
+		if err := db.db.QueryRow(`SELECT COUNT(*) FROM schema_version`).Scan(&rows); err != nil {
+			t.Fatal(err)
+		}
+		if rows != len(migrations) {
+			t.Errorf("schema_version has %d rows after opening %d times, want %d", rows, i+1, len(migrations))
+		}
+		db.Close()
+	}
+}
+
+func TestMigrateRejectsNewerSchema(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := db.db.Exec(`INSERT INTO schema_version (version, description) VALUES (?, 'from the future')`, len(migrations)+1); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if _, err := NewDB(db.path); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("NewDB returned %v, want an error about the newer schema", err)
+	}
+}
+
+func TestFailedMigrationIsRolledBack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.db")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	db.Close()
+
+	failing := migration{"failing", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`CREATE TABLE half_done (id INTEGER)`); err != nil {
+			return err
+		}
+		return errors.New("something went wrong")
+	}}
+	original := migrations
+	migrations = append(append([]migration(nil), original...), failing)
+	defer func() { migrations = original }()
+
+	if _, err := NewDB(path); err == nil || !strings.Contains(err.Error(), "failing") {
+		t.Fatalf("NewDB returned %v, want the migration's error", err)
+	}
+
+	migrations = original
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+	if version, _ := db.SchemaVersion(); version != len(original) {
+		t.Errorf("schema version = %d after the failed migration, want %d", version, len(original))
+	}
+	var tables int
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'half_done'`).Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Error("the failed migration's table was kept")
+	}
+}
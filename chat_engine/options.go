@@ -0,0 +1,162 @@
+package chat_engine
+
+import "time"
+
+// Option configures optional ChatEngine behaviour
+type Option func(*ChatEngine)
+
+const (
+	defaultCommandTimeout        = 60 * time.Second
+	defaultToolTimeout           = 5 * time.Minute
+	defaultMaxRepeatedToolCalls  = 3
+	defaultMaxReadFileBytes      = 100 * 1024
+	defaultMaxCommandOutputBytes = 100 * 1024
+	defaultMaxMessageBytes       = 256 * 1024
+	defaultMaxToolIterations     = 10
+
+	defaultIterationLimitMessage = "I stopped because this task hit the complexity limit of {{.MaxIterations}} tool call rounds " +
+		"after running {{.ToolCalls}} tool calls. Send another message if you want me to continue from here."
+)
+
+// WithModel sets the model that answers in conversations, in place of the provider's default
+// model. Every completion of a turn uses it, including those after tool calls.
+func WithModel(model string) Option {
+	return func(e *ChatEngine) {
+		e.model = model
+	}
+}
+
+// Model returns the model that answers in conversations, empty when the provider doesn't
+// report its default model
+func (e *ChatEngine) Model() string {
+	if e.model != "" {
+		return e.model
+	}
+	if reporter, ok := e.provider.(ModelReporter); ok {
+		return reporter.DefaultModel()
+	}
+	return ""
+}
+
+// WithMaxRepeatedToolCalls sets how many times in a row the same tool call (same name and
+// arguments) may be requested within a turn before the engine stops executing it.
+// A value of 0 disables the check.
+func WithMaxRepeatedToolCalls(n int) Option {
+	return func(e *ChatEngine) {
+		e.maxRepeatedToolCalls = n
+	}
+}
+
+// WithWorkspaceRoot sets the directory file tools operate in. Paths outside of it are rejected.
+// Defaults to the server's working directory.
+func WithWorkspaceRoot(dir string) Option {
+	return func(e *ChatEngine) {
+		e.workspaceRoot = dir
+	}
+}
+
+// WithMaxReadFileBytes caps the output of the read_file tool. A value of 0 disables the cap.
+func WithMaxReadFileBytes(n int) Option {
+	return func(e *ChatEngine) {
+		e.maxReadFileBytes = n
+	}
+}
+
+// WithIterationLimitMessage sets the text/template used for the final assistant message when a
+// turn reaches the tool call iteration limit. The template receives .MaxIterations and .ToolCalls.
+func WithIterationLimitMessage(text string) Option {
+	return func(e *ChatEngine) {
+		e.iterationLimitMessage = text
+	}
+}
+
+// WithIterationLimitSummary makes the engine ask the model for a progress summary, with no tools
+// offered, when the iteration limit is reached. The template message is used if that call fails.
+func WithIterationLimitSummary(enabled bool) Option {
+	return func(e *ChatEngine) {
+		e.iterationLimitSummary = enabled
+	}
+}
+
+// WithCommandTimeout bounds how long a foreground bash_command or shell command may run
+// before it is killed. A value of 0 disables the timeout.
+func WithCommandTimeout(timeout time.Duration) Option {
+	return func(e *ChatEngine) {
+		e.commandTimeout = timeout
+	}
+}
+
+// WithToolTimeout bounds how long any tool call may run, so that a tool that hangs doesn't
+// hang the turn. The model gets an error for a tool call that timed out. It should be longer
+// than the command timeout, which bounds bash_command and shell on its own. A value of 0
+// disables the timeout.
+func WithToolTimeout(timeout time.Duration) Option {
+	return func(e *ChatEngine) {
+		e.toolTimeout = timeout
+	}
+}
+
+// WithMaxCommandOutputBytes caps how much command output is returned to the model. Longer output
+// keeps its head and tail with a truncation marker in between. A value of 0 disables the cap.
+func WithMaxCommandOutputBytes(n int) Option {
+	return func(e *ChatEngine) {
+		e.maxCommandOutputBytes = n
+	}
+}
+
+// WithMaxMessageBytes caps the length of user messages, longer ones are rejected with
+// ErrMessageTooLong. A value of 0 disables the cap.
+func WithMaxMessageBytes(n int) Option {
+	return func(e *ChatEngine) {
+		e.maxMessageBytes = n
+	}
+}
+
+// WithTitleTrigger sets when conversations get their automatic title
+func WithTitleTrigger(trigger TitleTrigger) Option {
+	return func(e *ChatEngine) {
+		e.titleTrigger = trigger
+	}
+}
+
+// WithMaxProcessDepth limits how deeply processes spawned by background commands may nest,
+// see ProcessManager.SetMaxDepth. A value of 0 (the default) disables the limit.
+func WithMaxProcessDepth(depth int) Option {
+	return func(e *ChatEngine) {
+		e.maxProcessDepth = depth
+	}
+}
+
+// WithKillGracePeriod sets how long killed background processes get to exit after SIGTERM
+// before they are killed with SIGKILL, see ProcessManager.SetKillGracePeriod. Defaults to 5s.
+func WithKillGracePeriod(grace time.Duration) Option {
+	return func(e *ChatEngine) {
+		e.killGracePeriod = grace
+	}
+}
+
+// WithOrphanPolicy sets what happens on startup to background processes that are still running
+// from a previous run of the server. Defaults to OrphanPolicyKill.
+func WithOrphanPolicy(policy OrphanPolicy) Option {
+	return func(e *ChatEngine) {
+		e.orphanPolicy = policy
+	}
+}
+
+// WithMaxConversationToolCalls caps how many tool calls a conversation may execute over its
+// whole lifetime, across turns. Once reached, tools are no longer offered to the model.
+// A value of 0 (the default) means unlimited.
+func WithMaxConversationToolCalls(n int) Option {
+	return func(e *ChatEngine) {
+		e.maxConversationToolCalls = n
+	}
+}
+
+// WithMaxToolIterations sets how many rounds of tool calls the model may make in a single turn.
+// When the limit is reached the turn ends with an explanation, see IterationLimitError.
+// Must be at least 1, defaults to 10.
+func WithMaxToolIterations(n int) Option {
+	return func(e *ChatEngine) {
+		e.maxToolIterations = n
+	}
+}
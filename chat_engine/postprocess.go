@@ -0,0 +1,63 @@
+package chat_engine
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// PostProcessor transforms the content of a final assistant message, the one ending a turn,
+// before it is saved and returned
+type PostProcessor func(content string) string
+
+// WithPostProcessor adds a post-processor, they run in the order they were added
+func WithPostProcessor(p PostProcessor) Option {
+	return func(e *ChatEngine) {
+		e.postProcessors = append(e.postProcessors, p)
+	}
+}
+
+// WithKeepRawContent keeps the content of post-processed messages as the model produced it in
+// Message.RawContent, which is also stored. Meant for debugging, as it defeats redaction.
+func WithKeepRawContent(enabled bool) Option {
+	return func(e *ChatEngine) {
+		e.keepRawContent = enabled
+	}
+}
+
+// RedactPatterns returns a post-processor replacing every match of the patterns with [REDACTED]
+func RedactPatterns(patterns ...*regexp.Regexp) PostProcessor {
+	return func(content string) string {
+		for _, pattern := range patterns {
+			content = pattern.ReplaceAllString(content, "[REDACTED]")
+		}
+		return content
+	}
+}
+
+// CompileRedactPatterns compiles regular expressions for RedactPatterns
+func CompileRedactPatterns(exprs []string) ([]*regexp.Regexp, error) {
+	patterns := make([]*regexp.Regexp, 0, len(exprs))
+	for _, expr := range exprs {
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %q: %w", expr, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// postProcess runs the post-processors on a final assistant message
+func (e *ChatEngine) postProcess(msg *Message) {
+	if len(e.postProcessors) == 0 {
+		return
+	}
+
+	raw := msg.Content
+	for _, p := range e.postProcessors {
+		msg.Content = p(msg.Content)
+	}
+	if e.keepRawContent && msg.Content != raw {
+		msg.RawContent = raw
+	}
+}
@@ -0,0 +1,60 @@
+package chat_engine
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestPostProcessorsRunInOrder(t *testing.T) {
+	provider := newFakeProvider(
+		toolCallReply("call_1", "count", `{}`),
+		textReply("the key is sk-abc123"),
+	)
+	var seen []string
+	engine := newTestEngine(t, provider,
+		WithTool(&countingTool{name: "count"}),
+		WithPostProcessor(RedactPatterns(regexp.MustCompile(`sk-[a-z0-9]+`))),
+		WithPostProcessor(func(content string) string {
+			seen = append(seen, content)
+			return strings.ToUpper(content)
+		}),
+		WithKeepRawContent(true),
+	)
+
+	messages, err := engine.SendUserMessage("conv", "what is the key?")
+	if err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	// The second post-processor sees the output of the first, and only for the final message
+	if len(seen) != 1 || seen[0] != "the key is [REDACTED]" {
+		t.Errorf("second post-processor got %q, want the redacted final message", seen)
+	}
+	last := messages[len(messages)-1]
+	if last.Content != "THE KEY IS [REDACTED]" || last.RawContent != "the key is sk-abc123" {
+		t.Errorf("final message is %q from %q, want the post-processed content and the raw one", last.Content, last.RawContent)
+	}
+
+	stored, err := engine.db.LoadConversation("conv")
+	if err != nil {
+		t.Fatalf("LoadConversation: %v", err)
+	}
+	saved := stored.Messages[len(stored.Messages)-1]
+	if saved.Content != last.Content || saved.RawContent != last.RawContent {
+		t.Errorf("stored %q from %q, want the returned message", saved.Content, saved.RawContent)
+	}
+}
+
+func TestPostProcessingWithoutRawContent(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("token=hunter2")),
+		WithPostProcessor(RedactPatterns(regexp.MustCompile(`hunter2`))),
+	)
+
+	messages, err := engine.SendUserMessage("conv", "hi")
+	if err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if last := messages[len(messages)-1]; last.Content != "token=[REDACTED]" || last.RawContent != "" {
+		t.Errorf("final message is %q from %q, want it redacted without the raw content", last.Content, last.RawContent)
+	}
+}
@@ -1,11 +1,13 @@
 package chat_engine
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
-	"os/signal"
+	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -14,44 +16,158 @@ import (
 type ProcessInfo struct {
 	PID            int       `json:"pid"`
 	Command        string    `json:"command"`
+	WorkingDir     string    `json:"working_dir,omitempty"`
 	StartTime      time.Time `json:"start_time"`
 	ConversationID string    `json:"conversation_id,omitempty"`
+	// Set by ListProcesses where /proc can be read
+	Usage *ResourceUsage `json:"usage,omitempty"`
+
+	// Combined stdout and stderr, only the most recent output is kept
+	output *outputBuffer
+	// Identifies the process together with the PID, see processStartTicks
+	startTicks uint64
+	// Set once the process has exited
+	endTime  time.Time
+	exitCode int
+	// Command audit log entry completed once the process exits, 0 for none
+	auditID int64
+}
+
+// ProcessOutput is the captured output of a background process
+type ProcessOutput struct {
+	PID       int    `json:"pid"`
+	Command   string `json:"command"`
+	Running   bool   `json:"running"`
+	ExitCode  *int   `json:"exit_code,omitempty"`
+	Output    string `json:"output"`
+	Truncated bool   `json:"truncated"`
 }
 
+// maxFinishedProcesses is how many exited processes are remembered for their output
+const maxFinishedProcesses = 20
+
 type ProcessManager struct {
 	processes map[int]*ProcessInfo
-	mutex     sync.RWMutex
+	// Recently exited processes, oldest first, kept so their output can still be read
+	finished []*ProcessInfo
+	mutex    sync.RWMutex
+
+	// Persistent shell sessions by conversation ID
+	shellSessions map[string]*shellSession
+	shellMutex    sync.Mutex
+
+	maxDepth       int
+	depthWatchStop chan struct{}
+
+	// How long killed processes get to exit after SIGTERM, see SetKillGracePeriod
+	killGracePeriod time.Duration
+	terminations    sync.WaitGroup
+
+	// Environment of started processes, nil inherits the server's, see SetEnvPolicy
+	envPolicy *EnvPolicy
+
+	// Records running processes so they can be found again after a restart, may be nil
+	db     ProcessStore
+	closed bool
+}
+
+// depthCheckInterval is how often the nesting depth limit is enforced
+const depthCheckInterval = 2 * time.Second
+
+// defaultKillGracePeriod is how long killed processes get to exit after SIGTERM by default
+const defaultKillGracePeriod = 5 * time.Second
+
+// NewProcessManager creates a process manager. When db is not nil, running background
+// processes are recorded in it, see ReapOrphans.
+func NewProcessManager(db ProcessStore) *ProcessManager {
+	return &ProcessManager{
+		processes:       make(map[int]*ProcessInfo),
+		shellSessions:   make(map[string]*shellSession),
+		db:              db,
+		killGracePeriod: defaultKillGracePeriod,
+	}
 }
 
-func NewProcessManager() *ProcessManager {
-	pm := &ProcessManager{
-		processes: make(map[int]*ProcessInfo),
+// RunInShell runs command in the conversation's persistent shell session, starting one in dir
+// if needed, and returns the command's combined output and exit code. A command that is still
+// running when ctx is canceled or timeout passed is killed together with the session.
+func (pm *ProcessManager) RunInShell(ctx context.Context, conversationID, dir, command string, timeout time.Duration) (string, int, error) {
+	pm.shellMutex.Lock()
+	session := pm.shellSessions[conversationID]
+	if session == nil {
+		var err error
+		session, err = startShellSession(dir, pm.commandEnv())
+		if err != nil {
+			pm.shellMutex.Unlock()
+			return "", -1, err
+		}
+		pm.shellSessions[conversationID] = session
+	}
+	pm.shellMutex.Unlock()
+
+	output, exitCode, err := session.run(ctx, command, timeout)
+	if err != nil {
+		// The session is gone, the next command starts a fresh one
+		pm.shellMutex.Lock()
+		if pm.shellSessions[conversationID] == session {
+			delete(pm.shellSessions, conversationID)
+		}
+		pm.shellMutex.Unlock()
 	}
 
-	// Cleanup on exit
-	go pm.setupCleanup()
+	return output, exitCode, err
+}
+
+// SetEnvPolicy sets which environment variables background processes and shell sessions
+// started from now on get. nil passes the whole environment of the server.
+func (pm *ProcessManager) SetEnvPolicy(policy *EnvPolicy) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	pm.envPolicy = policy
+}
 
-	return pm
+// commandEnv returns the environment of a started process, see EnvPolicy
+func (pm *ProcessManager) commandEnv() []string {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	return pm.envPolicy.environ()
 }
 
-func (pm *ProcessManager) setupCleanup() {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	<-sigChan
+// CloseShell kills the conversation's persistent shell session, if any
+func (pm *ProcessManager) CloseShell(conversationID string) {
+	pm.shellMutex.Lock()
+	defer pm.shellMutex.Unlock()
 
-	// Kill all processes on exit
-	pm.KillAll()
-	os.Exit(0)
+	if session, ok := pm.shellSessions[conversationID]; ok {
+		session.terminate()
+		delete(pm.shellSessions, conversationID)
+	}
 }
 
-func (pm *ProcessManager) StartProcess(command string, conversationID string) (*ProcessInfo, error) {
+func (pm *ProcessManager) closeAllShells() {
+	pm.shellMutex.Lock()
+	defer pm.shellMutex.Unlock()
+
+	for conversationID, session := range pm.shellSessions {
+		session.terminate()
+		delete(pm.shellSessions, conversationID)
+	}
+}
+
+func (pm *ProcessManager) StartProcess(command, dir, conversationID string) (*ProcessInfo, error) {
 	cmd := exec.Command("bash", "-c", command)
+	cmd.Dir = dir
+	cmd.Env = pm.commandEnv()
 
 	// Set process group so we can kill child processes
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid: true,
 	}
 
+	output := newOutputBuffer(defaultProcessOutputBytes)
+	cmd.Stdout = output
+	cmd.Stderr = output
+
 	err := cmd.Start()
 	if err != nil {
 		return nil, fmt.Errorf("failed to start process: %w", err)
@@ -61,49 +177,237 @@ func (pm *ProcessManager) StartProcess(command string, conversationID string) (*
 	info := &ProcessInfo{
 		PID:            pid,
 		Command:        command,
+		WorkingDir:     dir,
 		StartTime:      time.Now(),
 		ConversationID: conversationID,
+		output:         output,
 	}
+	info.startTicks, _ = processStartTicks(pid)
 
 	pm.mutex.Lock()
 	pm.processes[pid] = info
+	if pm.db != nil {
+		if err := pm.db.SaveProcess(info); err != nil {
+			slog.Error("Failed to record process", "pid", pid, "error", err)
+		}
+	}
 	pm.mutex.Unlock()
 
 	// Monitor process in background
 	go func() {
 		cmd.Wait()
-		pm.mutex.Lock()
-		delete(pm.processes, pid)
-		pm.mutex.Unlock()
-		log.Printf("Process %d finished: %s", pid, command)
+		pm.finish(info, cmd.ProcessState.ExitCode())
+		slog.Info("Process finished", "pid", pid, "command", command)
 	}()
 
-	log.Printf("Started background process PID: %d, Command: %s", pid, command)
+	slog.Info("Started background process", "pid", pid, "command", command, "conversation_id", conversationID)
 	return info, nil
 }
 
+// finish moves an exited process to the recently finished ones and drops its record
+func (pm *ProcessManager) finish(info *ProcessInfo, exitCode int) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if pm.processes[info.PID] == info {
+		delete(pm.processes, info.PID)
+	}
+	info.endTime = time.Now()
+	info.exitCode = exitCode
+	info.output.Close()
+	pm.finished = append(pm.finished, info)
+	if len(pm.finished) > maxFinishedProcesses {
+		pm.finished = pm.finished[1:]
+	}
+	pm.finishAudit(info)
+
+	// After Close the database may already be closed, the records were cleared by then
+	if pm.db != nil && !pm.closed {
+		if err := pm.db.DeleteProcess(info.PID); err != nil {
+			slog.Error("Failed to delete record of process", "pid", info.PID, "error", err)
+		}
+	}
+}
+
+// trackAudit links a process to its command audit log entry, which is completed with the exit
+// code and run time once the process exits
+func (pm *ProcessManager) trackAudit(info *ProcessInfo, auditID int64) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	info.auditID = auditID
+	if !info.endTime.IsZero() {
+		// The process already exited before its entry was recorded
+		pm.finishAudit(info)
+	}
+}
+
+// finishAudit completes the audit log entry of an exited process, pm.mutex must be held
+func (pm *ProcessManager) finishAudit(info *ProcessInfo) {
+	if info.auditID == 0 || pm.db == nil || pm.closed {
+		return
+	}
+	if err := pm.db.FinishAuditedCommand(info.auditID, info.exitCode, info.endTime.Sub(info.StartTime)); err != nil {
+		slog.Error("Failed to complete audit entry of process", "pid", info.PID, "error", err)
+	}
+}
+
+// ListProcesses returns copies of the running background processes with their resource usage
 func (pm *ProcessManager) ListProcesses() []*ProcessInfo {
+	// Copies are taken under the lock, /proc is read without holding it
 	pm.mutex.RLock()
-	defer pm.mutex.RUnlock()
-
-	processes := make([]*ProcessInfo, 0, len(pm.processes))
+	tracked := make([]*ProcessInfo, 0, len(pm.processes))
+	copies := make([]ProcessInfo, 0, len(pm.processes))
 	for _, info := range pm.processes {
+		tracked = append(tracked, info)
+		copies = append(copies, *info)
+	}
+	pm.mutex.RUnlock()
+
+	processes := make([]*ProcessInfo, 0, len(tracked))
+	var exited []*ProcessInfo
+	for i, info := range tracked {
 		// Check if process is still running
 		process, err := os.FindProcess(info.PID)
 		if err == nil {
 			err = process.Signal(syscall.Signal(0)) // Signal 0 checks if process exists
 			if err == nil {
-				processes = append(processes, info)
+				// The usage is only valid for this listing
+				listed := &copies[i]
+				listed.Usage = processUsage(info.PID, info.StartTime)
+				processes = append(processes, listed)
 			} else {
-				// Process is dead, remove it
+				exited = append(exited, info)
+			}
+		}
+	}
+
+	// Dead processes are removed, unless their PID was reused by a new one meanwhile
+	if len(exited) > 0 {
+		pm.mutex.Lock()
+		for _, info := range exited {
+			if pm.processes[info.PID] == info {
 				delete(pm.processes, info.PID)
 			}
 		}
+		pm.mutex.Unlock()
 	}
 
 	return processes
 }
 
+// FindConversationProcess returns a copy of the running background process of a conversation
+// with the given PID or, when pid is 0, the one whose command contains match. A match that
+// fits several processes is an error listing them.
+func (pm *ProcessManager) FindConversationProcess(conversationID string, pid int, match string) (*ProcessInfo, error) {
+	pm.mutex.RLock()
+	defer pm.mutex.RUnlock()
+
+	if pid != 0 {
+		info, exists := pm.processes[pid]
+		if !exists || info.ConversationID != conversationID {
+			return nil, fmt.Errorf("no background process %d in this conversation", pid)
+		}
+		found := *info
+		return &found, nil
+	}
+
+	var matches []*ProcessInfo
+	for _, info := range pm.processes {
+		if info.ConversationID == conversationID && strings.Contains(info.Command, match) {
+			matches = append(matches, info)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no background process in this conversation runs a command containing %q", match)
+	case 1:
+		found := *matches[0]
+		return &found, nil
+	}
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].StartTime.Before(matches[j].StartTime) })
+	candidates := make([]string, len(matches))
+	for i, info := range matches {
+		candidates[i] = fmt.Sprintf("PID %d: %s", info.PID, info.Command)
+	}
+	return nil, fmt.Errorf("%d background processes run a command containing %q, pass the pid of one of them:\n%s", len(matches), match, strings.Join(candidates, "\n"))
+}
+
+// lookup returns a running background process or else the latest recently finished one with
+// the PID, which may have been reused, and whether it is running. pm.mutex must be held.
+func (pm *ProcessManager) lookup(pid int) (*ProcessInfo, bool) {
+	if info, running := pm.processes[pid]; running {
+		return info, true
+	}
+	for i := len(pm.finished) - 1; i >= 0; i-- {
+		if pm.finished[i].PID == pid {
+			return pm.finished[i], false
+		}
+	}
+	return nil, false
+}
+
+// FollowOutput passes the captured output of a background process to onOutput, then its
+// output as it is written, until the process exits. truncated tells that output was dropped
+// before the passed one, either because it wasn't kept or because onOutput fell behind. It
+// returns the exit code, or ctx.Err() when ctx is done first.
+func (pm *ProcessManager) FollowOutput(ctx context.Context, pid int, onOutput func(output string, truncated bool)) (int, error) {
+	pm.mutex.RLock()
+	info, _ := pm.lookup(pid)
+	pm.mutex.RUnlock()
+	if info == nil {
+		return 0, fmt.Errorf("process %d not found", pid)
+	}
+
+	var offset int64
+	for {
+		output, next, truncated, changed := info.output.Since(offset)
+		offset = next
+		if output != "" || truncated {
+			onOutput(output, truncated)
+		}
+		if changed == nil {
+			// Set before the output is closed
+			pm.mutex.RLock()
+			exitCode := info.exitCode
+			pm.mutex.RUnlock()
+			return exitCode, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// GetOutput returns the captured output of a running or recently exited background process
+func (pm *ProcessManager) GetOutput(pid int) (*ProcessOutput, error) {
+	pm.mutex.RLock()
+	defer pm.mutex.RUnlock()
+
+	info, running := pm.lookup(pid)
+	if info == nil {
+		return nil, fmt.Errorf("process %d not found", pid)
+	}
+
+	output, truncated := info.output.Snapshot()
+	result := &ProcessOutput{
+		PID:       info.PID,
+		Command:   info.Command,
+		Running:   running,
+		Output:    output,
+		Truncated: truncated,
+	}
+	if !running {
+		exitCode := info.exitCode
+		result.ExitCode = &exitCode
+	}
+	return result, nil
+}
+
 func (pm *ProcessManager) KillProcess(pid int) error {
 	pm.mutex.Lock()
 	defer pm.mutex.Unlock()
@@ -113,8 +417,8 @@ func (pm *ProcessManager) KillProcess(pid int) error {
 		return fmt.Errorf("process %d not found", pid)
 	}
 
-	// Kill the process group to kill all children (negative PID kills the group)
-	err := syscall.Kill(-pid, syscall.SIGTERM)
+	// Kill the process group and any descendants that left it
+	err := pm.terminate(info)
 	if err != nil {
 		// Try killing just the process
 		process, err2 := os.FindProcess(pid)
@@ -128,39 +432,62 @@ func (pm *ProcessManager) KillProcess(pid int) error {
 	}
 
 	delete(pm.processes, pid)
-	log.Printf("Killed process %d (and its process group): %s", pid, info.Command)
+	slog.Info("Killed process and its process tree", "pid", pid, "command", info.Command)
 	return nil
 }
 
+// Close kills all processes and stops background monitoring
+func (pm *ProcessManager) Close() {
+	pm.mutex.Lock()
+	if pm.depthWatchStop != nil {
+		close(pm.depthWatchStop)
+		pm.depthWatchStop = nil
+	}
+	pm.mutex.Unlock()
+
+	pm.KillAll()
+	pm.terminations.Wait()
+
+	// Every recorded process was just killed
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	if pm.db != nil {
+		if err := pm.db.DeleteAllProcesses(); err != nil {
+			slog.Error("Failed to clear process records", "error", err)
+		}
+	}
+	pm.closed = true
+}
+
 func (pm *ProcessManager) KillAll() {
+	pm.closeAllShells()
+
 	pm.mutex.Lock()
 	defer pm.mutex.Unlock()
 
 	for pid, info := range pm.processes {
-		process, err := os.FindProcess(pid)
-		if err == nil {
-			syscall.Kill(-pid, syscall.SIGTERM)
-			process.Kill()
-			log.Printf("Killed process %d: %s", pid, info.Command)
-		}
+		pm.terminate(info)
+		slog.Info("Killed process", "pid", pid, "command", info.Command)
 		delete(pm.processes, pid)
 	}
 }
 
-func (pm *ProcessManager) KillByConversation(conversationID string) {
+// KillByConversation kills the background processes and the shell session of a conversation
+// and returns how many background processes were killed
+func (pm *ProcessManager) KillByConversation(conversationID string) int {
+	pm.CloseShell(conversationID)
+
 	pm.mutex.Lock()
 	defer pm.mutex.Unlock()
 
+	killed := 0
 	for pid, info := range pm.processes {
 		if info.ConversationID == conversationID {
-			process, err := os.FindProcess(pid)
-			if err == nil {
-				syscall.Kill(-pid, syscall.SIGTERM)
-				process.Kill()
-				log.Printf("Killed process %d from conversation %s: %s", pid, conversationID, info.Command)
-			}
+			pm.terminate(info)
+			slog.Info("Killed process", "pid", pid, "command", info.Command, "conversation_id", conversationID)
+			killed++
 			delete(pm.processes, pid)
 		}
 	}
+	return killed
 }
-
@@ -0,0 +1,352 @@
+package chat_engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestProcessManager creates a process manager that kills its processes when the test ends
+func newTestProcessManager(t *testing.T) *ProcessManager {
+	t.Helper()
+	pm := NewProcessManager(nil)
+	t.Cleanup(pm.Close)
+	return pm
+}
+
+func TestListProcessesReportsUsage(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("resource usage is read from /proc")
+	}
+	pm := newTestProcessManager(t)
+	info, err := pm.StartProcess("sleep 30", t.TempDir(), "conv")
+	if err != nil {
+		t.Fatalf("StartProcess: %v", err)
+	}
+
+	processes := pm.ListProcesses()
+	if len(processes) != 1 || processes[0].PID != info.PID {
+		t.Fatalf("listed %+v, want the started process", processes)
+	}
+	usage := processes[0].Usage
+	if usage == nil {
+		t.Fatal("no resource usage for a running process")
+	}
+	if usage.CPUSeconds < 0 || usage.CPUPercent < 0 || usage.RSSBytes <= 0 {
+		t.Errorf("usage = %+v, want non-negative CPU and some memory", usage)
+	}
+}
+
+func TestListProcessesWhileProcessesExit(t *testing.T) {
+	pm := newTestProcessManager(t)
+	dir := t.TempDir()
+	for i := 0; i < 5; i++ {
+		if _, err := pm.StartProcess("sleep 0.05", dir, "conv"); err != nil {
+			t.Fatalf("StartProcess: %v", err)
+		}
+	}
+
+	// Listings prune exited processes while other listings read the table, run with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				pm.ListProcesses()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// waitForExit waits until a background process of pm has exited and returns its output
+func waitForExit(t *testing.T, pm *ProcessManager, pid int) *ProcessOutput {
+	t.Helper()
+	var output *ProcessOutput
+	exited := waitFor(5*time.Second, func() bool {
+		var err error
+		output, err = pm.GetOutput(pid)
+		if err != nil {
+			t.Fatalf("GetOutput: %v", err)
+		}
+		return !output.Running
+	})
+	if !exited {
+		t.Fatalf("process %d is still running", pid)
+	}
+	return output
+}
+
+func TestGetOutputAfterExit(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")))
+	info, err := engine.processManager.StartProcess("echo out; echo err >&2; exit 3", t.TempDir(), "conv")
+	if err != nil {
+		t.Fatalf("StartProcess: %v", err)
+	}
+
+	output := waitForExit(t, engine.processManager, info.PID)
+	if output.Output != "out\nerr\n" || output.ExitCode == nil || *output.ExitCode != 3 {
+		t.Errorf("got %+v, want both streams and exit code 3", output)
+	}
+
+	want := fmt.Sprintf("Process %d (echo out; echo err >&2; exit 3) is exited with code 3.\nout\nerr\n", info.PID)
+	if got := callTool(t, engine, "conv", "get_process_output", fmt.Sprintf(`{"pid": %d}`, info.PID)); got != want {
+		t.Errorf("tool output is %q, want %q", got, want)
+	}
+}
+
+// conversationPIDs returns the PIDs of the running background processes of a conversation
+func conversationPIDs(pm *ProcessManager, conversationID string) []int {
+	var pids []int
+	for _, info := range pm.ListProcesses() {
+		if info.ConversationID == conversationID {
+			pids = append(pids, info.PID)
+		}
+	}
+	return pids
+}
+
+func TestKillConversationProcessesTool(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")))
+	pm := engine.processManager
+	dir := t.TempDir()
+	for _, conversationID := range []string{"conv", "conv", "other"} {
+		if _, err := pm.StartProcess("sleep 30", dir, conversationID); err != nil {
+			t.Fatalf("StartProcess: %v", err)
+		}
+		if _, _, err := pm.RunInShell(t.Context(), conversationID, dir, "export STATE=kept", 0); err != nil {
+			t.Fatalf("RunInShell: %v", err)
+		}
+	}
+	killed := conversationPIDs(pm, "conv")
+
+	output := callTool(t, engine, "conv", "kill_conversation_processes", `{}`)
+	if output != "Killed 2 background process(es) started by this conversation" {
+		t.Errorf("tool output is %q", output)
+	}
+	if pids := conversationPIDs(pm, "conv"); len(pids) != 0 {
+		t.Errorf("processes %v of the conversation are still listed", pids)
+	}
+	for _, pid := range killed {
+		if !waitFor(5*time.Second, func() bool { return syscall.Kill(pid, 0) == syscall.ESRCH }) {
+			t.Errorf("process %d is still running", pid)
+		}
+	}
+	if pids := conversationPIDs(pm, "other"); len(pids) != 1 {
+		t.Errorf("other conversation has %d processes, want its one left running", len(pids))
+	}
+
+	// The conversation's shell was reset, the other one's wasn't
+	for conversationID, want := range map[string]string{"conv": "reset\n", "other": "kept\n"} {
+		output, _, err := pm.RunInShell(t.Context(), conversationID, dir, "echo ${STATE:-reset}", 0)
+		if err != nil || output != want {
+			t.Errorf("shell of %s printed %q, %v, want %q", conversationID, output, err, want)
+		}
+	}
+}
+
+func TestReapOrphansKillsLeftoverProcess(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("needs /proc to recognize leftover processes")
+	}
+	db := newTestDB(t)
+
+	// A process left running by a previous run of the server
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	ticks, ok := processStartTicks(cmd.Process.Pid)
+	if !ok {
+		t.Fatal("no start time for the process")
+	}
+	leftover := &ProcessInfo{PID: cmd.Process.Pid, Command: "sleep 30", StartTime: time.Now(), startTicks: ticks}
+	// And a record of a process that is gone, its PID now belonging to another process
+	stale := &ProcessInfo{PID: os.Getpid(), Command: "sleep 60", StartTime: time.Now(), startTicks: ticks + 1}
+	for _, info := range []*ProcessInfo{leftover, stale} {
+		if err := db.SaveProcess(info); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pm := NewProcessManager(db)
+	pm.SetKillGracePeriod(time.Second)
+	t.Cleanup(pm.Close)
+	if err := pm.ReapOrphans(OrphanPolicyKill); err != nil {
+		t.Fatalf("ReapOrphans: %v", err)
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("leftover process is still running")
+	}
+	records, err := db.ListProcesses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Errorf("%d process records are left, want none", len(records))
+	}
+	if len(pm.ListProcesses()) != 0 {
+		t.Error("killed process is tracked")
+	}
+}
+
+func TestDeleteConversationKillsItsProcesses(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("one"), textReply("two")))
+	pm := engine.processManager
+	dir := t.TempDir()
+	for _, conversationID := range []string{"doomed", "kept"} {
+		if _, err := engine.SendUserMessage(conversationID, "hi"); err != nil {
+			t.Fatalf("SendUserMessage: %v", err)
+		}
+		if _, err := pm.StartProcess("sleep 30", dir, conversationID); err != nil {
+			t.Fatalf("StartProcess: %v", err)
+		}
+		if _, _, err := pm.RunInShell(t.Context(), conversationID, dir, "export STATE=kept", 0); err != nil {
+			t.Fatalf("RunInShell: %v", err)
+		}
+	}
+	killed := conversationPIDs(pm, "doomed")
+
+	if err := engine.DeleteConversation("doomed"); err != nil {
+		t.Fatalf("DeleteConversation: %v", err)
+	}
+	if pids := conversationPIDs(pm, "doomed"); len(pids) != 0 {
+		t.Errorf("processes %v of the deleted conversation are still listed", pids)
+	}
+	for _, pid := range killed {
+		if !waitFor(5*time.Second, func() bool { return syscall.Kill(pid, 0) == syscall.ESRCH }) {
+			t.Errorf("process %d is still running", pid)
+		}
+	}
+	if pids := conversationPIDs(pm, "kept"); len(pids) != 1 {
+		t.Errorf("kept conversation has %d processes, want its one left running", len(pids))
+	}
+	for conversationID, want := range map[string]string{"doomed": "reset\n", "kept": "kept\n"} {
+		output, _, err := pm.RunInShell(t.Context(), conversationID, dir, "echo ${STATE:-reset}", 0)
+		if err != nil || output != want {
+			t.Errorf("shell of %s printed %q, %v, want %q", conversationID, output, err, want)
+		}
+	}
+}
+
+func TestStopBackgroundCommandTool(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")))
+	pm := engine.processManager
+	dir := t.TempDir()
+	start := func(command, conversationID string) int {
+		info, err := pm.StartProcess(command, dir, conversationID)
+		if err != nil {
+			t.Fatalf("StartProcess: %v", err)
+		}
+		return info.PID
+	}
+	server := start("sleep 30 && echo server", "conv")
+	worker := start("sleep 30 && echo worker", "conv")
+	other := start("sleep 30 && echo server", "other")
+
+	tests := []struct {
+		args string
+		want string
+	}{
+		{`{"match": "sleep"}`, fmt.Sprintf("Error: 2 background processes run a command containing \"sleep\", pass the pid of one of them:\nPID %d: sleep 30 && echo server\nPID %d: sleep 30 && echo worker", server, worker)},
+		{`{"match": "npm"}`, `Error: no background process in this conversation runs a command containing "npm"`},
+		{fmt.Sprintf(`{"pid": %d}`, other), fmt.Sprintf("Error: no background process %d in this conversation", other)},
+		{`{}`, "Error: invalid tool arguments: exactly one of pid and match is required"},
+		{fmt.Sprintf(`{"pid": %d, "match": "server"}`, server), "Error: invalid tool arguments: exactly one of pid and match is required"},
+	}
+	for _, tt := range tests {
+		if output := callTool(t, engine, "conv", "stop_background_command", tt.args); output != tt.want {
+			t.Errorf("%s: output is %q, want %q", tt.args, output, tt.want)
+		}
+	}
+	if n := len(pm.ListProcesses()); n != 3 {
+		t.Fatalf("%d processes are running after failed calls, want all 3", n)
+	}
+
+	// Matching is scoped to the conversation, so "server" finds only its own server
+	output := callTool(t, engine, "conv", "stop_background_command", `{"match": "server"}`)
+	if want := fmt.Sprintf("Stopped process %d (sleep 30 && echo server) after running for ", server); !strings.HasPrefix(output, want) {
+		t.Errorf("output is %q, want %q", output, want)
+	}
+	output = callTool(t, engine, "conv", "stop_background_command", fmt.Sprintf(`{"pid": %d}`, worker))
+	if want := fmt.Sprintf("Stopped process %d (sleep 30 && echo worker)", worker); !strings.HasPrefix(output, want) {
+		t.Errorf("output is %q, want %q", output, want)
+	}
+	for _, pid := range []int{server, worker} {
+		if !waitFor(5*time.Second, func() bool { return syscall.Kill(pid, 0) == syscall.ESRCH }) {
+			t.Errorf("process %d is still running", pid)
+		}
+	}
+	if pids := conversationPIDs(pm, "other"); len(pids) != 1 || pids[0] != other {
+		t.Errorf("other conversation runs %v, want its process %d", pids, other)
+	}
+}
+
+func TestFollowOutputUntilExit(t *testing.T) {
+	pm := newTestProcessManager(t)
+	info, err := pm.StartProcess("echo start; for i in 1 2 3; do sleep 0.1; echo line $i; done; exit 4", t.TempDir(), "conv")
+	if err != nil {
+		t.Fatalf("StartProcess: %v", err)
+	}
+
+	var output strings.Builder
+	chunks := 0
+	exitCode, err := pm.FollowOutput(t.Context(), info.PID, func(chunk string, truncated bool) {
+		if truncated {
+			t.Errorf("chunk %q is marked truncated", chunk)
+		}
+		output.WriteString(chunk)
+		chunks++
+	})
+	if err != nil || exitCode != 4 {
+		t.Errorf("FollowOutput = %d, %v, want exit code 4", exitCode, err)
+	}
+	if want := "start\nline 1\nline 2\nline 3\n"; output.String() != want {
+		t.Errorf("followed output %q, want %q", output.String(), want)
+	}
+	if chunks < 2 {
+		t.Errorf("output came in %d chunk(s), want it as it was written", chunks)
+	}
+
+	// Following an exited process passes its output and exit code right away
+	output.Reset()
+	if exitCode, err := pm.FollowOutput(t.Context(), info.PID, func(chunk string, _ bool) { output.WriteString(chunk) }); err != nil || exitCode != 4 || output.String() != "start\nline 1\nline 2\nline 3\n" {
+		t.Errorf("following the exited process = %d, %v with output %q", exitCode, err, output.String())
+	}
+	if _, err := pm.FollowOutput(t.Context(), 1<<30, func(string, bool) {}); err == nil {
+		t.Error("following an unknown process succeeded")
+	}
+}
+
+func TestFollowOutputStopsWithContext(t *testing.T) {
+	pm := newTestProcessManager(t)
+	info, err := pm.StartProcess("echo ready; sleep 30", t.TempDir(), "conv")
+	if err != nil {
+		t.Fatalf("StartProcess: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := pm.FollowOutput(ctx, info.PID, func(string, bool) {}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("FollowOutput = %v, want the context's error", err)
+	}
+	// The follower going away leaves the process running
+	if output, err := pm.GetOutput(info.PID); err != nil || !output.Running {
+		t.Errorf("process after the follower stopped: %+v, %v", output, err)
+	}
+}
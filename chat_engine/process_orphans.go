@@ -0,0 +1,106 @@
+package chat_engine
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// OrphanPolicy decides what happens to background processes that are still running from a
+// previous run of the server, e.g. after a crash
+type OrphanPolicy string
+
+const (
+	// OrphanPolicyKill terminates leftover processes
+	OrphanPolicyKill OrphanPolicy = "kill"
+	// OrphanPolicyAdopt tracks leftover processes again, so they can be listed and killed.
+	// Their output from before the restart is lost.
+	OrphanPolicyAdopt OrphanPolicy = "adopt"
+)
+
+// ParseOrphanPolicy validates an orphan policy name
+func ParseOrphanPolicy(s string) (OrphanPolicy, error) {
+	switch policy := OrphanPolicy(s); policy {
+	case OrphanPolicyKill, OrphanPolicyAdopt:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown orphan policy %q", s)
+	}
+}
+
+// orphanCheckInterval is how often adopted processes are checked for having exited,
+// they are not our children so we can't wait for them
+const orphanCheckInterval = time.Second
+
+// ReapOrphans handles processes recorded by a previous run that are still alive according to
+// policy and drops the records of those that are gone. A recorded PID only counts as alive if
+// the process has the recorded start time, so a reused PID is never killed or adopted. Without
+// /proc this can't be verified and all records are dropped.
+func (pm *ProcessManager) ReapOrphans(policy OrphanPolicy) error {
+	if pm.db == nil {
+		return nil
+	}
+
+	records, err := pm.db.ListProcesses()
+	if err != nil {
+		return err
+	}
+
+	for _, info := range records {
+		if !isSameProcess(info) {
+			if err := pm.db.DeleteProcess(info.PID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch policy {
+		case OrphanPolicyAdopt:
+			info.output = newOutputBuffer(defaultProcessOutputBytes)
+			pm.mutex.Lock()
+			pm.processes[info.PID] = info
+			pm.mutex.Unlock()
+			go pm.watchAdopted(info)
+			slog.Info("Adopted background process left from a previous run", "pid", info.PID, "command", info.Command)
+
+		default:
+			pm.mutex.Lock()
+			pm.terminate(info)
+			pm.mutex.Unlock()
+			if err := pm.db.DeleteProcess(info.PID); err != nil {
+				return err
+			}
+			slog.Info("Killed background process left from a previous run", "pid", info.PID, "command", info.Command)
+		}
+	}
+
+	return nil
+}
+
+// watchAdopted waits for an adopted process to exit. Its exit code can't be known.
+func (pm *ProcessManager) watchAdopted(info *ProcessInfo) {
+	ticker := time.NewTicker(orphanCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		pm.mutex.RLock()
+		tracked := pm.processes[info.PID] == info
+		closed := pm.closed
+		pm.mutex.RUnlock()
+		if closed {
+			return
+		}
+
+		if !tracked || !isSameProcess(info) {
+			pm.finish(info, -1)
+			slog.Info("Adopted process finished", "pid", info.PID, "command", info.Command)
+			return
+		}
+	}
+}
+
+// isSameProcess reports whether the process recorded in info is still running
+func isSameProcess(info *ProcessInfo) bool {
+	ticks, ok := processStartTicks(info.PID)
+	return ok && info.startTicks != 0 && ticks == info.startTicks
+}
@@ -0,0 +1,87 @@
+package chat_engine
+
+import "sync"
+
+// defaultProcessOutputBytes is how much output is kept per background process
+const defaultProcessOutputBytes = 64 * 1024
+
+// outputBuffer keeps the last bytes written to it, safe for concurrent use
+type outputBuffer struct {
+	mutex sync.Mutex
+	max   int
+	data  []byte
+	total int64
+	// Closed on the next write or Close, created by Since when there is a reader waiting
+	changed chan struct{}
+	closed  bool
+}
+
+func newOutputBuffer(max int) *outputBuffer {
+	return &outputBuffer{max: max}
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.total += int64(len(p))
+	b.data = append(b.data, p...)
+	// Trim lazily to keep appends amortized
+	if len(b.data) > 2*b.max {
+		b.data = append(b.data[:0], b.data[len(b.data)-b.max:]...)
+	}
+	b.notify()
+	return len(p), nil
+}
+
+// Close marks the end of the output once the process exited
+func (b *outputBuffer) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.closed = true
+	b.notify()
+}
+
+// notify wakes up the readers waiting in Since, b.mutex must be held
+func (b *outputBuffer) notify() {
+	if b.changed != nil {
+		close(b.changed)
+		b.changed = nil
+	}
+}
+
+// Snapshot returns the kept output and whether older output was dropped
+func (b *outputBuffer) Snapshot() (string, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	data := b.data
+	if len(data) > b.max {
+		data = data[len(data)-b.max:]
+	}
+	return string(data), b.total > int64(len(data))
+}
+
+// Since returns the kept output written after offset, a count of bytes written like the next
+// offset it returns, and whether output after offset was already dropped. The channel is
+// closed once more output is written; it is nil after Close, when no more output follows.
+func (b *outputBuffer) Since(offset int64) (string, int64, bool, <-chan struct{}) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	start := b.total - int64(min(len(b.data), b.max))
+	dropped := offset < start
+	if dropped {
+		offset = start
+	}
+	output := string(b.data[len(b.data)-int(b.total-offset):])
+
+	if b.closed {
+		return output, b.total, dropped, nil
+	}
+	if b.changed == nil {
+		b.changed = make(chan struct{})
+	}
+	return output, b.total, dropped, b.changed
+}
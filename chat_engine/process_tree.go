@@ -0,0 +1,245 @@
+package chat_engine
+
+import (
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Background processes run in their own process group, which covers everything they start
+// unless a descendant moves to another group or session (setsid, nohup with job control,
+// daemonizing servers). To catch those as well, descendants are discovered through /proc by
+// parent PID. This only works on Linux; elsewhere killing falls back to the process group,
+// and descendants that left it are not tracked.
+
+// processNode is a descendant of a tracked process
+type processNode struct {
+	pid   int
+	depth int // 1 for direct children
+}
+
+// processDescendants returns all descendants of pid with their depth, or nil when the
+// process table can't be read
+func processDescendants(pid int) []processNode {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		childPID, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if ppid, ok := parentPID(childPID); ok {
+			children[ppid] = append(children[ppid], childPID)
+		}
+	}
+
+	var nodes []processNode
+	queue := []processNode{{pid: pid, depth: 0}}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for _, child := range children[node.pid] {
+			childNode := processNode{pid: child, depth: node.depth + 1}
+			nodes = append(nodes, childNode)
+			queue = append(queue, childNode)
+		}
+	}
+	return nodes
+}
+
+// procStat returns the fields of /proc/<pid>/stat that follow the command name, so the
+// process state is at index 0 and the parent PID at index 1
+func procStat(pid int) ([]string, bool) {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return nil, false
+	}
+	return parseProcStat(string(data))
+}
+
+// parseProcStat splits the content of a /proc/<pid>/stat file as described for procStat
+func parseProcStat(stat string) ([]string, bool) {
+	// The command name is in parentheses and may itself contain spaces or parentheses
+	end := strings.LastIndexByte(stat, ')')
+	if end == -1 {
+		return nil, false
+	}
+	return strings.Fields(stat[end+1:]), true
+}
+
+// parentPID reads the parent PID from /proc/<pid>/stat
+func parentPID(pid int) (int, bool) {
+	fields, ok := procStat(pid)
+	if !ok || len(fields) < 2 {
+		return 0, false
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, false
+	}
+	return ppid, true
+}
+
+// processStartTicks reads when a process started, in clock ticks since boot. Together with
+// the PID it identifies a process even when PIDs are reused. Zombies are reported as not running.
+func processStartTicks(pid int) (uint64, bool) {
+	fields, ok := procStat(pid)
+	if !ok || len(fields) < 20 || fields[0] == "Z" {
+		return 0, false
+	}
+	ticks, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return ticks, true
+}
+
+// signalTree sends sig to the process group of pid and to every descendant of pid, including
+// those that left the group. Descendants are collected first because once the parent dies
+// they are reparented and can no longer be found.
+func signalTree(pid int, sig syscall.Signal) error {
+	descendants := processDescendants(pid)
+
+	err := syscall.Kill(-pid, sig)
+	if err != nil {
+		err = syscall.Kill(pid, sig)
+	}
+	for _, node := range descendants {
+		syscall.Kill(node.pid, sig)
+	}
+	return err
+}
+
+// killPollInterval is how often terminated processes are checked for having exited during
+// the grace period
+const killPollInterval = 100 * time.Millisecond
+
+// processIdentity identifies a process even when its PID is reused, startTicks is 0 where
+// /proc can't be read
+type processIdentity struct {
+	pid        int
+	startTicks uint64
+}
+
+// alive tells whether the identified process is still running
+func (p processIdentity) alive() bool {
+	if p.startTicks == 0 {
+		return syscall.Kill(p.pid, 0) == nil
+	}
+	ticks, ok := processStartTicks(p.pid)
+	return ok && ticks == p.startTicks
+}
+
+// terminateTree asks a process and its descendants to exit with SIGTERM, see signalTree, and
+// kills those still running after grace with SIGKILL. It returns once SIGTERM was sent and
+// calls done, if not nil, once every process exited or was killed.
+func terminateTree(pid int, startTicks uint64, grace time.Duration, done func()) error {
+	tree := []processIdentity{{pid, startTicks}}
+	for _, node := range processDescendants(pid) {
+		ticks, _ := processStartTicks(node.pid)
+		tree = append(tree, processIdentity{node.pid, ticks})
+	}
+
+	err := signalTree(pid, syscall.SIGTERM)
+	go func() {
+		if done != nil {
+			defer done()
+		}
+		deadline := time.Now().Add(grace)
+		for {
+			running := slices.DeleteFunc(slices.Clone(tree), func(p processIdentity) bool { return !p.alive() })
+			if len(running) == 0 {
+				return
+			}
+			if time.Now().Before(deadline) {
+				time.Sleep(killPollInterval)
+				continue
+			}
+
+			for _, p := range running {
+				if p.pid == pid {
+					// The rest of the group too, it can't have been reused while its leader runs
+					syscall.Kill(-pid, syscall.SIGKILL)
+				}
+				syscall.Kill(p.pid, syscall.SIGKILL)
+				slog.Warn("Killed process that did not exit after SIGTERM", "pid", p.pid, "grace_period", grace)
+			}
+			return
+		}
+	}()
+	return err
+}
+
+// SetKillGracePeriod sets how long killed processes get to exit after SIGTERM before they are
+// killed with SIGKILL. 0 sends SIGKILL right away.
+func (pm *ProcessManager) SetKillGracePeriod(grace time.Duration) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	pm.killGracePeriod = grace
+}
+
+// terminate kills a background process and its descendants, see terminateTree. Close waits
+// for the processes to be gone. pm.mutex must be held.
+func (pm *ProcessManager) terminate(info *ProcessInfo) error {
+	pm.terminations.Add(1)
+	return terminateTree(info.PID, info.startTicks, pm.killGracePeriod, pm.terminations.Done)
+}
+
+// SetMaxDepth limits how deeply processes started by a background process may nest.
+// Processes deeper than depth (the background process itself being depth 0) are killed
+// together with their own descendants, checked every few seconds. 0 disables the limit.
+func (pm *ProcessManager) SetMaxDepth(depth int) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.maxDepth = depth
+	if depth > 0 && pm.depthWatchStop == nil {
+		pm.depthWatchStop = make(chan struct{})
+		go pm.watchDepth(pm.depthWatchStop)
+	}
+}
+
+func (pm *ProcessManager) watchDepth(stop chan struct{}) {
+	ticker := time.NewTicker(depthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			pm.enforceMaxDepth()
+		}
+	}
+}
+
+// enforceMaxDepth kills descendants of tracked processes that are nested too deeply
+func (pm *ProcessManager) enforceMaxDepth() {
+	pm.mutex.RLock()
+	maxDepth := pm.maxDepth
+	pids := make([]int, 0, len(pm.processes))
+	for pid := range pm.processes {
+		pids = append(pids, pid)
+	}
+	pm.mutex.RUnlock()
+
+	if maxDepth <= 0 {
+		return
+	}
+	for _, pid := range pids {
+		for _, node := range processDescendants(pid) {
+			if node.depth > maxDepth {
+				slog.Warn("Killing process nested too deeply below a background process", "pid", node.pid, "depth", node.depth, "background_pid", pid, "limit", maxDepth)
+				signalTree(node.pid, syscall.SIGKILL)
+			}
+		}
+	}
+}
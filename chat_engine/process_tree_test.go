@@ -0,0 +1,147 @@
+package chat_engine
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or timeout passed and reports whether it held
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if cond() {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestKillProcessKillsTree(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("descendants are found through /proc")
+	}
+	pm := newTestProcessManager(t)
+	// A child and a grandchild, one of them in a session of its own outside the process group
+	info, err := pm.StartProcess("bash -c 'sleep 30' & setsid sleep 30 & wait", t.TempDir(), "conv")
+	if err != nil {
+		t.Fatalf("StartProcess: %v", err)
+	}
+
+	var tree []processIdentity
+	found := waitFor(5*time.Second, func() bool {
+		tree = tree[:0]
+		sleeps := 0
+		for _, node := range processDescendants(info.PID) {
+			ticks, _ := processStartTicks(node.pid)
+			tree = append(tree, processIdentity{node.pid, ticks})
+			if comm, _ := os.ReadFile(fmt.Sprintf("/proc/%d/comm", node.pid)); strings.TrimSpace(string(comm)) == "sleep" {
+				sleeps++
+			}
+		}
+		return sleeps == 2
+	})
+	if !found {
+		t.Fatalf("the sleeps didn't start below process %d", info.PID)
+	}
+	tree = append(tree, processIdentity{info.PID, info.startTicks})
+
+	if err := pm.KillProcess(info.PID); err != nil {
+		t.Fatalf("KillProcess: %v", err)
+	}
+	for _, p := range tree {
+		if !waitFor(5*time.Second, func() bool { return !p.alive() }) {
+			t.Errorf("process %d is still running", p.pid)
+		}
+	}
+}
+
+func TestParseProcStat(t *testing.T) {
+	tests := []struct {
+		name      string
+		stat      string
+		wantState string
+		wantPPID  string
+		wantOK    bool
+	}{
+		{"plain name", "42 (sleep) S 7 42 42 0 -1", "S", "7", true},
+		{"name with spaces", "42 (my server) R 7 42 42 0 -1", "R", "7", true},
+		{"name with parentheses", "42 (a) b (c)) Z 1 42 42 0 -1", "Z", "1", true},
+		{"name that looks like fields", "42 (x) S 99 1) S 3 42 42", "S", "3", true},
+		{"no name", "42 sleep S 7", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, ok := parseProcStat(tt.stat)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if len(fields) < 2 || fields[0] != tt.wantState || fields[1] != tt.wantPPID {
+				t.Errorf("fields = %q, want state %s and parent %s first", fields, tt.wantState, tt.wantPPID)
+			}
+		})
+	}
+}
+
+func TestProcessDescendants(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("descendants are found through /proc")
+	}
+	pm := newTestProcessManager(t)
+	info, err := pm.StartProcess("bash -c 'sleep 30 & wait' & wait", t.TempDir(), "conv")
+	if err != nil {
+		t.Fatalf("StartProcess: %v", err)
+	}
+
+	// The inner bash at depth 1, its sleep at depth 2
+	var nodes []processNode
+	found := waitFor(5*time.Second, func() bool {
+		nodes = processDescendants(info.PID)
+		return len(nodes) == 2
+	})
+	if !found {
+		t.Fatalf("found descendants %+v, want two", nodes)
+	}
+	for i, node := range nodes {
+		if node.depth != i+1 {
+			t.Errorf("descendant %d has depth %d, want %d", node.pid, node.depth, i+1)
+		}
+		if ppid, ok := parentPID(node.pid); !ok || (i == 0 && ppid != info.PID) || (i == 1 && ppid != nodes[0].pid) {
+			t.Errorf("parent of descendant %d is %d, want the previous process", node.pid, ppid)
+		}
+	}
+	if nodes := processDescendants(nodes[1].pid); len(nodes) != 0 {
+		t.Errorf("sleep has descendants %+v, want none", nodes)
+	}
+}
+
+func TestKillProcessEscalatesToSIGKILL(t *testing.T) {
+	pm := newTestProcessManager(t)
+	pm.SetKillGracePeriod(200 * time.Millisecond)
+	// Ignored signals stay ignored in the sleep, so neither exits on SIGTERM
+	info, err := pm.StartProcess("trap '' TERM; sleep 30", t.TempDir(), "conv")
+	if err != nil {
+		t.Fatalf("StartProcess: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if err := pm.KillProcess(info.PID); err != nil {
+		t.Fatalf("KillProcess: %v", err)
+	}
+	process := processIdentity{info.PID, info.startTicks}
+	if waitFor(100*time.Millisecond, func() bool { return !process.alive() }) {
+		t.Fatal("process exited on SIGTERM although it ignores it")
+	}
+	if !waitFor(5*time.Second, func() bool { return !process.alive() }) {
+		t.Error("process is still running after the grace period")
+	}
+}
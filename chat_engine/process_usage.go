@@ -0,0 +1,93 @@
+package chat_engine
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicksPerSecond is the unit of CPU times in /proc/<pid>/stat (USER_HZ), 100 on every
+// Linux platform Go supports
+const clockTicksPerSecond = 100
+
+// ResourceUsage is the CPU and memory use of a background process together with its
+// descendants, read from /proc and so only available on Linux
+type ResourceUsage struct {
+	// CPU time spent in user and kernel mode
+	CPUSeconds float64 `json:"cpu_seconds"`
+	// CPU time relative to the time the process has been running, can exceed 100 on
+	// several cores
+	CPUPercent float64 `json:"cpu_percent"`
+	// Resident memory
+	RSSBytes int64 `json:"rss_bytes"`
+}
+
+// String formats the usage for the list_processes tool
+func (u *ResourceUsage) String() string {
+	return fmt.Sprintf("CPU: %.1f%% (%.1fs) | Memory: %.1f MB", u.CPUPercent, u.CPUSeconds, float64(u.RSSBytes)/(1<<20))
+}
+
+// processUsage returns the resource usage of a process started at startTime and of its
+// descendants, or nil when it can't be read
+func processUsage(pid int, startTime time.Time) *ResourceUsage {
+	cpuTicks, rss, ok := procUsage(pid)
+	if !ok {
+		return nil
+	}
+	for _, node := range processDescendants(pid) {
+		// Descendants may exit while they are read
+		if ticks, bytes, ok := procUsage(node.pid); ok {
+			cpuTicks += ticks
+			rss += bytes
+		}
+	}
+
+	usage := &ResourceUsage{
+		CPUSeconds: float64(cpuTicks) / clockTicksPerSecond,
+		RSSBytes:   rss,
+	}
+	if elapsed := time.Since(startTime).Seconds(); elapsed > 0 {
+		usage.CPUPercent = usage.CPUSeconds / elapsed * 100
+	}
+	return usage
+}
+
+// procUsage reads the CPU time in clock ticks and the resident memory in bytes of a process
+func procUsage(pid int) (cpuTicks uint64, rss int64, ok bool) {
+	fields, ok := procStat(pid)
+	if !ok || len(fields) < 13 {
+		return 0, 0, false
+	}
+	// utime and stime
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	// Zombies have no memory and no VmRSS line
+	file, err := os.Open("/proc/" + strconv.Itoa(pid) + "/status")
+	if err != nil {
+		return 0, 0, false
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		value, found := strings.CutPrefix(scanner.Text(), "VmRSS:")
+		if !found {
+			continue
+		}
+		kb, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+		if err == nil {
+			rss = kb * 1024
+		}
+		break
+	}
+	return utime + stime, rss, true
+}
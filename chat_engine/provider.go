@@ -0,0 +1,137 @@
+package chat_engine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/openai/openai-go/v2"
+)
+
+// CompletionRequest is a single request for the next assistant message
+type CompletionRequest struct {
+	Messages []*Message
+	// Tools the model may call, none when empty
+	Tools []openai.ChatCompletionToolUnionParam
+	// Model overrides the provider's default model when set
+	Model string
+	// OnDelta, when set, asks the provider to stream the response and receives pieces of the
+	// content as they are generated. Providers that can't stream may ignore it.
+	OnDelta DeltaCallback
+	// ResponseFormat, when set, asks for a JSON reply
+	ResponseFormat *ResponseFormat
+	Sampling       SamplingParams
+}
+
+// DeltaCallback receives a piece of assistant content while it is being generated
+type DeltaCallback func(content string)
+
+// CompletionProvider produces assistant messages from a conversation history. Implementations
+// fill in Role, Content, ToolCalls and, when known, Model and Usage of the returned message;
+// the engine assigns the ID.
+type CompletionProvider interface {
+	Complete(ctx context.Context, req CompletionRequest) (*Message, error)
+}
+
+// OpenAIProvider is a CompletionProvider backed by the OpenAI chat completions API
+type OpenAIProvider struct {
+	client *openai.Client
+	model  string
+}
+
+// NewOpenAIProvider creates a provider using client, requests use model unless they set their own
+func NewOpenAIProvider(client *openai.Client, model string) *OpenAIProvider {
+	return &OpenAIProvider{client: client, model: model}
+}
+
+// DefaultModel returns the model used by requests that don't set their own
+func (p *OpenAIProvider) DefaultModel() string {
+	return p.model
+}
+
+func (p *OpenAIProvider) Complete(ctx context.Context, req CompletionRequest) (*Message, error) {
+	model := p.model
+	if req.Model != "" {
+		model = req.Model
+	}
+
+	messages := make([]openai.ChatCompletionMessageParamUnion, 0, len(req.Messages))
+	for _, msg := range req.Messages {
+		messages = append(messages, ToOpenAIMessage(msg))
+	}
+
+	params := openai.ChatCompletionNewParams{
+		Messages: messages,
+		Tools:    req.Tools,
+		Model:    model,
+	}
+	if req.ResponseFormat != nil {
+		params.ResponseFormat = req.ResponseFormat.toOpenAI()
+	}
+	req.Sampling.apply(&params)
+
+	var completion *openai.ChatCompletion
+	var err error
+	if req.OnDelta != nil {
+		completion, err = p.completeStreaming(ctx, params, req.OnDelta)
+	} else {
+		completion, err = p.client.Chat.Completions.New(ctx, params)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(completion.Choices) == 0 {
+		return nil, fmt.Errorf("completion has no choices")
+	}
+	choice := completion.Choices[0].Message
+
+	toolCalls := make([]ToolCall, len(choice.ToolCalls))
+	for i, toolCall := range choice.ToolCalls {
+		toolCalls[i] = ToolCall{
+			ID:        toolCall.ID,
+			Type:      string(toolCall.Type),
+			Name:      toolCall.Function.Name,
+			Arguments: toolCall.Function.Arguments,
+		}
+	}
+
+	return &Message{
+		Role:      "assistant",
+		Content:   choice.Content,
+		ToolCalls: toolCalls,
+		Model:     completion.Model,
+		Usage: &TokenUsage{
+			PromptTokens:     completion.Usage.PromptTokens,
+			CompletionTokens: completion.Usage.CompletionTokens,
+			TotalTokens:      completion.Usage.TotalTokens,
+		},
+	}, nil
+}
+
+// completeStreaming runs a streaming completion, forwarding content deltas to onDelta, and
+// returns the completion assembled from the chunks. Tool calls arrive in fragments and are
+// only complete once the stream ends.
+func (p *OpenAIProvider) completeStreaming(ctx context.Context, params openai.ChatCompletionNewParams, onDelta DeltaCallback) (*openai.ChatCompletion, error) {
+	params.StreamOptions = openai.ChatCompletionStreamOptionsParam{
+		IncludeUsage: openai.Bool(true),
+	}
+	stream := p.client.Chat.Completions.NewStreaming(ctx, params)
+	defer stream.Close()
+
+	var acc openai.ChatCompletionAccumulator
+	for stream.Next() {
+		chunk := stream.Current()
+		if !acc.AddChunk(chunk) {
+			return nil, fmt.Errorf("received a chunk of another completion")
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Index == 0 && choice.Delta.Content != "" {
+				onDelta(choice.Delta.Content)
+			}
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return nil, err
+	}
+
+	return &acc.ChatCompletion, nil
+}
@@ -0,0 +1,215 @@
+package chat_engine
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/openai/openai-go/v2"
+	"github.com/openai/openai-go/v2/option"
+)
+
+// fakeProvider is a CompletionProvider that answers with the replies of a script and records
+// the requests it got. Content is streamed word by word to requests that ask for deltas.
+type fakeProvider struct {
+	mutex    sync.Mutex
+	reply    func(n int, req CompletionRequest) (*Message, error)
+	requests []CompletionRequest
+}
+
+// newFakeProvider answers the nth request with replies[n], and with the last reply after that
+func newFakeProvider(replies ...*Message) *fakeProvider {
+	return &fakeProvider{
+		reply: func(n int, req CompletionRequest) (*Message, error) {
+			return replies[min(n, len(replies)-1)], nil
+		},
+	}
+}
+
+// DefaultModel reports a model so the engine applies a known context budget
+func (p *fakeProvider) DefaultModel() string {
+	return "fake-model"
+}
+
+func (p *fakeProvider) Complete(ctx context.Context, req CompletionRequest) (*Message, error) {
+	p.mutex.Lock()
+	n := len(p.requests)
+	p.requests = append(p.requests, req)
+	p.mutex.Unlock()
+
+	reply, err := p.reply(n, req)
+	if err != nil {
+		return nil, err
+	}
+	// A copy, the engine assigns the ID of the message it gets
+	msg := *reply
+	if msg.Model == "" {
+		msg.Model = req.Model
+		if msg.Model == "" {
+			msg.Model = p.DefaultModel()
+		}
+	}
+	if req.OnDelta != nil {
+		for _, word := range strings.SplitAfter(msg.Content, " ") {
+			if word != "" {
+				req.OnDelta(word)
+			}
+		}
+	}
+	return &msg, nil
+}
+
+// Requests returns the requests the provider got so far
+func (p *fakeProvider) Requests() []CompletionRequest {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]CompletionRequest(nil), p.requests...)
+}
+
+// funcProvider is a CompletionProvider answering with a function, for replies that depend on
+// the request's context
+type funcProvider func(ctx context.Context, req CompletionRequest) (*Message, error)
+
+func (f funcProvider) Complete(ctx context.Context, req CompletionRequest) (*Message, error) {
+	return f(ctx, req)
+}
+
+// textReply is an assistant reply without tool calls
+func textReply(content string) *Message {
+	return &Message{Role: "assistant", Content: content}
+}
+
+// toolCallReply is an assistant reply calling a tool with JSON arguments
+func toolCallReply(id, name, arguments string) *Message {
+	return &Message{
+		Role:      "assistant",
+		ToolCalls: []ToolCall{{ID: id, Type: "function", Name: name, Arguments: arguments}},
+	}
+}
+
+// newTestEngine creates an engine answering with provider, storing its database and running
+// its commands in a temporary directory
+func newTestEngine(t *testing.T, provider CompletionProvider, opts ...Option) *ChatEngine {
+	t.Helper()
+	dir := t.TempDir()
+	opts = append([]Option{
+		WithDatabaseURL(filepath.Join(dir, "agent.db")),
+		WithWorkspaceRoot(dir),
+	}, opts...)
+	engine, err := NewChatEngine(provider, opts...)
+	if err != nil {
+		t.Fatalf("NewChatEngine: %v", err)
+	}
+	t.Cleanup(func() { engine.Close() })
+	return engine
+}
+
+func TestFakeProviderStreamsContent(t *testing.T) {
+	provider := newFakeProvider(textReply("streamed in pieces"))
+
+	var deltas []string
+	msg, err := provider.Complete(context.Background(), CompletionRequest{
+		OnDelta: func(content string) { deltas = append(deltas, content) },
+	})
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if got := strings.Join(deltas, ""); got != msg.Content {
+		t.Errorf("deltas add up to %q, want %q", got, msg.Content)
+	}
+	if len(deltas) != 3 {
+		t.Errorf("got %d deltas, want 3", len(deltas))
+	}
+	if msg.Model != "fake-model" {
+		t.Errorf("model = %q, want the default model", msg.Model)
+	}
+	if n := len(provider.Requests()); n != 1 {
+		t.Errorf("recorded %d requests, want 1", n)
+	}
+}
+
+func TestNewTestEngineUsesFakeProvider(t *testing.T) {
+	provider := newFakeProvider(textReply("hello"))
+	engine := newTestEngine(t, provider)
+
+	messages, err := engine.SendUserMessage("conv", "hi")
+	if err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if len(messages) != 2 || messages[1].Content != "hello" {
+		t.Fatalf("got %d messages, want the user message and the reply", len(messages))
+	}
+}
+
+func TestEngineRunsToolTurnAgainstProvider(t *testing.T) {
+	provider := newFakeProvider(
+		toolCallReply("call_echo", "bash_command", `{"command": "echo from the tool"}`),
+		textReply("The tool printed its output."),
+	)
+	engine := newTestEngine(t, provider)
+
+	messages, err := engine.SendUserMessage("conv", "run echo")
+	if err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if len(messages) != 4 || messages[3].Content != "The tool printed its output." {
+		t.Fatalf("got %d messages, want the prompt, the tool call, its result and the reply", len(messages))
+	}
+	for _, msg := range messages[1:] {
+		if msg.ID == "" {
+			t.Errorf("%s message has no ID", msg.Role)
+		}
+	}
+
+	requests := provider.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("provider got %d requests, want 2", len(requests))
+	}
+	if !slices.Contains(toolNames(requests[0].Tools), "bash_command") {
+		t.Errorf("offered tools %v, want bash_command", toolNames(requests[0].Tools))
+	}
+	// The second request carries the tool's output back to the model
+	history := requests[1].Messages
+	last := history[len(history)-1]
+	if last.Role != "tool" || last.TollCallID != "call_echo" || !strings.Contains(last.Content, "from the tool") {
+		t.Errorf("last message sent is %s %q for %q, want the tool's output", last.Role, last.Content, last.TollCallID)
+	}
+}
+
+// openAITestProvider returns an OpenAIProvider talking to a fake chat completions endpoint
+// that answers with content, and a function returning the body of the last request it got
+func openAITestProvider(t *testing.T, content string) (*OpenAIProvider, func() map[string]any) {
+	t.Helper()
+	var mutex sync.Mutex
+	var last map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mutex.Lock()
+		last = body
+		mutex.Unlock()
+		reply, _ := json.Marshal(map[string]any{
+			"id": "chatcmpl-1", "object": "chat.completion", "model": body["model"],
+			"choices": []map[string]any{{"index": 0, "finish_reason": "stop", "message": map[string]any{"role": "assistant", "content": content}}},
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(reply)
+	}))
+	t.Cleanup(server.Close)
+
+	client := openai.NewClient(option.WithBaseURL(server.URL), option.WithAPIKey("sk-test"), option.WithMaxRetries(0))
+	return NewOpenAIProvider(&client, "gpt-test"), func() map[string]any {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return last
+	}
+}
@@ -0,0 +1,203 @@
+package chat_engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// In read-only mode tools may inspect the workspace but not change it. File writing tools are
+// rejected outright. Commands are checked with a heuristic that looks for redirections to
+// files and for well-known commands that modify files; it catches common cases, not a
+// determined attempt (a script or an interpreter one-liner can still write).
+
+// readOnlyFileTools are tools that always modify files
+var readOnlyFileTools = map[string]bool{
+	"write_file": true,
+	"edit_file":  true,
+}
+
+// writeCommands modify files whatever their arguments are
+var writeCommands = map[string]bool{
+	"rm": true, "rmdir": true, "mv": true, "cp": true, "touch": true, "mkdir": true,
+	"ln": true, "chmod": true, "chown": true, "chgrp": true, "truncate": true, "dd": true,
+	"tee": true, "install": true, "shred": true, "unlink": true, "mkfifo": true, "mknod": true,
+	"patch": true, "rsync": true,
+}
+
+// writeSubcommands are subcommands that modify files, keyed by command
+var writeSubcommands = map[string]map[string]bool{
+	"git": {
+		"add": true, "am": true, "apply": true, "checkout": true, "cherry-pick": true, "clean": true,
+		"clone": true, "commit": true, "fetch": true, "init": true, "merge": true, "mv": true,
+		"pull": true, "push": true, "rebase": true, "reset": true, "restore": true, "revert": true,
+		"rm": true, "stash": true, "switch": true, "tag": true,
+	},
+	"go":   {"get": true, "install": true, "generate": true, "mod": true},
+	"npm":  {"install": true, "i": true, "ci": true, "add": true, "uninstall": true, "remove": true, "update": true, "init": true},
+	"yarn": {"install": true, "add": true, "remove": true, "upgrade": true, "init": true},
+	"pnpm": {"install": true, "i": true, "add": true, "remove": true, "update": true, "init": true},
+	"pip":  {"install": true, "uninstall": true},
+	"pip3": {"install": true, "uninstall": true},
+}
+
+// findWriteActions are actions of find that delete or write files
+var findWriteActions = map[string]bool{
+	"-delete": true, "-fprint": true, "-fprint0": true, "-fprintf": true, "-fls": true,
+}
+
+// findExecActions run a command for every file find matches
+var findExecActions = map[string]bool{
+	"-exec": true, "-execdir": true, "-ok": true, "-okdir": true,
+}
+
+// inPlaceFlagCommands modify files when given an in-place flag (-i, --in-place)
+var inPlaceFlagCommands = map[string]bool{
+	"sed":  true,
+	"perl": true,
+}
+
+var (
+	// Splits a command line into simple commands
+	commandSeparator = regexp.MustCompile(`&&|\|\||[;|&\n(){}` + "`" + `]|\$\(`)
+	// Output redirection to a file: > file, >> file, 2> file, &> file (but not >&2 or 2>&1)
+	fileRedirection = regexp.MustCompile(`>>?\|?\s*([^\s&|;<>()]+)`)
+)
+
+// WithReadOnly puts every conversation in read-only mode, see SetReadOnly
+func WithReadOnly(enabled bool) Option {
+	return func(e *ChatEngine) {
+		e.readOnly = enabled
+	}
+}
+
+// SetReadOnly enables or disables read-only mode for a conversation. It can't be disabled
+// for a single conversation while the whole engine is read-only.
+func (e *ChatEngine) SetReadOnly(conversationID string, enabled bool) error {
+	if e.readOnly && !enabled {
+		return fmt.Errorf("the server runs in read-only mode")
+	}
+
+	e.readOnlyMutex.Lock()
+	defer e.readOnlyMutex.Unlock()
+	if enabled {
+		e.readOnlyConversations[conversationID] = true
+	} else {
+		delete(e.readOnlyConversations, conversationID)
+	}
+	return nil
+}
+
+// IsReadOnly reports whether tools of a conversation may only read
+func (e *ChatEngine) IsReadOnly(conversationID string) bool {
+	if e.readOnly {
+		return true
+	}
+	e.readOnlyMutex.RLock()
+	defer e.readOnlyMutex.RUnlock()
+	return e.readOnlyConversations[conversationID]
+}
+
+// readOnlyViolation returns the policy message for a tool call that is not allowed because
+// the conversation is read-only, or "" when the call may run
+func (e *ChatEngine) readOnlyViolation(conv *Conversation, toolCall ToolCall) string {
+	if !e.IsReadOnly(conv.ID) {
+		return ""
+	}
+
+	if readOnlyFileTools[toolCall.Name] {
+		return fmt.Sprintf("Blocked by policy: %s is not allowed because this conversation is in read-only mode. "+
+			"Only tools that read files are available.", toolCall.Name)
+	}
+
+	if toolCall.Name == "git" {
+		var call gitCall
+		if err := json.Unmarshal([]byte(toolCall.Arguments), &call); err != nil {
+			return ""
+		}
+		if reason := call.writeReason(); reason != "" {
+			return fmt.Sprintf("Blocked by policy: this conversation is in read-only mode and %s modifies the repository. "+
+				"Only git status, diff, log and listing branches are allowed.", reason)
+		}
+	}
+
+	if toolCall.Name == "bash_command" || toolCall.Name == "shell" || toolCall.Name == "schedule_command" {
+		var args map[string]interface{}
+		if err := json.Unmarshal([]byte(toolCall.Arguments), &args); err != nil {
+			return ""
+		}
+		command, _ := args["command"].(string)
+		if reason := commandWriteReason(command); reason != "" {
+			return fmt.Sprintf("Blocked by policy: this conversation is in read-only mode and the command appears to modify files (%s). "+
+				"Only commands that read are allowed.", reason)
+		}
+	}
+
+	return ""
+}
+
+// commandWriteReason returns why a command looks like it writes to the filesystem, or ""
+func commandWriteReason(command string) string {
+	for _, match := range fileRedirection.FindAllStringSubmatch(command, -1) {
+		target := strings.Trim(match[1], `"'`)
+		if !strings.HasPrefix(target, "/dev/") {
+			return fmt.Sprintf("output redirection to %s", target)
+		}
+	}
+
+	for _, words := range simpleCommands(command) {
+		name := filepath.Base(words[0])
+		if writeCommands[name] {
+			return name
+		}
+		if subcommands, ok := writeSubcommands[name]; ok {
+			for _, word := range words[1:] {
+				if strings.HasPrefix(word, "-") {
+					continue
+				}
+				if subcommands[word] {
+					return name + " " + word
+				}
+				break
+			}
+		}
+		if name == "find" {
+			for i, word := range words[1:] {
+				if findWriteActions[word] {
+					return name + " " + word
+				}
+				if findExecActions[word] && i+2 < len(words) && writeCommands[filepath.Base(words[i+2])] {
+					return name + " " + word + " " + filepath.Base(words[i+2])
+				}
+			}
+		}
+		if inPlaceFlagCommands[name] {
+			for _, word := range words[1:] {
+				if word == "--in-place" || (strings.HasPrefix(word, "-") && !strings.HasPrefix(word, "--") && strings.Contains(word, "i")) {
+					return name + " " + word
+				}
+			}
+		}
+	}
+
+	return ""
+}
+
+// simpleCommands splits a command line into the words of its simple commands, without
+// leading variable assignments and wrappers that run another command
+func simpleCommands(command string) [][]string {
+	var commands [][]string
+	for _, part := range commandSeparator.Split(command, -1) {
+		words := strings.Fields(part)
+		for len(words) > 0 && (strings.Contains(words[0], "=") || words[0] == "sudo" || words[0] == "env" ||
+			words[0] == "command" || words[0] == "nohup" || words[0] == "xargs" || words[0] == "time") {
+			words = words[1:]
+		}
+		if len(words) > 0 {
+			commands = append(commands, words)
+		}
+	}
+	return commands
+}
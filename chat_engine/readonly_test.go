@@ -0,0 +1,83 @@
+package chat_engine
+
+import "testing"
+
+func TestCommandWriteReason(t *testing.T) {
+	tests := []struct {
+		command string
+		writes  bool
+	}{
+		{"cat x", false},
+		{"cat x > y", true},
+		{"cat x >y", true},
+		{"cat x >> y", true},
+		{"make 2> errors.log", true},
+		{"ls missing 2>/dev/null", false},
+		{"grep -r foo . 2>&1 | head", false},
+		{"echo done >&2", false},
+		{"find . -name '*.go'", false},
+		{"find . -name '*.tmp' -delete", true},
+		{`find . -type f -exec rm {} \;`, true},
+		{"find . -type f -exec grep -l foo {} +", false},
+		{"find . -fprint files.txt", true},
+		{"sed -n 1,10p file", false},
+		{"sed -i s/a/b/ file", true},
+		{"sed -i.bak s/a/b/ file", true},
+		{"sed --in-place s/a/b/ file", true},
+		{"perl -pi -e s/a/b/ file", true},
+		{"echo $(rm -rf build)", true},
+		{"echo `rm -rf build`", true},
+		{"ls && rm x", true},
+		{"(cd sub; touch marker)", true},
+		{"sudo rm x", true},
+		{"FOO=1 rm x", true},
+		{"find . -name '*.o' | xargs rm", true},
+		{"cat a | tee b", true},
+		{"/bin/rm x", true},
+		{"git status", false},
+		{"git log --oneline", false},
+		{"git commit -m msg", true},
+		{"go test ./...", false},
+		{"go mod tidy", true},
+		{"npm ls", false},
+		{"npm install", true},
+	}
+	for _, tt := range tests {
+		reason := commandWriteReason(tt.command)
+		if writes := reason != ""; writes != tt.writes {
+			t.Errorf("commandWriteReason(%q) = %q, want writes = %v", tt.command, reason, tt.writes)
+		}
+	}
+}
+
+func TestReadOnlyViolation(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("ok")))
+	conv := &Conversation{ID: "conv"}
+
+	write := ToolCall{ID: "call_write", Name: "write_file", Arguments: `{"path": "x", "content": "y"}`}
+	if violation := engine.readOnlyViolation(conv, write); violation != "" {
+		t.Errorf("write_file is blocked outside of read-only mode: %s", violation)
+	}
+
+	if err := engine.SetReadOnly("conv", true); err != nil {
+		t.Fatalf("SetReadOnly: %v", err)
+	}
+	for _, toolCall := range []ToolCall{
+		write,
+		{ID: "call_edit", Name: "edit_file", Arguments: `{"path": "x"}`},
+		{ID: "call_bash", Name: "bash_command", Arguments: `{"command": "cat x > y"}`},
+		{ID: "call_shell", Name: "shell", Arguments: `{"command": "find . -delete"}`},
+	} {
+		if violation := engine.readOnlyViolation(conv, toolCall); violation == "" {
+			t.Errorf("%s %s is allowed in read-only mode", toolCall.Name, toolCall.Arguments)
+		}
+	}
+	for _, toolCall := range []ToolCall{
+		{ID: "call_read", Name: "read_file", Arguments: `{"path": "x"}`},
+		{ID: "call_bash", Name: "bash_command", Arguments: `{"command": "cat x | grep y"}`},
+	} {
+		if violation := engine.readOnlyViolation(conv, toolCall); violation != "" {
+			t.Errorf("%s %s is blocked in read-only mode: %s", toolCall.Name, toolCall.Arguments, violation)
+		}
+	}
+}
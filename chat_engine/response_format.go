@@ -0,0 +1,76 @@
+package chat_engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/openai/openai-go/v2"
+	"github.com/openai/openai-go/v2/packages/param"
+	"github.com/openai/openai-go/v2/shared"
+)
+
+// Response format types
+const (
+	ResponseFormatJSONObject = "json_object"
+	ResponseFormatJSONSchema = "json_schema"
+)
+
+// invalidJSONInstruction asks the model to correct a reply that was not valid JSON
+const invalidJSONInstruction = "Your previous reply was not valid JSON. Reply again with valid JSON only, " +
+	"without any text or code fences around it."
+
+// ErrInvalidJSONResponse is returned when a turn asked for JSON but the model's final reply
+// still was not valid JSON after being asked to correct it
+var ErrInvalidJSONResponse = errors.New("model did not reply with valid JSON")
+
+// ResponseFormat makes the model reply with JSON, either any JSON object or one matching a
+// JSON Schema
+type ResponseFormat struct {
+	// ResponseFormatJSONObject or ResponseFormatJSONSchema
+	Type string `json:"type"`
+	// Name of the schema, required for ResponseFormatJSONSchema
+	Name   string          `json:"name,omitempty"`
+	Schema json.RawMessage `json:"schema,omitempty"`
+	// Strict makes the model follow the schema exactly, see the OpenAI structured outputs guide
+	Strict bool `json:"strict,omitempty"`
+}
+
+// Validate checks that the format is complete
+func (f *ResponseFormat) Validate() error {
+	switch f.Type {
+	case ResponseFormatJSONObject:
+		return nil
+	case ResponseFormatJSONSchema:
+		if f.Name == "" {
+			return fmt.Errorf("json_schema response format needs a name")
+		}
+		var schema map[string]any
+		if err := json.Unmarshal(f.Schema, &schema); err != nil {
+			return fmt.Errorf("json_schema response format needs a schema object: %w", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown response format %q, use %q or %q", f.Type, ResponseFormatJSONObject, ResponseFormatJSONSchema)
+	}
+}
+
+// toOpenAI converts the format to its chat completions API parameter
+func (f *ResponseFormat) toOpenAI() openai.ChatCompletionNewParamsResponseFormatUnion {
+	if f.Type == ResponseFormatJSONObject {
+		return openai.ChatCompletionNewParamsResponseFormatUnion{
+			OfJSONObject: &shared.ResponseFormatJSONObjectParam{},
+		}
+	}
+
+	schema := shared.ResponseFormatJSONSchemaJSONSchemaParam{
+		Name:   f.Name,
+		Schema: f.Schema,
+	}
+	if f.Strict {
+		schema.Strict = param.NewOpt(true)
+	}
+	return openai.ChatCompletionNewParamsResponseFormatUnion{
+		OfJSONSchema: &shared.ResponseFormatJSONSchemaParam{JSONSchema: schema},
+	}
+}
@@ -0,0 +1,98 @@
+package chat_engine
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestResponseFormatValidate(t *testing.T) {
+	tests := []struct {
+		format ResponseFormat
+		valid  bool
+	}{
+		{ResponseFormat{Type: ResponseFormatJSONObject}, true},
+		{ResponseFormat{Type: ResponseFormatJSONSchema, Name: "answer", Schema: json.RawMessage(`{"type": "object"}`)}, true},
+		{ResponseFormat{Type: ResponseFormatJSONSchema, Schema: json.RawMessage(`{"type": "object"}`)}, false},
+		{ResponseFormat{Type: ResponseFormatJSONSchema, Name: "answer", Schema: json.RawMessage(`[1]`)}, false},
+		{ResponseFormat{Type: "xml"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.format.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%+v: Validate returned %v, want valid %v", tt.format, err, tt.valid)
+		}
+	}
+}
+
+func TestResponseFormatReachesProvider(t *testing.T) {
+	provider := newFakeProvider(textReply(`{"answer": 42}`))
+	engine := newTestEngine(t, provider)
+	format := &ResponseFormat{Type: ResponseFormatJSONObject}
+
+	messages, err := engine.SendUserMessageWithOptions("conv", "answer in JSON", SendOptions{ResponseFormat: format})
+	if err != nil {
+		t.Fatalf("SendUserMessageWithOptions: %v", err)
+	}
+	if got := provider.Requests()[0].ResponseFormat; got != format {
+		t.Errorf("provider got response format %+v, want %+v", got, format)
+	}
+	if last := messages[len(messages)-1]; last.Content != `{"answer": 42}` {
+		t.Errorf("reply is %q", last.Content)
+	}
+}
+
+func TestInvalidJSONReplyIsAskedAgain(t *testing.T) {
+	provider := newFakeProvider(textReply("Sure! ```json\n{}\n```"), textReply(`{"answer": 42}`))
+	engine := newTestEngine(t, provider)
+
+	messages, err := engine.SendUserMessageWithOptions("conv", "answer in JSON", SendOptions{ResponseFormat: &ResponseFormat{Type: ResponseFormatJSONObject}})
+	if err != nil {
+		t.Fatalf("SendUserMessageWithOptions: %v", err)
+	}
+	requests := provider.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("provider got %d requests, want 2", len(requests))
+	}
+	// The retry shows the model its reply and what was wrong with it
+	retry := requests[1].Messages
+	if n := len(retry); retry[n-2].Content != "Sure! ```json\n{}\n```" || retry[n-1].Role != "system" || retry[n-1].Content != invalidJSONInstruction {
+		t.Errorf("retry ends with %+v and %+v, want the invalid reply and the instruction", retry[n-2], retry[n-1])
+	}
+	// Only the valid reply is kept
+	if len(messages) != 2 || messages[1].Content != `{"answer": 42}` {
+		t.Errorf("turn messages are %+v, want the prompt and the valid reply", messages)
+	}
+}
+
+func TestInvalidJSONReplyFailsTurn(t *testing.T) {
+	provider := newFakeProvider(textReply("not JSON"))
+	engine := newTestEngine(t, provider)
+
+	_, err := engine.SendUserMessageWithOptions("conv", "answer in JSON", SendOptions{ResponseFormat: &ResponseFormat{Type: ResponseFormatJSONObject}})
+	if !errors.Is(err, ErrInvalidJSONResponse) {
+		t.Errorf("SendUserMessageWithOptions returned %v, want ErrInvalidJSONResponse", err)
+	}
+	if n := len(provider.Requests()); n != 2 {
+		t.Errorf("provider got %d requests, want a single retry", n)
+	}
+}
+
+func TestOpenAIProviderSendsResponseFormat(t *testing.T) {
+	provider, lastRequest := openAITestProvider(t, `{"answer": 42}`)
+	format := &ResponseFormat{Type: ResponseFormatJSONSchema, Name: "answer", Schema: json.RawMessage(`{"type": "object"}`), Strict: true}
+
+	if _, err := provider.Complete(t.Context(), CompletionRequest{
+		Messages:       []*Message{{Role: "user", Content: "answer"}},
+		ResponseFormat: format,
+	}); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	want := map[string]any{
+		"type":        "json_schema",
+		"json_schema": map[string]any{"name": "answer", "schema": map[string]any{"type": "object"}, "strict": true},
+	}
+	if got := lastRequest()["response_format"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent response_format %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,146 @@
+package chat_engine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/openai/openai-go/v2"
+)
+
+const (
+	defaultMaxCompletionAttempts = 3
+	defaultMaxEmptyReplyRetries  = 1
+	// completionBackoff is the delay before the first retry of a completion request, doubled
+	// for every further one up to maxCompletionBackoff
+	completionBackoff    = time.Second
+	maxCompletionBackoff = 30 * time.Second
+	// maxRetryAfter caps how long a Retry-After header can make a retry wait
+	maxRetryAfter = time.Minute
+)
+
+// WithMaxCompletionAttempts sets how often a completion request is tried when it fails with a
+// transient error: rate limits, server errors and network errors. 1 disables retries.
+func WithMaxCompletionAttempts(n int) Option {
+	return func(e *ChatEngine) {
+		e.maxCompletionAttempts = n
+	}
+}
+
+// emptyReplyInstruction asks the model to answer after a reply without content or tool calls
+const emptyReplyInstruction = "Your previous reply was empty. Reply again, either answering the user or calling a tool."
+
+// WithMaxEmptyReplyRetries sets how often the model is asked again when it replies without any
+// content or tool calls, which would leave the user with a blank reply. 0 disables retries.
+func WithMaxEmptyReplyRetries(n int) Option {
+	return func(e *ChatEngine) {
+		e.maxEmptyReplyRetries = n
+	}
+}
+
+// isEmptyReply reports whether a model reply has neither content nor tool calls
+func isEmptyReply(msg *Message) bool {
+	return len(msg.ToolCalls) == 0 && strings.TrimSpace(msg.Content) == ""
+}
+
+// addUsage adds the token usage of a discarded reply to the one replacing it
+func addUsage(msg *Message, usage *TokenUsage) {
+	if usage == nil {
+		return
+	}
+	if msg.Usage == nil {
+		msg.Usage = &TokenUsage{}
+	}
+	msg.Usage.PromptTokens += usage.PromptTokens
+	msg.Usage.CompletionTokens += usage.CompletionTokens
+	msg.Usage.TotalTokens += usage.TotalTokens
+}
+
+// complete asks the provider for a completion, retrying transient errors with exponential
+// backoff and jitter, or after the delay the API asked for with Retry-After. A streaming
+// request is not retried once content was passed to its OnDelta, as it would be sent twice.
+func (e *ChatEngine) complete(ctx context.Context, req CompletionRequest) (*Message, error) {
+	streamed := false
+	if onDelta := req.OnDelta; onDelta != nil {
+		req.OnDelta = func(content string) {
+			streamed = true
+			onDelta(content)
+		}
+	}
+
+	backoff := completionBackoff
+	for attempt := 1; ; attempt++ {
+		msg, err := e.provider.Complete(ctx, req)
+		if err == nil {
+			return msg, nil
+		}
+
+		retryAfter, retryable := retryableCompletionError(err)
+		if !retryable || streamed || attempt >= e.maxCompletionAttempts {
+			return nil, err
+		}
+
+		delay := retryAfter
+		if delay <= 0 {
+			delay = backoff/2 + rand.N(backoff/2+1)
+		}
+		slog.Warn("Completion request failed, retrying", "attempt", attempt, "retry_in", delay.String(), "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff = min(backoff*2, maxCompletionBackoff)
+	}
+}
+
+// retryableCompletionError reports whether a failed completion request may succeed when
+// tried again, and how long the API asked to wait first, if it did
+func retryableCompletionError(err error) (retryAfter time.Duration, retryable bool) {
+	var apiErr *openai.Error
+	if errors.As(err, &apiErr) {
+		switch code := apiErr.StatusCode; {
+		case code == http.StatusTooManyRequests, code == http.StatusRequestTimeout, code >= 500:
+			return parseRetryAfter(apiErr.Response), true
+		default:
+			// Other client errors, such as invalid requests, fail the same way every time
+			return 0, false
+		}
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return 0, false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, true
+	}
+	return 0, false
+}
+
+// parseRetryAfter reads the delay from the retry-after-ms or Retry-After header, which holds
+// either seconds or an HTTP date. It returns 0 when there is none.
+func parseRetryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+
+	var delay time.Duration
+	if ms, err := strconv.ParseFloat(resp.Header.Get("retry-after-ms"), 64); err == nil {
+		delay = time.Duration(ms * float64(time.Millisecond))
+	} else if value := resp.Header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+			delay = time.Duration(seconds * float64(time.Second))
+		} else if date, err := http.ParseTime(value); err == nil {
+			delay = time.Until(date)
+		}
+	}
+	return max(0, min(delay, maxRetryAfter))
+}
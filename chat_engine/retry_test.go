@@ -0,0 +1,193 @@
+package chat_engine
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/openai/openai-go/v2"
+)
+
+// apiError is the error the OpenAI client returns for a response with status and header
+func apiError(status int, header map[string]string) *openai.Error {
+	resp := &http.Response{StatusCode: status, Header: make(http.Header)}
+	for key, value := range header {
+		resp.Header.Set(key, value)
+	}
+	return &openai.Error{
+		StatusCode: status,
+		Request:    httptest.NewRequest(http.MethodPost, "https://api.openai.com/v1/chat/completions", nil),
+		Response:   resp,
+	}
+}
+
+// failingProvider fails the first len(errs) requests with errs and answers the rest with reply
+func failingProvider(reply *Message, errs ...error) *fakeProvider {
+	return &fakeProvider{
+		reply: func(n int, req CompletionRequest) (*Message, error) {
+			if n < len(errs) {
+				return nil, errs[n]
+			}
+			return reply, nil
+		},
+	}
+}
+
+func TestCompleteRetriesAfterRetryAfter(t *testing.T) {
+	provider := failingProvider(textReply("done"),
+		apiError(http.StatusTooManyRequests, map[string]string{"retry-after-ms": "50"}),
+		apiError(http.StatusServiceUnavailable, map[string]string{"retry-after-ms": "50"}),
+	)
+	engine := newTestEngine(t, provider)
+
+	start := time.Now()
+	msg, err := engine.complete(context.Background(), CompletionRequest{})
+	if err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+	if msg.Content != "done" {
+		t.Errorf("reply = %q, want done", msg.Content)
+	}
+	if n := len(provider.Requests()); n != 3 {
+		t.Errorf("provider got %d requests, want 3", n)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("retries took %s, they did not wait for Retry-After", elapsed)
+	}
+}
+
+func TestCompleteBacksOffWithoutRetryAfter(t *testing.T) {
+	provider := failingProvider(textReply("done"), apiError(http.StatusInternalServerError, nil))
+	engine := newTestEngine(t, provider)
+
+	start := time.Now()
+	if _, err := engine.complete(context.Background(), CompletionRequest{}); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+	if n := len(provider.Requests()); n != 2 {
+		t.Errorf("provider got %d requests, want 2", n)
+	}
+	// The first backoff is jittered between half and all of completionBackoff
+	if elapsed := time.Since(start); elapsed < completionBackoff/2 {
+		t.Errorf("retry came after %s, want a backoff of at least %s", elapsed, completionBackoff/2)
+	}
+}
+
+func TestCompleteDoesNotRetryClientErrors(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusNotFound} {
+		provider := failingProvider(textReply("done"), apiError(status, nil))
+		engine := newTestEngine(t, provider)
+
+		_, err := engine.complete(context.Background(), CompletionRequest{})
+		var apiErr *openai.Error
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != status {
+			t.Errorf("status %d: complete returned %v, want the API error", status, err)
+		}
+		if n := len(provider.Requests()); n != 1 {
+			t.Errorf("status %d: provider got %d requests, want 1", status, n)
+		}
+	}
+}
+
+func TestCompleteGivesUpAfterMaxAttempts(t *testing.T) {
+	rateLimited := apiError(http.StatusTooManyRequests, map[string]string{"retry-after-ms": "1"})
+	provider := failingProvider(textReply("done"), rateLimited, rateLimited, rateLimited)
+	engine := newTestEngine(t, provider, WithMaxCompletionAttempts(2))
+
+	if _, err := engine.complete(context.Background(), CompletionRequest{}); !errors.Is(err, rateLimited) {
+		t.Errorf("complete returned %v, want the last rate limit error", err)
+	}
+	if n := len(provider.Requests()); n != 2 {
+		t.Errorf("provider got %d requests, want 2", n)
+	}
+}
+
+func TestCompleteStopsWaitingWhenCanceled(t *testing.T) {
+	provider := failingProvider(textReply("done"), apiError(http.StatusTooManyRequests, map[string]string{"Retry-After": "30"}))
+	engine := newTestEngine(t, provider)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := engine.complete(ctx, CompletionRequest{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("complete returned %v, want the context's error", err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   time.Duration
+	}{
+		{"none", nil, 0},
+		{"seconds", map[string]string{"Retry-After": "2"}, 2 * time.Second},
+		{"milliseconds win", map[string]string{"retry-after-ms": "250", "Retry-After": "2"}, 250 * time.Millisecond},
+		{"capped", map[string]string{"Retry-After": "3600"}, maxRetryAfter},
+		{"past date", map[string]string{"Retry-After": "Mon, 02 Jan 2006 15:04:05 GMT"}, 0},
+		{"invalid", map[string]string{"Retry-After": "soon"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(apiError(http.StatusTooManyRequests, tt.header).Response); got != tt.want {
+				t.Errorf("parseRetryAfter = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmptyReplyIsAskedAgain(t *testing.T) {
+	empty := &Message{Role: "assistant", Usage: &TokenUsage{PromptTokens: 10, CompletionTokens: 1, TotalTokens: 11}}
+	reply := &Message{Role: "assistant", Content: "the real answer", Usage: &TokenUsage{PromptTokens: 12, CompletionTokens: 3, TotalTokens: 15}}
+	provider := newFakeProvider(empty, reply)
+	engine := newTestEngine(t, provider)
+
+	messages, err := engine.SendUserMessage("conv", "question")
+	if err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	last := messages[len(messages)-1]
+	if last.Content != "the real answer" {
+		t.Errorf("turn ended with %q, want the real answer", last.Content)
+	}
+	for _, msg := range messages {
+		if msg.Role == "assistant" && isEmptyReply(msg) {
+			t.Errorf("the empty reply %s was kept", msg.ID)
+		}
+	}
+	if last.Usage == nil || last.Usage.TotalTokens != 26 {
+		t.Errorf("usage = %+v, want both replies counted", last.Usage)
+	}
+
+	requests := provider.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("provider got %d requests, want 2", len(requests))
+	}
+	retry := requests[1].Messages
+	if instruction := retry[len(retry)-1]; instruction.Role != "system" || instruction.Content != emptyReplyInstruction {
+		t.Errorf("retry ends with %+v, want the empty reply instruction", instruction)
+	}
+}
+
+func TestEmptyReplyRetriesAreLimited(t *testing.T) {
+	provider := newFakeProvider(&Message{Role: "assistant"})
+	engine := newTestEngine(t, provider, WithMaxEmptyReplyRetries(2))
+
+	if _, err := engine.SendUserMessage("conv", "question"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if n := len(provider.Requests()); n != 3 {
+		t.Errorf("provider got %d requests, want the first and 2 retries", n)
+	}
+
+	provider = newFakeProvider(&Message{Role: "assistant"})
+	engine = newTestEngine(t, provider, WithMaxEmptyReplyRetries(0))
+	if _, err := engine.SendUserMessage("conv", "question"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if n := len(provider.Requests()); n != 1 {
+		t.Errorf("provider got %d requests with retries disabled, want 1", n)
+	}
+}
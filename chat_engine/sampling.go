@@ -0,0 +1,80 @@
+package chat_engine
+
+import (
+	"fmt"
+
+	"github.com/openai/openai-go/v2"
+)
+
+// SamplingParams control how the model samples its replies. Nil fields are left to the API's
+// defaults.
+type SamplingParams struct {
+	Temperature      *float64 `json:"temperature,omitempty"`
+	TopP             *float64 `json:"top_p,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+}
+
+// WithSampling sets the sampling parameters of completion requests, turns may override them
+// with SendOptions.Sampling
+func WithSampling(params SamplingParams) Option {
+	return func(e *ChatEngine) {
+		e.sampling = params
+	}
+}
+
+// Validate checks that the parameters are within the ranges the API accepts
+func (p SamplingParams) Validate() error {
+	checks := []struct {
+		name     string
+		value    *float64
+		min, max float64
+	}{
+		{"temperature", p.Temperature, 0, 2},
+		{"top_p", p.TopP, 0, 1},
+		{"presence_penalty", p.PresencePenalty, -2, 2},
+		{"frequency_penalty", p.FrequencyPenalty, -2, 2},
+	}
+	for _, check := range checks {
+		if check.value != nil && (*check.value < check.min || *check.value > check.max) {
+			return fmt.Errorf("%s must be between %g and %g, got %g", check.name, check.min, check.max, *check.value)
+		}
+	}
+	return nil
+}
+
+// merge returns p with the fields set in overrides replaced
+func (p SamplingParams) merge(overrides *SamplingParams) SamplingParams {
+	if overrides == nil {
+		return p
+	}
+	if overrides.Temperature != nil {
+		p.Temperature = overrides.Temperature
+	}
+	if overrides.TopP != nil {
+		p.TopP = overrides.TopP
+	}
+	if overrides.PresencePenalty != nil {
+		p.PresencePenalty = overrides.PresencePenalty
+	}
+	if overrides.FrequencyPenalty != nil {
+		p.FrequencyPenalty = overrides.FrequencyPenalty
+	}
+	return p
+}
+
+// apply sets the parameters on a chat completion request
+func (p SamplingParams) apply(params *openai.ChatCompletionNewParams) {
+	if p.Temperature != nil {
+		params.Temperature = openai.Float(*p.Temperature)
+	}
+	if p.TopP != nil {
+		params.TopP = openai.Float(*p.TopP)
+	}
+	if p.PresencePenalty != nil {
+		params.PresencePenalty = openai.Float(*p.PresencePenalty)
+	}
+	if p.FrequencyPenalty != nil {
+		params.FrequencyPenalty = openai.Float(*p.FrequencyPenalty)
+	}
+}
@@ -0,0 +1,94 @@
+package chat_engine
+
+import "testing"
+
+// float returns a pointer to f, for the fields of SamplingParams
+func float(f float64) *float64 {
+	return &f
+}
+
+func TestSamplingParamsValidate(t *testing.T) {
+	tests := []struct {
+		params SamplingParams
+		valid  bool
+	}{
+		{SamplingParams{}, true},
+		{SamplingParams{Temperature: float(0), TopP: float(1)}, true},
+		{SamplingParams{PresencePenalty: float(-2), FrequencyPenalty: float(2)}, true},
+		{SamplingParams{Temperature: float(2.5)}, false},
+		{SamplingParams{TopP: float(-0.1)}, false},
+		{SamplingParams{PresencePenalty: float(3)}, false},
+		{SamplingParams{FrequencyPenalty: float(-3)}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.params.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%+v: Validate returned %v, want valid %v", tt.params, err, tt.valid)
+		}
+	}
+}
+
+func TestTurnSamplingOverridesEngineDefaults(t *testing.T) {
+	provider := newFakeProvider(toolCallReply("call_1", "bash_command", `{"command": "echo hi"}`), textReply("done"))
+	engine := newTestEngine(t, provider, WithSampling(SamplingParams{Temperature: float(0.2), TopP: float(0.9)}))
+
+	if _, err := engine.SendUserMessageWithOptions("conv", "run it", SendOptions{Sampling: &SamplingParams{Temperature: float(1.1)}}); err != nil {
+		t.Fatalf("SendUserMessageWithOptions: %v", err)
+	}
+	requests := provider.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("provider got %d requests, want 2", len(requests))
+	}
+	// Every request of the turn, including the one after the tool call, is sampled the same way
+	for i, request := range requests {
+		sampling := request.Sampling
+		if sampling.Temperature == nil || *sampling.Temperature != 1.1 || sampling.TopP == nil || *sampling.TopP != 0.9 {
+			t.Errorf("request %d has sampling %+v, want temperature 1.1 and top_p 0.9", i, sampling)
+		}
+		if sampling.PresencePenalty != nil || sampling.FrequencyPenalty != nil {
+			t.Errorf("request %d sets penalties that were never configured", i)
+		}
+	}
+
+	// The next turn is back to the engine's defaults
+	if _, err := engine.SendUserMessage("conv", "again"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if got := provider.Requests()[2].Sampling.Temperature; got == nil || *got != 0.2 {
+		t.Errorf("next turn has temperature %v, want 0.2", got)
+	}
+}
+
+func TestOpenAIProviderSendsSampling(t *testing.T) {
+	provider, lastRequest := openAITestProvider(t, "hi")
+
+	if _, err := provider.Complete(t.Context(), CompletionRequest{
+		Messages: []*Message{{Role: "user", Content: "hi"}},
+		Sampling: SamplingParams{
+			Temperature:      float(0.5),
+			TopP:             float(0.8),
+			PresencePenalty:  float(-1),
+			FrequencyPenalty: float(1.5),
+		},
+	}); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	body := lastRequest()
+	for name, want := range map[string]float64{"temperature": 0.5, "top_p": 0.8, "presence_penalty": -1, "frequency_penalty": 1.5} {
+		if got := body[name]; got != want {
+			t.Errorf("sent %s %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestOpenAIProviderLeavesUnsetSamplingOut(t *testing.T) {
+	provider, lastRequest := openAITestProvider(t, "hi")
+
+	if _, err := provider.Complete(t.Context(), CompletionRequest{Messages: []*Message{{Role: "user", Content: "hi"}}}); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	for _, name := range []string{"temperature", "top_p", "presence_penalty", "frequency_penalty"} {
+		if got, ok := lastRequest()[name]; ok {
+			t.Errorf("sent %s %v, want it left to the API's default", name, got)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package chat_engine
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Scheduled commands are bash commands the model registered with the schedule_command tool to
+// run periodically, on an interval or a cron expression. Schedules are stored in the
+// database, so they survive restarts; runs missed while the server was down are not made up
+// for, a due schedule runs once and is then scheduled from the current time. The output of
+// every run is added to the conversation that registered the schedule as a system message.
+// While a turn of the conversation is running the output waits for it to end, so that it
+// doesn't land between a tool call and its response.
+
+const (
+	// schedulerTickInterval is how often the scheduler looks for due schedules
+	schedulerTickInterval = time.Second
+	// minScheduleInterval bounds how often a schedule may run
+	minScheduleInterval = 10 * time.Second
+	// maxSchedulesPerConversation bounds the schedules a conversation may register
+	maxSchedulesPerConversation = 20
+)
+
+// ErrScheduleNotFound is returned when deleting a schedule that doesn't exist
+var ErrScheduleNotFound = errors.New("schedule not found")
+
+// Schedule is a command run periodically on behalf of a conversation
+type Schedule struct {
+	ID             string `json:"id"`
+	ConversationID string `json:"conversation_id"`
+	Command        string `json:"command"`
+	WorkingDir     string `json:"working_dir"`
+	// Exactly one of IntervalSeconds and Cron is set
+	IntervalSeconds int64      `json:"interval_seconds,omitempty"`
+	Cron            string     `json:"cron,omitempty"`
+	NextRunAt       time.Time  `json:"next_run_at"`
+	LastRunAt       *time.Time `json:"last_run_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// nextRun returns when the schedule runs next after t
+func (s *Schedule) nextRun(t time.Time) (time.Time, error) {
+	if s.Cron == "" {
+		return t.Add(time.Duration(s.IntervalSeconds) * time.Second), nil
+	}
+	cron, err := parseCron(s.Cron)
+	if err != nil {
+		return time.Time{}, err
+	}
+	next := cron.next(t.Local())
+	if next.IsZero() {
+		return time.Time{}, fmt.Errorf("cron expression %q never matches", s.Cron)
+	}
+	return next.UTC(), nil
+}
+
+// ScheduleCommand registers command to run in dir for a conversation, every intervalSeconds
+// or on the cron expression cron, and returns the schedule
+func (e *ChatEngine) ScheduleCommand(conversationID, command, dir string, intervalSeconds int64, cron string) (*Schedule, error) {
+	if strings.TrimSpace(command) == "" {
+		return nil, fmt.Errorf("command is required")
+	}
+	switch {
+	case intervalSeconds == 0 && cron == "":
+		return nil, fmt.Errorf("either interval_seconds or cron is required")
+	case intervalSeconds != 0 && cron != "":
+		return nil, fmt.Errorf("interval_seconds and cron can't be used together")
+	case cron == "" && time.Duration(intervalSeconds)*time.Second < minScheduleInterval:
+		return nil, fmt.Errorf("interval_seconds must be at least %d", int(minScheduleInterval.Seconds()))
+	}
+
+	count, err := e.db.CountSchedules(conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if count >= maxSchedulesPerConversation {
+		return nil, fmt.Errorf("a conversation can have at most %d schedules", maxSchedulesPerConversation)
+	}
+
+	now := time.Now().UTC()
+	schedule := &Schedule{
+		ID:              fmt.Sprintf("sched_%d", now.UnixNano()),
+		ConversationID:  conversationID,
+		Command:         command,
+		WorkingDir:      dir,
+		IntervalSeconds: intervalSeconds,
+		Cron:            cron,
+		CreatedAt:       now,
+	}
+	if schedule.NextRunAt, err = schedule.nextRun(now); err != nil {
+		return nil, err
+	}
+	if err := e.db.SaveSchedule(schedule); err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+// ListSchedules returns the schedules of a conversation, or of all conversations when
+// conversationID is empty, oldest first
+func (e *ChatEngine) ListSchedules(conversationID string) ([]Schedule, error) {
+	return e.db.ListSchedules(conversationID)
+}
+
+// DeleteSchedule stops and deletes a schedule, returning ErrScheduleNotFound if there is none
+// with the ID. A run in progress completes.
+func (e *ChatEngine) DeleteSchedule(id string) error {
+	deleted, err := e.db.DeleteSchedule(id)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrScheduleNotFound
+	}
+	return nil
+}
+
+// startScheduler runs due schedules until Close
+func (e *ChatEngine) startScheduler() {
+	ctx, cancel := context.WithCancel(context.Background())
+	e.schedulerCancel = cancel
+	e.schedulerDone = make(chan struct{})
+
+	go func() {
+		defer close(e.schedulerDone)
+		ticker := time.NewTicker(schedulerTickInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				// Wait for the runs in progress, their commands are killed
+				e.scheduleRuns.Wait()
+				return
+			case now := <-ticker.C:
+				e.runDueSchedules(ctx, now.UTC())
+			}
+		}
+	}()
+}
+
+// stopScheduler stops the scheduler and waits for runs in progress to end
+func (e *ChatEngine) stopScheduler() {
+	if e.schedulerCancel == nil {
+		return
+	}
+	e.schedulerCancel()
+	<-e.schedulerDone
+}
+
+// runDueSchedules starts a run of every schedule due at now that isn't running already
+func (e *ChatEngine) runDueSchedules(ctx context.Context, now time.Time) {
+	schedules, err := e.db.ListSchedules("")
+	if err != nil {
+		slog.Error("Failed to load schedules", "error", err)
+		return
+	}
+
+	for _, schedule := range schedules {
+		if schedule.NextRunAt.After(now) {
+			continue
+		}
+
+		e.schedulesMutex.Lock()
+		running := e.runningSchedules[schedule.ID]
+		if !running {
+			e.runningSchedules[schedule.ID] = true
+		}
+		e.schedulesMutex.Unlock()
+		if running {
+			continue
+		}
+
+		next, err := schedule.nextRun(now)
+		if err == nil {
+			err = e.db.UpdateScheduleRun(schedule.ID, now, next)
+		}
+		if err != nil {
+			slog.Error("Failed to update schedule", "schedule_id", schedule.ID, "error", err)
+			e.endScheduleRun(schedule.ID)
+			continue
+		}
+
+		e.scheduleRuns.Add(1)
+		go func() {
+			defer e.scheduleRuns.Done()
+			defer e.endScheduleRun(schedule.ID)
+			e.runSchedule(ctx, schedule, now)
+		}()
+	}
+}
+
+// endScheduleRun marks the run of a schedule as over
+func (e *ChatEngine) endScheduleRun(id string) {
+	e.schedulesMutex.Lock()
+	delete(e.runningSchedules, id)
+	e.schedulesMutex.Unlock()
+}
+
+// runSchedule runs the command of a schedule and adds its output to the conversation
+func (e *ChatEngine) runSchedule(ctx context.Context, schedule Schedule, startedAt time.Time) {
+	logger := slog.With("schedule_id", schedule.ID, "conversation_id", schedule.ConversationID)
+
+	conv := e.GetConversation(schedule.ConversationID)
+	if conv == nil {
+		logger.Info("Deleting schedule of a conversation that no longer exists")
+		if _, err := e.db.DeleteSchedule(schedule.ID); err != nil {
+			logger.Error("Failed to delete schedule", "error", err)
+		}
+		return
+	}
+
+	audit := func(entry *CommandAuditEntry) {
+		entry.ConversationID = schedule.ConversationID
+		entry.Tool = "schedule_command"
+		if err := e.db.RecordCommand(entry); err != nil {
+			logger.Error("Failed to record command in audit log", "command", entry.Command, "error", err)
+		}
+	}
+	logger.Info("Running scheduled command", "command", schedule.Command)
+	output, err := executeBashCommand(ctx, schedule.Command, schedule.WorkingDir, "", e.envPolicy.environ(), e.commandTimeout, e.maxCommandOutputBytes, audit)
+	if err != nil {
+		logger.Warn("Scheduled command failed", "command", schedule.Command, "error", err)
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	// Wait for running turns to end, checking again whenever the scheduler ticks
+	for e.turnRunning(schedule.ConversationID) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(schedulerTickInterval):
+		}
+	}
+
+	msg := &Message{
+		ID:   fmt.Sprintf("msg_%d", time.Now().UnixNano()),
+		Role: "system",
+		Content: fmt.Sprintf("Scheduled command %s ran at %s:\n$ %s\n%s",
+			schedule.ID, startedAt.Format(time.RFC3339), schedule.Command, strings.TrimSuffix(output, "\n")),
+	}
+	if err := conv.AddMessageWithDB(msg, e.db); err != nil {
+		logger.Error("Failed to save scheduled command output", "error", err)
+	}
+}
+
+// SaveSchedule stores a new schedule
+func (d *DB) SaveSchedule(schedule *Schedule) error {
+	_, err := d.db.Exec(`
+		INSERT INTO schedules (id, conversation_id, command, working_dir, interval_seconds, cron, next_run_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, schedule.ID, schedule.ConversationID, schedule.Command, schedule.WorkingDir, schedule.IntervalSeconds,
+		schedule.Cron, schedule.NextRunAt.UTC(), schedule.CreatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to save schedule: %w", err)
+	}
+	return nil
+}
+
+// UpdateScheduleRun records that a schedule ran at lastRun and runs next at nextRun
+func (d *DB) UpdateScheduleRun(id string, lastRun, nextRun time.Time) error {
+	_, err := d.db.Exec(`UPDATE schedules SET last_run_at = ?, next_run_at = ? WHERE id = ?`, lastRun.UTC(), nextRun.UTC(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update schedule: %w", err)
+	}
+	return nil
+}
+
+// CountSchedules returns how many schedules a conversation has
+func (d *DB) CountSchedules(conversationID string) (int, error) {
+	var count int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM schedules WHERE conversation_id = ?`, conversationID).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count schedules: %w", err)
+	}
+	return count, nil
+}
+
+// ListSchedules returns the schedules of a conversation, or all of them when conversationID
+// is empty, oldest first
+func (d *DB) ListSchedules(conversationID string) ([]Schedule, error) {
+	query := `SELECT id, conversation_id, command, working_dir, interval_seconds, cron, next_run_at, last_run_at, created_at FROM schedules`
+	var args []interface{}
+	if conversationID != "" {
+		query += ` WHERE conversation_id = ?`
+		args = append(args, conversationID)
+	}
+	rows, err := d.db.Query(query+` ORDER BY created_at ASC, id ASC`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schedules: %w", err)
+	}
+	defer rows.Close()
+
+	schedules := make([]Schedule, 0)
+	for rows.Next() {
+		var schedule Schedule
+		var lastRunAt sql.NullTime
+		err := rows.Scan(&schedule.ID, &schedule.ConversationID, &schedule.Command, &schedule.WorkingDir,
+			&schedule.IntervalSeconds, &schedule.Cron, &schedule.NextRunAt, &lastRunAt, &schedule.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan schedule: %w", err)
+		}
+		if lastRunAt.Valid {
+			schedule.LastRunAt = &lastRunAt.Time
+		}
+		schedules = append(schedules, schedule)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating schedules: %w", err)
+	}
+	return schedules, nil
+}
+
+// DeleteSchedule deletes a schedule and reports whether it existed
+func (d *DB) DeleteSchedule(id string) (bool, error) {
+	result, err := d.db.Exec(`DELETE FROM schedules WHERE id = ?`, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete schedule: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete schedule: %w", err)
+	}
+	return deleted > 0, nil
+}
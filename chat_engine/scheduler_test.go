@@ -0,0 +1,110 @@
+package chat_engine
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runSchedulesAt runs the schedules due at now as the scheduler would, and waits for them
+func runSchedulesAt(engine *ChatEngine, now time.Time) {
+	engine.runDueSchedules(context.Background(), now)
+	engine.scheduleRuns.Wait()
+}
+
+func TestScheduleCommandToolRunsCommand(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider())
+	output := callTool(t, engine, "conv", "schedule_command", `{"command": "echo tick", "interval_seconds": 60}`)
+	if !strings.HasPrefix(output, "Scheduled sched_") {
+		t.Fatalf("schedule_command returned %q", output)
+	}
+	schedules, err := engine.ListSchedules("conv")
+	if err != nil || len(schedules) != 1 {
+		t.Fatalf("ListSchedules = %+v, %v, want the schedule", schedules, err)
+	}
+	schedule := schedules[0]
+	if schedule.WorkingDir != engine.WorkingDir("conv") || schedule.NextRunAt.Sub(schedule.CreatedAt) != time.Minute {
+		t.Errorf("schedule is %+v, want it to run in a minute in the working directory", schedule)
+	}
+
+	// Not due yet
+	runSchedulesAt(engine, schedule.NextRunAt.Add(-time.Second))
+	if n := len(engine.GetConversation("conv").Messages); n != 0 {
+		t.Errorf("schedule ran before it was due, the conversation has %d messages", n)
+	}
+
+	runAt := schedule.NextRunAt
+	runSchedulesAt(engine, runAt)
+	messages := engine.GetConversation("conv").Messages
+	if len(messages) != 1 || messages[0].Role != "system" || !strings.Contains(messages[0].Content, "$ echo tick\n") || !strings.HasSuffix(messages[0].Content, "--- stdout ---\ntick") {
+		t.Fatalf("conversation has %q, want the output of the run", messageContents(messages))
+	}
+
+	schedules, _ = engine.ListSchedules("conv")
+	if got := schedules[0]; got.LastRunAt == nil || !got.LastRunAt.Equal(runAt) || !got.NextRunAt.Equal(runAt.Add(time.Minute)) {
+		t.Errorf("after the run the schedule is %+v, want it to run again a minute later", got)
+	}
+}
+
+func TestScheduleCommandValidation(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider())
+	tests := map[string]string{
+		`{"command": "", "interval_seconds": 60}`:                            "command is required",
+		`{"command": "true"}`:                                                "either interval_seconds or cron is required",
+		`{"command": "true", "interval_seconds": 60, "cron": "* * * * *"}`:   "can't be used together",
+		`{"command": "true", "interval_seconds": 1}`:                         "interval_seconds must be at least 10",
+		`{"command": "true", "cron": "every minute"}`:                        "Error:",
+		`{"command": "true", "interval_seconds": 60, "working_dir": "/etc"}`: "invalid working_dir",
+	}
+	for args, want := range tests {
+		if output := callTool(t, engine, "conv", "schedule_command", args); !strings.Contains(output, want) {
+			t.Errorf("%s: output is %q, want %q", args, output, want)
+		}
+	}
+	if schedules, _ := engine.ListSchedules(""); len(schedules) != 0 {
+		t.Errorf("invalid calls created schedules %+v", schedules)
+	}
+}
+
+func TestSchedulesSurviveRestart(t *testing.T) {
+	provider := newFakeProvider()
+	engine := newTestEngine(t, provider)
+	engine.GetOrCreateConversation("conv")
+	schedule, err := engine.ScheduleCommand("conv", "date", engine.workspaceRoot, 0, "*/5 * * * *")
+	if err != nil {
+		t.Fatalf("ScheduleCommand: %v", err)
+	}
+
+	engine = reopenEngine(t, engine, provider)
+	schedules, err := engine.ListSchedules("")
+	if err != nil || len(schedules) != 1 || schedules[0].ID != schedule.ID || schedules[0].Cron != "*/5 * * * *" {
+		t.Fatalf("schedules after a restart are %+v, %v", schedules, err)
+	}
+
+	if err := engine.DeleteSchedule(schedule.ID); err != nil {
+		t.Fatalf("DeleteSchedule: %v", err)
+	}
+	if err := engine.DeleteSchedule(schedule.ID); !errors.Is(err, ErrScheduleNotFound) {
+		t.Errorf("deleting twice returned %v, want ErrScheduleNotFound", err)
+	}
+}
+
+func TestDeletingConversationDeletesSchedules(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider())
+	for _, id := range []string{"deleted", "kept"} {
+		engine.GetOrCreateConversation(id)
+		if _, err := engine.ScheduleCommand(id, "true", engine.workspaceRoot, 60, ""); err != nil {
+			t.Fatalf("ScheduleCommand: %v", err)
+		}
+	}
+
+	if err := engine.DeleteConversation("deleted"); err != nil {
+		t.Fatalf("DeleteConversation: %v", err)
+	}
+	schedules, err := engine.ListSchedules("")
+	if err != nil || len(schedules) != 1 || schedules[0].ConversationID != "kept" {
+		t.Errorf("schedules after deleting a conversation are %+v, %v, want only the other one's", schedules, err)
+	}
+}
@@ -0,0 +1,47 @@
+package chat_engine
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SearchResult is a message matching a search
+type SearchResult struct {
+	ConversationID string    `json:"conversation_id"`
+	MessageID      string    `json:"message_id"`
+	Role           string    `json:"role"`
+	Snippet        string    `json:"snippet"`
+	CreatedAt      time.Time `json:"created_at"`
+	// Score is the cosine similarity to the query of a semantic search
+	Score float64 `json:"score,omitempty"`
+}
+
+// isSearchable tells whether a message goes into the search index. Tool output and empty
+// assistant messages that only request tool calls are left out.
+func isSearchable(msg *Message) bool {
+	return (msg.Role == "user" || msg.Role == "assistant") && msg.Content != ""
+}
+
+// SearchMessages finds user and assistant messages across all conversations containing every
+// word of query, ignoring case. Words match as prefixes of longer words too.
+func (e *ChatEngine) SearchMessages(query string, limit int) ([]SearchResult, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive")
+	}
+	if strings.TrimSpace(query) == "" {
+		return nil, fmt.Errorf("search query is empty")
+	}
+	return e.db.SearchMessages(query, limit)
+}
+
+// ftsQuery turns free text into an FTS5 query matching all of its words. Each word is quoted
+// so that FTS5 operators and punctuation in the input are matched literally.
+func ftsQuery(text string) string {
+	words := strings.Fields(text)
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
@@ -0,0 +1,185 @@
+package chat_engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// defaultMaxSearchResults caps the matching lines search_code returns
+	defaultMaxSearchResults = 100
+	// searchMaxFileBytes skips files larger than this, they are rarely source code
+	searchMaxFileBytes = 2 * 1024 * 1024
+	// searchMaxLineLength cuts long matching lines, e.g. of minified files
+	searchMaxLineLength = 300
+)
+
+// searchSkipDirs are directories search_code doesn't descend into
+var searchSkipDirs = map[string]bool{
+	".git":         true,
+	".hg":          true,
+	".svn":         true,
+	"node_modules": true,
+	"vendor":       true,
+}
+
+// WithMaxSearchResults caps how many matching lines the search_code tool returns. A value of 0
+// disables the cap.
+func WithMaxSearchResults(n int) Option {
+	return func(e *ChatEngine) {
+		e.maxSearchResults = n
+	}
+}
+
+// codeSearch is a search_code call
+type codeSearch struct {
+	Pattern    string `json:"pattern"`
+	Path       string `json:"path"`
+	FileGlob   string `json:"file_glob"`
+	IgnoreCase bool   `json:"ignore_case"`
+}
+
+// searchCode finds lines matching the search's regular expression in the files under path
+// inside root and returns them as path:line:content, paths relative to dir. It stops after
+// maxResults matches. Binary files, large files, symlinks and VCS and dependency directories
+// are skipped.
+func searchCode(ctx context.Context, root, dir, path string, search codeSearch, maxResults int) (string, error) {
+	if search.Pattern == "" {
+		return "", fmt.Errorf("pattern is empty")
+	}
+	expr := search.Pattern
+	if search.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return "", fmt.Errorf("invalid pattern: %w", err)
+	}
+	if search.FileGlob != "" {
+		if _, err := filepath.Match(search.FileGlob, ""); err != nil {
+			return "", fmt.Errorf("invalid file_glob: %w", err)
+		}
+	}
+
+	start, err := resolveWorkspacePath(root, path)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(start); err != nil {
+		return "", fmt.Errorf("path %s does not exist", search.Path)
+	}
+
+	var out strings.Builder
+	matches := 0
+	limitReached := false
+	err = filepath.WalkDir(start, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable entries are skipped
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d.IsDir() {
+			if file != start && searchSkipDirs[d.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !matchesFileGlob(search.FileGlob, start, file) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			rel = file
+		}
+		// Files that can't be read are skipped, keeping matches found before an error
+		n, _ := searchFile(file, rel, re, maxResults-matches, &out)
+		matches += n
+		if maxResults > 0 && matches >= maxResults {
+			limitReached = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if matches == 0 {
+		return fmt.Sprintf("No matches for %q", search.Pattern), nil
+	}
+	if limitReached {
+		fmt.Fprintf(&out, "[stopped at the limit of %d matches, there may be more; narrow the pattern, path or file_glob]", maxResults)
+	}
+	return strings.TrimRight(out.String(), "\n"), nil
+}
+
+// matchesFileGlob reports whether a file is selected by glob, matched against its name or,
+// for globs with a slash, against its path relative to the search path
+func matchesFileGlob(glob, start, file string) bool {
+	if glob == "" {
+		return true
+	}
+	name := filepath.Base(file)
+	if strings.Contains(glob, "/") {
+		rel, err := filepath.Rel(start, file)
+		if err != nil {
+			return false
+		}
+		name = filepath.ToSlash(rel)
+	}
+	matched, _ := filepath.Match(glob, name)
+	return matched
+}
+
+// searchFile writes the lines of file matching re to out, at most limit of them unless limit
+// is not positive, and returns how many it wrote
+func searchFile(file, displayPath string, re *regexp.Regexp, limit int, out *strings.Builder) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.Size() > searchMaxFileBytes {
+		return 0, err
+	}
+
+	reader := bufio.NewReader(f)
+	head, _ := reader.Peek(8000)
+	if bytes.IndexByte(head, 0) != -1 {
+		return 0, nil
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), searchMaxFileBytes)
+	matches := 0
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if !re.MatchString(line) {
+			continue
+		}
+		line = strings.TrimRight(line, "\r")
+		if len(line) > searchMaxLineLength {
+			line = strings.ToValidUTF8(line[:searchMaxLineLength], "") + "..."
+		}
+		fmt.Fprintf(out, "%s:%d:%s\n", filepath.ToSlash(displayPath), lineNumber, line)
+		matches++
+		if limit > 0 && matches >= limit {
+			break
+		}
+	}
+	return matches, scanner.Err()
+}
@@ -0,0 +1,93 @@
+package chat_engine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles creates files under root, with their directories
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSearchCodeTool(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")))
+	writeFiles(t, engine.workspaceRoot, map[string]string{
+		"main.go":                   "package main\n\nfunc main() {\n\trun()\n}\n",
+		"cmd/run.go":                "package main\n\nfunc run() {}\n",
+		"README.md":                 "Call run() to start.\n",
+		"node_modules/lib/index.js": "function run() {}\n",
+		".git/config":               "func run\n",
+		"image.bin":                 "func run()\x00\x01",
+	})
+
+	output := callTool(t, engine, "conv", "search_code", `{"pattern": "func \\w+\\(\\)"}`)
+	want := "cmd/run.go:3:func run() {}\nmain.go:3:func main() {"
+	if output != want {
+		t.Errorf("output is\n%s\nwant\n%s", output, want)
+	}
+}
+
+func TestSearchCodeToolFilters(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")))
+	writeFiles(t, engine.workspaceRoot, map[string]string{
+		"main.go":     "// TODO: handle errors\n",
+		"notes.txt":   "todo: write docs\n",
+		"pkg/a/a.go":  "// TODO: a\n",
+		"pkg/b/b.go":  "// TODO: b\n",
+		"pkg/b/b.txt": "TODO: b notes\n",
+	})
+
+	tests := []struct {
+		args string
+		want string
+	}{
+		{`{"pattern": "todo", "ignore_case": true, "file_glob": "*.txt"}`, "notes.txt:1:todo: write docs\npkg/b/b.txt:1:TODO: b notes"},
+		{`{"pattern": "TODO", "path": "pkg/b"}`, "pkg/b/b.go:1:// TODO: b\npkg/b/b.txt:1:TODO: b notes"},
+		{`{"pattern": "TODO", "path": "pkg", "file_glob": "a/*.go"}`, "pkg/a/a.go:1:// TODO: a"},
+		{`{"pattern": "FIXME"}`, `No matches for "FIXME"`},
+	}
+	for _, tt := range tests {
+		if output := callTool(t, engine, "conv", "search_code", tt.args); output != tt.want {
+			t.Errorf("%s: output is\n%s\nwant\n%s", tt.args, output, tt.want)
+		}
+	}
+}
+
+func TestSearchCodeToolLimitsResults(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")), WithMaxSearchResults(2))
+	writeFiles(t, engine.workspaceRoot, map[string]string{"log.txt": "match\nmatch\nmatch\n"})
+
+	output := callTool(t, engine, "conv", "search_code", `{"pattern": "match"}`)
+	if !strings.HasPrefix(output, "log.txt:1:match\nlog.txt:2:match\n[stopped at the limit of 2 matches") {
+		t.Errorf("output is %q, want two matches and the limit", output)
+	}
+}
+
+func TestSearchCodeToolRejectsInvalidSearches(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")))
+
+	tests := map[string]string{
+		`{"pattern": ""}`:                     "pattern is empty",
+		`{"pattern": "("}`:                    "invalid pattern",
+		`{"pattern": "x", "file_glob": "["}`:  "invalid file_glob",
+		`{"pattern": "x", "path": "missing"}`: "does not exist",
+		`{"pattern": "x", "path": "/etc"}`:    "outside the working directory",
+	}
+	for args, want := range tests {
+		if output := callTool(t, engine, "conv", "search_code", args); !strings.Contains(output, want) {
+			t.Errorf("%s: output is %q, want %q", args, output, want)
+		}
+	}
+}
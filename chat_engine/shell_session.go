@@ -0,0 +1,164 @@
+package chat_engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shellSession is a long-lived bash process that keeps state (working directory, exported
+// variables, activated virtualenvs, ...) between commands of a conversation.
+//
+// The shell reads commands from a pipe rather than a pty, so programs that require a
+// terminal won't behave interactively. Each command's stdin is /dev/null.
+type shellSession struct {
+	// mu serializes commands, fields below are only used while holding it
+	mu sync.Mutex
+
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	output  chan []byte
+	pending []byte
+	marker  string
+	exited  bool
+}
+
+func startShellSession(dir string, env []string) (*shellSession, error) {
+	markerBytes := make([]byte, 8)
+	if _, err := rand.Read(markerBytes); err != nil {
+		return nil, fmt.Errorf("failed to generate session marker: %w", err)
+	}
+
+	cmd := exec.Command("bash", "--noprofile", "--norc")
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdin pipe: %w", err)
+	}
+	outputReader, outputWriter, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output pipe: %w", err)
+	}
+	cmd.Stdout = outputWriter
+	cmd.Stderr = outputWriter
+
+	if err := cmd.Start(); err != nil {
+		outputReader.Close()
+		outputWriter.Close()
+		return nil, fmt.Errorf("failed to start shell: %w", err)
+	}
+	outputWriter.Close()
+
+	session := &shellSession{
+		cmd:    cmd,
+		stdin:  stdin,
+		output: make(chan []byte, 64),
+		marker: "__AGENT_SHELL_DONE_" + hex.EncodeToString(markerBytes) + "__",
+	}
+
+	go func() {
+		defer outputReader.Close()
+		defer close(session.output)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := outputReader.Read(buf)
+			if n > 0 {
+				chunk := make([]byte, n)
+				copy(chunk, buf[:n])
+				session.output <- chunk
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go cmd.Wait()
+
+	slog.Info("Started shell session", "pid", cmd.Process.Pid, "dir", dir)
+	return session, nil
+}
+
+// run executes command in the session and returns its combined output and exit code.
+// If the command doesn't finish within timeout, ctx is canceled or the shell exits, the
+// session is closed, killing the command, and must not be reused. A timeout of 0 waits for
+// the command indefinitely.
+func (s *shellSession) run(ctx context.Context, command string, timeout time.Duration) (string, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.exited {
+		return "", -1, fmt.Errorf("shell session is closed")
+	}
+
+	// Braces keep cd/export in the current shell, the marker frames this command's output
+	script := fmt.Sprintf("{\n%s\n} </dev/null\nprintf '\\n%s %%d\\n' \"$?\"\n", command, s.marker)
+	if _, err := io.WriteString(s.stdin, script); err != nil {
+		s.close()
+		return "", -1, fmt.Errorf("shell session is no longer running: %w", err)
+	}
+
+	// A nil channel never fires, for no timeout
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	buf := s.pending
+	s.pending = nil
+	for {
+		if idx := bytes.Index(buf, []byte("\n"+s.marker+" ")); idx != -1 {
+			rest := buf[idx+len(s.marker)+2:]
+			end := bytes.IndexByte(rest, '\n')
+			if end != -1 {
+				exitCode, _ := strconv.Atoi(strings.TrimSpace(string(rest[:end])))
+				s.pending = rest[end+1:]
+				return string(buf[:idx]), exitCode, nil
+			}
+		}
+
+		select {
+		case chunk, ok := <-s.output:
+			if !ok {
+				s.close()
+				return string(buf), -1, fmt.Errorf("shell exited")
+			}
+			buf = append(buf, chunk...)
+		case <-expired:
+			s.close()
+			return string(buf), -1, fmt.Errorf("command timed out after %s, the shell session was reset", timeout)
+		case <-ctx.Done():
+			s.close()
+			return string(buf), -1, fmt.Errorf("command was canceled, the shell session was reset")
+		}
+	}
+}
+
+// close marks the session as unusable and kills it, the caller must hold mu
+func (s *shellSession) close() {
+	s.exited = true
+	s.terminate()
+}
+
+// terminate kills the shell and everything it started. A command running at the time
+// returns with an error.
+func (s *shellSession) terminate() {
+	syscall.Kill(-s.cmd.Process.Pid, syscall.SIGKILL)
+	slog.Info("Closed shell session", "pid", s.cmd.Process.Pid)
+}
@@ -0,0 +1,162 @@
+package chat_engine
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShellWithoutCommandTimeout(t *testing.T) {
+	provider := newFakeProvider(
+		toolCallReply("call_1", "shell", `{"command": "mkdir sub && cd sub && sleep 0.2 && echo first"}`),
+		toolCallReply("call_2", "shell", `{"command": "pwd"}`),
+		textReply("done"),
+	)
+	// A timeout of 0 disables it
+	engine := newTestEngine(t, provider, WithCommandTimeout(0))
+
+	messages, err := engine.SendUserMessage("conv", "run")
+	if err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	var outputs []string
+	for _, msg := range messages {
+		if msg.Role == "tool" {
+			outputs = append(outputs, msg.Content)
+		}
+	}
+	if len(outputs) != 2 {
+		t.Fatalf("got %d tool outputs, want 2", len(outputs))
+	}
+	if want := "first\n\n[exit code: 0]"; outputs[0] != want {
+		t.Errorf("first command returned %q, want %q", outputs[0], want)
+	}
+	// The session wasn't reset, so the directory change persisted
+	if !strings.HasPrefix(outputs[1], filepath.Join(engine.workspaceRoot, "sub")+"\n") {
+		t.Errorf("pwd returned %q, want the sub directory", outputs[1])
+	}
+}
+
+func TestShellSessionTimeout(t *testing.T) {
+	dir := t.TempDir()
+	pm := NewProcessManager(nil)
+	t.Cleanup(pm.closeAllShells)
+
+	start := time.Now()
+	_, _, err := pm.RunInShell(t.Context(), "conv", dir, "sleep 5", 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("got error %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("timed out after %s, want about 100ms", elapsed)
+	}
+
+	// The next command gets a fresh session
+	output, exitCode, err := pm.RunInShell(t.Context(), "conv", dir, "echo again", 0)
+	if err != nil || exitCode != 0 || output != "again\n" {
+		t.Errorf("got %q, %d, %v after the timeout, want the command to run", output, exitCode, err)
+	}
+}
+
+func TestExecuteBashCommandWithoutTimeout(t *testing.T) {
+	noAudit := func(*CommandAuditEntry) {}
+	output, err := executeBashCommand(t.Context(), "sleep 0.2 && echo finished", t.TempDir(), "", os.Environ(), 0, 0, noAudit)
+	if err != nil {
+		t.Fatalf("executeBashCommand: %v", err)
+	}
+	if !strings.Contains(output, "finished") || strings.Contains(output, "timed out") {
+		t.Errorf("got %q, want the command to finish", output)
+	}
+
+	output, err = executeBashCommand(t.Context(), "sleep 5", t.TempDir(), "", os.Environ(), 100*time.Millisecond, 0, noAudit)
+	if err == nil || !strings.Contains(output, "timed out after 100ms") {
+		t.Errorf("got %q, %v, want a timeout", output, err)
+	}
+}
+
+func TestCancelTurnKillsShellCommand(t *testing.T) {
+	provider := newFakeProvider(
+		toolCallReply("call_1", "shell", `{"command": "sleep 30"}`),
+		textReply("done"),
+	)
+	engine := newTestEngine(t, provider, WithCommandTimeout(0))
+
+	started := make(chan struct{})
+	go func() {
+		<-started
+		// Give the shell time to start sleeping
+		time.Sleep(200 * time.Millisecond)
+		if err := engine.CancelTurn("conv", false); err != nil {
+			t.Errorf("CancelTurn: %v", err)
+		}
+	}()
+
+	start := time.Now()
+	messages, err := engine.SendUserMessageWithOptions("conv", "sleep", SendOptions{
+		OnToolStart: func(ToolCall) { close(started) },
+	})
+	if !errors.Is(err, ErrTurnCanceled) {
+		t.Fatalf("SendUserMessageWithOptions returned %v, want ErrTurnCanceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("turn took %s, the command wasn't killed", elapsed)
+	}
+	last := messages[len(messages)-1]
+	if last.Role != "tool" || !strings.Contains(last.Content, "command was canceled") {
+		t.Errorf("last message is %s %q, want the canceled command", last.Role, last.Content)
+	}
+
+	// The next command runs in a fresh session
+	output, exitCode, err := engine.processManager.RunInShell(t.Context(), "conv", t.TempDir(), "echo again", 0)
+	if err != nil || exitCode != 0 || !strings.Contains(output, "again") {
+		t.Errorf("next command returned %q, %d, %v, want it to run", output, exitCode, err)
+	}
+}
+
+func TestShellSessionKeepsState(t *testing.T) {
+	dir := t.TempDir()
+	pm := newTestProcessManager(t)
+	run := func(conversationID, command string) string {
+		t.Helper()
+		output, exitCode, err := pm.RunInShell(t.Context(), conversationID, dir, command, 10*time.Second)
+		if err != nil || exitCode != 0 {
+			t.Fatalf("%s: got %q, %d, %v", command, output, exitCode, err)
+		}
+		return output
+	}
+
+	run("conv", "mkdir -p sub && cd sub")
+	run("conv", "export GREETING=hello")
+	run("conv", "shout() { echo \"$1!\"; }")
+	if got, want := run("conv", "pwd"), filepath.Join(dir, "sub")+"\n"; got != want {
+		t.Errorf("pwd = %q, want %q", got, want)
+	}
+	if got := run("conv", `echo "$GREETING"`); got != "hello\n" {
+		t.Errorf("exported variable = %q, want hello", got)
+	}
+	if got := run("conv", "shout hey"); got != "hey!\n" {
+		t.Errorf("function output = %q, want hey!", got)
+	}
+
+	// Other conversations have their own session
+	if got := run("other", `echo "[$GREETING]" && pwd`); got != "[]\n"+dir+"\n" {
+		t.Errorf("other conversation got %q, want a fresh session", got)
+	}
+
+	// A failing command doesn't end the session
+	if _, exitCode, err := pm.RunInShell(t.Context(), "conv", dir, "false", 10*time.Second); err != nil || exitCode != 1 {
+		t.Errorf("false returned exit code %d, %v, want 1", exitCode, err)
+	}
+	if got := run("conv", `echo "$GREETING"`); got != "hello\n" {
+		t.Errorf("after a failing command the variable is %q, want hello", got)
+	}
+
+	// Closing the session starts over
+	pm.CloseShell("conv")
+	if got := run("conv", `echo "[$GREETING]"`); got != "[]\n" {
+		t.Errorf("after CloseShell the variable is %q, want it unset", got)
+	}
+}
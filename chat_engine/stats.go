@@ -0,0 +1,125 @@
+package chat_engine
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// ConversationStats are aggregates over the stored history of a conversation
+type ConversationStats struct {
+	ConversationID string `json:"conversation_id"`
+	MessageCount   int64  `json:"message_count"`
+	// Message limit of the conversation, see WithMaxConversationMessages. Unset without a limit.
+	MaxMessages int `json:"max_messages,omitempty"`
+	// Number of messages per role
+	MessagesByRole map[string]int64 `json:"messages_by_role"`
+	// Number of tool calls per tool name
+	ToolCallsByName  map[string]int64 `json:"tool_calls_by_name"`
+	PromptTokens     int64            `json:"prompt_tokens"`
+	CompletionTokens int64            `json:"completion_tokens"`
+	TotalTokens      int64            `json:"total_tokens"`
+	// Unset while the conversation has no messages
+	FirstMessageAt *time.Time `json:"first_message_at,omitempty"`
+	LastMessageAt  *time.Time `json:"last_message_at,omitempty"`
+	// Background processes started by the conversation, from the command audit log
+	BackgroundProcesses int64 `json:"background_processes"`
+}
+
+// ConversationStats returns aggregates over the history of a conversation
+func (e *ChatEngine) ConversationStats(conversationID string) (*ConversationStats, error) {
+	stats, err := e.db.ConversationStats(conversationID)
+	if err != nil {
+		return nil, err
+	}
+	stats.MaxMessages = e.maxConversationMessages
+	return stats, nil
+}
+
+// ConversationStats aggregates the messages, tool calls, token usage and background
+// processes of a conversation
+func (d *DB) ConversationStats(conversationID string) (*ConversationStats, error) {
+	stats := &ConversationStats{
+		ConversationID:  conversationID,
+		MessagesByRole:  make(map[string]int64),
+		ToolCallsByName: make(map[string]int64),
+	}
+
+	rows, err := d.db.Query(`
+		SELECT role, COUNT(*), SUM(prompt_tokens), SUM(completion_tokens)
+		FROM messages WHERE conversation_id = ?
+		GROUP BY role
+	`, conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query message stats: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var role string
+		var count, promptTokens, completionTokens int64
+		if err := rows.Scan(&role, &count, &promptTokens, &completionTokens); err != nil {
+			return nil, fmt.Errorf("failed to scan message stats: %w", err)
+		}
+		stats.MessagesByRole[role] = count
+		stats.MessageCount += count
+		stats.PromptTokens += promptTokens
+		stats.CompletionTokens += completionTokens
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating message stats: %w", err)
+	}
+	stats.TotalTokens = stats.PromptTokens + stats.CompletionTokens
+
+	toolRows, err := d.db.Query(`
+		SELECT tc.name, COUNT(*)
+		FROM tool_calls tc JOIN messages m ON m.id = tc.message_id
+		WHERE m.conversation_id = ?
+		GROUP BY tc.name
+	`, conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tool call stats: %w", err)
+	}
+	defer toolRows.Close()
+	for toolRows.Next() {
+		var name string
+		var count int64
+		if err := toolRows.Scan(&name, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan tool call stats: %w", err)
+		}
+		stats.ToolCallsByName[name] = count
+	}
+	if err := toolRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating tool call stats: %w", err)
+	}
+
+	// Aggregates lose the column type, so the bounds are read as rows to get times
+	for _, bound := range []struct {
+		order string
+		dest  **time.Time
+	}{
+		{"ASC", &stats.FirstMessageAt},
+		{"DESC", &stats.LastMessageAt},
+	} {
+		var createdAt time.Time
+		err := d.db.QueryRow(`
+			SELECT created_at FROM messages WHERE conversation_id = ?
+			ORDER BY created_at `+bound.order+`, rowid `+bound.order+` LIMIT 1
+		`, conversationID).Scan(&createdAt)
+		if err == sql.ErrNoRows {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to query message times: %w", err)
+		}
+		*bound.dest = &createdAt
+	}
+
+	err = d.db.QueryRow(`
+		SELECT COUNT(*) FROM command_audit WHERE conversation_id = ? AND background = 1 AND pid != 0
+	`, conversationID).Scan(&stats.BackgroundProcesses)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count background processes: %w", err)
+	}
+
+	return stats, nil
+}
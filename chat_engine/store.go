@@ -0,0 +1,97 @@
+package chat_engine
+
+import (
+	"context"
+	"time"
+)
+
+// Store persists conversations and their messages. DB keeps them in SQLite, the default, and
+// PostgresDB in PostgreSQL; WithDatabaseURL selects one of them.
+type Store interface {
+	SaveConversation(conv *Conversation) error
+	// LoadConversation returns nil without an error if the conversation doesn't exist
+	LoadConversation(conversationID string) (*Conversation, error)
+	ListConversationSummaries(limit, offset int, tag string) ([]ConversationSummary, int, error)
+	DeleteConversation(conversationID string) error
+	ClearConversationMessages(conversationID string) error
+	UpdateConversationTitle(conversationID, title string) error
+	UpdateConversationSystemPrompt(conversationID, prompt string) error
+	UpdateConversationWebhookURL(conversationID, webhookURL string) error
+	IncrementToolCallCount(conversationID string) error
+	ConversationStats(conversationID string) (*ConversationStats, error)
+	AddConversationTag(conversationID, tag string) error
+	RemoveConversationTag(conversationID, tag string) (bool, error)
+	// CopyConversation copies a conversation, up to and including throughMessageID unless it
+	// is empty, into a new conversation with the parent parentID
+	CopyConversation(sourceID, targetID, throughMessageID, parentID string) error
+	// ImportConversation creates conv with all its messages, failing if it already exists
+	ImportConversation(conv *Conversation) error
+
+	SaveMessage(conversationID string, msg *Message) error
+	SaveMessages(conversationID string, msgs []*Message) error
+	UpdateMessage(conversationID string, msg *Message) error
+	DeleteMessages(conversationID string, messageIDs []string) error
+	CompactMessages(conversationID string, messageIDs []string, summary *Message) error
+	LoadConversationMessages(conversationID string, limit, offset int) ([]*Message, error)
+	// LoadMessagesAfter returns the messages saved after messageID, ErrMessageNotFound if the
+	// conversation has no such message
+	LoadMessagesAfter(conversationID, messageID string) ([]*Message, error)
+	CountMessages(conversationID string) (int, error)
+	// SearchMessages finds user and assistant messages containing every word of query as a
+	// prefix, ignoring case, best matches first
+	SearchMessages(query string, limit int) ([]SearchResult, error)
+
+	Close() error
+}
+
+// ProcessStore records running background processes so they can be found again after a
+// restart, see ProcessManager.ReapOrphans
+type ProcessStore interface {
+	SaveProcess(info *ProcessInfo) error
+	DeleteProcess(pid int) error
+	DeleteAllProcesses() error
+	ListProcesses() ([]*ProcessInfo, error)
+	// FinishAuditedCommand records how a background command of the audit log ended
+	FinishAuditedCommand(id int64, exitCode int, duration time.Duration) error
+}
+
+// embeddingStore keeps the embeddings of messages for semantic search. Messages are embedded
+// in the background, see embedPendingMessages.
+type embeddingStore interface {
+	messagesWithoutEmbedding(limit int) ([]pendingEmbedding, error)
+	SaveEmbedding(messageID, conversationID string, vector []float32) error
+	NearestMessages(vector []float32, limit int) ([]SearchResult, error)
+}
+
+// memoryStore keeps the facts remembered across conversations, see the memory tool
+type memoryStore interface {
+	SaveMemory(namespace, key, value string) (*Memory, error)
+	Memories(namespace, query string, limit int) ([]Memory, error)
+	DeleteMemory(namespace, key string) (bool, error)
+}
+
+// scheduleStore keeps the commands of the schedule_command tool
+type scheduleStore interface {
+	SaveSchedule(schedule *Schedule) error
+	UpdateScheduleRun(id string, lastRun, nextRun time.Time) error
+	CountSchedules(conversationID string) (int, error)
+	ListSchedules(conversationID string) ([]Schedule, error)
+	DeleteSchedule(id string) (bool, error)
+}
+
+// engineStore is everything the engine keeps in its database
+type engineStore interface {
+	Store
+	ProcessStore
+	embeddingStore
+	memoryStore
+	scheduleStore
+
+	// Ping checks that the database answers queries
+	Ping(ctx context.Context) error
+	// Vacuum reclaims the space of deleted rows
+	Vacuum(ctx context.Context, opts VacuumOptions) (*VacuumResult, error)
+	UsageByDay(from, to time.Time) ([]usageRow, error)
+	RecordCommand(entry *CommandAuditEntry) error
+	ListCommandAudit(conversationID string, limit, offset int) ([]CommandAuditEntry, int, error)
+}
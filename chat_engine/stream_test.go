@@ -0,0 +1,58 @@
+package chat_engine
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestTurnEventOrder(t *testing.T) {
+	tool := &countingTool{name: "count"}
+	first := toolCallReply("call_1", "count", `{"n": 1}`)
+	first.Content = "counting twice"
+	first.ToolCalls = append(first.ToolCalls, ToolCall{ID: "call_2", Type: "function", Name: "count", Arguments: `{"n": 2}`})
+	provider := newFakeProvider(first, textReply("counted both"))
+	engine := newTestEngine(t, provider, WithTool(tool))
+
+	var mutex sync.Mutex
+	var events []string
+	record := func(event string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, event)
+	}
+	_, err := engine.SendUserMessageWithOptions("conv", "count", SendOptions{
+		OnDelta:     func(content string) { record("delta " + content) },
+		OnToolStart: func(toolCall ToolCall) { record("tool_start " + toolCall.ID) },
+		Callback: func(msg *Message) {
+			switch {
+			case msg.Role == "tool":
+				record("tool_output " + msg.TollCallID)
+			case len(msg.ToolCalls) > 0:
+				record("tool_calls " + msg.Content)
+			default:
+				record(msg.Role + " " + msg.Content)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("SendUserMessageWithOptions: %v", err)
+	}
+
+	want := []string{
+		"user count",
+		"delta counting ",
+		"delta twice",
+		"tool_calls counting twice",
+		"tool_start call_1",
+		"tool_output call_1",
+		"tool_start call_2",
+		"tool_output call_2",
+		"delta counted ",
+		"delta both",
+		"assistant counted both",
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got events\n%q\nwant\n%q", events, want)
+	}
+}
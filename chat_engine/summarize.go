@@ -0,0 +1,121 @@
+package chat_engine
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const (
+	// summaryKeepTurns is how many of the latest turns are kept verbatim when summarizing
+	summaryKeepTurns = 3
+
+	summaryInstruction = "Summarize the conversation above for your own future reference. Keep the user's goals, " +
+		"decisions that were made, facts learned about files, commands and their results, and any open tasks. " +
+		"Reply with the summary only."
+)
+
+// WithAutoSummarize makes the engine condense the oldest messages of a conversation into a
+// summary once its history exceeds threshold estimated tokens, keeping the latest turns
+// verbatim. The summary replaces the messages it covers, also in the database. A threshold
+// of 0 disables summarizing.
+func WithAutoSummarize(threshold int) Option {
+	return func(e *ChatEngine) {
+		e.summarizeThreshold = threshold
+	}
+}
+
+// summarizeIfNeeded summarizes the oldest messages of conv when auto-summarizing is enabled and
+// the conversation exceeds the threshold. Failing to summarize is logged and the history is
+// left as it is, so is canceling the turn, which cancels ctx.
+func (e *ChatEngine) summarizeIfNeeded(ctx context.Context, conv *Conversation, logger *slog.Logger) {
+	if e.summarizeThreshold <= 0 {
+		return
+	}
+
+	e.conversationsMutex.RLock()
+	messages := append([]*Message(nil), conv.Messages...)
+	e.conversationsMutex.RUnlock()
+
+	total := 0
+	for _, msg := range conv.modelMessages() {
+		total += EstimateTokens(msg)
+	}
+	if total <= e.summarizeThreshold {
+		return
+	}
+
+	count := summaryCutoff(messages)
+	// Nothing to gain from summarizing a single message, e.g. an earlier summary
+	if count < 2 {
+		return
+	}
+
+	logger.Info("Summarizing old messages", "messages", count, "estimated_tokens", total)
+	// The summary replaces stored messages, so those of the turn have to be stored first
+	e.saveTurnMessages(conv, logger)
+	if err := e.summarize(ctx, conv, messages[:count]); err != nil {
+		logger.Warn("Failed to summarize old messages", "error", err)
+	}
+}
+
+// summaryCutoff returns how many of the oldest messages may be summarized: all before the
+// summaryKeepTurns latest turns. As turns start with a user message, a tool call is never
+// separated from its responses.
+func summaryCutoff(messages []*Message) int {
+	turns := 0
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			turns++
+			if turns == summaryKeepTurns {
+				return i
+			}
+		}
+	}
+	return 0
+}
+
+// summarize asks the model to condense old, the oldest messages of conv, and replaces them
+// with a summary message. The summary is written by the model of the turns.
+func (e *ChatEngine) summarize(ctx context.Context, conv *Conversation, old []*Message) error {
+	request := make([]*Message, 0, len(old)+1)
+	request = append(request, old...)
+	request = append(request, &Message{Role: "system", Content: summaryInstruction})
+
+	response, err := e.complete(ctx, CompletionRequest{Messages: request, Model: e.model, Sampling: e.sampling})
+	if err != nil {
+		return err
+	}
+	content := strings.TrimSpace(response.Content)
+	if content == "" {
+		return fmt.Errorf("model returned an empty summary")
+	}
+
+	summary := &Message{
+		ID:      fmt.Sprintf("msg_%d", time.Now().UnixNano()),
+		Role:    "summary",
+		Content: content,
+		Model:   response.Model,
+		Usage:   response.Usage,
+		// Ordered before the messages that are kept
+		CreatedAt: old[0].CreatedAt.Add(-time.Millisecond),
+	}
+
+	ids := make([]string, len(old))
+	for i, msg := range old {
+		ids[i] = msg.ID
+	}
+	if !conv.ephemeral {
+		if err := e.db.CompactMessages(conv.ID, ids, summary); err != nil {
+			return err
+		}
+	}
+
+	e.conversationsMutex.Lock()
+	defer e.conversationsMutex.Unlock()
+	// Messages are only ever appended during a turn, so the summarized ones are still first
+	conv.Messages = append([]*Message{summary}, conv.Messages[len(old):]...)
+	return nil
+}
@@ -0,0 +1,91 @@
+package chat_engine
+
+import "testing"
+
+// summarizingProvider replies to summary requests with summary and to everything else with reply
+func summarizingProvider(summary, reply string) *fakeProvider {
+	return &fakeProvider{
+		reply: func(n int, req CompletionRequest) (*Message, error) {
+			if last := req.Messages[len(req.Messages)-1]; last.Role == "system" && last.Content == summaryInstruction {
+				return textReply(summary), nil
+			}
+			return textReply(reply), nil
+		},
+	}
+}
+
+func TestAutoSummarizeCompactsHistory(t *testing.T) {
+	provider := summarizingProvider("the user said hello", "ok")
+	engine := newTestEngine(t, provider, WithAutoSummarize(1), WithModel("chosen-model"))
+
+	// Every turn exceeds the threshold, but nothing is summarized before there are more turns
+	// than are kept verbatim
+	for _, content := range []string{"first", "second", "third"} {
+		if _, err := engine.SendUserMessage("conv", content); err != nil {
+			t.Fatalf("SendUserMessage: %v", err)
+		}
+	}
+	if got := len(provider.Requests()); got != 3 {
+		t.Fatalf("model was asked %d times for three turns, want 3", got)
+	}
+
+	if _, err := engine.SendUserMessage("conv", "fourth"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	requests := provider.Requests()
+	if len(requests) != 5 {
+		t.Fatalf("model was asked %d times, want 5 with the summary", len(requests))
+	}
+	summaryRequest := requests[3]
+	if summaryRequest.Model != "chosen-model" {
+		t.Errorf("summary was requested from model %q, want chosen-model", summaryRequest.Model)
+	}
+	// The first turn and the instruction
+	if len(summaryRequest.Messages) != 3 || summaryRequest.Messages[0].Content != "first" {
+		t.Errorf("summary request has %d messages, want the first turn and the instruction", len(summaryRequest.Messages))
+	}
+
+	// The summary replaces the first turn in memory, in the database and in what the model gets
+	want := []string{"the user said hello", "second", "ok", "third", "ok", "fourth", "ok"}
+	stored, err := engine.db.LoadConversation("conv")
+	if err != nil {
+		t.Fatalf("LoadConversation: %v", err)
+	}
+	for name, messages := range map[string][]*Message{
+		"memory":   engine.GetConversation("conv").Messages,
+		"database": stored.Messages,
+	} {
+		if len(messages) != len(want) {
+			t.Errorf("%s has %d messages, want %d", name, len(messages), len(want))
+			continue
+		}
+		if messages[0].Role != "summary" {
+			t.Errorf("first message in %s is a %s message, want the summary", name, messages[0].Role)
+		}
+		for i, msg := range messages {
+			if msg.Content != want[i] {
+				t.Errorf("message %d in %s is %q, want %q", i, name, msg.Content, want[i])
+			}
+		}
+	}
+	if first := requests[4].Messages[0]; first.Role != "summary" {
+		t.Errorf("turn after summarizing starts with a %s message, want the summary", first.Role)
+	}
+}
+
+func TestAutoSummarizeBelowThreshold(t *testing.T) {
+	provider := summarizingProvider("summary", "ok")
+	engine := newTestEngine(t, provider, WithAutoSummarize(1_000_000))
+
+	for _, content := range []string{"first", "second", "third", "fourth"} {
+		if _, err := engine.SendUserMessage("conv", content); err != nil {
+			t.Fatalf("SendUserMessage: %v", err)
+		}
+	}
+	if got := len(provider.Requests()); got != 4 {
+		t.Errorf("model was asked %d times, want 4 without a summary", got)
+	}
+	if got := len(engine.GetConversation("conv").Messages); got != 8 {
+		t.Errorf("conversation has %d messages, want all 8", got)
+	}
+}
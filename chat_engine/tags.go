@@ -0,0 +1,95 @@
+package chat_engine
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ErrTagNotFound is returned when removing a tag the conversation doesn't have
+var ErrTagNotFound = errors.New("conversation does not have this tag")
+
+// validTag is what tags look like once normalized: lowercase letters, digits and a few
+// separators, starting with a letter or digit
+var validTag = regexp.MustCompile(`^[a-z0-9][a-z0-9_.:/-]{0,63}$`)
+
+// normalizeTag trims and lowercases a tag, so that tags differing in case are the same
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// ValidateTag checks that a tag is usable. Tags are case-insensitive and may contain letters,
+// digits, '_', '.', ':', '/' and '-', up to 64 characters.
+func ValidateTag(tag string) error {
+	if !validTag.MatchString(normalizeTag(tag)) {
+		return fmt.Errorf("invalid tag %q: use up to 64 letters, digits, '_', '.', ':', '/' or '-', starting with a letter or digit", tag)
+	}
+	return nil
+}
+
+// AddConversationTag labels a conversation with a tag. Adding a tag the conversation already
+// has does nothing.
+func (e *ChatEngine) AddConversationTag(conversationID, tag string) error {
+	if err := ValidateTag(tag); err != nil {
+		return err
+	}
+	tag = normalizeTag(tag)
+
+	conv := e.GetConversation(conversationID)
+	if conv == nil {
+		return fmt.Errorf("conversation %s not found", conversationID)
+	}
+	if err := e.db.AddConversationTag(conversationID, tag); err != nil {
+		return err
+	}
+
+	e.conversationsMutex.Lock()
+	defer e.conversationsMutex.Unlock()
+	if !slices.Contains(conv.Tags, tag) {
+		// A new slice, ephemeral copies of the conversation share the old one
+		tags := append(slices.Clone(conv.Tags), tag)
+		slices.Sort(tags)
+		conv.Tags = tags
+	}
+	return nil
+}
+
+// RemoveConversationTag removes a tag from a conversation, returning ErrTagNotFound if the
+// conversation doesn't have it
+func (e *ChatEngine) RemoveConversationTag(conversationID, tag string) error {
+	tag = normalizeTag(tag)
+
+	conv := e.GetConversation(conversationID)
+	if conv == nil {
+		return fmt.Errorf("conversation %s not found", conversationID)
+	}
+	removed, err := e.db.RemoveConversationTag(conversationID, tag)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return ErrTagNotFound
+	}
+
+	e.conversationsMutex.Lock()
+	defer e.conversationsMutex.Unlock()
+	conv.Tags = slices.DeleteFunc(slices.Clone(conv.Tags), func(t string) bool { return t == tag })
+	if len(conv.Tags) == 0 {
+		conv.Tags = nil
+	}
+	return nil
+}
+
+// ConversationTags returns the tags of a conversation in alphabetical order
+func (e *ChatEngine) ConversationTags(conversationID string) ([]string, error) {
+	conv := e.GetConversation(conversationID)
+	if conv == nil {
+		return nil, fmt.Errorf("conversation %s not found", conversationID)
+	}
+
+	e.conversationsMutex.RLock()
+	defer e.conversationsMutex.RUnlock()
+	return slices.Clone(conv.Tags), nil
+}
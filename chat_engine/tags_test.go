@@ -0,0 +1,74 @@
+package chat_engine
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestValidateTag(t *testing.T) {
+	tests := []struct {
+		tag   string
+		valid bool
+	}{
+		{"work", true},
+		{" Work ", true},
+		{"project:agent/v2", true},
+		{"2024-q1", true},
+		{"", false},
+		{"-work", false},
+		{"two words", false},
+		{"émoji", false},
+		{string(make([]byte, 65)), false},
+	}
+	for _, tt := range tests {
+		if err := ValidateTag(tt.tag); (err == nil) != tt.valid {
+			t.Errorf("ValidateTag(%q) = %v, want valid %v", tt.tag, err, tt.valid)
+		}
+	}
+}
+
+func TestConversationTags(t *testing.T) {
+	provider := newFakeProvider()
+	engine := newTestEngine(t, provider)
+	for _, id := range []string{"a", "b", "c"} {
+		engine.GetOrCreateConversation(id)
+	}
+	for _, tag := range []struct{ conv, tag string }{{"a", "Work"}, {"a", "urgent"}, {"a", "work "}, {"b", "work"}, {"c", "home"}} {
+		if err := engine.AddConversationTag(tag.conv, tag.tag); err != nil {
+			t.Fatalf("AddConversationTag(%s, %q): %v", tag.conv, tag.tag, err)
+		}
+	}
+	if err := engine.AddConversationTag("missing", "work"); err == nil {
+		t.Error("tagged a conversation that doesn't exist")
+	}
+
+	// Tags are normalized, sorted and kept across restarts
+	engine = reopenEngine(t, engine, provider)
+	if tags, err := engine.ConversationTags("a"); err != nil || !slices.Equal(tags, []string{"urgent", "work"}) {
+		t.Errorf("tags of a are %v, %v, want urgent and work", tags, err)
+	}
+
+	page, err := engine.ListConversationsPaged(10, 0, "work")
+	if err != nil {
+		t.Fatalf("ListConversationsPaged: %v", err)
+	}
+	var ids []string
+	for _, summary := range page.Conversations {
+		ids = append(ids, summary.ID)
+	}
+	slices.Sort(ids)
+	if page.Total != 2 || !slices.Equal(ids, []string{"a", "b"}) {
+		t.Errorf("conversations tagged work are %v (total %d), want a and b", ids, page.Total)
+	}
+
+	if err := engine.RemoveConversationTag("a", "WORK"); err != nil {
+		t.Fatalf("RemoveConversationTag: %v", err)
+	}
+	if err := engine.RemoveConversationTag("a", "work"); !errors.Is(err, ErrTagNotFound) {
+		t.Errorf("removing a removed tag returned %v, want ErrTagNotFound", err)
+	}
+	if page, _ := engine.ListConversationsPaged(10, 0, "work"); page.Total != 1 {
+		t.Errorf("%d conversations are tagged work after removing a's tag, want 1", page.Total)
+	}
+}
@@ -0,0 +1,126 @@
+package chat_engine
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/openai/openai-go/v2"
+)
+
+// TitleTrigger controls when a conversation gets its automatic title
+type TitleTrigger string
+
+const (
+	// TitleTriggerFirstUser titles the conversation from its first user message
+	TitleTriggerFirstUser TitleTrigger = "first_user"
+	// TitleTriggerFirstAssistant asks the model for a title in the background once the
+	// first turn has completed, so the title reflects the actual topic
+	TitleTriggerFirstAssistant TitleTrigger = "first_assistant"
+	// TitleTriggerManual never sets titles automatically
+	TitleTriggerManual TitleTrigger = "manual"
+)
+
+// ParseTitleTrigger validates a title trigger name
+func ParseTitleTrigger(s string) (TitleTrigger, error) {
+	switch trigger := TitleTrigger(s); trigger {
+	case TitleTriggerFirstUser, TitleTriggerFirstAssistant, TitleTriggerManual:
+		return trigger, nil
+	default:
+		return "", fmt.Errorf("unknown title trigger %q", s)
+	}
+}
+
+const (
+	maxTitleLength = 60
+	titleModel     = openai.ChatModelGPT5Mini
+)
+
+// SetConversationTitle sets a conversation's title and persists it
+func (e *ChatEngine) SetConversationTitle(conversationID, title string) error {
+	conv := e.GetConversation(conversationID)
+	if conv == nil {
+		return fmt.Errorf("conversation %s not found", conversationID)
+	}
+
+	title = strings.TrimSpace(title)
+	if err := e.db.UpdateConversationTitle(conversationID, title); err != nil {
+		return err
+	}
+
+	e.conversationsMutex.Lock()
+	conv.Title = title
+	conv.UpdatedAt = time.Now().UTC()
+	e.conversationsMutex.Unlock()
+	return nil
+}
+
+// titleAfterUserMessage titles an untitled conversation from its first user message
+func (e *ChatEngine) titleAfterUserMessage(conv *Conversation, content string) {
+	if e.titleTrigger != TitleTriggerFirstUser || conv.Title != "" || conv.ephemeral {
+		return
+	}
+
+	if err := e.SetConversationTitle(conv.ID, titleFromText(content)); err != nil {
+		slog.Error("Failed to set conversation title", "conversation_id", conv.ID, "error", err)
+	}
+}
+
+// titleAfterTurn starts background title generation for an untitled conversation once a turn completed
+func (e *ChatEngine) titleAfterTurn(conv *Conversation, userContent, assistantContent string) {
+	if e.titleTrigger != TitleTriggerFirstAssistant || conv.Title != "" || conv.ephemeral {
+		return
+	}
+
+	go func() {
+		title, err := e.generateTitle(userContent, assistantContent)
+		if err != nil {
+			slog.Warn("Failed to generate conversation title, falling back to first message", "conversation_id", conv.ID, "error", err)
+			title = titleFromText(userContent)
+		}
+		if err := e.SetConversationTitle(conv.ID, title); err != nil {
+			slog.Error("Failed to set conversation title", "conversation_id", conv.ID, "error", err)
+		}
+	}()
+}
+
+// generateTitle asks the model for a short title describing the exchange
+func (e *ChatEngine) generateTitle(userContent, assistantContent string) (string, error) {
+	completion, err := e.complete(context.Background(), CompletionRequest{
+		Messages: []*Message{
+			{Role: "system", Content: "Write a short title (at most 6 words) describing the topic of this conversation. " +
+				"Reply with the title only, no quotes or punctuation at the end."},
+			{Role: "user", Content: userContent},
+			{Role: "assistant", Content: assistantContent},
+		},
+		Model: titleModel,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	title := titleFromText(strings.Trim(completion.Content, "\"' \n"))
+	if title == "" {
+		return "", fmt.Errorf("model returned an empty title")
+	}
+	return title, nil
+}
+
+// titleFromText derives a title from the first line of text, cut at a word boundary
+func titleFromText(text string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	line = strings.Join(strings.Fields(line), " ")
+	if utf8.RuneCountInString(line) <= maxTitleLength {
+		return line
+	}
+
+	runes := []rune(line)[:maxTitleLength]
+	cut := string(runes)
+	if idx := strings.LastIndex(cut, " "); idx > maxTitleLength/2 {
+		cut = cut[:idx]
+	}
+	return cut + "…"
+}
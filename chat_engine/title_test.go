@@ -0,0 +1,142 @@
+package chat_engine
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storedTitle reads the title of a conversation from the database
+func storedTitle(t *testing.T, engine *ChatEngine, conversationID string) string {
+	t.Helper()
+	conv, err := engine.db.LoadConversation(conversationID)
+	if err != nil || conv == nil {
+		t.Fatalf("LoadConversation: %v, %v", conv, err)
+	}
+	return conv.Title
+}
+
+// titleProvider answers title requests with title, or fails them with err, and every other
+// request with a text reply
+func titleProvider(title string, err error) *fakeProvider {
+	return &fakeProvider{
+		reply: func(n int, req CompletionRequest) (*Message, error) {
+			if req.Model != titleModel {
+				return textReply("Set -count=1 to disable the test cache."), nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return textReply(title), nil
+		},
+	}
+}
+
+func TestTitleFromFirstUserMessage(t *testing.T) {
+	provider := titleProvider("Unused", nil)
+	engine := newTestEngine(t, provider, WithTitleTrigger(TitleTriggerFirstUser))
+
+	if _, err := engine.SendUserMessage("conv", "Why are my tests cached?\nThey never rerun."); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if got := storedTitle(t, engine, "conv"); got != "Why are my tests cached?" {
+		t.Errorf("title = %q, want the first line of the first message", got)
+	}
+
+	if _, err := engine.SendUserMessage("conv", "Something else"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if got := storedTitle(t, engine, "conv"); got != "Why are my tests cached?" {
+		t.Errorf("title changed to %q with the second message", got)
+	}
+	for _, req := range provider.Requests() {
+		if req.Model == titleModel {
+			t.Error("the model was asked for a title")
+		}
+	}
+}
+
+func TestTitleFromFirstAssistantReply(t *testing.T) {
+	provider := titleProvider("\"Go Test Caching\"", nil)
+	engine := newTestEngine(t, provider, WithTitleTrigger(TitleTriggerFirstAssistant))
+
+	if _, err := engine.SendUserMessage("conv", "Why are my tests cached?"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	// The title is generated in the background
+	if !waitFor(5*time.Second, func() bool { return storedTitle(t, engine, "conv") != "" }) {
+		t.Fatal("conversation was not titled")
+	}
+	if got := storedTitle(t, engine, "conv"); got != "Go Test Caching" {
+		t.Errorf("title = %q, want the generated one without quotes", got)
+	}
+
+	var titleRequests []CompletionRequest
+	for _, req := range provider.Requests() {
+		if req.Model == titleModel {
+			titleRequests = append(titleRequests, req)
+		}
+	}
+	if len(titleRequests) != 1 {
+		t.Fatalf("the model was asked for a title %d times, want once", len(titleRequests))
+	}
+	messages := titleRequests[0].Messages
+	if last := messages[len(messages)-1]; last.Role != "assistant" || !strings.Contains(last.Content, "-count=1") {
+		t.Errorf("title request ends with %+v, want the assistant's reply", last)
+	}
+}
+
+func TestTitleFallsBackToFirstMessage(t *testing.T) {
+	engine := newTestEngine(t, titleProvider("", errors.New("model unavailable")), WithTitleTrigger(TitleTriggerFirstAssistant))
+
+	if _, err := engine.SendUserMessage("conv", "Why are my tests cached?"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if !waitFor(5*time.Second, func() bool { return storedTitle(t, engine, "conv") != "" }) {
+		t.Fatal("conversation was not titled")
+	}
+	if got := storedTitle(t, engine, "conv"); got != "Why are my tests cached?" {
+		t.Errorf("title = %q, want the first message", got)
+	}
+}
+
+func TestManualTitles(t *testing.T) {
+	provider := titleProvider("Unused", nil)
+	engine := newTestEngine(t, provider, WithTitleTrigger(TitleTriggerManual))
+
+	if _, err := engine.SendUserMessage("conv", "Why are my tests cached?"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if got := storedTitle(t, engine, "conv"); got != "" {
+		t.Errorf("title = %q, want none", got)
+	}
+	if err := engine.SetConversationTitle("conv", "  Test caching  "); err != nil {
+		t.Fatalf("SetConversationTitle: %v", err)
+	}
+	if got := storedTitle(t, engine, "conv"); got != "Test caching" {
+		t.Errorf("title = %q, want the one set", got)
+	}
+	for _, req := range provider.Requests() {
+		if req.Model == titleModel {
+			t.Error("the model was asked for a title")
+		}
+	}
+}
+
+func TestTitleFromText(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"  Fix the   build \nand more", "Fix the build"},
+		{strings.Repeat("word ", 20), "word word word word word word word word word word word word…"},
+		{strings.Repeat("x", 70), strings.Repeat("x", 60) + "…"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := titleFromText(tt.text); got != tt.want {
+			t.Errorf("titleFromText(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package chat_engine
+
+import (
+	"fmt"
+	"sort"
+)
+
+// toolFilter is the set of tools a turn may use, nil allows every tool
+type toolFilter map[string]bool
+
+// newToolFilter returns the filter allowing the named tools, nil for nil names
+func newToolFilter(names []string) toolFilter {
+	if names == nil {
+		return nil
+	}
+	filter := make(toolFilter, len(names))
+	for _, name := range names {
+		filter[name] = true
+	}
+	return filter
+}
+
+// allows reports whether the tool may be used
+func (f toolFilter) allows(name string) bool {
+	return f == nil || f[name]
+}
+
+// intersect returns the tools allowed by both filters
+func (f toolFilter) intersect(other toolFilter) toolFilter {
+	if f == nil {
+		return other
+	}
+	if other == nil {
+		return f
+	}
+	both := make(toolFilter)
+	for name := range f {
+		if other[name] {
+			both[name] = true
+		}
+	}
+	return both
+}
+
+// ValidateToolNames checks that every name is a registered tool
+func (e *ChatEngine) ValidateToolNames(names []string) error {
+	for _, name := range names {
+		if _, ok := e.tools.Get(name); !ok {
+			return fmt.Errorf("unknown tool %q", name)
+		}
+	}
+	return nil
+}
+
+// SetAllowedTools restricts the tools offered in a conversation to the named ones. An empty
+// list disables tools, making it a plain chat; nil lifts the restriction.
+func (e *ChatEngine) SetAllowedTools(conversationID string, names []string) error {
+	if err := e.ValidateToolNames(names); err != nil {
+		return err
+	}
+
+	e.allowedToolsMutex.Lock()
+	defer e.allowedToolsMutex.Unlock()
+	if names == nil {
+		delete(e.allowedTools, conversationID)
+	} else {
+		e.allowedTools[conversationID] = newToolFilter(names)
+	}
+	return nil
+}
+
+// AllowedTools returns the tools a conversation is restricted to, nil when it may use all
+func (e *ChatEngine) AllowedTools(conversationID string) []string {
+	e.allowedToolsMutex.RLock()
+	defer e.allowedToolsMutex.RUnlock()
+	filter, ok := e.allowedTools[conversationID]
+	if !ok {
+		return nil
+	}
+	names := make([]string, 0, len(filter))
+	for name := range filter {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// turnTools returns the tools a turn in conv may use, as restricted by the conversation and
+// by the turn's options
+func (e *ChatEngine) turnTools(conv *Conversation, opts SendOptions) toolFilter {
+	e.allowedToolsMutex.RLock()
+	filter := e.allowedTools[conv.ID]
+	e.allowedToolsMutex.RUnlock()
+
+	if opts.DisableTools {
+		return toolFilter{}
+	}
+	return filter.intersect(newToolFilter(opts.AllowedTools))
+}
@@ -0,0 +1,133 @@
+package chat_engine
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/openai/openai-go/v2"
+)
+
+// toolNames returns the names of tool definitions
+func toolNames(definitions []openai.ChatCompletionToolUnionParam) []string {
+	names := make([]string, 0, len(definitions))
+	for _, definition := range definitions {
+		names = append(names, toolName(definition))
+	}
+	return names
+}
+
+func TestConversationContextOmitsDisabledTools(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("hello")))
+	engine.GetOrCreateConversation("conv")
+
+	all := toolNames(engine.GetConversationContext("conv").Tools)
+	if !slices.Contains(all, "bash_command") || !slices.Contains(all, "read_file") {
+		t.Fatalf("context offers %v, want every tool", all)
+	}
+
+	if err := engine.SetAllowedTools("conv", []string{"read_file"}); err != nil {
+		t.Fatalf("SetAllowedTools: %v", err)
+	}
+	if got := toolNames(engine.GetConversationContext("conv").Tools); !slices.Equal(got, []string{"read_file"}) {
+		t.Errorf("context offers %v, want only read_file", got)
+	}
+
+	if err := engine.SetAllowedTools("conv", []string{}); err != nil {
+		t.Fatalf("SetAllowedTools: %v", err)
+	}
+	if got := engine.GetConversationContext("conv").Tools; len(got) != 0 {
+		t.Errorf("context of a conversation without tools offers %v", toolNames(got))
+	}
+}
+
+func TestDisabledToolsAreNotOfferedOrRun(t *testing.T) {
+	tool := &countingTool{name: "count"}
+	// The model calls the tool anyway
+	provider := newFakeProvider(toolCallReply("call_1", "count", `{}`), textReply("done"))
+	engine := newTestEngine(t, provider, WithTool(tool))
+
+	messages, err := engine.SendUserMessageWithOptions("conv", "count", SendOptions{DisableTools: true})
+	if err != nil {
+		t.Fatalf("SendUserMessageWithOptions: %v", err)
+	}
+	if tools := provider.Requests()[0].Tools; len(tools) != 0 {
+		t.Errorf("turn without tools offered %v", toolNames(tools))
+	}
+	if calls := tool.calls.Load(); calls != 0 {
+		t.Errorf("tool ran %d times in a turn without tools", calls)
+	}
+	if output := toolOutputs(messages)["call_1"]; output != "Not executed: the count tool is not available in this conversation." {
+		t.Errorf("tool output is %q", output)
+	}
+
+	// The next turn has its tools again
+	if _, err := engine.SendUserMessage("conv", "hi"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if names := toolNames(provider.Requests()[2].Tools); !slices.Contains(names, "count") {
+		t.Errorf("next turn offered %v, want count", names)
+	}
+}
+
+func TestTurnAllowedToolsNarrowConversationTools(t *testing.T) {
+	provider := newFakeProvider(textReply("a"), textReply("b"))
+	engine := newTestEngine(t, provider)
+	engine.GetOrCreateConversation("conv")
+	if err := engine.SetAllowedTools("conv", []string{"read_file", "search_code"}); err != nil {
+		t.Fatalf("SetAllowedTools: %v", err)
+	}
+
+	if _, err := engine.SendUserMessage("conv", "a"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if got := toolNames(provider.Requests()[0].Tools); !slices.Equal(got, []string{"read_file", "search_code"}) {
+		t.Errorf("turn offered %v, want the conversation's tools", got)
+	}
+
+	// A turn can only narrow the conversation's tools, not add to them
+	if _, err := engine.SendUserMessageWithOptions("conv", "b", SendOptions{AllowedTools: []string{"search_code", "bash_command"}}); err != nil {
+		t.Fatalf("SendUserMessageWithOptions: %v", err)
+	}
+	if got := toolNames(provider.Requests()[1].Tools); !slices.Equal(got, []string{"search_code"}) {
+		t.Errorf("turn offered %v, want only search_code", got)
+	}
+}
+
+func TestConversationWithoutToolsRunsNoCommands(t *testing.T) {
+	provider := newFakeProvider(toolCallReply("call_1", "bash_command", `{"command": "touch ran"}`), textReply("done"))
+	engine := newTestEngine(t, provider)
+	engine.GetOrCreateConversation("conv")
+	if err := engine.SetAllowedTools("conv", []string{}); err != nil {
+		t.Fatalf("SetAllowedTools: %v", err)
+	}
+
+	if _, err := engine.SendUserMessage("conv", "touch a file"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if tools := provider.Requests()[0].Tools; len(tools) != 0 {
+		t.Errorf("conversation without tools offered %v", toolNames(tools))
+	}
+	if _, err := os.Stat(filepath.Join(engine.workspaceRoot, "ran")); !os.IsNotExist(err) {
+		t.Errorf("the command ran in a conversation without tools")
+	}
+
+	// nil lifts the restriction
+	if err := engine.SetAllowedTools("conv", nil); err != nil {
+		t.Fatalf("SetAllowedTools: %v", err)
+	}
+	if got := engine.AllowedTools("conv"); got != nil {
+		t.Errorf("AllowedTools is %v after lifting the restriction", got)
+	}
+}
+
+func TestSetAllowedToolsRejectsUnknownTools(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")))
+	if err := engine.SetAllowedTools("conv", []string{"read_file", "teleport"}); err == nil {
+		t.Error("SetAllowedTools accepted an unknown tool")
+	}
+	if got := engine.AllowedTools("conv"); got != nil {
+		t.Errorf("AllowedTools is %v after a rejected call", got)
+	}
+}
@@ -0,0 +1,162 @@
+package chat_engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/openai/openai-go/v2"
+)
+
+// ErrInvalidToolArguments is returned by tools whose arguments can't be used. Such a tool call
+// is logged, answered with the error and doesn't count as a tool call that ran.
+var ErrInvalidToolArguments = errors.New("invalid tool arguments")
+
+// Tool is a tool the model can call
+type Tool interface {
+	// Definition describes the tool to the model, its function name identifies the tool
+	Definition() openai.ChatCompletionToolUnionParam
+	// Execute runs a call of the tool with the JSON arguments the model passed and returns the
+	// output for the model. Errors are reported to the model as the output. ctx is canceled
+	// when the turn is, see ToolConversationID for the calling conversation.
+	Execute(ctx context.Context, args json.RawMessage) (string, error)
+}
+
+// ToolRegistry holds the tools offered to the model, in the order they were registered
+type ToolRegistry struct {
+	mutex sync.RWMutex
+	tools map[string]Tool
+	order []string
+}
+
+// NewToolRegistry creates an empty registry
+func NewToolRegistry() *ToolRegistry {
+	return &ToolRegistry{tools: make(map[string]Tool)}
+}
+
+// toolName returns the function name of a tool definition
+func toolName(definition openai.ChatCompletionToolUnionParam) string {
+	if definition.OfFunction == nil {
+		return ""
+	}
+	return definition.OfFunction.Function.Name
+}
+
+// Register adds a tool. Tool names must be unique.
+func (r *ToolRegistry) Register(tool Tool) error {
+	name := toolName(tool.Definition())
+	if name == "" {
+		return fmt.Errorf("tool has no function name")
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.tools[name]; ok {
+		return fmt.Errorf("tool %q is already registered", name)
+	}
+	r.tools[name] = tool
+	r.order = append(r.order, name)
+	return nil
+}
+
+// Unregister removes the named tool and reports whether it was registered
+func (r *ToolRegistry) Unregister(name string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.tools[name]; !ok {
+		return false
+	}
+	delete(r.tools, name)
+	r.order = slices.DeleteFunc(r.order, func(n string) bool { return n == name })
+	return true
+}
+
+// Get returns the tool with the given name
+func (r *ToolRegistry) Get(name string) (Tool, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	tool, ok := r.tools[name]
+	return tool, ok
+}
+
+// Definitions returns the definitions of all tools in registration order
+func (r *ToolRegistry) Definitions() []openai.ChatCompletionToolUnionParam {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	definitions := make([]openai.ChatCompletionToolUnionParam, 0, len(r.order))
+	for _, name := range r.order {
+		definitions = append(definitions, r.tools[name].Definition())
+	}
+	return definitions
+}
+
+// WithTool registers an additional tool when the engine is created
+func WithTool(tool Tool) Option {
+	return func(e *ChatEngine) {
+		e.extraTools = append(e.extraTools, tool)
+	}
+}
+
+// RegisterTool adds a tool to the engine, offered to the model from the next completion on
+func (e *ChatEngine) RegisterTool(tool Tool) error {
+	return e.tools.Register(tool)
+}
+
+// UnregisterTool removes a tool from the engine, from the next completion on it is no longer
+// offered and calls of it are answered with an error. It reports whether the tool existed.
+func (e *ChatEngine) UnregisterTool(name string) bool {
+	return e.tools.Unregister(name)
+}
+
+// toolScope is what a tool call runs for, passed to tools through their context
+type toolScope struct {
+	conv   *Conversation
+	logger *slog.Logger
+}
+
+type toolScopeKey struct{}
+
+// ToolConversationID returns the ID of the conversation whose tool call is executed with ctx
+func ToolConversationID(ctx context.Context) string {
+	if scope, ok := ctx.Value(toolScopeKey{}).(*toolScope); ok {
+		return scope.conv.ID
+	}
+	return ""
+}
+
+type requestIDKey struct{}
+
+// ToolRequestID returns the ID of the request that started the turn whose tool call is
+// executed with ctx, or "" if the turn was not started with one
+func ToolRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// builtinTool is a tool implemented by the engine itself
+type builtinTool struct {
+	definition openai.ChatCompletionToolUnionParam
+	run        func(ctx context.Context, conv *Conversation, args json.RawMessage, logger *slog.Logger) (string, error)
+}
+
+func (t builtinTool) Definition() openai.ChatCompletionToolUnionParam {
+	return t.definition
+}
+
+func (t builtinTool) Execute(ctx context.Context, args json.RawMessage) (string, error) {
+	scope := ctx.Value(toolScopeKey{}).(*toolScope)
+	return t.run(ctx, scope.conv, args, scope.logger)
+}
+
+// parseToolArgs decodes tool arguments into a map
+func parseToolArgs(args json.RawMessage) (map[string]interface{}, error) {
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(args, &parsed); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToolArguments, err)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,106 @@
+package chat_engine
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestToolRegistry(t *testing.T) {
+	registry := NewToolRegistry()
+	for _, name := range []string{"a", "b", "c"} {
+		if err := registry.Register(&countingTool{name: name}); err != nil {
+			t.Fatalf("Register(%s): %v", name, err)
+		}
+	}
+	if err := registry.Register(&countingTool{name: "b"}); err == nil {
+		t.Error("registering b twice succeeded")
+	}
+	if err := registry.Register(&countingTool{}); err == nil {
+		t.Error("registering a tool without a name succeeded")
+	}
+
+	if !registry.Unregister("b") {
+		t.Error("Unregister(b) reported it was not registered")
+	}
+	if registry.Unregister("b") {
+		t.Error("Unregister(b) succeeded twice")
+	}
+	if _, ok := registry.Get("b"); ok {
+		t.Error("b is still registered")
+	}
+	if got := toolNames(registry.Definitions()); !slices.Equal(got, []string{"a", "c"}) {
+		t.Errorf("definitions are %v, want a and c in registration order", got)
+	}
+	// A removed name can be registered again, it goes last
+	if err := registry.Register(&countingTool{name: "b"}); err != nil {
+		t.Fatalf("registering b again: %v", err)
+	}
+	if got := toolNames(registry.Definitions()); !slices.Equal(got, []string{"a", "c", "b"}) {
+		t.Errorf("definitions are %v, want a, c, b", got)
+	}
+}
+
+func TestRegisteredToolRunsEndToEnd(t *testing.T) {
+	var gotConversation string
+	var gotArgs string
+	tool := &funcTool{name: "weather", run: func(ctx context.Context, args json.RawMessage) (string, error) {
+		gotConversation = ToolConversationID(ctx)
+		gotArgs = string(args)
+		return "sunny", nil
+	}}
+	provider := newFakeProvider(toolCallReply("call_1", "weather", `{"city": "Oslo"}`), textReply("It is sunny."))
+	engine := newTestEngine(t, provider)
+	if err := engine.RegisterTool(tool); err != nil {
+		t.Fatalf("RegisterTool: %v", err)
+	}
+	if err := engine.RegisterTool(&countingTool{name: "bash_command"}); err == nil {
+		t.Error("registering a tool with a built-in tool's name succeeded")
+	}
+
+	messages, err := engine.SendUserMessage("conv", "weather in Oslo?")
+	if err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if !slices.Contains(toolNames(provider.Requests()[0].Tools), "weather") {
+		t.Errorf("provider was offered %v, want weather", toolNames(provider.Requests()[0].Tools))
+	}
+	if gotConversation != "conv" || gotArgs != `{"city": "Oslo"}` {
+		t.Errorf("tool ran for %q with %s", gotConversation, gotArgs)
+	}
+	if output := toolOutputs(messages)["call_1"]; output != "sunny" {
+		t.Errorf("tool output is %q, want sunny", output)
+	}
+}
+
+func TestUnregisteredToolIsNoLongerOffered(t *testing.T) {
+	tool := &countingTool{name: "count"}
+	provider := newFakeProvider(textReply("hi"), toolCallReply("call_1", "count", `{}`), textReply("done"))
+	engine := newTestEngine(t, provider, WithTool(tool))
+
+	if _, err := engine.SendUserMessage("conv", "hi"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if !slices.Contains(toolNames(provider.Requests()[0].Tools), "count") {
+		t.Fatalf("provider was offered %v, want count", toolNames(provider.Requests()[0].Tools))
+	}
+
+	if !engine.UnregisterTool("count") {
+		t.Fatal("UnregisterTool reported count was not registered")
+	}
+	// A model that still calls it gets an error instead of running it
+	messages, err := engine.SendUserMessage("conv", "count")
+	if err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if slices.Contains(toolNames(provider.Requests()[1].Tools), "count") {
+		t.Errorf("provider was still offered count")
+	}
+	if output := toolOutputs(messages)["call_1"]; output != "Error: there is no tool named count" {
+		t.Errorf("tool output is %q, want that there is no such tool", output)
+	}
+	if calls := tool.calls.Load(); calls != 0 {
+		t.Errorf("unregistered tool ran %d times", calls)
+	}
+}
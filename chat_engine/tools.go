@@ -1,85 +1,511 @@
 package chat_engine
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
-
-	"github.com/openai/openai-go/v2"
+	"syscall"
+	"time"
 )
 
-var (
-	allTools = []openai.ChatCompletionToolUnionParam{
-		openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
-			Name:        "bash_command",
-			Description: openai.String("Execute a bash command and return the output. Use background=true for long-running commands like servers."),
-			Parameters: openai.FunctionParameters{
-				"type": "object",
-				"properties": map[string]any{
-					"command": map[string]string{
-						"type":        "string",
-						"description": "The bash command to execute",
-					},
-					"background": map[string]any{
-						"type":        "boolean",
-						"description": "If true, run the command in the background. Use for long-running commands like servers. Returns process ID instead of output.",
-					},
-				},
-				"required": []string{"command"},
-			},
-		}),
-		openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
-			Name:        "list_processes",
-			Description: openai.String("List all currently running background processes started by bash_command"),
-			Parameters: openai.FunctionParameters{
-				"type":       "object",
-				"properties": map[string]any{},
-			},
-		}),
-		openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
-			Name:        "kill_process",
-			Description: openai.String("Kill a background process by its process ID (PID)"),
-			Parameters: openai.FunctionParameters{
-				"type": "object",
-				"properties": map[string]any{
-					"pid": map[string]any{
-						"type":        "integer",
-						"description": "The process ID (PID) to kill",
-					},
-				},
-				"required": []string{"pid"},
-			},
-		}),
-	}
-)
-
-// executeBashCommand executes a bash command and returns the output
-func executeBashCommand(command string) (string, error) {
+// executeBashCommand runs command in dir and returns its stdout, stderr and exit code, also when
+// it fails. It is killed after timeout (none if 0) or when ctx is canceled, and recorded with audit.
+// Each stream beyond maxOutput bytes is dropped from the middle; a nil env inherits the server's.
+func executeBashCommand(parent context.Context, command, dir, stdin string, env []string, timeout time.Duration, maxOutput int, audit auditFunc) (string, error) {
 	if strings.TrimSpace(command) == "" {
 		return "", fmt.Errorf("empty command")
 	}
 
+	ctx := parent
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	// Use bash to execute the command to handle quotes and special characters properly
-	cmd := exec.Command("bash", "-c", command)
-	output, err := cmd.CombinedOutput()
+	cmd := exec.CommandContext(ctx, "bash", "-c", command)
+	cmd.Dir = dir
+	cmd.Env = env
+
+	// Run in its own process group so a timeout kills everything the command started
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// Don't wait forever for descendants that escaped the group and still hold the output pipe
+	cmd.WaitDelay = 5 * time.Second
+
+	stdout := newHeadTailBuffer(maxOutput)
+	stderr := newHeadTailBuffer(maxOutput)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	start := time.Now()
+	err := cmd.Run()
+
+	exitCode := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	} else if err != nil {
+		exitCode = -1
+	}
+
+	entry := CommandAuditEntry{
+		Command:    command,
+		WorkingDir: dir,
+		ExitCode:   &exitCode,
+		DurationMS: time.Since(start).Milliseconds(),
+		StartedAt:  start,
+	}
 	if err != nil {
-		fmt.Printf("Error executing bash command: %v, output: %s, command: %s\n", err, output, command)
-		return string(output), err
+		entry.Error = err.Error()
 	}
+	audit(&entry)
+	output := formatCommandOutput(stdout.String(), stderr.String(), exitCode)
 
-	return string(output), nil
+	if parent.Err() != nil {
+		return fmt.Sprintf("%s\n[command was killed because the turn was canceled]", output), context.Cause(parent)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Sprintf("%s\n[command timed out after %s and was killed]", output, timeout), ctx.Err()
+	}
+	if err != nil {
+		slog.Debug("Command failed", "command", command, "error", err)
+		return output, err
+	}
+
+	return output, nil
 }
 
-// executeBashCommandBackground executes a bash command in the background and returns the process info
-func executeBashCommandBackground(command string, pm *ProcessManager, conversationID string) (string, error) {
+// formatCommandOutput labels a command's exit code and output streams for the model. The
+// exit code line comes first and says whether the command succeeded, so that a failure isn't
+// mistaken for output. An exit code of -1 means the command didn't exit normally.
+func formatCommandOutput(stdout, stderr string, exitCode int) string {
+	var out strings.Builder
+	switch exitCode {
+	case -1:
+		out.WriteString("Exit code: none (command did not exit normally)\n")
+	case 0:
+		out.WriteString("Exit code: 0 (success)\n")
+	default:
+		fmt.Fprintf(&out, "Exit code: %d (failed)\n", exitCode)
+	}
+
+	if stdout == "" && stderr == "" {
+		out.WriteString("(no output)\n")
+	}
+	if stdout != "" {
+		out.WriteString("--- stdout ---\n")
+		out.WriteString(stdout)
+		if !strings.HasSuffix(stdout, "\n") {
+			out.WriteByte('\n')
+		}
+	}
+	if stderr != "" {
+		out.WriteString("--- stderr ---\n")
+		out.WriteString(stderr)
+		if !strings.HasSuffix(stderr, "\n") {
+			out.WriteByte('\n')
+		}
+	}
+
+	return out.String()
+}
+
+// headTailBuffer is an io.Writer that keeps only the first and last bytes written once
+// more than max bytes were written, so huge outputs can't exhaust memory
+type headTailBuffer struct {
+	max   int
+	head  []byte
+	tail  []byte
+	total int
+}
+
+// newHeadTailBuffer returns a buffer keeping at most max bytes, 0 meaning unlimited
+func newHeadTailBuffer(max int) *headTailBuffer {
+	return &headTailBuffer{max: max}
+}
+
+func (b *headTailBuffer) Write(p []byte) (int, error) {
+	written := len(p)
+	b.total += written
+	if b.max <= 0 {
+		b.head = append(b.head, p...)
+		return written, nil
+	}
+
+	headCap := b.max / 2
+	if room := headCap - len(b.head); room > 0 {
+		n := min(room, len(p))
+		b.head = append(b.head, p[:n]...)
+		p = p[n:]
+	}
+
+	tailCap := b.max - headCap
+	b.tail = append(b.tail, p...)
+	// Trim lazily to keep appends amortized
+	if len(b.tail) > 2*tailCap {
+		b.tail = append(b.tail[:0], b.tail[len(b.tail)-tailCap:]...)
+	}
+	return written, nil
+}
+
+// String returns the kept output with a marker where bytes were dropped
+func (b *headTailBuffer) String() string {
+	if b.max <= 0 || b.total <= b.max {
+		return string(b.head) + string(b.tail)
+	}
+
+	tail := b.tail[len(b.tail)-(b.max-len(b.head)):]
+	omitted := b.total - len(b.head) - len(tail)
+	return fmt.Sprintf("%s\n[output truncated, %d bytes omitted]\n%s", b.head, omitted, tail)
+}
+
+// truncateOutput applies the same head and tail truncation as headTailBuffer to a string
+func truncateOutput(output string, max int) string {
+	buf := newHeadTailBuffer(max)
+	buf.Write([]byte(output))
+	return buf.String()
+}
+
+// executeBashCommandBackground starts command in dir as a background process of pm, recorded
+// with audit, and returns the process info
+func executeBashCommandBackground(command, dir string, pm *ProcessManager, conversationID string, audit auditFunc) (string, error) {
 	if strings.TrimSpace(command) == "" {
 		return "", fmt.Errorf("empty command")
 	}
 
-	info, err := pm.StartProcess(command, conversationID)
+	entry := CommandAuditEntry{
+		Command:    command,
+		WorkingDir: dir,
+		Background: true,
+		StartedAt:  time.Now(),
+	}
+	info, err := pm.StartProcess(command, dir, conversationID)
 	if err != nil {
+		entry.Error = err.Error()
+		audit(&entry)
 		return "", fmt.Errorf("failed to start background process: %w", err)
 	}
+	entry.PID = info.PID
+	audit(&entry)
+	pm.trackAudit(info, entry.ID)
 
 	return fmt.Sprintf("Started background process (PID: %d)\nCommand: %s", info.PID, info.Command), nil
 }
+
+// resolveWorkspacePath resolves path against root and returns an absolute path,
+// rejecting anything that ends up outside root (including through symlinks)
+func resolveWorkspacePath(root, path string) (string, error) {
+	if strings.TrimSpace(path) == "" {
+		return "", fmt.Errorf("empty path")
+	}
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", fmt.Errorf("invalid working directory: %w", err)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(absRoot, path)
+	}
+	path = filepath.Clean(path)
+
+	if !isWithinDir(absRoot, path) {
+		return "", fmt.Errorf("path %s is outside the working directory %s", path, absRoot)
+	}
+
+	// Resolve symlinks on the longest existing prefix so a link can't point outside root
+	realRoot, err := filepath.EvalSymlinks(absRoot)
+	if err != nil {
+		return "", fmt.Errorf("invalid working directory: %w", err)
+	}
+	existing := path
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+	realExisting, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve path: %w", err)
+	}
+	if !isWithinDir(realRoot, realExisting) {
+		return "", fmt.Errorf("path %s resolves outside the working directory %s", path, absRoot)
+	}
+
+	return path, nil
+}
+
+// isWithinDir reports whether path is dir itself or located inside it
+func isWithinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// readFile returns lines startLine..endLine (1-based, inclusive, 0 meaning unbounded) of the
+// file at path prefixed with line numbers. Output is capped at maxBytes with a truncation notice.
+func readFile(root, path string, startLine, endLine, maxBytes int) (string, error) {
+	resolved, err := resolveWorkspacePath(root, path)
+	if err != nil {
+		return "", err
+	}
+	if startLine < 1 {
+		startLine = 1
+	}
+	if endLine != 0 && endLine < startLine {
+		return "", fmt.Errorf("end_line %d is before start_line %d", endLine, startLine)
+	}
+
+	file, err := os.Open(resolved)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("file %s does not exist", path)
+		}
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to stat file: %w", err)
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("%s is a directory", path)
+	}
+
+	reader := bufio.NewReader(file)
+	head, _ := reader.Peek(8000)
+	if bytes.IndexByte(head, 0) != -1 {
+		return "", fmt.Errorf("%s looks like a binary file (%d bytes), refusing to read it as text", path, info.Size())
+	}
+
+	var out strings.Builder
+	lineNumber := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			lineNumber++
+			if lineNumber >= startLine && (endLine == 0 || lineNumber <= endLine) {
+				formatted := fmt.Sprintf("%6d\t%s", lineNumber, strings.TrimRight(line, "\r\n"))
+				if maxBytes > 0 && out.Len()+len(formatted)+1 > maxBytes {
+					fmt.Fprintf(&out, "[output truncated at %d bytes; continue reading with start_line=%d]", maxBytes, lineNumber)
+					return out.String(), nil
+				}
+				out.WriteString(formatted)
+				out.WriteByte('\n')
+			}
+		}
+		if err == io.EOF || (endLine != 0 && lineNumber >= endLine) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read file: %w", err)
+		}
+	}
+
+	if lineNumber < startLine {
+		return fmt.Sprintf("[file has %d lines, nothing to show from line %d]", lineNumber, startLine), nil
+	}
+	return out.String(), nil
+}
+
+// writeFile writes content to path inside root, either replacing the file or appending to it,
+// and returns the number of bytes written
+func writeFile(root, path, content, mode string, createDirs bool) (int, error) {
+	resolved, err := resolveWorkspacePath(root, path)
+	if err != nil {
+		return 0, err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	switch mode {
+	case "", "overwrite":
+		flags |= os.O_TRUNC
+	case "append":
+		flags |= os.O_APPEND
+	default:
+		return 0, fmt.Errorf("unknown mode %q, expected overwrite or append", mode)
+	}
+
+	if info, err := os.Stat(resolved); err == nil && info.IsDir() {
+		return 0, fmt.Errorf("%s is a directory", path)
+	}
+
+	dir := filepath.Dir(resolved)
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		if !createDirs {
+			return 0, fmt.Errorf("directory %s does not exist, set create_dirs to create it", dir)
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return 0, fmt.Errorf("failed to create directories: %w", err)
+		}
+	}
+
+	file, err := os.OpenFile(resolved, flags, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file: %w", err)
+	}
+	n, err := file.WriteString(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return n, fmt.Errorf("failed to write file: %w", err)
+	}
+
+	return n, nil
+}
+
+// fileEdit replaces the single occurrence of old with new
+type fileEdit struct {
+	old string
+	new string
+}
+
+// editFile applies edits to the file at path inside root in order and returns the edited
+// regions with line numbers. Every edit must match exactly once or nothing is written.
+func editFile(root, path string, edits []fileEdit) (string, error) {
+	resolved, err := resolveWorkspacePath(root, path)
+	if err != nil {
+		return "", err
+	}
+	if len(edits) == 0 {
+		return "", fmt.Errorf("nothing to edit, provide search/replace or diff")
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("file %s does not exist", path)
+		}
+		return "", fmt.Errorf("failed to stat file: %w", err)
+	}
+	data, err := os.ReadFile(resolved)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+
+	content := string(data)
+	var regions []string
+	for i, edit := range edits {
+		if edit.old == "" {
+			return "", fmt.Errorf("edit %d: search text is empty", i+1)
+		}
+		switch matches := strings.Count(content, edit.old); matches {
+		case 1:
+		case 0:
+			return "", fmt.Errorf("edit %d: search text not found in %s", i+1, path)
+		default:
+			return "", fmt.Errorf("edit %d: search text matches %d times in %s, include more context to make it unique", i+1, matches, path)
+		}
+
+		idx := strings.Index(content, edit.old)
+		content = content[:idx] + edit.new + content[idx+len(edit.old):]
+
+		startLine := strings.Count(content[:idx], "\n") + 1
+		endLine := startLine + strings.Count(edit.new, "\n")
+		regions = append(regions, numberedLines(content, startLine-3, endLine+3))
+	}
+
+	if err := os.WriteFile(resolved, []byte(content), info.Mode().Perm()); err != nil {
+		return "", fmt.Errorf("failed to write file: %w", err)
+	}
+
+	return fmt.Sprintf("Edited %s:\n%s", path, strings.Join(regions, "...\n")), nil
+}
+
+// numberedLines returns lines from..to (1-based, inclusive, clamped to the content) with line numbers
+func numberedLines(content string, from, to int) string {
+	lines := strings.Split(content, "\n")
+	if from < 1 {
+		from = 1
+	}
+	if to > len(lines) {
+		to = len(lines)
+	}
+
+	var out strings.Builder
+	for i := from; i <= to; i++ {
+		fmt.Fprintf(&out, "%6d\t%s\n", i, lines[i-1])
+	}
+	return out.String()
+}
+
+// parseUnifiedDiff turns each hunk of a unified diff into an edit. Line numbers in hunk
+// headers are ignored, hunks are located by their context and removed lines instead.
+func parseUnifiedDiff(diff string) ([]fileEdit, error) {
+	var edits []fileEdit
+	var oldLines, newLines []string
+	inHunk := false
+
+	flush := func() error {
+		if !inHunk {
+			return nil
+		}
+		if len(oldLines) == 0 {
+			return fmt.Errorf("hunk %d has no context or removed lines to locate it", len(edits)+1)
+		}
+		edits = append(edits, fileEdit{
+			old: strings.Join(oldLines, "\n"),
+			new: strings.Join(newLines, "\n"),
+		})
+		oldLines, newLines = nil, nil
+		return nil
+	}
+
+	for _, line := range strings.Split(strings.TrimRight(diff, "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "@@"):
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			inHunk = true
+		case !inHunk:
+			// File headers (---, +++, diff --git, ...) before the first hunk
+		case strings.HasPrefix(line, "\\"):
+			// "\ No newline at end of file"
+		case strings.HasPrefix(line, "-"):
+			oldLines = append(oldLines, line[1:])
+		case strings.HasPrefix(line, "+"):
+			newLines = append(newLines, line[1:])
+		case strings.HasPrefix(line, " "):
+			oldLines = append(oldLines, line[1:])
+			newLines = append(newLines, line[1:])
+		case line == "":
+			oldLines = append(oldLines, "")
+			newLines = append(newLines, "")
+		default:
+			return nil, fmt.Errorf("unexpected line in diff: %q", line)
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	if len(edits) == 0 {
+		return nil, fmt.Errorf("diff contains no hunks")
+	}
+
+	return edits, nil
+}
@@ -0,0 +1,506 @@
+package chat_engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeTestFile creates a file with content inside dir
+func writeTestFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadFileLineRanges(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "lines.txt", "one\ntwo\nthree\nfour\nfive\n")
+
+	tests := []struct {
+		name       string
+		start, end int
+		want       string
+	}{
+		{"whole file", 0, 0, "     1\tone\n     2\ttwo\n     3\tthree\n     4\tfour\n     5\tfive\n"},
+		{"from a line", 4, 0, "     4\tfour\n     5\tfive\n"},
+		{"range", 2, 3, "     2\ttwo\n     3\tthree\n"},
+		{"single line", 3, 3, "     3\tthree\n"},
+		{"end past the file", 5, 10, "     5\tfive\n"},
+		{"start past the file", 8, 0, "[file has 5 lines, nothing to show from line 8]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readFile(root, "lines.txt", tt.start, tt.end, 0)
+			if err != nil {
+				t.Fatalf("readFile: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadFileErrors(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "lines.txt", "one\ntwo\n")
+	writeTestFile(t, root, "binary.bin", "ab\x00cd")
+	writeTestFile(t, root, "dir/file.txt", "x")
+
+	tests := []struct {
+		name       string
+		path       string
+		start, end int
+		want       string
+	}{
+		{"missing file", "missing.txt", 0, 0, "does not exist"},
+		{"end before start", "lines.txt", 2, 1, "is before start_line"},
+		{"directory", "dir", 0, 0, "is a directory"},
+		{"binary file", "binary.bin", 0, 0, "binary file"},
+		{"outside the workspace", "../outside.txt", 0, 0, "outside the working directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readFile(root, tt.path, tt.start, tt.end, 0)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadFileMaxBytes(t *testing.T) {
+	root := t.TempDir()
+	var content strings.Builder
+	for i := 1; i <= 100; i++ {
+		fmt.Fprintf(&content, "line %d\n", i)
+	}
+	writeTestFile(t, root, "long.txt", content.String())
+
+	const maxBytes = 100
+	got, err := readFile(root, "long.txt", 0, 0, maxBytes)
+	if err != nil {
+		t.Fatalf("readFile: %v", err)
+	}
+	lines, notice, found := strings.Cut(got, "[output truncated")
+	if !found {
+		t.Fatalf("no truncation notice in %q", got)
+	}
+	if len(lines) > maxBytes {
+		t.Errorf("returned %d bytes of lines, want at most %d", len(lines), maxBytes)
+	}
+	// Whole lines are kept, the notice tells where to continue
+	if !strings.HasSuffix(lines, "\n") {
+		t.Errorf("output ends in the middle of a line: %q", lines)
+	}
+	next := strings.Count(lines, "\n") + 1
+	if want := fmt.Sprintf("start_line=%d]", next); !strings.HasSuffix(notice, want) {
+		t.Errorf("notice %q doesn't end with %q", notice, want)
+	}
+
+	// Continuing from the notice returns the next line
+	rest, err := readFile(root, "long.txt", next, next, maxBytes)
+	if err != nil {
+		t.Fatalf("readFile: %v", err)
+	}
+	if want := fmt.Sprintf("%6d\tline %d\n", next, next); rest != want {
+		t.Errorf("continued with %q, want %q", rest, want)
+	}
+
+	// No cap without a limit
+	if got, _ := readFile(root, "long.txt", 0, 0, 0); strings.Contains(got, "truncated") {
+		t.Error("output truncated without a limit")
+	}
+}
+
+func TestReadFileToolAppliesMaxReadFileBytes(t *testing.T) {
+	provider := newFakeProvider(toolCallReply("call_1", "read_file", `{"path": "long.txt"}`), textReply("done"))
+	engine := newTestEngine(t, provider, WithMaxReadFileBytes(64))
+	writeTestFile(t, engine.workspaceRoot, "long.txt", strings.Repeat("0123456789\n", 20))
+
+	messages, err := engine.SendUserMessage("conv", "read long.txt")
+	if err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	output := messages[2].Content
+	if messages[2].Role != "tool" || !strings.Contains(output, "[output truncated at 64 bytes") {
+		t.Errorf("read_file returned %q, want output truncated at 64 bytes", output)
+	}
+}
+
+func TestWriteFileRejectsPathsOutsideWorkspace(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "workspace")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{root, outside} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, outside, "target.txt", "original")
+	if err := os.Symlink(outside, filepath.Join(root, "linked_dir")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "target.txt"), filepath.Join(root, "linked_file")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"parent traversal", "../../etc/passwd"},
+		{"traversal into a sibling", "../outside/target.txt"},
+		{"traversal through a subdirectory", "sub/../../outside/target.txt"},
+		{"absolute path outside", filepath.Join(outside, "target.txt")},
+		{"absolute system path", "/etc/passwd"},
+		{"symlinked directory", "linked_dir/new.txt"},
+		{"symlinked directory to an existing file", "linked_dir/target.txt"},
+		{"symlinked file", "linked_file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := writeFile(root, tt.path, "overwritten", "overwrite", true)
+			if err == nil || !strings.Contains(err.Error(), "outside the working directory") {
+				t.Errorf("got error %v, want the path rejected", err)
+			}
+		})
+	}
+
+	content, err := os.ReadFile(filepath.Join(outside, "target.txt"))
+	if err != nil || string(content) != "original" {
+		t.Errorf("file outside the workspace changed to %q (%v)", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.txt")); !os.IsNotExist(err) {
+		t.Errorf("file created outside the workspace: %v", err)
+	}
+}
+
+func TestWriteFileInsideWorkspace(t *testing.T) {
+	root := t.TempDir()
+
+	// Paths may be absolute or leave the workspace temporarily
+	for _, path := range []string{"a.txt", filepath.Join(root, "b.txt"), "sub/../c.txt", "./d/e.txt"} {
+		if _, err := writeFile(root, path, "content", "overwrite", true); err != nil {
+			t.Errorf("writeFile(%q): %v", path, err)
+		}
+	}
+	for _, name := range []string{"a.txt", "b.txt", "c.txt", "d/e.txt"} {
+		if content, err := os.ReadFile(filepath.Join(root, name)); err != nil || string(content) != "content" {
+			t.Errorf("%s has %q (%v), want the written content", name, content, err)
+		}
+	}
+}
+
+func TestBackgroundCommandStartError(t *testing.T) {
+	provider := newFakeProvider(
+		toolCallReply("call_1", "bash_command", `{"command": "  ", "background": true}`),
+		textReply("done"),
+	)
+	engine := newTestEngine(t, provider)
+
+	messages, err := engine.SendUserMessage("conv", "start it")
+	if err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	if output := messages[2]; output.Role != "tool" || !strings.Contains(output.Content, "Error: empty command") {
+		t.Errorf("tool message is %s %q, want the start error", output.Role, output.Content)
+	}
+	if processes := engine.GetProcesses(); len(processes) != 0 {
+		t.Errorf("%d background processes are running, want none", len(processes))
+	}
+}
+
+func TestEditFile(t *testing.T) {
+	const original = "func a() {\n\treturn 1\n}\n\nfunc b() {\n\treturn 1\n}\n"
+
+	tests := []struct {
+		name    string
+		edits   []fileEdit
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "single match",
+			edits: []fileEdit{{old: "func a() {\n\treturn 1", new: "func a() {\n\treturn 2"}},
+			want:  "func a() {\n\treturn 2\n}\n\nfunc b() {\n\treturn 1\n}\n",
+		},
+		{
+			name:    "no match",
+			edits:   []fileEdit{{old: "func c()", new: "func d()"}},
+			wantErr: "not found",
+		},
+		{
+			name:    "ambiguous match",
+			edits:   []fileEdit{{old: "\treturn 1", new: "\treturn 2"}},
+			wantErr: "matches 2 times",
+		},
+		{
+			name: "later edit fails",
+			edits: []fileEdit{
+				{old: "func a()", new: "func first()"},
+				{old: "func missing()", new: "func x()"},
+			},
+			wantErr: "edit 2: search text not found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeTestFile(t, root, "code.go", original)
+
+			output, err := editFile(root, "code.go", tt.edits)
+			data, readErr := os.ReadFile(filepath.Join(root, "code.go"))
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("editFile returned %v, want an error containing %q", err, tt.wantErr)
+				}
+				if string(data) != original {
+					t.Errorf("failed edit changed the file to %q", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("editFile: %v", err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("file is %q, want %q", data, tt.want)
+			}
+			if !strings.Contains(output, "     2\t\treturn 2") {
+				t.Errorf("output does not show the edited line:\n%s", output)
+			}
+		})
+	}
+}
+
+func TestEditFileWithDiff(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "notes.txt", "one\ntwo\nthree\nfour\n")
+
+	edits, err := parseUnifiedDiff("--- a/notes.txt\n+++ b/notes.txt\n@@ -1,3 +1,3 @@\n one\n-two\n+2\n three\n")
+	if err != nil {
+		t.Fatalf("parseUnifiedDiff: %v", err)
+	}
+	if _, err := editFile(root, "notes.txt", edits); err != nil {
+		t.Fatalf("editFile: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(root, "notes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "one\n2\nthree\nfour\n"; string(data) != want {
+		t.Errorf("file is %q, want %q", data, want)
+	}
+
+	if _, err := parseUnifiedDiff("--- a/notes.txt\n+++ b/notes.txt\n"); err == nil {
+		t.Error("a diff without hunks was accepted")
+	}
+}
+
+// callTool runs a tool call in a conversation of engine and returns its output
+func callTool(t *testing.T, engine *ChatEngine, conversationID, name, arguments string) string {
+	t.Helper()
+	conv := engine.GetOrCreateConversation(conversationID)
+	toolCall := ToolCall{ID: "call_1", Type: "function", Name: name, Arguments: arguments}
+	output, _ := engine.executeToolCall(t.Context(), conv, toolCall, slog.Default())
+	return output
+}
+
+func TestBashCommandTimeoutKillsCommand(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")), WithCommandTimeout(200*time.Millisecond))
+
+	// The shell's PID is also its process group, which the sleep belongs to
+	start := time.Now()
+	output := callTool(t, engine, "conv", "bash_command", `{"command": "echo $$ > shell.pid; sleep 30"}`)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("command returned after %s, want about 200ms", elapsed)
+	}
+	if !strings.Contains(output, "[command timed out after 200ms and was killed]") {
+		t.Errorf("output is %q, want the timeout", output)
+	}
+
+	data, err := os.ReadFile(filepath.Join(engine.workspaceRoot, "shell.pid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pgid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(5*time.Second, func() bool { return syscall.Kill(-pgid, 0) == syscall.ESRCH }) {
+		t.Error("processes of the command are still running")
+	}
+}
+
+func TestHeadTailBufferKeepsHeadAndTail(t *testing.T) {
+	buf := newHeadTailBuffer(10)
+	for _, chunk := range []string{"abc", "defgh", "ijklmnop", "qrstuvwxyz"} {
+		buf.Write([]byte(chunk))
+	}
+	if want := "abcde\n[output truncated, 16 bytes omitted]\nvwxyz"; buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+
+	// Output within the limit is kept whole
+	small := newHeadTailBuffer(10)
+	small.Write([]byte("0123456789"))
+	if small.String() != "0123456789" {
+		t.Errorf("got %q, want the whole output", small.String())
+	}
+}
+
+func TestBashCommandOutputIsTruncated(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")), WithMaxCommandOutputBytes(100))
+
+	output := callTool(t, engine, "conv", "bash_command", `{"command": "seq 1 10000"}`)
+	if !strings.Contains(output, "--- stdout ---\n1\n2\n3\n") {
+		t.Errorf("output %q lacks the first lines", output)
+	}
+	if !strings.HasSuffix(output, "9999\n10000\n") {
+		t.Errorf("output %q lacks the last lines", output)
+	}
+	if !strings.Contains(output, "[output truncated, ") {
+		t.Errorf("output %q doesn't say it was truncated", output)
+	}
+	if len(output) > 300 {
+		t.Errorf("output is %d bytes, want it capped", len(output))
+	}
+}
+
+func TestBashCommandSeparatesStdoutAndStderr(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")))
+
+	output := callTool(t, engine, "conv", "bash_command", `{"command": "echo a; echo b >&2"}`)
+	if want := "Exit code: 0 (success)\n--- stdout ---\na\n--- stderr ---\nb\n"; output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
+
+func TestBashCommandReportsFailure(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")))
+
+	tests := map[string]string{
+		`{"command": "echo partial; echo oops >&2; exit 3"}`: "Exit code: 3 (failed)\n--- stdout ---\npartial\n--- stderr ---\noops\n",
+		`{"command": "false"}`:                               "Exit code: 1 (failed)\n(no output)\n",
+		`{"command": "true"}`:                                "Exit code: 0 (success)\n(no output)\n",
+	}
+	for args, want := range tests {
+		if output := callTool(t, engine, "conv", "bash_command", args); output != want {
+			t.Errorf("%s: got %q, want %q", args, output, want)
+		}
+	}
+}
+
+func TestFormatCommandOutputWithoutExitCode(t *testing.T) {
+	if got, want := formatCommandOutput("", "", -1), "Exit code: none (command did not exit normally)\n(no output)\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestBashCommandStdin(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")))
+
+	tests := map[string]string{
+		`{"command": "sort", "stdin": "pear\napple\n"}`: "Exit code: 0 (success)\n--- stdout ---\napple\npear\n",
+		`{"command": "wc -l", "stdin": "a\nb\nc\n"}`:    "Exit code: 0 (success)\n--- stdout ---\n3\n",
+		// Without stdin the command reads an empty input instead of waiting for one
+		`{"command": "cat"}`: "Exit code: 0 (success)\n(no output)\n",
+		`{"command": "cat", "stdin": "x", "background": true}`: "Error: stdin can't be used with background=true",
+	}
+	for args, want := range tests {
+		if output := callTool(t, engine, "conv", "bash_command", args); output != want {
+			t.Errorf("%s: got %q, want %q", args, output, want)
+		}
+	}
+	if pids := conversationPIDs(engine.processManager, "conv"); len(pids) != 0 {
+		t.Errorf("background command with stdin was started as %v", pids)
+	}
+}
+
+func TestBashCommandWorkingDir(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")))
+	sub := filepath.Join(engine.workspaceRoot, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := engine.SetWorkingDir("conv", "sub"); err != nil {
+		t.Fatalf("SetWorkingDir: %v", err)
+	}
+	if output := callTool(t, engine, "conv", "bash_command", `{"command": "pwd"}`); !strings.Contains(output, "\n"+sub+"\n") {
+		t.Errorf("pwd printed %q, want %s", output, sub)
+	}
+	// Other conversations keep the workspace root
+	if output := callTool(t, engine, "other", "bash_command", `{"command": "pwd"}`); !strings.Contains(output, "\n"+engine.workspaceRoot+"\n") {
+		t.Errorf("pwd in another conversation printed %q, want %s", output, engine.workspaceRoot)
+	}
+
+	outside := t.TempDir()
+	if _, err := engine.SetWorkingDir("conv", outside); err == nil {
+		t.Error("SetWorkingDir accepted a directory outside the workspace")
+	}
+	for _, dir := range []string{outside, "../.."} {
+		args := fmt.Sprintf(`{"command": "pwd", "working_dir": %q}`, dir)
+		if output := callTool(t, engine, "conv", "bash_command", args); !strings.HasPrefix(output, "Error: invalid working_dir") {
+			t.Errorf("working_dir %s: got %q, want it rejected", dir, output)
+		}
+	}
+}
+
+func TestConversationInfoTool(t *testing.T) {
+	provider := newFakeProvider(
+		textReply("Hello."),
+		toolCallReply("call_count", "count", `{}`),
+		toolCallReply("call_info", "conversation_info", `{}`),
+		textReply("Done."),
+	)
+	engine := newTestEngine(t, provider,
+		WithTool(&countingTool{name: "count"}),
+		WithMaxToolIterations(5),
+		WithMaxConversationToolCalls(10),
+	)
+	if _, err := engine.SendUserMessage("conv", "hi"); err != nil {
+		t.Fatalf("first turn: %v", err)
+	}
+	messages, err := engine.SendUserMessage("conv", "count and report")
+	if err != nil {
+		t.Fatalf("second turn: %v", err)
+	}
+
+	var info ConversationInfo
+	if err := json.Unmarshal([]byte(toolOutputs(messages)["call_info"]), &info); err != nil {
+		t.Fatalf("invalid conversation info %q: %v", toolOutputs(messages)["call_info"], err)
+	}
+	// The user and assistant messages of the first turn, and the second turn up to the
+	// conversation_info call
+	if info.ConversationID != "conv" || info.MessageCount != 6 || info.TurnCount != 2 {
+		t.Errorf("got %+v, want 6 messages in 2 turns of conv", info)
+	}
+	if info.ToolCalls != 1 || info.ToolCallLimit != 10 || info.ToolCallsRemaining == nil || *info.ToolCallsRemaining != 9 {
+		t.Errorf("got %d tool calls of %d, want 1 of 10 with 9 remaining", info.ToolCalls, info.ToolCallLimit)
+	}
+	if info.ToolRoundsThisTurn != 2 || info.MaxToolRoundsPerTurn != 5 || info.ToolRoundsRemaining != 3 {
+		t.Errorf("got %d of %d tool rounds with %d remaining, want 2 of 5 with 3 remaining",
+			info.ToolRoundsThisTurn, info.MaxToolRoundsPerTurn, info.ToolRoundsRemaining)
+	}
+	if info.CreatedAt.IsZero() || info.ElapsedSeconds < 0 || info.WorkingDir == "" || info.ReadOnly {
+		t.Errorf("got %+v, want the creation time and working directory of a writable conversation", info)
+	}
+}
@@ -0,0 +1,137 @@
+package chat_engine
+
+import "fmt"
+
+// TranscriptProblem describes a single issue found in a transcript
+type TranscriptProblem struct {
+	MessageIndex int    `json:"message_index"`
+	MessageID    string `json:"message_id,omitempty"`
+	Code         string `json:"code"`
+	Detail       string `json:"detail"`
+}
+
+// TranscriptReport is the result of validating a transcript
+type TranscriptReport struct {
+	Valid    bool                `json:"valid"`
+	Problems []TranscriptProblem `json:"problems"`
+}
+
+// Problem codes reported by ValidateTranscript
+const (
+	ProblemMissingID          = "missing_id"
+	ProblemDuplicateID        = "duplicate_id"
+	ProblemUnknownRole        = "unknown_role"
+	ProblemDuplicateToolCall  = "duplicate_tool_call_id"
+	ProblemOrphanedToolCall   = "orphaned_tool_call"
+	ProblemOrphanedToolResult = "orphaned_tool_response"
+	ProblemMissingToolCallID  = "missing_tool_call_id"
+	ProblemOutOfOrder         = "out_of_order"
+)
+
+var knownRoles = map[string]bool{
+	"system":    true,
+	"user":      true,
+	"assistant": true,
+	"tool":      true,
+	"summary":   true,
+}
+
+// ValidateTranscript checks messages for problems that would make them unusable as a
+// conversation history: duplicate or missing IDs, unknown roles, tool calls without a
+// response, responses without a matching call, and responses outside of the block of tool
+// messages that must directly follow the assistant message requesting them.
+// ImportConversation runs it before storing anything.
+func ValidateTranscript(messages []*Message) *TranscriptReport {
+	report := &TranscriptReport{Problems: make([]TranscriptProblem, 0)}
+	add := func(index int, msg *Message, code, detail string) {
+		report.Problems = append(report.Problems, TranscriptProblem{
+			MessageIndex: index,
+			MessageID:    msg.ID,
+			Code:         code,
+			Detail:       detail,
+		})
+	}
+
+	// Index where each tool call was requested, to tell early responses from orphaned ones
+	callIndex := make(map[string]int)
+	for i, msg := range messages {
+		if msg == nil {
+			continue
+		}
+		for _, toolCall := range msg.ToolCalls {
+			if _, ok := callIndex[toolCall.ID]; !ok {
+				callIndex[toolCall.ID] = i
+			}
+		}
+	}
+
+	seenIDs := make(map[string]int)
+	seenCalls := make(map[string]bool)
+	// Tool calls of the latest assistant message (at openIndex) still waiting for a response
+	open := make(map[string]bool)
+	openIndex := -1
+	closeOpen := func(reason string) {
+		// Report in request order rather than map order
+		for _, toolCall := range messages[openIndex].ToolCalls {
+			if open[toolCall.ID] {
+				add(openIndex, messages[openIndex], ProblemOrphanedToolCall, fmt.Sprintf("tool call %s has no response before %s", toolCall.ID, reason))
+			}
+		}
+		open = make(map[string]bool)
+	}
+
+	for i, msg := range messages {
+		if msg == nil {
+			add(i, &Message{}, ProblemMissingID, "message is null")
+			continue
+		}
+
+		if msg.ID == "" {
+			add(i, msg, ProblemMissingID, "message has no ID")
+		} else if first, ok := seenIDs[msg.ID]; ok {
+			add(i, msg, ProblemDuplicateID, fmt.Sprintf("ID already used by message %d", first))
+		} else {
+			seenIDs[msg.ID] = i
+		}
+
+		if !knownRoles[msg.Role] {
+			add(i, msg, ProblemUnknownRole, fmt.Sprintf("unknown role %q", msg.Role))
+		}
+
+		if msg.Role == "tool" {
+			switch id := msg.TollCallID; {
+			case id == "":
+				add(i, msg, ProblemMissingToolCallID, "tool message does not reference a tool call")
+			case open[id]:
+				delete(open, id)
+			case seenCalls[id]:
+				add(i, msg, ProblemOutOfOrder, fmt.Sprintf("response to tool call %s does not directly follow the message requesting it", id))
+			case callIndex[id] > i:
+				add(i, msg, ProblemOutOfOrder, fmt.Sprintf("response to tool call %s comes before the call (message %d)", id, callIndex[id]))
+			default:
+				add(i, msg, ProblemOrphanedToolResult, fmt.Sprintf("no message requested tool call %s", id))
+			}
+			continue
+		}
+
+		if len(open) > 0 {
+			closeOpen(fmt.Sprintf("message %d", i))
+		}
+
+		for _, toolCall := range msg.ToolCalls {
+			if seenCalls[toolCall.ID] {
+				add(i, msg, ProblemDuplicateToolCall, fmt.Sprintf("tool call ID %s is used more than once", toolCall.ID))
+				continue
+			}
+			seenCalls[toolCall.ID] = true
+			open[toolCall.ID] = true
+			openIndex = i
+		}
+	}
+	if len(open) > 0 {
+		closeOpen("the end of the transcript")
+	}
+
+	report.Valid = len(report.Problems) == 0
+	return report
+}
@@ -0,0 +1,160 @@
+package chat_engine
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// toolResponse is a tool response message
+func toolResponse(id, toolCallID string) *Message {
+	return &Message{ID: id, Role: "tool", Content: "output", TollCallID: toolCallID}
+}
+
+// toolCallMessage is an assistant message requesting tool calls with the given IDs
+func toolCallMessage(id string, toolCallIDs ...string) *Message {
+	msg := &Message{ID: id, Role: "assistant"}
+	for _, toolCallID := range toolCallIDs {
+		msg.ToolCalls = append(msg.ToolCalls, ToolCall{ID: toolCallID, Type: "function", Name: "shell", Arguments: "{}"})
+	}
+	return msg
+}
+
+func TestValidateTranscript(t *testing.T) {
+	user := func(id string) *Message { return &Message{ID: id, Role: "user", Content: "hi"} }
+
+	type problem struct {
+		index int
+		code  string
+	}
+	tests := []struct {
+		name     string
+		messages []*Message
+		want     []problem
+	}{
+		{
+			name:     "valid",
+			messages: []*Message{user("m1"), toolCallMessage("m2", "c1", "c2"), toolResponse("m3", "c1"), toolResponse("m4", "c2"), {ID: "m5", Role: "assistant", Content: "done"}},
+		},
+		{
+			name:     "orphaned tool call at the end",
+			messages: []*Message{user("m1"), toolCallMessage("m2", "c1", "c2"), toolResponse("m3", "c1")},
+			want:     []problem{{1, ProblemOrphanedToolCall}},
+		},
+		{
+			name:     "orphaned tool call before the next message",
+			messages: []*Message{user("m1"), toolCallMessage("m2", "c1"), user("m3")},
+			want:     []problem{{1, ProblemOrphanedToolCall}},
+		},
+		{
+			name:     "tool response without a call",
+			messages: []*Message{user("m1"), toolResponse("m2", "c1")},
+			want:     []problem{{1, ProblemOrphanedToolResult}},
+		},
+		{
+			name:     "tool response without a tool call ID",
+			messages: []*Message{user("m1"), toolResponse("m2", "")},
+			want:     []problem{{1, ProblemMissingToolCallID}},
+		},
+		{
+			name:     "unknown role",
+			messages: []*Message{user("m1"), {ID: "m2", Role: "robot", Content: "beep"}},
+			want:     []problem{{1, ProblemUnknownRole}},
+		},
+		{
+			name:     "duplicate message ID",
+			messages: []*Message{user("m1"), user("m1")},
+			want:     []problem{{1, ProblemDuplicateID}},
+		},
+		{
+			name:     "missing message ID",
+			messages: []*Message{user(""), nil},
+			want:     []problem{{0, ProblemMissingID}, {1, ProblemMissingID}},
+		},
+		{
+			name:     "duplicate tool call ID",
+			messages: []*Message{toolCallMessage("m1", "c1"), toolResponse("m2", "c1"), toolCallMessage("m3", "c1")},
+			want:     []problem{{2, ProblemDuplicateToolCall}},
+		},
+		{
+			name:     "response before the call",
+			messages: []*Message{user("m1"), toolResponse("m2", "c1"), toolCallMessage("m3", "c1"), toolResponse("m4", "c1")},
+			want:     []problem{{1, ProblemOutOfOrder}},
+		},
+		{
+			name:     "response after another message",
+			messages: []*Message{toolCallMessage("m1", "c1"), user("m2"), toolResponse("m3", "c1")},
+			want:     []problem{{0, ProblemOrphanedToolCall}, {2, ProblemOutOfOrder}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := ValidateTranscript(tt.messages)
+			var got []problem
+			for _, p := range report.Problems {
+				got = append(got, problem{p.MessageIndex, p.Code})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got problems %v, want %v", report.Problems, tt.want)
+			}
+			if report.Valid != (len(tt.want) == 0) {
+				t.Errorf("valid = %v with %d problems", report.Valid, len(report.Problems))
+			}
+		})
+	}
+}
+
+func TestImportConversation(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")))
+	transcript := &Conversation{
+		Title:        "imported",
+		SystemPrompt: "be brief",
+		Messages: []*Message{
+			{ID: "m1", Role: "user", Content: "list files"},
+			toolCallMessage("m2", "c1"),
+			toolResponse("m3", "c1"),
+			{ID: "m4", Role: "assistant", Content: "done"},
+		},
+	}
+
+	conv, err := engine.ImportConversation(transcript)
+	if err != nil {
+		t.Fatalf("ImportConversation: %v", err)
+	}
+	if conv.Title != "imported" || conv.SystemPrompt != "be brief" || len(conv.Messages) != 4 {
+		t.Fatalf("imported %q with %d messages, want the transcript", conv.Title, len(conv.Messages))
+	}
+	if conv.Messages[0].ID == "m1" || len(conv.Messages[1].ToolCalls) != 1 || conv.Messages[2].TollCallID != "c1" {
+		t.Errorf("messages imported as %+v %+v %+v", conv.Messages[0], conv.Messages[1], conv.Messages[2])
+	}
+
+	// The same transcript can be imported again under new IDs
+	if _, err := engine.ImportConversation(transcript); err != nil {
+		t.Errorf("importing again: %v", err)
+	}
+}
+
+func TestImportConversationRejectsInvalidTranscript(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")))
+	_, before, err := engine.db.ListConversationSummaries(1, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = engine.ImportConversation(&Conversation{Messages: []*Message{{ID: "m1", Role: "user"}, toolCallMessage("m2", "c1")}})
+	var invalid *InvalidTranscriptError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("got error %v, want an InvalidTranscriptError", err)
+	}
+	if len(invalid.Report.Problems) != 1 || invalid.Report.Problems[0].Code != ProblemOrphanedToolCall {
+		t.Errorf("got problems %v, want the orphaned tool call", invalid.Report.Problems)
+	}
+
+	_, after, err := engine.db.ListConversationSummaries(1, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after != before {
+		t.Errorf("%d conversations stored after a rejected import, want %d", after, before)
+	}
+}
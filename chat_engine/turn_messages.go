@@ -0,0 +1,50 @@
+package chat_engine
+
+import (
+	"log/slog"
+	"time"
+)
+
+// The messages of a turn are added to the conversation in memory as they are produced and
+// saved to the database in batches, one transaction each instead of one per message: before
+// every round of tool calls and when the turn ends. A server that crashes during a turn
+// keeps the assistant message requesting the running tool calls, so the turn can be
+// continued with ContinueTurn, and loses at most the tool responses of that round.
+
+// addTurnMessage adds a message to the conversation during a turn. It is saved by
+// saveTurnMessages.
+func (e *ChatEngine) addTurnMessage(conv *Conversation, msg *Message) {
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now().UTC()
+	}
+
+	e.conversationsMutex.Lock()
+	defer e.conversationsMutex.Unlock()
+	conv.Messages = append(conv.Messages, msg)
+	conv.UpdatedAt = msg.CreatedAt
+	if !conv.ephemeral {
+		e.unsavedMessages[conv.ID] = append(e.unsavedMessages[conv.ID], msg)
+	}
+}
+
+// saveTurnMessages saves the messages added with addTurnMessage that are not saved yet. They
+// are dropped when the conversation was deleted meanwhile, so that it isn't created again.
+func (e *ChatEngine) saveTurnMessages(conv *Conversation, logger *slog.Logger) {
+	e.conversationsMutex.Lock()
+	messages := e.unsavedMessages[conv.ID]
+	delete(e.unsavedMessages, conv.ID)
+	// Conversations with a running turn aren't evicted, one that isn't cached was deleted
+	deleted := e.conversations[conv.ID] != conv
+	e.conversationsMutex.Unlock()
+
+	if len(messages) == 0 {
+		return
+	}
+	if deleted {
+		logger.Info("Dropping messages of a deleted conversation", "messages", len(messages))
+		return
+	}
+	if err := e.db.SaveMessages(conv.ID, messages); err != nil {
+		logger.Error("Failed to save messages to database", "messages", len(messages), "error", err)
+	}
+}
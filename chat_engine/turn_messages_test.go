@@ -0,0 +1,40 @@
+package chat_engine
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestTurnMessagesAreSavedBeforeToolsRun(t *testing.T) {
+	var engine *ChatEngine
+	var stored *Conversation
+	tool := &funcTool{name: "probe", run: func(ctx context.Context, args json.RawMessage) (string, error) {
+		// What a restarted server would find while the tool runs
+		conv, err := engine.db.LoadConversation("conv")
+		stored = conv
+		return "probed", err
+	}}
+	provider := newFakeProvider(toolCallReply("call_1", "probe", `{}`), textReply("done"))
+	engine = newTestEngine(t, provider, WithTool(tool))
+
+	if _, err := engine.SendUserMessage("conv", "probe"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+
+	if stored == nil || len(stored.Messages) != 2 {
+		t.Fatalf("stored conversation while the tool ran is %+v, want the user message and the tool call", stored)
+	}
+	if last := stored.Messages[1]; last.Role != "assistant" || len(last.ToolCalls) != 1 || last.ToolCalls[0].ID != "call_1" {
+		t.Errorf("last stored message is %+v, want the assistant message calling the tool", last)
+	}
+
+	// The rest of the turn is saved when it ends
+	count, err := engine.db.CountMessages("conv")
+	if err != nil {
+		t.Fatalf("CountMessages: %v", err)
+	}
+	if count != 4 {
+		t.Errorf("stored %d messages after the turn, want 4", count)
+	}
+}
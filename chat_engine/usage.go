@@ -0,0 +1,108 @@
+package chat_engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UsageGroupBy selects how usage is aggregated
+type UsageGroupBy string
+
+const (
+	UsageGroupByDay   UsageGroupBy = "day"
+	UsageGroupByModel UsageGroupBy = "model"
+)
+
+// UsageBucket is the token usage and estimated cost of one day or one model
+type UsageBucket struct {
+	Day              string  `json:"day,omitempty"`
+	Model            string  `json:"model,omitempty"`
+	Requests         int64   `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	EstimatedCostUSD float64 `json:"estimated_cost_usd"`
+}
+
+// modelPrice is the list price in USD per million tokens
+type modelPrice struct {
+	Prompt     float64
+	Completion float64
+}
+
+// modelPrices are used for cost estimates. The API reports dated model names
+// (gpt-5-2025-08-07), so models are matched by the longest known prefix.
+// Models that are not listed count as free.
+var modelPrices = map[string]modelPrice{
+	"gpt-5":        {Prompt: 1.25, Completion: 10},
+	"gpt-5-mini":   {Prompt: 0.25, Completion: 2},
+	"gpt-5-nano":   {Prompt: 0.05, Completion: 0.4},
+	"gpt-4.1":      {Prompt: 2, Completion: 8},
+	"gpt-4.1-mini": {Prompt: 0.4, Completion: 1.6},
+	"gpt-4.1-nano": {Prompt: 0.1, Completion: 0.4},
+	"gpt-4o":       {Prompt: 2.5, Completion: 10},
+	"gpt-4o-mini":  {Prompt: 0.15, Completion: 0.6},
+}
+
+// estimateCost returns the estimated cost in USD of the given token counts for a model
+func estimateCost(model string, promptTokens, completionTokens int64) float64 {
+	var price modelPrice
+	matched := ""
+	for name, p := range modelPrices {
+		if strings.HasPrefix(model, name) && len(name) > len(matched) {
+			matched, price = name, p
+		}
+	}
+	return (float64(promptTokens)*price.Prompt + float64(completionTokens)*price.Completion) / 1e6
+}
+
+// Usage aggregates token usage and estimated cost of completions made in [from, to),
+// grouped by UTC day or by model
+func (e *ChatEngine) Usage(from, to time.Time, groupBy UsageGroupBy) ([]*UsageBucket, error) {
+	if groupBy != UsageGroupByDay && groupBy != UsageGroupByModel {
+		return nil, fmt.Errorf("unknown groupBy %q, use %q or %q", groupBy, UsageGroupByDay, UsageGroupByModel)
+	}
+
+	rows, err := e.db.UsageByDay(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cost depends on the model, so it is computed per day and model before merging
+	buckets := make(map[string]*UsageBucket)
+	for _, row := range rows {
+		key := row.Day
+		if groupBy == UsageGroupByModel {
+			key = row.Model
+		}
+		bucket, ok := buckets[key]
+		if !ok {
+			bucket = &UsageBucket{}
+			if groupBy == UsageGroupByModel {
+				bucket.Model = row.Model
+			} else {
+				bucket.Day = row.Day
+			}
+			buckets[key] = bucket
+		}
+		bucket.Requests += row.Requests
+		bucket.PromptTokens += row.PromptTokens
+		bucket.CompletionTokens += row.CompletionTokens
+		bucket.TotalTokens += row.PromptTokens + row.CompletionTokens
+		bucket.EstimatedCostUSD += estimateCost(row.Model, row.PromptTokens, row.CompletionTokens)
+	}
+
+	keys := make([]string, 0, len(buckets))
+	for key := range buckets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	usage := make([]*UsageBucket, 0, len(keys))
+	for _, key := range keys {
+		usage = append(usage, buckets[key])
+	}
+	return usage, nil
+}
@@ -0,0 +1,143 @@
+package chat_engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultWebSearchResults is how many results web_search returns unless asked for more
+	defaultWebSearchResults = 5
+	maxWebSearchResults     = 20
+	// webSearchTimeout bounds a search request
+	webSearchTimeout = 15 * time.Second
+
+	// DefaultBraveSearchEndpoint is the Brave Search web search API
+	DefaultBraveSearchEndpoint = "https://api.search.brave.com/res/v1/web/search"
+)
+
+// WebSearchResult is a page found by a web search
+type WebSearchResult struct {
+	Title   string `json:"title"`
+	URL     string `json:"url"`
+	Snippet string `json:"snippet"`
+}
+
+// WebSearchProvider is a search engine backing the web_search tool
+type WebSearchProvider interface {
+	Search(ctx context.Context, query string, count int) ([]WebSearchResult, error)
+}
+
+// WithWebSearch enables the web_search tool, backed by provider. Without it the tool is not
+// offered to the model.
+func WithWebSearch(provider WebSearchProvider) Option {
+	return func(e *ChatEngine) {
+		e.webSearch = provider
+	}
+}
+
+// webSearch runs the web_search tool and formats the results for the model
+func webSearch(ctx context.Context, provider WebSearchProvider, query string, count int) (string, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return "", fmt.Errorf("query is empty")
+	}
+	if count <= 0 {
+		count = defaultWebSearchResults
+	}
+	count = min(count, maxWebSearchResults)
+
+	ctx, cancel := context.WithTimeout(ctx, webSearchTimeout)
+	defer cancel()
+	results, err := provider.Search(ctx, query, count)
+	if err != nil {
+		return "", err
+	}
+	if len(results) == 0 {
+		return fmt.Sprintf("No results for %q", query), nil
+	}
+
+	var b strings.Builder
+	for i, result := range results[:min(len(results), count)] {
+		fmt.Fprintf(&b, "%d. %s\n   %s\n", i+1, result.Title, result.URL)
+		if result.Snippet != "" {
+			fmt.Fprintf(&b, "   %s\n", result.Snippet)
+		}
+	}
+	return strings.TrimRight(b.String(), "\n"), nil
+}
+
+// BraveSearchProvider searches with the Brave Search API, or an API compatible with it
+type BraveSearchProvider struct {
+	endpoint string
+	apiKey   string
+	client   *http.Client
+}
+
+// NewBraveSearchProvider creates a provider using apiKey. An empty endpoint uses
+// DefaultBraveSearchEndpoint.
+func NewBraveSearchProvider(endpoint, apiKey string) *BraveSearchProvider {
+	if endpoint == "" {
+		endpoint = DefaultBraveSearchEndpoint
+	}
+	return &BraveSearchProvider{endpoint: endpoint, apiKey: apiKey, client: &http.Client{}}
+}
+
+func (p *BraveSearchProvider) Search(ctx context.Context, query string, count int) ([]WebSearchResult, error) {
+	u, err := url.Parse(p.endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid search endpoint: %w", err)
+	}
+	params := u.Query()
+	params.Set("q", query)
+	params.Set("count", strconv.Itoa(count))
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Subscription-Token", p.apiKey)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("search request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("search API returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var response struct {
+		Web struct {
+			Results []struct {
+				Title       string `json:"title"`
+				URL         string `json:"url"`
+				Description string `json:"description"`
+			} `json:"results"`
+		} `json:"web"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("invalid search API response: %w", err)
+	}
+
+	results := make([]WebSearchResult, 0, len(response.Web.Results))
+	for _, result := range response.Web.Results {
+		results = append(results, WebSearchResult{
+			Title:   result.Title,
+			URL:     result.URL,
+			Snippet: result.Description,
+		})
+	}
+	return results, nil
+}
@@ -0,0 +1,89 @@
+package chat_engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// braveSearchServer returns a fake Brave Search API that answers every query with results, and
+// the query parameters of the last search
+func braveSearchServer(t *testing.T, results string) (*httptest.Server, *url.Values) {
+	t.Helper()
+	var last url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		last = r.URL.Query()
+		if r.Header.Get("X-Subscription-Token") != "search-key" {
+			http.Error(w, `{"error": "invalid token"}`, http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"web": {"results": ` + results + `}}`))
+	}))
+	t.Cleanup(server.Close)
+	return server, &last
+}
+
+func TestWebSearchTool(t *testing.T) {
+	server, last := braveSearchServer(t, `[
+		{"title": "The Go Programming Language", "url": "https://go.dev/", "description": "Go is an open source language."},
+		{"title": "Go on Wikipedia", "url": "https://en.wikipedia.org/wiki/Go_(programming_language)"}
+	]`)
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")), WithWebSearch(NewBraveSearchProvider(server.URL, "search-key")))
+
+	output := callTool(t, engine, "conv", "web_search", `{"query": "golang", "count": 2}`)
+	want := "1. The Go Programming Language\n   https://go.dev/\n   Go is an open source language.\n" +
+		"2. Go on Wikipedia\n   https://en.wikipedia.org/wiki/Go_(programming_language)"
+	if output != want {
+		t.Errorf("output is\n%s\nwant\n%s", output, want)
+	}
+	if q, count := last.Get("q"), last.Get("count"); q != "golang" || count != "2" {
+		t.Errorf("searched q=%q count=%q, want golang and 2", q, count)
+	}
+}
+
+func TestWebSearchToolDefaultsAndCapsCount(t *testing.T) {
+	server, last := braveSearchServer(t, `[]`)
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")), WithWebSearch(NewBraveSearchProvider(server.URL, "search-key")))
+
+	if output := callTool(t, engine, "conv", "web_search", `{"query": "nothing"}`); output != `No results for "nothing"` {
+		t.Errorf("output is %q, want no results", output)
+	}
+	if got := last.Get("count"); got != "5" {
+		t.Errorf("searched for %s results, want the default of 5", got)
+	}
+	callTool(t, engine, "conv", "web_search", `{"query": "everything", "count": 1000}`)
+	if got := last.Get("count"); got != "20" {
+		t.Errorf("searched for %s results, want at most 20", got)
+	}
+}
+
+func TestWebSearchToolReportsErrors(t *testing.T) {
+	server, _ := braveSearchServer(t, `[]`)
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")), WithWebSearch(NewBraveSearchProvider(server.URL, "wrong-key")))
+
+	output := callTool(t, engine, "conv", "web_search", `{"query": "golang"}`)
+	if !strings.Contains(output, "Error searching the web") || !strings.Contains(output, "status 401") {
+		t.Errorf("output is %q, want the API's status", output)
+	}
+	if output := callTool(t, engine, "conv", "web_search", `{"query": "  "}`); !strings.Contains(output, "query is empty") {
+		t.Errorf("output for an empty query is %q", output)
+	}
+}
+
+func TestWebSearchToolOnlyOfferedWithProvider(t *testing.T) {
+	engine := newTestEngine(t, newFakeProvider(textReply("unused")))
+	engine.GetOrCreateConversation("conv")
+	if names := toolNames(engine.GetConversationContext("conv").Tools); slices.Contains(names, "web_search") {
+		t.Errorf("engine without a search provider offers %v", names)
+	}
+
+	engine = newTestEngine(t, newFakeProvider(textReply("unused")), WithWebSearch(NewBraveSearchProvider("", "search-key")))
+	engine.GetOrCreateConversation("conv")
+	if names := toolNames(engine.GetConversationContext("conv").Tools); !slices.Contains(names, "web_search") {
+		t.Errorf("engine with a search provider offers %v, want web_search", names)
+	}
+}
@@ -0,0 +1,176 @@
+package chat_engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// webhookAttempts is how often a webhook is tried before giving up
+	webhookAttempts = 5
+	// webhookBackoff is the delay before the first retry, doubled for every further one
+	webhookBackoff = time.Second
+	// webhookTimeout bounds each attempt
+	webhookTimeout = 10 * time.Second
+)
+
+// Turn statuses reported by webhooks
+const (
+	TurnCompleted        = "completed"
+	TurnPartial          = "partial"
+	TurnAwaitingApproval = "awaiting_approval"
+	TurnCanceled         = "canceled"
+	TurnFailed           = "failed"
+)
+
+// WebhookEvent is the payload POSTed to webhooks once a turn ended
+type WebhookEvent struct {
+	Event          string `json:"event"`
+	ConversationID string `json:"conversation_id"`
+	// One of TurnCompleted, TurnPartial, TurnAwaitingApproval, TurnCanceled or TurnFailed
+	Status           string     `json:"status"`
+	Error            string     `json:"error,omitempty"`
+	Messages         []*Message `json:"messages"`
+	PendingToolCalls []ToolCall `json:"pending_tool_calls,omitempty"`
+	Timestamp        time.Time  `json:"timestamp"`
+}
+
+// WithWebhookURL sets a webhook notified when any conversation's turn ends, in addition to
+// the conversation's own webhook, see SetWebhookURL
+func WithWebhookURL(url string) Option {
+	return func(e *ChatEngine) {
+		e.webhookURL = url
+	}
+}
+
+// ValidateWebhookURL checks that a webhook URL is an absolute http or https URL
+func ValidateWebhookURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q: must be an http or https URL", value)
+	}
+	return nil
+}
+
+// SetWebhookURL sets the webhook notified when a turn of the conversation ends, creating the
+// conversation if needed. An empty URL removes it.
+func (e *ChatEngine) SetWebhookURL(conversationID, webhookURL string) error {
+	webhookURL = strings.TrimSpace(webhookURL)
+	if webhookURL != "" {
+		if err := ValidateWebhookURL(webhookURL); err != nil {
+			return err
+		}
+	}
+
+	conv := e.GetOrCreateConversation(conversationID)
+	if err := e.db.UpdateConversationWebhookURL(conversationID, webhookURL); err != nil {
+		return err
+	}
+
+	e.conversationsMutex.Lock()
+	conv.WebhookURL = webhookURL
+	conv.UpdatedAt = time.Now().UTC()
+	e.conversationsMutex.Unlock()
+	return nil
+}
+
+// notifyTurnEnded sends the messages of a turn and how it ended to the global webhook and the
+// conversation's webhook. Delivery happens in the background.
+func (e *ChatEngine) notifyTurnEnded(conv *Conversation, messages []*Message, turnErr error) {
+	var urls []string
+	for _, webhookURL := range []string{e.webhookURL, conv.WebhookURL} {
+		if webhookURL != "" && (len(urls) == 0 || urls[0] != webhookURL) {
+			urls = append(urls, webhookURL)
+		}
+	}
+	if len(urls) == 0 {
+		return
+	}
+
+	event := WebhookEvent{
+		Event:          "turn.completed",
+		ConversationID: conv.ID,
+		Status:         TurnCompleted,
+		Messages:       messages,
+		Timestamp:      time.Now().UTC(),
+	}
+	if event.Messages == nil {
+		event.Messages = make([]*Message, 0)
+	}
+	var limitErr *IterationLimitError
+	var approvalErr *ApprovalRequiredError
+	switch {
+	case errors.As(turnErr, &limitErr):
+		event.Status = TurnPartial
+		event.Error = limitErr.Error()
+	case errors.As(turnErr, &approvalErr):
+		event.Status = TurnAwaitingApproval
+		event.PendingToolCalls = approvalErr.ToolCalls
+	case errors.Is(turnErr, ErrTurnCanceled):
+		event.Status = TurnCanceled
+	case turnErr != nil:
+		event.Status = TurnFailed
+		event.Error = turnErr.Error()
+	}
+
+	// Encoded now, as the messages may change once the next turn starts
+	payload, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Failed to encode webhook event", "conversation_id", conv.ID, "error", err)
+		return
+	}
+	for _, webhookURL := range urls {
+		go deliverWebhook(webhookURL, payload, conv.ID)
+	}
+}
+
+// deliverWebhook POSTs payload to url, retrying with exponential backoff until it gets a 2xx
+// response or runs out of attempts
+func deliverWebhook(url string, payload []byte, conversationID string) {
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err := postWebhook(url, payload)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			slog.Error("Giving up on webhook", "url", url, "conversation_id", conversationID, "attempts", attempt, "error", err)
+			return
+		}
+		slog.Warn("Webhook failed, retrying", "url", url, "conversation_id", conversationID, "attempt", attempt, "retry_in", backoff.String(), "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// postWebhook makes a single delivery attempt
+func postWebhook(url string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "agent-webhook")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package chat_engine
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a test server recording the webhook events it gets. It fails the first
+// failures requests with 500.
+func webhookReceiver(t *testing.T, failures int64) (*httptest.Server, <-chan WebhookEvent, *atomic.Int64) {
+	t.Helper()
+	events := make(chan WebhookEvent, 10)
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := requests.Add(1); n <= failures {
+			http.Error(w, "try again", http.StatusInternalServerError)
+			return
+		}
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook request is %s with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		var event WebhookEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("invalid webhook payload %s: %v", body, err)
+		}
+		events <- event
+	}))
+	t.Cleanup(server.Close)
+	return server, events, &requests
+}
+
+// receiveEvent waits for a webhook event
+func receiveEvent(t *testing.T, events <-chan WebhookEvent, timeout time.Duration) WebhookEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(timeout):
+		t.Fatal("no webhook event arrived")
+		return WebhookEvent{}
+	}
+}
+
+func TestWebhookPayload(t *testing.T) {
+	server, events, _ := webhookReceiver(t, 0)
+	engine := newTestEngine(t, newFakeProvider(textReply("hello there")), WithWebhookURL(server.URL))
+
+	if _, err := engine.SendUserMessage("conv", "hi"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+
+	event := receiveEvent(t, events, 5*time.Second)
+	if event.Event != "turn.completed" || event.ConversationID != "conv" || event.Status != TurnCompleted {
+		t.Errorf("event = %s for %s with status %s, want turn.completed for conv with status completed", event.Event, event.ConversationID, event.Status)
+	}
+	if len(event.Messages) != 2 || event.Messages[0].Content != "hi" || event.Messages[1].Content != "hello there" {
+		t.Errorf("event messages = %+v, want the turn's user message and reply", event.Messages)
+	}
+	if event.Timestamp.IsZero() {
+		t.Error("event has no timestamp")
+	}
+}
+
+func TestWebhookReportsFailedTurn(t *testing.T) {
+	server, events, _ := webhookReceiver(t, 0)
+	provider := &fakeProvider{reply: func(n int, req CompletionRequest) (*Message, error) {
+		return nil, errors.New("model unavailable")
+	}}
+	engine := newTestEngine(t, provider, WithWebhookURL(server.URL), WithMaxCompletionAttempts(1))
+
+	if _, err := engine.SendUserMessage("conv", "hi"); err == nil {
+		t.Fatal("SendUserMessage succeeded without a model")
+	}
+	event := receiveEvent(t, events, 5*time.Second)
+	if event.Status != TurnFailed || event.Error == "" {
+		t.Errorf("event status = %s with error %q, want failed with the error", event.Status, event.Error)
+	}
+}
+
+func TestWebhookRetriesFailedDelivery(t *testing.T) {
+	server, events, requests := webhookReceiver(t, 1)
+	engine := newTestEngine(t, newFakeProvider(textReply("hello there")), WithWebhookURL(server.URL))
+
+	if _, err := engine.SendUserMessage("conv", "hi"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+	event := receiveEvent(t, events, webhookBackoff+5*time.Second)
+	if event.ConversationID != "conv" {
+		t.Errorf("retried event is for %q, want conv", event.ConversationID)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("webhook got %d requests, want the failed one and the retry", n)
+	}
+}
+
+func TestConversationWebhook(t *testing.T) {
+	global, globalEvents, _ := webhookReceiver(t, 0)
+	own, ownEvents, _ := webhookReceiver(t, 0)
+	engine := newTestEngine(t, newFakeProvider(textReply("hello there")), WithWebhookURL(global.URL))
+
+	if err := engine.SetWebhookURL("conv", "ftp://example.com"); err == nil {
+		t.Error("a non-HTTP webhook URL was accepted")
+	}
+	if err := engine.SetWebhookURL("conv", own.URL); err != nil {
+		t.Fatalf("SetWebhookURL: %v", err)
+	}
+	if _, err := engine.SendUserMessage("conv", "hi"); err != nil {
+		t.Fatalf("SendUserMessage: %v", err)
+	}
+
+	// Both the global and the conversation's webhook are notified
+	receiveEvent(t, globalEvents, 5*time.Second)
+	receiveEvent(t, ownEvents, 5*time.Second)
+}
@@ -0,0 +1,76 @@
+package chat_engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// SetWorkingDir sets the default directory tools run in for a conversation. Relative paths are
+// resolved against the workspace root and the directory must be inside it.
+func (e *ChatEngine) SetWorkingDir(conversationID, dir string) (string, error) {
+	resolved, err := e.resolveDir(e.workspaceRoot, dir)
+	if err != nil {
+		return "", err
+	}
+
+	e.workingDirsMutex.Lock()
+	e.workingDirs[conversationID] = resolved
+	e.workingDirsMutex.Unlock()
+	return resolved, nil
+}
+
+// WorkingDir returns the directory tools run in by default for a conversation
+func (e *ChatEngine) WorkingDir(conversationID string) string {
+	e.workingDirsMutex.RLock()
+	dir, ok := e.workingDirs[conversationID]
+	e.workingDirsMutex.RUnlock()
+	if ok {
+		return dir
+	}
+
+	root, err := filepath.Abs(e.workspaceRoot)
+	if err != nil {
+		return e.workspaceRoot
+	}
+	return root
+}
+
+// toolDir resolves a directory requested by a tool call, relative to the conversation's
+// working directory, defaulting to the working directory itself
+func (e *ChatEngine) toolDir(conv *Conversation, dir string) (string, error) {
+	base := e.WorkingDir(conv.ID)
+	if dir == "" {
+		return base, nil
+	}
+	return e.resolveDir(base, dir)
+}
+
+// toolPath makes a path from a tool call relative to the conversation's working directory.
+// The result still has to be checked against the workspace root.
+func (e *ChatEngine) toolPath(conv *Conversation, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(e.WorkingDir(conv.ID), path)
+}
+
+// resolveDir resolves dir against base and checks it is an existing directory inside the workspace root
+func (e *ChatEngine) resolveDir(base, dir string) (string, error) {
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(base, dir)
+	}
+	resolved, err := resolveWorkspacePath(e.workspaceRoot, dir)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", fmt.Errorf("working directory %s does not exist", dir)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	return resolved, nil
+}
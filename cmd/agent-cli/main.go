@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	neturl "net/url"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -27,12 +30,63 @@ var helloCmd = &cobra.Command{
 	},
 }
 
+// jsonOutput makes commands print the API's JSON response instead of formatted text
+var jsonOutput bool
+
+// printJSON writes a JSON response body to stdout, ending with a newline
+func printJSON(body []byte) error {
+	body = bytes.TrimSpace(body)
+	if !json.Valid(body) {
+		return fmt.Errorf("API returned invalid JSON: %s", string(body))
+	}
+	_, err := fmt.Println(string(body))
+	return err
+}
+
+// apiToken is sent as a bearer token with every request when set
+var apiToken string
+
+// apiRequest sends a request to the agent API, authenticated with apiToken
+func apiRequest(method, url string, body io.Reader) (*http.Response, error) {
+	req, err := newAPIRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// newAPIRequest creates a request to the agent API, authenticated with apiToken, for callers
+// that set more headers
+func newAPIRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if apiToken != "" {
+		req.Header.Set("Authorization", "Bearer "+apiToken)
+	}
+	return req, nil
+}
+
 var (
 	message        string
 	conversationID string
+	streamResponse bool
 	serverURL      string
 	getConvID      string
 	listConvURL    string
+	listConvLimit  int
+	listConvOffset int
+	listConvTag    string
+	searchQuery    string
+	searchLimit    int
+	exportConvID   string
+	exportFormat   string
+	exportOutput   string
+	killPID        int
 )
 
 var sendMessageCmd = &cobra.Command{
@@ -57,6 +111,10 @@ var sendMessageCmd = &cobra.Command{
 			reqBody["conversationId"] = conversationID
 		}
 
+		if streamResponse {
+			return sendMessageStream(os.Stdout, serverURL, reqBody, jsonOutput)
+		}
+
 		jsonData, err := json.Marshal(reqBody)
 		if err != nil {
 			return fmt.Errorf("failed to marshal request: %w", err)
@@ -64,7 +122,7 @@ var sendMessageCmd = &cobra.Command{
 
 		// Make HTTP request
 		url := serverURL + "/api/chat"
-		resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+		resp, err := apiRequest(http.MethodPost, url, bytes.NewBuffer(jsonData))
 		if err != nil {
 			return fmt.Errorf("failed to send request: %w", err)
 		}
@@ -81,6 +139,10 @@ var sendMessageCmd = &cobra.Command{
 			return fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
 		}
 
+		if jsonOutput {
+			return printJSON(body)
+		}
+
 		// Parse and display response
 		var apiResponse struct {
 			Messages []struct {
@@ -146,7 +208,7 @@ var getConvCmd = &cobra.Command{
 
 		// Make HTTP GET request
 		apiURL := url + "/api/conversations/" + getConvID
-		resp, err := http.Get(apiURL)
+		resp, err := apiRequest(http.MethodGet, apiURL, nil)
 		if err != nil {
 			return fmt.Errorf("failed to send request: %w", err)
 		}
@@ -163,6 +225,10 @@ var getConvCmd = &cobra.Command{
 			return fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
 		}
 
+		if jsonOutput {
+			return printJSON(body)
+		}
+
 		// Parse and display response
 		var conversation struct {
 			ID       string `json:"id"`
@@ -220,8 +286,8 @@ var getConvCmd = &cobra.Command{
 
 var listConvCmd = &cobra.Command{
 	Use:   "list-conv",
-	Short: "List all conversations",
-	Long:  `Retrieve a list of all conversations from the agent API server.`,
+	Short: "List conversations",
+	Long:  `Retrieve a page of conversations from the agent API server, most recently updated first.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		// Default server URL if not provided
 		url := listConvURL
@@ -230,8 +296,11 @@ var listConvCmd = &cobra.Command{
 		}
 
 		// Make HTTP GET request
-		apiURL := url + "/api/conversations"
-		resp, err := http.Get(apiURL)
+		apiURL := fmt.Sprintf("%s/api/conversations?limit=%d&offset=%d", url, listConvLimit, listConvOffset)
+		if listConvTag != "" {
+			apiURL += "&tag=" + neturl.QueryEscape(listConvTag)
+		}
+		resp, err := apiRequest(http.MethodGet, apiURL, nil)
 		if err != nil {
 			return fmt.Errorf("failed to send request: %w", err)
 		}
@@ -248,47 +317,321 @@ var listConvCmd = &cobra.Command{
 			return fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
 		}
 
+		if jsonOutput {
+			return printJSON(body)
+		}
+
 		// Parse and display response
-		var conversations []struct {
-			ID       string `json:"id"`
-			Messages []struct {
-				ID      string `json:"ID"`
-				Role    string `json:"role"`
-				Content string `json:"content"`
-			} `json:"messages"`
+		var page struct {
+			Conversations []struct {
+				ID           string `json:"id"`
+				Title        string   `json:"title"`
+				Tags         []string `json:"tags"`
+				ParentID     string   `json:"parent_id"`
+				MessageCount int      `json:"message_count"`
+				UpdatedAt    string   `json:"updated_at"`
+			} `json:"conversations"`
+			Total  int `json:"total"`
+			Offset int `json:"offset"`
 		}
 
-		if err := json.Unmarshal(body, &conversations); err != nil {
+		if err := json.Unmarshal(body, &page); err != nil {
 			// If JSON parsing fails, just print the raw response
 			fmt.Println(string(body))
 			return nil
 		}
 
 		// Display conversations
-		if len(conversations) == 0 {
-			fmt.Println("No conversations found.")
+		if len(page.Conversations) == 0 {
+			if page.Total > 0 {
+				fmt.Printf("No conversations at offset %d (%d in total).\n", page.Offset, page.Total)
+			} else {
+				fmt.Println("No conversations found.")
+			}
+			return nil
+		}
+
+		fmt.Printf("Showing %d-%d of %d conversation(s):\n\n", page.Offset+1, page.Offset+len(page.Conversations), page.Total)
+		for i, conv := range page.Conversations {
+			title := conv.Title
+			if title == "" {
+				title = "(untitled)"
+			}
+			fmt.Printf("%d. %s - Conversation ID: %s (%d messages, updated %s)\n", page.Offset+i+1, title, conv.ID, conv.MessageCount, conv.UpdatedAt)
+			if len(conv.Tags) > 0 {
+				fmt.Printf("   Tags: %s\n", strings.Join(conv.Tags, ", "))
+			}
+			if conv.ParentID != "" {
+				fmt.Printf("   Forked from: %s\n", conv.ParentID)
+			}
+		}
+
+		if next := page.Offset + len(page.Conversations); next < page.Total {
+			fmt.Printf("\nMore conversations available, use --offset %d to see the next page.\n", next)
+		}
+
+		return nil
+	},
+}
+
+var searchCmd = &cobra.Command{
+	Use:   "search",
+	Short: "Search messages across conversations",
+	Long:  `Find user and assistant messages containing every word of the query across all conversations.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if searchQuery == "" {
+			return fmt.Errorf("query is required")
+		}
+
+		// Default server URL if not provided
+		if serverURL == "" {
+			serverURL = "http://localhost:8080"
+		}
+
+		// Make HTTP GET request
+		params := neturl.Values{}
+		params.Set("q", searchQuery)
+		params.Set("limit", fmt.Sprint(searchLimit))
+		resp, err := apiRequest(http.MethodGet, serverURL+"/api/search?"+params.Encode(), nil)
+		if err != nil {
+			return fmt.Errorf("failed to send request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		// Read response
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("failed to read response: %w", err)
+		}
+
+		// Check status code
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+		}
+
+		if jsonOutput {
+			return printJSON(body)
+		}
+
+		// Parse and display response
+		var results []struct {
+			ConversationID string `json:"conversation_id"`
+			MessageID      string `json:"message_id"`
+			Role           string `json:"role"`
+			Snippet        string `json:"snippet"`
+		}
+
+		if err := json.Unmarshal(body, &results); err != nil {
+			// If JSON parsing fails, just print the raw response
+			fmt.Println(string(body))
+			return nil
+		}
+
+		if len(results) == 0 {
+			fmt.Println("No matching messages found.")
 			return nil
 		}
 
-		fmt.Printf("Found %d conversation(s):\n\n", len(conversations))
-		for i, conv := range conversations {
-			fmt.Printf("%d. Conversation ID: %s (%d messages)\n", i+1, conv.ID, len(conv.Messages))
+		fmt.Printf("Found %d matching message(s):\n\n", len(results))
+		for i, result := range results {
+			fmt.Printf("%d. Conversation %s [%s] %s: %s\n", i+1, result.ConversationID, result.MessageID, result.Role, result.Snippet)
 		}
 
 		return nil
 	},
 }
 
+var exportConvCmd = &cobra.Command{
+	Use:   "export-conv",
+	Short: "Export a conversation to a file",
+	Long:  `Export a conversation as Markdown or JSON and write it to a file.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if exportConvID == "" {
+			return fmt.Errorf("conversation ID is required")
+		}
+
+		// Default server URL if not provided
+		if serverURL == "" {
+			serverURL = "http://localhost:8080"
+		}
+
+		// Make HTTP GET request
+		params := neturl.Values{}
+		params.Set("format", exportFormat)
+		apiURL := serverURL + "/api/conversations/" + neturl.PathEscape(exportConvID) + "/export?" + params.Encode()
+		resp, err := apiRequest(http.MethodGet, apiURL, nil)
+		if err != nil {
+			return fmt.Errorf("failed to send request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		// Read response
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("failed to read response: %w", err)
+		}
+
+		// Check status code
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+		}
+
+		output := exportOutput
+		if output == "" {
+			extension := exportFormat
+			if exportFormat == "markdown" {
+				extension = "md"
+			}
+			output = exportConvID + "." + extension
+		}
+		if err := os.WriteFile(output, body, 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", output, err)
+		}
+
+		fmt.Printf("Exported conversation %s to %s\n", exportConvID, output)
+		return nil
+	},
+}
+
+var listProcessesCmd = &cobra.Command{
+	Use:   "list-processes",
+	Short: "List background processes",
+	Long:  `List the background processes started by the agent that are still running.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Default server URL if not provided
+		if serverURL == "" {
+			serverURL = "http://localhost:8080"
+		}
+
+		// Make HTTP GET request
+		resp, err := apiRequest(http.MethodGet, serverURL+"/api/processes", nil)
+		if err != nil {
+			return fmt.Errorf("failed to send request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		// Read response
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("failed to read response: %w", err)
+		}
+
+		// Check status code
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+		}
+
+		if jsonOutput {
+			return printJSON(body)
+		}
+
+		// Parse and display response
+		var processes []struct {
+			PID            int       `json:"pid"`
+			Command        string    `json:"command"`
+			StartTime      time.Time `json:"start_time"`
+			ConversationID string    `json:"conversation_id"`
+			Usage          *struct {
+				CPUPercent float64 `json:"cpu_percent"`
+				RSSBytes   int64   `json:"rss_bytes"`
+			} `json:"usage"`
+		}
+
+		if err := json.Unmarshal(body, &processes); err != nil {
+			// If JSON parsing fails, just print the raw response
+			fmt.Println(string(body))
+			return nil
+		}
+
+		if len(processes) == 0 {
+			fmt.Println("No background processes running.")
+			return nil
+		}
+
+		fmt.Printf("Running processes (%d):\n\n", len(processes))
+		for _, proc := range processes {
+			conversation := proc.ConversationID
+			if conversation == "" {
+				conversation = "-"
+			}
+			duration := time.Since(proc.StartTime).Round(time.Second)
+			usage := ""
+			if proc.Usage != nil {
+				usage = fmt.Sprintf(" | CPU: %.1f%% | Memory: %.1f MB", proc.Usage.CPUPercent, float64(proc.Usage.RSSBytes)/(1<<20))
+			}
+			fmt.Printf("PID: %d | Command: %s | Conversation: %s | Running for: %s%s\n", proc.PID, proc.Command, conversation, duration, usage)
+		}
+
+		return nil
+	},
+}
+
+var killProcessCmd = &cobra.Command{
+	Use:   "kill-process",
+	Short: "Kill a background process",
+	Long:  `Kill a background process started by the agent, together with the processes it started.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if killPID <= 0 {
+			return fmt.Errorf("a valid PID is required")
+		}
+
+		// Default server URL if not provided
+		if serverURL == "" {
+			serverURL = "http://localhost:8080"
+		}
+
+		// Make HTTP POST request
+		resp, err := apiRequest(http.MethodPost, fmt.Sprintf("%s/api/processes/%d/kill", serverURL, killPID), nil)
+		if err != nil {
+			return fmt.Errorf("failed to send request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		// Read response
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("failed to read response: %w", err)
+		}
+
+		// Check status code
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("API returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		}
+
+		if jsonOutput {
+			return printJSON(body)
+		}
+
+		var result struct {
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil || result.Message == "" {
+			fmt.Println(string(body))
+			return nil
+		}
+		fmt.Println(result.Message)
+		return nil
+	},
+}
+
 func init() {
+	rootCmd.PersistentFlags().BoolVar(&jsonOutput, "json", false, "Print JSON responses instead of formatted text")
+	rootCmd.PersistentFlags().StringVar(&apiToken, "token", os.Getenv("AGENT_API_TOKEN"), "API token (default from AGENT_API_TOKEN)")
+
 	rootCmd.AddCommand(helloCmd)
 	rootCmd.AddCommand(sendMessageCmd)
 	rootCmd.AddCommand(getConvCmd)
 	rootCmd.AddCommand(listConvCmd)
+	rootCmd.AddCommand(searchCmd)
+	rootCmd.AddCommand(exportConvCmd)
+	rootCmd.AddCommand(listProcessesCmd)
+	rootCmd.AddCommand(killProcessCmd)
 
 	// Flags for send_message command
 	sendMessageCmd.Flags().StringVarP(&message, "message", "m", "", "Message to send to the agent (required)")
 	sendMessageCmd.Flags().StringVarP(&conversationID, "conversation-id", "c", "", "Conversation ID (optional)")
 	sendMessageCmd.Flags().StringVarP(&serverURL, "server", "s", "http://localhost:8080", "Server URL")
+	sendMessageCmd.Flags().BoolVar(&streamResponse, "stream", false, "Print messages and tool output as they arrive")
 
 	sendMessageCmd.MarkFlagRequired("message")
 
@@ -299,6 +642,30 @@ func init() {
 
 	// Flags for list-conv command
 	listConvCmd.Flags().StringVarP(&listConvURL, "server", "s", "http://localhost:8080", "Server URL")
+	listConvCmd.Flags().IntVarP(&listConvLimit, "limit", "l", 20, "Maximum number of conversations to list")
+	listConvCmd.Flags().IntVarP(&listConvOffset, "offset", "o", 0, "Number of conversations to skip")
+	listConvCmd.Flags().StringVarP(&listConvTag, "tag", "t", "", "Only list conversations with this tag")
+
+	// Flags for search command
+	searchCmd.Flags().StringVarP(&searchQuery, "query", "q", "", "Words to search for (required)")
+	searchCmd.Flags().IntVarP(&searchLimit, "limit", "l", 20, "Maximum number of results")
+	searchCmd.Flags().StringVarP(&serverURL, "server", "s", "http://localhost:8080", "Server URL")
+	searchCmd.MarkFlagRequired("query")
+
+	// Flags for export-conv command
+	exportConvCmd.Flags().StringVarP(&exportConvID, "id", "i", "", "Conversation ID (required)")
+	exportConvCmd.Flags().StringVarP(&exportFormat, "format", "f", "markdown", "Export format: markdown or json")
+	exportConvCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "Output file (default <id>.md or <id>.json)")
+	exportConvCmd.Flags().StringVarP(&serverURL, "server", "s", "http://localhost:8080", "Server URL")
+	exportConvCmd.MarkFlagRequired("id")
+
+	// Flags for list-processes command
+	listProcessesCmd.Flags().StringVarP(&serverURL, "server", "s", "http://localhost:8080", "Server URL")
+
+	// Flags for kill-process command
+	killProcessCmd.Flags().IntVarP(&killPID, "pid", "p", 0, "PID of the process to kill (required)")
+	killProcessCmd.Flags().StringVarP(&serverURL, "server", "s", "http://localhost:8080", "Server URL")
+	killProcessCmd.MarkFlagRequired("pid")
 }
 
 func main() {
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runCLI runs the CLI with args and returns what it printed to stdout
+func runCLI(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	// Flags keep their values between runs
+	jsonOutput = false
+	killPID = 0
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+	printed := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		printed <- string(data)
+	}()
+
+	rootCmd.SetArgs(args)
+	err = rootCmd.Execute()
+	writer.Close()
+	return <-printed, err
+}
+
+func TestListProcesses(t *testing.T) {
+	started := time.Now().Add(-90 * time.Second).UTC().Format(time.RFC3339Nano)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/processes" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `[{"pid": 42, "command": "sleep 30", "start_time": %q, "conversation_id": "conv",
+			"usage": {"cpu_percent": 1.5, "rss_bytes": 2097152}},
+			{"pid": 43, "command": "make", "start_time": %q}]`, started, started)
+	}))
+	defer server.Close()
+
+	out, err := runCLI(t, "list-processes", "--server", server.URL)
+	if err != nil {
+		t.Fatalf("list-processes: %v", err)
+	}
+	want := "Running processes (2):\n\n" +
+		"PID: 42 | Command: sleep 30 | Conversation: conv | Running for: 1m30s | CPU: 1.5% | Memory: 2.0 MB\n" +
+		"PID: 43 | Command: make | Conversation: - | Running for: 1m30s\n"
+	if out != want {
+		t.Errorf("printed\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestKillProcess(t *testing.T) {
+	var killed []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/processes/42/kill" {
+			http.Error(w, "Process not found", http.StatusNotFound)
+			return
+		}
+		killed = append(killed, r.URL.Path)
+		fmt.Fprint(w, `{"message": "Process 42 killed", "pid": 42}`)
+	}))
+	defer server.Close()
+
+	out, err := runCLI(t, "kill-process", "--pid", "42", "--server", server.URL)
+	if err != nil {
+		t.Fatalf("kill-process: %v", err)
+	}
+	if out != "Process 42 killed\n" || len(killed) != 1 {
+		t.Errorf("printed %q after %d requests, want the server's message after one", out, len(killed))
+	}
+
+	_, err = runCLI(t, "kill-process", "--pid", "7", "--server", server.URL)
+	if err == nil || !strings.Contains(err.Error(), "404") || !strings.Contains(err.Error(), "Process not found") {
+		t.Errorf("killing an unknown process returned %v, want the 404", err)
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	responses := map[string]string{
+		"/api/chat":               `{"messages": [{"ID": "msg_1", "role": "user", "content": "hi"}, {"ID": "msg_2", "role": "assistant", "content": "Hello."}]}`,
+		"/api/conversations/conv": `{"id": "conv", "messages": [{"ID": "msg_1", "role": "user", "content": "hi"}]}`,
+		"/api/conversations":      `{"conversations": [{"id": "conv", "title": "Greeting", "message_count": 2}], "total": 1, "limit": 20, "offset": 0}`,
+		"/api/processes":          `[]`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// Indented and followed by a newline, like json.Encoder output
+		fmt.Fprintf(w, "  %s\n", response)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		args []string
+		path string
+	}{
+		{[]string{"send-message", "-m", "hi"}, "/api/chat"},
+		{[]string{"get-conv", "--id", "conv"}, "/api/conversations/conv"},
+		{[]string{"list-conv"}, "/api/conversations"},
+		{[]string{"list-processes"}, "/api/processes"},
+	}
+	for _, tt := range tests {
+		out, err := runCLI(t, append(tt.args, "--server", server.URL, "--json")...)
+		if err != nil {
+			t.Errorf("%s: %v", tt.args[0], err)
+			continue
+		}
+		if want := responses[tt.path] + "\n"; out != want {
+			t.Errorf("%s printed %q, want the response %q", tt.args[0], out, want)
+		}
+	}
+
+	// Without --json the output is formatted
+	out, err := runCLI(t, "get-conv", "--id", "conv", "--server", server.URL)
+	if err != nil {
+		t.Fatalf("get-conv: %v", err)
+	}
+	if json.Valid([]byte(out)) || !strings.Contains(out, "[msg_1] user: hi") {
+		t.Errorf("get-conv printed %q, want formatted text", out)
+	}
+}
+
+func TestPrintJSONRejectsInvalidJSON(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html>proxy error</html>")
+	}))
+	defer server.Close()
+
+	if _, err := runCLI(t, "list-conv", "--server", server.URL, "--json"); err == nil || !strings.Contains(err.Error(), "invalid JSON") {
+		t.Errorf("list-conv returned %v, want an invalid JSON error", err)
+	}
+}
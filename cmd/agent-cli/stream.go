@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// resumeMaxFailures is how many reconnects in a row may fail before giving up
+const resumeMaxFailures = 5
+
+// resumeRetryInterval is how long to wait before reconnecting after the stream dropped
+var resumeRetryInterval = 2 * time.Second
+
+// streamMessage is a message as sent by the server, in the stream and in conversations
+type streamMessage struct {
+	ID         string `json:"ID"`
+	Role       string `json:"role"`
+	Content    string `json:"content"`
+	TollCallID string `json:"TollCallID"`
+	ToolCalls  []struct {
+		ID        string `json:"id"`
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"tool_calls,omitempty"`
+}
+
+// streamEvent is any event of /api/chat/stream. Events with a type are control events,
+// anything else is a message.
+type streamEvent struct {
+	streamMessage
+	Type             string `json:"type"`
+	Error            string `json:"error"`
+	Partial          bool   `json:"partial"`
+	AwaitingApproval bool   `json:"awaiting_approval"`
+	Canceled         bool   `json:"canceled"`
+	PendingToolCalls []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"pending_tool_calls"`
+}
+
+// streamPrinter prints the messages of a turn as they arrive
+type streamPrinter struct {
+	out io.Writer
+	// Print every event as a line of JSON instead of formatted text
+	raw bool
+	// IDs of the messages already printed, so none is printed twice after resuming
+	seen map[string]bool
+	// Whether assistant content is being printed from deltas
+	inDelta bool
+	// ID of the last event received, the stream is resumed after it
+	lastEventID string
+}
+
+func newStreamPrinter(out io.Writer, raw bool) *streamPrinter {
+	return &streamPrinter{out: out, raw: raw, seen: make(map[string]bool)}
+}
+
+func (p *streamPrinter) delta(content string) {
+	if p.raw {
+		return
+	}
+	if !p.inDelta {
+		fmt.Fprint(p.out, "[assistant]: ")
+		p.inDelta = true
+	}
+	fmt.Fprint(p.out, content)
+}
+
+// message prints a message unless it was printed before, data is the message's JSON
+func (p *streamPrinter) message(msg streamMessage, data []byte) {
+	if msg.ID != "" {
+		if p.seen[msg.ID] {
+			return
+		}
+		p.seen[msg.ID] = true
+	}
+	if p.raw {
+		fmt.Fprintln(p.out, string(data))
+		return
+	}
+
+	switch {
+	case msg.Role == "assistant" && p.inDelta:
+		// The content was already printed while it was generated
+		fmt.Fprintln(p.out)
+		p.inDelta = false
+	case msg.Role == "tool":
+		if output := strings.TrimRight(msg.Content, "\n"); output != "" {
+			fmt.Fprintln(p.out, indent(output, "    "))
+		}
+	case msg.Content != "":
+		fmt.Fprintf(p.out, "[%s]: %s\n", msg.Role, msg.Content)
+	}
+
+	for _, toolCall := range msg.ToolCalls {
+		var args struct {
+			Command string `json:"command"`
+		}
+		if json.Unmarshal([]byte(toolCall.Arguments), &args) == nil && args.Command != "" {
+			fmt.Fprintf(p.out, "  $ %s\n", args.Command)
+		} else {
+			fmt.Fprintf(p.out, "  -> %s %s\n", toolCall.Name, toolCall.Arguments)
+		}
+	}
+}
+
+// errStreamDropped is returned by readStream when the connection ended before the turn did
+var errStreamDropped = errors.New("stream ended before the turn completed")
+
+// readStream prints the events of an SSE stream until the done or error event
+func (p *streamPrinter) readStream(body io.Reader) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		// Blank lines separate events and lines starting with a colon are keepalive comments
+		line := scanner.Text()
+		if id, ok := strings.CutPrefix(line, "id: "); ok {
+			p.lastEventID = id
+			continue
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+
+		var event streamEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return fmt.Errorf("invalid stream event %q: %w", data, err)
+		}
+		if p.raw && event.Type != "" {
+			fmt.Fprintln(p.out, data)
+		}
+
+		switch event.Type {
+		case "connected":
+		case "delta":
+			p.delta(event.Content)
+		case "error":
+			return fmt.Errorf("turn failed: %s", event.Error)
+		case "done":
+			if p.raw {
+				return nil
+			}
+			if p.inDelta {
+				fmt.Fprintln(p.out)
+				p.inDelta = false
+			}
+			if event.Partial {
+				fmt.Fprintln(p.out, "Stopped: the tool iteration limit was reached.")
+			}
+			if event.Canceled {
+				fmt.Fprintln(p.out, "Stopped: the turn was canceled.")
+			}
+			if event.AwaitingApproval {
+				fmt.Fprintln(p.out, "Waiting for approval of:")
+				for _, toolCall := range event.PendingToolCalls {
+					fmt.Fprintf(p.out, "  %s (%s)\n", toolCall.Name, toolCall.ID)
+				}
+			}
+			return nil
+		case "":
+			p.message(event.streamMessage, []byte(data))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%w: %v", errStreamDropped, err)
+	}
+	return errStreamDropped
+}
+
+// resume reconnects after the stream dropped, with Last-Event-ID set to the last event
+// received, so the server replays the messages that were missed and follows the turn until it
+// completes. The turn keeps running on the server, sending the message again would start
+// another one.
+func (p *streamPrinter) resume(server string, reqBody []byte) error {
+	if p.lastEventID == "" {
+		return fmt.Errorf("%w, and it is unknown whether the message was received", errStreamDropped)
+	}
+	if p.inDelta {
+		fmt.Fprintln(p.out)
+		p.inDelta = false
+	}
+	if !p.raw {
+		fmt.Fprintln(p.out, "Connection lost, reconnecting...")
+	}
+
+	failures := 0
+	for {
+		time.Sleep(resumeRetryInterval)
+		resumedFrom := p.lastEventID
+		err := p.reconnect(server, reqBody)
+		if !errors.Is(err, errStreamDropped) {
+			return err
+		}
+		// Only attempts that got nothing further count as failures
+		if p.lastEventID != resumedFrom {
+			failures = 0
+		}
+		failures++
+		if failures >= resumeMaxFailures {
+			return fmt.Errorf("failed to resume: %w", err)
+		}
+	}
+}
+
+// reconnect repeats the stream request with Last-Event-ID and prints the events it gets. It
+// returns an error wrapping errStreamDropped when another attempt may succeed.
+func (p *streamPrinter) reconnect(server string, reqBody []byte) error {
+	req, err := newAPIRequest(http.MethodPost, server+"/api/chat/stream", bytes.NewReader(reqBody))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Last-Event-ID", p.lastEventID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errStreamDropped, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		err := fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+		if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+			return fmt.Errorf("%w: %v", errStreamDropped, err)
+		}
+		return err
+	}
+	return p.readStream(resp.Body)
+}
+
+// sendMessageStream sends a message through /api/chat/stream and prints the turn as it runs.
+// With raw set every event is printed as a line of JSON.
+func sendMessageStream(out io.Writer, server string, reqBody map[string]interface{}, raw bool) error {
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	resp, err := apiRequest(http.MethodPost, server+"/api/chat/stream", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	printer := newStreamPrinter(out, raw)
+	err = printer.readStream(resp.Body)
+	if !errors.Is(err, errStreamDropped) {
+		return err
+	}
+
+	return printer.resume(server, jsonData)
+}
+
+// indent prefixes every line of text
+func indent(text, prefix string) string {
+	return prefix + strings.ReplaceAll(text, "\n", "\n"+prefix)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// sseEvent writes an event of an SSE stream, with an ID if id is not empty
+func sseEvent(w http.ResponseWriter, id, data string) {
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	w.(http.Flusher).Flush()
+}
+
+func TestStreamPrinterPrintsTurn(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		sseEvent(w, "", `{"type":"connected"}`)
+		sseEvent(w, "msg_1", `{"ID":"msg_1","role":"user","content":"list files"}`)
+		sseEvent(w, "msg_2", `{"ID":"msg_2","role":"assistant","tool_calls":[{"id":"call_1","name":"bash_command","arguments":"{\"command\":\"ls\"}"}]}`)
+		fmt.Fprint(w, ": keepalive\n\n")
+		sseEvent(w, "msg_3", `{"ID":"msg_3","role":"tool","content":"a.txt\nb.txt\n","TollCallID":"call_1"}`)
+		sseEvent(w, "", `{"type":"delta","content":"Two "}`)
+		sseEvent(w, "", `{"type":"delta","content":"files."}`)
+		sseEvent(w, "msg_4", `{"ID":"msg_4","role":"assistant","content":"Two files."}`)
+		sseEvent(w, "", `{"type":"done"}`)
+	}))
+	defer server.Close()
+
+	var out bytes.Buffer
+	if err := sendMessageStream(&out, server.URL, map[string]interface{}{"message": "list files"}, false); err != nil {
+		t.Fatalf("sendMessageStream: %v", err)
+	}
+	want := "[user]: list files\n" +
+		"  $ ls\n" +
+		"    a.txt\n    b.txt\n" +
+		"[assistant]: Two files.\n"
+	if got := out.String(); got != want {
+		t.Errorf("printed\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestStreamPrinterReportsFailedTurn(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sseEvent(w, "", `{"type":"connected"}`)
+		sseEvent(w, "", `{"type":"error","error":"model \"x\" is unavailable"}`)
+	}))
+	defer server.Close()
+
+	err := sendMessageStream(&bytes.Buffer{}, server.URL, map[string]interface{}{"message": "hi"}, false)
+	if err == nil || !strings.Contains(err.Error(), `model "x" is unavailable`) {
+		t.Errorf("sendMessageStream returned %v, want the turn's error", err)
+	}
+}
+
+func TestStreamResumesWithLastEventID(t *testing.T) {
+	resumeRetryInterval = 0
+	var mutex sync.Mutex
+	var lastEventIDs []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		attempt := len(lastEventIDs)
+		lastEventIDs = append(lastEventIDs, r.Header.Get("Last-Event-ID"))
+		mutex.Unlock()
+
+		sseEvent(w, "", `{"type":"connected"}`)
+		switch attempt {
+		case 0:
+			// The connection drops while the reply is generated
+			sseEvent(w, "msg_1", `{"ID":"msg_1","role":"user","content":"hi"}`)
+			sseEvent(w, "", `{"type":"delta","content":"Hel"}`)
+		case 1:
+			// And again after the next message
+			sseEvent(w, "msg_2", `{"ID":"msg_2","role":"assistant","content":"Hello"}`)
+		default:
+			sseEvent(w, "msg_3", `{"ID":"msg_3","role":"assistant","content":"How can I help?"}`)
+			sseEvent(w, "", `{"type":"done"}`)
+		}
+	}))
+	defer server.Close()
+
+	var out bytes.Buffer
+	if err := sendMessageStream(&out, server.URL, map[string]interface{}{"message": "hi"}, false); err != nil {
+		t.Fatalf("sendMessageStream: %v", err)
+	}
+
+	if got := strings.Join(lastEventIDs, ","); got != ",msg_1,msg_2" {
+		t.Errorf("requests had Last-Event-ID %q, want none, msg_1, then msg_2", got)
+	}
+	want := "[user]: hi\n" +
+		"[assistant]: Hel\n" +
+		"Connection lost, reconnecting...\n" +
+		"[assistant]: Hello\n" +
+		"[assistant]: How can I help?\n"
+	if got := out.String(); got != want {
+		t.Errorf("printed\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestStreamResumeGivesUp(t *testing.T) {
+	resumeRetryInterval = 0
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Last-Event-ID") != "" {
+			http.Error(w, "Last-Event-ID does not match a message of the conversation", http.StatusNotFound)
+			return
+		}
+		sseEvent(w, "msg_1", `{"ID":"msg_1","role":"user","content":"hi"}`)
+	}))
+	defer server.Close()
+
+	// A stream that can't be resumed fails at once instead of being retried
+	err := sendMessageStream(&bytes.Buffer{}, server.URL, map[string]interface{}{"message": "hi"}, false)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("sendMessageStream returned %v, want the 404", err)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("made %d requests, want 2", got)
+	}
+}
+
+func TestStreamWithoutEventIDIsNotResumed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sseEvent(w, "", `{"type":"connected"}`)
+	}))
+	defer server.Close()
+
+	err := sendMessageStream(&bytes.Buffer{}, server.URL, map[string]interface{}{"message": "hi"}, false)
+	if err == nil || !strings.Contains(err.Error(), "unknown whether the message was received") {
+		t.Errorf("sendMessageStream returned %v, want that the message may be lost", err)
+	}
+}
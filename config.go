@@ -0,0 +1,486 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evgeniy-scherbina/agent/chat_engine"
+	"github.com/openai/openai-go/v2/option"
+)
+
+// engineOptionsFromEnv builds chat engine options from environment variables.
+// Unset variables keep the engine defaults.
+func engineOptionsFromEnv() ([]chat_engine.Option, error) {
+	var opts []chat_engine.Option
+
+	if n, ok, err := envInt("AGENT_MAX_REPEATED_TOOL_CALLS"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithMaxRepeatedToolCalls(n))
+	}
+
+	if dir := os.Getenv("AGENT_WORKSPACE_ROOT"); dir != "" {
+		opts = append(opts, chat_engine.WithWorkspaceRoot(dir))
+	}
+
+	if n, ok, err := envInt("AGENT_MAX_TOOL_ITERATIONS"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithMaxToolIterations(n))
+	}
+
+	if model := os.Getenv("AGENT_MODEL"); model != "" {
+		opts = append(opts, chat_engine.WithModel(model))
+	}
+
+	if n, ok, err := envInt("AGENT_MAX_COMPLETION_ATTEMPTS"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithMaxCompletionAttempts(n))
+	}
+
+	if n, ok, err := envInt("AGENT_MAX_EMPTY_REPLY_RETRIES"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithMaxEmptyReplyRetries(n))
+	}
+
+	if n, ok, err := envInt("AGENT_MAX_CONVERSATION_TOOL_CALLS"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithMaxConversationToolCalls(n))
+	}
+
+	if url := os.Getenv("DATABASE_URL"); url != "" {
+		opts = append(opts, chat_engine.WithDatabaseURL(url))
+	}
+
+	if n, ok, err := envInt("AGENT_MAX_CACHED_CONVERSATIONS"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithMaxCachedConversations(n))
+	}
+
+	if n, ok, err := envInt("AGENT_MAX_READ_FILE_BYTES"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithMaxReadFileBytes(n))
+	}
+
+	if n, ok, err := envInt("AGENT_MAX_SEARCH_RESULTS"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithMaxSearchResults(n))
+	}
+
+	if timeout, ok, err := envDuration("AGENT_COMMAND_TIMEOUT"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithCommandTimeout(timeout))
+	}
+
+	if timeout, ok, err := envDuration("AGENT_TOOL_TIMEOUT"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithToolTimeout(timeout))
+	}
+
+	if n, ok, err := envInt("AGENT_MAX_MESSAGE_BYTES"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithMaxMessageBytes(n))
+	}
+
+	if n, ok, err := envInt("AGENT_MAX_COMMAND_OUTPUT_BYTES"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithMaxCommandOutputBytes(n))
+	}
+
+	if n, ok, err := envInt("AGENT_MAX_PROCESS_DEPTH"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithMaxProcessDepth(n))
+	}
+
+	if grace, ok, err := envDuration("AGENT_KILL_GRACE_PERIOD"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithKillGracePeriod(grace))
+	}
+
+	if enabled, ok, err := envBool("AGENT_READ_ONLY"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithReadOnly(enabled))
+	}
+
+	if value := os.Getenv("AGENT_ORPHAN_POLICY"); value != "" {
+		policy, err := chat_engine.ParseOrphanPolicy(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AGENT_ORPHAN_POLICY: %w", err)
+		}
+		opts = append(opts, chat_engine.WithOrphanPolicy(policy))
+	}
+
+	if n, ok, err := envInt("AGENT_MAX_CONVERSATION_MESSAGES"); err != nil {
+		return nil, err
+	} else if ok {
+		policy := chat_engine.ConversationLimitRefuse
+		if value := os.Getenv("AGENT_CONVERSATION_LIMIT_POLICY"); value != "" {
+			if policy, err = chat_engine.ParseConversationLimitPolicy(value); err != nil {
+				return nil, fmt.Errorf("invalid AGENT_CONVERSATION_LIMIT_POLICY: %w", err)
+			}
+		}
+		opts = append(opts, chat_engine.WithMaxConversationMessages(n, policy))
+	}
+
+	if value := os.Getenv("AGENT_REDACT_PATTERNS"); value != "" {
+		// One regular expression per line, as patterns may contain any other separator
+		patterns, err := chat_engine.CompileRedactPatterns(strings.Split(strings.TrimSpace(value), "\n"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid AGENT_REDACT_PATTERNS: %w", err)
+		}
+		opts = append(opts, chat_engine.WithPostProcessor(chat_engine.RedactPatterns(patterns...)))
+	}
+
+	if enabled, ok, err := envBool("AGENT_KEEP_RAW_CONTENT"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithKeepRawContent(enabled))
+	}
+
+	if enabled, ok, err := envBool("AGENT_TOOL_APPROVAL"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithToolApproval(enabled))
+	}
+
+	if timeout, ok, err := envDuration("AGENT_APPROVAL_TIMEOUT"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithApprovalTimeout(timeout))
+	}
+
+	if value := os.Getenv("AGENT_COMMAND_POLICY"); value != "" {
+		policy, err := commandPolicyFromEnv(value)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, chat_engine.WithCommandPolicy(policy))
+	}
+
+	if value := os.Getenv("AGENT_TITLE_TRIGGER"); value != "" {
+		trigger, err := chat_engine.ParseTitleTrigger(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AGENT_TITLE_TRIGGER: %w", err)
+		}
+		opts = append(opts, chat_engine.WithTitleTrigger(trigger))
+	}
+
+	if text := os.Getenv("AGENT_ITERATION_LIMIT_MESSAGE"); text != "" {
+		opts = append(opts, chat_engine.WithIterationLimitMessage(text))
+	}
+
+	if enabled, ok, err := envBool("AGENT_ITERATION_LIMIT_SUMMARY"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithIterationLimitSummary(enabled))
+	}
+
+	if n, ok, err := envInt("AGENT_SUMMARIZE_THRESHOLD"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithAutoSummarize(n))
+	}
+
+	if enabled, ok, err := envBool("AGENT_HTTP_ALLOW_PRIVATE"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithHTTPPrivateNetworks(enabled))
+	}
+
+	if n, ok, err := envInt("AGENT_MAX_HTTP_RESPONSE_BYTES"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, chat_engine.WithMaxHTTPResponseBytes(n))
+	}
+
+	if key := os.Getenv("AGENT_WEB_SEARCH_API_KEY"); key != "" {
+		endpoint := os.Getenv("AGENT_WEB_SEARCH_ENDPOINT")
+		opts = append(opts, chat_engine.WithWebSearch(chat_engine.NewBraveSearchProvider(endpoint, key)))
+	}
+
+	if enabled, _, err := envBool("AGENT_MEMORY"); err != nil {
+		return nil, err
+	} else if enabled {
+		opts = append(opts, chat_engine.WithMemory(os.Getenv("AGENT_MEMORY_NAMESPACE")))
+	}
+
+	var sampling chat_engine.SamplingParams
+	samplingVars := []struct {
+		name  string
+		field **float64
+	}{
+		{"AGENT_TEMPERATURE", &sampling.Temperature},
+		{"AGENT_TOP_P", &sampling.TopP},
+		{"AGENT_PRESENCE_PENALTY", &sampling.PresencePenalty},
+		{"AGENT_FREQUENCY_PENALTY", &sampling.FrequencyPenalty},
+	}
+	for _, v := range samplingVars {
+		if f, ok, err := envFloat(v.name); err != nil {
+			return nil, err
+		} else if ok {
+			*v.field = &f
+		}
+	}
+	if err := sampling.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid sampling parameters: %w", err)
+	}
+	opts = append(opts, chat_engine.WithSampling(sampling))
+
+	if value := os.Getenv("AGENT_CONTEXT_BUDGETS"); value != "" {
+		budgetOpts, err := contextBudgetsFromEnv(value)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, budgetOpts...)
+	}
+
+	if value := os.Getenv("AGENT_WEBHOOK_URL"); value != "" {
+		if err := chat_engine.ValidateWebhookURL(value); err != nil {
+			return nil, fmt.Errorf("invalid AGENT_WEBHOOK_URL: %w", err)
+		}
+		opts = append(opts, chat_engine.WithWebhookURL(value))
+	}
+
+	if policy := envPolicyFromEnv(); policy != nil {
+		opts = append(opts, chat_engine.WithEnvPolicy(policy))
+	}
+
+	return opts, nil
+}
+
+// envPolicyFromEnv builds the environment policy of commands from AGENT_COMMAND_ENV_ALLOW and
+// AGENT_COMMAND_ENV_BLOCK, comma-separated lists of variable name patterns like LC_*. The
+// blocklist replaces chat_engine.DefaultBlockedEnv, "none" blocks nothing. It returns nil
+// when neither is set, keeping the default policy.
+func envPolicyFromEnv() *chat_engine.EnvPolicy {
+	allow, block := os.Getenv("AGENT_COMMAND_ENV_ALLOW"), os.Getenv("AGENT_COMMAND_ENV_BLOCK")
+	if allow == "" && block == "" {
+		return nil
+	}
+
+	policy := chat_engine.DefaultEnvPolicy()
+	policy.Allow = splitList(allow)
+	switch strings.TrimSpace(block) {
+	case "":
+	case "none":
+		policy.Block = nil
+	default:
+		policy.Block = splitList(block)
+	}
+	return policy
+}
+
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(value string) []string {
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// contextBudgetsFromEnv parses AGENT_CONTEXT_BUDGETS, a comma-separated list of model=tokens
+// prompt token budgets. A number without a model sets the budget of all other models.
+func contextBudgetsFromEnv(value string) ([]chat_engine.Option, error) {
+	var opts []chat_engine.Option
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		model, tokens, found := strings.Cut(entry, "=")
+		if !found {
+			model, tokens = "", entry
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(tokens))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid AGENT_CONTEXT_BUDGETS entry %q: want model=tokens", entry)
+		}
+		opts = append(opts, chat_engine.WithContextBudget(strings.TrimSpace(model), n))
+	}
+	return opts, nil
+}
+
+// commandPolicyFromEnv builds the command policy for AGENT_COMMAND_POLICY (allowlist or
+// blocklist). Patterns come from AGENT_COMMAND_PATTERNS, one regular expression per line,
+// and from the file named by AGENT_COMMAND_PATTERNS_FILE.
+func commandPolicyFromEnv(value string) (*chat_engine.CommandPolicy, error) {
+	mode, err := chat_engine.ParseCommandPolicyMode(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AGENT_COMMAND_POLICY: %w", err)
+	}
+
+	var exprs []string
+	if patterns := strings.TrimSpace(os.Getenv("AGENT_COMMAND_PATTERNS")); patterns != "" {
+		exprs = append(exprs, strings.Split(patterns, "\n")...)
+	}
+	if path := os.Getenv("AGENT_COMMAND_PATTERNS_FILE"); path != "" {
+		filePatterns, err := chat_engine.ReadCommandPatterns(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AGENT_COMMAND_PATTERNS_FILE: %w", err)
+		}
+		exprs = append(exprs, filePatterns...)
+	}
+	if mode == chat_engine.CommandPolicyAllowlist && len(exprs) == 0 {
+		slog.Warn("Command allowlist is empty, bash_command and shell will refuse every command")
+	}
+
+	policy, err := chat_engine.NewCommandPolicy(mode, exprs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid command policy: %w", err)
+	}
+	return policy, nil
+}
+
+// defaultAllowedOrigin is the origin of the UI served by this server
+const defaultAllowedOrigin = "http://localhost:8080"
+
+// allowedOriginsFromEnv reads the origins allowed to make cross-origin requests from
+// AGENT_ALLOWED_ORIGINS, a comma-separated list. "*" allows every origin and has to be set
+// explicitly.
+func allowedOriginsFromEnv() []string {
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("AGENT_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	if len(origins) == 0 {
+		return []string{defaultAllowedOrigin}
+	}
+	if slices.Contains(origins, "*") {
+		slog.Warn("AGENT_ALLOWED_ORIGINS allows every origin, any website can call the API from a browser")
+	}
+	return origins
+}
+
+// rateLimiterFromEnv builds the /api rate limiter from AGENT_RATE_LIMIT_PER_MINUTE and
+// AGENT_RATE_LIMIT_BURST (defaults to the per-minute limit). It returns nil when no limit is set.
+func rateLimiterFromEnv() (*rateLimiter, error) {
+	perMinute, ok, err := envInt("AGENT_RATE_LIMIT_PER_MINUTE")
+	if err != nil || !ok || perMinute <= 0 {
+		return nil, err
+	}
+	burst, _, err := envInt("AGENT_RATE_LIMIT_BURST")
+	if err != nil {
+		return nil, err
+	}
+	return newRateLimiter(perMinute, burst), nil
+}
+
+// loggerFromEnv builds the logger from LOG_LEVEL (debug, info, warn or error, default info)
+// and LOG_FORMAT (text or json, default text)
+func loggerFromEnv() (*slog.Logger, error) {
+	var level slog.Level
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			return nil, fmt.Errorf("invalid LOG_LEVEL: %w", err)
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	switch format := os.Getenv("LOG_FORMAT"); format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid LOG_FORMAT %q: must be text or json", format)
+	}
+}
+
+// clientOptionsFromEnv builds OpenAI client options from environment variables.
+// OPENAI_BASE_URL points the client at another OpenAI-compatible endpoint such as Azure
+// OpenAI, LiteLLM or a local server, OPENAI_API_KEY sets the key sent to it.
+func clientOptionsFromEnv() ([]option.RequestOption, error) {
+	// The engine retries failed completions itself, see AGENT_MAX_COMPLETION_ATTEMPTS
+	opts := []option.RequestOption{option.WithMaxRetries(0)}
+
+	if value := os.Getenv("OPENAI_BASE_URL"); value != "" {
+		baseURL, err := url.Parse(value)
+		if err != nil || (baseURL.Scheme != "http" && baseURL.Scheme != "https") || baseURL.Host == "" {
+			return nil, fmt.Errorf("invalid OPENAI_BASE_URL %q: must be an http or https URL", value)
+		}
+		slog.Info("Using OpenAI-compatible endpoint", "url", baseURL.Redacted())
+		opts = append(opts, option.WithBaseURL(value))
+	}
+
+	if key := os.Getenv("OPENAI_API_KEY"); key != "" {
+		opts = append(opts, option.WithAPIKey(key))
+	}
+
+	return opts, nil
+}
+
+// envInt reads an integer environment variable, ok is false when it is unset
+func envInt(name string) (n int, ok bool, err error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, false, nil
+	}
+	n, err = strconv.Atoi(value)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return n, true, nil
+}
+
+// envFloat reads a floating point environment variable, ok is false when it is unset
+func envFloat(name string) (f float64, ok bool, err error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, false, nil
+	}
+	f, err = strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return f, true, nil
+}
+
+// envBool reads a boolean environment variable, ok is false when it is unset
+func envBool(name string) (b bool, ok bool, err error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return false, false, nil
+	}
+	b, err = strconv.ParseBool(value)
+	if err != nil {
+		return false, false, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return b, true, nil
+}
+
+// envDuration reads a duration environment variable such as "90s", ok is false when it is unset
+func envDuration(name string) (d time.Duration, ok bool, err error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, false, nil
+	}
+	d, err = time.ParseDuration(value)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return d, true, nil
+}
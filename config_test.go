@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/evgeniy-scherbina/agent/chat_engine"
+	"github.com/openai/openai-go/v2"
+)
+
+// endlessToolProvider runs another command after every tool result and only answers with text
+// when no tools are offered
+type endlessToolProvider struct{}
+
+func (endlessToolProvider) Complete(ctx context.Context, req chat_engine.CompletionRequest) (*chat_engine.Message, error) {
+	if len(req.Tools) == 0 {
+		return &chat_engine.Message{Role: "assistant", Content: "Not done yet."}, nil
+	}
+	n := len(req.Messages)
+	return &chat_engine.Message{
+		Role:      "assistant",
+		ToolCalls: []chat_engine.ToolCall{{ID: fmt.Sprintf("call_%d", n), Type: "function", Name: "bash_command", Arguments: fmt.Sprintf(`{"command": "echo %d"}`, n)}},
+	}, nil
+}
+
+func TestMaxToolIterationsFromEnv(t *testing.T) {
+	t.Setenv("AGENT_MAX_TOOL_ITERATIONS", "3")
+	opts, err := engineOptionsFromEnv()
+	if err != nil {
+		t.Fatalf("engineOptionsFromEnv: %v", err)
+	}
+	server := newTestServerWithProvider(t, endlessToolProvider{}, nil, opts...)
+
+	resp, body := doJSON(t, http.MethodPost, server.URL+"/api/chat", SendMessageRequest{Message: "keep going", ConversationID: "conv"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	var response SendMessageResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatalf("invalid response %s: %v", body, err)
+	}
+	if !response.Partial || !strings.Contains(response.Error, "limit of 3 tool call rounds") {
+		t.Errorf("response is partial %v with error %q, want the limit of 3 rounds", response.Partial, response.Error)
+	}
+	var commands int
+	for _, msg := range response.Messages {
+		if msg.Role == "tool" && !strings.HasPrefix(msg.Content, "Not executed") {
+			commands++
+		}
+	}
+	if commands != 3 {
+		t.Errorf("ran %d commands, want 3", commands)
+	}
+}
+
+func TestInvalidMaxToolIterations(t *testing.T) {
+	t.Setenv("AGENT_MAX_TOOL_ITERATIONS", "many")
+	if _, err := engineOptionsFromEnv(); err == nil || !strings.Contains(err.Error(), "AGENT_MAX_TOOL_ITERATIONS") {
+		t.Errorf("engineOptionsFromEnv returned %v, want an error naming the variable", err)
+	}
+}
+
+func TestInvalidSamplingFromEnv(t *testing.T) {
+	t.Setenv("AGENT_TEMPERATURE", "3")
+	if _, err := engineOptionsFromEnv(); err == nil || !strings.Contains(err.Error(), "temperature") {
+		t.Errorf("engineOptionsFromEnv returned %v, want the temperature rejected", err)
+	}
+}
+
+func TestClientUsesBaseURLFromEnv(t *testing.T) {
+	var path, authorization, model string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		authorization = r.Header.Get("Authorization")
+		var body struct {
+			Model string `json:"model"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		model = body.Model
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id": "chatcmpl-1", "object": "chat.completion", "model": "local-model",
+			"choices": [{"index": 0, "finish_reason": "stop", "message": {"role": "assistant", "content": "Hi from the local server."}}]}`)
+	}))
+	defer server.Close()
+	t.Setenv("OPENAI_BASE_URL", server.URL+"/v1/")
+	t.Setenv("OPENAI_API_KEY", "sk-local")
+
+	opts, err := clientOptionsFromEnv()
+	if err != nil {
+		t.Fatalf("clientOptionsFromEnv: %v", err)
+	}
+	client := openai.NewClient(opts...)
+	provider := chat_engine.NewOpenAIProvider(&client, "local-model")
+	msg, err := provider.Complete(t.Context(), chat_engine.CompletionRequest{
+		Messages: []*chat_engine.Message{{Role: "user", Content: "hi"}},
+	})
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+
+	if path != "/v1/chat/completions" || authorization != "Bearer sk-local" || model != "local-model" {
+		t.Errorf("request went to %q with %q for model %q, want the local server with its key", path, authorization, model)
+	}
+	if msg.Content != "Hi from the local server." {
+		t.Errorf("reply is %q, want the local server's", msg.Content)
+	}
+}
+
+func TestInvalidBaseURL(t *testing.T) {
+	for _, value := range []string{"localhost:8080", "ftp://example.com", "http://"} {
+		t.Setenv("OPENAI_BASE_URL", value)
+		if _, err := clientOptionsFromEnv(); err == nil {
+			t.Errorf("OPENAI_BASE_URL %q was accepted", value)
+		}
+	}
+}
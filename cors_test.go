@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// preflight sends a CORS preflight request for a POST from origin
+func preflight(t *testing.T, url, origin string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodOptions, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	req.Header.Set("Access-Control-Request-Headers", "Content-Type")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("OPTIONS %s: %v", url, err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestCORSAllowsOnlyConfiguredOrigins(t *testing.T) {
+	server := newTestServer(t, func(s *Server) { s.allowedOrigins = []string{"https://app.example"} })
+	url := server.URL + "/api/chat"
+
+	resp := preflight(t, url, "https://app.example")
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "https://app.example" {
+		t.Errorf("allowed origin got Access-Control-Allow-Origin %q", got)
+	}
+
+	resp = preflight(t, url, "https://evil.example")
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("disallowed origin got Access-Control-Allow-Origin %q", got)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/conversations", nil)
+	req.Header.Set("Origin", "https://evil.example")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("request from a disallowed origin got Access-Control-Allow-Origin %q", got)
+	}
+}
+
+func TestWebSocketChecksOrigin(t *testing.T) {
+	server := newTestServer(t, func(s *Server) { s.allowedOrigins = []string{"https://app.example"} })
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws"
+
+	for origin, allowed := range map[string]bool{
+		"":                     true, // not a browser
+		"https://app.example":  true,
+		server.URL:             true, // the server's own UI
+		"https://evil.example": false,
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if allowed {
+			if err != nil {
+				t.Errorf("origin %q was rejected: %v", origin, err)
+				continue
+			}
+			conn.Close()
+			continue
+		}
+		if err == nil {
+			conn.Close()
+			t.Errorf("origin %q was accepted", origin)
+		} else if resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("origin %q got %v, want 403", origin, resp)
+		}
+	}
+}
+
+func TestAllowedOriginsFromEnv(t *testing.T) {
+	tests := []struct {
+		env  string
+		want []string
+	}{
+		{"", []string{defaultAllowedOrigin}},
+		{" , ", []string{defaultAllowedOrigin}},
+		{"https://a.example", []string{"https://a.example"}},
+		{"https://a.example, https://b.example", []string{"https://a.example", "https://b.example"}},
+		{"*", []string{"*"}},
+	}
+	for _, tt := range tests {
+		t.Setenv("AGENT_ALLOWED_ORIGINS", tt.env)
+		if got := allowedOriginsFromEnv(); !slices.Equal(got, tt.want) {
+			t.Errorf("AGENT_ALLOWED_ORIGINS=%q gives %q, want %q", tt.env, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,930 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evgeniy-scherbina/agent/chat_engine"
+)
+
+// doJSON makes a request with body encoded as JSON, if not nil, and returns the response with
+// its body read
+func doJSON(t *testing.T, method, url string, body any) (*http.Response, []byte) {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: reading the body: %v", method, url, err)
+	}
+	return resp, data
+}
+
+// sendMessage runs a turn in a conversation and returns its messages
+func sendMessage(t *testing.T, baseURL, conversationID, message string) SendMessageResponse {
+	t.Helper()
+	resp, body := doJSON(t, http.MethodPost, baseURL+"/api/chat", SendMessageRequest{Message: message, ConversationID: conversationID})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /api/chat: status %d: %s", resp.StatusCode, body)
+	}
+	var response SendMessageResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatalf("invalid response %s: %v", body, err)
+	}
+	return response
+}
+
+func TestEditMessageHandler(t *testing.T) {
+	server := newTestServer(t, nil)
+	turn := sendMessage(t, server.URL, "conv", "run echo")
+	prompt := turn.Messages[0]
+	url := server.URL + "/api/conversations/conv/messages/" + prompt.ID
+
+	for _, content := range []string{"", "  \n\t"} {
+		if resp, body := doJSON(t, http.MethodPut, url, map[string]string{"content": content}); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("editing to %q: status %d (%s), want 400", content, resp.StatusCode, body)
+		}
+	}
+	resp, _ := doJSON(t, http.MethodPut, server.URL+"/api/conversations/conv/messages/no_such_message", map[string]string{"content": "x"})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("editing an unknown message: status %d, want 404", resp.StatusCode)
+	}
+
+	resp, body := doJSON(t, http.MethodPut, url, map[string]string{"content": "run echo again"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	var conv chat_engine.Conversation
+	if err := json.Unmarshal(body, &conv); err != nil {
+		t.Fatalf("invalid response %s: %v", body, err)
+	}
+	if len(conv.Messages) != 1 || conv.Messages[0].Content != "run echo again" {
+		t.Errorf("edited conversation is %s, want only the edited prompt", body)
+	}
+}
+
+// toolCallProvider calls a tool with the content of the user message as its arguments, then
+// replies with the tool's output
+type toolCallProvider struct {
+	tool string
+}
+
+func (p toolCallProvider) Complete(ctx context.Context, req chat_engine.CompletionRequest) (*chat_engine.Message, error) {
+	last := req.Messages[len(req.Messages)-1]
+	if last.Role == "tool" {
+		return &chat_engine.Message{Role: "assistant", Content: last.Content}, nil
+	}
+	return &chat_engine.Message{
+		Role:      "assistant",
+		ToolCalls: []chat_engine.ToolCall{{ID: "call_1", Type: "function", Name: p.tool, Arguments: last.Content}},
+	}, nil
+}
+
+// startBackgroundCommand starts a background command in a conversation of a server answering
+// with toolCallProvider for bash_command and returns its PID
+func startBackgroundCommand(t *testing.T, baseURL, conversationID, command string) int {
+	t.Helper()
+	args, _ := json.Marshal(map[string]interface{}{"command": command, "background": true})
+	turn := sendMessage(t, baseURL, conversationID, string(args))
+	reply := turn.Messages[len(turn.Messages)-1].Content
+	var pid int
+	if _, err := fmt.Sscanf(reply, "Started background process (PID: %d)", &pid); err != nil {
+		t.Fatalf("command didn't start: %q", reply)
+	}
+	return pid
+}
+
+func TestProcessLogsAfterExit(t *testing.T) {
+	server := newTestServerWithProvider(t, toolCallProvider{tool: "bash_command"}, nil)
+	pid := startBackgroundCommand(t, server.URL, "conv", "echo out; echo err >&2; exit 3")
+
+	var output chat_engine.ProcessOutput
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, body := doJSON(t, http.MethodGet, fmt.Sprintf("%s/api/processes/%d/logs", server.URL, pid), nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d: %s", resp.StatusCode, body)
+		}
+		if err := json.Unmarshal(body, &output); err != nil {
+			t.Fatalf("invalid response %s: %v", body, err)
+		}
+		if !output.Running || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if output.Running || output.Output != "out\nerr\n" || output.ExitCode == nil || *output.ExitCode != 3 {
+		t.Errorf("got %+v, want the output and exit code of the exited process", output)
+	}
+
+	if resp, _ := doJSON(t, http.MethodGet, server.URL+"/api/processes/999999999/logs", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown process: status %d, want 404", resp.StatusCode)
+	}
+}
+
+// processStreamEvent is an event of a process output stream
+type processStreamEvent struct {
+	Type     string `json:"type"`
+	Output   string `json:"output"`
+	ExitCode *int   `json:"exit_code"`
+	Error    string `json:"error"`
+}
+
+func TestStreamProcessOutput(t *testing.T) {
+	server := newTestServerWithProvider(t, toolCallProvider{tool: "bash_command"}, nil)
+	pid := startBackgroundCommand(t, server.URL, "conv", "echo start; for i in 1 2 3; do sleep 0.1; echo line $i; done; exit 4")
+
+	resp, err := http.Get(fmt.Sprintf("%s/api/processes/%d/stream", server.URL, pid))
+	if err != nil {
+		t.Fatalf("GET stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d with content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	// The stream ends by itself once the process exited
+	var output strings.Builder
+	var events []processStreamEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var event processStreamEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("invalid event %q: %v", data, err)
+		}
+		events = append(events, event)
+		output.WriteString(event.Output)
+	}
+	if want := "start\nline 1\nline 2\nline 3\n"; output.String() != want {
+		t.Errorf("streamed output %q, want %q", output.String(), want)
+	}
+	if len(events) == 0 {
+		t.Fatal("stream sent no events")
+	}
+	last := events[len(events)-1]
+	if last.Type != "exit" || last.ExitCode == nil || *last.ExitCode != 4 {
+		t.Errorf("stream ended with %+v, want the exit code 4", last)
+	}
+	for _, event := range events[:len(events)-1] {
+		if event.Type != "output" {
+			t.Errorf("stream sent %+v before the exit", event)
+		}
+	}
+
+	for path, want := range map[string]int{"/api/processes/999999999/stream": http.StatusNotFound, "/api/processes/abc/stream": http.StatusBadRequest} {
+		if resp, _ := doJSON(t, http.MethodGet, server.URL+path, nil); resp.StatusCode != want {
+			t.Errorf("%s: status %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestStreamProcessOutputClientDisconnect(t *testing.T) {
+	server := newTestServerWithProvider(t, toolCallProvider{tool: "bash_command"}, nil)
+	pid := startBackgroundCommand(t, server.URL, "conv", "echo ready; sleep 30")
+
+	ctx, cancel := context.WithCancel(t.Context())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/api/processes/%d/stream", server.URL, pid), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET stream: %v", err)
+	}
+	defer resp.Body.Close()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != `data: {"type":"output","output":"ready\n"}`+"\n" {
+		t.Fatalf("first line %q, %v, want the output", line, err)
+	}
+	cancel()
+
+	// The process keeps running without a follower
+	if pids := listedProcesses(t, server.URL); !slices.Contains(pids["conv"], pid) {
+		t.Errorf("process %d stopped when the client disconnected, running: %v", pid, pids)
+	}
+}
+
+// listedProcesses returns the PIDs of the background processes the server lists, by conversation
+func listedProcesses(t *testing.T, baseURL string) map[string][]int {
+	t.Helper()
+	resp, body := doJSON(t, http.MethodGet, baseURL+"/api/processes", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /api/processes: status %d: %s", resp.StatusCode, body)
+	}
+	var processes []chat_engine.ProcessInfo
+	if err := json.Unmarshal(body, &processes); err != nil {
+		t.Fatalf("invalid response %s: %v", body, err)
+	}
+	pids := make(map[string][]int)
+	for _, info := range processes {
+		pids[info.ConversationID] = append(pids[info.ConversationID], info.PID)
+	}
+	return pids
+}
+
+func TestKillConversationProcessesHandler(t *testing.T) {
+	server := newTestServerWithProvider(t, toolCallProvider{tool: "bash_command"}, nil)
+	startBackgroundCommand(t, server.URL, "conv", "sleep 30")
+	other := startBackgroundCommand(t, server.URL, "other", "sleep 30")
+
+	resp, body := doJSON(t, http.MethodPost, server.URL+"/api/conversations/conv/kill-processes", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	var result struct {
+		Killed int `json:"killed"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil || result.Killed != 1 {
+		t.Errorf("response %s, want 1 killed process", body)
+	}
+
+	pids := listedProcesses(t, server.URL)
+	if len(pids["conv"]) != 0 {
+		t.Errorf("processes %v of the conversation are still running", pids["conv"])
+	}
+	if len(pids["other"]) != 1 || pids["other"][0] != other {
+		t.Errorf("other conversation runs %v, want its process %d", pids["other"], other)
+	}
+}
+
+func TestDeleteConversationKillsProcessesHandler(t *testing.T) {
+	server := newTestServerWithProvider(t, toolCallProvider{tool: "bash_command"}, nil)
+	startBackgroundCommand(t, server.URL, "conv", "sleep 30")
+	other := startBackgroundCommand(t, server.URL, "other", "sleep 30")
+
+	resp, body := doJSON(t, http.MethodDelete, server.URL+"/api/conversations/conv", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	pids := listedProcesses(t, server.URL)
+	if len(pids["conv"]) != 0 {
+		t.Errorf("processes %v of the deleted conversation are still running", pids["conv"])
+	}
+	if len(pids["other"]) != 1 || pids["other"][0] != other {
+		t.Errorf("other conversation runs %v, want its process %d", pids["other"], other)
+	}
+	if ids := listConversationIDs(t, server.URL); slices.Contains(ids, "conv") {
+		t.Errorf("deleted conversation is still listed in %v", ids)
+	}
+
+	if resp, _ := doJSON(t, http.MethodDelete, server.URL+"/api/conversations/conv", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("deleting it again: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestSetSystemPromptHandler(t *testing.T) {
+	server := newTestServer(t, nil)
+	url := server.URL + "/api/conversations/conv/system-prompt"
+
+	if resp, body := doJSON(t, http.MethodPut, url, map[string]string{"system_prompt": "Be brief."}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	sendMessage(t, server.URL, "conv", "run echo")
+
+	resp, body := doJSON(t, http.MethodGet, server.URL+"/api/conversations/conv", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	var conv chat_engine.Conversation
+	if err := json.Unmarshal(body, &conv); err != nil {
+		t.Fatalf("invalid response %s: %v", body, err)
+	}
+	if conv.SystemPrompt != "Be brief." || conv.Messages[0].Role != "user" {
+		t.Errorf("conversation has system prompt %q and starts with a %s message, want the prompt kept apart from the messages",
+			conv.SystemPrompt, conv.Messages[0].Role)
+	}
+}
+
+// listConversationIDs returns the IDs of the server's conversations
+func listConversationIDs(t *testing.T, baseURL string) []string {
+	t.Helper()
+	resp, body := doJSON(t, http.MethodGet, baseURL+"/api/conversations", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /api/conversations: status %d: %s", resp.StatusCode, body)
+	}
+	var page chat_engine.ConversationPage
+	if err := json.Unmarshal(body, &page); err != nil {
+		t.Fatalf("invalid response %s: %v", body, err)
+	}
+	var ids []string
+	for _, summary := range page.Conversations {
+		ids = append(ids, summary.ID)
+	}
+	return ids
+}
+
+func TestGetUnknownConversation(t *testing.T) {
+	server := newTestServer(t, nil)
+
+	if resp, _ := doJSON(t, http.MethodGet, server.URL+"/api/conversations/typo", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown conversation: status %d, want 404", resp.StatusCode)
+	}
+	// default is always created
+	if resp, body := doJSON(t, http.MethodGet, server.URL+"/api/conversations/default", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("default conversation: status %d: %s", resp.StatusCode, body)
+	}
+	if ids := listConversationIDs(t, server.URL); slices.Contains(ids, "typo") {
+		t.Errorf("conversations %v include the unknown one", ids)
+	}
+}
+
+func TestGetUnknownConversationCreatesIt(t *testing.T) {
+	server := newTestServer(t, func(s *Server) { s.createOnGet = true })
+
+	resp, body := doJSON(t, http.MethodGet, server.URL+"/api/conversations/new", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	var conv chat_engine.Conversation
+	if err := json.Unmarshal(body, &conv); err != nil || conv.ID != "new" || len(conv.Messages) != 0 {
+		t.Errorf("response %s, want the new empty conversation", body)
+	}
+	if ids := listConversationIDs(t, server.URL); !slices.Contains(ids, "new") {
+		t.Errorf("conversations %v don't include the created one", ids)
+	}
+}
+
+func TestListConversationsPages(t *testing.T) {
+	server := newTestServer(t, nil)
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		sendMessage(t, server.URL, id, "run echo")
+	}
+
+	// getPage follows a link and returns the IDs of the page and its Link header
+	getPage := func(path string) ([]string, int, string) {
+		t.Helper()
+		resp, body := doJSON(t, http.MethodGet, server.URL+path, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: status %d: %s", path, resp.StatusCode, body)
+		}
+		var page chat_engine.ConversationPage
+		if err := json.Unmarshal(body, &page); err != nil {
+			t.Fatalf("invalid response %s: %v", body, err)
+		}
+		var ids []string
+		for _, summary := range page.Conversations {
+			ids = append(ids, summary.ID)
+		}
+		return ids, page.Total, resp.Header.Get("Link")
+	}
+
+	// The pages split the conversations between them
+	var seen []string
+	ids, total, link := getPage("/api/conversations?limit=2")
+	seen = append(seen, ids...)
+	if len(ids) != 2 || total != 5 {
+		t.Errorf("first page is %v of %d, want 2 of 5", ids, total)
+	}
+	if want := `</api/conversations?limit=2&offset=2>; rel="next"`; link != want {
+		t.Errorf("first page links %q, want %q", link, want)
+	}
+
+	ids, _, link = getPage("/api/conversations?limit=2&offset=2")
+	seen = append(seen, ids...)
+	if len(ids) != 2 {
+		t.Errorf("second page is %v, want 2 conversations", ids)
+	}
+	if want := `</api/conversations?limit=2&offset=4>; rel="next", </api/conversations?limit=2&offset=0>; rel="prev"`; link != want {
+		t.Errorf("second page links %q, want %q", link, want)
+	}
+
+	ids, _, link = getPage("/api/conversations?limit=2&offset=4")
+	seen = append(seen, ids...)
+	if len(ids) != 1 {
+		t.Errorf("last page is %v, want 1 conversation", ids)
+	}
+	if want := `</api/conversations?limit=2&offset=2>; rel="prev"`; link != want {
+		t.Errorf("last page links %q, want %q", link, want)
+	}
+	slices.Sort(seen)
+	if got := strings.Join(seen, ","); got != "a,b,c,d,e" {
+		t.Errorf("pages listed %s, want every conversation once", got)
+	}
+
+	// Past the end the page is empty and links back to the last full page
+	ids, total, link = getPage("/api/conversations?limit=2&offset=10")
+	if len(ids) != 0 || total != 5 {
+		t.Errorf("page past the end is %v of %d, want none of 5", ids, total)
+	}
+	if want := `</api/conversations?limit=2&offset=3>; rel="prev"`; link != want {
+		t.Errorf("page past the end links %q, want %q", link, want)
+	}
+
+	for _, query := range []string{"limit=0", "limit=x", "offset=-1"} {
+		if resp, _ := doJSON(t, http.MethodGet, server.URL+"/api/conversations?"+query, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, resp.StatusCode)
+		}
+	}
+}
+
+func TestExportConversationHandler(t *testing.T) {
+	server := newTestServer(t, nil)
+	sendMessage(t, server.URL, "conv", "run echo")
+	url := server.URL + "/api/conversations/conv/export"
+
+	resp, body := doJSON(t, http.MethodGet, url, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/markdown; charset=utf-8" {
+		t.Errorf("Markdown export has Content-Type %q", got)
+	}
+	if got := resp.Header.Get("Content-Disposition"); got != `attachment; filename="conv.md"` {
+		t.Errorf("Markdown export has Content-Disposition %q", got)
+	}
+	if !strings.Contains(string(body), "**Tool call:** `bash_command`") || !strings.Contains(string(body), "The command printed hi.") {
+		t.Errorf("Markdown export is\n%s\nwant the tool call and the reply", body)
+	}
+
+	resp, body = doJSON(t, http.MethodGet, url+"?format=json", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	var conv chat_engine.Conversation
+	if err := json.Unmarshal(body, &conv); err != nil || len(conv.Messages) != 4 {
+		t.Errorf("JSON export is %s, want the conversation with its 4 messages", body)
+	}
+	if got := resp.Header.Get("Content-Disposition"); got != `attachment; filename="conv.json"` {
+		t.Errorf("JSON export has Content-Disposition %q", got)
+	}
+
+	if resp, _ := doJSON(t, http.MethodGet, url+"?format=pdf", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown format: status %d, want 400", resp.StatusCode)
+	}
+	if resp, _ := doJSON(t, http.MethodGet, server.URL+"/api/conversations/missing/export", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown conversation: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestConversationTimesInAPI(t *testing.T) {
+	server := newTestServer(t, nil)
+	sendMessage(t, server.URL, "conv", "run echo")
+
+	var times struct {
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+	resp, body := doJSON(t, http.MethodGet, server.URL+"/api/conversations/conv", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	if err := json.Unmarshal(body, &times); err != nil || times.CreatedAt.IsZero() || times.UpdatedAt.Before(times.CreatedAt) {
+		t.Errorf("conversation has created_at %s and updated_at %s", times.CreatedAt, times.UpdatedAt)
+	}
+
+	resp, body = doJSON(t, http.MethodGet, server.URL+"/api/conversations", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	var page struct {
+		Conversations []struct {
+			CreatedAt time.Time `json:"created_at"`
+			UpdatedAt time.Time `json:"updated_at"`
+		} `json:"conversations"`
+	}
+	if err := json.Unmarshal(body, &page); err != nil || len(page.Conversations) != 1 {
+		t.Fatalf("invalid list %s: %v", body, err)
+	}
+	if summary := page.Conversations[0]; summary.CreatedAt.IsZero() || summary.UpdatedAt.IsZero() {
+		t.Errorf("summary has created_at %s and updated_at %s", summary.CreatedAt, summary.UpdatedAt)
+	}
+}
+
+func TestMessageTimesInAPI(t *testing.T) {
+	server := newTestServer(t, nil)
+	turn := sendMessage(t, server.URL, "conv", "run echo")
+
+	resp, body := doJSON(t, http.MethodGet, server.URL+"/api/conversations/conv", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	var conv struct {
+		Messages []struct {
+			ID        string    `json:"ID"`
+			CreatedAt time.Time `json:"created_at"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &conv); err != nil || len(conv.Messages) != len(turn.Messages) {
+		t.Fatalf("invalid conversation %s: %v", body, err)
+	}
+	for i, msg := range conv.Messages {
+		if msg.ID != turn.Messages[i].ID || !msg.CreatedAt.Equal(turn.Messages[i].CreatedAt) || msg.CreatedAt.IsZero() {
+			t.Errorf("message %d is %s created at %s, want %s created at %s",
+				i, msg.ID, msg.CreatedAt, turn.Messages[i].ID, turn.Messages[i].CreatedAt)
+		}
+	}
+}
+
+func TestCancelTurnHandler(t *testing.T) {
+	var engine *chat_engine.ChatEngine
+	server := newTestServerWithProvider(t, toolCallProvider{tool: "bash_command"}, func(s *Server) { engine = s.chatEngine })
+	background := startBackgroundCommand(t, server.URL, "conv", "sleep 30")
+
+	if resp, _ := doJSON(t, http.MethodPost, server.URL+"/api/conversations/conv/cancel", nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("canceling without a running turn: status %d, want 409", resp.StatusCode)
+	}
+
+	// A turn running a long foreground command
+	type result struct {
+		status   int
+		response SendMessageResponse
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, body := doJSON(t, http.MethodPost, server.URL+"/api/chat", SendMessageRequest{Message: `{"command": "sleep 30"}`, ConversationID: "conv"})
+		var response SendMessageResponse
+		json.Unmarshal(body, &response)
+		done <- result{resp.StatusCode, response}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for !engine.TurnRunning("conv") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, body := doJSON(t, http.MethodPost, server.URL+"/api/conversations/conv/cancel", map[string]bool{"kill_processes": true})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("cancel: status %d: %s", resp.StatusCode, body)
+	}
+	select {
+	case r := <-done:
+		if r.status != http.StatusOK || !r.response.Canceled {
+			t.Errorf("canceled turn: status %d with %+v, want a canceled response", r.status, r.response)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("turn didn't stop after it was canceled")
+	}
+	if pids := listedProcesses(t, server.URL); len(pids["conv"]) != 0 {
+		t.Errorf("background processes %v are still running, want %d killed", pids["conv"], background)
+	}
+}
+
+func TestChatRejectsInvalidSampling(t *testing.T) {
+	server := newTestServer(t, nil)
+
+	temperature := 5.0
+	resp, body := doJSON(t, http.MethodPost, server.URL+"/api/chat", SendMessageRequest{Message: "hi", ConversationID: "conv", Temperature: &temperature})
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "temperature") {
+		t.Errorf("got %d %s, want 400 naming the temperature", resp.StatusCode, body)
+	}
+}
+
+func TestChatWithoutTools(t *testing.T) {
+	server := newTestServerWithProvider(t, toolCallProvider{tool: "bash_command"}, nil)
+	notExecuted := "Not executed: the bash_command tool is not available in this conversation."
+
+	resp, body := doJSON(t, http.MethodPost, server.URL+"/api/chat", SendMessageRequest{Message: `{"command": "echo hi"}`, ConversationID: "conv", DisableTools: true})
+	var turn SendMessageResponse
+	if err := json.Unmarshal(body, &turn); resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("POST /api/chat: status %d: %s", resp.StatusCode, body)
+	}
+	if reply := turn.Messages[len(turn.Messages)-1].Content; reply != notExecuted {
+		t.Errorf("turn without tools replied %q", reply)
+	}
+
+	resp, body = doJSON(t, http.MethodPost, server.URL+"/api/chat", SendMessageRequest{Message: "hi", ConversationID: "conv", AllowedTools: []string{"teleport"}})
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "teleport") {
+		t.Errorf("turn with an unknown tool: got %d %s, want 400", resp.StatusCode, body)
+	}
+}
+
+func TestSetAllowedToolsHandler(t *testing.T) {
+	server := newTestServerWithProvider(t, toolCallProvider{tool: "bash_command"}, nil)
+	url := server.URL + "/api/conversations/conv/tools"
+
+	if resp, body := doJSON(t, http.MethodPut, url, map[string]any{"allowed_tools": []string{"teleport"}}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("allowing an unknown tool: got %d %s, want 400", resp.StatusCode, body)
+	}
+
+	resp, body := doJSON(t, http.MethodPut, url, map[string]any{"allowed_tools": []string{"search_code", "read_file"}})
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"allowed_tools":["read_file","search_code"]`) {
+		t.Fatalf("got %d %s, want the allowed tools", resp.StatusCode, body)
+	}
+	turn := sendMessage(t, server.URL, "conv", `{"command": "echo hi"}`)
+	if reply := turn.Messages[len(turn.Messages)-1].Content; reply != "Not executed: the bash_command tool is not available in this conversation." {
+		t.Errorf("restricted conversation replied %q", reply)
+	}
+
+	// null allows every tool again
+	if resp, body := doJSON(t, http.MethodPut, url, map[string]any{"allowed_tools": nil}); resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"allowed_tools":null`) {
+		t.Fatalf("got %d %s, want no restriction", resp.StatusCode, body)
+	}
+	turn = sendMessage(t, server.URL, "conv", `{"command": "echo hi"}`)
+	if reply := turn.Messages[len(turn.Messages)-1].Content; !strings.Contains(reply, "hi") || strings.Contains(reply, "Not executed") {
+		t.Errorf("unrestricted conversation replied %q", reply)
+	}
+}
+
+func TestTagHandlers(t *testing.T) {
+	server := newTestServer(t, nil)
+	for _, id := range []string{"a", "b"} {
+		sendMessage(t, server.URL, id, "hi")
+	}
+	tagsURL := server.URL + "/api/conversations/a/tags"
+
+	resp, body := doJSON(t, http.MethodPost, tagsURL, map[string]string{"tag": "Work"})
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"tags":["work"]`) {
+		t.Fatalf("adding a tag: got %d %s", resp.StatusCode, body)
+	}
+	if resp, body := doJSON(t, http.MethodPost, tagsURL, map[string]string{"tag": "two words"}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("adding an invalid tag: got %d %s, want 400", resp.StatusCode, body)
+	}
+	if resp, body := doJSON(t, http.MethodPost, server.URL+"/api/conversations/missing/tags", map[string]string{"tag": "work"}); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("tagging an unknown conversation: got %d %s, want 404", resp.StatusCode, body)
+	}
+
+	// The tag filter is case-insensitive like the tags
+	resp, body = doJSON(t, http.MethodGet, server.URL+"/api/conversations?tag=WORK", nil)
+	var page chat_engine.ConversationPage
+	if err := json.Unmarshal(body, &page); resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("listing by tag: got %d %s", resp.StatusCode, body)
+	}
+	if page.Total != 1 || page.Conversations[0].ID != "a" || !slices.Equal(page.Conversations[0].Tags, []string{"work"}) {
+		t.Errorf("conversations tagged work are %+v", page)
+	}
+
+	resp, body = doJSON(t, http.MethodDelete, tagsURL+"/work", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"tags":[]`) {
+		t.Errorf("removing a tag: got %d %s", resp.StatusCode, body)
+	}
+	if resp, body := doJSON(t, http.MethodDelete, tagsURL+"/work", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("removing a removed tag: got %d %s, want 404", resp.StatusCode, body)
+	}
+}
+
+func TestChatRejectsInvalidImages(t *testing.T) {
+	server := newTestServer(t, nil)
+
+	resp, body := doJSON(t, http.MethodPost, server.URL+"/api/chat", SendMessageRequest{
+		Message:        "what is this?",
+		ConversationID: "conv",
+		Images:         []chat_engine.ImageRef{{URL: "https://example.com/cat.png"}, {URL: "file:///etc/passwd"}},
+	})
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "image 1") {
+		t.Errorf("got %d %s, want 400 naming the second image", resp.StatusCode, body)
+	}
+}
+
+func TestForkConversationHandler(t *testing.T) {
+	server := newTestServer(t, nil)
+	turn := sendMessage(t, server.URL, "source", "run echo")
+	forkURL := server.URL + "/api/conversations/source/fork"
+
+	resp, body := doJSON(t, http.MethodPost, forkURL, map[string]string{"fromMessageId": turn.Messages[1].ID})
+	var fork chat_engine.Conversation
+	if err := json.Unmarshal(body, &fork); resp.StatusCode != http.StatusCreated || err != nil {
+		t.Fatalf("forking: got %d %s, want 201", resp.StatusCode, body)
+	}
+	if !strings.HasPrefix(fork.ID, "conv_") || fork.ParentID != "source" || len(fork.Messages) != 2 || fork.Messages[1].ToolCalls[0].ID != "call_echo" {
+		t.Errorf("fork is %+v, want the prompt and the tool call under a new ID", fork)
+	}
+
+	// Without a body the whole conversation is forked
+	resp, body = doJSON(t, http.MethodPost, forkURL, nil)
+	if err := json.Unmarshal(body, &fork); resp.StatusCode != http.StatusCreated || err != nil || len(fork.Messages) != 4 {
+		t.Errorf("forking everything: got %d %s, want the 4 messages", resp.StatusCode, body)
+	}
+
+	if resp, body := doJSON(t, http.MethodPost, forkURL, map[string]string{"fromMessageId": "msg_missing"}); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("forking at an unknown message: got %d %s, want 404", resp.StatusCode, body)
+	}
+	if resp, body := doJSON(t, http.MethodPost, server.URL+"/api/conversations/missing/fork", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("forking an unknown conversation: got %d %s, want 404", resp.StatusCode, body)
+	}
+
+	resp, body = doJSON(t, http.MethodGet, server.URL+"/api/conversations/source", nil)
+	var source chat_engine.Conversation
+	if err := json.Unmarshal(body, &source); err != nil || len(source.Messages) != 4 || source.ParentID != "" {
+		t.Errorf("source is %d %s after forking, want it unchanged", resp.StatusCode, body)
+	}
+}
+
+func TestDuplicateConversationHandler(t *testing.T) {
+	server := newTestServer(t, nil)
+	turn := sendMessage(t, server.URL, "source", "run echo")
+
+	resp, body := doJSON(t, http.MethodPost, server.URL+"/api/conversations/source/duplicate", nil)
+	var duplicate chat_engine.Conversation
+	if err := json.Unmarshal(body, &duplicate); resp.StatusCode != http.StatusCreated || err != nil {
+		t.Fatalf("duplicating: got %d %s, want 201", resp.StatusCode, body)
+	}
+	if !strings.HasPrefix(duplicate.ID, "conv_") || duplicate.ParentID != "" || len(duplicate.Messages) != len(turn.Messages) {
+		t.Fatalf("duplicate is %+v, want a copy of the %d messages under a new ID", duplicate, len(turn.Messages))
+	}
+	for i, msg := range duplicate.Messages {
+		if msg.ID == turn.Messages[i].ID || msg.Content != turn.Messages[i].Content {
+			t.Errorf("duplicate message %d is %+v, want a copy of %+v", i, msg, turn.Messages[i])
+		}
+	}
+
+	if resp, body := doJSON(t, http.MethodPost, server.URL+"/api/conversations/missing/duplicate", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("duplicating an unknown conversation: got %d %s, want 404", resp.StatusCode, body)
+	}
+}
+
+func TestMemoryHandlers(t *testing.T) {
+	server := newTestServerWithProvider(t, scriptedProvider{}, nil, chat_engine.WithMemory("work"))
+
+	resp, body := doJSON(t, http.MethodPost, server.URL+"/api/memories", map[string]string{"key": "editor", "value": "vim"})
+	var memory chat_engine.Memory
+	if err := json.Unmarshal(body, &memory); resp.StatusCode != http.StatusOK || err != nil || memory.Namespace != "work" || memory.Value != "vim" {
+		t.Fatalf("remembering: got %d %s", resp.StatusCode, body)
+	}
+	if resp, body := doJSON(t, http.MethodPost, server.URL+"/api/memories", map[string]string{"key": "editor"}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("remembering without a value: got %d %s, want 400", resp.StatusCode, body)
+	}
+
+	resp, body = doJSON(t, http.MethodGet, server.URL+"/api/memories?q=VIM", nil)
+	var memories []chat_engine.Memory
+	if err := json.Unmarshal(body, &memories); resp.StatusCode != http.StatusOK || err != nil || len(memories) != 1 || memories[0].Key != "editor" {
+		t.Errorf("listing memories: got %d %s", resp.StatusCode, body)
+	}
+	if resp, body := doJSON(t, http.MethodGet, server.URL+"/api/memories?namespace=home", nil); resp.StatusCode != http.StatusOK || strings.TrimSpace(string(body)) != "[]" {
+		t.Errorf("listing another namespace: got %d %s, want no memories", resp.StatusCode, body)
+	}
+
+	if resp, body := doJSON(t, http.MethodDelete, server.URL+"/api/memories/editor", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("forgetting: got %d %s", resp.StatusCode, body)
+	}
+	if resp, body := doJSON(t, http.MethodDelete, server.URL+"/api/memories/editor", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("forgetting twice: got %d %s, want 404", resp.StatusCode, body)
+	}
+}
+
+func TestScheduleHandlers(t *testing.T) {
+	server := newTestServerWithProvider(t, toolCallProvider{tool: "schedule_command"}, nil)
+	sendMessage(t, server.URL, "a", `{"command": "date", "interval_seconds": 60}`)
+	sendMessage(t, server.URL, "b", `{"command": "uptime", "cron": "0 * * * *"}`)
+
+	resp, body := doJSON(t, http.MethodGet, server.URL+"/api/schedules", nil)
+	var schedules []chat_engine.Schedule
+	if err := json.Unmarshal(body, &schedules); resp.StatusCode != http.StatusOK || err != nil || len(schedules) != 2 {
+		t.Fatalf("listing schedules: got %d %s, want both", resp.StatusCode, body)
+	}
+	resp, body = doJSON(t, http.MethodGet, server.URL+"/api/schedules?conversation_id=b", nil)
+	if err := json.Unmarshal(body, &schedules); resp.StatusCode != http.StatusOK || err != nil || len(schedules) != 1 || schedules[0].Cron != "0 * * * *" {
+		t.Fatalf("listing the schedules of b: got %d %s", resp.StatusCode, body)
+	}
+
+	url := server.URL + "/api/schedules/" + schedules[0].ID
+	if resp, body := doJSON(t, http.MethodDelete, url, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("deleting: got %d %s", resp.StatusCode, body)
+	}
+	if resp, body := doJSON(t, http.MethodDelete, url, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("deleting twice: got %d %s, want 404", resp.StatusCode, body)
+	}
+}
+
+func TestConversationStatsHandler(t *testing.T) {
+	server := newTestServer(t, nil)
+	sendMessage(t, server.URL, "conv", "run echo")
+	sendMessage(t, server.URL, "conv", "run echo again")
+
+	resp, body := doJSON(t, http.MethodGet, server.URL+"/api/conversations/conv/stats", nil)
+	var stats chat_engine.ConversationStats
+	if err := json.Unmarshal(body, &stats); resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("GET stats: %d %s", resp.StatusCode, body)
+	}
+	if stats.ConversationID != "conv" || stats.MessageCount != 8 {
+		t.Errorf("stats count %d messages of %q, want 8 of conv", stats.MessageCount, stats.ConversationID)
+	}
+	if want := map[string]int64{"user": 2, "assistant": 4, "tool": 2}; !maps.Equal(stats.MessagesByRole, want) {
+		t.Errorf("messages by role are %v, want %v", stats.MessagesByRole, want)
+	}
+	if want := map[string]int64{"bash_command": 2}; !maps.Equal(stats.ToolCallsByName, want) {
+		t.Errorf("tool calls by name are %v, want %v", stats.ToolCallsByName, want)
+	}
+	if stats.FirstMessageAt == nil || stats.LastMessageAt == nil || stats.LastMessageAt.Before(*stats.FirstMessageAt) {
+		t.Errorf("message times are %v and %v", stats.FirstMessageAt, stats.LastMessageAt)
+	}
+
+	if resp, _ := doJSON(t, http.MethodGet, server.URL+"/api/conversations/missing/stats", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("stats of a missing conversation: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestVacuumHandler(t *testing.T) {
+	server := newTestServer(t, func(s *Server) { s.adminToken = "admin-secret" })
+	sendMessage(t, server.URL, "conv", "run echo")
+
+	vacuum := func(query, auth string) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/api/admin/vacuum"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /api/admin/vacuum: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	// The API is open, so a client without a token may use it but is no admin
+	if resp, _ := vacuum("", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("vacuum without a token: status %d, want 403", resp.StatusCode)
+	}
+	if resp, _ := vacuum("", "wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("vacuum with a wrong token: status %d, want 401", resp.StatusCode)
+	}
+	for _, query := range []string{"", "?checkpoint=true&optimize=true"} {
+		resp, body := vacuum(query, "admin-secret")
+		var result chat_engine.VacuumResult
+		if err := json.Unmarshal(body, &result); resp.StatusCode != http.StatusOK || err != nil {
+			t.Fatalf("vacuum%s: %d %s", query, resp.StatusCode, body)
+		}
+		if result.SizeBefore <= 0 || result.SizeAfter <= 0 {
+			t.Errorf("vacuum%s reported sizes %d and %d", query, result.SizeBefore, result.SizeAfter)
+		}
+	}
+
+	// The history is intact
+	resp, body := doJSON(t, http.MethodGet, server.URL+"/api/conversations/conv", nil)
+	var conv chat_engine.Conversation
+	if err := json.Unmarshal(body, &conv); resp.StatusCode != http.StatusOK || err != nil || len(conv.Messages) != 4 {
+		t.Errorf("conversation after vacuuming: %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestClearConversationHandler(t *testing.T) {
+	server := newTestServer(t, nil)
+	if resp, body := doJSON(t, http.MethodPut, server.URL+"/api/conversations/conv/system-prompt", map[string]string{"system_prompt": "Be brief."}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	sendMessage(t, server.URL, "conv", "run echo")
+
+	if resp, body := doJSON(t, http.MethodPost, server.URL+"/api/conversations/conv/clear", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	resp, body := doJSON(t, http.MethodGet, server.URL+"/api/conversations/conv", nil)
+	var conv chat_engine.Conversation
+	if err := json.Unmarshal(body, &conv); resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("GET conversation: %d %s", resp.StatusCode, body)
+	}
+	if len(conv.Messages) != 0 || conv.SystemPrompt != "Be brief." {
+		t.Errorf("cleared conversation has %d messages and system prompt %q, want none and the prompt kept", len(conv.Messages), conv.SystemPrompt)
+	}
+
+	// The conversation goes on from an empty history
+	if turn := sendMessage(t, server.URL, "conv", "run echo"); len(turn.Messages) != 4 {
+		t.Errorf("turn after clearing has %d messages, want 4", len(turn.Messages))
+	}
+	if resp, _ := doJSON(t, http.MethodPost, server.URL+"/api/conversations/missing/clear", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("clearing a missing conversation: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestClearConversationWithRunningTurn(t *testing.T) {
+	provider := blockingReplyProvider{release: make(chan struct{})}
+	var engine *chat_engine.ChatEngine
+	server := newTestServerWithProvider(t, provider, func(s *Server) { engine = s.chatEngine })
+
+	turnDone := make(chan struct{})
+	go func() {
+		defer close(turnDone)
+		doJSON(t, http.MethodPost, server.URL+"/api/chat", SendMessageRequest{Message: "run echo", ConversationID: "conv"})
+	}()
+	defer func() { <-turnDone }()
+	defer close(provider.release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !engine.TurnRunning("conv") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if resp, body := doJSON(t, http.MethodPost, server.URL+"/api/conversations/conv/clear", nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("clearing during a turn: status %d %s, want 409", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/evgeniy-scherbina/agent/chat_engine"
+	"github.com/openai/openai-go/v2"
+	"github.com/openai/openai-go/v2/option"
+)
+
+// readiness returns the status code and checks of /readyz, requested without credentials
+func readiness(t *testing.T, url string) (int, map[string]string) {
+	t.Helper()
+	resp, body := doJSON(t, http.MethodGet, url, nil)
+	var result struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		t.Fatalf("invalid response %s: %v", body, err)
+	}
+	return resp.StatusCode, result.Checks
+}
+
+func TestReadyz(t *testing.T) {
+	var engine *chat_engine.ChatEngine
+	server := newTestServer(t, func(s *Server) {
+		engine = s.chatEngine
+		// Health checks don't need the API token
+		s.apiToken = "secret"
+	})
+
+	if resp, body := doJSON(t, http.MethodGet, server.URL+"/healthz", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("/healthz: status %d: %s", resp.StatusCode, body)
+	}
+	if code, checks := readiness(t, server.URL+"/readyz"); code != http.StatusOK || checks["database"] != "ok" {
+		t.Errorf("/readyz: status %d with checks %v, want 200", code, checks)
+	}
+
+	engine.Close()
+	if code, checks := readiness(t, server.URL+"/readyz"); code != http.StatusServiceUnavailable || checks["database"] == "ok" {
+		t.Errorf("/readyz with the database closed: status %d with checks %v, want 503", code, checks)
+	}
+	if resp, _ := doJSON(t, http.MethodGet, server.URL+"/healthz", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("/healthz with the database closed: status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestReadyzChecksOpenAI(t *testing.T) {
+	var unavailable atomic.Bool
+	openaiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/models/gpt-test" {
+			http.NotFound(w, r)
+			return
+		}
+		if unavailable.Load() {
+			http.Error(w, `{"error": {"message": "unavailable"}}`, http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id": "gpt-test", "object": "model", "created": 0, "owned_by": "test"}`)
+	}))
+	defer openaiServer.Close()
+	client := openai.NewClient(option.WithBaseURL(openaiServer.URL), option.WithAPIKey("sk-test"), option.WithMaxRetries(0))
+	server := newTestServerWithProvider(t, scriptedProvider{}, func(s *Server) { s.client = &client }, chat_engine.WithModel("gpt-test"))
+
+	if code, checks := readiness(t, server.URL+"/readyz?check=openai"); code != http.StatusOK || checks["openai"] != "ok" {
+		t.Errorf("status %d with checks %v, want 200", code, checks)
+	}
+	// The model endpoint is only checked when asked for
+	unavailable.Store(true)
+	if code, checks := readiness(t, server.URL+"/readyz"); code != http.StatusOK || checks["openai"] != "" {
+		t.Errorf("without ?check=openai: status %d with checks %v, want 200 without the openai check", code, checks)
+	}
+	if code, checks := readiness(t, server.URL+"/readyz?check=openai"); code != http.StatusServiceUnavailable || checks["openai"] == "ok" {
+		t.Errorf("with the model endpoint down: status %d with checks %v, want 503", code, checks)
+	}
+}
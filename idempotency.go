@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// idempotencyWindow is how long the response to a request with an idempotency key is kept
+const idempotencyWindow = 10 * time.Minute
+
+// idempotencyCache remembers the responses to send-message requests by idempotency key, so a
+// retried request gets the response of the original one instead of running the turn again
+type idempotencyCache struct {
+	mutex     sync.Mutex
+	entries   map[string]*idempotentRequest
+	lastSweep time.Time
+}
+
+// idempotentRequest is a request seen with an idempotency key
+type idempotentRequest struct {
+	message string
+	// Closed once the original request completed
+	done chan struct{}
+	// The original response, nil when the request failed
+	response *SendMessageResponse
+	expires  time.Time
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{
+		entries:   make(map[string]*idempotentRequest),
+		lastSweep: time.Now(),
+	}
+}
+
+// begin looks up key. If the key is new, the caller owns the request and must call finish
+// with its response. Otherwise it gets the earlier request, whose done channel is closed once
+// its response is available.
+func (c *idempotencyCache) begin(key, message string, now time.Time) (req *idempotentRequest, owner bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if now.Sub(c.lastSweep) >= time.Minute {
+		c.lastSweep = now
+		for k, entry := range c.entries {
+			if isExpired(entry, now) {
+				delete(c.entries, k)
+			}
+		}
+	}
+
+	if entry, ok := c.entries[key]; ok && !isExpired(entry, now) {
+		return entry, false
+	}
+	req = &idempotentRequest{message: message, done: make(chan struct{})}
+	c.entries[key] = req
+	return req, true
+}
+
+// finish records the response of an owned request. Failed requests (nil response) are
+// forgotten, so retrying them runs the turn again.
+func (c *idempotencyCache) finish(key string, req *idempotentRequest, response *SendMessageResponse) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	req.response = response
+	req.expires = time.Now().Add(idempotencyWindow)
+	if response == nil && c.entries[key] == req {
+		delete(c.entries, key)
+	}
+	close(req.done)
+}
+
+// isExpired reports whether a completed request is past the idempotency window. Requests
+// still running never expire.
+func isExpired(req *idempotentRequest, now time.Time) bool {
+	select {
+	case <-req.done:
+		return now.After(req.expires)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// postChat sends a send-message request with an Idempotency-Key header unless key is empty
+func postChat(t *testing.T, baseURL, key string, req SendMessageRequest) (*http.Response, []byte) {
+	t.Helper()
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, baseURL+"/api/chat", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "" {
+		httpReq.Header.Set("Idempotency-Key", key)
+	}
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestIdempotencyKeyReplaysResponse(t *testing.T) {
+	server := newTestServer(t, nil)
+	req := SendMessageRequest{Message: "run echo", ConversationID: "conv"}
+
+	first, firstBody := postChat(t, server.URL, "key-1", req)
+	if first.StatusCode != http.StatusOK || first.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first request: status %d, replayed %q", first.StatusCode, first.Header.Get("Idempotent-Replayed"))
+	}
+	retry, retryBody := postChat(t, server.URL, "key-1", req)
+	if retry.StatusCode != http.StatusOK || retry.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry: status %d, replayed %q, want the replayed response", retry.StatusCode, retry.Header.Get("Idempotent-Replayed"))
+	}
+	if !bytes.Equal(retryBody, firstBody) {
+		t.Errorf("retry got\n%s\nwant the first response\n%s", retryBody, firstBody)
+	}
+
+	// The key can also be sent in the body
+	req.IdempotencyKey = "key-1"
+	if resp, body := postChat(t, server.URL, "", req); resp.Header.Get("Idempotent-Replayed") != "true" || !bytes.Equal(body, firstBody) {
+		t.Errorf("retry with the key in the body: replayed %q with %s", resp.Header.Get("Idempotent-Replayed"), body)
+	}
+	req.IdempotencyKey = ""
+
+	// The turn ran once
+	resp, body := doJSON(t, http.MethodGet, server.URL+"/api/conversations/conv", nil)
+	var conv struct {
+		Messages []json.RawMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &conv); err != nil || resp.StatusCode != http.StatusOK || len(conv.Messages) != 4 {
+		t.Errorf("conversation is %s, want the messages of one turn", body)
+	}
+
+	if resp, _ := postChat(t, server.URL, "key-1", SendMessageRequest{Message: "something else", ConversationID: "conv"}); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("reusing the key for another message: status %d, want 422", resp.StatusCode)
+	}
+	// Keys are scoped to the conversation
+	if resp, _ := postChat(t, server.URL, "key-1", SendMessageRequest{Message: "run echo", ConversationID: "other"}); resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Error("the key of another conversation was replayed")
+	}
+}
+
+func TestIdempotencyCacheExpires(t *testing.T) {
+	cache := newIdempotencyCache()
+	now := time.Now()
+
+	req, owner := cache.begin("key", "hi", now)
+	if !owner {
+		t.Fatal("first request doesn't own its key")
+	}
+	// A retry while the request runs waits for it
+	if retry, owner := cache.begin("key", "hi", now.Add(time.Hour)); owner || retry != req {
+		t.Error("retry of a running request got a new entry")
+	}
+	cache.finish("key", req, &SendMessageResponse{})
+
+	if _, owner := cache.begin("key", "hi", time.Now().Add(idempotencyWindow/2)); owner {
+		t.Error("key expired within the window")
+	}
+	if _, owner := cache.begin("key", "hi", time.Now().Add(idempotencyWindow+time.Second)); !owner {
+		t.Error("key didn't expire after the window")
+	}
+
+	// Failed requests are forgotten
+	failed, _ := cache.begin("failed", "hi", now)
+	cache.finish("failed", failed, nil)
+	if _, owner := cache.begin("failed", "hi", now); !owner {
+		t.Error("failed request was kept")
+	}
+}
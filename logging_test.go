@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/evgeniy-scherbina/agent/chat_engine"
+)
+
+// logCapture collects the records logged through the default logger as JSON
+type logCapture struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (c *logCapture) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.buf.Write(p)
+}
+
+// records returns the records logged with message msg
+func (c *logCapture) records(t *testing.T, msg string) []map[string]any {
+	t.Helper()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(c.buf.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		if record["msg"] == msg {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// captureLogs makes the default logger write to the returned capture until the test ends
+func captureLogs(t *testing.T) *logCapture {
+	capture := &logCapture{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(capture, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return capture
+}
+
+func TestToolLogsHaveStructuredFields(t *testing.T) {
+	logs := captureLogs(t)
+	policy, err := chat_engine.NewCommandPolicy(chat_engine.CommandPolicyBlocklist, []string{`^rm\b`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestServerWithProvider(t, toolCallProvider{tool: "bash_command"}, nil, chat_engine.WithCommandPolicy(policy))
+	sendMessage(t, server.URL, "conv", `{"command": "rm -rf build"}`)
+
+	records := logs.records(t, "Blocked tool call by command policy")
+	if len(records) != 1 {
+		t.Fatalf("logged %d records about the blocked call, want 1", len(records))
+	}
+	record := records[0]
+	if record["level"] != "INFO" || record["conversation_id"] != "conv" || record["tool"] != "bash_command" || record["tool_call_id"] != "call_1" {
+		t.Errorf("record %v, want the level, conversation and tool call", record)
+	}
+	if id, _ := record["request_id"].(string); id == "" {
+		t.Errorf("record %v has no request ID", record)
+	}
+}
+
+func TestLoggerFromEnv(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "warn")
+	t.Setenv("LOG_FORMAT", "json")
+	logger, err := loggerFromEnv()
+	if err != nil {
+		t.Fatalf("loggerFromEnv: %v", err)
+	}
+	if logger.Enabled(t.Context(), slog.LevelInfo) || !logger.Enabled(t.Context(), slog.LevelWarn) {
+		t.Error("LOG_LEVEL=warn doesn't log from warnings up")
+	}
+	if _, ok := logger.Handler().(*slog.JSONHandler); !ok {
+		t.Errorf("LOG_FORMAT=json made a %T", logger.Handler())
+	}
+
+	for name, value := range map[string]string{"LOG_LEVEL": "verbose", "LOG_FORMAT": "xml"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := loggerFromEnv(); err == nil || !strings.Contains(err.Error(), name) {
+				t.Errorf("%s=%s returned %v, want an error naming the variable", name, value, err)
+			}
+		})
+	}
+}
+
+// chatWithRequestID runs a turn, sending id as X-Request-ID unless it is empty, and returns
+// the request ID of the response
+func chatWithRequestID(t *testing.T, baseURL, id string) string {
+	t.Helper()
+	body := strings.NewReader(`{"message": "run echo", "conversationId": "conv"}`)
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/api/chat", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	return resp.Header.Get(requestIDHeader)
+}
+
+func TestRequestIDInLogsAndAudit(t *testing.T) {
+	logs := captureLogs(t)
+	server := newTestServer(t, nil)
+
+	if got := chatWithRequestID(t, server.URL, "trace-123"); got != "trace-123" {
+		t.Errorf("response has request ID %q, want the client's", got)
+	}
+	generated := chatWithRequestID(t, server.URL, "")
+	if !regexp.MustCompile(`^[0-9a-f]{32}$`).MatchString(generated) {
+		t.Errorf("generated request ID %q, want 32 hex digits", generated)
+	}
+	// IDs that aren't safe to log are replaced
+	if replaced := chatWithRequestID(t, server.URL, "has spaces"); replaced == "has spaces" || replaced == "" {
+		t.Errorf("unsafe request ID was echoed as %q", replaced)
+	}
+
+	var logged []string
+	for _, record := range logs.records(t, "Request") {
+		if record["path"] == "/api/chat" {
+			logged = append(logged, record["request_id"].(string))
+		}
+	}
+	if len(logged) != 3 || logged[0] != "trace-123" || logged[1] != generated {
+		t.Errorf("requests were logged with IDs %q, want trace-123 and %s first", logged, generated)
+	}
+
+	// The engine's log lines for the turn carry the ID too
+	if records := logs.records(t, "Executing tool calls"); len(records) != 3 || records[0]["request_id"] != "trace-123" {
+		t.Errorf("tool loop logged %v, want the request ID", records)
+	}
+
+	resp, body := doJSON(t, http.MethodGet, server.URL+"/api/audit?conversation_id=conv", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	var page chat_engine.CommandAuditPage
+	if err := json.Unmarshal(body, &page); err != nil {
+		t.Fatalf("invalid response %s: %v", body, err)
+	}
+	var audited []string
+	for _, entry := range page.Entries {
+		audited = append(audited, entry.RequestID)
+	}
+	// Most recent first
+	if len(audited) != 3 || audited[2] != "trace-123" || audited[1] != generated {
+		t.Errorf("commands were audited with request IDs %q, want the IDs of their requests", audited)
+	}
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/evgeniy-scherbina/agent/chat_engine"
@@ -21,58 +28,256 @@ import (
 type SendMessageRequest struct {
 	Message        string `json:"message"`
 	ConversationID string `json:"conversationId,omitempty"`
+	// Ephemeral messages are processed but not saved to the conversation history
+	Ephemeral bool `json:"ephemeral,omitempty"`
+	// SystemPrompt, when set, becomes the conversation's system prompt
+	SystemPrompt string `json:"system_prompt,omitempty"`
+	// IdempotencyKey makes retries of the request return the original response instead of
+	// running the turn again. The Idempotency-Key header takes precedence.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// ResponseFormat, when set, makes the final reply of the turn JSON
+	ResponseFormat *chat_engine.ResponseFormat `json:"response_format,omitempty"`
+	// Sampling parameters for the turn, unset ones keep the server's defaults
+	Temperature      *float64 `json:"temperature,omitempty"`
+	TopP             *float64 `json:"top_p,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	// DisableTools makes the turn a plain chat without tools
+	DisableTools bool `json:"disable_tools,omitempty"`
+	// AllowedTools, when set, restricts the tools of the turn to the named ones
+	AllowedTools []string `json:"allowed_tools,omitempty"`
+	// Images attached to the message, for models that accept images
+	Images []chat_engine.ImageRef `json:"images,omitempty"`
+}
+
+// sampling returns the sampling parameters set in the request
+func (req SendMessageRequest) sampling() *chat_engine.SamplingParams {
+	return &chat_engine.SamplingParams{
+		Temperature:      req.Temperature,
+		TopP:             req.TopP,
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+	}
 }
 
 // SendMessageResponse represents a response from the chat
 type SendMessageResponse struct {
 	Messages []*chat_engine.Message `json:"messages"`
 	Error    string                 `json:"error,omitempty"`
+	// Partial is set when the turn stopped at the tool iteration limit, Error then says why
+	Partial bool `json:"partial,omitempty"`
+	// PendingToolCalls are set when the turn paused until these tool calls are approved or rejected
+	PendingToolCalls []chat_engine.ToolCall `json:"pending_tool_calls,omitempty"`
+	// Canceled is set when the turn was stopped through the cancel endpoint
+	Canceled bool `json:"canceled,omitempty"`
+}
+
+// turnResponse builds the response for the messages of a turn and the error it ended with.
+// ok is false when the turn failed.
+func turnResponse(messages []*chat_engine.Message, err error) (response SendMessageResponse, ok bool) {
+	response = SendMessageResponse{Messages: messages}
+	var limitErr *chat_engine.IterationLimitError
+	var approvalErr *chat_engine.ApprovalRequiredError
+	switch {
+	case errors.As(err, &limitErr):
+		response.Partial = true
+		response.Error = limitErr.Error()
+	case errors.As(err, &approvalErr):
+		response.PendingToolCalls = approvalErr.ToolCalls
+	case errors.Is(err, chat_engine.ErrTurnCanceled):
+		response.Canceled = true
+	case err != nil:
+		return response, false
+	}
+	return response, true
 }
 
+// shutdownTimeout bounds how long in-flight requests may run after a shutdown signal
+const shutdownTimeout = 15 * time.Second
+
+// readyCheckTimeout bounds each check of the readiness endpoint
+const readyCheckTimeout = 5 * time.Second
+
 type Server struct {
 	client     *openai.Client
 	chatEngine *chat_engine.ChatEngine
+	// Bearer token required for every /api endpoint, the API is open when it is empty
+	apiToken string
+	// Bearer token for /api/admin endpoints, which are disabled when it is empty
+	adminToken string
+	// Whether getting an unknown conversation creates it, "default" is always created
+	createOnGet bool
+	// Per-client limit on /api requests, nil when rate limiting is disabled
+	rateLimiter *rateLimiter
+	// Responses to send-message requests by idempotency key
+	idempotency *idempotencyCache
+	// Origins allowed to make cross-origin requests and open WebSocket connections
+	allowedOrigins []string
+}
+
+// fatal logs err and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
 
 func main() {
-	// Initialize OpenAI client
-	client := openai.NewClient(
-	//option.WithAPIKey(""), // Will use OPENAI_API_KEY env var
-	)
+	logger, err := loggerFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
+	clientOptions, err := clientOptionsFromEnv()
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+	engineOptions, err := engineOptionsFromEnv()
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+	createOnGet, _, err := envBool("AGENT_CREATE_CONVERSATION_ON_GET")
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+	rateLimiter, err := rateLimiterFromEnv()
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+
+	// Initialize OpenAI client, or a client for any OpenAI-compatible endpoint
+	client := openai.NewClient(clientOptions...)
+
+	// Semantic search embeds messages with the same client
+	if model := os.Getenv("AGENT_EMBEDDING_MODEL"); model != "" {
+		engineOptions = append(engineOptions, chat_engine.WithEmbedder(chat_engine.NewOpenAIEmbedder(&client, model)))
+	}
 
-	chatEngine, err := chat_engine.NewChatEngine(&client)
+	provider := chat_engine.NewOpenAIProvider(&client, openai.ChatModelGPT5)
+	chatEngine, err := chat_engine.NewChatEngine(provider, engineOptions...)
 	if err != nil {
-		log.Fatalf("Failed to initialize chat engine: %v", err)
+		fatal("Failed to initialize chat engine", err)
 	}
 
 	server := &Server{
-		client:     &client,
-		chatEngine: chatEngine,
+		client:         &client,
+		chatEngine:     chatEngine,
+		apiToken:       os.Getenv("AGENT_API_TOKEN"),
+		adminToken:     os.Getenv("AGENT_ADMIN_TOKEN"),
+		createOnGet:    createOnGet,
+		rateLimiter:    rateLimiter,
+		idempotency:    newIdempotencyCache(),
+		allowedOrigins: allowedOriginsFromEnv(),
+	}
+	if server.apiToken == "" {
+		slog.Warn("AGENT_API_TOKEN is not set, the API (including command execution) is open to anyone who can reach it")
+	}
+
+	httpServer := &http.Server{
+		Addr:    ":8080",
+		Handler: server.routes(),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("Server starting", "addr", httpServer.Addr, "frontend", "ui/dist")
+		serverErr <- httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Server error", "error", err)
+		}
+	case <-ctx.Done():
+		slog.Info("Shutting down, waiting for in-flight requests", "timeout", shutdownTimeout.String())
+	}
+	stop()
+
+	// Single shutdown path: drain HTTP requests, then kill processes and close the database
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		slog.Error("HTTP server shutdown failed", "error", err)
 	}
+	if err := chatEngine.Close(); err != nil {
+		slog.Error("Failed to close chat engine", "error", err)
+	}
+	slog.Info("Shutdown complete")
+}
 
-	// Setup router
+// routes returns the router serving the API, the health checks and the frontend
+func (s *Server) routes() http.Handler {
 	r := chi.NewRouter()
 
 	// Middleware
-	r.Use(middleware.Logger)
+	r.Use(requestID)
+	r.Use(requestLogger)
 	r.Use(middleware.Recoverer)
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"*"},
+		AllowedOrigins:   s.allowedOrigins,
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "Idempotency-Key", "X-CSRF-Token", "X-Request-ID"},
+		ExposedHeaders:   []string{"Idempotent-Replayed", "Link", "Retry-After", "X-Request-ID"},
 		AllowCredentials: false,
 		MaxAge:           300,
 	}))
 
+	// Health checks for load balancers and orchestrators, outside of /api so they need no token
+	r.Get("/healthz", s.handleHealth)
+	r.Get("/readyz", s.handleReady)
+
 	// API Routes
 	r.Route("/api", func(r chi.Router) {
-		r.Post("/chat", server.handleSendMessage)
-		r.Post("/chat/stream", server.handleSendMessageStream)
-		r.Get("/conversations/{id}", server.handleGetConversation)
-		r.Get("/conversations", server.handleListConversations)
-		r.Get("/processes", server.handleListProcesses)
-		r.Post("/processes/{pid}/kill", server.handleKillProcess)
+		r.Use(s.rateLimit)
+		r.Use(s.requireAPIToken)
+
+		r.Post("/chat", s.handleSendMessage)
+		r.Post("/chat/stream", s.handleSendMessageStream)
+		r.Get("/ws", s.handleWebSocket)
+		r.Get("/conversations/{id}", s.handleGetConversation)
+		r.Delete("/conversations/{id}", s.handleDeleteConversation)
+		r.Post("/conversations/{id}/clear", s.handleClearConversation)
+		r.Get("/conversations/{id}/context", s.handleGetConversationContext)
+		r.Get("/conversations/{id}/stats", s.handleGetConversationStats)
+		r.Get("/conversations/{id}/export", s.handleExportConversation)
+		r.Put("/conversations/{id}/working-dir", s.handleSetWorkingDir)
+		r.Put("/conversations/{id}/read-only", s.handleSetReadOnly)
+		r.Put("/conversations/{id}/tools", s.handleSetAllowedTools)
+		r.Put("/conversations/{id}/system-prompt", s.handleSetSystemPrompt)
+		r.Put("/conversations/{id}/title", s.handleSetTitle)
+		r.Put("/conversations/{id}/webhook", s.handleSetWebhook)
+		r.Post("/conversations/{id}/tags", s.handleAddTag)
+		r.Delete("/conversations/{id}/tags/{tag}", s.handleRemoveTag)
+		r.Put("/conversations/{id}/messages/{msgId}", s.handleEditMessage)
+		r.Post("/conversations/{id}/fork", s.handleForkConversation)
+		r.Post("/conversations/{id}/continue", s.handleContinueTurn)
+		r.Post("/conversations/{id}/duplicate", s.handleDuplicateConversation)
+		r.Post("/conversations/{id}/approve-tool/{toolCallId}", s.handleDecideToolCall(true))
+		r.Post("/conversations/{id}/reject-tool/{toolCallId}", s.handleDecideToolCall(false))
+		r.Post("/conversations/{id}/kill-processes", s.handleKillConversationProcesses)
+		r.Post("/conversations/{id}/cancel", s.handleCancelTurn)
+		r.Get("/conversations", s.handleListConversations)
+		r.Post("/import", s.handleImport)
+		r.Post("/import/validate", s.handleValidateImport)
+		r.Get("/search", s.handleSearch)
+		r.Get("/search/semantic", s.handleSemanticSearch)
+		r.Get("/memories", s.handleListMemories)
+		r.Post("/memories", s.handleRemember)
+		r.Delete("/memories/{key}", s.handleForget)
+		r.Get("/schedules", s.handleListSchedules)
+		r.Delete("/schedules/{id}", s.handleDeleteSchedule)
+		r.Get("/usage", s.handleGetUsage)
+		r.Get("/audit", s.handleAudit)
+		r.Get("/processes", s.handleListProcesses)
+		r.With(s.requireAdmin).Post("/admin/vacuum", s.handleVacuum)
+		r.Get("/processes/{pid}/logs", s.handleGetProcessLogs)
+		r.Get("/processes/{pid}/stream", s.handleStreamProcessOutput)
+		r.Post("/processes/{pid}/kill", s.handleKillProcess)
 	})
 
 	// Serve static files from ui/dist
@@ -103,12 +308,26 @@ func main() {
 		indexPath := filepath.Join(filesDir, "index.html")
 		http.ServeFile(w, r, indexPath)
 	})
+	return r
+}
 
-	fmt.Println("Server starting on :8080")
-	fmt.Println("Serving frontend from: ui/dist")
-	if err := http.ListenAndServe(":8080", r); err != nil {
-		log.Fatal(err)
+// validateSendMessageRequest checks the options of a send-message request
+func (s *Server) validateSendMessageRequest(req SendMessageRequest) error {
+	if err := s.chatEngine.ValidateUserMessage(req.Message, req.Images); err != nil {
+		return err
+	}
+	if req.ResponseFormat != nil {
+		if err := req.ResponseFormat.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := req.sampling().Validate(); err != nil {
+		return err
 	}
+	if err := s.chatEngine.ValidateToolNames(req.AllowedTools); err != nil {
+		return err
+	}
+	return chat_engine.ValidateImages(req.Images)
 }
 
 // handleSendMessage processes chat messages
@@ -118,6 +337,10 @@ func (s *Server) handleSendMessage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if err := s.validateSendMessageRequest(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Use provided conversation ID or default
 	conversationID := req.ConversationID
@@ -125,125 +348,1462 @@ func (s *Server) handleSendMessage(w http.ResponseWriter, r *http.Request) {
 		conversationID = "default"
 	}
 
-	newMessages, err := s.chatEngine.SendUserMessage(conversationID, req.Message)
-	if err != nil {
-		http.Error(w, "Failed to send message", http.StatusInternalServerError)
+	// A request repeating an earlier idempotency key gets the earlier response, waiting for it
+	// if the earlier request is still running
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		idempotencyKey = req.IdempotencyKey
+	}
+	if idempotencyKey != "" {
+		cacheKey := conversationID + "\x00" + idempotencyKey
+		original, owner := s.idempotency.begin(cacheKey, req.Message, time.Now())
+		if !owner {
+			if original.message != req.Message {
+				http.Error(w, "Idempotency key was already used for a different message", http.StatusUnprocessableEntity)
+				return
+			}
+			select {
+			case <-original.done:
+			case <-r.Context().Done():
+				return
+			}
+			if original.response == nil {
+				http.Error(w, "Failed to send message", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Idempotent-Replayed", "true")
+			json.NewEncoder(w).Encode(original.response)
+			return
+		}
+
+		// Deferred so that waiting retries are released even if the turn panics
+		var response *SendMessageResponse
+		defer func() {
+			s.idempotency.finish(cacheKey, original, response)
+		}()
+		response = s.sendMessage(w, r, conversationID, req)
 		return
 	}
 
+	s.sendMessage(w, r, conversationID, req)
+}
+
+// sendMessage runs the turn of a send-message request and writes the response, which is
+// returned unless the turn failed
+func (s *Server) sendMessage(w http.ResponseWriter, r *http.Request, conversationID string, req SendMessageRequest) *SendMessageResponse {
+	newMessages, err := s.chatEngine.SendUserMessageWithOptions(conversationID, req.Message, chat_engine.SendOptions{
+		Ephemeral:      req.Ephemeral,
+		SystemPrompt:   req.SystemPrompt,
+		RequestID:      middleware.GetReqID(r.Context()),
+		ResponseFormat: req.ResponseFormat,
+		Sampling:       req.sampling(),
+		DisableTools:   req.DisableTools,
+		AllowedTools:   req.AllowedTools,
+		Images:         req.Images,
+	})
+	if errors.Is(err, chat_engine.ErrConversationFull) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return nil
+	}
+	response, ok := turnResponse(newMessages, err)
+	if !ok {
+		requestLog(r).Error("Failed to send message", "conversation_id", conversationID, "error", err)
+		http.Error(w, "Failed to send message", http.StatusInternalServerError)
+		return nil
+	}
+
 	// Return response
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(SendMessageResponse{
-		Messages: newMessages,
-	})
+	json.NewEncoder(w).Encode(response)
+	return &response
 }
 
-// handleGetConversation returns a specific conversation
+// handleGetConversation returns a specific conversation. Without limit the full history is
+// returned, with limit and offset only that page of messages, oldest first, along with the
+// total number of messages.
 func (s *Server) handleGetConversation(w http.ResponseWriter, r *http.Request) {
 	conversationID := chi.URLParam(r, "id")
+	query := r.URL.Query()
+
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	offset := 0
+	if value := query.Get("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
 
 	conv := s.chatEngine.GetConversation(conversationID)
 
-	// If conversation doesn't exist, create it (especially for "default")
+	// If conversation doesn't exist, create it if allowed, so a mistyped ID doesn't silently
+	// add an empty conversation
 	if conv == nil {
+		if conversationID != "default" && !s.createOnGet {
+			http.Error(w, "Conversation not found", http.StatusNotFound)
+			return
+		}
 		conv = s.chatEngine.GetOrCreateConversation(conversationID)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(conv)
+	if limit == 0 {
+		json.NewEncoder(w).Encode(conv)
+		return
+	}
+
+	page, err := s.chatEngine.ConversationMessagesPaged(conversationID, limit, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The page's messages replace the conversation's full history in the response
+	json.NewEncoder(w).Encode(struct {
+		*chat_engine.Conversation
+		Messages      []*chat_engine.Message `json:"messages"`
+		TotalMessages int                    `json:"total_messages"`
+		Limit         int                    `json:"limit"`
+		Offset        int                    `json:"offset"`
+	}{conv, page.Messages, page.Total, page.Limit, page.Offset})
 }
 
-// handleListConversations returns all conversations
-func (s *Server) handleListConversations(w http.ResponseWriter, r *http.Request) {
-	conversations := s.chatEngine.ListConversation()
+// handleExportConversation returns the full conversation as a file download, format is
+// markdown (the default) or json
+func (s *Server) handleExportConversation(w http.ResponseWriter, r *http.Request) {
+	conversationID := chi.URLParam(r, "id")
+
+	format := chat_engine.ExportMarkdown
+	if value := r.URL.Query().Get("format"); value != "" {
+		parsed, err := chat_engine.ParseExportFormat(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		format = parsed
+	}
+
+	if s.chatEngine.GetConversation(conversationID) == nil {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+
+	data, err := s.chatEngine.ExportConversation(conversationID, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if format == chat_engine.ExportMarkdown {
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", conversationID+"."+format.FileExtension()))
+	w.Write(data)
+}
+
+// handleGetConversationContext returns the messages and tools the model would see for a conversation
+func (s *Server) handleGetConversationContext(w http.ResponseWriter, r *http.Request) {
+	conversationID := chi.URLParam(r, "id")
+
+	convContext := s.chatEngine.GetConversationContext(conversationID)
+	if convContext == nil {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(conversations)
+	json.NewEncoder(w).Encode(convContext)
 }
 
-// handleSendMessageStream processes chat messages with Server-Sent Events streaming
-func (s *Server) handleSendMessageStream(w http.ResponseWriter, r *http.Request) {
-	var req SendMessageRequest
+// handleGetConversationStats responds with aggregates over the history of a conversation
+func (s *Server) handleGetConversationStats(w http.ResponseWriter, r *http.Request) {
+	conversationID := chi.URLParam(r, "id")
+
+	if s.chatEngine.GetConversation(conversationID) == nil {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+	stats, err := s.chatEngine.ConversationStats(conversationID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// handleSetWorkingDir sets the default directory tools run in for a conversation
+func (s *Server) handleSetWorkingDir(w http.ResponseWriter, r *http.Request) {
+	conversationID := chi.URLParam(r, "id")
+
+	var req struct {
+		WorkingDir string `json:"working_dir"`
+	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	// Use provided conversation ID or default
-	conversationID := req.ConversationID
-	if conversationID == "" {
-		conversationID = "default"
+	dir, err := s.chatEngine.SetWorkingDir(conversationID, req.WorkingDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// Set up SSE headers
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"conversation_id": conversationID,
+		"working_dir":     dir,
+	})
+}
 
-	// Create a flusher to send data immediately
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+// handleSetTitle renames a conversation. Automatic titling skips conversations that already
+// have a title, so a manual title is kept.
+func (s *Server) handleSetTitle(w http.ResponseWriter, r *http.Request) {
+	conversationID := chi.URLParam(r, "id")
+
+	var req struct {
+		Title string `json:"title"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	// Send initial connection message
-	fmt.Fprintf(w, "data: %s\n\n", `{"type":"connected"}`)
-	flusher.Flush()
+	if err := s.chatEngine.SetConversationTitle(conversationID, req.Title); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 
-	// Callback to send messages as they're created
-	callback := func(msg *chat_engine.Message) {
-		msgJSON, err := json.Marshal(msg)
-		if err != nil {
-			log.Printf("Error marshaling message for stream: %v", err)
-			return
-		}
-		fmt.Fprintf(w, "data: %s\n\n", string(msgJSON))
-		flusher.Flush()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"conversation_id": conversationID,
+		"title":           s.chatEngine.GetConversation(conversationID).Title,
+	})
+}
+
+// handleAddTag labels a conversation with a tag
+func (s *Server) handleAddTag(w http.ResponseWriter, r *http.Request) {
+	conversationID := chi.URLParam(r, "id")
+
+	var req struct {
+		Tag string `json:"tag"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := chat_engine.ValidateTag(req.Tag); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// Process message with streaming updates in a goroutine
-	done := make(chan bool)
-	go func() {
-		defer func() {
-			done <- true
-		}()
+	if err := s.chatEngine.AddConversationTag(conversationID, req.Tag); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.writeTags(w, conversationID)
+}
 
-		_, err := s.chatEngine.SendUserMessageWithCallback(conversationID, req.Message, callback)
-		if err != nil {
-			errorMsg := fmt.Sprintf(`{"type":"error","error":"%s"}`, err.Error())
-			fmt.Fprintf(w, "data: %s\n\n", errorMsg)
-			flusher.Flush()
-		} else {
-			// Send completion message
-			fmt.Fprintf(w, "data: %s\n\n", `{"type":"done"}`)
-			flusher.Flush()
-		}
-	}()
+// handleRemoveTag removes a tag from a conversation
+func (s *Server) handleRemoveTag(w http.ResponseWriter, r *http.Request) {
+	conversationID := chi.URLParam(r, "id")
 
-	// Keep connection alive and wait for completion
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-r.Context().Done():
-			return
-		case <-done:
+	if err := s.chatEngine.RemoveConversationTag(conversationID, chi.URLParam(r, "tag")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.writeTags(w, conversationID)
+}
+
+// writeTags responds with the tags of a conversation
+func (s *Server) writeTags(w http.ResponseWriter, conversationID string) {
+	tags, err := s.chatEngine.ConversationTags(conversationID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"conversation_id": conversationID,
+		"tags":            tags,
+	})
+}
+
+// handleDeleteConversation deletes a conversation, killing its background processes
+func (s *Server) handleDeleteConversation(w http.ResponseWriter, r *http.Request) {
+	conversationID := chi.URLParam(r, "id")
+
+	if s.chatEngine.GetConversation(conversationID) == nil {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+	if err := s.chatEngine.DeleteConversation(conversationID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Conversation %s deleted", conversationID),
+	})
+}
+
+// handleClearConversation deletes the messages of a conversation, keeping its settings
+func (s *Server) handleClearConversation(w http.ResponseWriter, r *http.Request) {
+	conversationID := chi.URLParam(r, "id")
+
+	if s.chatEngine.GetConversation(conversationID) == nil {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+	err := s.chatEngine.ClearConversation(conversationID)
+	if errors.Is(err, chat_engine.ErrTurnRunning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Conversation %s cleared", conversationID),
+	})
+}
+
+// handleForkConversation creates a conversation from the history of another one, up to and
+// including fromMessageId if given, and responds with it
+func (s *Server) handleForkConversation(w http.ResponseWriter, r *http.Request) {
+	conversationID := chi.URLParam(r, "id")
+
+	var req struct {
+		FromMessageID string `json:"fromMessageId"`
+	}
+	// The body is optional
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
-		case <-ticker.C:
-			fmt.Fprintf(w, ": keepalive\n\n")
-			flusher.Flush()
 		}
 	}
-}
 
-// handleListProcesses returns all running background processes
-func (s *Server) handleListProcesses(w http.ResponseWriter, r *http.Request) {
-	processes := s.chatEngine.GetProcesses()
+	if s.chatEngine.GetConversation(conversationID) == nil {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+	fork, err := s.chatEngine.ForkConversation(conversationID, req.FromMessageID)
+	if errors.Is(err, chat_engine.ErrMessageNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		requestLog(r).Error("Failed to fork conversation", "conversation_id", conversationID, "error", err)
+		http.Error(w, "Failed to fork conversation", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(processes)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(fork)
+}
+
+// handleDuplicateConversation copies a whole conversation into a new independent one and
+// responds with it
+func (s *Server) handleDuplicateConversation(w http.ResponseWriter, r *http.Request) {
+	conversationID := chi.URLParam(r, "id")
+
+	if s.chatEngine.GetConversation(conversationID) == nil {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+	duplicate, err := s.chatEngine.DuplicateConversation(conversationID)
+	if errors.Is(err, chat_engine.ErrTurnRunning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		requestLog(r).Error("Failed to duplicate conversation", "conversation_id", conversationID, "error", err)
+		http.Error(w, "Failed to duplicate conversation", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(duplicate)
+}
+
+// handleDecideToolCall approves or rejects a tool call awaiting approval. Once every pending
+// call of the round is decided the turn resumes, and the response holds its new messages
+// like the chat endpoint; until then it only lists the calls still pending.
+func (s *Server) handleDecideToolCall(approved bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conversationID := chi.URLParam(r, "id")
+		toolCallID := chi.URLParam(r, "toolCallId")
+
+		if s.chatEngine.GetConversation(conversationID) == nil {
+			http.Error(w, "Conversation not found", http.StatusNotFound)
+			return
+		}
+
+		newMessages, err := s.chatEngine.DecideToolCall(conversationID, toolCallID, approved, chat_engine.SendOptions{
+			RequestID: middleware.GetReqID(r.Context()),
+		})
+		if errors.Is(err, chat_engine.ErrToolCallNotPending) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		response, ok := turnResponse(newMessages, err)
+		if !ok {
+			http.Error(w, "Failed to resume conversation", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// handleContinueTurn resumes a turn that was interrupted, running the tool calls left without
+// a response, and responds with the new messages like handleSendMessage
+func (s *Server) handleContinueTurn(w http.ResponseWriter, r *http.Request) {
+	conversationID := chi.URLParam(r, "id")
+
+	if s.chatEngine.GetConversation(conversationID) == nil {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+
+	newMessages, err := s.chatEngine.ContinueTurn(conversationID, chat_engine.SendOptions{
+		RequestID: middleware.GetReqID(r.Context()),
+	})
+	if errors.Is(err, chat_engine.ErrNothingToContinue) || errors.Is(err, chat_engine.ErrTurnRunning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	response, ok := turnResponse(newMessages, err)
+	if !ok {
+		requestLog(r).Error("Failed to continue turn", "conversation_id", conversationID, "error", err)
+		http.Error(w, "Failed to continue conversation", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleEditMessage replaces the content of a message. Editing a user message removes the
+// messages after it, so the conversation can be continued from the corrected prompt.
+func (s *Server) handleEditMessage(w http.ResponseWriter, r *http.Request) {
+	conversationID := chi.URLParam(r, "id")
+	messageID := chi.URLParam(r, "msgId")
+
+	var req struct {
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := s.chatEngine.ValidateUserMessage(req.Content, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if s.chatEngine.GetConversation(conversationID) == nil {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+
+	conv, err := s.chatEngine.EditMessage(conversationID, messageID, req.Content)
+	if errors.Is(err, chat_engine.ErrMessageNotFound) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, chat_engine.ErrTurnRunning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conv)
+}
+
+// handleSetSystemPrompt sets the system prompt of a conversation, an empty prompt removes it
+func (s *Server) handleSetSystemPrompt(w http.ResponseWriter, r *http.Request) {
+	conversationID := chi.URLParam(r, "id")
+
+	var req struct {
+		SystemPrompt string `json:"system_prompt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.chatEngine.SetSystemPrompt(conversationID, req.SystemPrompt); err != nil {
+		http.Error(w, "Failed to set system prompt", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"conversation_id": conversationID,
+		"system_prompt":   req.SystemPrompt,
+	})
+}
+
+// handleSetWebhook sets the URL notified when a turn of the conversation ended, an empty
+// URL removes it
+func (s *Server) handleSetWebhook(w http.ResponseWriter, r *http.Request) {
+	conversationID := chi.URLParam(r, "id")
+
+	var req struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.URL != "" {
+		if err := chat_engine.ValidateWebhookURL(req.URL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := s.chatEngine.SetWebhookURL(conversationID, req.URL); err != nil {
+		http.Error(w, "Failed to set webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"conversation_id": conversationID,
+		"webhook_url":     req.URL,
+	})
+}
+
+// handleSetReadOnly enables or disables read-only mode for a conversation's tools
+func (s *Server) handleSetReadOnly(w http.ResponseWriter, r *http.Request) {
+	conversationID := chi.URLParam(r, "id")
+
+	var req struct {
+		ReadOnly bool `json:"read_only"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.chatEngine.SetReadOnly(conversationID, req.ReadOnly); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"conversation_id": conversationID,
+		"read_only":       s.chatEngine.IsReadOnly(conversationID),
+	})
+}
+
+// handleSetAllowedTools restricts the tools of a conversation. An empty list disables tools,
+// null allows all of them again.
+func (s *Server) handleSetAllowedTools(w http.ResponseWriter, r *http.Request) {
+	conversationID := chi.URLParam(r, "id")
+
+	var req struct {
+		AllowedTools []string `json:"allowed_tools"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.chatEngine.SetAllowedTools(conversationID, req.AllowedTools); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"conversation_id": conversationID,
+		"allowed_tools":   s.chatEngine.AllowedTools(conversationID),
+	})
+}
+
+// handleImport stores a transcript as a new conversation and responds with it. A transcript
+// with problems is rejected with the report of handleValidateImport.
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	var transcript chat_engine.Conversation
+	if err := json.NewDecoder(r.Body).Decode(&transcript); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	conv, err := s.chatEngine.ImportConversation(&transcript)
+	var invalid *chat_engine.InvalidTranscriptError
+	if errors.As(err, &invalid) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(invalid.Report)
+		return
+	} else if err != nil {
+		requestLog(r).Error("Failed to import conversation", "error", err)
+		http.Error(w, "Failed to import conversation", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(conv)
+}
+
+// handleValidateImport checks a transcript for problems without persisting anything
+func (s *Server) handleValidateImport(w http.ResponseWriter, r *http.Request) {
+	var transcript chat_engine.Conversation
+	if err := json.NewDecoder(r.Body).Decode(&transcript); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(chat_engine.ValidateTranscript(transcript.Messages))
+}
+
+const (
+	defaultConversationPageSize = 50
+	maxConversationPageSize     = 200
+)
+
+// pageParams reads the limit and offset query parameters. limit defaults to defaultLimit and
+// is capped at maxLimit, offset defaults to 0.
+func pageParams(r *http.Request, defaultLimit, maxLimit int) (limit, offset int, err error) {
+	query := r.URL.Query()
+
+	limit = defaultLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return 0, 0, errors.New("invalid limit")
+		}
+		limit = min(n, maxLimit)
+	}
+
+	if value := query.Get("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, 0, errors.New("invalid offset")
+		}
+		offset = n
+	}
+	return limit, offset, nil
+}
+
+// setPageLinks sets a Link header pointing at the next and previous pages of a paged list,
+// keeping the request's other query parameters
+func setPageLinks(w http.ResponseWriter, r *http.Request, limit, offset, total int) {
+	link := func(offset int, rel string) string {
+		query := r.URL.Query()
+		query.Set("limit", strconv.Itoa(limit))
+		query.Set("offset", strconv.Itoa(offset))
+		return fmt.Sprintf("<%s?%s>; rel=%q", r.URL.Path, query.Encode(), rel)
+	}
+
+	var links []string
+	if offset+limit < total {
+		links = append(links, link(offset+limit, "next"))
+	}
+	if offset > 0 {
+		links = append(links, link(max(min(offset, total)-limit, 0), "prev"))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
+
+// handleListConversations returns a page of conversation summaries, most recently updated
+// first, only those tagged with ?tag if given. limit defaults to 50 (at most 200) and offset to 0.
+// The Link header points at the next and previous pages.
+func (s *Server) handleListConversations(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := pageParams(r, defaultConversationPageSize, maxConversationPageSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := s.chatEngine.ListConversationsPaged(limit, offset, strings.ToLower(strings.TrimSpace(r.URL.Query().Get("tag"))))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	setPageLinks(w, r, page.Limit, page.Offset, page.Total)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// handleAudit returns a page of the command audit log, most recent first, optionally only
+// for ?conversation_id. limit defaults to 50 (at most 200) and offset to 0. The Link header
+// points at the next and previous pages.
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := pageParams(r, defaultConversationPageSize, maxConversationPageSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := s.chatEngine.CommandAudit(r.URL.Query().Get("conversation_id"), limit, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	setPageLinks(w, r, page.Limit, page.Offset, page.Total)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// handleSearch finds messages containing every word of q across all conversations.
+// limit defaults to 20 (at most 100).
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultSearchLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxSearchLimit)
+	}
+
+	results, err := s.chatEngine.SearchMessages(q, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// handleSemanticSearch finds the messages closest in meaning to q across all conversations,
+// see handleSearch for limit. It responds 501 Not Implemented unless an embedding model is
+// configured.
+func (s *Server) handleSemanticSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultSearchLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxSearchLimit)
+	}
+
+	results, err := s.chatEngine.SemanticSearch(r.Context(), q, limit)
+	if errors.Is(err, chat_engine.ErrSemanticSearchDisabled) {
+		http.Error(w, "Semantic search is not enabled, set AGENT_EMBEDDING_MODEL", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// handleListMemories lists the memories of namespace, the engine's one by default, whose key
+// or value contains q. limit defaults to 20 (at most 100).
+func (s *Server) handleListMemories(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := defaultSearchLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxSearchLimit)
+	}
+
+	memories, err := s.chatEngine.Recall(query.Get("namespace"), query.Get("q"), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(memories)
+}
+
+// handleRemember stores a memory, replacing the value of an existing one with the same key
+func (s *Server) handleRemember(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Namespace string `json:"namespace"`
+		Key       string `json:"key"`
+		Value     string `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	memory, err := s.chatEngine.Remember(req.Namespace, req.Key, req.Value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(memory)
+}
+
+// handleForget deletes the memory key of namespace, the engine's one by default
+func (s *Server) handleForget(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	err := s.chatEngine.Forget(r.URL.Query().Get("namespace"), key)
+	if errors.Is(err, chat_engine.ErrMemoryNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Memory %s deleted", key),
+	})
+}
+
+// handleListSchedules lists scheduled commands, only those of conversation_id if given
+func (s *Server) handleListSchedules(w http.ResponseWriter, r *http.Request) {
+	schedules, err := s.chatEngine.ListSchedules(r.URL.Query().Get("conversation_id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedules)
+}
+
+// handleDeleteSchedule stops and deletes a scheduled command
+func (s *Server) handleDeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	err := s.chatEngine.DeleteSchedule(id)
+	if errors.Is(err, chat_engine.ErrScheduleNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Schedule %s deleted", id),
+	})
+}
+
+// handleGetUsage returns token usage and estimated cost aggregated by day or model.
+// from and to are dates (2006-01-02, to is inclusive) or RFC 3339 timestamps and default
+// to the last 30 days.
+func (s *Server) handleGetUsage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	now := time.Now().UTC()
+	to := now
+	from := now.AddDate(0, 0, -30)
+	if value := query.Get("from"); value != "" {
+		t, _, err := parseUsageTime(value)
+		if err != nil {
+			http.Error(w, "Invalid from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+	if value := query.Get("to"); value != "" {
+		t, dateOnly, err := parseUsageTime(value)
+		if err != nil {
+			http.Error(w, "Invalid to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		to = t
+		if dateOnly {
+			to = to.AddDate(0, 0, 1)
+		}
+	}
+
+	groupBy := chat_engine.UsageGroupByDay
+	if value := query.Get("groupBy"); value != "" {
+		groupBy = chat_engine.UsageGroupBy(value)
+	}
+
+	usage, err := s.chatEngine.Usage(from, to, groupBy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+// parseUsageTime parses a date or an RFC 3339 timestamp, dateOnly tells which it was
+func parseUsageTime(value string) (t time.Time, dateOnly bool, err error) {
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, true, nil
+	}
+	t, err = time.Parse(time.RFC3339, value)
+	return t, false, err
+}
+
+// handleSendMessageStream processes chat messages with Server-Sent Events streaming.
+//
+// Events are sent in this order: {"type":"connected"}, then every message of the turn in the
+// order described by chat_engine.MessageUpdateCallback, each assistant message preceded by
+// {"type":"delta","content":"..."} events carrying its content as it was generated (the
+// complete message follows them) and each tool message that ran a tool preceded by a
+// {"type":"tool_start","tool_call_id":"...","name":"...","arguments":"..."} event sent when
+// the tool started, then either {"type":"done"} or {"type":"error"}. A turn that stopped at
+// the tool iteration limit ends with {"type":"done","partial":true,"reason":"iteration_limit"}.
+// Keepalive comments may be interleaved at any point.
+//
+// Message events of stored conversations carry the message ID as their event ID. A client
+// that lost the connection repeats the request with the Last-Event-ID header instead of
+// running the turn again: the messages stored after that one are replayed, followed by those
+// of the turn while it is still running, then {"type":"done"}. Deltas and tool_start events
+// are not replayed.
+func (s *Server) handleSendMessageStream(w http.ResponseWriter, r *http.Request) {
+	var req SendMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := s.validateSendMessageRequest(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Use provided conversation ID or default
+	conversationID := req.ConversationID
+	if conversationID == "" {
+		conversationID = "default"
+	}
+
+	// A reconnecting client resumes the stream after the last message it received
+	lastEventID := r.Header.Get("Last-Event-ID")
+	var replay []*chat_engine.Message
+	if lastEventID != "" {
+		var err error
+		replay, err = s.chatEngine.MessagesAfter(conversationID, lastEventID)
+		if errors.Is(err, chat_engine.ErrMessageNotFound) {
+			http.Error(w, "Last-Event-ID does not match a message of the conversation", http.StatusNotFound)
+			return
+		} else if err != nil {
+			requestLog(r).Error("Failed to load messages to replay", "conversation_id", conversationID, "error", err)
+			http.Error(w, "Failed to resume stream", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Set up SSE headers
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	// Create a flusher to send data immediately
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// The turn runs in another goroutine than the keepalive, serialize writes. Once the handler
+	// returned the writer must not be used anymore, while the turn may still be running.
+	var writeMutex sync.Mutex
+	closed := false
+	sendEvent := func(id, data string) {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		if closed {
+			return
+		}
+		if id != "" {
+			fmt.Fprintf(w, "id: %s\n", id)
+		}
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+	}
+	send := func(data string) {
+		sendEvent("", data)
+	}
+	defer func() {
+		writeMutex.Lock()
+		closed = true
+		writeMutex.Unlock()
+	}()
+
+	// Send initial connection message
+	send(`{"type":"connected"}`)
+
+	// Callback to send messages as they're created
+	callback := func(msg *chat_engine.Message) {
+		msgJSON, err := json.Marshal(msg)
+		if err != nil {
+			requestLog(r).Error("Failed to marshal message for stream", "error", err)
+			return
+		}
+		// Ephemeral messages are not stored, so the stream can't be resumed after them
+		id := msg.ID
+		if req.Ephemeral {
+			id = ""
+		}
+		sendEvent(id, string(msgJSON))
+	}
+
+	// Forward assistant content while it is generated
+	onDelta := func(content string) {
+		deltaJSON, err := json.Marshal(struct {
+			Type    string `json:"type"`
+			Content string `json:"content"`
+		}{Type: "delta", Content: content})
+		if err != nil {
+			requestLog(r).Error("Failed to marshal delta for stream", "error", err)
+			return
+		}
+		send(string(deltaJSON))
+	}
+
+	// Announce tool calls before they run, their tool messages follow once they're done
+	onToolStart := func(toolCall chat_engine.ToolCall) {
+		startJSON, err := json.Marshal(struct {
+			Type       string `json:"type"`
+			ToolCallID string `json:"tool_call_id"`
+			Name       string `json:"name"`
+			Arguments  string `json:"arguments"`
+		}{Type: "tool_start", ToolCallID: toolCall.ID, Name: toolCall.Name, Arguments: toolCall.Arguments})
+		if err != nil {
+			requestLog(r).Error("Failed to marshal tool start for stream", "error", err)
+			return
+		}
+		send(string(startJSON))
+	}
+
+	// Process message with streaming updates in a goroutine
+	done := make(chan bool)
+	go func() {
+		defer func() {
+			done <- true
+		}()
+
+		if lastEventID != "" {
+			if err := s.resumeStream(r.Context(), conversationID, lastEventID, replay, callback); err != nil {
+				if r.Context().Err() == nil {
+					requestLog(r).Error("Failed to resume stream", "conversation_id", conversationID, "error", err)
+					send(`{"type":"error","error":"failed to resume stream"}`)
+				}
+				return
+			}
+			send(`{"type":"done"}`)
+			return
+		}
+
+		_, err := s.chatEngine.SendUserMessageWithOptions(conversationID, req.Message, chat_engine.SendOptions{
+			Callback:       callback,
+			OnDelta:        onDelta,
+			OnToolStart:    onToolStart,
+			Ephemeral:      req.Ephemeral,
+			SystemPrompt:   req.SystemPrompt,
+			RequestID:      middleware.GetReqID(r.Context()),
+			ResponseFormat: req.ResponseFormat,
+			Sampling:       req.sampling(),
+			DisableTools:   req.DisableTools,
+			AllowedTools:   req.AllowedTools,
+			Images:         req.Images,
+		})
+		var limitErr *chat_engine.IterationLimitError
+		var approvalErr *chat_engine.ApprovalRequiredError
+		if errors.As(err, &limitErr) {
+			send(`{"type":"done","partial":true,"reason":"iteration_limit"}`)
+		} else if errors.As(err, &approvalErr) {
+			doneJSON, _ := json.Marshal(map[string]interface{}{
+				"type":               "done",
+				"awaiting_approval":  true,
+				"pending_tool_calls": approvalErr.ToolCalls,
+			})
+			send(string(doneJSON))
+		} else if errors.Is(err, chat_engine.ErrTurnCanceled) {
+			send(`{"type":"done","canceled":true}`)
+		} else if err != nil {
+			errorJSON, _ := json.Marshal(map[string]interface{}{
+				"type":  "error",
+				"error": err.Error(),
+			})
+			send(string(errorJSON))
+		} else {
+			// Send completion message
+			send(`{"type":"done"}`)
+		}
+	}()
+
+	// Keep connection alive and wait for completion
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-done:
+			return
+		case <-ticker.C:
+			writeMutex.Lock()
+			fmt.Fprintf(w, ": keepalive\n\n")
+			flusher.Flush()
+			writeMutex.Unlock()
+		}
+	}
+}
+
+// resumePollInterval is how often a resumed stream checks for new messages of a running turn
+const resumePollInterval = 500 * time.Millisecond
+
+// resumeStream passes the messages to replay to callback, then the messages stored after them
+// until no turn of the conversation is running anymore
+func (s *Server) resumeStream(ctx context.Context, conversationID, lastEventID string, replay []*chat_engine.Message, callback chat_engine.MessageUpdateCallback) error {
+	for {
+		for _, msg := range replay {
+			callback(msg)
+			lastEventID = msg.ID
+		}
+
+		// Checked before loading, so the messages of a turn that just ended are still sent
+		running := s.chatEngine.TurnRunning(conversationID)
+		var err error
+		replay, err = s.chatEngine.MessagesAfter(conversationID, lastEventID)
+		if err != nil {
+			return err
+		}
+		if !running && len(replay) == 0 {
+			return nil
+		}
+		if len(replay) == 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(resumePollInterval):
+			}
+		}
+	}
+}
+
+// requireAPIToken only lets requests carrying the API token through when one is configured.
+// The admin token is accepted as well, so admin endpoints need only one token.
+func (s *Server) requireAPIToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.apiToken != "" && !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="agent"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorized reports whether the request carries the API or the admin token
+func (s *Server) authorized(r *http.Request) bool {
+	return hasBearerToken(r, s.apiToken) || (s.adminToken != "" && hasBearerToken(r, s.adminToken))
+}
+
+// requireAdmin only lets requests carrying the admin token through. Clients that may use the
+// API but aren't admins are forbidden, an unknown token is unauthorized.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			http.Error(w, "Admin endpoints are disabled, set AGENT_ADMIN_TOKEN to enable them", http.StatusForbidden)
+			return
+		}
+		if !hasBearerToken(r, s.adminToken) {
+			if r.Header.Get("Authorization") != "" && !s.authorized(r) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="agent"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			http.Error(w, "Forbidden, the admin token is required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hasBearerToken reports whether the request's Authorization header carries token
+func hasBearerToken(r *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// handleVacuum compacts the database. With ?checkpoint=true the write-ahead log is
+// checkpointed and truncated as well, with ?optimize=true PRAGMA optimize runs afterwards.
+func (s *Server) handleVacuum(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts := chat_engine.VacuumOptions{
+		Checkpoint: query.Get("checkpoint") == "true",
+		Optimize:   query.Get("optimize") == "true",
+	}
+
+	result, err := s.chatEngine.CompactDatabase(r.Context(), opts)
+	if err != nil {
+		requestLog(r).Error("Failed to vacuum database", "error", err)
+		http.Error(w, "Failed to vacuum database: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	requestLog(r).Info("Vacuumed database", "size_before", result.SizeBefore, "size_after", result.SizeAfter, "duration_ms", result.DurationMS)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleHealth reports that the process is up
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// handleReady reports whether the server can handle requests: the database has to answer,
+// and with ?check=openai the model endpoint as well. It returns 503 when a check fails.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+	check := func(name string, timeout time.Duration, fn func(ctx context.Context) error) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		if err := fn(ctx); err != nil {
+			requestLog(r).Warn("Readiness check failed", "check", name, "error", err)
+			checks[name] = err.Error()
+			ready = false
+			return
+		}
+		checks[name] = "ok"
+	}
+
+	check("database", readyCheckTimeout, s.chatEngine.CheckDatabase)
+	if r.URL.Query().Get("check") == "openai" {
+		check("openai", readyCheckTimeout, func(ctx context.Context) error {
+			_, err := s.client.Models.Get(ctx, s.chatEngine.Model())
+			return err
+		})
+	}
+
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+// handleListProcesses returns all running background processes
+func (s *Server) handleListProcesses(w http.ResponseWriter, r *http.Request) {
+	processes := s.chatEngine.GetProcesses()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(processes)
+}
+
+// handleGetProcessLogs returns the captured output of a background process
+func (s *Server) handleGetProcessLogs(w http.ResponseWriter, r *http.Request) {
+	pidStr := chi.URLParam(r, "pid")
+	var pid int
+	if _, err := fmt.Sscanf(pidStr, "%d", &pid); err != nil {
+		http.Error(w, "Invalid PID", http.StatusBadRequest)
+		return
+	}
+
+	output, err := s.chatEngine.GetProcessOutput(pid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(output)
+}
+
+// handleStreamProcessOutput tails the output of a background process with Server-Sent Events.
+//
+// The output captured so far is sent first, then the output as it is written, each chunk as
+// {"type":"output","output":"...","truncated":true}, with truncated only set when output was
+// dropped before the chunk. Once the process exits the stream ends with
+// {"type":"exit","exit_code":N}; an adopted process has no known exit code and reports -1.
+// Keepalive comments may be interleaved at any point.
+func (s *Server) handleStreamProcessOutput(w http.ResponseWriter, r *http.Request) {
+	pidStr := chi.URLParam(r, "pid")
+	var pid int
+	if _, err := fmt.Sscanf(pidStr, "%d", &pid); err != nil {
+		http.Error(w, "Invalid PID", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.chatEngine.GetProcessOutput(pid); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	// Output is sent from another goroutine than the keepalive, serialize writes
+	var writeMutex sync.Mutex
+	send := func(event interface{}) {
+		data, err := json.Marshal(event)
+		if err != nil {
+			requestLog(r).Error("Failed to marshal process output event", "pid", pid, "error", err)
+			return
+		}
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		exitCode, err := s.chatEngine.FollowProcessOutput(r.Context(), pid, func(output string, truncated bool) {
+			send(struct {
+				Type      string `json:"type"`
+				Output    string `json:"output"`
+				Truncated bool   `json:"truncated,omitempty"`
+			}{Type: "output", Output: output, Truncated: truncated})
+		})
+		if r.Context().Err() != nil {
+			return
+		}
+		if err != nil {
+			send(map[string]interface{}{"type": "error", "error": err.Error()})
+			return
+		}
+		send(map[string]interface{}{"type": "exit", "exit_code": exitCode})
+	}()
+
+	// FollowProcessOutput returns once the client disconnects, so the writer is not used
+	// after the handler returned
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			writeMutex.Lock()
+			fmt.Fprintf(w, ": keepalive\n\n")
+			flusher.Flush()
+			writeMutex.Unlock()
+		}
+	}
+}
+
+// handleKillConversationProcesses kills all background processes started by a conversation
+func (s *Server) handleKillConversationProcesses(w http.ResponseWriter, r *http.Request) {
+	conversationID := chi.URLParam(r, "id")
+
+	killed := s.chatEngine.KillConversationProcesses(conversationID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"conversation_id": conversationID,
+		"killed":          killed,
+	})
+}
+
+// handleCancelTurn stops the running turn of a conversation. With {"kill_processes": true}
+// the conversation's background processes are killed as well.
+func (s *Server) handleCancelTurn(w http.ResponseWriter, r *http.Request) {
+	conversationID := chi.URLParam(r, "id")
+
+	var req struct {
+		KillProcesses bool `json:"kill_processes"`
+	}
+	// The body is optional
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := s.chatEngine.CancelTurn(conversationID, req.KillProcesses); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"conversation_id": conversationID,
+		"canceled":        true,
+	})
 }
 
 // handleKillProcess kills a background process by PID
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/evgeniy-scherbina/agent/chat_engine"
+)
+
+// scriptedProvider runs echo once per turn and then answers with a text reply, streaming its
+// content word by word to requests that ask for deltas
+type scriptedProvider struct{}
+
+func (scriptedProvider) Complete(ctx context.Context, req chat_engine.CompletionRequest) (*chat_engine.Message, error) {
+	if last := req.Messages[len(req.Messages)-1]; last.Role != "tool" {
+		return &chat_engine.Message{
+			Role:      "assistant",
+			ToolCalls: []chat_engine.ToolCall{{ID: "call_echo", Type: "function", Name: "bash_command", Arguments: `{"command": "echo hi"}`}},
+		}, nil
+	}
+	msg := &chat_engine.Message{Role: "assistant", Content: "The command printed hi."}
+	if req.OnDelta != nil {
+		for _, word := range strings.SplitAfter(msg.Content, " ") {
+			req.OnDelta(word)
+		}
+	}
+	return msg, nil
+}
+
+// newTestServer returns a server answering with scriptedProvider, with its database and
+// workspace in a temporary directory. configure may set up the Server before it is started.
+func newTestServer(t *testing.T, configure func(*Server)) *httptest.Server {
+	t.Helper()
+	return newTestServerWithProvider(t, scriptedProvider{}, configure)
+}
+
+// newTestServerWithProvider is newTestServer answering with provider, opts are applied to the
+// engine after the test defaults
+func newTestServerWithProvider(t *testing.T, provider chat_engine.CompletionProvider, configure func(*Server), opts ...chat_engine.Option) *httptest.Server {
+	t.Helper()
+	dir := t.TempDir()
+	engine, err := chat_engine.NewChatEngine(provider, append([]chat_engine.Option{
+		chat_engine.WithDatabaseURL(filepath.Join(dir, "agent.db")),
+		chat_engine.WithWorkspaceRoot(dir),
+	}, opts...)...)
+	if err != nil {
+		t.Fatalf("NewChatEngine: %v", err)
+	}
+
+	server := &Server{chatEngine: engine, idempotency: newIdempotencyCache()}
+	if configure != nil {
+		configure(server)
+	}
+	httpServer := httptest.NewServer(server.routes())
+	t.Cleanup(func() {
+		httpServer.Close()
+		engine.Close()
+	})
+	return httpServer
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter is an in-process token bucket per client, a rate.Limiter each. Each client may
+// make burst requests at once, after which tokens refill at perMinute per minute.
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+	// idleTimeout is how long a client's bucket takes to refill completely, after that it
+	// behaves like a new one and is dropped
+	idleTimeout time.Duration
+
+	mutex     sync.Mutex
+	clients   map[string]*rateLimitClient
+	lastSweep time.Time
+}
+
+type rateLimitClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = perMinute
+	}
+	return &rateLimiter{
+		limit:       rate.Limit(float64(perMinute) / time.Minute.Seconds()),
+		burst:       burst,
+		idleTimeout: time.Duration(float64(burst) / float64(perMinute) * float64(time.Minute)),
+		clients:     make(map[string]*rateLimitClient),
+		lastSweep:   time.Now(),
+	}
+}
+
+// allow takes a token from key's bucket. When the bucket is empty it returns false and how
+// long until the next token is available.
+func (rl *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	rl.sweep(now)
+
+	client, ok := rl.clients[key]
+	if !ok {
+		client = &rateLimitClient{limiter: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.clients[key] = client
+	}
+	client.lastSeen = now
+
+	reservation := client.limiter.ReserveN(now, 1)
+	if wait := reservation.DelayFrom(now); wait > 0 {
+		// Rejected requests don't use up tokens
+		reservation.CancelAt(now)
+		return false, wait
+	}
+	return true, 0
+}
+
+// sweep drops clients that were idle long enough for their bucket to refill, as they behave
+// like new ones. It runs at most once a minute so clients that came and went don't accumulate.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < time.Minute {
+		return
+	}
+	rl.lastSweep = now
+	for key, client := range rl.clients {
+		if now.Sub(client.lastSeen) >= rl.idleTimeout {
+			delete(rl.clients, key)
+		}
+	}
+}
+
+// rateLimit rejects requests from clients that exceeded the rate limit with 429 Too Many
+// Requests. Clients are identified by their API token when they present a valid one and by
+// IP address otherwise, so invalid tokens can't be rotated to escape the limit.
+func (s *Server) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.rateLimiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := "ip:" + clientIP(r)
+		if s.apiToken != "" && s.authorized(r) {
+			key = "token:" + r.Header.Get("Authorization")
+		}
+
+		if ok, wait := s.rateLimiter.allow(key, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the IP address the request came from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
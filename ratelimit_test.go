@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// rateLimitedHandler returns the rate limiting middleware of server in front of a handler
+// that always succeeds
+func rateLimitedHandler(server *Server) http.Handler {
+	return server.rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func requestFrom(handler http.Handler, remoteAddr, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/api/conversations", nil)
+	req.RemoteAddr = remoteAddr
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRateLimitRejectsWithRetryAfter(t *testing.T) {
+	handler := rateLimitedHandler(&Server{rateLimiter: newRateLimiter(6, 3)})
+
+	for i := 0; i < 3; i++ {
+		if rec := requestFrom(handler, "192.0.2.1:1234", ""); rec.Code != http.StatusOK {
+			t.Fatalf("request %d within the burst got %d", i, rec.Code)
+		}
+	}
+
+	rec := requestFrom(handler, "192.0.2.1:5678", "")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the limit got %d, want 429", rec.Code)
+	}
+	retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if err != nil {
+		t.Fatalf("Retry-After = %q: %v", rec.Header().Get("Retry-After"), err)
+	}
+	// A token refills every 10 seconds at 6 per minute
+	if retryAfter < 1 || retryAfter > 10 {
+		t.Errorf("Retry-After = %d, want between 1 and 10 seconds", retryAfter)
+	}
+
+	if rec := requestFrom(handler, "192.0.2.2:1234", ""); rec.Code != http.StatusOK {
+		t.Errorf("another client got %d, it must have its own limit", rec.Code)
+	}
+}
+
+func TestRateLimitKeysByValidToken(t *testing.T) {
+	server := &Server{apiToken: "secret", rateLimiter: newRateLimiter(60, 1)}
+	handler := rateLimitedHandler(server)
+
+	if rec := requestFrom(handler, "192.0.2.1:1234", "secret"); rec.Code != http.StatusOK {
+		t.Fatalf("first request got %d", rec.Code)
+	}
+	// The same token is limited from any address
+	if rec := requestFrom(handler, "192.0.2.2:1234", "secret"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("same token from another address got %d, want 429", rec.Code)
+	}
+
+	// Invalid tokens count against the address, so rotating them doesn't help
+	if rec := requestFrom(handler, "192.0.2.3:1234", "wrong1"); rec.Code != http.StatusOK {
+		t.Fatalf("first request with an invalid token got %d", rec.Code)
+	}
+	if rec := requestFrom(handler, "192.0.2.3:1234", "wrong2"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("rotated invalid token got %d, want 429", rec.Code)
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	rl := newRateLimiter(60, 2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := rl.allow("client", now); !ok {
+			t.Fatalf("request %d within the burst was rejected", i)
+		}
+	}
+	ok, wait := rl.allow("client", now)
+	if ok {
+		t.Fatal("request over the burst was allowed")
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Errorf("wait = %s, want up to the second a token takes at 60 per minute", wait)
+	}
+
+	if ok, _ := rl.allow("client", now.Add(wait)); !ok {
+		t.Error("request after the returned wait was rejected")
+	}
+	if ok, _ := rl.allow("client", now.Add(wait)); ok {
+		t.Error("a single refilled token allowed two requests")
+	}
+}
+
+func TestRateLimiterEvictsIdleClients(t *testing.T) {
+	rl := newRateLimiter(60, 2)
+	now := time.Now()
+
+	rl.allow("idle", now)
+	rl.allow("busy", now)
+	// Two tokens refill in two seconds, the sweep runs a minute after the limiter was created
+	later := now.Add(time.Minute)
+	rl.allow("busy", later.Add(-time.Second))
+	rl.allow("new", later)
+
+	if _, ok := rl.clients["idle"]; ok {
+		t.Error("idle client was kept")
+	}
+	for _, key := range []string{"busy", "new"} {
+		if _, ok := rl.clients[key]; !ok {
+			t.Errorf("client %s was dropped", key)
+		}
+	}
+}
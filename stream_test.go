@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evgeniy-scherbina/agent/chat_engine"
+)
+
+// resumeTurnStream repeats a streamed turn of the conversation with the Last-Event-ID header
+// and returns the IDs and summaries of the events until done, or the response if it failed
+func resumeTurnStream(t *testing.T, baseURL, conversationID, lastEventID string) (ids, events []string, resp *http.Response) {
+	t.Helper()
+	body, _ := json.Marshal(SendMessageRequest{Message: "hi", ConversationID: conversationID})
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/api/chat/stream", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Last-Event-ID", lastEventID)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /api/chat/stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, resp
+	}
+
+	id := ""
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if value, ok := strings.CutPrefix(line, "id: "); ok {
+			id = value
+			continue
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var event wsEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("invalid event %q: %v", data, err)
+		}
+		if event.Type == "" {
+			var msg chat_engine.Message
+			if err := json.Unmarshal([]byte(data), &msg); err != nil {
+				t.Fatalf("invalid message event %q: %v", data, err)
+			}
+			event = wsEvent{Type: "message", Message: &msg}
+		}
+		ids = append(ids, id)
+		events = append(events, eventSummary(event))
+		id = ""
+		if event.Type == "done" || event.Type == "error" {
+			break
+		}
+	}
+	return ids, events, resp
+}
+
+func TestStreamResumesAfterLastEventID(t *testing.T) {
+	server := newTestServer(t, nil)
+	turn := sendMessage(t, server.URL, "conv", "run echo")
+	if len(turn.Messages) != 4 {
+		t.Fatalf("turn has %d messages, want the prompt, the tool call, its output and the reply", len(turn.Messages))
+	}
+
+	// Only the messages after the tool call are replayed, the turn is not run again
+	ids, events, _ := resumeTurnStream(t, server.URL, "conv", turn.Messages[1].ID)
+	want := []string{"connected", "message tool " + turn.Messages[2].Content, "message assistant The command printed hi.", "done"}
+	if !slices.Equal(events, want) {
+		t.Errorf("resumed stream sent\n%q\nwant\n%q", events, want)
+	}
+	if wantIDs := []string{"", turn.Messages[2].ID, turn.Messages[3].ID, ""}; !slices.Equal(ids, wantIDs) {
+		t.Errorf("resumed stream has event IDs %q, want %q", ids, wantIDs)
+	}
+
+	// Resuming after the last message only ends the stream
+	if _, events, _ := resumeTurnStream(t, server.URL, "conv", turn.Messages[3].ID); !slices.Equal(events, []string{"connected", "done"}) {
+		t.Errorf("stream resumed after its end sent %q", events)
+	}
+	resp, body := doJSON(t, http.MethodGet, server.URL+"/api/conversations/conv", nil)
+	var conv chat_engine.Conversation
+	if err := json.Unmarshal(body, &conv); resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("GET conversation: %d %s", resp.StatusCode, body)
+	}
+	if len(conv.Messages) != 4 {
+		t.Errorf("conversation has %d messages after resuming, want the turn's 4", len(conv.Messages))
+	}
+}
+
+func TestStreamResumeWithUnknownLastEventID(t *testing.T) {
+	server := newTestServer(t, nil)
+	sendMessage(t, server.URL, "conv", "run echo")
+
+	if _, _, resp := resumeTurnStream(t, server.URL, "conv", "msg_missing"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("resuming after an unknown message: status %d, want 404", resp.StatusCode)
+	}
+}
+
+// blockingReplyProvider calls bash_command, then waits for release before replying
+type blockingReplyProvider struct {
+	release chan struct{}
+}
+
+func (p blockingReplyProvider) Complete(ctx context.Context, req chat_engine.CompletionRequest) (*chat_engine.Message, error) {
+	if last := req.Messages[len(req.Messages)-1]; last.Role != "tool" {
+		return &chat_engine.Message{
+			Role:      "assistant",
+			ToolCalls: []chat_engine.ToolCall{{ID: "call_echo", Type: "function", Name: "bash_command", Arguments: `{"command": "echo hi"}`}},
+		}, nil
+	}
+	select {
+	case <-p.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return &chat_engine.Message{Role: "assistant", Content: "Released."}, nil
+}
+
+func TestStreamResumesRunningTurn(t *testing.T) {
+	provider := blockingReplyProvider{release: make(chan struct{})}
+	var engine *chat_engine.ChatEngine
+	server := newTestServerWithProvider(t, provider, func(s *Server) { engine = s.chatEngine })
+
+	turnDone := make(chan struct{})
+	go func() {
+		defer close(turnDone)
+		doJSON(t, http.MethodPost, server.URL+"/api/chat", SendMessageRequest{Message: "run echo", ConversationID: "conv"})
+	}()
+	defer func() { <-turnDone }()
+
+	// Wait until the tool call is stored. Its output is saved with the reply, which waits for
+	// the release.
+	var messages []*chat_engine.Message
+	deadline := time.Now().Add(5 * time.Second)
+	for len(messages) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		page, err := engine.ConversationMessagesPaged("conv", 10, 0)
+		if err == nil {
+			messages = page.Messages
+		}
+	}
+	if len(messages) < 2 {
+		close(provider.release)
+		t.Fatalf("turn stored %d messages, want the tool call", len(messages))
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(provider.release)
+	}()
+	_, events, _ := resumeTurnStream(t, server.URL, "conv", messages[1].ID)
+	if len(events) != 4 || events[0] != "connected" || !strings.HasPrefix(events[1], "message tool ") || !strings.Contains(events[1], "hi") ||
+		events[2] != "message assistant Released." || events[3] != "done" {
+		t.Errorf("resumed stream sent %q, want the tool's output, the reply and done", events)
+	}
+}
@@ -68,11 +68,17 @@ function App() {
         actualConversationId = `conv-${Date.now()}-${Math.random().toString(36).substring(2, 11)}`;
       }
 
+      // Assistant content is shown in a placeholder while it is generated
+      const streamingMessageID = `streaming-${Date.now()}`;
+
       // Use streaming for real-time updates
       await sendMessageStream(messageText, actualConversationId, (message) => {
         setMessages(prev => {
-          // Remove temporary user message once we get the real one
-          const withoutTemp = prev.filter(m => m.ID !== tempUserMessage.ID);
+          // Remove temporary user message once we get the real one, and the streaming
+          // placeholder once the complete assistant message arrives
+          const withoutTemp = prev.filter(m =>
+            m.ID !== tempUserMessage.ID && !(message.role === 'assistant' && m.ID === streamingMessageID)
+          );
           
           // Check if this message already exists
           const existingIndex = withoutTemp.findIndex(m => m.ID === message.ID);
@@ -86,6 +92,19 @@ function App() {
             return [...withoutTemp, message];
           }
         });
+      }, (content) => {
+        setMessages(prev => {
+          const existingIndex = prev.findIndex(m => m.ID === streamingMessageID);
+          if (existingIndex >= 0) {
+            const updated = [...prev];
+            updated[existingIndex] = {
+              ...updated[existingIndex],
+              content: updated[existingIndex].content + content,
+            };
+            return updated;
+          }
+          return [...prev, { ID: streamingMessageID, role: 'assistant', content }];
+        });
       });
 
       // Reload conversations to get updated list
@@ -95,10 +114,10 @@ function App() {
       if (!conversationId || isNewChat) {
         const convs = await listConversations();
         if (convs.length > 0) {
-          // Find the conversation that matches our ID, or get the last one
+          // Find the conversation that matches our ID, or get the most recent one
           const targetConv = actualConversationId 
-            ? convs.find(c => c.id === actualConversationId) || convs[convs.length - 1]
-            : convs[convs.length - 1];
+            ? convs.find(c => c.id === actualConversationId) || convs[0]
+            : convs[0];
           setSelectedConversationId(targetConv.id);
           setIsNewChat(false);
         }
@@ -81,6 +81,11 @@ const Message = ({ message, toolMessages = [] }) => {
       <div className="message-content">
         <div className="message-role">
           {isUser ? 'You' : 'Assistant'}
+          {message.created_at && (
+            <div className="message-time" title={new Date(message.created_at).toLocaleString()}>
+              {new Date(message.created_at).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' })}
+            </div>
+          )}
         </div>
         <div className="message-text">
           {displayContent}
@@ -3,11 +3,8 @@ import './Sidebar.css';
 const Sidebar = ({ conversations, selectedConversationId, onSelectConversation, onNewConversation, onDeleteConversation }) => {
 
   const getConversationTitle = (conv) => {
-    if (conv.messages && conv.messages.length > 0) {
-      const firstUserMessage = conv.messages.find(msg => msg.role === 'user');
-      if (firstUserMessage) {
-        return firstUserMessage.content.substring(0, 30) + (firstUserMessage.content.length > 30 ? '...' : '');
-      }
+    if (conv.title) {
+      return conv.title;
     }
     return 'New Chat';
   };
@@ -1,6 +1,16 @@
 // Use Coder dev URL or env var, fallback to relative path
 const API_BASE_URL = import.meta.env.VITE_API_URL || 'https://8080--dev--agent--yevhenii--apps.dev.coder.com';
 
+/**
+ * Headers authenticating requests when the server requires an API token.
+ * The token comes from VITE_API_TOKEN or the agentApiToken entry in localStorage.
+ * @returns {Object}
+ */
+const authHeaders = () => {
+  const token = import.meta.env.VITE_API_TOKEN || localStorage.getItem('agentApiToken');
+  return token ? { Authorization: `Bearer ${token}` } : {};
+};
+
 /**
  * Send a message to the agent
  * @param {string} message - The message to send
@@ -12,6 +22,7 @@ export const sendMessage = async (message, conversationId = null) => {
     method: 'POST',
     headers: {
       'Content-Type': 'application/json',
+      ...authHeaders(),
     },
     body: JSON.stringify({
       message,
@@ -31,13 +42,16 @@ export const sendMessage = async (message, conversationId = null) => {
  * @param {string} message - The message to send
  * @param {string} conversationId - Optional conversation ID
  * @param {Function} onMessage - Callback for each message update
+ * @param {Function} onDelta - Callback for assistant content while it is generated
+ * @param {Function} onToolStart - Callback for each tool call when it starts running
  * @returns {Promise<void>}
  */
-export const sendMessageStream = async (message, conversationId = null, onMessage) => {
+export const sendMessageStream = async (message, conversationId = null, onMessage, onDelta, onToolStart) => {
   const response = await fetch(`${API_BASE_URL}/api/chat/stream`, {
     method: 'POST',
     headers: {
       'Content-Type': 'application/json',
+      ...authHeaders(),
     },
     body: JSON.stringify({
       message,
@@ -76,6 +90,18 @@ export const sendMessageStream = async (message, conversationId = null, onMessag
             if (parsed.type === 'error') {
               throw new Error(parsed.error);
             }
+            if (parsed.type === 'delta') {
+              if (onDelta) {
+                onDelta(parsed.content);
+              }
+              continue;
+            }
+            if (parsed.type === 'tool_start') {
+              if (onToolStart) {
+                onToolStart(parsed);
+              }
+              continue;
+            }
             // It's a message object
             if (onMessage) {
               onMessage(parsed);
@@ -100,7 +126,9 @@ export const sendMessageStream = async (message, conversationId = null, onMessag
  * @returns {Promise<{id: string, messages: Array}>}
  */
 export const getConversation = async (conversationId) => {
-  const response = await fetch(`${API_BASE_URL}/api/conversations/${conversationId}`);
+  const response = await fetch(`${API_BASE_URL}/api/conversations/${conversationId}`, {
+    headers: authHeaders(),
+  });
 
   if (!response.ok) {
     throw new Error(`Failed to get conversation: ${response.statusText}`);
@@ -110,17 +138,22 @@ export const getConversation = async (conversationId) => {
 };
 
 /**
- * List all conversations
- * @returns {Promise<Array<{id: string, messages: Array}>>}
+ * List conversations, most recently updated first
+ * @param {number} limit - Maximum number of conversations to return
+ * @param {number} offset - Number of conversations to skip
+ * @returns {Promise<Array<{id: string, title: string, message_count: number, updated_at: string}>>}
  */
-export const listConversations = async () => {
-  const response = await fetch(`${API_BASE_URL}/api/conversations`);
+export const listConversations = async (limit = 50, offset = 0) => {
+  const response = await fetch(`${API_BASE_URL}/api/conversations?limit=${limit}&offset=${offset}`, {
+    headers: authHeaders(),
+  });
 
   if (!response.ok) {
     throw new Error(`Failed to list conversations: ${response.statusText}`);
   }
 
-  return response.json();
+  const page = await response.json();
+  return page.conversations;
 };
 
 /**
@@ -128,7 +161,9 @@ export const listConversations = async () => {
  * @returns {Promise<Array<{pid: number, command: string, start_time: string, conversation_id: string}>>}
  */
 export const listProcesses = async () => {
-  const response = await fetch(`${API_BASE_URL}/api/processes`);
+  const response = await fetch(`${API_BASE_URL}/api/processes`, {
+    headers: authHeaders(),
+  });
 
   if (!response.ok) {
     throw new Error(`Failed to list processes: ${response.statusText}`);
@@ -145,6 +180,7 @@ export const listProcesses = async () => {
 export const killProcess = async (pid) => {
   const response = await fetch(`${API_BASE_URL}/api/processes/${pid}/kill`, {
     method: 'POST',
+    headers: authHeaders(),
   });
 
   if (!response.ok) {
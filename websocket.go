@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/evgeniy-scherbina/agent/chat_engine"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsMaxFrameSize bounds the frames a client may send, large enough for attached images
+	wsMaxFrameSize = 16 << 20
+	// wsPingInterval is how often the connection is pinged to keep it alive
+	wsPingInterval = 30 * time.Second
+	// wsWriteTimeout bounds writing a single frame to the client
+	wsWriteTimeout = 10 * time.Second
+)
+
+// wsClientFrame is a frame sent by a WebSocket client. Its type is one of:
+//
+//   - "send" runs a turn, with the fields of a send-message request
+//   - "cancel" cancels the running turn of conversationId, with kill_processes as for the
+//     cancel endpoint
+//   - "approve" and "reject" decide the tool call tool_call_id of conversationId
+type wsClientFrame struct {
+	Type string `json:"type"`
+	SendMessageRequest
+	KillProcesses bool   `json:"kill_processes,omitempty"`
+	ToolCallID    string `json:"tool_call_id,omitempty"`
+}
+
+// wsEvent is a frame sent to a WebSocket client. Events carry the conversation they belong
+// to, as turns of several conversations may run over the same connection.
+type wsEvent struct {
+	Type           string `json:"type"`
+	ConversationID string `json:"conversation_id,omitempty"`
+	// Set on "message" events
+	Message *chat_engine.Message `json:"message,omitempty"`
+	// Set on "delta" events
+	Content string `json:"content,omitempty"`
+	// Set on "tool_start" events
+	ToolCallID string `json:"tool_call_id,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Arguments  string `json:"arguments,omitempty"`
+	// Set on "done" events of turns that ended early
+	Partial          bool                   `json:"partial,omitempty"`
+	Reason           string                 `json:"reason,omitempty"`
+	AwaitingApproval bool                   `json:"awaiting_approval,omitempty"`
+	PendingToolCalls []chat_engine.ToolCall `json:"pending_tool_calls,omitempty"`
+	Canceled         bool                   `json:"canceled,omitempty"`
+	// Set on "error" events
+	Error string `json:"error,omitempty"`
+}
+
+// wsConn serializes writes to a WebSocket connection, turns write to it concurrently
+type wsConn struct {
+	conn   *websocket.Conn
+	mutex  sync.Mutex
+	logger *slog.Logger
+}
+
+// send writes an event, errors are logged as the client may just have gone away
+func (c *wsConn) send(event wsEvent) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := c.conn.WriteJSON(event); err != nil {
+		c.logger.Debug("Failed to write WebSocket event", "type", event.Type, "error", err)
+	}
+}
+
+// handleWebSocket serves a bidirectional alternative to the streaming endpoint. Clients send
+// wsClientFrame frames and receive wsEvent frames: {"type":"connected"} first, then for every
+// turn started by a send, approve or reject frame the same events as the streaming endpoint,
+// messages wrapped as {"type":"message","message":{...}}, until its "done" or "error" event.
+// A frame that can't be handled is answered with an "error" event.
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{CheckOrigin: s.webSocketOriginAllowed}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already responded with an error
+		requestLog(r).Warn("WebSocket upgrade failed", "error", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(wsMaxFrameSize)
+
+	ws := &wsConn{conn: conn, logger: requestLog(r)}
+	ws.send(wsEvent{Type: "connected"})
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		var frame wsClientFrame
+		if err := conn.ReadJSON(&frame); err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				ws.send(wsEvent{Type: "error", Error: "invalid frame"})
+				continue
+			}
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				ws.logger.Debug("WebSocket closed", "error", err)
+			}
+			return
+		}
+		s.handleWebSocketFrame(r, ws, frame)
+	}
+}
+
+// handleWebSocketFrame handles a client frame. Turns run in their own goroutine so that the
+// connection keeps reading, e.g. a cancel frame for the turn.
+func (s *Server) handleWebSocketFrame(r *http.Request, ws *wsConn, frame wsClientFrame) {
+	conversationID := frame.ConversationID
+	if conversationID == "" {
+		conversationID = "default"
+	}
+	fail := func(err error) {
+		ws.send(wsEvent{Type: "error", ConversationID: conversationID, Error: err.Error()})
+	}
+
+	switch frame.Type {
+	case "send":
+		req := frame.SendMessageRequest
+		if err := s.validateSendMessageRequest(req); err != nil {
+			fail(err)
+			return
+		}
+		go func() {
+			_, err := s.chatEngine.SendUserMessageWithOptions(conversationID, req.Message, chat_engine.SendOptions{
+				Callback:       webSocketMessages(ws, conversationID),
+				OnDelta:        webSocketDeltas(ws, conversationID),
+				OnToolStart:    webSocketToolStarts(ws, conversationID),
+				Ephemeral:      req.Ephemeral,
+				SystemPrompt:   req.SystemPrompt,
+				RequestID:      middleware.GetReqID(r.Context()),
+				ResponseFormat: req.ResponseFormat,
+				Sampling:       req.sampling(),
+				DisableTools:   req.DisableTools,
+				AllowedTools:   req.AllowedTools,
+				Images:         req.Images,
+			})
+			ws.send(webSocketTurnEnd(conversationID, err))
+		}()
+	case "approve", "reject":
+		if frame.ToolCallID == "" {
+			fail(fmt.Errorf("tool_call_id is required"))
+			return
+		}
+		go func() {
+			_, err := s.chatEngine.DecideToolCall(conversationID, frame.ToolCallID, frame.Type == "approve", chat_engine.SendOptions{
+				Callback:    webSocketMessages(ws, conversationID),
+				OnDelta:     webSocketDeltas(ws, conversationID),
+				OnToolStart: webSocketToolStarts(ws, conversationID),
+				RequestID:   middleware.GetReqID(r.Context()),
+			})
+			ws.send(webSocketTurnEnd(conversationID, err))
+		}()
+	case "cancel":
+		// The canceled turn reports its end with a "done" event
+		if err := s.chatEngine.CancelTurn(conversationID, frame.KillProcesses); err != nil {
+			fail(err)
+		}
+	default:
+		fail(fmt.Errorf("unknown frame type %q, use send, cancel, approve or reject", frame.Type))
+	}
+}
+
+// webSocketMessages returns a callback sending the messages of a turn
+func webSocketMessages(ws *wsConn, conversationID string) chat_engine.MessageUpdateCallback {
+	return func(msg *chat_engine.Message) {
+		ws.send(wsEvent{Type: "message", ConversationID: conversationID, Message: msg})
+	}
+}
+
+// webSocketDeltas returns a callback sending assistant content while it is generated
+func webSocketDeltas(ws *wsConn, conversationID string) chat_engine.DeltaCallback {
+	return func(content string) {
+		ws.send(wsEvent{Type: "delta", ConversationID: conversationID, Content: content})
+	}
+}
+
+// webSocketToolStarts returns a callback announcing tool calls before they run
+func webSocketToolStarts(ws *wsConn, conversationID string) chat_engine.ToolStartCallback {
+	return func(toolCall chat_engine.ToolCall) {
+		ws.send(wsEvent{
+			Type:           "tool_start",
+			ConversationID: conversationID,
+			ToolCallID:     toolCall.ID,
+			Name:           toolCall.Name,
+			Arguments:      toolCall.Arguments,
+		})
+	}
+}
+
+// webSocketTurnEnd returns the event ending a turn that returned err
+func webSocketTurnEnd(conversationID string, err error) wsEvent {
+	event := wsEvent{Type: "done", ConversationID: conversationID}
+	var limitErr *chat_engine.IterationLimitError
+	var approvalErr *chat_engine.ApprovalRequiredError
+	switch {
+	case errors.As(err, &limitErr):
+		event.Partial = true
+		event.Reason = "iteration_limit"
+	case errors.As(err, &approvalErr):
+		event.AwaitingApproval = true
+		event.PendingToolCalls = approvalErr.ToolCalls
+	case errors.Is(err, chat_engine.ErrTurnCanceled):
+		event.Canceled = true
+	case err != nil:
+		event.Type = "error"
+		event.Error = err.Error()
+	}
+	return event
+}
+
+// webSocketOriginAllowed lets browsers connect from the server's own origin and the origins
+// allowed to make cross-origin requests. Clients that send no Origin aren't browsers.
+func (s *Server) webSocketOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return true
+	}
+	return slices.Contains(s.allowedOrigins, "*") || slices.Contains(s.allowedOrigins, origin)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evgeniy-scherbina/agent/chat_engine"
+	"github.com/gorilla/websocket"
+)
+
+// eventSummary describes an event by what both transports must agree on, leaving out IDs
+// and timestamps
+func eventSummary(event wsEvent) string {
+	switch event.Type {
+	case "message":
+		return "message " + event.Message.Role + " " + event.Message.Content
+	case "delta":
+		return "delta " + event.Content
+	case "tool_start":
+		return "tool_start " + event.Name + " " + event.Arguments
+	case "error":
+		return "error " + event.Error
+	default:
+		return event.Type
+	}
+}
+
+// streamEvents runs a turn through the streaming endpoint and returns its events
+func streamEvents(t *testing.T, baseURL, message string) []string {
+	t.Helper()
+	body, _ := json.Marshal(SendMessageRequest{Message: message})
+	resp, err := http.Post(baseURL+"/api/chat/stream", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("POST /api/chat/stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /api/chat/stream: status %d", resp.StatusCode)
+	}
+
+	var events []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		// Messages are sent as they are, other events carry a type
+		var event wsEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("invalid event %q: %v", data, err)
+		}
+		if event.Type == "" {
+			var msg chat_engine.Message
+			if err := json.Unmarshal([]byte(data), &msg); err != nil {
+				t.Fatalf("invalid message event %q: %v", data, err)
+			}
+			event = wsEvent{Type: "message", Message: &msg}
+		}
+		events = append(events, eventSummary(event))
+		if event.Type == "done" || event.Type == "error" {
+			break
+		}
+	}
+	return events
+}
+
+// webSocketEvents runs a turn over a WebSocket connection and returns its events
+func webSocketEvents(t *testing.T, baseURL, message string) []string {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(baseURL, "http")+"/api/ws", nil)
+	if err != nil {
+		t.Fatalf("dialing /api/ws: %v", err)
+	}
+	resp.Body.Close()
+	defer conn.Close()
+
+	frame := wsClientFrame{Type: "send", SendMessageRequest: SendMessageRequest{Message: message}}
+	if err := conn.WriteJSON(frame); err != nil {
+		t.Fatalf("sending frame: %v", err)
+	}
+
+	var events []string
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		var event wsEvent
+		if err := conn.ReadJSON(&event); err != nil {
+			t.Fatalf("reading event after %v: %v", events, err)
+		}
+		if event.Type != "connected" && event.ConversationID != "default" {
+			t.Errorf("event %s is for conversation %q, want default", event.Type, event.ConversationID)
+		}
+		events = append(events, eventSummary(event))
+		if event.Type == "done" || event.Type == "error" {
+			return events
+		}
+	}
+}
+
+func TestWebSocketEventsMatchStream(t *testing.T) {
+	sse := streamEvents(t, newTestServer(t, nil).URL, "say hi")
+	ws := webSocketEvents(t, newTestServer(t, nil).URL, "say hi")
+
+	want := []string{
+		"connected",
+		"message user say hi",
+		"message assistant ",
+		`tool_start bash_command {"command": "echo hi"}`,
+		"message tool Exit code: 0 (success)\n--- stdout ---\nhi\n",
+		"delta The ",
+		"delta command ",
+		"delta printed ",
+		"delta hi.",
+		"message assistant The command printed hi.",
+		"done",
+	}
+	if strings.Join(sse, "\n") != strings.Join(want, "\n") {
+		t.Errorf("stream events:\n%q\nwant:\n%q", sse, want)
+	}
+	if strings.Join(ws, "\n") != strings.Join(sse, "\n") {
+		t.Errorf("WebSocket events:\n%q\ndiffer from the stream's:\n%q", ws, sse)
+	}
+}
+
+func TestWebSocketRejectsInvalidFrames(t *testing.T) {
+	server := newTestServer(t, nil)
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/ws", nil)
+	if err != nil {
+		t.Fatalf("dialing /api/ws: %v", err)
+	}
+	resp.Body.Close()
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	var event wsEvent
+	if err := conn.ReadJSON(&event); err != nil || event.Type != "connected" {
+		t.Fatalf("first event = %+v, %v, want connected", event, err)
+	}
+	for _, frame := range []string{`not json`, `{"type":"shout"}`, `{"type":"approve"}`} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			t.Fatalf("sending frame: %v", err)
+		}
+		if err := conn.ReadJSON(&event); err != nil || event.Type != "error" {
+			t.Errorf("frame %s was answered with %+v, %v, want an error event", frame, event, err)
+		}
+	}
+}